@@ -1,54 +1,158 @@
+// Package agent implements the ssh-agent protocol for TPM keys, with the
+// @tpm-ssh-agent extensions and their client functions.
 package agent
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"net"
 	"os"
-	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
 
 	keyfile "github.com/foxboron/go-tpm-keyfiles"
 	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
 	"github.com/foxboron/ssh-tpm-agent/signer"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
 	"github.com/google/go-tpm/tpm2/transport"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
-var ErrOperationUnsupported = errors.New("operation unsupported")
+var (
+	ErrOperationUnsupported = errors.New("operation unsupported")
+	ErrInteractionRequired  = errors.New("request needs a prompt, which is disabled in batch mode")
+	ErrKeyNotValid          = errors.New("key is outside of its validity window")
+	ErrNotConfirmed         = errors.New("use of the key was not confirmed")
+	ErrSHA1Disabled         = errors.New("ssh-rsa signatures using SHA-1 are disabled")
+	ErrAlgorithmNotAllowed  = errors.New("signature algorithm is not allowed for the key")
+	ErrKeyNotAllowed        = errors.New("key type is not allowed by the policy")
+	ErrKeyNotFound          = errors.New("key not found")
+	ErrLocked               = errors.New("agent is locked")
+)
+
+// ExpiryWarning is how long before the end of its validity window a key is
+// reported as expiring.
+var ExpiryWarning = 7 * 24 * time.Hour
 
 var SSH_TPM_AGENT_ADD = "tpm-add-key"
 
+// DefaultRequestTimeout bounds how long a single request, including PIN
+// prompts and TPM commands, may take.
+var DefaultRequestTimeout = time.Minute
+
 type Agent struct {
-	mu       sync.Mutex
-	tpm      func() transport.TPMCloser
-	op       func() ([]byte, error)
-	pin      func(*key.SSHTPMKey) ([]byte, error)
-	listener *net.UnixListener
-	quit     chan interface{}
-	wg       sync.WaitGroup
-	keys     []*key.SSHTPMKey
-	agents   []agent.ExtendedAgent
+	mu      sync.Mutex
+	tpm     func() transport.TPMCloser
+	cache   *cachedTPM
+	queue   *tpmQueue
+	op      func() ([]byte, error)
+	pin     func(*key.SSHTPMKey) ([]byte, error)
+	confirm func(context.Context, *key.SSHTPMKey) (bool, error)
+	approve func(context.Context, *key.SSHTPMKey, []byte) ([]byte, error)
+	sockets []net.Listener
+	quit    chan interface{}
+	wg      sync.WaitGroup
+	timeout time.Duration
+	batch   bool
+	noSHA1  bool
+
+	// the keystore is read-only, see SetReadOnly
+	readOnly bool
+
+	// confirmations are remembered for confirmFor, per destination if
+	// confirmPerDestination is set
+	confirmFor            time.Duration
+	confirmPerDestination bool
+	// expiry of the remembered confirmations, by fingerprint and destination
+	confirmed map[string]map[string]time.Time
+
+	// the agent locks after no key was used for idleLock since lastUse, or
+	// with the session
+	idleLock time.Duration
+	lastUse  time.Time
+	locked   bool
+	unlock   func(context.Context) (bool, error)
+
+	// log the agent protocol messages of each connection
+	debugProto atomic.Bool
+	conns      atomic.Uint64
+	openConns  atomic.Int64
+	ctx        context.Context
+	cancel     context.CancelFunc
+	keys       []*key.SSHTPMKey
+
+	// registered providers, whose keys are served after the TPM keys
+	providers []Provider
+
+	// signers for keys, built on first use and reset when keys changes
+	keySigners []ssh.Signer
+
+	// fingerprints of the keys loaded from the keystore
+	stored map[string]bool
+
+	// records key usage, if set
+	metadata *keystore.Metadata
+
+	// centrally provisioned key policy, if set
+	policy *keystore.Policy
+
+	// constraints of the keys added through the agent protocol, by
+	// fingerprint
+	constraints map[string]*constraint
+
+	// uses of the keys since started, by fingerprint
+	stats   map[string]*keyStats
+	started time.Time
+
+	// asynchronous key creations by id
+	jobs map[string]*job
 }
 
 var _ agent.ExtendedAgent = &Agent{}
 
+// extensions maps the supported extension types to their handlers
+func (a *Agent) extensions() map[string]func([]byte) ([]byte, error) {
+	return map[string]func([]byte) ([]byte, error){
+		SSH_TPM_AGENT_ADD:          a.AddTPMKey,
+		SSH_TPM_AGENT_CREATE:       a.Create,
+		SSH_TPM_AGENT_CREATE_ASYNC: a.CreateAsync,
+		SSH_TPM_AGENT_JOB:          a.Job,
+		SSH_TPM_AGENT_IMPORT:       a.Import,
+		SSH_TPM_AGENT_LIST:         func([]byte) ([]byte, error) { return a.ListTPMKeys() },
+		SSH_TPM_AGENT_SEAL:         a.Seal,
+		SSH_TPM_AGENT_UNSEAL:       a.Unseal,
+		SSH_TPM_AGENT_DECRYPT:      a.Decrypt,
+		SSH_TPM_AGENT_ECDH:         a.ECDH,
+		SSH_TPM_AGENT_SIGN:         a.SignDigest,
+		SSH_TPM_AGENT_QUOTE:        a.Quote,
+		SSH_TPM_AGENT_POLICY:       func([]byte) ([]byte, error) { return a.Policy() },
+		SSH_TPM_AGENT_FORGET_PINS:  func([]byte) ([]byte, error) { return nil, a.ForgetPINs() },
+		SSH_TPM_AGENT_PING:         func([]byte) ([]byte, error) { return a.Ping() },
+		SSH_TPM_AGENT_CAPABILITIES: func([]byte) ([]byte, error) { return a.Capabilities() },
+		SSH_TPM_AGENT_STATS:        func([]byte) ([]byte, error) { return a.Stats() },
+	}
+}
+
 func (a *Agent) Extension(extensionType string, contents []byte) ([]byte, error) {
 	slog.Debug("called extensions")
-	switch extensionType {
-	case SSH_TPM_AGENT_ADD:
+	if f, ok := a.extensions()[extensionType]; ok {
+		if a.refused(extensionType) {
+			slog.Info("refusing to change the read-only keystore", slog.String("type", extensionType))
+			return nil, keystore.ErrReadOnly
+		}
 		slog.Debug("runnning extension", slog.String("type", extensionType))
-		return a.AddTPMKey(contents)
+		return f(contents)
 	}
 	return nil, agent.ErrExtensionUnsupported
 }
@@ -63,18 +167,30 @@ func (a *Agent) AddTPMKey(addedkey []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	k := &key.SSHTPMKey{
-		TPMKey:      addkey.PrivateKey,
-		Certificate: addkey.Certificate,
+	if addkey.PrivateKey == nil {
+		return nil, fmt.Errorf("no private key in request")
 	}
 
+	k := addkey.PrivateKey
+	if !k.HasSigner() {
+		return nil, fmt.Errorf("not a signing key")
+	}
+	c, err := newConstraint(addkey)
+	if err != nil {
+		return nil, err
+	}
+	k.Certificate = addkey.Certificate
+
 	// delete the key if it already exists in the list
 	// it may have been loaded with no certificate or an old certificate
 	a.keys = slices.DeleteFunc(a.keys, func(kk *key.SSHTPMKey) bool {
 		return kk.Fingerprint() == k.Fingerprint()
 	})
+	delete(a.stored, k.Fingerprint())
 
 	a.keys = append(a.keys, k)
+	a.keySigners = nil
+	a.constrain(k, c)
 
 	return []byte(""), nil
 }
@@ -88,30 +204,70 @@ func (a *Agent) Close() error {
 func (a *Agent) signers() ([]ssh.Signer, error) {
 	var signers []ssh.Signer
 
-	for _, agent := range a.agents {
-		l, err := agent.Signers()
+	for _, p := range a.providers {
+		s, ok := p.(interface{ Signers() ([]ssh.Signer, error) })
+		if !ok {
+			continue
+		}
+		l, err := s.Signers()
 		if err != nil {
-			slog.Info("failed getting Signers from agent", slog.String("error", err.Error()))
+			slog.Info("failed getting Signers from provider", slog.String("error", err.Error()))
 			continue
 		}
 		signers = append(signers, l...)
 	}
 
+	keySigners, err := a.tpmSigners()
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range a.keys {
+		if a.validity(k) != nil {
+			continue
+		}
+		signers = append(signers, keySigners[i])
+	}
+	return signers, nil
+}
+
+// tpmSigners returns the signers for the loaded keys, in the same order.
+func (a *Agent) tpmSigners() ([]ssh.Signer, error) {
+	if a.keySigners != nil {
+		return a.keySigners, nil
+	}
+	signers := []ssh.Signer{}
 	for _, k := range a.keys {
+		k.Approve = a.approver(k)
 		s, err := ssh.NewSignerFromSigner(
-			signer.NewSSHKeySigner(k, a.op, a.tpm,
+			signer.NewSSHKeySigner(k, a.op, a.TPM(),
 				func(_ *keyfile.TPMKey) ([]byte, error) {
 					// Shimming the function to get the correct type
-					return a.pin(k)
+					return a.askPin(k)
 				}))
 		if err != nil {
 			return nil, fmt.Errorf("failed to prepare signer: %w", err)
 		}
 		signers = append(signers, s)
 	}
+	a.keySigners = signers
 	return signers, nil
 }
 
+// authSigner returns a signer of k which signs with the owner password and
+// userauth given, so they are asked for before the signature is queued for the
+// TPM and prompts don't hold up the other requests.
+func (a *Agent) authSigner(k *key.SSHTPMKey, ownerauth, auth []byte) (ssh.AlgorithmSigner, error) {
+	s, err := ssh.NewSignerFromSigner(
+		signer.NewSSHKeySigner(k,
+			func() ([]byte, error) { return ownerauth, nil },
+			a.TPM(),
+			func(_ *keyfile.TPMKey) ([]byte, error) { return bytes.Clone(auth), nil }))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare signer: %w", err)
+	}
+	return s.(ssh.AlgorithmSigner), nil
+}
+
 func (a *Agent) Signers() ([]ssh.Signer, error) {
 	slog.Debug("called signers")
 	a.mu.Lock()
@@ -123,35 +279,61 @@ func (a *Agent) List() ([]*agent.Key, error) {
 	slog.Debug("called list")
 	var agentKeys []*agent.Key
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	for _, agent := range a.agents {
-		l, err := agent.List()
+	// keys are only listed from the first provider having them, which is the
+	// one signing with them
+	seen := map[string]bool{}
+	for _, p := range a.allProviders(0, "") {
+		l, err := p.List()
 		if err != nil {
-			slog.Info("failed getting list from agent", slog.String("error", err.Error()))
+			if _, ok := p.(*tpmProvider); ok {
+				return nil, err
+			}
+			slog.Info("failed getting list from provider", slog.String("error", err.Error()))
 			continue
 		}
-		agentKeys = append(agentKeys, l...)
+		for _, k := range l {
+			if seen[string(k.Blob)] {
+				slog.Debug("not listing duplicate key", slog.String("key", ssh.FingerprintSHA256(k)))
+				continue
+			}
+			seen[string(k.Blob)] = true
+			agentKeys = append(agentKeys, k)
+		}
 	}
+	return agentKeys, nil
+}
 
-	for _, k := range a.keys {
-		pk, err := k.SSHPublicKey()
-		if err != nil {
-			return nil, err
+// listTPM lists the TPM keys which can be used
+func (a *Agent) listTPM() ([]*agent.Key, error) {
+	var agentKeys []*agent.Key
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	keySigners, err := a.tpmSigners()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, k := range a.keys {
+		if err := a.validity(k); err != nil {
+			slog.Debug("not listing key", slog.String("key", k.Fingerprint()), slog.String("error", err.Error()))
+			continue
 		}
+		pk := keySigners[i].PublicKey()
 
+		comment := a.comment(k)
 		agentKeys = append(agentKeys, &agent.Key{
 			Format:  pk.Type(),
 			Blob:    pk.Marshal(),
-			Comment: k.Description,
+			Comment: comment,
 		})
 
 		if k.Certificate != nil {
 			agentKeys = append(agentKeys, &agent.Key{
 				Format:  k.Certificate.Type(),
 				Blob:    k.Certificate.Marshal(),
-				Comment: k.Description,
+				Comment: comment,
 			})
 		}
 	}
@@ -160,45 +342,148 @@ func (a *Agent) List() ([]*agent.Key, error) {
 }
 
 func (a *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return a.signWithFlags(0, "", key, data, flags)
+}
+
+// signWithFlags signs for the connection client, which the TPM is scheduled
+// fairly between. destination is the host key fingerprint the signature is
+// for, or empty if it isn't known.
+func (a *Agent) signWithFlags(client uint64, destination string, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
 	slog.Debug("called signwithflags")
+	providers := a.allProviders(client, destination)
+	sig, err := providers[0].SignWithFlags(key, data, flags)
+	if !errors.Is(err, ErrKeyNotFound) {
+		return sig, err
+	}
+
+	slog.Debug("trying to sign with the providers...")
+	for _, p := range providers[1:] {
+		keys, err := p.List()
+		if err != nil {
+			slog.Info("failed getting list from provider", slog.String("error", err.Error()))
+			continue
+		}
+		for _, k := range keys {
+			if !bytes.Equal(k.Marshal(), key.Marshal()) {
+				continue
+			}
+			ctx, cancel := a.requestContext()
+			err := a.wake(ctx, nil)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+			sig, err := p.SignWithFlags(key, data, flags)
+			if err == nil {
+				a.mu.Lock()
+				a.touch()
+				a.mu.Unlock()
+			}
+			return sig, err
+		}
+	}
+
+	return nil, fmt.Errorf("no private keys match the requested public key")
+}
+
+// signTPM signs with the TPM key matching key for the connection client
+func (a *Agent) signTPM(client uint64, destination string, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
 	a.mu.Lock()
-	defer a.mu.Unlock()
-	signers, err := a.signers()
+	keys := slices.Clone(a.keys)
+	keySigners, err := a.tpmSigners()
+	m := a.metadata
+	p := a.policy
+	a.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
 
-	alg := key.Type()
-	switch {
-	case alg == ssh.KeyAlgoRSA && flags&agent.SignatureFlagRsaSha256 != 0:
-		alg = ssh.KeyAlgoRSASHA256
-	case alg == ssh.KeyAlgoRSA && flags&agent.SignatureFlagRsaSha512 != 0:
-		alg = ssh.KeyAlgoRSASHA512
+	alg, err := a.signatureAlgorithm(key, flags)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, s := range signers {
-		if !bytes.Equal(s.PublicKey().Marshal(), key.Marshal()) {
-			continue
-		}
-		return s.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, alg)
+	// certificates are signed with the key they certify
+	pk := key
+	if cert, ok := key.(*ssh.Certificate); ok {
+		pk = cert.Key
 	}
 
-	slog.Debug("trying to sign as proxy...")
-	for _, agent := range a.agents {
-		signers, err := agent.Signers()
-		if err != nil {
-			slog.Info("failed getting signers from agent", slog.String("error", err.Error()))
+	for i, s := range keySigners {
+		if !bytes.Equal(s.PublicKey().Marshal(), pk.Marshal()) {
 			continue
 		}
-		for _, s := range signers {
-			if !bytes.Equal(s.PublicKey().Marshal(), key.Marshal()) {
-				continue
-			}
-			return s.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, alg)
+		if err := checkValidity(m, keys[i], time.Now()); err != nil {
+			return nil, err
+		}
+		if err := checkPolicy(p, keys[i]); err != nil {
+			return nil, err
+		}
+		if err := checkAlgorithm(m, keys[i], alg); err != nil {
+			return nil, err
+		}
+		ctx, cancel := a.requestContext()
+		defer cancel()
+		ctx = withClient(ctx, client)
+		if err := a.confirmUse(ctx, keys[i], destination); err != nil {
+			return nil, err
+		}
+		auth, ownerauth, err := a.keyAuth(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		defer clear(auth)
+		as, err := a.authSigner(keys[i], ownerauth, auth)
+		if err != nil {
+			return nil, err
+		}
+		var sig *ssh.Signature
+		err = a.queue.do(ctx, func() (err error) {
+			sig, err = as.SignWithAlgorithm(rand.Reader, data, alg)
+			return err
+		})
+		a.recordStats(keys[i], true, err)
+		if err == nil {
+			a.recordUse(keys[i])
+		} else {
+			logUnrecoverable(keys[i], err)
 		}
+		return sig, err
 	}
+	return nil, ErrKeyNotFound
+}
 
-	return nil, fmt.Errorf("no private keys match the requested public key")
+// signatureAlgorithm returns the signature algorithm for key requested by
+// flags. RSA keys sign with SHA-1 unless one of the rsa-sha2 flags is given.
+func (a *Agent) signatureAlgorithm(key ssh.PublicKey, flags agent.SignatureFlags) (string, error) {
+	alg := key.Type()
+	if cert, ok := key.(*ssh.Certificate); ok {
+		alg = cert.Key.Type()
+	}
+	if alg != ssh.KeyAlgoRSA {
+		return alg, nil
+	}
+	switch {
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		return ssh.KeyAlgoRSASHA256, nil
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		return ssh.KeyAlgoRSASHA512, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.noSHA1 {
+		slog.Info("refusing ssh-rsa signature", slog.String("key", ssh.FingerprintSHA256(key)))
+		return "", ErrSHA1Disabled
+	}
+	return alg, nil
+}
+
+// SetNoSHA1 makes the agent refuse ssh-rsa signatures, which use SHA-1. RSA
+// keys can still sign with rsa-sha2-256 and rsa-sha2-512.
+func (a *Agent) SetNoSHA1(noSHA1 bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.noSHA1 = noSHA1
 }
 
 func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
@@ -207,7 +492,16 @@ func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 }
 
 func (a *Agent) serveConn(c net.Conn) {
-	if err := agent.ServeAgent(a, c); err != io.EOF {
+	id := a.conns.Add(1)
+	defer a.queue.forget(id)
+	a.openConns.Add(1)
+	defer a.openConns.Add(-1)
+	if a.debugProto.Load() {
+		c = &traceConn{Conn: c, id: id}
+		slog.Info("agent connection opened", slog.Uint64("conn", c.(*traceConn).id))
+		defer slog.Info("agent connection closed", slog.Uint64("conn", c.(*traceConn).id))
+	}
+	if err := agent.ServeAgent(newSession(a, id), c); err != io.EOF {
 		slog.Info("Agent client connection ended unsuccessfully", slog.String("error", err.Error()))
 	}
 }
@@ -218,14 +512,211 @@ func (a *Agent) Wait() {
 
 func (a *Agent) Stop() {
 	close(a.quit)
-	a.listener.Close()
+	a.cancel()
+	for _, l := range a.sockets {
+		l.Close()
+	}
 	a.wg.Wait()
+	a.queue.stop()
+	a.cache.release()
+}
+
+// SetMetadata makes the agent record the use of keys in m and show it in the
+// key comments.
+func (a *Agent) SetMetadata(m *keystore.Metadata) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.metadata = m
+}
+
+// recordUse counts a successful use of k
+func (a *Agent) recordUse(k *key.SSHTPMKey) {
+	a.mu.Lock()
+	m := a.metadata
+	a.mu.Unlock()
+	if m == nil {
+		return
+	}
+	if err := m.RecordUse(k.Fingerprint(), time.Now()); err != nil {
+		slog.Info("failed recording key use", slog.String("error", err.Error()))
+	}
+}
+
+// logUnrecoverable explains errors of keys the TPM can't load anymore, and of
+// keys bound to PCRs which changed
+func logUnrecoverable(k *key.SSHTPMKey, err error) {
+	switch {
+	case errors.Is(err, key.ErrWrongTPM):
+		slog.Error("key can't be loaded, the TPM was cleared or replaced since it was created and the key is unrecoverable. Remove dead keys with ssh-tpm-agent prune",
+			slog.String("key", k.Fingerprint()),
+			slog.String("comment", k.Description))
+	case errors.Is(err, key.ErrPCRMismatch):
+		pcrs := k.BoundPCRs()
+		msg := "key is bound to PCR values which changed since it was created"
+		if slices.Contains(pcrs, 7) {
+			msg = "key is bound to the Secure Boot state in PCR 7, which changed since it was created: Secure Boot was turned on or off, or its key databases were updated. Revert the change or create a new key"
+		}
+		slog.Error(msg,
+			slog.String("key", k.Fingerprint()),
+			slog.String("comment", k.Description),
+			slog.Any("pcrs", pcrs))
+	}
+}
+
+// comment returns the comment of k for listing, with its usage if known
+func (a *Agent) comment(k *key.SSHTPMKey) string {
+	if a.metadata == nil {
+		return k.Description
+	}
+	km := a.metadata.Get(k.Fingerprint())
+	comment := fmt.Sprintf("%s (never used)", k.Description)
+	if km.Uses != 0 {
+		comment = fmt.Sprintf("%s (used %d times, last %s)", k.Description, km.Uses, km.LastUsed.Local().Format(time.DateTime))
+	}
+	if km.NotAfter != nil && time.Until(*km.NotAfter) < ExpiryWarning {
+		comment += fmt.Sprintf(" (expires %s)", km.NotAfter.Local().Format(time.DateTime))
+	}
+	return comment
+}
+
+// validity checks k against its validity window and the policy. a.mu must
+// be held.
+func (a *Agent) validity(k *key.SSHTPMKey) error {
+	if err := checkValidity(a.metadata, k, time.Now()); err != nil {
+		return err
+	}
+	return checkPolicy(a.policy, k)
+}
+
+// checkValidity returns ErrKeyNotValid if k is outside of its validity window
+// in m at t, and warns if it is about to expire.
+func checkValidity(m *keystore.Metadata, k *key.SSHTPMKey, t time.Time) error {
+	if m == nil {
+		return nil
+	}
+	km := m.Get(k.Fingerprint())
+	if !km.Valid(t) {
+		return fmt.Errorf("%s: %w", k.Fingerprint(), ErrKeyNotValid)
+	}
+	if km.NotAfter != nil && km.NotAfter.Sub(t) < ExpiryWarning {
+		slog.Warn("key expires soon", slog.String("key", k.Fingerprint()), slog.Time("not_after", *km.NotAfter))
+	}
+	return nil
+}
+
+// checkAlgorithm returns ErrAlgorithmNotAllowed if k is restricted to other
+// signature algorithms than alg in m
+func checkAlgorithm(m *keystore.Metadata, k *key.SSHTPMKey, alg string) error {
+	if m == nil {
+		return nil
+	}
+	if km := m.Get(k.Fingerprint()); !km.AllowsAlgorithm(alg) {
+		slog.Info("refusing signature algorithm for key", slog.String("key", k.Fingerprint()), slog.String("algorithm", alg), slog.Any("algorithms", km.Algorithms))
+		return fmt.Errorf("%s: %s: %w", k.Fingerprint(), alg, ErrAlgorithmNotAllowed)
+	}
+	return nil
 }
 
-func (a *Agent) serve() {
+// SetApprover sets the external approver asked to sign the challenge of keys
+// created with key.CreateOptions.Approver on each use.
+func (a *Agent) SetApprover(f func(ctx context.Context, k *key.SSHTPMKey, challenge []byte) ([]byte, error)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.approve = f
+}
+
+// approver returns the key.SSHTPMKey.Approve function of k
+func (a *Agent) approver(k *key.SSHTPMKey) func([]byte) ([]byte, error) {
+	return func(challenge []byte) ([]byte, error) {
+		a.mu.Lock()
+		approve := a.approve
+		a.mu.Unlock()
+		if approve == nil {
+			return nil, key.ErrNoApprover
+		}
+		ctx, cancel := a.requestContext()
+		defer cancel()
+		return approve(ctx, k, challenge)
+	}
+}
+
+// SetDebugProto enables logging of the decoded agent protocol messages
+func (a *Agent) SetDebugProto(debug bool) {
+	a.debugProto.Store(debug)
+}
+
+// SetBatch makes requests that need to prompt for a PIN or a confirmation
+// fail with ErrInteractionRequired instead. Cached PINs are still used.
+func (a *Agent) SetBatch(batch bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.batch = batch
+}
+
+func (a *Agent) isBatch() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.batch
+}
+
+// askPin returns the userauth of k from the PIN callback
+func (a *Agent) askPin(k *key.SSHTPMKey) ([]byte, error) {
+	if a.isBatch() {
+		if auth := k.CachedUserauth(); len(auth) != 0 {
+			return auth, nil
+		}
+		slog.Info("refusing to prompt for PIN in batch mode", slog.String("desc", k.Description))
+		return nil, ErrInteractionRequired
+	}
+	return a.pin(k)
+}
+
+// askConfirm asks the user to confirm the use of k
+func (a *Agent) askConfirm(ctx context.Context, k *key.SSHTPMKey) (bool, error) {
+	if a.isBatch() {
+		slog.Info("refusing to ask for confirmation in batch mode", slog.String("desc", k.Description))
+		return false, ErrInteractionRequired
+	}
+	return a.confirm(ctx, k)
+}
+
+// SetRequestTimeout sets the deadline of a single request. Requests waiting
+// on the TPM or a prompt for longer fail. A zero timeout disables it.
+func (a *Agent) SetRequestTimeout(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.timeout = d
+}
+
+// requestContext returns the context of a request, which is done when the
+// request timeout passes or the agent is stopped.
+func (a *Agent) requestContext() (context.Context, context.CancelFunc) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.timeout == 0 {
+		return context.WithCancel(a.ctx)
+	}
+	return context.WithTimeout(a.ctx, a.timeout)
+}
+
+// SetTPMIdleTimeout sets how long the TPM transport is kept open after the
+// last command. The agent closes the transport after the timeout and when
+// stopped. A zero timeout, the default, keeps it open until the agent is
+// stopped. Transports of a tpmconn.Static opener are left to their owner.
+func (a *Agent) SetTPMIdleTimeout(d time.Duration) {
+	a.cache.setTimeout(d)
+}
+
+// TPM returns an Opener for the transport of the agent, for keystores which
+// use the TPM. Closing what it returns leaves the transport open.
+func (a *Agent) TPM() tpmconn.Opener {
+	return tpmconn.Static(a.tpm())
+}
+
+func (a *Agent) serve(l net.Listener) {
 	defer a.wg.Done()
 	for {
-		c, err := a.listener.AcceptUnix()
+		c, err := l.Accept()
 		if err != nil {
 			type temporary interface {
 				Temporary() bool
@@ -243,6 +734,11 @@ func (a *Agent) serve() {
 				slog.Error("Failed to accept connections", slog.String("error", err.Error()))
 			}
 		}
+		if err := checkPeer(l, c); err != nil {
+			slog.Info("rejecting connection", slog.String("error", err.Error()))
+			c.Close()
+			continue
+		}
 		a.wg.Add(1)
 		go func() {
 			a.serveConn(c)
@@ -251,9 +747,34 @@ func (a *Agent) serve() {
 	}
 }
 
+// IsAbstractSocket reports if path names a socket in the abstract namespace
+// of Linux, which starts with @
+func IsAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// checkPeer only lets the user of the agent connect to abstract sockets,
+// which have no file permissions. Sockets in the file system are protected
+// by the permissions of their directory.
+func checkPeer(l net.Listener, c net.Conn) error {
+	uc, ok := c.(*net.UnixConn)
+	if !ok || !IsAbstractSocket(l.Addr().String()) {
+		return nil
+	}
+	uid, err := peerUID(uc)
+	if err != nil {
+		return err
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("connection from uid %d to the abstract socket", uid)
+	}
+	return nil
+}
+
 func (a *Agent) AddKey(k *key.SSHTPMKey) error {
 	slog.Debug("called addkey")
 	a.keys = append(a.keys, k)
+	a.keySigners = nil
 	return nil
 }
 
@@ -267,15 +788,71 @@ func (a *Agent) LoadKeys(keyDir string) error {
 	}
 
 	a.keys = keys
+	a.keySigners = nil
+	return nil
+}
+
+// LoadKeystore replaces the keys previously loaded from a keystore with the
+// keys from ks. Keys added through the agent protocol are kept.
+func (a *Agent) LoadKeystore(ks keystore.Keystore) error {
+	slog.Debug("called loadkeystore")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys, err := ks.Keys()
+	if err != nil {
+		return err
+	}
+
+	// added keys take precedence as they might carry a certificate
+	a.keys = slices.DeleteFunc(a.keys, func(k *key.SSHTPMKey) bool {
+		return a.stored[k.Fingerprint()]
+	})
+	added := map[string]bool{}
+	for _, k := range a.keys {
+		added[k.Fingerprint()] = true
+	}
+
+	for fp := range a.stored {
+		if !added[fp] {
+			a.unconstrain(fp)
+		}
+	}
+	a.stored = map[string]bool{}
+	for _, k := range keys {
+		if added[k.Fingerprint()] {
+			continue
+		}
+		a.stored[k.Fingerprint()] = true
+		a.keys = append(a.keys, k)
+		if host := k.DerivedHost(); host != "" {
+			a.constrain(k, derivedConstraint(host))
+		}
+	}
+	a.keySigners = nil
 	return nil
 }
 
+// WatchKeystore reloads the keys from ks when they change, until the agent is
+// stopped.
+func (a *Agent) WatchKeystore(ks keystore.Keystore) error {
+	w, ok := ks.(keystore.Watcher)
+	if !ok {
+		return fmt.Errorf("keystore %T can't be watched", ks)
+	}
+	return w.Watch(a.quit, func() {
+		slog.Info("keystore changed, reloading keys")
+		if err := a.LoadKeystore(ks); err != nil {
+			slog.Error("reloading keys", slog.String("error", err.Error()))
+		}
+	})
+}
+
 func (a *Agent) Add(key agent.AddedKey) error {
-	// This just proxies the Add call to all proxied agents
+	// This just proxies the Add call to the providers
 	// First to accept gets the key!
 	slog.Debug("called add")
-	for _, agent := range a.agents {
-		if err := agent.Add(key); err == nil {
+	for _, p := range a.allProviders(0, "") {
+		if err := p.Add(key); err == nil {
 			return nil
 		}
 	}
@@ -284,23 +861,17 @@ func (a *Agent) Add(key agent.AddedKey) error {
 
 func (a *Agent) Remove(sshkey ssh.PublicKey) error {
 	slog.Debug("called remove")
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
 	fp := ssh.FingerprintSHA256(sshkey)
 
-	a.keys = slices.DeleteFunc(a.keys, func(k *key.SSHTPMKey) bool {
-		if k.Fingerprint() == ssh.FingerprintSHA256(sshkey) {
-			slog.Debug("deleting key from ssh-tpm-agent", slog.String("fingerprint", fp))
-			return true
-		}
-		return false
-	})
+	// TPM keys are also removed when a provider has the same key
+	providers := a.allProviders(0, "")
+	err := providers[0].Remove(sshkey)
+	removed := err == nil
 
-	for _, agent := range a.agents {
-		lkeys, err := agent.List()
+	for _, p := range providers[1:] {
+		lkeys, err := p.List()
 		if err != nil {
-			slog.Debug("agent returned err on List()", slog.Any("err", err))
+			slog.Debug("provider returned err on List()", slog.Any("err", err))
 			continue
 		}
 
@@ -308,26 +879,75 @@ func (a *Agent) Remove(sshkey ssh.PublicKey) error {
 			if !bytes.Equal(k.Marshal(), sshkey.Marshal()) {
 				continue
 			}
-			if err := agent.Remove(sshkey); err != nil {
-				slog.Debug("agent returned err on Remove()", slog.Any("err", err))
+			if err := p.Remove(sshkey); err != nil {
+				slog.Debug("provider returned err on Remove()", slog.Any("err", err))
 			}
-			slog.Debug("deleting key from an proxy agent", slog.String("fingerprint", fp))
+			slog.Debug("deleting key from a provider", slog.String("fingerprint", fp))
 			return nil
 		}
 	}
-	slog.Debug("could not find key in any proxied agent", slog.String("fingerprint", fp))
+	if removed {
+		return nil
+	}
+	if errors.Is(err, keystore.ErrReadOnly) {
+		slog.Info("keeping the key of the read-only keystore", slog.String("fingerprint", fp))
+		return err
+	}
+	slog.Debug("could not find key in any provider", slog.String("fingerprint", fp))
 	return fmt.Errorf("key not found")
 }
 
-func (a *Agent) RemoveAll() error {
-	slog.Debug("called removeall")
+// removeTPM removes the TPM key matching sshkey
+func (a *Agent) removeTPM(sshkey ssh.PublicKey) error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	a.keys = []*key.SSHTPMKey{}
+	fp := ssh.FingerprintSHA256(sshkey)
+	if a.readOnly && a.stored[fp] {
+		return keystore.ErrReadOnly
+	}
+	n := len(a.keys)
+	a.keys = slices.DeleteFunc(a.keys, func(k *key.SSHTPMKey) bool {
+		if k.Fingerprint() == fp {
+			slog.Debug("deleting key from ssh-tpm-agent", slog.String("fingerprint", fp))
+			return true
+		}
+		return false
+	})
+	a.keySigners = nil
+	a.unconstrain(fp)
+	if len(a.keys) == n {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+func (a *Agent) RemoveAll() error {
+	slog.Debug("called removeall")
+	a.mu.Lock()
+	if a.readOnly {
+		slog.Info("keeping the keys of the read-only keystore")
+		a.keys = slices.DeleteFunc(a.keys, func(k *key.SSHTPMKey) bool {
+			return !a.stored[k.Fingerprint()]
+		})
+	} else {
+		a.keys = []*key.SSHTPMKey{}
+	}
+	a.keySigners = nil
+	for fp := range a.constraints {
+		if !a.readOnly || !a.stored[fp] {
+			a.unconstrain(fp)
+		}
+	}
+	a.confirmed = nil
+	a.mu.Unlock()
 
-	for _, agent := range a.agents {
-		if err := agent.RemoveAll(); err == nil {
+	for _, p := range a.allProviders(0, "")[1:] {
+		r, ok := p.(interface{ RemoveAll() error })
+		if !ok {
+			continue
+		}
+		if err := r.RemoveAll(); err == nil {
 			return nil
 		}
 	}
@@ -345,65 +965,49 @@ func (a *Agent) Unlock(passphrase []byte) error {
 }
 
 func LoadKeys(keyDir string) ([]*key.SSHTPMKey, error) {
-	keyDir, err := filepath.EvalSymlinks(keyDir)
-	if err != nil {
-		return nil, err
-	}
-
-	var keys []*key.SSHTPMKey
-
-	walkFunc := func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if d.IsDir() {
-			return nil
-		}
-
-		if !strings.HasSuffix(path, ".tpm") {
-			slog.Debug("skipping key: does not have .tpm suffix", slog.String("name", path))
-			return nil
-		}
-
-		f, err := os.ReadFile(path)
-		if err != nil {
-			return fmt.Errorf("failed reading %s", path)
-		}
-
-		k, err := key.Decode(f)
-		if err != nil {
-			if errors.Is(err, key.ErrOldKey) {
-				slog.Info("TPM key is in an old format. Will not load it.", slog.String("key_path", path), slog.String("error", err.Error()))
-
-			} else {
-				slog.Debug("not a TPM sealed key", slog.String("key_path", path), slog.String("error", err.Error()))
-			}
-			return nil
-		}
-
-		keys = append(keys, k)
-
-		slog.Debug("added TPM key", slog.String("name", path))
-		return nil
-	}
+	return keystore.NewDirs(keyDir, "").Keys()
+}
 
-	err = filepath.WalkDir(keyDir, walkFunc)
-	return keys, err
+// NewAgent makes an agent serving listener, see New
+func NewAgent(listener *net.UnixListener, agents []agent.ExtendedAgent, tpmFetch tpmconn.Opener, ownerPassword func() ([]byte, error), pin func(*key.SSHTPMKey) ([]byte, error)) *Agent {
+	return newAgent(&options{
+		listeners:      []net.Listener{listener},
+		providers:      fallbackProviders(agents),
+		tpm:            tpmFetch,
+		ownerPassword:  ownerPassword,
+		prompter:       pinPrompter(pin),
+		requestTimeout: DefaultRequestTimeout,
+	})
 }
 
-func NewAgent(listener *net.UnixListener, agents []agent.ExtendedAgent, tpmFetch func() transport.TPMCloser, ownerPassword func() ([]byte, error), pin func(*key.SSHTPMKey) ([]byte, error)) *Agent {
+func newAgent(o *options) *Agent {
+	cache := &cachedTPM{open: o.tpm, timeout: o.tpmIdleTimeout}
+	ctx, cancel := context.WithCancel(context.Background())
 	a := &Agent{
-		agents:   agents,
-		tpm:      tpmFetch,
-		op:       ownerPassword,
-		listener: listener,
-		pin:      pin,
-		quit:     make(chan interface{}),
-		keys:     []*key.SSHTPMKey{},
+		providers: o.providers,
+		tpm:       func() transport.TPMCloser { return cache },
+		cache:     cache,
+		queue:     newTPMQueue(cache),
+		op:        o.ownerPassword,
+		sockets:   o.listeners,
+		confirm:   o.prompter.Confirm,
+		quit:      make(chan interface{}),
+		keys:      []*key.SSHTPMKey{},
+		timeout:   o.requestTimeout,
+		ctx:       ctx,
+		cancel:    cancel,
+		started:   time.Now(),
+		unlock:    askUnlock,
+	}
+	a.pin = func(k *key.SSHTPMKey) ([]byte, error) {
+		ctx, cancel := a.requestContext()
+		defer cancel()
+		return o.prompter.PIN(ctx, k)
 	}
 
-	a.wg.Add(1)
-	go a.serve()
+	for _, l := range a.sockets {
+		a.wg.Add(1)
+		go a.serve(l)
+	}
 	return a
 }
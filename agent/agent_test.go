@@ -1,15 +1,33 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
 	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
 	"github.com/google/go-tpm/tpm2"
-	"github.com/google/go-tpm/tpm2/transport"
 	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
@@ -31,7 +49,7 @@ func TestAddKey(t *testing.T) {
 	ag := NewAgent(unixList,
 		[]agent.ExtendedAgent{},
 		// TPM Callback
-		func() transport.TPMCloser { return tpm },
+		tpmconn.Static(tpm),
 		// Owner password
 		func() ([]byte, error) { return []byte(""), nil },
 		// PIN Callback
@@ -58,8 +76,2068 @@ func TestAddKey(t *testing.T) {
 		Comment:     k.Description,
 	}
 
-	_, err = client.Extension(SSH_TPM_AGENT_ADD, MarshalTPMKeyMsg(&addedkey))
+	req, err := MarshalTPMKeyMsg(&addedkey)
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, err = client.Extension(SSH_TPM_AGENT_ADD, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealSecret(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		log.Fatalln("Failed to listen on UNIX socket:", err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		// TPM Callback
+		tpmconn.Static(tpm),
+		// Owner password
+		func() ([]byte, error) { return []byte(""), nil },
+		// PIN Callback
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	var confirmed bool
+	ag.confirm = func(_ context.Context, _ *key.SSHTPMKey) (bool, error) { return confirmed, nil }
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := agent.NewClient(conn)
+
+	secret := []byte("hunter2")
+
+	for _, c := range []struct {
+		name string
+		msg  SealMsg
+	}{
+		{"plain", SealMsg{Secret: secret}},
+		{"pcr", SealMsg{Secret: secret, PCRMask: 1<<0 | 1<<7}},
+		{"confirm", SealMsg{Secret: secret, Confirm: true}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			confirmed = true
+			sealed, err := SealSecret(client, &c.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := UnsealSecret(client, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, secret) {
+				t.Fatalf("unsealed %q, expected %q", b, secret)
+			}
+
+			confirmed = false
+			_, err = UnsealSecret(client, sealed)
+			if c.msg.Confirm && err == nil {
+				t.Fatal("unsealed without confirmation")
+			} else if !c.msg.Confirm && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("pcr changed", func(t *testing.T) {
+		sealed, err := SealSecret(client, &SealMsg{Secret: secret, PCRMask: 1 << 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tpm2.PCRExtend{
+			PCRHandle: tpm2.AuthHandle{
+				Handle: tpm2.TPMHandle(16),
+				Auth:   tpm2.PasswordAuth(nil),
+			},
+			Digests: tpm2.TPMLDigestValues{
+				Digests: []tpm2.TPMTHA{
+					{HashAlg: tpm2.TPMAlgSHA256, Digest: make([]byte, 32)},
+				},
+			},
+		}.Execute(tpm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := UnsealSecret(client, sealed); err == nil {
+			t.Fatal("unsealed with a changed pcr")
+		}
+	})
+}
+
+func TestDecrypt(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		log.Fatalln("Failed to listen on UNIX socket:", err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		// TPM Callback
+		tpmconn.Static(tpm),
+		// Owner password
+		func() ([]byte, error) { return []byte(""), nil },
+		// PIN Callback
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte("123"), nil },
+	)
+	defer ag.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := agent.NewClient(conn)
+
+	k, err := key.NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgRSA, 2048, []byte(""), &key.CreateOptions{Userauth: []byte("123")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+
+	pk, err := k.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshpk, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		hash crypto.Hash
+	}{
+		{"sha256", crypto.SHA256},
+		{"sha1", crypto.SHA1},
+		{"sha512", crypto.SHA512},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			msg := []byte("secret message")
+			ciphertext, err := rsa.EncryptOAEP(c.hash.New(), rand.Reader, pk.(*rsa.PublicKey), msg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := DecryptWithKey(client, sshpk, ciphertext, c.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, msg) {
+				t.Fatalf("decrypted %q, expected %q", b, msg)
+			}
+		})
+	}
+}
+
+func TestSignerCache(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+
+	signers, err := ag.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ag.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 || len(again) != 1 || signers[0] != again[0] {
+		t.Fatalf("expected the signer to be reused")
+	}
+
+	if err := ag.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected removed key to be gone, got %d keys", len(keys))
+	}
+}
+
+func TestPing(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := PingAgent(agent.NewClient(conn)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	nonce := []byte("nonce")
+	q, err := QuotePCRs(agent.NewClient(conn), 1<<0|1<<7, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := q.Verify(&key.VerifyOptions{Nonce: nonce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := result.PCRs[7]; !ok || len(result.PCRs) != 2 {
+		t.Fatalf("wrong pcrs quoted: %v", result.PCRs)
+	}
+}
+
+func TestManageKeys(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := agent.NewClient(conn)
+
+	created, err := CreateKey(client, &CreateMsg{Algorithm: "ecdsa", Comment: "created"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Description != "created" {
+		t.Fatalf("wrong comment %q", created.Description)
+	}
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportKey(client, &ImportMsg{PrivateKey: der, Comment: "imported"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshpk, err := ssh.NewPublicKey(&pk.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Fingerprint() != ssh.FingerprintSHA256(sshpk) {
+		t.Fatalf("imported key doesn't match the private key")
+	}
+
+	keys, err := ListKeys(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("created keys shouldn't be added, got %d keys", len(keys))
+	}
+
+	for _, k := range []*key.SSHTPMKey{created, imported} {
+		req, err := MarshalTPMKeyMsg(&agent.AddedKey{
+			PrivateKey:       k,
+			Comment:          k.Description,
+			ConfirmBeforeUse: k == imported,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Extension(SSH_TPM_AGENT_ADD, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err = ListKeys(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	if keys[0].Comment != "created" || keys[0].Confirm || keys[0].Stored {
+		t.Fatalf("wrong created key: %+v", keys[0])
+	}
+	if keys[1].Comment != "imported" || !keys[1].Confirm {
+		t.Fatalf("wrong imported key: %+v", keys[1])
+	}
+
+	if _, err := CreateKey(client, &CreateMsg{Algorithm: "ed25519"}); err == nil {
+		t.Fatal("created a key with an unsupported algorithm")
+	}
+}
+
+func TestCreateAsync(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := agent.NewClient(conn)
+
+	if _, err := StartCreateKey(client, &CreateMsg{Algorithm: "ed25519"}); err == nil {
+		t.Fatal("started a job with an unsupported algorithm")
+	}
+
+	id, err := StartCreateKey(client, &CreateMsg{Algorithm: "ecdsa", Comment: "async"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := WaitJob(client, id, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Description != "async" {
+		t.Fatalf("wrong comment %q", k.Description)
+	}
+	if _, err := QueryJob(client, id); err == nil {
+		t.Fatal("finished job wasn't forgotten")
+	}
+
+	id, err = StartCreateKey(client, &CreateMsg{Algorithm: "ecdsa", Bits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WaitJob(client, id, 10*time.Millisecond); err == nil {
+		t.Fatal("job with invalid bits didn't fail")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(nil),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	caps, err := QueryCapabilities(agent.NewClient(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{SSH_TPM_AGENT_ADD, SSH_TPM_AGENT_SIGN, SSH_TPM_AGENT_CAPABILITIES} {
+		if !caps.HasExtension(ext) {
+			t.Fatalf("missing extension %s in %v", ext, caps.Extensions)
+		}
+	}
+	if len(caps.KeyAlgorithms) == 0 || caps.Version == "" {
+		t.Fatalf("incomplete capabilities: %+v", caps)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	prompted := false
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) {
+			prompted = true
+			return []byte("1234"), nil
+		},
+	)
+	defer ag.Stop()
+	ag.SetBatch(true)
+
+	k, err := key.NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &key.CreateOptions{Userauth: []byte("1234")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ag.Sign(pub, []byte("data")); !errors.Is(err, ErrInteractionRequired) {
+		t.Fatalf("expected signing to need interaction, got %v", err)
+	}
+	if prompted {
+		t.Fatal("prompted for the pin in batch mode")
+	}
+
+	// Cached pins are fine
+	k.CacheUserauth([]byte("1234"), 0)
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleLock(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte("1234"), nil },
+	)
+	defer ag.Stop()
+
+	unlocks := 0
+	unlock := false
+	ag.unlock = func(context.Context) (bool, error) {
+		unlocks++
+		return unlock, nil
+	}
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinKey, err := key.NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &key.CreateOptions{Userauth: []byte("1234")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []*key.SSHTPMKey{k, pinKey} {
+		if err := ag.AddKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinPub, err := pinKey.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ag.SetIdleLock(50 * time.Millisecond)
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	pinKey.CacheUserauth([]byte("1234"), 0)
+	if _, err := ag.Sign(pub, []byte("data")); !errors.Is(err, ErrLocked) {
+		t.Fatalf("signed with the idle agent: %v", err)
+	}
+	if pinKey.CachedUserauth() != nil {
+		t.Fatal("the idle agent kept the cached pin")
+	}
+
+	// entering the pin again unlocks the agent
+	if _, err := ag.Sign(pinPub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if unlocks != 1 {
+		t.Fatalf("expected one unlock prompt, got %d", unlocks)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	unlock = true
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if unlocks != 2 {
+		t.Fatalf("expected two unlock prompts, got %d", unlocks)
+	}
+
+	ag.SetIdleLock(0)
+	unlock = false
+	pinKey.CacheUserauth([]byte("1234"), 0)
+	ag.LockSession()
+	if _, err := ag.Sign(pub, []byte("data")); !errors.Is(err, ErrLocked) {
+		t.Fatalf("signed with the agent locked with the session: %v", err)
+	}
+	if pinKey.CachedUserauth() != nil {
+		t.Fatal("the locked agent kept the cached pin")
+	}
+	ag.UnlockSession()
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleLockUnseal(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	unlocks := 0
+	unlock := false
+	ag.unlock = func(context.Context) (bool, error) {
+		unlocks++
+		return unlock, nil
+	}
+
+	sealed, err := ag.Seal(ssh.Marshal(SealMsg{Secret: []byte("hunter2")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rsp SealResponse
+	if err := ssh.Unmarshal(sealed, &rsp); err != nil {
+		t.Fatal(err)
+	}
+	req := ssh.Marshal(UnsealMsg{Key: rsp.Key})
+
+	ag.SetIdleLock(50 * time.Millisecond)
+	if _, err := ag.Unseal(req); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := ag.Unseal(req); !errors.Is(err, ErrLocked) {
+		t.Fatalf("unsealed with the idle agent: %v", err)
+	}
+	if _, err := ag.Seal(ssh.Marshal(SealMsg{Secret: []byte("hunter2")})); !errors.Is(err, ErrLocked) {
+		t.Fatalf("sealed with the idle agent: %v", err)
+	}
+	unlock = true
+	if _, err := ag.Unseal(req); err != nil {
+		t.Fatal(err)
+	}
+	if unlocks != 3 {
+		t.Fatalf("expected three unlock prompts, got %d", unlocks)
+	}
+}
+
+func TestForgetPINs(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte("1234"), nil },
+	)
+	defer ag.Stop()
+
+	k, err := key.NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &key.CreateOptions{Userauth: []byte("1234")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	k.CacheUserauth([]byte("1234"), 0)
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := ForgetCachedPINs(agent.NewClient(conn)); err != nil {
+		t.Fatal(err)
+	}
+	if k.CachedUserauth() != nil {
+		t.Fatal("the agent didn't forget the cached pin")
+	}
+}
+
+func TestAbstractSocket(t *testing.T) {
+	socket := fmt.Sprintf("@ssh-tpm-agent-test/%d", time.Now().UnixNano())
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(nil),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	if !IsAbstractSocket(unixList.Addr().String()) {
+		t.Fatalf("%s is not an abstract socket", unixList.Addr())
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// connections of the same user are accepted
+	if _, err := agent.NewClient(conn).List(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsageMetadata(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	metadata, err := keystore.OpenMetadata(path.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag.SetMetadata(metadata)
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""), keyfile.WithDescription("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].Comment != "test (never used)" {
+		t.Fatalf("unexpected comment %q", keys[0].Comment)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := ag.Sign(pub, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if km := metadata.Get(k.Fingerprint()); km.Uses != 2 {
+		t.Fatalf("expected 2 uses, got %d", km.Uses)
+	}
+	keys, err = ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(keys[0].Comment, "test (used 2 times, last ") {
+		t.Fatalf("unexpected comment %q", keys[0].Comment)
+	}
+}
+
+func TestStats(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""), keyfile.WithDescription("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		keyfile.WithDescription("pin"), keyfile.WithUserAuth([]byte("1234")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []*key.SSHTPMKey{k, pk} {
+		if err := ag.AddKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := ag.Sign(pub, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pinPub, err := pk.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ag.Sign(pinPub, []byte("data")); err == nil {
+		t.Fatal("signed with the wrong pin")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	started, stats, err := QueryStats(agent.NewClient(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(started) > time.Minute {
+		t.Fatalf("agent started at %v", started)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("expected stats of 2 keys, got %d", len(stats))
+	}
+	if s := stats[0]; s.Comment != "test" || s.Signs != 2 || s.Errors != 0 || s.LastUsed == 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s := stats[1]; s.Comment != "pin" || s.Signs != 0 || s.Errors != 1 || s.LastUsed != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestKeyValidity(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	metadataFile := path.Join(t.TempDir(), "metadata.json")
+	metadata, err := keystore.OpenMetadata(metadataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag.SetMetadata(metadata)
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""), keyfile.WithDescription("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The window is written by ssh-tpm-keygen, which has its own view of the file
+	keygen, err := keystore.OpenMetadata(metadataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, c := range []struct {
+		name                string
+		notBefore, notAfter time.Time
+		valid               bool
+	}{
+		{"expired", now.Add(-2 * time.Hour), now.Add(-time.Hour), false},
+		{"not yet valid", now.Add(time.Hour), now.Add(2 * time.Hour), false},
+		{"expiring", now.Add(-time.Hour), now.Add(time.Hour), true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := keygen.SetValidity(k.Fingerprint(), &c.notBefore, &c.notAfter); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := ag.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ag.Sign(pub, []byte("data"))
+			if !c.valid {
+				if len(keys) != 0 {
+					t.Fatalf("listed %d keys outside of their validity window", len(keys))
+				}
+				if !errors.Is(err, ErrKeyNotValid) {
+					t.Fatalf("signing returned %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 1 || !strings.Contains(keys[0].Comment, "(expires ") {
+				t.Fatalf("unexpected keys %v", keys)
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+	var confirmed bool
+	ag.confirm = func(_ context.Context, _ *key.SSHTPMKey) (bool, error) { return confirmed, nil }
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""), keyfile.WithDescription("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ag.SetPolicy(&keystore.Policy{Serial: 2, Algorithms: []string{ssh.KeyAlgoRSA}}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("listed %d keys the policy doesn't allow", len(keys))
+	}
+	if _, err := ag.Sign(pub, []byte("data")); !errors.Is(err, ErrKeyNotAllowed) {
+		t.Fatalf("signing returned %v", err)
+	}
+
+	if err := ag.SetPolicy(&keystore.Policy{Serial: 1}); !errors.Is(err, keystore.ErrPolicyRollback) {
+		t.Fatalf("expected rollback error, got %v", err)
+	}
+
+	if err := ag.SetPolicy(&keystore.Policy{Serial: 3, ConfirmKeys: []string{k.Fingerprint()}, RenewalURL: "https://ca.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ag.Sign(pub, []byte("data")); !errors.Is(err, ErrNotConfirmed) {
+		t.Fatalf("signed without confirmation: %v", err)
+	}
+	confirmed = true
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p, err := QueryPolicy(agent.NewClient(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Serial != 3 || p.RenewalURL != "https://ca.example.com" {
+		t.Fatalf("wrong policy %+v", p)
+	}
+}
+
+func TestRenewCertificates(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certify := func(validAfter, validBefore time.Time) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:         pub,
+			CertType:    ssh.UserCert,
+			ValidAfter:  uint64(validAfter.Unix()),
+			ValidBefore: uint64(validBefore.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	now := time.Now()
+	old := certify(now.Add(-time.Hour), now.Add(time.Minute))
+	k.Certificate = old
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+
+	var renewed *ssh.Certificate
+	renew := func(_ context.Context, url string, cert *ssh.Certificate, signer ssh.AlgorithmSigner) (*ssh.Certificate, error) {
+		if url != "https://ca.example.com" {
+			t.Fatalf("renewing at %q", url)
+		}
+		if cert != old {
+			t.Fatal("renewing another certificate")
+		}
+		sig, err := signer.Sign(rand.Reader, []byte("challenge"))
+		if err != nil {
+			return nil, err
+		}
+		if err := pub.Verify([]byte("challenge"), sig); err != nil {
+			return nil, err
+		}
+		renewed = certify(now, now.Add(time.Hour))
+		return renewed, nil
+	}
+
+	// without an endpoint nothing is renewed
+	ag.RenewCertificates("", renew)
+	if renewed != nil {
+		t.Fatal("renewed without a url")
+	}
+	ag.RenewCertificates("https://ca.example.com", renew)
+	if renewed == nil {
+		t.Fatal("certificate close to expiry wasn't renewed")
+	}
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !bytes.Equal(keys[1].Blob, renewed.Marshal()) {
+		t.Fatal("agent doesn't list the renewed certificate")
+	}
+
+	// the new certificate has most of its lifetime left
+	renewed = nil
+	ag.RenewCertificates("https://ca.example.com", renew)
+	if renewed != nil {
+		t.Fatal("renewed a fresh certificate")
+	}
+}
+
+func TestCertifyKeys(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	ag, err := New(WithTPM(tpmconn.Static(tpm)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ag.Stop()
+
+	ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+
+	var certified int
+	lifetime := time.Minute
+	certify := func(_ context.Context, pub ssh.PublicKey) (*ssh.Certificate, error) {
+		certified++
+		now := time.Now()
+		cert := &ssh.Certificate{
+			Key:         pub,
+			CertType:    ssh.UserCert,
+			ValidAfter:  uint64(now.Add(-time.Hour).Unix()),
+			ValidBefore: uint64(now.Add(lifetime).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			return nil, err
+		}
+		return cert, nil
+	}
+
+	// keys without a certificate are certified
+	ag.CertifyKeys(certify)
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certified != 1 || len(keys) != 2 || keys[1].Format != ssh.CertAlgoECDSA256v01 {
+		t.Fatalf("key wasn't certified: %v", keys)
+	}
+
+	// and certificates close to expiry are replaced
+	lifetime = time.Hour
+	ag.CertifyKeys(certify)
+	if certified != 2 || time.Until(time.Unix(int64(k.Certificate.ValidBefore), 0)) < 50*time.Minute {
+		t.Fatal("certificate close to expiry wasn't replaced")
+	}
+	ag.CertifyKeys(certify)
+	if certified != 2 {
+		t.Fatal("replaced a certificate with most of its lifetime left")
+	}
+}
+
+func TestApprover(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	approver, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := key.NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		&key.CreateOptions{Approver: approver.Public()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ag.Sign(pub, []byte("data")); !errors.Is(err, key.ErrNoApprover) {
+		t.Fatalf("signing without an approver returned %v", err)
+	}
+
+	var approvals int
+	ag.SetApprover(func(_ context.Context, _ *key.SSHTPMKey, challenge []byte) ([]byte, error) {
+		approvals++
+		h := sha256.Sum256(challenge)
+		return approver.Sign(rand.Reader, h[:], crypto.SHA256)
+	})
+	for i := 0; i < 2; i++ {
+		sig, err := ag.Sign(pub, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pub.Verify([]byte("data"), sig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if approvals != 2 {
+		t.Fatalf("expected an approval for each signature, got %d", approvals)
+	}
+}
+
+func TestAddConstraints(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	var confirmed bool
+	ag.confirm = func(_ context.Context, _ *key.SSHTPMKey) (bool, error) { return confirmed, nil }
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := MarshalTPMKeyMsg(&agent.AddedKey{
+		PrivateKey:       k,
+		Comment:          k.Description,
+		LifetimeSecs:     1,
+		ConfirmBeforeUse: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ag.AddTPMKey(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ag.Sign(pub, []byte("data")); !errors.Is(err, ErrNotConfirmed) {
+		t.Fatalf("expected ErrNotConfirmed, got %v", err)
+	}
+	confirmed = true
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("key was not removed after its lifetime, listed %d keys", len(keys))
+	}
+}
+
+func TestSignatureFlags(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgRSA, 2048, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		flags  agent.SignatureFlags
+		format string
+	}{
+		{0, ssh.KeyAlgoRSA},
+		{agent.SignatureFlagRsaSha256, ssh.KeyAlgoRSASHA256},
+		{agent.SignatureFlagRsaSha512, ssh.KeyAlgoRSASHA512},
+	} {
+		t.Run(c.format, func(t *testing.T) {
+			sig, err := ag.SignWithFlags(pub, []byte("data"), c.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sig.Format != c.format {
+				t.Fatalf("got signature format %s, expected %s", sig.Format, c.format)
+			}
+			if err := pub.Verify([]byte("data"), sig); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	ag.SetNoSHA1(true)
+	if _, err := ag.SignWithFlags(pub, []byte("data"), 0); !errors.Is(err, ErrSHA1Disabled) {
+		t.Fatalf("expected ErrSHA1Disabled, got %v", err)
+	}
+	if _, err := ag.SignWithFlags(pub, []byte("data"), agent.SignatureFlagRsaSha256); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := keystore.OpenMetadata(path.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetAlgorithms(k.Fingerprint(), []string{ssh.KeyAlgoRSASHA512}); err != nil {
+		t.Fatal(err)
+	}
+	ag.SetMetadata(m)
+	if _, err := ag.SignWithFlags(pub, []byte("data"), agent.SignatureFlagRsaSha256); !errors.Is(err, ErrAlgorithmNotAllowed) {
+		t.Fatalf("expected ErrAlgorithmNotAllowed, got %v", err)
+	}
+	if _, err := ag.SignWithFlags(pub, []byte("data"), agent.SignatureFlagRsaSha512); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrimaryKeys(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return nil, errors.New("no pin for primary keys") },
+	)
+	defer ag.Stop()
+
+	if err := ag.AddPrimaryKeys([]string{"work", "home"}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Comment != "work" || keys[1].Comment != "home" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	k, err := key.NewPrimary(tpm, []byte(""), "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub.Marshal(), keys[0].Marshal()) {
+		t.Fatal("the agent has a different primary key")
+	}
+	sig, err := ag.Sign(pub, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Verify([]byte("data"), sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type countingPrompter struct {
+	pin  []byte
+	pins int
+}
+
+func (p *countingPrompter) PIN(_ context.Context, _ *key.SSHTPMKey) ([]byte, error) {
+	p.pins++
+	return bytes.Clone(p.pin), nil
+}
+
+func (p *countingPrompter) Confirm(_ context.Context, _ *key.SSHTPMKey) (bool, error) {
+	return true, nil
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(); err == nil {
+		t.Fatal("made an agent without a tpm")
+	}
+
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	dir := t.TempDir()
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		keyfile.WithUserAuth([]byte("1234")),
+		keyfile.WithDescription("stored"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "id_ecdsa.tpm"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var sockets []string
+	var opts []Option
+	for _, name := range []string{"first", "second"} {
+		socket := path.Join(t.TempDir(), name)
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		sockets = append(sockets, socket)
+		opts = append(opts, WithListener(l))
+	}
+	prompter := &countingPrompter{pin: []byte("1234")}
+	ag, err := New(append(opts,
+		WithTPM(tpmconn.Static(tpm)),
+		WithPrompter(prompter),
+		WithKeystore(keystore.NewDirs(dir, "")),
+	)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ag.Stop()
+
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, socket := range sockets {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := agent.NewClient(conn)
+
+		keys, err := client.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0].Comment != "stored" {
+			t.Fatalf("keystore wasn't loaded: %v", keys)
+		}
+		sig, err := client.Sign(pub, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pub.Verify([]byte("data"), sig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prompter.pins != 2 {
+		t.Fatalf("prompted %d times, expected 2", prompter.pins)
+	}
+}
+
+func TestProvider(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	// only the methods of Provider, without Signers and RemoveAll
+	keyring := agent.NewKeyring().(agent.ExtendedAgent)
+	provider := struct{ Provider }{keyring}
+
+	ag, err := New(WithTPM(tpmconn.Static(tpm)), WithProvider(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ag.Stop()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.Add(agent.AddedKey{PrivateKey: priv, Comment: "provided"}); err != nil {
+		t.Fatal(err)
+	}
+	pk, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Comment == "provided" || keys[1].Comment != "provided" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	sig, err := ag.Sign(pk, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pk.Verify([]byte("data"), sig); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ag.Remove(pk); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := keyring.List(); len(keys) != 0 {
+		t.Fatal("key wasn't removed from the provider")
+	}
+	tpmPub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.Remove(tpmPub); err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.Remove(tpmPub); err == nil {
+		t.Fatal("removed a key twice")
+	}
+}
+
+// serveKeyring serves keyring on a new socket until the test ends
+func serveKeyring(t *testing.T, keyring agent.Agent) string {
+	t.Helper()
+	socket := path.Join(t.TempDir(), "upstream")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket
+}
+
+func TestUpstream(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	shared, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gpg, forwarded := agent.NewKeyring(), agent.NewKeyring()
+	for _, added := range []struct {
+		keyring agent.Agent
+		key     *ecdsa.PrivateKey
+		comment string
+	}{
+		{gpg, shared, "card"},
+		{forwarded, shared, "laptop"},
+		{forwarded, own, "laptop"},
+	} {
+		if err := added.keyring.Add(agent.AddedKey{PrivateKey: added.key, Comment: added.comment}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	forwardedSocket := serveKeyring(t, forwarded)
+	ag, err := New(WithTPM(tpmconn.Static(tpm)),
+		WithProvider(&Upstream{Label: "gpg", Socket: serveKeyring(t, gpg)}),
+		WithProvider(&Upstream{Socket: forwardedSocket}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ag.Stop()
+
+	keys, err := ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var comments []string
+	for _, k := range keys {
+		comments = append(comments, k.Comment)
+	}
+	if strings.Join(comments, ",") != "card (from gpg),laptop" {
+		t.Fatalf("unexpected keys %v", comments)
+	}
+
+	pk, err := ssh.NewPublicKey(&own.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ag.Sign(pk, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pk.Verify([]byte("data"), sig); err != nil {
+		t.Fatal(err)
+	}
+
+	// the forwarded agent going away only removes its keys
+	os.Remove(forwardedSocket)
+	keys, err = ag.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("listed %d keys without the forwarded agent", len(keys))
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	dir := t.TempDir()
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""), keyfile.WithDescription("machine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "machine.tpm"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := path.Join(t.TempDir(), "socket")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ag, err := New(
+		WithListener(l),
+		WithTPM(tpmconn.Static(tpm)),
+		WithKeystore(keystore.NewDirs(dir, "")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ag.Stop()
+	ag.SetReadOnly(true)
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := agent.NewClient(conn)
+
+	caps, err := QueryCapabilities(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caps.HasExtension(SSH_TPM_AGENT_READ_ONLY) || caps.HasExtension(SSH_TPM_AGENT_ADD) || caps.HasExtension(SSH_TPM_AGENT_IMPORT) {
+		t.Fatalf("wrong extensions for a read-only keystore: %v", caps.Extensions)
+	}
+
+	added, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := MarshalTPMKeyMsg(&agent.AddedKey{PrivateKey: added})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Extension(SSH_TPM_AGENT_ADD, req); err == nil {
+		t.Fatal("added a key to a read-only keystore")
+	}
+	if _, err := CreateKey(client, &CreateMsg{Algorithm: "ecdsa"}); err == nil {
+		t.Fatal("created a key with a read-only keystore")
+	}
+
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Remove(pub); err == nil {
+		t.Fatal("removed a key of a read-only keystore")
+	}
+	if err := client.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "machine" {
+		t.Fatalf("keys of the read-only keystore were removed: %v", keys)
+	}
+
+	ag.SetReadOnly(false)
+	if err := client.Remove(pub); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignDigestAlgorithms(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgRSA, 2048, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := keystore.OpenMetadata(path.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetAlgorithms(k.Fingerprint(), []string{ssh.KeyAlgoRSASHA512}); err != nil {
+		t.Fatal(err)
+	}
+	ag.SetMetadata(m)
+
+	sign := func(hash string, digest []byte) error {
+		_, err := ag.SignDigest(ssh.Marshal(SignDigestMsg{KeyBlob: pub.Marshal(), Digest: digest, Hash: hash}))
+		return err
+	}
+	d256 := sha256.Sum256([]byte("data"))
+	if err := sign("sha256", d256[:]); !errors.Is(err, ErrAlgorithmNotAllowed) {
+		t.Fatalf("expected ErrAlgorithmNotAllowed, got %v", err)
+	}
+	d384 := sha512.Sum384([]byte("data"))
+	if err := sign("sha384", d384[:]); !errors.Is(err, ErrAlgorithmNotAllowed) {
+		t.Fatalf("expected ErrAlgorithmNotAllowed, got %v", err)
+	}
+	d512 := sha512.Sum512([]byte("data"))
+	if err := sign("sha512", d512[:]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinPromptDoesNotHoldTPM(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	prompted := make(chan struct{})
+	release := make(chan struct{})
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) {
+			close(prompted)
+			<-release
+			return []byte("1234"), nil
+		},
+	)
+	defer ag.Stop()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinKey, err := key.NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &key.CreateOptions{Userauth: []byte("1234")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []*key.SSHTPMKey{k, pinKey} {
+		if err := ag.AddKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinPub, err := pinKey.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ag.Sign(pinPub, []byte("data"))
+		errc <- err
+	}()
+	<-prompted
+
+	// the key without a pin signs while the pin is asked for
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordingPrompter keeps the PINs it returned
+type recordingPrompter struct {
+	countingPrompter
+	returned [][]byte
+}
+
+func (p *recordingPrompter) PIN(ctx context.Context, k *key.SSHTPMKey) ([]byte, error) {
+	pin, err := p.countingPrompter.PIN(ctx, k)
+	p.returned = append(p.returned, pin)
+	return pin, err
+}
+
+func TestPinWiped(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	prompter := &recordingPrompter{countingPrompter: countingPrompter{pin: []byte("1234")}}
+	ag, err := New(WithListener(l), WithTPM(tpmconn.Static(tpm)), WithPrompter(prompter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ag.Stop()
+
+	k, err := key.NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &key.CreateOptions{Userauth: []byte("1234")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if len(prompter.returned) != 1 {
+		t.Fatalf("prompted %d times, expected once", len(prompter.returned))
+	}
+	if !bytes.Equal(prompter.returned[0], make([]byte, 4)) {
+		t.Fatalf("the pin wasn't wiped after signing: %q", prompter.returned[0])
+	}
 }
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var SSH_TPM_AGENT_CAPABILITIES = "capabilities@tpm-ssh-agent"
+
+// Version is the version reported by the capabilities extension. It defaults
+// to the module version of the binary.
+var Version string
+
+// KeyAlgorithms are the signature algorithms the agent can produce with TPM
+// keys.
+var KeyAlgorithms = []string{
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSASHA512,
+}
+
+// CapabilitiesResponse describes what the agent supports. Agents predating
+// the extension answer with agent.ErrExtensionUnsupported.
+type CapabilitiesResponse struct {
+	Type          string `sshtype:"6"`
+	Version       string
+	Extensions    []string
+	KeyAlgorithms []string
+}
+
+// HasExtension reports if the agent supports the extension type
+func (c *CapabilitiesResponse) HasExtension(extensionType string) bool {
+	return slices.Contains(c.Extensions, extensionType)
+}
+
+func version() string {
+	return utils.ReadBuildInfo(Version).Version
+}
+
+func (a *Agent) Capabilities() ([]byte, error) {
+	slog.Debug("called capabilities")
+	// session-bind is handled per connection, see session
+	extensions := []string{SSH_SESSION_BIND}
+	for ext := range a.extensions() {
+		if !a.refused(ext) {
+			extensions = append(extensions, ext)
+		}
+	}
+	if a.isReadOnly() {
+		extensions = append(extensions, SSH_TPM_AGENT_READ_ONLY)
+	}
+	slices.Sort(extensions)
+	algs := KeyAlgorithms
+	a.mu.Lock()
+	if a.noSHA1 {
+		algs = slices.DeleteFunc(slices.Clone(algs), func(alg string) bool {
+			return alg == ssh.KeyAlgoRSA
+		})
+	}
+	a.mu.Unlock()
+	return ssh.Marshal(CapabilitiesResponse{
+		Version:       version(),
+		Extensions:    extensions,
+		KeyAlgorithms: algs,
+	}), nil
+}
+
+// QueryCapabilities asks the agent for its version and supported extensions
+// and key algorithms.
+func QueryCapabilities(client sshagent.ExtendedAgent) (*CapabilitiesResponse, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_CAPABILITIES, nil)
+	if err != nil {
+		return nil, err
+	}
+	var rsp CapabilitiesResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed capabilities response: %w", err)
+	}
+	return &rsp, nil
+}
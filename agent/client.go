@@ -10,7 +10,7 @@ import (
 )
 
 type AddedKey struct {
-	PrivateKey           *keyfile.TPMKey
+	PrivateKey           *key.SSHTPMKey
 	Certificate          *ssh.Certificate
 	Comment              string
 	LifetimeSecs         uint32
@@ -25,7 +25,7 @@ type TPMKeyMsg struct {
 	Constraints []byte `ssh:"rest"`
 }
 
-func MarshalTPMKeyMsg(cert *sshagent.AddedKey) []byte {
+func MarshalTPMKeyMsg(cert *sshagent.AddedKey) ([]byte, error) {
 	var req []byte
 	var constraints []byte
 
@@ -37,35 +37,41 @@ func MarshalTPMKeyMsg(cert *sshagent.AddedKey) []byte {
 		constraints = append(constraints, agentConstrainConfirm)
 	}
 
+	for _, ext := range cert.ConstraintExtensions {
+		constraints = append(constraints, ssh.Marshal(constrainExtensionAgentMsg{
+			ExtensionName:    ext.ExtensionName,
+			ExtensionDetails: ext.ExtensionDetails,
+		})...)
+	}
+
 	var certBytes []byte
 	if cert.Certificate != nil {
 		certBytes = cert.Certificate.Marshal()
 	}
 
+	var b []byte
 	switch k := cert.PrivateKey.(type) {
 	case *keyfile.TPMKey:
-		req = ssh.Marshal(TPMKeyMsg{
-			Type:        "TPMKEY",
-			PrivateKey:  k.Bytes(),
-			CertBytes:   certBytes,
-			Constraints: constraints,
-		})
+		b = k.Bytes()
 	case *key.SSHTPMKey:
-		req = ssh.Marshal(TPMKeyMsg{
-			Type:        "TPMKEY",
-			PrivateKey:  k.Bytes(),
-			CertBytes:   certBytes,
-			Constraints: constraints,
-		})
-
+		var err error
+		if b, err = k.Bytes(); err != nil {
+			return nil, err
+		}
 	}
-	return req
+	req = ssh.Marshal(TPMKeyMsg{
+		Type:        "TPMKEY",
+		PrivateKey:  b,
+		CertBytes:   certBytes,
+		Constraints: constraints,
+	})
+	return req, nil
 }
 
 func ParseTPMKeyMsg(req []byte) (*AddedKey, error) {
 	var k TPMKeyMsg
 
-	var key *keyfile.TPMKey
+	var tpmkey *key.SSHTPMKey
 	var err error
 
 	if err := ssh.Unmarshal(req, &k); err != nil {
@@ -73,13 +79,13 @@ func ParseTPMKeyMsg(req []byte) (*AddedKey, error) {
 	}
 
 	if len(k.PrivateKey) != 0 {
-		key, err = keyfile.Decode(k.PrivateKey)
+		tpmkey, err = key.Decode(k.PrivateKey)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	addedKey := &AddedKey{PrivateKey: key}
+	addedKey := &AddedKey{PrivateKey: tpmkey}
 
 	if len(k.CertBytes) != 0 {
 		pubKey, err := ssh.ParsePublicKey(k.CertBytes)
@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"golang.org/x/crypto/ssh"
+)
+
+// constraint holds the constraints a key was added to the agent with
+type constraint struct {
+	confirm      bool
+	lifetime     time.Duration
+	expiry       *time.Timer
+	destinations []DestinationConstraint
+}
+
+// newConstraint returns the constraints of addkey, or nil if it has none
+func newConstraint(addkey *AddedKey) (*constraint, error) {
+	c := &constraint{
+		confirm:  addkey.ConfirmBeforeUse,
+		lifetime: time.Duration(addkey.LifetimeSecs) * time.Second,
+	}
+	for _, ext := range addkey.ConstraintExtensions {
+		if ext.ExtensionName != SSH_RESTRICT_DESTINATION {
+			return nil, fmt.Errorf("unsupported constraint extension %s", ext.ExtensionName)
+		}
+		dcs, err := parseDestinationConstraints(ext.ExtensionDetails)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination constraints: %w", err)
+		}
+		c.destinations = append(c.destinations, dcs...)
+	}
+	if !c.confirm && c.lifetime == 0 && len(c.destinations) == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// constrain applies the constraints c to k, replacing the constraints of a
+// key previously added with the same fingerprint. a.mu must be held.
+func (a *Agent) constrain(k *key.SSHTPMKey, c *constraint) {
+	a.unconstrain(k.Fingerprint())
+	if c == nil {
+		return
+	}
+	if c.lifetime != 0 {
+		c.expiry = time.AfterFunc(c.lifetime, func() {
+			a.expire(k, c)
+		})
+	}
+	if a.constraints == nil {
+		a.constraints = map[string]*constraint{}
+	}
+	a.constraints[k.Fingerprint()] = c
+}
+
+// unconstrain drops the constraints and remembered confirmations of the key
+// with fingerprint fp. a.mu must be held.
+func (a *Agent) unconstrain(fp string) {
+	delete(a.confirmed, fp)
+	if c, ok := a.constraints[fp]; ok {
+		if c.expiry != nil {
+			c.expiry.Stop()
+		}
+		delete(a.constraints, fp)
+	}
+}
+
+// derivedConstraint restricts a key derived for host to the keys of host in
+// the known_hosts files. Without any known keys the key is only used locally.
+func derivedConstraint(host string) *constraint {
+	keys, err := HostKeys(KnownHostsFiles(), host)
+	if err != nil {
+		slog.Warn("derived key is only used for local connections", slog.String("host", host), slog.String("error", err.Error()))
+	}
+	return &constraint{
+		destinations: []DestinationConstraint{{To: Hop{Hostname: host, Keys: keys}}},
+	}
+}
+
+// expire removes k once its lifetime c has passed
+func (a *Agent) expire(k *key.SSHTPMKey, c *constraint) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// the key was removed or added again in the meantime
+	if a.constraints[k.Fingerprint()] != c {
+		return
+	}
+	slog.Info("removing key at the end of its lifetime", slog.String("fingerprint", k.Fingerprint()))
+	delete(a.constraints, k.Fingerprint())
+	delete(a.confirmed, k.Fingerprint())
+	a.keys = slices.DeleteFunc(a.keys, func(kk *key.SSHTPMKey) bool {
+		return kk == k
+	})
+	a.keySigners = nil
+}
+
+// confirmUse asks the user to confirm the use of k if it was added with the
+// confirm constraint or the policy requires it, or to unlock the idle agent. destination is the host key
+// fingerprint the key is used for, or empty if it isn't known.
+func (a *Agent) confirmUse(ctx context.Context, k *key.SSHTPMKey, destination string) error {
+	if err := a.wake(ctx, k); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	c := a.constraints[k.Fingerprint()]
+	p := a.policy
+	a.mu.Unlock()
+	if (c == nil || !c.confirm) && !p.NeedsConfirm(k.Fingerprint()) {
+		return nil
+	}
+	if a.remembered(k, destination) {
+		slog.Debug("using remembered confirmation", slog.String("desc", k.Description), slog.String("destination", destination))
+		return nil
+	}
+	ok, err := a.askConfirm(ctx, k)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotConfirmed
+	}
+	a.remember(k, destination)
+	return nil
+}
+
+// SetConfirmCache remembers a confirmed use of a key for d, so a burst of
+// connections isn't confirmed one by one. With perDestination the
+// confirmation only covers the host the key was used for, and uses without a
+// bound session are always confirmed. A zero d asks for every use.
+func (a *Agent) SetConfirmCache(d time.Duration, perDestination bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.confirmFor = d
+	a.confirmPerDestination = perDestination
+	a.confirmed = nil
+}
+
+// remembered reports if the use of k for destination was confirmed recently
+func (a *Agent) remembered(k *key.SSHTPMKey, destination string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.confirmPerDestination && destination == "" {
+		return false
+	}
+	if !a.confirmPerDestination {
+		destination = ""
+	}
+	expiry, ok := a.confirmed[k.Fingerprint()][destination]
+	return ok && time.Now().Before(expiry)
+}
+
+// remember records a confirmed use of k for destination
+func (a *Agent) remember(k *key.SSHTPMKey, destination string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.confirmFor == 0 || (a.confirmPerDestination && destination == "") {
+		return
+	}
+	if !a.confirmPerDestination {
+		destination = ""
+	}
+	if a.confirmed == nil {
+		a.confirmed = map[string]map[string]time.Time{}
+	}
+	fp := k.Fingerprint()
+	if a.confirmed[fp] == nil {
+		a.confirmed[fp] = map[string]time.Time{}
+	}
+	a.confirmed[fp][destination] = time.Now().Add(a.confirmFor)
+}
+
+// destinations returns the destination constraints of the key pk
+func (a *Agent) destinations(pk ssh.PublicKey) []DestinationConstraint {
+	if cert, ok := pk.(*ssh.Certificate); ok {
+		pk = cert.Key
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c := a.constraints[ssh.FingerprintSHA256(pk)]; c != nil {
+		return c.destinations
+	}
+	return nil
+}
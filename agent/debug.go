@@ -0,0 +1,37 @@
+package agent
+
+import "time"
+
+// DebugState is what the agent is doing, for diagnosing hangs. TPMRunning is
+// how long the running TPM operation has been running, zero while idle.
+// TPMRetries counts the commands resent because the TPM was busy, TPMResets
+// the transports reopened after they failed.
+type DebugState struct {
+	Connections     uint64        `json:"connections"`
+	OpenConnections int64         `json:"open_connections"`
+	Keys            int           `json:"keys"`
+	TPMWaiting      int           `json:"tpm_waiting"`
+	TPMRunning      time.Duration `json:"tpm_running"`
+	TPMRetries      uint64        `json:"tpm_retries"`
+	TPMResets       int           `json:"tpm_resets"`
+	Uptime          time.Duration `json:"uptime"`
+}
+
+// DebugState returns the state of the agent
+func (a *Agent) DebugState() DebugState {
+	waiting, running := a.queue.state()
+	retries, resets := a.cache.counts()
+	a.mu.Lock()
+	keys := len(a.keys)
+	a.mu.Unlock()
+	return DebugState{
+		Connections:     a.conns.Load(),
+		OpenConnections: a.openConns.Load(),
+		Keys:            keys,
+		TPMWaiting:      waiting,
+		TPMRunning:      running,
+		TPMRetries:      retries,
+		TPMResets:       resets,
+		Uptime:          time.Since(a.started),
+	}
+}
@@ -0,0 +1,375 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/signer"
+	"github.com/google/go-tpm/tpm2"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	SSH_TPM_AGENT_DECRYPT = "decrypt@tpm-ssh-agent"
+	SSH_TPM_AGENT_ECDH    = "ecdh@tpm-ssh-agent"
+	SSH_TPM_AGENT_SIGN    = "sign-digest@tpm-ssh-agent"
+)
+
+// DecryptMsg is the request of the decrypt extension. KeyBlob is the wire
+// format of the SSH public key, Hash is the OAEP hash and defaults to sha256.
+type DecryptMsg struct {
+	KeyBlob    []byte
+	Ciphertext []byte
+	Hash       string
+}
+
+// DecryptResponse contains the plaintext of a decrypt request.
+type DecryptResponse struct {
+	Type      string `sshtype:"6"`
+	Plaintext []byte
+}
+
+// ECDHMsg is the request of the ecdh extension. Point is the uncompressed
+// peer public key.
+type ECDHMsg struct {
+	KeyBlob []byte
+	Point   []byte
+}
+
+// ECDHResponse contains the shared secret of an ecdh request.
+type ECDHResponse struct {
+	Type   string `sshtype:"6"`
+	Secret []byte
+}
+
+// SignDigestMsg is the request of the sign-digest extension. Hash is the
+// algorithm the digest was computed with, suffixed with -pss for an RSA-PSS
+// signature from keys created with key.CreateOptions.PSS.
+type SignDigestMsg struct {
+	KeyBlob []byte
+	Digest  []byte
+	Hash    string
+}
+
+// SignDigestResponse contains the ASN.1 ECDSA, PKCS#1 v1.5 RSA or RSA-PSS
+// signature of a sign-digest request.
+type SignDigestResponse struct {
+	Type      string `sshtype:"6"`
+	Signature []byte
+}
+
+func digestHash(name string) (tpm2.TPMAlgID, error) {
+	switch name {
+	case "sha256":
+		return tpm2.TPMAlgSHA256, nil
+	case "sha384":
+		return tpm2.TPMAlgSHA384, nil
+	case "sha512":
+		return tpm2.TPMAlgSHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported hash %s", name)
+}
+
+// digestAlgorithm returns the signature algorithm of a sign-digest request with
+// hash, to check against keystore.KeyMetadata.Algorithms. RSA signatures are
+// named like rsa-sha2-512, with a -pss suffix for RSA-PSS, so the ones SSH
+// has no algorithm for are only made by unrestricted keys.
+func digestAlgorithm(k *key.SSHTPMKey, hash string, pss bool) (string, error) {
+	pk, err := k.SSHPublicKey()
+	if err != nil {
+		return "", err
+	}
+	if pk.Type() != ssh.KeyAlgoRSA {
+		return pk.Type(), nil
+	}
+	alg := "rsa-sha2-" + strings.TrimPrefix(hash, "sha")
+	if pss {
+		alg += "-pss"
+	}
+	return alg, nil
+}
+
+func oaepHash(name string) (tpm2.TPMAlgID, error) {
+	switch name {
+	case "sha1":
+		return tpm2.TPMAlgSHA1, nil
+	case "", "sha256":
+		return tpm2.TPMAlgSHA256, nil
+	case "sha384":
+		return tpm2.TPMAlgSHA384, nil
+	case "sha512":
+		return tpm2.TPMAlgSHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported oaep hash %s", name)
+}
+
+func (a *Agent) Decrypt(req []byte) ([]byte, error) {
+	slog.Debug("called decrypt")
+	var msg DecryptMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+
+	hashalg, err := oaepHash(msg.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := a.findKey(msg.KeyBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	if err := a.confirmUse(ctx, k, ""); err != nil {
+		return nil, err
+	}
+	auth, ownerauth, err := a.keyAuth(k)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(auth)
+	err = a.queue.do(ctx, func() (err error) {
+		plaintext, err = k.Decrypt(a.tpm(), ownerauth, auth, msg.Ciphertext, hashalg)
+		clearAuth(k, err)
+		return err
+	})
+	a.recordStats(k, false, err)
+	if err != nil {
+		logUnrecoverable(k, err)
+		return nil, err
+	}
+	a.recordUse(k)
+	return ssh.Marshal(DecryptResponse{Plaintext: plaintext}), nil
+}
+
+func (a *Agent) ECDH(req []byte) ([]byte, error) {
+	slog.Debug("called ecdh")
+	var msg ECDHMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+
+	k, err := a.findKey(msg.KeyBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	curve, ok := eccCurve(k)
+	if !ok {
+		return nil, fmt.Errorf("can only derive with ecc keys")
+	}
+	peer, err := curve.NewPublicKey(msg.Point)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret []byte
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	if err := a.confirmUse(ctx, k, ""); err != nil {
+		return nil, err
+	}
+	auth, ownerauth, err := a.keyAuth(k)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(auth)
+	err = a.queue.do(ctx, func() (err error) {
+		secret, err = k.ECDH(a.tpm(), ownerauth, auth, peer)
+		clearAuth(k, err)
+		return err
+	})
+	a.recordStats(k, false, err)
+	if err != nil {
+		logUnrecoverable(k, err)
+		return nil, err
+	}
+	a.recordUse(k)
+	return ssh.Marshal(ECDHResponse{Secret: secret}), nil
+}
+
+func (a *Agent) SignDigest(req []byte) ([]byte, error) {
+	slog.Debug("called signdigest")
+	var msg SignDigestMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+
+	hash, pss := strings.CutSuffix(msg.Hash, "-pss")
+	hashalg, err := digestHash(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := a.findKey(msg.KeyBlob)
+	if err != nil {
+		return nil, err
+	}
+	if pss != k.IsPSS() {
+		if pss {
+			return nil, fmt.Errorf("key was not created for RSA-PSS signatures")
+		}
+		return nil, signer.ErrPSSOnly
+	}
+
+	alg, err := digestAlgorithm(k, hash, pss)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	m := a.metadata
+	a.mu.Unlock()
+	if err := checkAlgorithm(m, k, alg); err != nil {
+		return nil, err
+	}
+
+	var sig []byte
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	if err := a.confirmUse(ctx, k, ""); err != nil {
+		return nil, err
+	}
+	auth, ownerauth, err := a.keyAuth(k)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(auth)
+	err = a.queue.do(ctx, func() (err error) {
+		sig, err = k.Sign(a.tpm(), ownerauth, auth, msg.Digest, hashalg)
+		clearAuth(k, err)
+		return err
+	})
+	a.recordStats(k, true, err)
+	if err != nil {
+		logUnrecoverable(k, err)
+		return nil, err
+	}
+	a.recordUse(k)
+	return ssh.Marshal(SignDigestResponse{Signature: sig}), nil
+}
+
+func eccCurve(k *key.SSHTPMKey) (ecdh.Curve, bool) {
+	pk, err := k.PublicKey()
+	if err != nil {
+		return nil, false
+	}
+	ecdsakey, ok := pk.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, false
+	}
+	ecdhkey, err := ecdsakey.ECDH()
+	if err != nil {
+		return nil, false
+	}
+	return ecdhkey.Curve(), true
+}
+
+// findKey returns the TPM key matching the SSH public key wire format
+func (a *Agent) findKey(blob []byte) (*key.SSHTPMKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, k := range a.keys {
+		pk, err := k.SSHPublicKey()
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(pk.Marshal(), blob) {
+			if err := a.validity(k); err != nil {
+				return nil, err
+			}
+			k.Approve = a.approver(k)
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("no private keys match the requested public key")
+}
+
+// keyAuth returns the userauth of the key and the owner password. The caller
+// wipes the userauth after use.
+func (a *Agent) keyAuth(k *key.SSHTPMKey) ([]byte, []byte, error) {
+	auth := []byte("")
+	if k.HasAuth() {
+		p, err := a.askPin(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		auth = p
+	}
+	ownerauth, err := a.op()
+	if err != nil {
+		return nil, nil, err
+	}
+	return auth, ownerauth, nil
+}
+
+// clearAuth removes the cached userauth of the key if err is an authorization
+// failure, like signer.SSHKeySigner does.
+func clearAuth(k *key.SSHTPMKey, err error) {
+	if errors.Is(err, tpm2.TPMRCAuthFail) {
+		slog.Debug("removed cached userauth for key", slog.Any("err", err), slog.String("desc", k.Description))
+		k.ForgetUserauth()
+	}
+}
+
+// DecryptWithKey decrypts RSA-OAEP ciphertext through the agent with the TPM
+// key matching pub.
+func DecryptWithKey(client sshagent.ExtendedAgent, pub ssh.PublicKey, ciphertext []byte, hash string) ([]byte, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_DECRYPT, ssh.Marshal(DecryptMsg{
+		KeyBlob:    pub.Marshal(),
+		Ciphertext: ciphertext,
+		Hash:       hash,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	var rsp DecryptResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed decrypt response: %w", err)
+	}
+	return rsp.Plaintext, nil
+}
+
+// ECDHWithKey returns the shared secret between the TPM key matching pub and
+// peer through the agent.
+func ECDHWithKey(client sshagent.ExtendedAgent, pub ssh.PublicKey, peer *ecdh.PublicKey) ([]byte, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_ECDH, ssh.Marshal(ECDHMsg{
+		KeyBlob: pub.Marshal(),
+		Point:   peer.Bytes(),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	var rsp ECDHResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed ecdh response: %w", err)
+	}
+	return rsp.Secret, nil
+}
+
+// SignDigestWithKey signs a digest through the agent with the TPM key
+// matching pub.
+func SignDigestWithKey(client sshagent.ExtendedAgent, pub ssh.PublicKey, digest []byte, hash string) ([]byte, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_SIGN, ssh.Marshal(SignDigestMsg{
+		KeyBlob: pub.Marshal(),
+		Digest:  digest,
+		Hash:    hash,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	var rsp SignDigestResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed sign-digest response: %w", err)
+	}
+	return rsp.Signature, nil
+}
@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	SSH_TPM_AGENT_CREATE_ASYNC = "create-async@tpm-ssh-agent"
+	SSH_TPM_AGENT_JOB          = "job@tpm-ssh-agent"
+)
+
+// JobTimeout bounds how long an asynchronous key creation may take, unlike
+// requests it isn't limited by the request timeout.
+var JobTimeout = 10 * time.Minute
+
+// jobRetention is how long the result of a finished job is kept for the
+// client to fetch it
+const jobRetention = 10 * time.Minute
+
+// maxJobs is the number of jobs the agent keeps at a time
+const maxJobs = 16
+
+// States of a job
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+var ErrNoJob = errors.New("no such job")
+
+// JobMsg is the request of the job extension.
+type JobMsg struct {
+	ID string
+}
+
+// JobStartResponse contains the id of the job started by a create-async
+// request.
+type JobStartResponse struct {
+	Type string `sshtype:"6"`
+	ID   string
+}
+
+// JobResponse contains the state of a job. Key is the key file of a done
+// job, Error the reason of a failed one.
+type JobResponse struct {
+	Type    string `sshtype:"6"`
+	State   string
+	Started uint64
+	Error   string
+	Key     []byte
+}
+
+// job is a key creation running in the background
+type job struct {
+	started, finished time.Time
+	key               *key.SSHTPMKey
+	err               error
+}
+
+// expireJobs forgets finished jobs whose result wasn't fetched in time
+func (a *Agent) expireJobs(now time.Time) {
+	for id, j := range a.jobs {
+		if !j.finished.IsZero() && now.Sub(j.finished) > jobRetention {
+			delete(a.jobs, id)
+		}
+	}
+}
+
+// CreateAsync starts creating a key like Create and returns the id of the
+// job right away. The client polls the job extension for the key.
+func (a *Agent) CreateAsync(req []byte) ([]byte, error) {
+	slog.Debug("called createasync")
+	var msg CreateMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+	if err := checkCreateMsg(&msg); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+
+	a.mu.Lock()
+	if a.jobs == nil {
+		a.jobs = map[string]*job{}
+	}
+	a.expireJobs(time.Now())
+	if len(a.jobs) >= maxJobs {
+		a.mu.Unlock()
+		return nil, fmt.Errorf("too many jobs, at most %d are kept", maxJobs)
+	}
+	j := &job{started: time.Now()}
+	a.jobs[id] = j
+	a.mu.Unlock()
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		ctx, cancel := context.WithTimeout(a.ctx, JobTimeout)
+		defer cancel()
+		k, err := a.create(ctx, &msg)
+		if err != nil {
+			slog.Info("creating key failed", slog.String("job", id), slog.String("error", err.Error()))
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		j.key, j.err, j.finished = k, err, time.Now()
+	}()
+	return ssh.Marshal(JobStartResponse{ID: id}), nil
+}
+
+// Job returns the state of a job. The job is forgotten once its result has
+// been returned.
+func (a *Agent) Job(req []byte) ([]byte, error) {
+	slog.Debug("called job")
+	var msg JobMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	j := a.jobs[msg.ID]
+	if j == nil {
+		return nil, ErrNoJob
+	}
+	rsp := JobResponse{State: JobRunning, Started: uint64(j.started.Unix())}
+	switch {
+	case j.finished.IsZero():
+		return ssh.Marshal(rsp), nil
+	case j.err != nil:
+		rsp.State = JobFailed
+		rsp.Error = j.err.Error()
+	default:
+		b, err := j.key.Bytes()
+		if err != nil {
+			rsp.State = JobFailed
+			rsp.Error = err.Error()
+			break
+		}
+		rsp.State = JobDone
+		rsp.Key = b
+	}
+	delete(a.jobs, msg.ID)
+	return ssh.Marshal(rsp), nil
+}
+
+// Job is the state of a job as returned by QueryJob. Key is set once the
+// job is done, Err once it failed.
+type Job struct {
+	State   string
+	Started time.Time
+	Key     *key.SSHTPMKey
+	Err     error
+}
+
+// StartCreateKey starts creating a key through the agent, and returns the id
+// of the job to poll with QueryJob.
+func StartCreateKey(client sshagent.ExtendedAgent, msg *CreateMsg) (string, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_CREATE_ASYNC, ssh.Marshal(msg))
+	if err != nil {
+		return "", err
+	}
+	var rsp JobStartResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return "", fmt.Errorf("malformed create-async response: %w", err)
+	}
+	return rsp.ID, nil
+}
+
+// QueryJob asks the agent for the state of the job with id
+func QueryJob(client sshagent.ExtendedAgent, id string) (*Job, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_JOB, ssh.Marshal(JobMsg{ID: id}))
+	if err != nil {
+		return nil, err
+	}
+	var rsp JobResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed job response: %w", err)
+	}
+	j := &Job{State: rsp.State, Started: time.Unix(int64(rsp.Started), 0)}
+	switch rsp.State {
+	case JobDone:
+		j.Key, err = key.Decode(rsp.Key)
+		if err != nil {
+			return nil, err
+		}
+	case JobFailed:
+		j.Err = errors.New(rsp.Error)
+	}
+	return j, nil
+}
+
+// WaitJob polls the job with id every interval until it's finished, and
+// returns its key.
+func WaitJob(client sshagent.ExtendedAgent, id string, interval time.Duration) (*key.SSHTPMKey, error) {
+	for {
+		j, err := QueryJob(client, id)
+		if err != nil {
+			return nil, err
+		}
+		switch j.State {
+		case JobDone:
+			return j.Key, nil
+		case JobFailed:
+			return nil, j.Err
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KnownHostsFiles returns the system and user known_hosts files OpenSSH
+// reads by default.
+func KnownHostsFiles() []string {
+	files := []string{"/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2"}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files,
+			filepath.Join(home, ".ssh", "known_hosts"),
+			filepath.Join(home, ".ssh", "known_hosts2"))
+	}
+	return files
+}
+
+// matchHost reports if the known_hosts pattern matches host
+func matchHost(pattern, host string) bool {
+	if hashed, ok := strings.CutPrefix(pattern, "|1|"); ok {
+		salt64, hash64, ok := strings.Cut(hashed, "|")
+		if !ok {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(salt64)
+		if err != nil {
+			return false
+		}
+		hash, err := base64.StdEncoding.DecodeString(hash64)
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+	ok, _ := path.Match(pattern, host)
+	return ok
+}
+
+// HostKeys returns the keys of host in the known_hosts files
+func HostKeys(files []string, host string) ([]KeySpec, error) {
+	var keys []KeySpec
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for len(b) != 0 {
+			marker, hosts, pubKey, _, rest, err := ssh.ParseKnownHosts(b)
+			if err != nil {
+				// io.EOF or a malformed line
+				break
+			}
+			b = rest
+			if marker == "revoked" {
+				continue
+			}
+			matched := false
+			for _, h := range hosts {
+				if negated, ok := strings.CutPrefix(h, "!"); ok {
+					if matchHost(negated, host) {
+						matched = false
+						break
+					}
+					continue
+				}
+				if matchHost(h, host) {
+					matched = true
+				}
+			}
+			if !matched {
+				continue
+			}
+			ks := KeySpec{Key: pubKey, CA: marker == "cert-authority"}
+			if !containsKey(keys, ks) {
+				keys = append(keys, ks)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys found for %s", host)
+	}
+	return keys, nil
+}
+
+func containsKey(keys []KeySpec, ks KeySpec) bool {
+	for _, k := range keys {
+		if k.CA == ks.CA && bytes.Equal(k.Key.Marshal(), ks.Key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
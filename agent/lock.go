@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/askpass"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var SSH_TPM_AGENT_FORGET_PINS = "forget-pins@tpm-ssh-agent"
+
+// ForgetPINs forgets the cached PINs of the keys
+func (a *Agent) ForgetPINs() error {
+	slog.Debug("called forget pins")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, k := range a.keys {
+		k.ForgetUserauth()
+	}
+	return nil
+}
+
+// ForgetCachedPINs asks the agent to forget the cached PINs of its keys
+func ForgetCachedPINs(client sshagent.ExtendedAgent) error {
+	_, err := client.Extension(SSH_TPM_AGENT_FORGET_PINS, nil)
+	return err
+}
+
+// SetIdleLock locks the agent when no key was used for d. A locked agent
+// forgets the cached PINs and remembered confirmations, and the next use of a
+// key has to be confirmed through SSH_ASKPASS, or for TPM keys with a PIN by
+// entering the PIN again. A zero d never locks.
+func (a *Agent) SetIdleLock(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.idleLock = d
+	a.lastUse = time.Now()
+}
+
+// LockSession locks the agent like SetIdleLock does, for when the session of
+// the user is locked.
+func (a *Agent) LockSession() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.locked {
+		slog.Info("locking the agent with the session")
+		a.lock()
+	}
+}
+
+// UnlockSession unlocks the agent once the session of the user is unlocked.
+// The forgotten PINs are asked for again.
+func (a *Agent) UnlockSession() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.touch()
+}
+
+// lock forgets the cached PINs and remembered confirmations. a.mu must be
+// held.
+func (a *Agent) lock() {
+	a.locked = true
+	for _, k := range a.keys {
+		k.ForgetUserauth()
+	}
+	a.confirmed = nil
+}
+
+// isLocked reports if the agent is locked, and locks it when it became idle
+func (a *Agent) isLocked() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locked {
+		return true
+	}
+	if a.idleLock == 0 || time.Since(a.lastUse) < a.idleLock {
+		return false
+	}
+	slog.Info("locking the agent after being idle", slog.Duration("idle", time.Since(a.lastUse)))
+	a.lock()
+	return true
+}
+
+// touch marks a key as used now, unlocking the agent. a.mu must be held.
+func (a *Agent) touch() {
+	if a.locked {
+		slog.Info("unlocked the agent")
+	}
+	a.locked = false
+	a.lastUse = time.Now()
+}
+
+// wake asks the user to unlock the agent for the use of k if it's locked. k is
+// nil for the keys of providers and for sealing. TPM keys with a PIN unlock the
+// agent once the PIN is entered again.
+func (a *Agent) wake(ctx context.Context, k *key.SSHTPMKey) error {
+	if !a.isLocked() {
+		return nil
+	}
+	if k != nil && !k.EmptyAuth {
+		return nil
+	}
+	if a.isBatch() {
+		slog.Info("refusing to unlock the agent in batch mode")
+		return ErrInteractionRequired
+	}
+	ok, err := a.unlock(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLocked
+	}
+	a.mu.Lock()
+	a.touch()
+	a.mu.Unlock()
+	return nil
+}
+
+// askUnlock asks with SSH_ASKPASS to unlock the agent
+func askUnlock(ctx context.Context) (bool, error) {
+	answer, err := askpass.ReadPassphraseContext(ctx, "Unlock ssh-tpm-agent?", askpass.RP_USE_ASKPASS|askpass.RP_ASK_PERMISSION)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(answer, []byte("yes")), nil
+}
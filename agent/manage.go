@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	SSH_TPM_AGENT_CREATE = "create@tpm-ssh-agent"
+	SSH_TPM_AGENT_IMPORT = "import@tpm-ssh-agent"
+	SSH_TPM_AGENT_LIST   = "list@tpm-ssh-agent"
+)
+
+// CreateMsg is the request of the create extension. Algorithm is ecdsa or
+// rsa, Bits 0 is the default size.
+type CreateMsg struct {
+	Algorithm string
+	Bits      uint32
+	Comment   string
+	Userauth  []byte
+}
+
+// ImportMsg is the request of the import extension, PrivateKey is an ECDSA
+// or RSA key in PKCS #8 form.
+type ImportMsg struct {
+	PrivateKey []byte
+	Comment    string
+	Userauth   []byte
+}
+
+// KeyResponse contains the key file of a create or import request.
+type KeyResponse struct {
+	Type string `sshtype:"6"`
+	Key  []byte
+}
+
+// ListedKey is a TPM key of the agent, as returned by the list extension.
+// Stored keys were loaded from the keystore rather than added.
+type ListedKey struct {
+	KeyBlob      []byte
+	Comment      string
+	Stored       bool
+	Certificate  bool
+	Confirm      bool
+	LifetimeSecs uint32
+	Destinations uint32
+}
+
+type listedKeyMsg struct {
+	KeyBlob      []byte
+	Comment      string
+	Stored       bool
+	Certificate  bool
+	Confirm      bool
+	LifetimeSecs uint32
+	Destinations uint32
+	Rest         []byte `ssh:"rest"`
+}
+
+// ListResponse contains the keys of a list request, as consecutive ListedKey.
+type ListResponse struct {
+	Type string `sshtype:"6"`
+	Keys []byte `ssh:"rest"`
+}
+
+// Create creates a key in the TPM and returns its key file. The key isn't
+// added to the agent, the client adds it with its constraints.
+func (a *Agent) Create(req []byte) ([]byte, error) {
+	slog.Debug("called create")
+	var msg CreateMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+	if err := checkCreateMsg(&msg); err != nil {
+		return nil, err
+	}
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	k, err := a.create(ctx, &msg)
+	if err != nil {
+		return nil, err
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(KeyResponse{Key: b}), nil
+}
+
+// checkCreateMsg checks the algorithm of msg and fills in the default size
+func checkCreateMsg(msg *CreateMsg) error {
+	switch msg.Algorithm {
+	case "ecdsa":
+		if msg.Bits == 0 {
+			msg.Bits = 256
+		}
+	case "rsa":
+		if msg.Bits == 0 {
+			msg.Bits = 2048
+		}
+	default:
+		return fmt.Errorf("unsupported key algorithm %q", msg.Algorithm)
+	}
+	return nil
+}
+
+// create creates the key of a checked CreateMsg
+func (a *Agent) create(ctx context.Context, msg *CreateMsg) (*key.SSHTPMKey, error) {
+	alg := tpm2.TPMAlgECC
+	if msg.Algorithm == "rsa" {
+		alg = tpm2.TPMAlgRSA
+	}
+	var k *key.SSHTPMKey
+	ownerauth, err := a.op()
+	if err != nil {
+		return nil, err
+	}
+	err = a.queue.do(ctx, func() (err error) {
+		k, err = key.NewSSHTPMKeyWithOptions(a.tpm(), alg, int(msg.Bits), ownerauth,
+			&key.CreateOptions{Userauth: msg.Userauth},
+			keyfile.WithDescription(msg.Comment))
+		return err
+	})
+	return k, err
+}
+
+// Import imports a private key into the TPM and returns its key file. Like
+// Create the key isn't added to the agent.
+func (a *Agent) Import(req []byte) ([]byte, error) {
+	slog.Debug("called import")
+	var msg ImportMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(msg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	var toImport any
+	switch pk := pk.(type) {
+	case *ecdsa.PrivateKey:
+		toImport = *pk
+	case *rsa.PrivateKey:
+		if pk.N.BitLen() != 2048 {
+			return nil, errors.New("can only import 2048 bit RSA keys")
+		}
+		toImport = *pk
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pk)
+	}
+
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	var k *key.SSHTPMKey
+	ownerauth, err := a.op()
+	if err != nil {
+		return nil, err
+	}
+	err = a.queue.do(ctx, func() (err error) {
+		k, err = key.NewImportedSSHTPMKey(a.tpm(), toImport, ownerauth,
+			keyfile.WithUserAuth(msg.Userauth),
+			keyfile.WithDescription(msg.Comment))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(KeyResponse{Key: b}), nil
+}
+
+// ListTPMKeys lists the TPM keys of the agent with their constraints, the
+// keys of the proxied agents are left out.
+func (a *Agent) ListTPMKeys() ([]byte, error) {
+	slog.Debug("called list")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var keys []byte
+	for _, k := range a.keys {
+		pk, err := k.SSHPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		lk := ListedKey{
+			KeyBlob:     pk.Marshal(),
+			Comment:     k.Description,
+			Stored:      a.stored[k.Fingerprint()],
+			Certificate: k.Certificate != nil,
+		}
+		if c := a.constraints[k.Fingerprint()]; c != nil {
+			lk.Confirm = c.confirm
+			lk.LifetimeSecs = uint32(c.lifetime.Seconds())
+			lk.Destinations = uint32(len(c.destinations))
+		}
+		keys = append(keys, ssh.Marshal(lk)...)
+	}
+	return ssh.Marshal(ListResponse{Keys: keys}), nil
+}
+
+// CreateKey creates a key through the agent and returns it.
+func CreateKey(client sshagent.ExtendedAgent, msg *CreateMsg) (*key.SSHTPMKey, error) {
+	return keyRequest(client, SSH_TPM_AGENT_CREATE, ssh.Marshal(msg))
+}
+
+// ImportKey imports a private key through the agent and returns the TPM key.
+func ImportKey(client sshagent.ExtendedAgent, msg *ImportMsg) (*key.SSHTPMKey, error) {
+	return keyRequest(client, SSH_TPM_AGENT_IMPORT, ssh.Marshal(msg))
+}
+
+func keyRequest(client sshagent.ExtendedAgent, extension string, req []byte) (*key.SSHTPMKey, error) {
+	b, err := client.Extension(extension, req)
+	if err != nil {
+		return nil, err
+	}
+	var rsp KeyResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed %s response: %w", extension, err)
+	}
+	return key.Decode(rsp.Key)
+}
+
+// ListKeys lists the TPM keys of the agent.
+func ListKeys(client sshagent.ExtendedAgent) ([]ListedKey, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_LIST, nil)
+	if err != nil {
+		return nil, err
+	}
+	var rsp ListResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed list response: %w", err)
+	}
+	var keys []ListedKey
+	for rest := rsp.Keys; len(rest) != 0; {
+		var lk listedKeyMsg
+		if err := ssh.Unmarshal(rest, &lk); err != nil {
+			return nil, fmt.Errorf("malformed list response: %w", err)
+		}
+		keys = append(keys, ListedKey{
+			KeyBlob:      lk.KeyBlob,
+			Comment:      lk.Comment,
+			Stored:       lk.Stored,
+			Certificate:  lk.Certificate,
+			Confirm:      lk.Confirm,
+			LifetimeSecs: lk.LifetimeSecs,
+			Destinations: lk.Destinations,
+		})
+		rest = lk.Rest
+	}
+	return keys, nil
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/askpass"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Prompter asks the user for the PIN of a key, and to confirm the use of
+// keys added with confirmation. ctx is done when the request times out. The
+// agent wipes the returned PIN after use, so it has to be a copy the prompter
+// doesn't keep.
+type Prompter interface {
+	PIN(ctx context.Context, k *key.SSHTPMKey) ([]byte, error)
+	Confirm(ctx context.Context, k *key.SSHTPMKey) (bool, error)
+}
+
+// AskpassPrompter prompts with SSH_ASKPASS. The PIN is cached in the key
+// until the TPM rejects it or TTL passes, unless NoCache is set.
+type AskpassPrompter struct {
+	NoCache bool
+	TTL     time.Duration
+}
+
+var _ Prompter = &AskpassPrompter{}
+
+func (p *AskpassPrompter) PIN(ctx context.Context, k *key.SSHTPMKey) ([]byte, error) {
+	// SSHKeySigner in signer/signer.go resets the cached PIN if we get a
+	// TPMRCAuthFail
+	if auth := k.CachedUserauth(); len(auth) != 0 {
+		slog.Debug("providing cached userauth for key", slog.String("desc", k.Description))
+		return auth, nil
+	}
+	keyInfo := fmt.Sprintf("Enter passphrase for (%s): ", k.Description)
+	userauth, err := askpass.ReadPassphraseContext(ctx, keyInfo, askpass.RP_USE_ASKPASS)
+	if !p.NoCache && err == nil {
+		slog.Debug("caching userauth for key", slog.String("desc", k.Description))
+		k.CacheUserauth(userauth, p.TTL)
+	}
+	return userauth, err
+}
+
+func (p *AskpassPrompter) Confirm(ctx context.Context, _ *key.SSHTPMKey) (bool, error) {
+	return askpass.AskPermissionContext(ctx)
+}
+
+// pinPrompter is the PIN callback of NewAgent
+type pinPrompter func(*key.SSHTPMKey) ([]byte, error)
+
+func (p pinPrompter) PIN(_ context.Context, k *key.SSHTPMKey) ([]byte, error) {
+	// the callback may return the same PIN each time
+	pin, err := p(k)
+	return bytes.Clone(pin), err
+}
+
+func (p pinPrompter) Confirm(ctx context.Context, _ *key.SSHTPMKey) (bool, error) {
+	return askpass.AskPermissionContext(ctx)
+}
+
+type options struct {
+	listeners      []net.Listener
+	providers      []Provider
+	tpm            tpmconn.Opener
+	ownerPassword  func() ([]byte, error)
+	prompter       Prompter
+	keystore       keystore.Keystore
+	requestTimeout time.Duration
+	tpmIdleTimeout time.Duration
+}
+
+// Option configures an agent made with New
+type Option func(*options)
+
+// WithListener serves the agent on l, until the agent is stopped. It can be
+// given more than once. Sockets in the abstract namespace only accept
+// connections from the user of the agent.
+func WithListener(l net.Listener) Option {
+	return func(o *options) { o.listeners = append(o.listeners, l) }
+}
+
+// WithFallbackAgents lists the keys of agents along with the TPM keys, and
+// uses them for the keys which aren't TPM keys.
+func WithFallbackAgents(agents ...agent.ExtendedAgent) Option {
+	return func(o *options) { o.providers = append(o.providers, fallbackProviders(agents)...) }
+}
+
+// WithProvider serves the keys of p after the TPM keys, see RegisterProvider.
+// It can be given more than once.
+func WithProvider(p Provider) Option {
+	return func(o *options) { o.providers = append(o.providers, p) }
+}
+
+// WithTPM sets how the agent gets the TPM. It's required.
+func WithTPM(tpm tpmconn.Opener) Option {
+	return func(o *options) { o.tpm = tpm }
+}
+
+// WithOwnerPassword sets the callback returning the owner hierarchy
+// password. By default it's empty.
+func WithOwnerPassword(f func() ([]byte, error)) Option {
+	return func(o *options) { o.ownerPassword = f }
+}
+
+// WithPrompter sets how the agent asks for PINs and confirmations. By
+// default it's an AskpassPrompter.
+func WithPrompter(p Prompter) Option {
+	return func(o *options) { o.prompter = p }
+}
+
+// WithKeystore loads the keys of ks when the agent is made. See
+// WatchKeystore for reloading them when they change.
+func WithKeystore(ks keystore.Keystore) Option {
+	return func(o *options) { o.keystore = ks }
+}
+
+// WithRequestTimeout is SetRequestTimeout, by default DefaultRequestTimeout
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *options) { o.requestTimeout = d }
+}
+
+// WithTPMIdleTimeout is SetTPMIdleTimeout
+func WithTPMIdleTimeout(d time.Duration) Option {
+	return func(o *options) { o.tpmIdleTimeout = d }
+}
+
+// New makes an agent and starts serving it on the listeners, for embedding
+// the agent into other programs. Only WithTPM is required.
+func New(opts ...Option) (*Agent, error) {
+	o := &options{
+		ownerPassword:  func() ([]byte, error) { return []byte(""), nil },
+		prompter:       &AskpassPrompter{},
+		requestTimeout: DefaultRequestTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.tpm == nil {
+		return nil, errors.New("agent needs a tpm, see WithTPM")
+	}
+	a := newAgent(o)
+	if o.keystore != nil {
+		if err := a.LoadKeystore(o.keystore); err != nil {
+			a.Stop()
+			return nil, err
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+)
+
+func peerUID(c *net.UnixConn) (int, error) {
+	return 0, errors.New("peer credentials are only supported on linux")
+}
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/google/go-tpm/tpm2"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var SSH_TPM_AGENT_PING = "ping@tpm-ssh-agent"
+
+// PingResponse is returned when the agent could talk to the TPM.
+type PingResponse struct {
+	Type string `sshtype:"6"`
+}
+
+// Ping runs a trivial TPM command to check that the TPM is usable.
+func (a *Agent) Ping() ([]byte, error) {
+	slog.Debug("called ping")
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	err := a.queue.do(ctx, func() error {
+		_, err := tpm2.GetRandom{BytesRequested: 8}.Execute(a.tpm())
+		return err
+	})
+	if err != nil {
+		slog.Error("ping failed", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("tpm is not responding: %w", err)
+	}
+	return ssh.Marshal(PingResponse{}), nil
+}
+
+// PingAgent checks that the agent answers requests and can use the TPM.
+func PingAgent(client sshagent.ExtendedAgent) error {
+	if _, err := client.List(); err != nil {
+		return fmt.Errorf("listing keys: %w", err)
+	}
+	b, err := client.Extension(SSH_TPM_AGENT_PING, nil)
+	if err != nil {
+		return fmt.Errorf("agent could not use the tpm: %w", err)
+	}
+	var rsp PingResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return fmt.Errorf("malformed ping response: %w", err)
+	}
+	return nil
+}
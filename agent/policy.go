@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var SSH_TPM_AGENT_POLICY = "policy@tpm-ssh-agent"
+
+// PolicyResponse describes the policy of the agent. Serial is 0 without a
+// policy.
+type PolicyResponse struct {
+	Type        string `sshtype:"6"`
+	Serial      uint64
+	Algorithms  []string
+	Confirm     bool
+	ConfirmKeys []string
+	RenewalURL  string
+}
+
+// checkPolicy returns ErrKeyNotAllowed if p doesn't allow the type of k
+func checkPolicy(p *keystore.Policy, k *key.SSHTPMKey) error {
+	pk, err := k.SSHPublicKey()
+	if err != nil {
+		return err
+	}
+	if !p.Allows(pk) {
+		return fmt.Errorf("%s: %w", k.Fingerprint(), ErrKeyNotAllowed)
+	}
+	return nil
+}
+
+// SetPolicy applies the policy to the keys of the agent. Policies with a
+// lower serial than the current one are rejected.
+func (a *Agent) SetPolicy(p *keystore.Policy) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	next, err := a.policy.Update(p)
+	if err != nil {
+		return err
+	}
+	a.policy = next
+	return nil
+}
+
+// WatchPolicy fetches the policy every interval until the agent is stopped.
+// Failing fetches keep the current policy. saved is called with each new
+// policy.
+func (a *Agent) WatchPolicy(fetch func() (*keystore.Policy, error), interval time.Duration, saved func(*keystore.Policy)) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-a.quit:
+				return
+			case <-t.C:
+			}
+			p, err := fetch()
+			if err != nil {
+				slog.Error("failed fetching policy", slog.String("error", err.Error()))
+				continue
+			}
+			a.mu.Lock()
+			current := a.policy
+			a.mu.Unlock()
+			if current != nil && current.Serial == p.Serial {
+				continue
+			}
+			if err := a.SetPolicy(p); err != nil {
+				slog.Error("not applying policy", slog.String("error", err.Error()))
+				continue
+			}
+			slog.Info("applied new policy", slog.Uint64("serial", p.Serial))
+			saved(p)
+		}
+	}()
+}
+
+func (a *Agent) Policy() ([]byte, error) {
+	slog.Debug("called policy")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rsp := PolicyResponse{}
+	if p := a.policy; p != nil {
+		rsp.Serial = p.Serial
+		rsp.Algorithms = p.Algorithms
+		rsp.Confirm = p.Confirm
+		rsp.ConfirmKeys = p.ConfirmKeys
+		rsp.RenewalURL = p.RenewalURL
+	}
+	return ssh.Marshal(rsp), nil
+}
+
+// QueryPolicy asks the agent for its policy
+func QueryPolicy(client sshagent.ExtendedAgent) (*PolicyResponse, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_POLICY, nil)
+	if err != nil {
+		return nil, err
+	}
+	var rsp PolicyResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed policy response: %w", err)
+	}
+	return &rsp, nil
+}
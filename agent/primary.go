@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+)
+
+// AddPrimaryKeys creates the primary keys with the given names and adds them
+// to the agent. They are recreated from the TPM seed and aren't stored
+// anywhere, so the agent has to be told their names each time it starts.
+func (a *Agent) AddPrimaryKeys(names []string) error {
+	slog.Debug("called addprimarykeys")
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	var keys []*key.SSHTPMKey
+	ownerauth, err := a.op()
+	if err != nil {
+		return err
+	}
+	err = a.queue.do(ctx, func() error {
+		for _, name := range names {
+			k, err := key.NewPrimary(a.tpm(), ownerauth, name)
+			if err != nil {
+				return fmt.Errorf("primary key %s: %w", name, err)
+			}
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = append(a.keys, keys...)
+	a.keySigners = nil
+	return nil
+}
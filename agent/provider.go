@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Provider is a source of keys the agent serves. The TPM keys are the first
+// provider, the fallback agents and registered providers come after them in
+// order. SignWithFlags and Remove are only called for keys the provider
+// listed.
+//
+// Providers also implementing Signers or RemoveAll, like agent.ExtendedAgent,
+// are used for Agent.Signers and Agent.RemoveAll.
+type Provider interface {
+	List() ([]*agent.Key, error)
+	SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error)
+	Add(key agent.AddedKey) error
+	Remove(key ssh.PublicKey) error
+}
+
+// tpmProvider is the provider of the TPM keys of the agent. The TPM is
+// scheduled fairly between clients.
+type tpmProvider struct {
+	a      *Agent
+	client uint64
+	// host key fingerprint signatures are made for, if known
+	destination string
+}
+
+var _ Provider = &tpmProvider{}
+
+func (p *tpmProvider) List() ([]*agent.Key, error) {
+	return p.a.listTPM()
+}
+
+func (p *tpmProvider) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return p.a.signTPM(p.client, p.destination, key, data, flags)
+}
+
+// Add refuses keys, TPM keys are added with the SSH_TPM_AGENT_ADD extension
+func (p *tpmProvider) Add(agent.AddedKey) error {
+	return errors.New("tpm keys are added with ssh-tpm-add")
+}
+
+func (p *tpmProvider) Remove(key ssh.PublicKey) error {
+	return p.a.removeTPM(key)
+}
+
+// fallbackProviders returns agents as providers
+func fallbackProviders(agents []agent.ExtendedAgent) []Provider {
+	providers := make([]Provider, 0, len(agents))
+	for _, ag := range agents {
+		providers = append(providers, ag)
+	}
+	return providers
+}
+
+// RegisterProvider serves the keys of p after the TPM keys and the providers
+// registered before it.
+func (a *Agent) RegisterProvider(p Provider) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.providers = append(a.providers, p)
+}
+
+// allProviders returns the TPM keys of client signing for destination
+// followed by the registered providers
+func (a *Agent) allProviders(client uint64, destination string) []Provider {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Provider{&tpmProvider{a, client, destination}}, a.providers...)
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var SSH_TPM_AGENT_QUOTE = "quote@tpm-ssh-agent"
+
+// QuoteMsg is the request of the quote extension. PCRMask selects the SHA-256
+// PCRs to quote, bit n being PCR n, and Nonce is the qualifying data of the
+// quote.
+type QuoteMsg struct {
+	PCRMask uint32
+	Nonce   []byte
+}
+
+// QuoteResponse contains the PEM encoded key.Quote of a quote request.
+type QuoteResponse struct {
+	Type  string `sshtype:"6"`
+	Quote []byte
+}
+
+// Quote returns a TPM2_Quote of the PCRs signed by the attestation key.
+func (a *Agent) Quote(req []byte) ([]byte, error) {
+	slog.Debug("called quote")
+	var msg QuoteMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	var q *key.Quote
+	err := a.queue.do(ctx, func() error {
+		var err error
+		q, err = key.NewQuote(a.tpm(), pcrsFromMask(msg.PCRMask), msg.Nonce)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(QuoteResponse{Quote: q.Bytes()}), nil
+}
+
+// QuotePCRs asks the agent for a quote of the PCRs in mask. The quote is not
+// verified, the caller checks it with key.Quote.Verify and the nonce.
+func QuotePCRs(client sshagent.ExtendedAgent, mask uint32, nonce []byte) (*key.Quote, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_QUOTE, ssh.Marshal(QuoteMsg{PCRMask: mask, Nonce: nonce}))
+	if err != nil {
+		return nil, err
+	}
+	var rsp QuoteResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed quote response: %w", err)
+	}
+	return key.DecodeQuote(rsp.Quote)
+}
@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"slices"
+)
+
+// SSH_TPM_AGENT_READ_ONLY is advertised by the capabilities extension in
+// place of the writeExtensions when the keystore is read-only. It can't be
+// called.
+var SSH_TPM_AGENT_READ_ONLY = "read-only@tpm-ssh-agent"
+
+// writeExtensions add keys to the agent or make keys for the keystore, they
+// are refused when it is read-only
+var writeExtensions = []string{
+	SSH_TPM_AGENT_ADD,
+	SSH_TPM_AGENT_CREATE,
+	SSH_TPM_AGENT_CREATE_ASYNC,
+	SSH_TPM_AGENT_IMPORT,
+}
+
+// SetReadOnly makes the agent treat the keystore as read-only, for machine
+// keys provisioned on an immutable image. The agent then refuses to add,
+// create and import keys, and keeps the keys of the keystore when asked to
+// remove them.
+func (a *Agent) SetReadOnly(readOnly bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.readOnly = readOnly
+}
+
+func (a *Agent) isReadOnly() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.readOnly
+}
+
+// refused reports if the extension is refused as the keystore is read-only
+func (a *Agent) refused(extensionType string) bool {
+	return slices.Contains(writeExtensions, extensionType) && a.isReadOnly()
+}
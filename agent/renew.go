@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"golang.org/x/crypto/ssh"
+)
+
+// RenewFunc asks the CA at url for a new certificate for cert, proving
+// possession of the certified key with signer.
+type RenewFunc func(ctx context.Context, url string, cert *ssh.Certificate, signer ssh.AlgorithmSigner) (*ssh.Certificate, error)
+
+// RenewInterval is how often certificates are checked for renewal
+var RenewInterval = time.Minute
+
+// needsRenewal reports if less than a fifth of the lifetime of cert is left
+// at t. Certificates without an expiry are never renewed.
+func needsRenewal(cert *ssh.Certificate, t time.Time) bool {
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return false
+	}
+	lifetime := int64(cert.ValidBefore) - int64(cert.ValidAfter)
+	return t.Unix() > int64(cert.ValidBefore)-lifetime/5
+}
+
+// queuedSigner signs with key through the TPM queue of the agent
+type queuedSigner struct {
+	ssh.AlgorithmSigner
+	ctx   context.Context
+	agent *Agent
+	key   *key.SSHTPMKey
+}
+
+func (s *queuedSigner) Sign(r io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(r, data, "")
+}
+
+func (s *queuedSigner) SignWithAlgorithm(r io.Reader, data []byte, alg string) (sig *ssh.Signature, err error) {
+	auth, ownerauth, err := s.agent.keyAuth(s.key)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(auth)
+	as, err := s.agent.authSigner(s.key, ownerauth, auth)
+	if err != nil {
+		return nil, err
+	}
+	err = s.agent.queue.do(s.ctx, func() (err error) {
+		sig, err = as.SignWithAlgorithm(r, data, alg)
+		return err
+	})
+	return sig, err
+}
+
+// RenewCertificates renews the certificates of the loaded keys which are
+// close to expiry, at url or the renewal URL of the policy.
+func (a *Agent) RenewCertificates(url string, renew RenewFunc) {
+	a.mu.Lock()
+	if url == "" && a.policy != nil {
+		url = a.policy.RenewalURL
+	}
+	if url == "" {
+		a.mu.Unlock()
+		return
+	}
+	keySigners, err := a.tpmSigners()
+	if err != nil {
+		a.mu.Unlock()
+		slog.Error("failed renewing certificates", slog.String("error", err.Error()))
+		return
+	}
+	var keys []*key.SSHTPMKey
+	var certs []*ssh.Certificate
+	var signers []ssh.Signer
+	for i, k := range a.keys {
+		if k.Certificate == nil || !needsRenewal(k.Certificate, time.Now()) || a.validity(k) != nil {
+			continue
+		}
+		keys = append(keys, k)
+		certs = append(certs, k.Certificate)
+		signers = append(signers, keySigners[i])
+	}
+	a.mu.Unlock()
+
+	for i, k := range keys {
+		if err := a.renewCertificate(url, renew, k, certs[i], signers[i]); err != nil {
+			slog.Error("failed renewing certificate",
+				slog.String("key", k.Fingerprint()),
+				slog.String("error", err.Error()))
+			continue
+		}
+		slog.Info("renewed certificate", slog.String("key", k.Fingerprint()))
+	}
+}
+
+// renewCertificate replaces old with a certificate from renew in the keys of
+// the agent
+func (a *Agent) renewCertificate(url string, renew RenewFunc, k *key.SSHTPMKey, old *ssh.Certificate, s ssh.Signer) error {
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	cert, err := renew(ctx, url, old, &queuedSigner{s.(ssh.AlgorithmSigner), ctx, a, k})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.Key.Marshal(), old.Key.Marshal()) {
+		return errors.New("renewed certificate is for another key")
+	}
+	if cert.ValidBefore <= old.ValidBefore {
+		return errors.New("renewed certificate doesn't expire later")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, k := range a.keys {
+		// the key may have been added again with another certificate
+		if k.Certificate == old {
+			k.Certificate = cert
+		}
+	}
+	return nil
+}
+
+// WatchCertificates renews the certificates of the loaded keys every
+// RenewInterval until the agent is stopped.
+func (a *Agent) WatchCertificates(url string, renew RenewFunc) {
+	a.everyRenewInterval(func() { a.RenewCertificates(url, renew) })
+}
+
+// CertifyFunc asks a CA to sign pub, which it does without a proof of
+// possession of the key.
+type CertifyFunc func(ctx context.Context, pub ssh.PublicKey) (*ssh.Certificate, error)
+
+// CertifyKeys gets certificates from certify for the loaded keys without a
+// certificate, or with one close to expiry.
+func (a *Agent) CertifyKeys(certify CertifyFunc) {
+	a.mu.Lock()
+	keySigners, err := a.tpmSigners()
+	if err != nil {
+		a.mu.Unlock()
+		slog.Error("failed certifying keys", slog.String("error", err.Error()))
+		return
+	}
+	var keys []*key.SSHTPMKey
+	var certs []*ssh.Certificate
+	var pubs []ssh.PublicKey
+	for i, k := range a.keys {
+		if (k.Certificate != nil && !needsRenewal(k.Certificate, time.Now())) || a.validity(k) != nil {
+			continue
+		}
+		keys = append(keys, k)
+		certs = append(certs, k.Certificate)
+		pubs = append(pubs, keySigners[i].PublicKey())
+	}
+	a.mu.Unlock()
+
+	for i, k := range keys {
+		if err := a.certifyKey(certify, k, certs[i], pubs[i]); err != nil {
+			slog.Error("failed certifying key",
+				slog.String("key", k.Fingerprint()),
+				slog.String("error", err.Error()))
+			continue
+		}
+		slog.Info("certified key", slog.String("key", k.Fingerprint()))
+	}
+}
+
+// certifyKey sets the certificate of k from certify, unless k got another
+// certificate than old meanwhile
+func (a *Agent) certifyKey(certify CertifyFunc, k *key.SSHTPMKey, old *ssh.Certificate, pub ssh.PublicKey) error {
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	cert, err := certify(ctx, pub)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.Key.Marshal(), pub.Marshal()) {
+		return errors.New("certificate is for another key")
+	}
+	if old != nil && cert.ValidBefore <= old.ValidBefore {
+		return errors.New("certificate doesn't expire later")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if k.Certificate == old {
+		k.Certificate = cert
+	}
+	return nil
+}
+
+// WatchCertify certifies the loaded keys with CertifyKeys every
+// RenewInterval until the agent is stopped.
+func (a *Agent) WatchCertify(certify CertifyFunc) {
+	a.everyRenewInterval(func() { a.CertifyKeys(certify) })
+}
+
+// everyRenewInterval runs f now and every RenewInterval until the agent is
+// stopped
+func (a *Agent) everyRenewInterval(f func()) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		t := time.NewTicker(RenewInterval)
+		defer t.Stop()
+		for {
+			f()
+			select {
+			case <-a.quit:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
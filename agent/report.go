@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/foxboron/ssh-tpm-agent/utils"
+)
+
+// ReportTPM runs the self test of the TPM, logs what it is and supports, and
+// warns about keys of the agent the TPM can't use, so they don't only fail at
+// the first signature.
+func (a *Agent) ReportTPM() error {
+	slog.Debug("called reporttpm")
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	var info *utils.TPMInfo
+	err := a.queue.do(ctx, func() (err error) {
+		// Only tests what wasn't tested yet, the full test can take seconds
+		if err := utils.SelfTest(a.tpm(), false); err != nil {
+			return fmt.Errorf("tpm self test failed: %w", err)
+		}
+		info, err = utils.ReadTPMInfo(a.tpm())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("tpm",
+		slog.String("manufacturer", info.Manufacturer),
+		slog.String("firmware", info.FirmwareVersion),
+		slog.Any("ecc", info.ECCBits),
+		slog.Bool("rsa", info.RSA),
+		slog.Bool("sha256_pcrs", info.SHA256PCR),
+		slog.Uint64("lockout_counter", uint64(info.LockoutCounter)),
+		slog.Uint64("max_auth_fail", uint64(info.MaxAuthFail)),
+	)
+	if info.InLockout {
+		slog.Warn("tpm is in dictionary attack lockout, keys with a pin can't be used",
+			slog.Uint64("lockout_counter", uint64(info.LockoutCounter)))
+	}
+
+	a.mu.Lock()
+	keys := slices.Clone(a.keys)
+	a.mu.Unlock()
+	for _, k := range keys {
+		if missing := info.Missing(k); missing != "" {
+			slog.Warn("tpm doesn't support a key",
+				slog.String("key", k.Fingerprint()),
+				slog.String("desc", k.Description),
+				slog.String("missing", missing))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var SSH_RESTRICT_DESTINATION = "restrict-destination-v00@openssh.com"
+
+var ErrKeyRestricted = errors.New("key is not permitted for this destination")
+
+// KeySpec is a host key, or a certificate authority for host certificates,
+// of a hop in a destination constraint.
+type KeySpec struct {
+	Key ssh.PublicKey
+	CA  bool
+}
+
+// Hop is one side of a destination constraint. An empty Hostname as the From
+// of a constraint is the local machine.
+type Hop struct {
+	User     string
+	Hostname string
+	Keys     []KeySpec
+}
+
+// DestinationConstraint permits the use of a key on the connection from From
+// to To. See restrict-destination-v00@openssh.com in the OpenSSH
+// PROTOCOL.agent.
+type DestinationConstraint struct {
+	From Hop
+	To   Hop
+}
+
+type keySpecMsg struct {
+	KeyBlob []byte
+	CA      bool
+	Rest    []byte `ssh:"rest"`
+}
+
+type hopMsg struct {
+	User     string
+	Hostname string
+	Reserved []byte
+	Rest     []byte `ssh:"rest"`
+}
+
+type destinationMsg struct {
+	From     []byte
+	To       []byte
+	Reserved []byte
+}
+
+func (h *Hop) marshal() []byte {
+	var keys []byte
+	for _, k := range h.Keys {
+		keys = append(keys, ssh.Marshal(keySpecMsg{KeyBlob: k.Key.Marshal(), CA: k.CA})...)
+	}
+	return ssh.Marshal(hopMsg{User: h.User, Hostname: h.Hostname, Rest: keys})
+}
+
+func parseHop(b []byte) (Hop, error) {
+	var msg hopMsg
+	if err := ssh.Unmarshal(b, &msg); err != nil {
+		return Hop{}, err
+	}
+	if len(msg.Reserved) != 0 {
+		return Hop{}, errors.New("unsupported destination constraint extensions")
+	}
+	h := Hop{User: msg.User, Hostname: msg.Hostname}
+	for rest := msg.Rest; len(rest) != 0; {
+		var ks keySpecMsg
+		if err := ssh.Unmarshal(rest, &ks); err != nil {
+			return Hop{}, err
+		}
+		k, err := ssh.ParsePublicKey(ks.KeyBlob)
+		if err != nil {
+			return Hop{}, err
+		}
+		h.Keys = append(h.Keys, KeySpec{Key: k, CA: ks.CA})
+		rest = ks.Rest
+	}
+	return h, nil
+}
+
+// DestinationConstraintExtension returns the constraint extension restricting
+// a key to dcs, to be used in agent.AddedKey.ConstraintExtensions.
+func DestinationConstraintExtension(dcs []DestinationConstraint) sshagent.ConstraintExtension {
+	var details []byte
+	for _, dc := range dcs {
+		msg := destinationMsg{From: dc.From.marshal(), To: dc.To.marshal()}
+		details = append(details, ssh.Marshal(struct{ B []byte }{ssh.Marshal(msg)})...)
+	}
+	return sshagent.ConstraintExtension{
+		ExtensionName:    SSH_RESTRICT_DESTINATION,
+		ExtensionDetails: details,
+	}
+}
+
+func parseDestinationConstraints(details []byte) ([]DestinationConstraint, error) {
+	var dcs []DestinationConstraint
+	for len(details) != 0 {
+		var wrapped struct {
+			B    []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(details, &wrapped); err != nil {
+			return nil, err
+		}
+		var msg destinationMsg
+		if err := ssh.Unmarshal(wrapped.B, &msg); err != nil {
+			return nil, err
+		}
+		from, err := parseHop(msg.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseHop(msg.To)
+		if err != nil {
+			return nil, err
+		}
+		if from.User != "" {
+			return nil, errors.New("destination constraint with a from user")
+		}
+		if from.Hostname != "" && len(from.Keys) == 0 {
+			return nil, fmt.Errorf("destination constraint from %s without host keys", from.Hostname)
+		}
+		if to.Hostname == "" || len(to.Keys) == 0 {
+			return nil, errors.New("destination constraint without a destination")
+		}
+		dcs = append(dcs, DestinationConstraint{From: from, To: to})
+		details = wrapped.Rest
+	}
+	return dcs, nil
+}
+
+// match reports if the host key k belongs to the hop
+func (h *Hop) match(k ssh.PublicKey) bool {
+	for _, ks := range h.Keys {
+		if !ks.CA {
+			if bytes.Equal(ks.Key.Marshal(), k.Marshal()) {
+				return true
+			}
+			continue
+		}
+		cert, ok := k.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.HostCert || !bytes.Equal(cert.SignatureKey.Marshal(), ks.Key.Marshal()) {
+			continue
+		}
+		checker := ssh.CertChecker{}
+		if checker.CheckCert(h.Hostname, cert) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// permittedHop reports if a constraint permits the hop from the host key from
+// to the host key to, for user. A nil from is the local machine, a nil to and
+// an empty user match any destination.
+func permittedHop(dcs []DestinationConstraint, from, to ssh.PublicKey, user string) bool {
+	for _, dc := range dcs {
+		if from == nil {
+			if dc.From.Hostname != "" || len(dc.From.Keys) != 0 {
+				continue
+			}
+		} else if !dc.From.match(from) {
+			continue
+		}
+		if to != nil && !dc.To.match(to) {
+			continue
+		}
+		if dc.To.User != "" && user != "" && !matchPattern(user, dc.To.User) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// matchPattern reports if s matches the pattern, where * matches any run of
+// characters and ? any single one, like match_pattern of OpenSSH. There is no
+// escaping or character classes.
+func matchPattern(s, pattern string) bool {
+	for {
+		if pattern == "" {
+			return s == ""
+		}
+		if pattern[0] == '*' {
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := range len(s) {
+				if (pattern[0] == '?' || s[i] == pattern[0]) && matchPattern(s[i+1:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if s == "" || (pattern[0] != '?' && pattern[0] != s[0]) {
+			return false
+		}
+		s, pattern = s[1:], pattern[1:]
+	}
+}
+
+// userauthRequest is the data signed for publickey user authentication, see
+// RFC 4252 section 7 and publickey-hostbound-v00@openssh.com in the OpenSSH
+// PROTOCOL.
+type userauthRequest struct {
+	SessionID []byte
+	Msg       uint8
+	User      string
+	Service   string
+	Method    string
+	HasSig    bool
+	Algo      string
+	PubKey    []byte
+	Rest      []byte `ssh:"rest"`
+}
+
+const msgUserAuthRequest = 50
+
+// parseUserauth returns the userauth request in data and the host key of
+// publickey-hostbound requests.
+func parseUserauth(data []byte) (*userauthRequest, ssh.PublicKey, error) {
+	var req userauthRequest
+	if err := ssh.Unmarshal(data, &req); err != nil {
+		return nil, nil, err
+	}
+	if len(req.SessionID) == 0 || req.Msg != msgUserAuthRequest || req.Service != "ssh-connection" || !req.HasSig {
+		return nil, nil, errors.New("not a userauth request")
+	}
+	switch req.Method {
+	case "publickey":
+		if len(req.Rest) != 0 {
+			return nil, nil, errors.New("trailing data in userauth request")
+		}
+		return &req, nil, nil
+	case "publickey-hostbound-v00@openssh.com":
+		var hb struct {
+			HostKey []byte
+			Rest    []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(req.Rest, &hb); err != nil {
+			return nil, nil, err
+		}
+		if len(hb.Rest) != 0 {
+			return nil, nil, errors.New("trailing data in userauth request")
+		}
+		hostKey, err := ssh.ParsePublicKey(hb.HostKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &req, hostKey, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported userauth method %s", req.Method)
+}
@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	SSH_TPM_AGENT_SEAL   = "seal@tpm-ssh-agent"
+	SSH_TPM_AGENT_UNSEAL = "unseal@tpm-ssh-agent"
+)
+
+// SealMsg is the request of the seal extension. PCRMask selects the PCRs the
+// secret is bound to, bit n being PCR n.
+type SealMsg struct {
+	Secret  []byte
+	PCRMask uint32
+	Confirm bool
+	Comment string
+}
+
+// SealResponse contains the sealed key file of a seal request.
+type SealResponse struct {
+	Type string `sshtype:"6"`
+	Key  []byte
+}
+
+// UnsealMsg is the request of the unseal extension.
+type UnsealMsg struct {
+	Key []byte
+}
+
+// UnsealResponse contains the secret of a unseal request.
+type UnsealResponse struct {
+	Type   string `sshtype:"6"`
+	Secret []byte
+}
+
+func pcrsFromMask(mask uint32) []uint {
+	var pcrs []uint
+	for i := uint(0); i < 32; i++ {
+		if mask&(1<<i) != 0 {
+			pcrs = append(pcrs, i)
+		}
+	}
+	return pcrs
+}
+
+func (a *Agent) Seal(req []byte) ([]byte, error) {
+	slog.Debug("called seal")
+	var msg SealMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := a.requestContext()
+	defer cancel()
+	if err := a.wake(ctx, nil); err != nil {
+		return nil, err
+	}
+	var k *key.SSHTPMKey
+	ownerauth, err := a.op()
+	if err != nil {
+		return nil, err
+	}
+	err = a.queue.do(ctx, func() (err error) {
+		k, err = key.Seal(a.tpm(), ownerauth, msg.Secret, &key.SealOptions{
+			PCRs:    pcrsFromMask(msg.PCRMask),
+			Confirm: msg.Confirm,
+		}, keyfile.WithDescription(msg.Comment))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := k.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(SealResponse{Key: b}), nil
+}
+
+func (a *Agent) Unseal(req []byte) ([]byte, error) {
+	slog.Debug("called unseal")
+	var msg UnsealMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return nil, err
+	}
+
+	k, err := key.Decode(msg.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := a.requestContext()
+	defer cancel()
+
+	// sealed keys have no PIN, a locked agent is unlocked first
+	if err := a.wake(ctx, k); err != nil {
+		return nil, err
+	}
+	if k.NeedsConfirm() {
+		ok, err := a.askConfirm(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("unseal was not confirmed")
+		}
+	}
+
+	var secret []byte
+	ownerauth, err := a.op()
+	if err != nil {
+		return nil, err
+	}
+	err = a.queue.do(ctx, func() (err error) {
+		secret, err = k.Unseal(a.tpm(), ownerauth, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(UnsealResponse{Secret: secret}), nil
+}
+
+// SealSecret seals the secret through the agent and returns the sealed key
+// file.
+func SealSecret(client sshagent.ExtendedAgent, msg *SealMsg) ([]byte, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_SEAL, ssh.Marshal(msg))
+	if err != nil {
+		return nil, err
+	}
+	var rsp SealResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed seal response: %w", err)
+	}
+	return rsp.Key, nil
+}
+
+// UnsealSecret returns the secret of a sealed key file through the agent.
+func UnsealSecret(client sshagent.ExtendedAgent, sealed []byte) ([]byte, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_UNSEAL, ssh.Marshal(UnsealMsg{Key: sealed}))
+	if err != nil {
+		return nil, err
+	}
+	var rsp UnsealResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return nil, fmt.Errorf("malformed unseal response: %w", err)
+	}
+	return rsp.Secret, nil
+}
@@ -0,0 +1,279 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var SSH_SESSION_BIND = "session-bind@openssh.com"
+
+// maxBindings is the number of session bindings kept per connection, like
+// OpenSSH.
+const maxBindings = 16
+
+// SessionBindMsg is sent by ssh after key exchange to bind the agent
+// connection to the session with the host. See the session-bind@openssh.com
+// extension in the OpenSSH PROTOCOL.agent.
+type SessionBindMsg struct {
+	HostKey    []byte
+	SessionID  []byte
+	Signature  []byte
+	Forwarding bool
+}
+
+// binding is a verified session binding
+type binding struct {
+	hostKey    ssh.PublicKey
+	sessionID  []byte
+	forwarding bool
+}
+
+// session is the agent as seen by a single connection, which knows the
+// sessions the connection has been bound to.
+type session struct {
+	*Agent
+	// number of the connection
+	client   uint64
+	mu       sync.Mutex
+	bindings []binding
+	// a session-bind request on the connection failed
+	bindFailed bool
+}
+
+func newSession(a *Agent, client uint64) *session {
+	return &session{Agent: a, client: client}
+}
+
+func (s *session) Extension(extensionType string, contents []byte) ([]byte, error) {
+	switch extensionType {
+	case SSH_SESSION_BIND:
+		err := s.bind(contents)
+		if err != nil {
+			s.mu.Lock()
+			s.bindFailed = true
+			s.mu.Unlock()
+		}
+		return nil, err
+	case SSH_TPM_AGENT_DECRYPT, SSH_TPM_AGENT_ECDH, SSH_TPM_AGENT_SIGN:
+		// The destination of these can't be checked, so destination
+		// constrained keys are only usable locally.
+		var msg struct {
+			KeyBlob []byte
+			Rest    []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(contents, &msg); err != nil {
+			return nil, err
+		}
+		if pk, err := ssh.ParsePublicKey(msg.KeyBlob); err == nil && len(s.Agent.destinations(pk)) != 0 && s.bound() {
+			return nil, fmt.Errorf("%w: %s on a bound connection", ErrKeyRestricted, extensionType)
+		}
+	}
+	return s.Agent.Extension(extensionType, contents)
+}
+
+// bind verifies the host signature over the session identifier and records
+// the binding.
+func (s *session) bind(req []byte) error {
+	var msg SessionBindMsg
+	if err := ssh.Unmarshal(req, &msg); err != nil {
+		return err
+	}
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return fmt.Errorf("session-bind: %w", err)
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(msg.Signature, &sig); err != nil {
+		return fmt.Errorf("session-bind: %w", err)
+	}
+	if err := hostKey.Verify(msg.SessionID, &sig); err != nil {
+		return fmt.Errorf("session-bind: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.bindings {
+		// A connection used for authentication is not forwarded any further
+		if !b.forwarding {
+			return errors.New("session-bind: connection is already bound for authentication")
+		}
+		if bytes.Equal(b.sessionID, msg.SessionID) {
+			if bytes.Equal(b.hostKey.Marshal(), hostKey.Marshal()) {
+				return nil
+			}
+			return errors.New("session-bind: session bound to a different host key")
+		}
+	}
+	if len(s.bindings) >= maxBindings {
+		return errors.New("session-bind: too many bindings")
+	}
+	s.bindings = append(s.bindings, binding{
+		hostKey:    hostKey,
+		sessionID:  msg.SessionID,
+		forwarding: msg.Forwarding,
+	})
+	slog.Debug("bound session",
+		slog.String("hostkey", ssh.FingerprintSHA256(hostKey)),
+		slog.Bool("forwarding", msg.Forwarding))
+	return nil
+}
+
+// bound reports if a session-bind was attempted on the connection
+func (s *session) bound() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bindings) != 0 || s.bindFailed
+}
+
+// permitted checks the hops the connection went through against the
+// destination constraints dcs of a key, like identity_permitted in ssh-agent.
+// user is the user a signature is made for, and empty when listing keys.
+func (s *session) permitted(dcs []DestinationConstraint, user string) error {
+	if len(dcs) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bindFailed && len(s.bindings) == 0 {
+		return fmt.Errorf("%w: session-bind failed on the connection", ErrKeyRestricted)
+	}
+	if len(s.bindings) == 0 {
+		// local use
+		return nil
+	}
+	var from ssh.PublicKey
+	for i, b := range s.bindings {
+		testUser := ""
+		if i == len(s.bindings)-1 {
+			testUser = user
+			if b.forwarding && user != "" {
+				return fmt.Errorf("%w: signing on a forwarding hop", ErrKeyRestricted)
+			}
+		} else if !b.forwarding {
+			return fmt.Errorf("%w: forwarding through a session used for authentication", ErrKeyRestricted)
+		}
+		if !permittedHop(dcs, from, b.hostKey, testUser) {
+			return fmt.Errorf("%w: %s", ErrKeyRestricted, ssh.FingerprintSHA256(b.hostKey))
+		}
+		from = b.hostKey
+	}
+	// Hide keys that can be used to authenticate to the last host but not
+	// beyond it.
+	last := s.bindings[len(s.bindings)-1]
+	if last.forwarding && user == "" && !permittedHop(dcs, last.hostKey, nil, "") {
+		return fmt.Errorf("%w: not after %s", ErrKeyRestricted, ssh.FingerprintSHA256(last.hostKey))
+	}
+	return nil
+}
+
+// checkSign checks a signature request with a destination constrained key.
+// Only user authentication towards the host of the last session binding is
+// permitted.
+func (s *session) checkSign(pk ssh.PublicKey, dcs []DestinationConstraint, data []byte) error {
+	if !s.bound() {
+		return fmt.Errorf("%w: signing on an unbound connection", ErrKeyRestricted)
+	}
+	req, hostKey, err := parseUserauth(data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrKeyRestricted, err)
+	}
+	if !bytes.Equal(req.PubKey, pk.Marshal()) {
+		return fmt.Errorf("%w: userauth request for a different key", ErrKeyRestricted)
+	}
+	if req.User == "" {
+		return fmt.Errorf("%w: userauth request without a user", ErrKeyRestricted)
+	}
+	if err := s.permitted(dcs, req.User); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	last := s.bindings[len(s.bindings)-1]
+	s.mu.Unlock()
+	if !bytes.Equal(req.SessionID, last.sessionID) {
+		return fmt.Errorf("%w: unexpected session id", ErrKeyRestricted)
+	}
+	if hostKey == nil || !bytes.Equal(hostKey.Marshal(), last.hostKey.Marshal()) {
+		return fmt.Errorf("%w: host key of the request doesn't match the session", ErrKeyRestricted)
+	}
+	return nil
+}
+
+func (s *session) List() ([]*agent.Key, error) {
+	keys, err := s.Agent.List()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(keys, func(k *agent.Key) bool {
+		pk, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			return false
+		}
+		if err := s.permitted(s.Agent.destinations(pk), ""); err != nil {
+			slog.Debug("not listing key", slog.String("key", ssh.FingerprintSHA256(pk)), slog.String("error", err.Error()))
+			return true
+		}
+		return false
+	}), nil
+}
+
+// forwarded reports if the connection reached the agent through a forwarded
+// agent socket, and the host keys of the hops it was forwarded through.
+func (s *session) forwarded() (bool, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hops []string
+	for _, b := range s.bindings {
+		if b.forwarding {
+			hops = append(hops, ssh.FingerprintSHA256(b.hostKey))
+		}
+	}
+	return len(hops) != 0, hops
+}
+
+func (s *session) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if dcs := s.Agent.destinations(key); len(dcs) != 0 {
+		if err := s.checkSign(key, dcs, data); err != nil {
+			slog.Info("refusing to sign with destination constrained key",
+				slog.String("key", ssh.FingerprintSHA256(key)),
+				slog.String("error", err.Error()))
+			return nil, err
+		}
+	}
+	if ok, hops := s.forwarded(); ok {
+		slog.Info("signing request through a forwarded agent connection",
+			slog.String("key", ssh.FingerprintSHA256(key)),
+			slog.Any("hops", hops))
+	}
+	return s.Agent.signWithFlags(s.client, s.destination(data), key, data, flags)
+}
+
+// destination returns the host key fingerprint of the session the userauth
+// request in data authenticates to, or an empty string if the connection
+// isn't bound to it.
+func (s *session) destination(data []byte) string {
+	req, hostKey, err := parseUserauth(data)
+	if err != nil || hostKey == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.bindings) == 0 {
+		return ""
+	}
+	last := s.bindings[len(s.bindings)-1]
+	if last.forwarding || !bytes.Equal(req.SessionID, last.sessionID) || !bytes.Equal(hostKey.Marshal(), last.hostKey.Marshal()) {
+		return ""
+	}
+	return ssh.FingerprintSHA256(hostKey)
+}
+
+func (s *session) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return s.SignWithFlags(key, data, 0)
+}
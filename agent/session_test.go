@@ -0,0 +1,416 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func mkBind(t *testing.T, host ssh.Signer, sessionID []byte, forwarding bool) []byte {
+	t.Helper()
+	sig, err := host.Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.Marshal(SessionBindMsg{
+		HostKey:    host.PublicKey().Marshal(),
+		SessionID:  sessionID,
+		Signature:  ssh.Marshal(sig),
+		Forwarding: forwarding,
+	})
+}
+
+func TestSessionBind(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func() (agent.ExtendedAgent, func() error) {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return agent.NewClient(conn), conn.Close
+	}
+
+	t.Run("bad signature", func(t *testing.T) {
+		client, done := dial()
+		defer done()
+		msg := mkBind(t, host, []byte("session"), false)
+		msg[len(msg)-2] ^= 0xff
+		if _, err := client.Extension(SSH_SESSION_BIND, msg); err == nil {
+			t.Fatal("bound with a bad signature")
+		}
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		client, done := dial()
+		defer done()
+		if _, err := client.Extension(SSH_SESSION_BIND, mkBind(t, host, []byte("first"), true)); err != nil {
+			t.Fatal(err)
+		}
+		// binding twice to the same session is fine
+		if _, err := client.Extension(SSH_SESSION_BIND, mkBind(t, host, []byte("first"), true)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Extension(SSH_SESSION_BIND, mkBind(t, host, []byte("second"), false)); err != nil {
+			t.Fatal(err)
+		}
+		// the connection was used for authentication
+		if _, err := client.Extension(SSH_SESSION_BIND, mkBind(t, host, []byte("third"), true)); err == nil {
+			t.Fatal("bound a connection used for authentication")
+		}
+	})
+}
+
+func TestRestrictDestination(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	mkHost := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	host, other := mkHost(), mkHost()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dial := func() (agent.ExtendedAgent, func() error) {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return agent.NewClient(conn), conn.Close
+	}
+	userauth := func(sessionID []byte, hostKey ssh.PublicKey) []byte {
+		return ssh.Marshal(userauthRequest{
+			SessionID: sessionID,
+			Msg:       msgUserAuthRequest,
+			User:      "git",
+			Service:   "ssh-connection",
+			Method:    "publickey-hostbound-v00@openssh.com",
+			HasSig:    true,
+			Algo:      pub.Type(),
+			PubKey:    pub.Marshal(),
+			Rest:      ssh.Marshal(struct{ B []byte }{hostKey.Marshal()}),
+		})
+	}
+
+	client, done := dial()
+	req, err := MarshalTPMKeyMsg(&agent.AddedKey{
+		PrivateKey: k,
+		ConstraintExtensions: []agent.ConstraintExtension{
+			DestinationConstraintExtension([]DestinationConstraint{
+				{To: Hop{Hostname: "host", Keys: []KeySpec{{Key: host.PublicKey()}}}},
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Extension(SSH_TPM_AGENT_ADD, req); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("unbound", func(t *testing.T) {
+		keys, err := client.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 {
+			t.Fatalf("expected the key to be listed locally, got %d keys", len(keys))
+		}
+		if _, err := client.Sign(pub, []byte("data")); err == nil {
+			t.Fatal("signed with a constrained key on an unbound connection")
+		}
+	})
+	done()
+
+	t.Run("permitted", func(t *testing.T) {
+		client, done := dial()
+		defer done()
+		if _, err := client.Extension(SSH_SESSION_BIND, mkBind(t, host, []byte("session"), false)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Sign(pub, userauth([]byte("session"), host.PublicKey())); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Sign(pub, userauth([]byte("other"), host.PublicKey())); err == nil {
+			t.Fatal("signed for a different session")
+		}
+	})
+
+	t.Run("other host", func(t *testing.T) {
+		client, done := dial()
+		defer done()
+		if _, err := client.Extension(SSH_SESSION_BIND, mkBind(t, other, []byte("session"), false)); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := client.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 0 {
+			t.Fatal("listed a key not permitted for the host")
+		}
+		if _, err := client.Sign(pub, userauth([]byte("session"), other.PublicKey())); err == nil {
+			t.Fatal("signed for a host that is not permitted")
+		}
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		client, done := dial()
+		defer done()
+		if _, err := client.Extension(SSH_SESSION_BIND, mkBind(t, host, []byte("first"), true)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Extension(SSH_SESSION_BIND, mkBind(t, other, []byte("second"), false)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Sign(pub, userauth([]byte("second"), other.PublicKey())); err == nil {
+			t.Fatal("signed beyond the permitted host")
+		}
+	})
+}
+
+func TestMatchPattern(t *testing.T) {
+	// the behavior of match_pattern in match.c of OpenSSH
+	for _, c := range []struct {
+		s, pattern string
+		match      bool
+	}{
+		{"", "", true},
+		{"", "aaa", false},
+		{"aaa", "", false},
+		{"aaa", "aaaa", false},
+		{"aaaa", "aaa", false},
+		{"", "*", true},
+		{"a", "?", true},
+		{"aa", "a?", true},
+		{"a", "*", true},
+		{"aa", "a*", true},
+		{"aa", "?*", true},
+		{"aa", "**", true},
+		{"aa", "?a", true},
+		{"aa", "*a", true},
+		{"ba", "a?", false},
+		{"ba", "a*", false},
+		{"ab", "?a", false},
+		{"ab", "*a", false},
+		{"", "?", false},
+		{"aaa", "??", false},
+		{"aaa", "*?*", true},
+		{"abcd", "a*c*", true},
+		{"abcd", "a*b*d", true},
+		{"abcd", "a?cd", true},
+		{"abcd", "a*e", false},
+		// unlike path.Match, * spans slashes and there are no classes
+		{"a/b", "*", true},
+		{"a/b", "a?b", true},
+		{"[a]", "[a]", true},
+		{"a", "[a]", false},
+		{"git", "Git", false},
+	} {
+		if got := matchPattern(c.s, c.pattern); got != c.match {
+			t.Errorf("matchPattern(%q, %q) = %v, expected %v", c.s, c.pattern, got, c.match)
+		}
+	}
+}
+
+func TestConfirmCache(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	asked := 0
+	ag.confirm = func(_ context.Context, _ *key.SSHTPMKey) (bool, error) {
+		asked++
+		return true, nil
+	}
+
+	mkHost := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	host, other := mkHost(), mkHost()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func() {
+		req, err := MarshalTPMKeyMsg(&agent.AddedKey{PrivateKey: k, ConfirmBeforeUse: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ag.AddTPMKey(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// sign authenticates to host on a new connection bound to it
+	sign := func(host ssh.Signer) {
+		t.Helper()
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := agent.NewClient(conn)
+		if _, err := client.Extension(SSH_SESSION_BIND, mkBind(t, host, []byte("session"), false)); err != nil {
+			t.Fatal(err)
+		}
+		data := ssh.Marshal(userauthRequest{
+			SessionID: []byte("session"),
+			Msg:       msgUserAuthRequest,
+			User:      "git",
+			Service:   "ssh-connection",
+			Method:    "publickey-hostbound-v00@openssh.com",
+			HasSig:    true,
+			Algo:      pub.Type(),
+			PubKey:    pub.Marshal(),
+			Rest:      ssh.Marshal(struct{ B []byte }{host.PublicKey().Marshal()}),
+		})
+		if _, err := client.Sign(pub, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(n int) {
+		t.Helper()
+		if asked != n {
+			t.Fatalf("expected %d confirmations, got %d", n, asked)
+		}
+	}
+
+	add()
+	sign(host)
+	sign(host)
+	expect(2)
+
+	ag.SetConfirmCache(time.Hour, false)
+	sign(host)
+	sign(other)
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	expect(3)
+	add()
+	sign(host)
+	expect(4)
+
+	ag.SetConfirmCache(time.Hour, true)
+	sign(host)
+	sign(host)
+	sign(other)
+	expect(6)
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ag.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	expect(8)
+
+	ag.SetConfirmCache(time.Nanosecond, false)
+	sign(host)
+	time.Sleep(time.Millisecond)
+	sign(host)
+	expect(10)
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var SSH_TPM_AGENT_STATS = "stats@tpm-ssh-agent"
+
+// keyStats counts the uses of a key since the agent started
+type keyStats struct {
+	signs, decrypts, errors uint64
+	lastUsed                time.Time
+}
+
+// KeyStats are the uses of a TPM key of the agent since it started. Decrypts
+// counts decryptions and ECDH, Errors the failed TPM operations. LastUsed is
+// a unix time, 0 if the key wasn't used.
+type KeyStats struct {
+	KeyBlob  []byte
+	Comment  string
+	Signs    uint64
+	Decrypts uint64
+	Errors   uint64
+	LastUsed uint64
+}
+
+type keyStatsMsg struct {
+	KeyBlob  []byte
+	Comment  string
+	Signs    uint64
+	Decrypts uint64
+	Errors   uint64
+	LastUsed uint64
+	Rest     []byte `ssh:"rest"`
+}
+
+// StatsResponse contains the statistics of a stats request, as consecutive
+// KeyStats.
+type StatsResponse struct {
+	Type    string `sshtype:"6"`
+	Started uint64
+	Keys    []byte `ssh:"rest"`
+}
+
+// recordStats counts a signature or decryption with k, or a failed one
+func (a *Agent) recordStats(k *key.SSHTPMKey, sign bool, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stats == nil {
+		a.stats = map[string]*keyStats{}
+	}
+	s := a.stats[k.Fingerprint()]
+	if s == nil {
+		s = &keyStats{}
+		a.stats[k.Fingerprint()] = s
+	}
+	switch {
+	case err != nil:
+		s.errors++
+		return
+	case sign:
+		s.signs++
+	default:
+		s.decrypts++
+	}
+	s.lastUsed = time.Now()
+	a.touch()
+}
+
+// Stats returns the statistics of the TPM keys of the agent
+func (a *Agent) Stats() ([]byte, error) {
+	slog.Debug("called stats")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var keys []byte
+	for _, k := range a.keys {
+		pk, err := k.SSHPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		ks := KeyStats{
+			KeyBlob: pk.Marshal(),
+			Comment: k.Description,
+		}
+		if s := a.stats[k.Fingerprint()]; s != nil {
+			ks.Signs = s.signs
+			ks.Decrypts = s.decrypts
+			ks.Errors = s.errors
+			if !s.lastUsed.IsZero() {
+				ks.LastUsed = uint64(s.lastUsed.Unix())
+			}
+		}
+		keys = append(keys, ssh.Marshal(ks)...)
+	}
+	return ssh.Marshal(StatsResponse{Started: uint64(a.started.Unix()), Keys: keys}), nil
+}
+
+// QueryStats asks the agent for the statistics of its TPM keys, and returns
+// them with the time the agent started.
+func QueryStats(client sshagent.ExtendedAgent) (time.Time, []KeyStats, error) {
+	b, err := client.Extension(SSH_TPM_AGENT_STATS, nil)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	var rsp StatsResponse
+	if err := ssh.Unmarshal(b, &rsp); err != nil {
+		return time.Time{}, nil, fmt.Errorf("malformed stats response: %w", err)
+	}
+	var keys []KeyStats
+	for rest := rsp.Keys; len(rest) != 0; {
+		var ks keyStatsMsg
+		if err := ssh.Unmarshal(rest, &ks); err != nil {
+			return time.Time{}, nil, fmt.Errorf("malformed stats response: %w", err)
+		}
+		keys = append(keys, KeyStats{
+			KeyBlob:  ks.KeyBlob,
+			Comment:  ks.Comment,
+			Signs:    ks.Signs,
+			Decrypts: ks.Decrypts,
+			Errors:   ks.Errors,
+			LastUsed: ks.LastUsed,
+		})
+		rest = ks.Rest
+	}
+	return time.Unix(int64(rsp.Started), 0), keys, nil
+}
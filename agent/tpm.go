@@ -0,0 +1,376 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// cachedTPM keeps the transport returned by open around between requests and
+// closes it once it has been idle for longer than timeout. A zero timeout
+// keeps the transport open until it is released. The transport isn't idle
+// while an operation is bound to it, however long the TPM takes.
+type cachedTPM struct {
+	mu      sync.Mutex
+	open    tpmconn.Opener
+	tpm     transport.TPMCloser
+	timeout time.Duration
+	timer   *time.Timer
+
+	// counts the transports closed after they failed
+	resets int
+
+	// commands resent by the closed transports, see retryCounter
+	retries uint64
+
+	// context of the running operation, see tpmQueue
+	ctx context.Context
+	// an operation is bound, the idle timer is stopped until it's done
+	busy bool
+}
+
+func (c *cachedTPM) Send(cmd []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx != nil && c.ctx.Err() != nil {
+		return nil, fmt.Errorf("tpm command aborted: %w", c.ctx.Err())
+	}
+	if c.tpm == nil {
+		slog.Debug("opening tpm")
+		// the next command opens it again
+		tpm, err := c.open.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed opening tpm: %w", err)
+		}
+		c.tpm = tpm
+	}
+	if !c.busy {
+		c.arm()
+	}
+	// Commands the TPM asks to resend are resent by the transport, see
+	// utils.RetryTPM
+	rsp, err := c.tpm.Send(cmd)
+	if err != nil {
+		// The transport is broken, after a suspend and resume or a
+		// communication error. Objects loaded with it are gone, so the
+		// command isn't sent again, see tpmQueue.do.
+		slog.Info("tpm transport failed, reopening it", slog.String("error", err.Error()))
+		c.reset()
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// arm starts the idle timer again
+func (c *cachedTPM) arm() {
+	if c.timeout <= 0 {
+		return
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.timeout, c.idle)
+	} else {
+		c.timer.Reset(c.timeout)
+	}
+}
+
+// stopTimer stops the idle timer
+func (c *cachedTPM) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// reset closes the open transport, so the next command opens it again
+func (c *cachedTPM) reset() {
+	c.stopTimer()
+	c.closeTPM()
+	c.resets++
+}
+
+// closeTPM closes the open transport. Transports of a tpmconn.Static opener
+// are left open for their owner.
+func (c *cachedTPM) closeTPM() {
+	if r, ok := c.tpm.(retryCounter); ok {
+		c.retries += r.Retries()
+	}
+	if err := c.tpm.Close(); err != nil {
+		slog.Debug("failed closing tpm", slog.String("error", err.Error()))
+	}
+	c.tpm = nil
+}
+
+// retryCounter is a transport which resends commands the TPM asked to retry,
+// like utils.RetryTPM
+type retryCounter interface {
+	Retries() uint64
+}
+
+// counts returns how many commands were resent and how often the transport
+// was reset
+func (c *cachedTPM) counts() (retries uint64, resets int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	retries = c.retries
+	if r, ok := c.tpm.(retryCounter); ok {
+		retries += r.Retries()
+	}
+	return retries, c.resets
+}
+
+// resetCount returns how often the transport was reset
+func (c *cachedTPM) resetCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resets
+}
+
+// Close is a no-op as the transport is shared between requests, see release.
+func (c *cachedTPM) Close() error {
+	return nil
+}
+
+func (c *cachedTPM) idle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the timer fired as an operation was bound
+	if c.busy {
+		return
+	}
+	slog.Debug("closing idle tpm")
+	c.stopTimer()
+	if c.tpm != nil {
+		c.closeTPM()
+	}
+}
+
+// release closes the open transport
+func (c *cachedTPM) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopTimer()
+	if c.tpm != nil {
+		c.closeTPM()
+	}
+}
+
+// bind aborts the commands sent after ctx is done. The idle timer is stopped
+// while ctx is bound, and started again when the operation is done with a nil
+// ctx.
+func (c *cachedTPM) bind(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctx = ctx
+	c.busy = ctx != nil
+	switch {
+	case c.busy:
+		c.stopTimer()
+	case c.tpm != nil:
+		c.arm()
+	}
+}
+
+func (c *cachedTPM) setTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = d
+}
+
+// clientKey is the context key of the connection an operation is run for
+type clientKey struct{}
+
+// withClient marks the operations run with ctx as requested by the
+// connection client, see tpmQueue
+func withClient(ctx context.Context, client uint64) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func clientOf(ctx context.Context) uint64 {
+	client, _ := ctx.Value(clientKey{}).(uint64)
+	return client
+}
+
+// tpmJob is an operation waiting in the tpmQueue
+type tpmJob struct {
+	client uint64
+	// virtual time the job starts at, and the order it was submitted in
+	tag time.Duration
+	seq uint64
+	run func()
+}
+
+// tpmQueue runs TPM operations one at a time on a dedicated goroutine.
+// Operations span several TPM commands and loaded objects, so they can't be
+// interleaved on the hardware.
+//
+// The waiting operations are scheduled fairly between the connections they
+// were requested on, by the TPM time each connection used: the operation of
+// the connection which used the least goes first. New connections start at
+// the time of the running operation, so a connection with many or slow
+// operations doesn't hold up the others, and isn't starved by them either.
+// Operations not run for a connection share one client.
+type tpmQueue struct {
+	mu      sync.Mutex
+	waiting []*tpmJob
+	used    map[uint64]time.Duration
+	vtime   time.Duration
+	seq     uint64
+	wake    chan struct{}
+	done    chan struct{}
+	cache   *cachedTPM
+
+	// start of the running operation, zero while idle
+	running time.Time
+}
+
+func newTPMQueue(cache *cachedTPM) *tpmQueue {
+	q := &tpmQueue{
+		used:  map[uint64]time.Duration{},
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		cache: cache,
+	}
+	go q.loop()
+	return q
+}
+
+func (q *tpmQueue) loop() {
+	for {
+		select {
+		case <-q.wake:
+		case <-q.done:
+			return
+		}
+		for {
+			job := q.next()
+			if job == nil {
+				break
+			}
+			start := time.Now()
+			q.mu.Lock()
+			q.running = start
+			q.mu.Unlock()
+			job.run()
+			q.mu.Lock()
+			q.used[job.client] = job.tag + time.Since(start)
+			q.running = time.Time{}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// next removes the job with the earliest virtual start time from the queue
+func (q *tpmQueue) next() *tpmJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		return nil
+	}
+	// The time used is only known once the running operation of a
+	// connection is done, so start times are updated when picking a job
+	for _, job := range q.waiting {
+		job.tag = max(job.tag, q.used[job.client])
+	}
+	i := 0
+	for j, job := range q.waiting {
+		if job.tag < q.waiting[i].tag || (job.tag == q.waiting[i].tag && job.seq < q.waiting[i].seq) {
+			i = j
+		}
+	}
+	job := q.waiting[i]
+	q.waiting = slices.Delete(q.waiting, i, i+1)
+	q.vtime = job.tag
+	return job
+}
+
+// state returns the number of waiting operations, and how long the running
+// one has been running
+func (q *tpmQueue) state() (int, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.running.IsZero() {
+		return len(q.waiting), 0
+	}
+	return len(q.waiting), time.Since(q.running)
+}
+
+func (q *tpmQueue) submit(client uint64, run func()) *tpmJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	job := &tpmJob{
+		client: client,
+		tag:    max(q.used[client], q.vtime),
+		seq:    q.seq,
+		run:    run,
+	}
+	q.waiting = append(q.waiting, job)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job
+}
+
+// cancel removes job from the queue, and reports if it was still waiting
+func (q *tpmQueue) cancel(job *tpmJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.Index(q.waiting, job)
+	if i < 0 {
+		return false
+	}
+	q.waiting = slices.Delete(q.waiting, i, i+1)
+	return true
+}
+
+// forget drops the TPM time used by a connection which was closed
+func (q *tpmQueue) forget(client uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.used, client)
+}
+
+// do runs f on the queue and waits for it to return, or for ctx to be done.
+// TPM commands f sends after ctx is done fail, which unblocks the queue for
+// the next operation.
+func (q *tpmQueue) do(ctx context.Context, f func() error) error {
+	errc := make(chan error, 1)
+	job := q.submit(clientOf(ctx), func() {
+		if err := ctx.Err(); err != nil {
+			errc <- err
+			return
+		}
+		q.cache.bind(ctx)
+		defer q.cache.bind(nil)
+		resets := q.cache.resetCount()
+		err := f()
+		// The handles and sessions of f were lost with a failed
+		// transport, so f is run again on a new one
+		if err != nil && ctx.Err() == nil && q.cache.resetCount() != resets {
+			slog.Info("retrying tpm operation after the transport was reset", slog.String("error", err.Error()))
+			err = f()
+		}
+		errc <- err
+	})
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		if q.cancel(job) {
+			return ctx.Err()
+		}
+		slog.Info("tpm operation abandoned", slog.String("error", ctx.Err().Error()))
+		return ctx.Err()
+	}
+}
+
+func (q *tpmQueue) stop() {
+	close(q.done)
+}
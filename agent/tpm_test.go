@@ -0,0 +1,536 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn/tpmconntest"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type countingTPM struct {
+	transport.TPM
+	closed *int
+}
+
+func (c *countingTPM) Close() error {
+	*c.closed++
+	return nil
+}
+
+// failingTPM fails the commands sent after the first ok ones, like a
+// transport broken by a suspend
+type failingTPM struct {
+	countingTPM
+	ok   int
+	sent int
+}
+
+func (f *failingTPM) Send(cmd []byte) ([]byte, error) {
+	f.sent++
+	if f.ok >= 0 && f.sent > f.ok {
+		return nil, syscall.EPIPE
+	}
+	return f.TPM.Send(cmd)
+}
+
+func TestCachedTPM(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	var opened, closed int
+	cache := &cachedTPM{
+		open: tpmconn.Func(func() (transport.TPMCloser, error) {
+			opened++
+			return &countingTPM{TPM: tpm, closed: &closed}, nil
+		}),
+		timeout: 50 * time.Millisecond,
+	}
+
+	rand := func() {
+		t.Helper()
+		if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rand()
+	rand()
+	cache.mu.Lock()
+	if opened != 1 || closed != 0 {
+		t.Fatalf("opened %d and closed %d times, expected the tpm to be reused", opened, closed)
+	}
+	cache.mu.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+	cache.mu.Lock()
+	if closed != 1 {
+		t.Fatalf("closed %d times, expected the idle tpm to be closed", closed)
+	}
+	cache.mu.Unlock()
+
+	rand()
+	cache.release()
+	if opened != 2 || closed != 2 {
+		t.Fatalf("opened %d and closed %d times, expected 2", opened, closed)
+	}
+}
+
+func TestCachedTPMBusy(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	var closed int
+	cache := &cachedTPM{
+		open: tpmconn.Func(func() (transport.TPMCloser, error) {
+			return &countingTPM{TPM: tpm, closed: &closed}, nil
+		}),
+		timeout: 50 * time.Millisecond,
+	}
+	closes := func() int {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return closed
+	}
+
+	// a slow operation keeps the transport open past the timeout
+	cache.bind(context.Background())
+	if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := closes(); n != 0 {
+		t.Fatalf("closed %d times during the operation", n)
+	}
+	if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.bind(nil)
+	time.Sleep(200 * time.Millisecond)
+	if n := closes(); n != 1 {
+		t.Fatalf("closed %d times, expected the tpm to be closed once idle", n)
+	}
+}
+
+func TestCachedTPMNoTimeout(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	// without a timeout failed transports are closed too
+	var opened, closed int
+	cache := &cachedTPM{
+		open: tpmconn.Func(func() (transport.TPMCloser, error) {
+			opened++
+			return &failingTPM{countingTPM: countingTPM{TPM: tpm, closed: &closed}, ok: 1}, nil
+		}),
+	}
+	for range 2 {
+		if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); !errors.Is(err, syscall.EPIPE) {
+			t.Fatalf("expected the transport error, got %v", err)
+		}
+	}
+	if opened != 2 || closed != 2 {
+		t.Fatalf("opened %d and closed %d times, expected the failed tpms to be closed", opened, closed)
+	}
+
+	if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); err != nil {
+		t.Fatal(err)
+	}
+	cache.release()
+	if closed != 3 {
+		t.Fatalf("closed %d times, expected the released tpm to be closed", closed)
+	}
+
+	// tpmconn.Static transports are left open
+	cache = &cachedTPM{open: tpmconn.Static(tpm)}
+	if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); err != nil {
+		t.Fatal(err)
+	}
+	cache.release()
+	if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(tpm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTPMQueue(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the TPM with a slow operation
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go ag.queue.do(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	signed := make(chan error, 1)
+	go func() {
+		_, err := ag.Sign(pub, []byte("data"))
+		signed <- err
+	}()
+
+	listed := make(chan error, 1)
+	go func() {
+		_, err := ag.List()
+		listed <- err
+	}()
+	select {
+	case err := <-listed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("list blocked behind the tpm")
+	}
+
+	select {
+	case <-signed:
+		t.Fatal("sign didn't wait for the tpm")
+	default:
+	}
+	close(release)
+	if err := <-signed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTPMQueueTimeout(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	cache := &cachedTPM{open: tpmconn.Static(tpm)}
+	q := newTPMQueue(cache)
+	defer q.stop()
+
+	// A hung operation times out, and can't use the TPM afterwards
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	aborted := make(chan error, 1)
+	err = q.do(ctx, func() error {
+		<-ctx.Done()
+		_, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache)
+		aborted <- err
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+	if err := <-aborted; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected tpm command to be aborted, got %v", err)
+	}
+
+	// The queue is usable for the next request
+	if err := q.do(context.Background(), func() error {
+		_, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTPMQueueFair(t *testing.T) {
+	q := newTPMQueue(&cachedTPM{})
+	defer q.stop()
+
+	var mu sync.Mutex
+	var order []string
+	run := func(client uint64, name string, wait chan struct{}) chan error {
+		errc := make(chan error, 1)
+		go func() {
+			errc <- q.do(withClient(context.Background(), client), func() error {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				if wait != nil {
+					<-wait
+				}
+				return nil
+			})
+		}()
+		return errc
+	}
+	waiting := func(n int) {
+		for {
+			q.mu.Lock()
+			l := len(q.waiting)
+			q.mu.Unlock()
+			if l == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A slow operation of the first connection, followed by another one,
+	// doesn't hold up the second connection
+	release := make(chan struct{})
+	slow := run(1, "slow", release)
+	for ran := 0; ran == 0; {
+		mu.Lock()
+		ran = len(order)
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	next := run(1, "next", nil)
+	waiting(1)
+	other := run(2, "other", nil)
+	waiting(2)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for _, errc := range []chan error{slow, next, other} {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !slices.Equal(order, []string{"slow", "other", "next"}) {
+		t.Fatalf("operations ran in the order %v", order)
+	}
+
+	// A cancelled operation is removed from the queue
+	release = make(chan struct{})
+	started := make(chan struct{})
+	go q.do(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- q.do(ctx, func() error {
+			t.Error("cancelled operation ran")
+			return nil
+		})
+	}()
+	waiting(1)
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	waiting(0)
+	close(release)
+}
+
+func TestTPMTransportReset(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first transport breaks in the middle of the signature, the next
+	// ones work
+	var opened, closed int
+	failing := -1
+	open := tpmconn.Func(func() (transport.TPMCloser, error) {
+		opened++
+		ok := -1
+		if opened == 1 {
+			ok = failing
+		}
+		return &failingTPM{countingTPM: countingTPM{TPM: tpm, closed: &closed}, ok: ok}, nil
+	})
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		open,
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+	ag.SetTPMIdleTimeout(time.Minute)
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+
+	// The srk is created, loading the key fails
+	failing = 1
+	sig, err := ag.Sign(pub, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Verify([]byte("data"), sig); err != nil {
+		t.Fatal(err)
+	}
+	if opened != 2 || closed != 1 {
+		t.Fatalf("opened %d and closed %d times, expected the failed tpm to be reopened", opened, closed)
+	}
+	// the srk left behind by the failed transport
+	flushTransient(t, tpm)
+
+	// A transport which keeps failing fails the request
+	ag.cache.release()
+	opened, closed = 0, 0
+	fail := func() (transport.TPMCloser, error) {
+		opened++
+		return &failingTPM{countingTPM: countingTPM{TPM: tpm, closed: &closed}, ok: 0}, nil
+	}
+	ag.cache.mu.Lock()
+	ag.cache.open = tpmconn.Func(fail)
+	ag.cache.mu.Unlock()
+	if _, err := ag.Sign(pub, []byte("data")); !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("expected the transport error, got %v", err)
+	}
+	if opened != 2 {
+		t.Fatalf("opened %d times, expected one retry", opened)
+	}
+}
+
+func TestCachedTPMOpenFails(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	// the device can't be opened right after resuming
+	opened := 0
+	cache := &cachedTPM{
+		open: tpmconn.Func(func() (transport.TPMCloser, error) {
+			opened++
+			if opened == 1 {
+				return nil, syscall.ENOENT
+			}
+			return tpm, nil
+		}),
+	}
+	if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("expected the open error, got %v", err)
+	}
+	if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); err != nil {
+		t.Fatal(err)
+	}
+	if opened != 2 {
+		t.Fatalf("opened %d times, expected the tpm to be opened again", opened)
+	}
+
+	cache = &cachedTPM{open: tpmconn.Static(nil)}
+	if _, err := (tpm2.GetRandom{BytesRequested: 8}).Execute(cache); !errors.Is(err, tpmconn.ErrNoTPM) {
+		t.Fatalf("expected ErrNoTPM, got %v", err)
+	}
+}
+
+func TestCachedTPMRetries(t *testing.T) {
+	cache := &cachedTPM{
+		open: tpmconn.Func(func() (transport.TPMCloser, error) {
+			return utils.NewRetryTPM(&tpmconntest.Mock{RCs: []tpm2.TPMRC{tpm2.TPMRCRetry, tpm2.TPMRCSuccess}}), nil
+		}),
+	}
+	send := func() {
+		t.Helper()
+		if _, err := cache.Send([]byte{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send()
+	if retries, _ := cache.counts(); retries != 1 {
+		t.Fatalf("counted %d retries, expected 1", retries)
+	}
+	// the retries of closed transports are kept
+	cache.release()
+	send()
+	if retries, _ := cache.counts(); retries != 2 {
+		t.Fatalf("counted %d retries, expected 2", retries)
+	}
+}
+
+// flushTransient flushes the transient objects left on the simulator
+func flushTransient(t *testing.T, tpm transport.TPM) {
+	t.Helper()
+	rsp, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapHandles,
+		Property:      uint32(tpm2.TPMHTTransient) << 24,
+		PropertyCount: 16,
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handles, err := rsp.CapabilityData.Data.Handles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range handles.Handle {
+		if _, err := (tpm2.FlushContext{FlushHandle: h}).Execute(tpm); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Message numbers from the agent protocol draft
+var messageNames = map[byte]string{
+	5:  "SSH_AGENT_FAILURE",
+	6:  "SSH_AGENT_SUCCESS",
+	11: "SSH_AGENTC_REQUEST_IDENTITIES",
+	12: "SSH_AGENT_IDENTITIES_ANSWER",
+	13: "SSH_AGENTC_SIGN_REQUEST",
+	14: "SSH_AGENT_SIGN_RESPONSE",
+	17: "SSH_AGENTC_ADD_IDENTITY",
+	18: "SSH_AGENTC_REMOVE_IDENTITY",
+	19: "SSH_AGENTC_REMOVE_ALL_IDENTITIES",
+	20: "SSH_AGENTC_ADD_SMARTCARD_KEY",
+	21: "SSH_AGENTC_REMOVE_SMARTCARD_KEY",
+	22: "SSH_AGENTC_LOCK",
+	23: "SSH_AGENTC_UNLOCK",
+	25: "SSH_AGENTC_ADD_ID_CONSTRAINED",
+	26: "SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED",
+	27: "SSH_AGENTC_EXTENSION",
+	28: "SSH_AGENT_EXTENSION_FAILURE",
+}
+
+// traceConn logs the decoded agent protocol messages going over a connection.
+// Private keys, passphrases and signed data are never logged.
+type traceConn struct {
+	net.Conn
+	id     uint64
+	in     bytes.Buffer
+	out    bytes.Buffer
+	lastRq byte
+}
+
+func (t *traceConn) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	t.in.Write(p[:n])
+	t.messages(&t.in, "request")
+	return n, err
+}
+
+func (t *traceConn) Write(p []byte) (int, error) {
+	t.out.Write(p)
+	t.messages(&t.out, "response")
+	return t.Conn.Write(p)
+}
+
+// messages logs the complete messages in buf
+func (t *traceConn) messages(buf *bytes.Buffer, dir string) {
+	for buf.Len() >= 4 {
+		size := binary.BigEndian.Uint32(buf.Bytes())
+		if uint32(buf.Len()-4) < size {
+			return
+		}
+		buf.Next(4)
+		msg := buf.Next(int(size))
+		if len(msg) == 0 {
+			continue
+		}
+		attrs := []any{slog.Uint64("conn", t.id), slog.Int("size", len(msg))}
+		name, ok := messageNames[msg[0]]
+		if !ok {
+			name = fmt.Sprintf("unknown(%d)", msg[0])
+		}
+		attrs = append(attrs, slog.String("type", name))
+		attrs = append(attrs, t.decode(msg)...)
+		if dir == "request" {
+			t.lastRq = msg[0]
+		}
+		slog.Info("agent "+dir, attrs...)
+	}
+}
+
+func keyAttrs(blob []byte) []any {
+	pk, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return []any{slog.String("key", "malformed")}
+	}
+	return []any{slog.String("key", pk.Type()), slog.String("fingerprint", ssh.FingerprintSHA256(pk))}
+}
+
+func signFlags(flags uint32) string {
+	switch {
+	case flags&uint32(agent.SignatureFlagRsaSha256) != 0:
+		return "rsa-sha2-256"
+	case flags&uint32(agent.SignatureFlagRsaSha512) != 0:
+		return "rsa-sha2-512"
+	case flags != 0:
+		return fmt.Sprintf("0x%x", flags)
+	}
+	return "none"
+}
+
+// decode returns the interesting fields of the message
+func (t *traceConn) decode(msg []byte) []any {
+	switch msg[0] {
+	case 13:
+		var req struct {
+			KeyBlob []byte
+			Data    []byte
+			Flags   uint32
+		}
+		if err := ssh.Unmarshal(msg[1:], &req); err != nil {
+			return []any{slog.String("error", err.Error())}
+		}
+		return append(keyAttrs(req.KeyBlob),
+			slog.Int("data", len(req.Data)),
+			slog.String("flags", signFlags(req.Flags)))
+	case 12:
+		if len(msg) < 5 {
+			return nil
+		}
+		return []any{slog.Uint64("keys", uint64(binary.BigEndian.Uint32(msg[1:5])))}
+	case 14:
+		var rsp struct{ SigBlob []byte }
+		if err := ssh.Unmarshal(msg[1:], &rsp); err != nil {
+			return []any{slog.String("error", err.Error())}
+		}
+		var sig ssh.Signature
+		if err := ssh.Unmarshal(rsp.SigBlob, &sig); err != nil {
+			return []any{slog.String("error", err.Error())}
+		}
+		return []any{slog.String("format", sig.Format)}
+	case 18:
+		var req struct{ KeyBlob []byte }
+		if err := ssh.Unmarshal(msg[1:], &req); err != nil {
+			return []any{slog.String("error", err.Error())}
+		}
+		return keyAttrs(req.KeyBlob)
+	case 17, 25:
+		var req struct {
+			Type string
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(msg[1:], &req); err != nil {
+			return []any{slog.String("error", err.Error())}
+		}
+		return []any{slog.String("key", req.Type)}
+	case 27:
+		var req struct {
+			ExtensionType string
+			Contents      []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(msg[1:], &req); err != nil {
+			return []any{slog.String("error", err.Error())}
+		}
+		return []any{slog.String("extension", req.ExtensionType), slog.Int("contents", len(req.Contents))}
+	case 6:
+		if t.lastRq == 27 && len(msg) > 1 {
+			return []any{slog.Int("contents", len(msg)-1)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestDebugProto(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	buf := &syncBuffer{}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, nil)))
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := NewAgent(unixList,
+		[]agent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+	ag.SetDebugProto(true)
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := agent.NewClient(conn)
+	if _, err := client.List(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Sign(pub, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := QueryCapabilities(client); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	out := buf.String()
+	for _, s := range []string{
+		"type=SSH_AGENTC_REQUEST_IDENTITIES",
+		"type=SSH_AGENT_IDENTITIES_ANSWER keys=1",
+		"type=SSH_AGENTC_SIGN_REQUEST key=ecdsa-sha2-nistp256 fingerprint=" + ssh.FingerprintSHA256(pub) + " data=4 flags=none",
+		"type=SSH_AGENT_SIGN_RESPONSE format=ecdsa-sha2-nistp256",
+		"type=SSH_AGENTC_EXTENSION extension=" + SSH_TPM_AGENT_CAPABILITIES,
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("trace is missing %q:\n%s", s, out)
+		}
+	}
+}
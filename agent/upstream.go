@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Upstream is a provider of the keys of the agent listening on Socket, like
+// gpg-agent or a forwarded agent. It's dialed for every request, so the
+// upstream agent can be restarted or come and go. With a Label the comments
+// of its keys say which agent they are from.
+type Upstream struct {
+	Label  string
+	Socket string
+}
+
+var _ Provider = &Upstream{}
+
+// do runs f with a client of the upstream agent
+func (u *Upstream) do(f func(agent.ExtendedAgent) error) error {
+	conn, err := net.Dial("unix", u.Socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return f(agent.NewClient(conn))
+}
+
+func (u *Upstream) List() (keys []*agent.Key, err error) {
+	err = u.do(func(c agent.ExtendedAgent) error {
+		keys, err = c.List()
+		return err
+	})
+	if u.Label != "" {
+		for _, k := range keys {
+			k.Comment = fmt.Sprintf("%s (from %s)", k.Comment, u.Label)
+		}
+	}
+	return keys, err
+}
+
+func (u *Upstream) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (sig *ssh.Signature, err error) {
+	err = u.do(func(c agent.ExtendedAgent) error {
+		sig, err = c.SignWithFlags(key, data, flags)
+		return err
+	})
+	return sig, err
+}
+
+func (u *Upstream) Add(key agent.AddedKey) error {
+	return u.do(func(c agent.ExtendedAgent) error { return c.Add(key) })
+}
+
+func (u *Upstream) Remove(key ssh.PublicKey) error {
+	return u.do(func(c agent.ExtendedAgent) error { return c.Remove(key) })
+}
+
+func (u *Upstream) RemoveAll() error {
+	return u.do(func(c agent.ExtendedAgent) error { return c.RemoveAll() })
+}
@@ -3,6 +3,7 @@ package askpass
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -11,7 +12,6 @@ import (
 	"strings"
 	"syscall"
 
-	"golang.org/x/sys/unix"
 	"golang.org/x/term"
 )
 
@@ -38,6 +38,8 @@ const (
 
 var (
 	ErrNoAskpass = errors.New("system does not have an askpass program")
+	ErrNoPrompt  = errors.New("no terminal to prompt on, set SSH_ASKPASS and DISPLAY or SSH_ASKPASS_REQUIRE=force")
+	ErrCanceled  = errors.New("askpass prompt was canceled")
 
 	// Default ASKPASS programs
 	SSH_ASKPASS_DEFAULTS = []string{
@@ -62,11 +64,16 @@ func findAskPass() (string, error) {
 }
 
 func isTerminal(fd uintptr) bool {
-	_, err := unix.IoctlGetTermios(int(fd), unix.TCGETS)
-	return err == nil
+	return term.IsTerminal(int(fd))
 }
 
 func ReadPassphrase(prompt string, flags ReadPassFlags) ([]byte, error) {
+	return ReadPassphraseContext(context.Background(), prompt, flags)
+}
+
+// ReadPassphraseContext is ReadPassphrase, but kills the askpass program when
+// ctx is done.
+func ReadPassphraseContext(ctx context.Context, prompt string, flags ReadPassFlags) ([]byte, error) {
 	var allow_askpass bool
 	var use_askpass bool
 	var askpass_hint string
@@ -94,7 +101,7 @@ func ReadPassphrase(prompt string, flags ReadPassFlags) ([]byte, error) {
 	} else if (flags & RP_USE_ASKPASS) != 0 {
 		use_askpass = true
 	} else if (flags & RP_ALLOW_STDIN) != 0 {
-		if !isTerminal(os.Stdout.Fd()) {
+		if !isTerminal(os.Stdin.Fd()) {
 			slog.Debug("stdin is not a tty")
 			use_askpass = true
 		}
@@ -104,25 +111,27 @@ func ReadPassphrase(prompt string, flags ReadPassFlags) ([]byte, error) {
 		if (flags & RP_ASK_PERMISSION) != 0 {
 			askpass_hint = "confirm"
 		}
-		return SshAskPass(prompt, askpass_hint)
+		return SshAskPassContext(ctx, prompt, askpass_hint)
 	}
 
 	// If we want to echo stuff, we read directly from stdin
 	// using bufio.NewReader.
 	if (flags & RPP_ECHO_ON) != 0 {
 		fmt.Printf("%s", prompt)
-		reader := bufio.NewReader(os.Stdin)
-		input, err := reader.ReadString('\n')
-		if err != nil {
-			return []byte(""), nil
-		}
-		return []byte(strings.TrimSpace(input)), nil
+		return readLine()
 	}
+
 	// Then we are defaulting to TTY prompt
+	if !isTerminal(os.Stdin.Fd()) {
+		if (flags & RP_ALLOW_STDIN) != 0 {
+			return readLine()
+		}
+		return nil, ErrNoPrompt
+	}
 	fmt.Printf("%s", prompt)
 	pin, err := term.ReadPassword(int(syscall.Stdin))
 	if err != nil {
-		return []byte{}, nil
+		return nil, fmt.Errorf("failed reading passphrase: %w", err)
 	}
 	if (flags & RP_NEWLINE) != 0 {
 		fmt.Println("")
@@ -130,10 +139,23 @@ func ReadPassphrase(prompt string, flags ReadPassFlags) ([]byte, error) {
 	return pin, nil
 }
 
+func readLine() ([]byte, error) {
+	reader := bufio.NewReader(os.Stdin)
+	input, err := reader.ReadString('\n')
+	if err != nil {
+		return []byte(""), nil
+	}
+	return []byte(strings.TrimSpace(input)), nil
+}
+
 func SshAskPass(prompt, hint string) ([]byte, error) {
+	return SshAskPassContext(context.Background(), prompt, hint)
+}
+
+func SshAskPassContext(ctx context.Context, prompt, hint string) ([]byte, error) {
 	var askpass string
 	var err error
-	if s, ok := os.LookupEnv("SSH_ASKPASS"); ok {
+	if s := os.Getenv("SSH_ASKPASS"); s != "" {
 		askpass = s
 	} else if s, _ := exec.LookPath("ssh-askpass"); s != "" {
 		askpass = s
@@ -144,25 +166,30 @@ func SshAskPass(prompt, hint string) ([]byte, error) {
 		}
 	}
 
+	cmd := exec.CommandContext(ctx, askpass, prompt)
+	// The hint only applies to this prompt
+	cmd.Env = os.Environ()
 	if hint != "" {
-		os.Setenv("SSH_ASKPASS_PROMPT", hint)
-	}
-	out, err := exec.Command(askpass, prompt).Output()
-	switch hint {
-	case "confirm":
-		// TODO: Ugly and needs a rework
-		var exerr *exec.ExitError
-		if errors.As(err, &exerr) {
-			if exerr.ExitCode() != 0 {
-				return []byte("no"), nil
-			}
-		} else {
+		cmd.Env = append(cmd.Env, "SSH_ASKPASS_PROMPT="+hint)
+	}
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("askpass: %w", ctx.Err())
+	}
+	var exerr *exec.ExitError
+	if hint == "confirm" {
+		// The exit code is the answer
+		if err == nil {
 			return []byte("yes"), nil
+		} else if errors.As(err, &exerr) {
+			return []byte("no"), nil
 		}
 	}
 
-	if err != nil {
-		return []byte{}, nil
+	if errors.As(err, &exerr) {
+		return nil, ErrCanceled
+	} else if err != nil {
+		return nil, fmt.Errorf("failed running askpass %s: %w", askpass, err)
 	}
 	return bytes.TrimSpace(out), nil
 }
@@ -170,7 +197,11 @@ func SshAskPass(prompt, hint string) ([]byte, error) {
 // AskPremission runs SSH_ASKPASS in with SSH_ASKPASS_PROMPT=confirm set as env
 // it will expect exit code 0 or !0 and return 'yes' and 'no' respectively.
 func AskPermission() (bool, error) {
-	a, err := ReadPassphrase("Confirm touch", RP_USE_ASKPASS|RP_ASK_PERMISSION)
+	return AskPermissionContext(context.Background())
+}
+
+func AskPermissionContext(ctx context.Context) (bool, error) {
+	a, err := ReadPassphraseContext(ctx, "Confirm touch", RP_USE_ASKPASS|RP_ASK_PERMISSION)
 	if err != nil {
 		return false, err
 	}
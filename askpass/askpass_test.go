@@ -0,0 +1,55 @@
+package askpass
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeAskpass(t *testing.T, script string) {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "askpass")
+	if err := os.WriteFile(p, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSH_ASKPASS", p)
+	t.Setenv("SSH_ASKPASS_REQUIRE", "force")
+}
+
+func TestReadPassphraseAskpass(t *testing.T) {
+	writeAskpass(t, `echo "pin:$1:$SSH_ASKPASS_PROMPT"`)
+
+	b, err := ReadPassphrase("Enter PIN", RP_USE_ASKPASS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "pin:Enter PIN:" {
+		t.Fatalf("unexpected passphrase %q", b)
+	}
+}
+
+func TestAskPermission(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		ok     bool
+	}{
+		{`[ "$SSH_ASKPASS_PROMPT" = confirm ]`, true},
+		{"exit 1", false},
+	} {
+		writeAskpass(t, c.script)
+		ok, err := AskPermission()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != c.ok {
+			t.Fatalf("%q: got %v, expected %v", c.script, ok, c.ok)
+		}
+	}
+}
+
+func TestReadPassphraseCanceled(t *testing.T) {
+	writeAskpass(t, "exit 1")
+	if _, err := ReadPassphrase("Enter PIN", RP_USE_ASKPASS); err != ErrCanceled {
+		t.Fatalf("expected canceled prompt, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var Version string
+
+const usage = `Usage:
+    age-plugin-tpm
+    age-plugin-tpm [FILE.pub]
+    age-plugin-tpm -y IDENTITY
+
+Options:
+    -y                     Print the recipients of the identity file.
+    --age-plugin STATE     Run the age plugin state machine. Used by age.
+
+age plugin for keys in ssh-tpm-agent. Without arguments the age identities
+and recipients of the keys in the agent are printed, with a file the
+identity and recipient of the SSH public key are printed. Decryption is done
+by ssh-tpm-agent through SSH_AUTH_SOCK.
+
+P-256 and RSA keys are supported.
+
+Example:
+    $ age-plugin-tpm > identity.txt
+    $ age -R <(age-plugin-tpm -y identity.txt) -o secret.age secret.txt
+    $ age -d -i identity.txt secret.age`
+
+func agentClient() (sshagent.ExtendedAgent, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("can't find any ssh-tpm-agent socket")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	return sshagent.NewClient(conn), nil
+}
+
+func printIdentity(pub ssh.PublicKey, comment string) error {
+	recipient, err := EncodeRecipient(pub)
+	if err != nil {
+		return err
+	}
+	identity, err := EncodeIdentity(pub)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# %s\n", comment)
+	fmt.Printf("# recipient: %s\n", recipient)
+	fmt.Println(identity)
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Println(usage)
+	}
+
+	var (
+		state     string
+		recipient bool
+	)
+
+	flag.StringVar(&state, "age-plugin", "", "age plugin state machine")
+	flag.BoolVar(&recipient, "y", false, "print recipients of identity file")
+	flag.Parse()
+
+	switch state {
+	case "recipient-v1":
+		if err := RecipientV1(os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "identity-v1":
+		if err := IdentityV1(os.Stdin, os.Stdout, agentClient); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "":
+	default:
+		log.Fatalf("unknown state machine %s", state)
+	}
+
+	if recipient {
+		if len(flag.Args()) != 1 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		b, err := os.ReadFile(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		recipients, err := identitiesToRecipients(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range recipients {
+			fmt.Println(r)
+		}
+		return
+	}
+
+	if len(flag.Args()) == 1 {
+		b, err := os.ReadFile(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		pub, comment, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := printIdentity(pub, comment); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	client, err := agentClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := client.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, k := range keys {
+		if k.Format != ssh.KeyAlgoECDSA256 && k.Format != ssh.KeyAlgoRSA {
+			continue
+		}
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := printIdentity(pub, k.Comment); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
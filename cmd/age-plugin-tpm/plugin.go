@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// The age plugin protocol is described in
+// https://github.com/C2SP/C2SP/blob/main/age-plugin.md
+//
+// Recipients and identities both contain the SSH public key of a TPM key, the
+// private key stays in ssh-tpm-agent. File keys are wrapped in one of two
+// stanzas:
+//
+//	-> tpm-p256 <tag> <share>
+//	ChaCha20-Poly1305(HKDF-SHA256(ECDH(share, key), share || key, p256Label), file key)
+//
+//	-> tpm-rsa <tag>
+//	RSA-OAEP-SHA256(key, file key)
+//
+// the tag being the first 4 bytes of the SHA-256 of the SSH public key, and
+// share the compressed ephemeral P-256 key.
+
+const (
+	recipientHRP = "age1tpm"
+	identityHRP  = "AGE-PLUGIN-TPM-"
+
+	p256Stanza = "tpm-p256"
+	rsaStanza  = "tpm-rsa"
+	p256Label  = "age-encryption.org/v1/tpm-p256"
+
+	fileKeySize = 16
+)
+
+var b64 = base64.RawStdEncoding
+
+type stanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+func readStanza(r *bufio.Reader) (*stanza, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if !strings.HasPrefix(line, "-> ") {
+		return nil, fmt.Errorf("malformed stanza: %q", line)
+	}
+	fields := strings.Split(strings.TrimPrefix(line, "-> "), " ")
+	s := &stanza{Type: fields[0], Args: fields[1:]}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		b, err := b64.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed stanza body: %w", err)
+		}
+		s.Body = append(s.Body, b...)
+		if len(line) < 64 {
+			return s, nil
+		}
+	}
+}
+
+func writeStanza(w io.Writer, typ string, body []byte, args ...string) error {
+	var b bytes.Buffer
+	b.WriteString("-> " + strings.Join(append([]string{typ}, args...), " ") + "\n")
+	enc := b64.EncodeToString(body)
+	for len(enc) >= 64 {
+		b.WriteString(enc[:64] + "\n")
+		enc = enc[64:]
+	}
+	b.WriteString(enc + "\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func keyTag(pub ssh.PublicKey) string {
+	h := sha256.Sum256(pub.Marshal())
+	return b64.EncodeToString(h[:4])
+}
+
+// compressP256 returns the compressed point of an uncompressed P-256 key
+func compressP256(pub *ecdh.PublicKey) []byte {
+	b := pub.Bytes()
+	return append([]byte{2 | b[64]&1}, b[1:33]...)
+}
+
+func decompressP256(b []byte) (*ecdh.PublicKey, error) {
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), b)
+	if x == nil {
+		return nil, errors.New("invalid p256 point")
+	}
+	pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	return pub.ECDH()
+}
+
+func EncodeRecipient(pub ssh.PublicKey) (string, error) {
+	return bech32Encode(recipientHRP, pub.Marshal())
+}
+
+func EncodeIdentity(pub ssh.PublicKey) (string, error) {
+	return bech32Encode(identityHRP, pub.Marshal())
+}
+
+func decodeKey(s, hrp string) (ssh.PublicKey, error) {
+	h, b, err := bech32Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if h != strings.ToLower(hrp) {
+		return nil, fmt.Errorf("unknown type %s", h)
+	}
+	pub, err := ssh.ParsePublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	switch pub.Type() {
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSA:
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", pub.Type())
+}
+
+func DecodeRecipient(s string) (ssh.PublicKey, error) {
+	return decodeKey(s, recipientHRP)
+}
+
+func DecodeIdentity(s string) (ssh.PublicKey, error) {
+	return decodeKey(s, identityHRP)
+}
+
+func p256WrapKey(shared, share, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, share...), recipient...)
+	wrapKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(p256Label)), wrapKey); err != nil {
+		return nil, err
+	}
+	return wrapKey, nil
+}
+
+// wrap returns the stanza wrapping the file key to the recipient
+func wrap(pub ssh.PublicKey, fileKey []byte) (*stanza, error) {
+	cpub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.New("unsupported key")
+	}
+
+	switch k := cpub.CryptoPublicKey().(type) {
+	case *ecdsa.PublicKey:
+		recipient, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, err
+		}
+		share := compressP256(ephemeral.PublicKey())
+		wrapKey, err := p256WrapKey(shared, share, compressP256(recipient))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.New(wrapKey)
+		if err != nil {
+			return nil, err
+		}
+		return &stanza{
+			Type: p256Stanza,
+			Args: []string{keyTag(pub), b64.EncodeToString(share)},
+			Body: aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil),
+		}, nil
+	case *rsa.PublicKey:
+		body, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, k, fileKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &stanza{
+			Type: rsaStanza,
+			Args: []string{keyTag(pub)},
+			Body: body,
+		}, nil
+	}
+	return nil, errors.New("unsupported key")
+}
+
+// unwrap returns the file key of the stanza through the agent. A nil file key
+// means the stanza is not for the identity.
+func unwrap(client sshagent.ExtendedAgent, pub ssh.PublicKey, s *stanza) ([]byte, error) {
+	if len(s.Args) == 0 || s.Args[0] != keyTag(pub) {
+		return nil, nil
+	}
+
+	switch {
+	case s.Type == p256Stanza && pub.Type() == ssh.KeyAlgoECDSA256:
+		if len(s.Args) != 2 {
+			return nil, errors.New("malformed tpm-p256 stanza")
+		}
+		share, err := b64.DecodeString(s.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := decompressP256(share)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.Body) != fileKeySize+chacha20poly1305.Overhead {
+			return nil, errors.New("malformed tpm-p256 stanza body")
+		}
+		shared, err := agent.ECDHWithKey(client, pub, ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		recipient, err := pub.(ssh.CryptoPublicKey).CryptoPublicKey().(*ecdsa.PublicKey).ECDH()
+		if err != nil {
+			return nil, err
+		}
+		wrapKey, err := p256WrapKey(shared, share, compressP256(recipient))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.New(wrapKey)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), s.Body, nil)
+	case s.Type == rsaStanza && pub.Type() == ssh.KeyAlgoRSA:
+		if len(s.Args) != 1 {
+			return nil, errors.New("malformed tpm-rsa stanza")
+		}
+		return agent.DecryptWithKey(client, pub, s.Body, "sha256")
+	}
+	return nil, nil
+}
+
+// fail sends an error to age and waits for the acknowledgement
+func fail(r *bufio.Reader, w io.Writer, msg string, args ...string) error {
+	if err := writeStanza(w, "error", []byte(msg), args...); err != nil {
+		return err
+	}
+	_, err := readStanza(r)
+	return err
+}
+
+// RecipientV1 implements the recipient-v1 state machine used when encrypting
+func RecipientV1(in io.Reader, out io.Writer) error {
+	r := bufio.NewReader(in)
+
+	var recipients, identities []string
+	var fileKeys [][]byte
+	for {
+		s, err := readStanza(r)
+		if err != nil {
+			return err
+		}
+		switch s.Type {
+		case "add-recipient":
+			if len(s.Args) != 1 {
+				return errors.New("malformed add-recipient")
+			}
+			recipients = append(recipients, s.Args[0])
+		case "add-identity":
+			if len(s.Args) != 1 {
+				return errors.New("malformed add-identity")
+			}
+			identities = append(identities, s.Args[0])
+		case "wrap-file-key":
+			fileKeys = append(fileKeys, s.Body)
+		}
+		if s.Type == "done" {
+			break
+		}
+	}
+
+	var keys []ssh.PublicKey
+	for i, recipient := range recipients {
+		pub, err := DecodeRecipient(recipient)
+		if err != nil {
+			if err := fail(r, out, err.Error(), "recipient", strconv.Itoa(i)); err != nil {
+				return err
+			}
+			return writeStanza(out, "done", nil)
+		}
+		keys = append(keys, pub)
+	}
+	for i, identity := range identities {
+		pub, err := DecodeIdentity(identity)
+		if err != nil {
+			if err := fail(r, out, err.Error(), "identity", strconv.Itoa(i)); err != nil {
+				return err
+			}
+			return writeStanza(out, "done", nil)
+		}
+		keys = append(keys, pub)
+	}
+
+	for i, fileKey := range fileKeys {
+		for _, pub := range keys {
+			s, err := wrap(pub, fileKey)
+			if err != nil {
+				if err := fail(r, out, err.Error(), "internal"); err != nil {
+					return err
+				}
+				return writeStanza(out, "done", nil)
+			}
+			args := append([]string{strconv.Itoa(i), s.Type}, s.Args...)
+			if err := writeStanza(out, "recipient-stanza", s.Body, args...); err != nil {
+				return err
+			}
+			if _, err := readStanza(r); err != nil {
+				return err
+			}
+		}
+	}
+	return writeStanza(out, "done", nil)
+}
+
+// IdentityV1 implements the identity-v1 state machine used when decrypting.
+// The file keys are unwrapped through the agent.
+func IdentityV1(in io.Reader, out io.Writer, client func() (sshagent.ExtendedAgent, error)) error {
+	r := bufio.NewReader(in)
+
+	var identities []string
+	var files [][]*stanza
+	for {
+		s, err := readStanza(r)
+		if err != nil {
+			return err
+		}
+		switch s.Type {
+		case "add-identity":
+			if len(s.Args) != 1 {
+				return errors.New("malformed add-identity")
+			}
+			identities = append(identities, s.Args[0])
+		case "recipient-stanza":
+			if len(s.Args) < 2 {
+				return errors.New("malformed recipient-stanza")
+			}
+			n, err := strconv.Atoi(s.Args[0])
+			if err != nil || n < 0 {
+				return errors.New("malformed recipient-stanza")
+			}
+			for len(files) <= n {
+				files = append(files, nil)
+			}
+			files[n] = append(files[n], &stanza{Type: s.Args[1], Args: s.Args[2:], Body: s.Body})
+		}
+		if s.Type == "done" {
+			break
+		}
+	}
+
+	var keys []ssh.PublicKey
+	for i, identity := range identities {
+		pub, err := DecodeIdentity(identity)
+		if err != nil {
+			if err := fail(r, out, err.Error(), "identity", strconv.Itoa(i)); err != nil {
+				return err
+			}
+			return writeStanza(out, "done", nil)
+		}
+		keys = append(keys, pub)
+	}
+
+	var c sshagent.ExtendedAgent
+	for i, stanzas := range files {
+	file:
+		for j, s := range stanzas {
+			for _, pub := range keys {
+				if len(s.Args) == 0 || s.Args[0] != keyTag(pub) {
+					continue
+				}
+				if c == nil {
+					var err error
+					if c, err = client(); err != nil {
+						if err := fail(r, out, err.Error(), "internal"); err != nil {
+							return err
+						}
+						return writeStanza(out, "done", nil)
+					}
+				}
+				fileKey, err := unwrap(c, pub, s)
+				if err != nil {
+					if err := fail(r, out, err.Error(), "stanza", strconv.Itoa(i), strconv.Itoa(j)); err != nil {
+						return err
+					}
+					continue
+				}
+				if fileKey == nil {
+					continue
+				}
+				if err := writeStanza(out, "file-key", fileKey, strconv.Itoa(i)); err != nil {
+					return err
+				}
+				if _, err := readStanza(r); err != nil {
+					return err
+				}
+				break file
+			}
+		}
+	}
+	return writeStanza(out, "done", nil)
+}
+
+// identitiesToRecipients returns the recipients of the identities in an
+// identity file
+func identitiesToRecipients(b []byte) ([]string, error) {
+	var recipients []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pub, err := DecodeIdentity(line)
+		if err != nil {
+			return nil, err
+		}
+		recipient, err := EncodeRecipient(pub)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
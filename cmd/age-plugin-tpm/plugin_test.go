@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+func TestBech32(t *testing.T) {
+	data := make([]byte, 300)
+	rand.Read(data)
+	for _, hrp := range []string{recipientHRP, identityHRP} {
+		s, err := bech32Encode(hrp, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, b, err := bech32Decode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != strings.ToLower(hrp) || !bytes.Equal(b, data) {
+			t.Fatalf("roundtrip failed for %s", hrp)
+		}
+	}
+	if _, _, err := bech32Decode("age1tpm1qqqqqqqqqqqqqq"); err == nil {
+		t.Fatal("decoded invalid checksum")
+	}
+}
+
+// stanzas parses the plugin output
+func stanzas(t *testing.T, b []byte) []*stanza {
+	var ret []*stanza
+	r := bufio.NewReader(bytes.NewReader(b))
+	for {
+		s, err := readStanza(r)
+		if err == io.EOF {
+			return ret
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, s)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := agent.NewAgent(unixList,
+		[]sshagent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	client := func() (sshagent.ExtendedAgent, error) {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+		return sshagent.NewClient(conn), nil
+	}
+
+	for _, c := range []struct {
+		name string
+		alg  tpm2.TPMAlgID
+		bits int
+	}{
+		{"p256", tpm2.TPMAlgECC, 256},
+		{"rsa", tpm2.TPMAlgRSA, 2048},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			k, err := key.NewSSHTPMKey(tpm, c.alg, c.bits, []byte(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ag.AddKey(k); err != nil {
+				t.Fatal(err)
+			}
+			pub, err := k.SSHPublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recipient, err := EncodeRecipient(pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			identity, err := EncodeIdentity(pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fileKey := make([]byte, fileKeySize)
+			rand.Read(fileKey)
+
+			var in, out bytes.Buffer
+			writeStanza(&in, "add-recipient", nil, recipient)
+			writeStanza(&in, "wrap-file-key", fileKey)
+			writeStanza(&in, "done", nil)
+			writeStanza(&in, "ok", nil)
+			if err := RecipientV1(&in, &out); err != nil {
+				t.Fatal(err)
+			}
+
+			rsp := stanzas(t, out.Bytes())
+			if len(rsp) != 2 || rsp[0].Type != "recipient-stanza" || rsp[1].Type != "done" {
+				t.Fatalf("unexpected recipient-v1 response: %s", out.String())
+			}
+
+			in.Reset()
+			out.Reset()
+			writeStanza(&in, "add-identity", nil, identity)
+			writeStanza(&in, "recipient-stanza", rsp[0].Body, rsp[0].Args...)
+			writeStanza(&in, "done", nil)
+			writeStanza(&in, "ok", nil)
+			if err := IdentityV1(&in, &out, client); err != nil {
+				t.Fatal(err)
+			}
+
+			rsp = stanzas(t, out.Bytes())
+			if len(rsp) != 2 || rsp[0].Type != "file-key" || rsp[1].Type != "done" {
+				t.Fatalf("unexpected identity-v1 response: %s", out.String())
+			}
+			if !bytes.Equal(rsp[0].Body, fileKey) {
+				t.Fatal("unwrapped file key doesn't match")
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+)
+
+// destinations collects the -h flags
+type destinations []string
+
+func (d *destinations) String() string { return strings.Join(*d, ",") }
+
+func (d *destinations) Set(s string) error {
+	*d = append(*d, s)
+	return nil
+}
+
+// parseDestination parses a destination like ssh-add -h, either [user@]host
+// or host>[user@]host.
+func parseDestination(files []string, s string) (agent.DestinationConstraint, error) {
+	var dc agent.DestinationConstraint
+	from, to, ok := strings.Cut(s, ">")
+	if !ok {
+		from, to = "", s
+	}
+	if from != "" {
+		if strings.Contains(from, "@") {
+			return dc, fmt.Errorf("invalid destination %q: the first host can't have a user", s)
+		}
+		keys, err := agent.HostKeys(files, from)
+		if err != nil {
+			return dc, err
+		}
+		dc.From = agent.Hop{Hostname: from, Keys: keys}
+	}
+	user, host, ok := strings.Cut(to, "@")
+	if !ok {
+		user, host = "", to
+	}
+	if host == "" {
+		return dc, fmt.Errorf("invalid destination %q", s)
+	}
+	keys, err := agent.HostKeys(files, host)
+	if err != nil {
+		return dc, err
+	}
+	dc.To = agent.Hop{User: user, Hostname: host, Keys: keys}
+	return dc, nil
+}
@@ -5,15 +5,18 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	keyfile "github.com/foxboron/go-tpm-keyfiles"
 	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
 	"github.com/foxboron/ssh-tpm-ca-authority/client"
-	"github.com/google/go-tpm/tpm2/transport"
 	"golang.org/x/crypto/ssh"
 	sshagent "golang.org/x/crypto/ssh/agent"
 )
@@ -21,8 +24,42 @@ import (
 var Version string
 
 const usage = `Usage:
-    ssh-tpm-add [FILE]
-    ssh-tpm-add --ca [URL] --user [USER] --host [HOSTNAME]
+    ssh-tpm-add [OPTIONS] [FILE]
+    ssh-tpm-add [OPTIONS] --ca [URL] --user [USER] --host [HOSTNAME]
+    ssh-tpm-add [OPTIONS] --create TYPE [-b BITS] [-C COMMENT] [-f FILE]
+    ssh-tpm-add [OPTIONS] --import KEY [-C COMMENT] [-f FILE]
+    ssh-tpm-add -l | -L | -D | --forget-pins
+    ssh-tpm-add -d FILE...
+
+Options:
+    -t LIFE                Remove the key from the agent after LIFE, given in
+                           seconds or as a duration like 1h30m.
+    -c                     Ask for confirmation through SSH_ASKPASS every time
+                           the key is used.
+    -h DESTINATION         Only allow the key to be used towards DESTINATION,
+                           given as [user@]host or host>[user@]host to allow
+                           forwarding from the first host to the second. Can
+                           be given multiple times. Host keys are read from
+                           the known_hosts files.
+
+    --completion SHELL     Print the completion script for bash, zsh or fish.
+
+Options for managing keys:
+    -l                     List the fingerprints of the TPM keys of the agent,
+                           with their constraints.
+    -L                     List the public keys of the TPM keys of the agent.
+    -d                     Remove the keys of the FILEs from the agent, given
+                           as .tpm or public key files.
+    -D                     Remove all TPM keys from the agent.
+    --forget-pins          Make the agent forget the cached PINs of its keys.
+    --create TYPE          Create an ecdsa or rsa key in the TPM through the
+                           agent, save it and add it.
+    --import KEY           Import the private key KEY into the TPM through
+                           the agent, save it and add it.
+    -b BITS                Number of bits of the created key.
+    -C COMMENT             Comment of the created or imported key.
+    -f FILE                File to save the key in. Defaults to
+                           ~/.ssh/id_TYPE.tpm, or KEY.tpm on import.
 
 Options for CA provisioning:
     --ca URL               URL to the CA authority for CA key provisioning.
@@ -32,8 +69,35 @@ Options for CA provisioning:
 Add a sealed TPM key to ssh-tpm-agent. Allows CA key provisioning with the --ca
 option.
 
+Keys can also be created, imported, listed and removed through the running
+agent, which needs no access to the TPM from ssh-tpm-add. The constraints
+apply to the created and imported keys.
+
+Options which aren't given on the command line are read from
+$XDG_CONFIG_HOME/ssh-tpm-agent/config, see ssh-tpm-agent --help.
+
 Example:
-    $ ssh-tpm-add id_rsa.tpm`
+    $ ssh-tpm-add id_rsa.tpm
+    $ ssh-tpm-add -c -t 1h id_ecdsa.tpm
+    $ ssh-tpm-add -h bastion -h "bastion>git@example.com" id_ecdsa.tpm
+    $ ssh-tpm-add -t 8h --create ecdsa -f ~/.ssh/id_work
+    $ ssh-tpm-add -l
+    $ ssh-tpm-add -d ~/.ssh/id_work.tpm`
+
+// parseLifetime parses the seconds or duration given to -t
+func parseLifetime(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(secs), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Second || d.Seconds() > math.MaxUint32 {
+		return 0, fmt.Errorf("invalid lifetime %q", s)
+	}
+	return uint32(d.Seconds()), nil
+}
 
 func main() {
 	flag.Usage = func() {
@@ -41,19 +105,83 @@ func main() {
 	}
 
 	var (
-		caURL, host, user string
+		caURL, host, user, lifetime string
+		completion                  string
+		confirm                     bool
+		dests                       destinations
+
+		list, listPublic, remove, removeAll bool
+		forgetPINs                          bool
+		create, importFile, comment, file   string
+		bits                                int
 	)
 
 	flag.StringVar(&caURL, "ca", "", "ca authority")
-	flag.StringVar(&host, "host", "", "ssh hot")
+	flag.StringVar(&host, "host", "", "ssh host")
 	flag.StringVar(&user, "user", "", "remote ssh user")
+	flag.StringVar(&lifetime, "t", "", "lifetime of the key")
+	flag.BoolVar(&confirm, "c", false, "confirm every use of the key")
+	flag.Var(&dests, "h", "destination constraint")
+	flag.StringVar(&completion, "completion", "", "print the shell completion script")
+	flag.BoolVar(&list, "l", false, "list the fingerprints of the TPM keys")
+	flag.BoolVar(&listPublic, "L", false, "list the public TPM keys")
+	flag.BoolVar(&remove, "d", false, "remove the keys of the files")
+	flag.BoolVar(&removeAll, "D", false, "remove all TPM keys")
+	flag.BoolVar(&forgetPINs, "forget-pins", false, "forget the cached pins")
+	flag.StringVar(&create, "create", "", "create a key of the type")
+	flag.StringVar(&importFile, "import", "", "import the private key")
+	flag.IntVar(&bits, "b", 0, "number of bits of the created key")
+	flag.StringVar(&comment, "C", "", "comment of the created or imported key")
+	flag.StringVar(&file, "f", "", "file to save the key in")
 	flag.Parse()
+	if err := utils.LoadConfig(flag.CommandLine, "ssh-tpm-add", utils.ConfigFile()); err != nil {
+		log.Fatal(err)
+	}
 
-	if (caURL == "" || host == "" || user == "") && len(os.Args) == 1 {
+	if completion != "" {
+		c := &utils.Completion{
+			Program: "ssh-tpm-add",
+			Flags:   flag.CommandLine,
+			Values: map[string]utils.CompletionKind{
+				"import": utils.CompleteFile,
+				"f":      utils.CompleteFile,
+			},
+			Words: map[string][]string{
+				"completion": utils.CompletionShells,
+				"create":     {"ecdsa", "rsa"},
+			},
+			Args: utils.CompleteKey,
+		}
+		if err := c.Write(os.Stdout, completion); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	manage := list || listPublic || remove || removeAll || forgetPINs || create != "" || importFile != ""
+	if (caURL == "" || host == "" || user == "") && flag.NArg() == 0 && !manage {
 		fmt.Println(usage)
 		return
 	}
 
+	lifetimeSecs, err := parseLifetime(lifetime)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var extensions []sshagent.ConstraintExtension
+	if len(dests) != 0 {
+		var dcs []agent.DestinationConstraint
+		for _, d := range dests {
+			dc, err := parseDestination(agent.KnownHostsFiles(), d)
+			if err != nil {
+				log.Fatal(err)
+			}
+			dcs = append(dcs, dc)
+		}
+		extensions = append(extensions, agent.DestinationConstraintExtension(dcs))
+	}
+
 	socket := os.Getenv("SSH_AUTH_SOCK")
 	if socket == "" {
 		fmt.Println("Can't find any ssh-tpm-agent socket.")
@@ -66,9 +194,56 @@ func main() {
 	}
 	defer conn.Close()
 
+	switch {
+	case list || listPublic:
+		err = listKeys(sshagent.NewClient(conn), listPublic)
+	case remove:
+		err = deleteKeys(sshagent.NewClient(conn), flag.Args())
+	case removeAll:
+		err = deleteAllKeys(sshagent.NewClient(conn))
+	case forgetPINs:
+		err = forgetCachedPINs(sshagent.NewClient(conn))
+	}
+	if err != nil {
+		log.Fatal(err)
+	} else if list || listPublic || remove || removeAll || forgetPINs {
+		return
+	}
+
+	if create != "" || importFile != "" {
+		client := sshagent.NewClient(conn)
+		var k *key.SSHTPMKey
+		var path string
+		if create != "" {
+			k, path, err = createKey(client, create, bits, comment, file)
+		} else {
+			k, path, err = importKey(client, importFile, comment, file)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		addedkey := sshagent.AddedKey{
+			PrivateKey:           k,
+			Comment:              k.Description,
+			LifetimeSecs:         lifetimeSecs,
+			ConfirmBeforeUse:     confirm,
+			ConstraintExtensions: extensions,
+		}
+		req, err := agent.MarshalTPMKeyMsg(&addedkey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = client.Extension(agent.SSH_TPM_AGENT_ADD, req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Identity added: %s\n", path)
+		return
+	}
+
 	if caURL != "" && host != "" {
 		c := client.NewClient(caURL)
-		rwc, err := transport.OpenTPM()
+		rwc, err := utils.TPM(false)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -78,13 +253,21 @@ func main() {
 		}
 
 		sshagentclient := sshagent.NewClient(conn)
+		checkAgent(sshagentclient)
 		addedkey := sshagent.AddedKey{
-			PrivateKey:  k,
-			Comment:     k.Description,
-			Certificate: cert,
+			PrivateKey:           k,
+			Comment:              k.Description,
+			Certificate:          cert,
+			LifetimeSecs:         lifetimeSecs,
+			ConfirmBeforeUse:     confirm,
+			ConstraintExtensions: extensions,
 		}
 
-		_, err = sshagentclient.Extension(agent.SSH_TPM_AGENT_ADD, agent.MarshalTPMKeyMsg(&addedkey))
+		req, err := agent.MarshalTPMKeyMsg(&addedkey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = sshagentclient.Extension(agent.SSH_TPM_AGENT_ADD, req)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -92,24 +275,28 @@ func main() {
 		os.Exit(0)
 	}
 
-	if len(os.Args) != 1 {
-		path := os.Args[1]
+	if flag.NArg() != 0 {
+		path := flag.Arg(0)
 
 		b, err := os.ReadFile(path)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		k, err := keyfile.Decode(b)
+		k, err := key.Decode(b)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		client := sshagent.NewClient(conn)
+		checkAgent(client)
 
 		addedkey := sshagent.AddedKey{
-			PrivateKey: k,
-			Comment:    k.Description,
+			PrivateKey:           k,
+			Comment:              k.Description,
+			LifetimeSecs:         lifetimeSecs,
+			ConfirmBeforeUse:     confirm,
+			ConstraintExtensions: extensions,
 		}
 
 		certStr := fmt.Sprintf("%s-cert.pub", strings.TrimSuffix(path, filepath.Ext(path)))
@@ -131,7 +318,11 @@ func main() {
 			fmt.Printf("Identity added: %s\n", certStr)
 		}
 
-		_, err = client.Extension(agent.SSH_TPM_AGENT_ADD, agent.MarshalTPMKeyMsg(&addedkey))
+		req, err := agent.MarshalTPMKeyMsg(&addedkey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = client.Extension(agent.SSH_TPM_AGENT_ADD, req)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -139,3 +330,20 @@ func main() {
 		fmt.Printf("Identity added: %s\n", path)
 	}
 }
+
+// checkAgent fails if the agent says it can't add TPM keys. Agents without
+// the capabilities extension are assumed to support it.
+func checkAgent(client sshagent.ExtendedAgent) {
+	caps, err := agent.QueryCapabilities(client)
+	if errors.Is(err, sshagent.ErrExtensionUnsupported) {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	if caps.HasExtension(agent.SSH_TPM_AGENT_READ_ONLY) {
+		log.Fatal("ssh-tpm-agent runs with a read-only keystore and refuses to add keys")
+	}
+	if !caps.HasExtension(agent.SSH_TPM_AGENT_ADD) {
+		log.Fatalf("ssh-tpm-agent %s does not support adding TPM keys", caps.Version)
+	}
+}
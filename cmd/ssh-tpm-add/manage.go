@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/askpass"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// requireExtension fails if the agent lacks the key management extension
+func requireExtension(client sshagent.ExtendedAgent, ext string) error {
+	caps, err := agent.QueryCapabilities(client)
+	if err != nil {
+		return fmt.Errorf("ssh-tpm-agent doesn't support managing keys: %w", err)
+	}
+	if !caps.HasExtension(ext) {
+		return unsupported(caps, ext)
+	}
+	return nil
+}
+
+// unsupported is the error for an extension the agent doesn't offer, which
+// agents with a read-only keystore don't for adding keys
+func unsupported(caps *agent.CapabilitiesResponse, ext string) error {
+	if caps.HasExtension(agent.SSH_TPM_AGENT_READ_ONLY) {
+		return fmt.Errorf("ssh-tpm-agent runs with a read-only keystore and refuses %s", ext)
+	}
+	return fmt.Errorf("ssh-tpm-agent %s does not support %s", caps.Version, ext)
+}
+
+func getPin() ([]byte, error) {
+	for {
+		pin1, err := askpass.ReadPassphrase("Enter passphrase (empty for no passphrase): ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+		if err != nil {
+			return nil, err
+		}
+		pin2, err := askpass.ReadPassphrase("Enter same passphrase again: ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pin1, pin2) {
+			fmt.Println("Passphrases do not match.  Try again.")
+			continue
+		}
+		return pin1, nil
+	}
+}
+
+// listKeys prints the TPM keys of the agent like ssh-add -l, or their public
+// keys like ssh-add -L.
+func listKeys(client sshagent.ExtendedAgent, public bool) error {
+	if err := requireExtension(client, agent.SSH_TPM_AGENT_LIST); err != nil {
+		return err
+	}
+	keys, err := agent.ListKeys(client)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		fmt.Println("The agent has no TPM identities.")
+		return nil
+	}
+	for _, lk := range keys {
+		pk, err := ssh.ParsePublicKey(lk.KeyBlob)
+		if err != nil {
+			return err
+		}
+		if public {
+			fmt.Printf("%s %s\n", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk))), lk.Comment)
+			continue
+		}
+		var attrs []string
+		if lk.Stored {
+			attrs = append(attrs, "stored")
+		}
+		if lk.Certificate {
+			attrs = append(attrs, "certificate")
+		}
+		if lk.Confirm {
+			attrs = append(attrs, "confirm")
+		}
+		if lk.LifetimeSecs != 0 {
+			attrs = append(attrs, fmt.Sprintf("lifetime %s", time.Duration(lk.LifetimeSecs)*time.Second))
+		}
+		if lk.Destinations != 0 {
+			attrs = append(attrs, fmt.Sprintf("%d destinations", lk.Destinations))
+		}
+		line := fmt.Sprintf("%s %s (%s)", ssh.FingerprintSHA256(pk), lk.Comment, strings.ToUpper(pk.Type()))
+		if len(attrs) != 0 {
+			line += " [" + strings.Join(attrs, ", ") + "]"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// readPublicKey returns the public key of a .tpm key file or a public key
+// file.
+func readPublicKey(file string) (ssh.PublicKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if k, err := key.Decode(b); err == nil {
+		return k.SSHPublicKey()
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a TPM key nor a public key", file)
+	}
+	return pk, nil
+}
+
+// deleteKeys removes the keys of the files from the agent, like ssh-add -d
+func deleteKeys(client sshagent.ExtendedAgent, files []string) error {
+	for _, file := range files {
+		pk, err := readPublicKey(file)
+		if err != nil {
+			return err
+		}
+		if err := client.Remove(pk); err != nil {
+			return fmt.Errorf("failed removing %s: %w", file, err)
+		}
+		fmt.Printf("Identity removed: %s\n", file)
+	}
+	return nil
+}
+
+// deleteAllKeys removes the TPM keys from the agent. Unlike ssh-add -D the
+// keys of the proxied agents are left alone.
+func deleteAllKeys(client sshagent.ExtendedAgent) error {
+	if err := requireExtension(client, agent.SSH_TPM_AGENT_LIST); err != nil {
+		return err
+	}
+	keys, err := agent.ListKeys(client)
+	if err != nil {
+		return err
+	}
+	for _, lk := range keys {
+		pk, err := ssh.ParsePublicKey(lk.KeyBlob)
+		if err != nil {
+			return err
+		}
+		if err := client.Remove(pk); err != nil {
+			return fmt.Errorf("failed removing %s: %w", ssh.FingerprintSHA256(pk), err)
+		}
+	}
+	fmt.Println("All TPM identities removed.")
+	return nil
+}
+
+// forgetCachedPINs flushes the PINs cached by the agent
+func forgetCachedPINs(client sshagent.ExtendedAgent) error {
+	if err := requireExtension(client, agent.SSH_TPM_AGENT_FORGET_PINS); err != nil {
+		return err
+	}
+	if err := agent.ForgetCachedPINs(client); err != nil {
+		return err
+	}
+	fmt.Println("Cached PINs forgotten.")
+	return nil
+}
+
+// saveKey writes k to filename.tpm and filename.pub, refusing to replace
+// existing keys. An existing public key of an imported key is kept.
+func saveKey(k *key.SSHTPMKey, filename string) error {
+	filename = strings.TrimSuffix(filename, ".tpm")
+	if utils.FileExists(filename + ".tpm") {
+		return fmt.Errorf("%s.tpm already exists", filename)
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		return err
+	}
+	writePub := true
+	if utils.FileExists(filename + ".pub") {
+		pk, err := readPublicKey(filename + ".pub")
+		if err != nil || ssh.FingerprintSHA256(pk) != k.Fingerprint() {
+			return fmt.Errorf("%s.pub already exists", filename)
+		}
+		writePub = false
+	}
+	if err := utils.WriteFileAtomic(filename+".tpm", b, 0o600); err != nil {
+		return err
+	}
+	if writePub {
+		if err := os.WriteFile(filename+".pub", k.AuthorizedKey(), 0o600); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Your identification has been saved in %s.tpm\n", filename)
+	fmt.Printf("Your public key has been saved in %s.pub\n", filename)
+	return nil
+}
+
+// createKey creates a key of type keyType in the TPM through the agent and
+// saves it as filename, by default ~/.ssh/id_ecdsa or ~/.ssh/id_rsa.
+func createKey(client sshagent.ExtendedAgent, keyType string, bits int, comment, filename string) (*key.SSHTPMKey, string, error) {
+	caps, err := agent.QueryCapabilities(client)
+	if err != nil {
+		return nil, "", fmt.Errorf("ssh-tpm-agent doesn't support managing keys: %w", err)
+	}
+	if !caps.HasExtension(agent.SSH_TPM_AGENT_CREATE) {
+		return nil, "", unsupported(caps, agent.SSH_TPM_AGENT_CREATE)
+	}
+	if filename == "" {
+		filename = path.Join(utils.SSHDir(), "id_"+keyType)
+	}
+	pin, err := getPin()
+	if err != nil {
+		return nil, "", err
+	}
+	msg := &agent.CreateMsg{
+		Algorithm: keyType,
+		Bits:      uint32(bits),
+		Comment:   comment,
+		Userauth:  pin,
+	}
+	var k *key.SSHTPMKey
+	// Agents with jobs create the key in the background, so a slow RSA key
+	// doesn't run into the request timeout
+	if caps.HasExtension(agent.SSH_TPM_AGENT_CREATE_ASYNC) {
+		var id string
+		id, err = agent.StartCreateKey(client, msg)
+		if err == nil {
+			k, err = agent.WaitJob(client, id, 500*time.Millisecond)
+		}
+	} else {
+		k, err = agent.CreateKey(client, msg)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := saveKey(k, filename); err != nil {
+		return nil, "", err
+	}
+	return k, strings.TrimSuffix(filename, ".tpm") + ".tpm", nil
+}
+
+// importKey imports the private key in file into the TPM through the agent and saves it as filename, by default file.tpm. The comment
+// defaults to the one of file.pub.
+func importKey(client sshagent.ExtendedAgent, file, comment, filename string) (*key.SSHTPMKey, string, error) {
+	if err := requireExtension(client, agent.SSH_TPM_AGENT_IMPORT); err != nil {
+		return nil, "", err
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	raw, err := ssh.ParseRawPrivateKey(b)
+	var perr *ssh.PassphraseMissingError
+	if errors.As(err, &perr) {
+		pass, err := askpass.ReadPassphrase(fmt.Sprintf("Enter passphrase for %s: ", file), askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+		if err != nil {
+			return nil, "", err
+		}
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(b, pass)
+		if err != nil {
+			return nil, "", err
+		}
+	} else if err != nil {
+		return nil, "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("unsupported key type: %w", err)
+	}
+	if comment == "" {
+		if pub, err := os.ReadFile(file + ".pub"); err == nil {
+			if _, c, _, _, err := ssh.ParseAuthorizedKey(pub); err == nil {
+				comment = c
+			}
+		}
+	}
+	if filename == "" {
+		filename = file
+	}
+	pin, err := getPin()
+	if err != nil {
+		return nil, "", err
+	}
+	k, err := agent.ImportKey(client, &agent.ImportMsg{
+		PrivateKey: der,
+		Comment:    comment,
+		Userauth:   pin,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := saveKey(k, filename); err != nil {
+		return nil, "", err
+	}
+	return k, strings.TrimSuffix(filename, ".tpm") + ".tpm", nil
+}
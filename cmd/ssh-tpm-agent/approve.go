@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+)
+
+// approveHelper returns an approver which runs program with the fingerprint
+// and description of the key as arguments and the hex encoded challenge on
+// stdin. The program prints the base64 encoded signature over the SHA-256
+// digest of the challenge, after getting the approval from the user.
+func approveHelper(program string) func(context.Context, *key.SSHTPMKey, []byte) ([]byte, error) {
+	return func(ctx context.Context, k *key.SSHTPMKey, challenge []byte) ([]byte, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, program, k.Fingerprint(), k.Description)
+		cmd.Stdin = strings.NewReader(hex.EncodeToString(challenge) + "\n")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%s: %w: %s", program, err, strings.TrimSpace(stderr.String()))
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(stdout.String()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid signature: %w", program, err)
+		}
+		return sig, nil
+	}
+}
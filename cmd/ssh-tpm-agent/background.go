@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/utils"
+)
+
+// background starts the agent again as a detached process without the flags
+// in drop, and waits for it to listen on socketPath. The output of the agent
+// goes to logFile, or is discarded if it's empty.
+func background(socketPath, logFile string, drop []string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	args := slices.DeleteFunc(slices.Clone(os.Args[1:]), func(arg string) bool {
+		return slices.Contains(drop, arg)
+	})
+	args = append(args, "-l", socketPath)
+
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer null.Close()
+
+	out := null
+	if logFile != "" {
+		if err := os.MkdirAll(filepath.Dir(logFile), 0o700); err != nil {
+			return 0, err
+		}
+		out, err = os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return 0, err
+		}
+		defer out.Close()
+	}
+
+	// Setsid detaches the agent from the terminal and its process group, it
+	// is reparented to init once we exit.
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = null
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		select {
+		case err := <-exited:
+			return 0, fmt.Errorf("agent exited on startup: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return cmd.Process.Pid, nil
+		}
+	}
+	return cmd.Process.Pid, fmt.Errorf("agent is not listening on %s", socketPath)
+}
+
+// printEnv prints the shell commands setting up the environment of the agent,
+// like ssh-agent(1).
+func printEnv(w io.Writer, csh bool, socketPath string, pid int) {
+	if csh {
+		fmt.Fprintf(w, "setenv SSH_AUTH_SOCK %s;\n", socketPath)
+		fmt.Fprintf(w, "setenv SSH_AGENT_PID %d;\n", pid)
+	} else {
+		fmt.Fprintf(w, "SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", socketPath)
+		fmt.Fprintf(w, "SSH_AGENT_PID=%d; export SSH_AGENT_PID;\n", pid)
+	}
+	fmt.Fprintf(w, "echo Agent pid %d;\n", pid)
+}
+
+// defaultLogFile is where a daemonized agent logs to
+func defaultLogFile() string {
+	return filepath.Join(utils.StateDir(), "agent.log")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxboron/ssh-tpm-agent/askpass"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+)
+
+func backup(file, keyDir string, metadata *keystore.Metadata) ([]string, error) {
+	pin1, err := askpass.ReadPassphrase("Enter passphrase for the backup: ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+	if err != nil {
+		return nil, err
+	}
+	pin2, err := askpass.ReadPassphrase("Enter same passphrase again: ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pin1, pin2) {
+		return nil, errors.New("passphrases do not match")
+	}
+	if len(pin1) == 0 {
+		return nil, errors.New("the backup needs a passphrase")
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := keystore.WriteBackup(f, pin1, keyDir, metadata)
+	if err != nil {
+		f.Close()
+		os.Remove(file)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func restore(file, keyDir string, metadata *keystore.Metadata) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pin, err := askpass.ReadPassphrase(fmt.Sprintf("Enter passphrase for %s: ", file), askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := keystore.RestoreBackup(f, pin, keyDir, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func exportArchive(file, keyDir string, metadata *keystore.Metadata) ([]string, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := keystore.WriteArchive(f, keyDir, metadata)
+	if err != nil {
+		f.Close()
+		os.Remove(file)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func importArchive(file, keyDir string, metadata *keystore.Metadata) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return keystore.ImportArchive(f, keyDir, metadata)
+}
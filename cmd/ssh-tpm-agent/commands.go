@@ -0,0 +1,853 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/askpass"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// cli is the configuration the commands share, from the flags and the
+// configuration file.
+type cli struct {
+	socketPath, keyDir, keyGlob, keystoreType       string
+	metadataFile, sealedMetadata, enrollURL         string
+	swtpm, askOwnerPassword, jsonOutput, persistSRK bool
+	readOnly                                        bool
+	requestTimeout                                  time.Duration
+	// the flags given on the command line, before the command
+	flags []string
+}
+
+// command is a subcommand of ssh-tpm-agent. run gets the arguments after
+// the flags, starting with the name of the command. Commands which write
+// keys to --key-dir are refused with --read-only.
+type command struct {
+	name   string
+	run    func(c *cli, args []string) error
+	writes bool
+}
+
+// commands are the subcommands, agent runs the agent and is handled by main
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "agent"},
+		{name: "keygen", run: keygenCommand, writes: true},
+		{name: "list", run: listCommand},
+		{name: "delete", run: deleteCommand},
+		{name: "status", run: statusCommand},
+		{name: "setup", run: setupCommand},
+		{name: "lockout", run: lockoutCommand},
+		{name: "prune", run: pruneCommand},
+		{name: "diagnose", run: diagnoseCommand},
+		{name: "ping", run: pingCommand},
+		{name: "backup", run: backupCommand},
+		{name: "restore", run: backupCommand, writes: true},
+		{name: "export", run: archiveCommand},
+		{name: "import", run: archiveCommand, writes: true},
+		{name: "completion", run: completionCommand},
+		{name: "install", run: installCommand},
+		{name: "enroll", run: enrollCommand, writes: true},
+		{name: "version", run: versionCommand},
+	}
+}
+
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// checkReadOnly refuses commands which write keys with --read-only
+func (c *cli) checkReadOnly(cmd *command) error {
+	if cmd.writes && c.readOnly {
+		return fmt.Errorf("%s would change the keystore, which is read-only", cmd.name)
+	}
+	return nil
+}
+
+func (c *cli) tpm() (transport.TPMCloser, error) {
+	return utils.TPM(c.swtpm)
+}
+
+// writeKeyDir is the first directory of --key-dir, which new keys and
+// backups are written to
+func (c *cli) writeKeyDir() string {
+	if dirs := keystore.NewDirs(c.keyDir, c.keyGlob); len(dirs) != 0 {
+		return dirs[0].Path
+	}
+	return utils.SSHDir()
+}
+
+// metadata opens --sealed-metadata, or --metadata, it is nil if disabled
+func (c *cli) metadata() (*keystore.Metadata, error) {
+	if c.sealedMetadata != "" {
+		return c.openSealedMetadata(func() ([]byte, error) {
+			return readOwnerPassword(c.askOwnerPassword), nil
+		})
+	}
+	if c.metadataFile == "" {
+		return nil, nil
+	}
+	return keystore.OpenMetadata(c.metadataFile)
+}
+
+// openSealedMetadata opens --sealed-metadata, unsealing its secret with the
+// TPM
+func (c *cli) openSealedMetadata(ownerPassword func() ([]byte, error)) (*keystore.Metadata, error) {
+	pw, err := ownerPassword()
+	if err != nil {
+		return nil, err
+	}
+	tpm, err := c.tpm()
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.Close()
+	return keystore.OpenSealedMetadata(c.sealedMetadata, tpm, pw)
+}
+
+// keystore returns the --keystore, nv keystores use tpm
+func (c *cli) keystore(tpm transport.TPMCloser, ownerPassword []byte) (keystore.Keystore, error) {
+	switch c.keystoreType {
+	case "file":
+		ks := keystore.NewDirs(c.keyDir, c.keyGlob)
+		c.markReadOnly(ks)
+		return ks, nil
+	case "nv":
+		ks := keystore.NewNV(
+			tpmconn.Static(tpm),
+			func() ([]byte, error) { return ownerPassword, nil },
+		)
+		c.markReadOnly(ks)
+		return ks, nil
+	}
+	return nil, fmt.Errorf("unsupported keystore: %s", c.keystoreType)
+}
+
+// markReadOnly makes ks refuse changes with --read-only
+func (c *cli) markReadOnly(ks keystore.Keystore) {
+	if !c.readOnly {
+		return
+	}
+	switch ks := ks.(type) {
+	case keystore.Dirs:
+		for _, d := range ks {
+			d.ReadOnly = true
+		}
+	case *keystore.NV:
+		ks.ReadOnly = true
+	}
+}
+
+// openKeystore returns the keystore, and opens the TPM for nv keystores
+// until done is called.
+func (c *cli) openKeystore() (ks keystore.Keystore, done func(), err error) {
+	if c.keystoreType != "nv" {
+		ks, err := c.keystore(nil, nil)
+		return ks, func() {}, err
+	}
+	tpm, err := c.tpm()
+	if err != nil {
+		return nil, nil, err
+	}
+	ks, err = c.keystore(tpm, readOwnerPassword(c.askOwnerPassword))
+	if err != nil {
+		tpm.Close()
+		return nil, nil, err
+	}
+	return ks, func() { tpm.Close() }, nil
+}
+
+// keygenCommand runs ssh-tpm-keygen, preferring the one next to
+// ssh-tpm-agent.
+func keygenCommand(c *cli, args []string) error {
+	bin := "ssh-tpm-keygen"
+	if exe, err := os.Executable(); err == nil && utils.FileExists(filepath.Join(filepath.Dir(exe), bin)) {
+		bin = filepath.Join(filepath.Dir(exe), bin)
+	} else if bin, err = exec.LookPath(bin); err != nil {
+		return err
+	}
+	argv := []string{bin}
+	if c.swtpm {
+		argv = append(argv, "--swtpm")
+	}
+	return syscall.Exec(bin, append(argv, args[1:]...), os.Environ())
+}
+
+// listedKeyJSON is a key of list --json, with its metadata with --long
+type listedKeyJSON struct {
+	utils.KeyJSON
+	Metadata *keystore.KeyMetadata `json:"metadata,omitempty"`
+}
+
+func listCommand(c *cli, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	var long bool
+	fs.BoolVar(&long, "long", false, "show the metadata of the keys")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	var metadata *keystore.Metadata
+	if long {
+		var err error
+		if metadata, err = c.metadata(); err != nil {
+			return err
+		}
+	}
+	ks, done, err := c.openKeystore()
+	if err != nil {
+		return err
+	}
+	defer done()
+	keys, err := ks.Keys()
+	if err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		list := []listedKeyJSON{}
+		for _, k := range keys {
+			lk := listedKeyJSON{KeyJSON: utils.NewKeyJSON(k)}
+			if metadata != nil {
+				km := metadata.Get(k.Fingerprint())
+				lk.Metadata = &km
+			}
+			list = append(list, lk)
+		}
+		return utils.PrintJSON(os.Stdout, struct {
+			Keys []listedKeyJSON `json:"keys"`
+		}{list})
+	}
+	for _, k := range keys {
+		kj := utils.NewKeyJSON(k)
+		fmt.Printf("%s %s %s\n", kj.Fingerprint, kj.Type, kj.Comment)
+		if metadata != nil {
+			printKeyMetadata(os.Stdout, metadata.Get(k.Fingerprint()))
+		}
+	}
+	return nil
+}
+
+// printKeyMetadata prints what is known about a key for list --long
+func printKeyMetadata(w io.Writer, km keystore.KeyMetadata) {
+	if c := km.Created; c != nil {
+		created := c.Time.Local().Format(time.DateTime)
+		if c.Host != "" {
+			created += " on " + c.Host
+		}
+		fmt.Fprintf(w, "    created   %s\n", created)
+		if c.TPMManufacturer != "" {
+			fmt.Fprintf(w, "    tpm       %s, firmware %s\n", c.TPMManufacturer, c.TPMFirmware)
+		}
+		if c.Template != "" {
+			fmt.Fprintf(w, "    template  %s\n", c.Template)
+		}
+	} else {
+		fmt.Fprintf(w, "    created   unknown\n")
+	}
+	if km.Uses != 0 {
+		fmt.Fprintf(w, "    used      %d times, last %s\n", km.Uses, km.LastUsed.Local().Format(time.DateTime))
+	} else {
+		fmt.Fprintf(w, "    used      never\n")
+	}
+	if km.NotBefore != nil {
+		fmt.Fprintf(w, "    valid     from %s\n", km.NotBefore.Local().Format(time.DateTime))
+	}
+	if km.NotAfter != nil {
+		fmt.Fprintf(w, "    valid     until %s\n", km.NotAfter.Local().Format(time.DateTime))
+	}
+	if len(km.Algorithms) != 0 {
+		fmt.Fprintf(w, "    signs     only %s\n", strings.Join(km.Algorithms, ","))
+	}
+}
+
+func deleteCommand(c *cli, args []string) error {
+	if len(args) < 2 {
+		return errors.New("delete needs the fingerprints of the keys")
+	}
+	ks, done, err := c.openKeystore()
+	if err != nil {
+		return err
+	}
+	defer done()
+	keys, err := ks.Keys()
+	if err != nil {
+		return err
+	}
+	r, ok := ks.(keystore.Remover)
+	if !ok {
+		return errors.New("keys can't be removed from the keystore")
+	}
+	deleted := []utils.KeyJSON{}
+	for _, fp := range args[1:] {
+		found := false
+		for _, k := range keys {
+			if k.Fingerprint() != fp {
+				continue
+			}
+			if err := r.Remove(k); err != nil {
+				return fmt.Errorf("failed removing %s: %w", fp, err)
+			}
+			deleted = append(deleted, utils.NewKeyJSON(k))
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("no key with the fingerprint %s", fp)
+		}
+	}
+	if c.jsonOutput {
+		return utils.PrintJSON(os.Stdout, struct {
+			Deleted []utils.KeyJSON `json:"deleted"`
+		}{deleted})
+	}
+	for _, kj := range deleted {
+		fmt.Printf("Deleted %s %s\n", kj.Fingerprint, kj.Comment)
+	}
+	return nil
+}
+
+// statusCommand shows if the agent is running, and the keys it lists
+func statusCommand(c *cli, args []string) error {
+	status := struct {
+		Running bool            `json:"running"`
+		Socket  string          `json:"socket"`
+		Error   string          `json:"error,omitempty"`
+		Keys    []utils.KeyJSON `json:"keys"`
+		// read directly, so also without the agent
+		TPM      *tpmStatus `json:"tpm,omitempty"`
+		TPMError string     `json:"tpm_error,omitempty"`
+	}{Socket: c.socketPath, Keys: []utils.KeyJSON{}}
+
+	err := ping(c.socketPath, c.requestTimeout)
+	if err == nil {
+		var keys []*sshagent.Key
+		keys, err = listAgent(c.socketPath, c.requestTimeout)
+		for _, k := range keys {
+			kj := utils.KeyJSON{
+				Fingerprint:   ssh.FingerprintSHA256(k),
+				Type:          k.Type(),
+				Comment:       k.Comment,
+				AuthorizedKey: k.String(),
+			}
+			status.Keys = append(status.Keys, kj)
+		}
+	}
+	status.Running = err == nil
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	tpm, terr := c.tpm()
+	if terr == nil {
+		status.TPM, terr = readTPMStatus(tpm)
+		tpm.Close()
+	}
+	if terr != nil {
+		status.TPMError = terr.Error()
+	}
+
+	if c.jsonOutput {
+		if err := utils.PrintJSON(os.Stdout, status); err != nil {
+			return err
+		}
+	} else {
+		if status.Running {
+			fmt.Printf("ssh-tpm-agent is running on %s with %d keys\n", status.Socket, len(status.Keys))
+			for _, kj := range status.Keys {
+				fmt.Printf("%s %s %s\n", kj.Fingerprint, kj.Type, kj.Comment)
+			}
+			fmt.Println()
+		}
+		if status.TPM != nil {
+			printTPMStatus(os.Stdout, status.TPM)
+		} else {
+			fmt.Printf("can't read the TPM: %s\n", status.TPMError)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("ssh-tpm-agent is not running on %s: %w", c.socketPath, err)
+	}
+	return nil
+}
+
+func listAgent(socketPath string, timeout time.Duration) ([]*sshagent.Key, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	return sshagent.NewClient(conn).List()
+}
+
+func setupCommand(c *cli, args []string) error {
+	// setup takes its flags after the command
+	if err := flag.CommandLine.Parse(args[1:]); err != nil {
+		return err
+	}
+	ownerPassword := readOwnerPassword(c.askOwnerPassword)
+	tpm, err := c.tpm()
+	if err != nil {
+		return fmt.Errorf("can't open the TPM: %w", err)
+	}
+	checks, err := setup(tpm, ownerPassword, c.persistSRK)
+	tpm.Close()
+	if c.jsonOutput {
+		utils.PrintJSON(os.Stdout, struct {
+			Ready  bool         `json:"ready"`
+			Checks []setupCheck `json:"checks"`
+		}{err == nil, checks})
+	} else {
+		printChecks(os.Stdout, checks)
+	}
+	if err != nil {
+		return err
+	}
+	if !c.jsonOutput {
+		fmt.Println("The TPM is ready, create a key with ssh-tpm-keygen")
+	}
+	return nil
+}
+
+// lockoutCommand shows the dictionary attack state of the TPM, and resets it
+// with --reset.
+func lockoutCommand(c *cli, args []string) error {
+	fs := flag.NewFlagSet("lockout", flag.ContinueOnError)
+	var reset bool
+	fs.BoolVar(&reset, "reset", false, "reset the lockout with the lockout password")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	tpm, err := c.tpm()
+	if err != nil {
+		return fmt.Errorf("can't open the TPM: %w", err)
+	}
+	defer tpm.Close()
+	s, err := readLockout(tpm)
+	if err != nil {
+		return err
+	}
+	if reset {
+		if s, err = resetLockout(tpm, readLockoutPassword(s.LockoutAuthSet)); err != nil {
+			return err
+		}
+	}
+	if c.jsonOutput {
+		return utils.PrintJSON(os.Stdout, s)
+	}
+	printLockout(os.Stdout, s)
+	return nil
+}
+
+func pruneCommand(c *cli, args []string) error {
+	tpm, err := c.tpm()
+	if err != nil {
+		return err
+	}
+	defer tpm.Close()
+	ownerPassword := readOwnerPassword(c.askOwnerPassword)
+	ks, err := c.keystore(tpm, ownerPassword)
+	if err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		checks, err := checkKeys(ks, tpm, ownerPassword)
+		if err != nil {
+			return err
+		}
+		return utils.PrintJSON(os.Stdout, struct {
+			Keys []keyCheck `json:"keys"`
+		}{checks})
+	}
+	return prune(os.Stdout, ks, tpm, ownerPassword, func(n int) bool {
+		s, err := askpass.ReadPassphrase(fmt.Sprintf("Remove %d unrecoverable keys (y/n)? ", n), askpass.RP_ALLOW_STDIN|askpass.RPP_ECHO_ON)
+		return err == nil && string(s) == "y"
+	})
+}
+
+func pingCommand(c *cli, args []string) error {
+	err := ping(c.socketPath, c.requestTimeout)
+	if c.jsonOutput {
+		status := struct {
+			Running bool   `json:"running"`
+			Socket  string `json:"socket"`
+			Error   string `json:"error,omitempty"`
+		}{Running: err == nil, Socket: c.socketPath}
+		if err != nil {
+			status.Error = err.Error()
+		}
+		utils.PrintJSON(os.Stdout, status)
+	}
+	if err != nil {
+		return fmt.Errorf("ssh-tpm-agent is not healthy: %w", err)
+	}
+	if !c.jsonOutput {
+		fmt.Println("ssh-tpm-agent is running")
+	}
+	return nil
+}
+
+// backupCommand runs backup and restore, given as args[0]
+func backupCommand(c *cli, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("%s needs a FILE", args[0])
+	}
+	metadata, err := c.metadata()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	if args[0] == "backup" {
+		keys, err = backup(args[1], c.writeKeyDir(), metadata)
+	} else {
+		keys, err = restore(args[1], c.writeKeyDir(), metadata)
+	}
+	if err != nil {
+		return err
+	}
+	return printKeyFiles(c, args[0], args[1], keys)
+}
+
+// archiveCommand runs export and import, given as args[0]
+func archiveCommand(c *cli, args []string) error {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	var file string
+	fs.StringVar(&file, "archive", "", "tar of the keystore")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if file == "" || fs.NArg() != 0 {
+		return fmt.Errorf("%s needs --archive FILE", args[0])
+	}
+	metadata, err := c.metadata()
+	if err != nil {
+		return err
+	}
+	var keys []string
+	if args[0] == "export" {
+		keys, err = exportArchive(file, c.writeKeyDir(), metadata)
+	} else {
+		keys, err = importArchive(file, c.writeKeyDir(), metadata)
+	}
+	if err != nil {
+		return err
+	}
+	return printKeyFiles(c, args[0], file, keys)
+}
+
+// printKeyFiles prints the keys the command saved in file, or put into
+// --key-dir from it
+func printKeyFiles(c *cli, name, file string, keys []string) error {
+	if c.jsonOutput {
+		// [] rather than null without keys
+		return utils.PrintJSON(os.Stdout, struct {
+			File string   `json:"file"`
+			Keys []string `json:"keys"`
+		}{file, append([]string{}, keys...)})
+	}
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+	switch name {
+	case "backup", "export":
+		fmt.Printf("%d keys have been saved in %s\n", len(keys), file)
+	case "restore":
+		fmt.Printf("%d keys have been restored to %s\n", len(keys), c.writeKeyDir())
+	default:
+		fmt.Printf("%d keys have been imported to %s\n", len(keys), c.writeKeyDir())
+	}
+	return nil
+}
+
+func completionCommand(c *cli, args []string) error {
+	if len(args) != 2 {
+		return errors.New("completion needs a shell, bash, zsh or fish")
+	}
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	comp := &utils.Completion{
+		Program: "ssh-tpm-agent",
+		Flags:   flag.CommandLine,
+		Values: map[string]utils.CompletionKind{
+			"l":               utils.CompleteFile,
+			"A":               utils.CompleteFile,
+			"log-file":        utils.CompleteFile,
+			"pid-file":        utils.CompleteFile,
+			"metadata":        utils.CompleteFile,
+			"sealed-metadata": utils.CompleteDir,
+			"approver":        utils.CompleteFile,
+			"policy-key":      utils.CompleteFile,
+			"key-dir":         utils.CompleteDir,
+		},
+		Words:    map[string][]string{"keystore": {"file", "nv"}},
+		Commands: names,
+		Args:     utils.CompleteFile,
+	}
+	return comp.Write(os.Stdout, args[1])
+}
+
+// unitSkipFlags are the flags which don't apply to the agent service, the
+// socket comes from the socket unit.
+var unitSkipFlags = map[string]bool{
+	"l": true, "abstract": true, "print-socket": true, "s": true, "c": true, "daemon": true,
+	"pid-file": true, "install-user-units": true, "install-system": true,
+	"json": true, "persist-srk": true,
+}
+
+// unitEnvironment are the variables passed on to the agent service when
+// they are set.
+var unitEnvironment = []string{
+	"SSH_ASKPASS", "SSH_ASKPASS_REQUIRE",
+	"SSH_TPM_TCTI", "SSH_TPM_RELAY", "SSH_TPM_TABRMD", "SSH_TPM_AGENT_SWTPM",
+}
+
+// unitArgs returns the flags in args which apply to the agent service, args
+// being flags of fs.
+func unitArgs(fs *flag.FlagSet, args []string) []string {
+	var ret []string
+	for i := 0; i < len(args); i++ {
+		arg := []string{args[i]}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		b, isBool := f.Value.(interface{ IsBoolFlag() bool })
+		if !hasValue && !(isBool && b.IsBoolFlag()) && i+1 < len(args) {
+			i++
+			value = args[i]
+			arg = append(arg, value)
+		}
+		if !unitSkipFlags[name] {
+			ret = append(ret, arg...)
+		}
+	}
+	return ret
+}
+
+// installCommand writes the systemd user units running the agent with the
+// flags given before the command, and enables the socket.
+func installCommand(c *cli, args []string) error {
+	fs := flag.NewFlagSet("install", flag.ContinueOnError)
+	var user, system, force, noEnable bool
+	fs.BoolVar(&user, "user", true, "install the units for the current user")
+	fs.BoolVar(&system, "system", false, "install the units for all users")
+	fs.BoolVar(&force, "force", false, "replace existing units")
+	fs.BoolVar(&noEnable, "no-enable", false, "don't enable the socket")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	opts := &utils.UnitOptions{
+		Args:  unitArgs(flag.CommandLine, c.flags),
+		Force: force,
+	}
+	for _, name := range unitEnvironment {
+		if val, ok := os.LookupEnv(name); ok {
+			opts.Environment = append(opts.Environment, name+"="+val)
+		}
+	}
+	dir, err := utils.InstallAgentUnits(system, opts)
+	if errors.Is(err, utils.ErrUnitExists) {
+		return fmt.Errorf("%w, replace it with --force", err)
+	} else if err != nil {
+		return err
+	}
+	enable := []string{"--user", "enable", "--now", "ssh-tpm-agent.socket"}
+	systemctl := [][]string{{"--user", "daemon-reload"}, enable}
+	if force {
+		systemctl = append(systemctl, []string{"--user", "try-restart", "ssh-tpm-agent.service"})
+	}
+	if global, _ := utils.AgentUnitDir(true); dir == global {
+		enable = []string{"--global", "enable", "ssh-tpm-agent.socket"}
+		systemctl = [][]string{enable}
+	}
+	if noEnable {
+		fmt.Printf("Enable with: systemctl %s\n", strings.Join(enable, " "))
+		return nil
+	}
+	for _, sargs := range systemctl {
+		cmd := exec.Command("systemctl", sargs...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("systemctl %s: %w", strings.Join(sargs, " "), err)
+		}
+	}
+	fmt.Println(`Use the agent with: export SSH_AUTH_SOCK="$(ssh-tpm-agent --print-socket)"`)
+	return nil
+}
+
+// enrollCommand creates a key, has it certified by the --enroll-url endpoint
+// with the attestation of its creation and saves it with the certificate.
+func enrollCommand(c *cli, args []string) error {
+	fs := flag.NewFlagSet("enroll", flag.ContinueOnError)
+	var keyType, filename, comment string
+	var bits int
+	fs.StringVar(&keyType, "t", "", "key type, ecdsa or rsa")
+	fs.IntVar(&bits, "b", 0, "number of bits")
+	fs.StringVar(&filename, "f", "", "output file")
+	fs.StringVar(&comment, "C", "", "comment")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if c.enrollURL == "" {
+		c.enrollURL = policyRenewalURL(c.socketPath, c.requestTimeout)
+	}
+	if c.enrollURL == "" {
+		return errors.New("enroll needs the endpoint in --enroll-url")
+	}
+
+	// the key type and its file name default to what the TPM supports
+	tpm, err := c.tpm()
+	if err != nil {
+		return err
+	}
+	info, err := utils.ReadTPMInfo(tpm)
+	tpm.Close()
+	if err != nil {
+		return err
+	}
+	keyType, bits, err = info.ChooseKey(keyType, bits)
+	if err != nil {
+		return err
+	}
+	alg := tpm2.TPMAlgECC
+	if keyType == "rsa" {
+		alg = tpm2.TPMAlgRSA
+	}
+	if filename == "" {
+		filename = filepath.Join(c.writeKeyDir(), "id_"+keyType)
+	}
+	filename = strings.TrimSuffix(filename, ".tpm")
+	if err := checkEnrollFiles(filename); err != nil {
+		return err
+	}
+	if comment == "" {
+		u, uerr := user.Current()
+		host, herr := os.Hostname()
+		if uerr == nil && herr == nil {
+			comment = u.Username + "@" + host
+		}
+	}
+
+	pin, err := askpass.ReadPassphrase("Enter passphrase (empty for no passphrase): ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+	if err != nil {
+		return err
+	}
+	pin2, err := askpass.ReadPassphrase("Enter same passphrase again: ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pin, pin2) {
+		return errors.New("passphrases do not match")
+	}
+
+	ownerPassword := readOwnerPassword(c.askOwnerPassword)
+	tpm, err = c.tpm()
+	if err != nil {
+		return err
+	}
+	e, err := enroll(tpm, ownerPassword, pin, alg, bits, comment, c.enrollURL, os.Getenv("SSH_TPM_ENROLL_TOKEN"))
+	if err != nil {
+		tpm.Close()
+		return err
+	}
+	created := keystore.NewKeyCreation(tpm, e.Key)
+	tpm.Close()
+	files, err := e.save(filename)
+	if err != nil {
+		return err
+	}
+	metadata, err := c.metadata()
+	if err == nil && metadata != nil {
+		err = metadata.SetCreation(e.Key.Fingerprint(), created)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed recording the creation of the key: %v\n", err)
+	}
+	if c.jsonOutput {
+		return utils.PrintJSON(os.Stdout, struct {
+			utils.KeyJSON
+			PrivateKey  string `json:"private_key"`
+			PublicKey   string `json:"public_key"`
+			Attestation string `json:"attestation"`
+			Certificate string `json:"certificate"`
+			KeyID       string `json:"key_id"`
+		}{utils.NewKeyJSON(e.Key), files[0], files[1], files[2], files[3], e.Certificate.KeyId})
+	}
+	fmt.Printf("Your identification has been saved in %s\n", files[0])
+	fmt.Printf("Your public key has been saved in %s\n", files[1])
+	fmt.Printf("Your attestation has been saved in %s\n", files[2])
+	fmt.Printf("Your certificate has been saved in %s\n", files[3])
+	fmt.Printf("The certificate has the key ID %q and principals %s\n", e.Certificate.KeyId, strings.Join(e.Certificate.ValidPrincipals, ","))
+	return nil
+}
+
+// policyRenewalURL returns the renewal URL of the policy of the agent on
+// socketPath, if it runs
+func policyRenewalURL(socketPath string, timeout time.Duration) string {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	p, err := agent.QueryPolicy(sshagent.NewClient(conn))
+	if err != nil {
+		return ""
+	}
+	return p.RenewalURL
+}
+
+// versionCommand prints the version of the binary and how it was built
+func versionCommand(c *cli, args []string) error {
+	info := utils.ReadBuildInfo(Version)
+	if c.jsonOutput {
+		return utils.PrintJSON(os.Stdout, info)
+	}
+	fmt.Printf("ssh-tpm-agent %s\n", info.Version)
+	if info.Commit != "" {
+		commit := info.Commit
+		if info.CommitTime != "" {
+			commit += " " + info.CommitTime
+		}
+		if info.Modified {
+			commit += " (modified)"
+		}
+		fmt.Printf("commit %s\n", commit)
+	}
+	fmt.Printf("go %s %s\n", info.GoVersion, info.Platform)
+	fmt.Printf("features %s\n", strings.Join(info.Features, " "))
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestDeleteCommand(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	dir := t.TempDir()
+	var keys []*key.SSHTPMKey
+	for _, name := range []string{"id_a", "id_b"} {
+		k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := k.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".tpm"), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+
+	c := &cli{keyDir: dir, keystoreType: "file", jsonOutput: true}
+	if err := deleteCommand(c, []string{"delete", "SHA256:unknown"}); err == nil {
+		t.Fatal("deleted a key which doesn't exist")
+	}
+	if err := deleteCommand(c, []string{"delete", keys[0].Fingerprint()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "id_a.tpm")); !os.IsNotExist(err) {
+		t.Fatal("key not deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "id_b.tpm")); err != nil {
+		t.Fatal("other key deleted")
+	}
+	if lookupCommand("list") == nil || lookupCommand("lsit") != nil {
+		t.Fatal("unexpected command lookup")
+	}
+}
+
+func TestReadOnlyCommands(t *testing.T) {
+	c := &cli{readOnly: true}
+	for _, name := range []string{"keygen", "restore", "import", "enroll"} {
+		if err := c.checkReadOnly(lookupCommand(name)); err == nil {
+			t.Fatalf("%s allowed with --read-only", name)
+		}
+	}
+	for _, name := range []string{"list", "backup", "export", "status"} {
+		if err := c.checkReadOnly(lookupCommand(name)); err != nil {
+			t.Fatalf("%s refused with --read-only: %v", name, err)
+		}
+	}
+	c.readOnly = false
+	if err := c.checkReadOnly(lookupCommand("keygen")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnitArgs(t *testing.T) {
+	fs := flag.NewFlagSet("ssh-tpm-agent", flag.ContinueOnError)
+	fs.String("l", "", "")
+	fs.String("key-dir", "", "")
+	fs.Bool("batch", false, "")
+	fs.Bool("daemon", false, "")
+	fs.Duration("timeout", 0, "")
+
+	got := unitArgs(fs, []string{"-l", "/tmp/sock", "--key-dir", "/keys", "--daemon", "--batch", "--timeout=30s"})
+	want := []string{"--key-dir", "/keys", "--batch", "--timeout=30s"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q, expected %q", got, want)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+)
+
+// debugStats is the response of /debug/stats
+type debugStats struct {
+	Goroutines  int              `json:"goroutines"`
+	HeapAlloc   uint64           `json:"heap_alloc"`
+	HeapObjects uint64           `json:"heap_objects"`
+	NumGC       uint32           `json:"num_gc"`
+	Agent       agent.DebugState `json:"agent"`
+}
+
+// listenDebug listens on a UNIX socket for paths starting with / or @, and
+// on a loopback TCP address for anything else. pprof shows the command line
+// and memory of the agent, so it's never served to other hosts.
+func listenDebug(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "@") {
+		if !strings.HasPrefix(addr, "@") {
+			if err := os.MkdirAll(filepath.Dir(addr), 0o700); err != nil {
+				return nil, err
+			}
+			os.Remove(addr)
+		}
+		l, err := net.Listen("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(addr, "@") {
+			if err := os.Chmod(addr, 0o600); err != nil {
+				l.Close()
+				return nil, err
+			}
+		}
+		return l, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("--debug-listen %s isn't a loopback address or a UNIX socket", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func debugHandler(a *agent.Agent) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/stats", func(w http.ResponseWriter, r *http.Request) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(debugStats{
+			Goroutines:  runtime.NumGoroutine(),
+			HeapAlloc:   m.HeapAlloc,
+			HeapObjects: m.HeapObjects,
+			NumGC:       m.NumGC,
+			Agent:       a.DebugState(),
+		})
+	})
+	return mux
+}
+
+// serveDebug serves pprof and the stats of the agent on addr, until the
+// agent exits
+func serveDebug(a *agent.Agent, addr string) error {
+	l, err := listenDebug(addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("serving debug endpoint", slog.String("address", l.Addr().String()))
+	go func() {
+		if err := http.Serve(l, debugHandler(a)); err != nil {
+			slog.Debug("debug endpoint stopped", slog.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn/tpmconntest"
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestListenDebug(t *testing.T) {
+	for _, addr := range []string{"0.0.0.0:6060", ":6060", "192.0.2.1:6060", "example.com:6060"} {
+		if l, err := listenDebug(addr); err == nil {
+			l.Close()
+			t.Fatalf("listened on %s", addr)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1:0", filepath.Join(t.TempDir(), "debug", "sock")} {
+		l, err := listenDebug(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+}
+
+func TestDebugStats(t *testing.T) {
+	tpm, sim := tpmconntest.Simulator(t)
+	a, err := agent.New(agent.WithTPM(tpm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	k, err := key.NewSSHTPMKey(sim, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(debugHandler(a))
+	defer srv.Close()
+	rsp, err := http.Get(srv.URL + "/debug/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	var stats debugStats
+	if err := json.NewDecoder(rsp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Goroutines == 0 || stats.Agent.Keys != 1 || stats.Agent.TPMWaiting != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	rsp, err = http.Get(srv.URL + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("pprof returned %s", rsp.Status)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/askpass"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+)
+
+var errDiagnose = errors.New("the key can't be used")
+
+// diagnoseStep is a key.DiagnoseStep for printing
+type diagnoseStep struct {
+	Step   string `json:"step"`
+	OK     bool   `json:"ok"`
+	RC     string `json:"rc,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func newDiagnoseStep(s key.DiagnoseStep) diagnoseStep {
+	ds := diagnoseStep{Step: s.Step, OK: s.OK()}
+	if s.Err != nil {
+		ds.Detail = s.Err.Error()
+	}
+	if s.RC != 0 {
+		ds.RC = fmt.Sprintf("0x%x", uint32(s.RC))
+	}
+	return ds
+}
+
+// printDiagnose prints the steps of diagnose as a table
+func printDiagnose(w io.Writer, steps []diagnoseStep) {
+	for _, s := range steps {
+		status := "ok"
+		if !s.OK {
+			status = "failed"
+		}
+		detail := s.Detail
+		if s.RC != "" {
+			detail = fmt.Sprintf("rc %s: %s", s.RC, detail)
+		}
+		fmt.Fprintln(w, strings.TrimSpace(fmt.Sprintf("%-8s %-8s %s", s.Step, status, detail)))
+	}
+}
+
+// diagnoseKey finds the key given to diagnose, a key file or the
+// fingerprint of a key in --key-dir or the --keystore
+func diagnoseKey(c *cli, arg string) (*key.SSHTPMKey, error) {
+	if b, err := os.ReadFile(arg); err == nil {
+		return key.Decode(b)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ks, done, err := c.openKeystore()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	keys, err := ks.Keys()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.Fingerprint() == arg {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("no key file or key with the fingerprint %s", arg)
+}
+
+// diagnoseCommand loads, authorizes and signs with a key step by step, and
+// shows which step fails
+func diagnoseCommand(c *cli, args []string) error {
+	if len(args) != 2 {
+		return errors.New("diagnose needs a key file or the fingerprint of a key")
+	}
+	k, err := diagnoseKey(c, args[1])
+	if err != nil {
+		return err
+	}
+	var pin []byte
+	if k.HasAuth() {
+		pin, err = askpass.ReadPassphrase(fmt.Sprintf("Enter passphrase for (%s): ", k.Description), askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+		if err != nil {
+			return err
+		}
+	}
+	ownerPassword := readOwnerPassword(c.askOwnerPassword)
+	tpm, err := c.tpm()
+	if err != nil {
+		return fmt.Errorf("can't open the TPM: %w", err)
+	}
+	var steps []diagnoseStep
+	failed := false
+	for _, s := range k.Diagnose(tpm, ownerPassword, pin) {
+		steps = append(steps, newDiagnoseStep(s))
+		failed = failed || !s.OK()
+	}
+	tpm.Close()
+
+	if c.jsonOutput {
+		utils.PrintJSON(os.Stdout, struct {
+			Fingerprint string         `json:"fingerprint"`
+			OK          bool           `json:"ok"`
+			Steps       []diagnoseStep `json:"steps"`
+		}{k.Fingerprint(), !failed, steps})
+	} else {
+		printDiagnose(os.Stdout, steps)
+	}
+	if failed {
+		return errDiagnose
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestDiagnose(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := key.NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		&key.CreateOptions{Userauth: []byte("1234")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []diagnoseStep
+	for _, s := range k.Diagnose(tpm, []byte(""), []byte("4321")) {
+		steps = append(steps, newDiagnoseStep(s))
+	}
+	var out bytes.Buffer
+	printDiagnose(&out, steps)
+	if !strings.Contains(out.String(), "load     ok") || !strings.Contains(out.String(), "sign     failed   rc 0x98e") {
+		t.Fatalf("unexpected diagnosis:\n%s", out.String())
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/crypto/ssh"
+)
+
+// enrollRequest is posted to the enrollment endpoint. Attestation is the PEM
+// encoded TPM2_CertifyCreation of the new key.
+type enrollRequest struct {
+	PublicKey   string `json:"public_key"`
+	Attestation string `json:"attestation"`
+	Hostname    string `json:"hostname,omitempty"`
+}
+
+// enrollResponse is the answer of the enrollment endpoint, Certificate is
+// in authorized_keys format.
+type enrollResponse struct {
+	Certificate string `json:"certificate"`
+}
+
+// enrollment is a key created for enrollment and its certificate
+type enrollment struct {
+	Key         *key.SSHTPMKey
+	Certificate *ssh.Certificate
+}
+
+var enrollTimeout = time.Minute
+
+// submitEnrollment posts the key and its attestation to url and returns the
+// certificate issued for the key. token is sent as bearer token when set.
+func submitEnrollment(url, token string, k *key.SSHTPMKey) (*ssh.Certificate, error) {
+	req := enrollRequest{
+		PublicKey:   strings.TrimSpace(string(k.AuthorizedKey())),
+		Attestation: string(k.Attestation.Bytes()),
+	}
+	req.Hostname, _ = os.Hostname()
+	ctx, cancel := context.WithTimeout(context.Background(), enrollTimeout)
+	defer cancel()
+	cert, err := requestCertificate(ctx, url, token, req)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment failed: %w", err)
+	}
+	if ssh.FingerprintSHA256(cert.Key) != k.Fingerprint() {
+		return nil, errors.New("enrollment certificate is for another key")
+	}
+	return cert, nil
+}
+
+// requestCertificate posts req as JSON to url and returns the certificate of
+// the enrollResponse
+func requestCertificate(ctx context.Context, url, token string, req any) (*ssh.Certificate, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+token)
+	}
+	rsp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return nil, fmt.Errorf("request was refused: %s: %s", rsp.Status, bytes.TrimSpace(msg))
+	}
+
+	var er enrollResponse
+	if err := json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(&er); err != nil {
+		return nil, fmt.Errorf("malformed response: %w", err)
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(er.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("malformed certificate in response: %w", err)
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("response is not a certificate")
+	}
+	return cert, nil
+}
+
+// enroll creates a key with an attestation of its creation and gets a
+// certificate for it from the enrollment endpoint.
+func enroll(tpm transport.TPMCloser, ownerPassword, pin []byte, keyType tpm2.TPMAlgID, bits int, comment, url, token string) (*enrollment, error) {
+	k, err := key.NewSSHTPMKeyWithOptions(tpm, keyType, bits, ownerPassword,
+		&key.CreateOptions{
+			Userauth: pin,
+			Attest:   true,
+		},
+		keyfile.WithDescription(comment),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := submitEnrollment(url, token, k)
+	if err != nil {
+		return nil, err
+	}
+	return &enrollment{Key: k, Certificate: cert}, nil
+}
+
+// enrollFiles are the files of an enrolled key, the certificate is
+// filename-cert.pub as ssh-add expects.
+func enrollFiles(filename string) []string {
+	return []string{filename + ".tpm", filename + ".pub", filename + ".attest", filename + "-cert.pub"}
+}
+
+// checkEnrollFiles fails if any of the files of an enrolled key exist
+func checkEnrollFiles(filename string) error {
+	for _, f := range enrollFiles(filename) {
+		if utils.FileExists(f) {
+			return fmt.Errorf("%s already exists", f)
+		}
+	}
+	return nil
+}
+
+// save writes the key, its public key, attestation and certificate to the
+// enrollFiles of filename.
+func (e *enrollment) save(filename string) ([]string, error) {
+	if err := checkEnrollFiles(filename); err != nil {
+		return nil, err
+	}
+	b, err := e.Key.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	files := enrollFiles(filename)
+	contents := [][]byte{
+		b,
+		e.Key.AuthorizedKey(),
+		e.Key.Attestation.Bytes(),
+		ssh.MarshalAuthorizedKey(e.Certificate),
+	}
+	for i, f := range files {
+		if err := utils.WriteFileAtomic(f, contents[i], 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/sshsig"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestEnroll(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "bad token", http.StatusForbidden)
+			return
+		}
+		var req enrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a, err := key.DecodeAttestation([]byte(req.Attestation))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := a.Verify(nil)
+		if err != nil || !result.Generated {
+			http.Error(w, "bad attestation", http.StatusForbidden)
+			return
+		}
+		attested, err := ssh.NewPublicKey(result.PublicKey)
+		if err != nil || ssh.FingerprintSHA256(attested) != ssh.FingerprintSHA256(pk) {
+			http.Error(w, "attestation is for another key", http.StatusForbidden)
+			return
+		}
+		cert := &ssh.Certificate{
+			Key:             pk,
+			CertType:        ssh.UserCert,
+			KeyId:           req.Hostname,
+			ValidPrincipals: []string{"user"},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(enrollResponse{
+			Certificate: string(ssh.MarshalAuthorizedKey(cert)),
+		})
+	}))
+	defer srv.Close()
+
+	e, err := enroll(tpm, []byte(""), nil, tpm2.TPMAlgECC, 256, "test", srv.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(e.Certificate.SignatureKey) != ssh.FingerprintSHA256(caSigner.PublicKey()) {
+		t.Fatal("certificate isn't signed by the ca")
+	}
+
+	filename := filepath.Join(t.TempDir(), "id_ecdsa")
+	files, err := e.save(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if !utils.FileExists(f) {
+			t.Fatalf("%s wasn't saved", f)
+		}
+	}
+	if _, err := e.save(filename); err == nil {
+		t.Fatal("replaced the enrolled key")
+	}
+
+	_, err = enroll(tpm, []byte(""), nil, tpm2.TPMAlgECC, 256, "test", srv.URL, "other")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected the enrollment to be refused, got %v", err)
+	}
+}
+
+func TestRenewCertificate(t *testing.T) {
+	ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certify := func(lifetime time.Duration) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:         signer.PublicKey(),
+			CertType:    ssh.UserCert,
+			ValidBefore: uint64(time.Now().Add(lifetime).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req renewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.Certificate))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sig, err := sshsig.Unarmor([]byte(req.Signature))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cert := pk.(*ssh.Certificate)
+		if !bytes.Equal(sig.PublicKey.Marshal(), cert.Key.Marshal()) ||
+			sshsig.Verify(sig, bytes.NewReader(renewMessage(req.Certificate, req.Timestamp)), renewNamespace) != nil {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(enrollResponse{
+			Certificate: string(ssh.MarshalAuthorizedKey(certify(time.Hour))),
+		})
+	}))
+	defer srv.Close()
+
+	renew := renewCertificate("")
+	cert, err := renew(context.Background(), srv.URL, certify(time.Minute), signer.(ssh.AlgorithmSigner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(time.Unix(int64(cert.ValidBefore), 0)) < 50*time.Minute {
+		t.Fatal("didn't get the renewed certificate")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// lockoutStatus is the dictionary attack state of the TPM
+type lockoutStatus struct {
+	InLockout      bool   `json:"in_lockout"`
+	FailedTries    uint32 `json:"failed_tries"`
+	MaxTries       uint32 `json:"max_tries"`
+	RecoveryTime   uint32 `json:"recovery_time"`
+	LockoutAuthSet bool   `json:"lockout_auth_set"`
+	Reset          bool   `json:"reset"`
+}
+
+func readLockout(tpm transport.TPMCloser) (*lockoutStatus, error) {
+	info, err := utils.ReadTPMInfo(tpm)
+	if err != nil {
+		return nil, err
+	}
+	return &lockoutStatus{
+		InLockout:      info.InLockout,
+		FailedTries:    info.LockoutCounter,
+		MaxTries:       info.MaxAuthFail,
+		RecoveryTime:   info.LockoutInterval,
+		LockoutAuthSet: info.LockoutAuthSet,
+	}, nil
+}
+
+// resetLockout forgets the failed authorizations of the TPM with the lockout
+// password, and returns the state after the reset.
+func resetLockout(tpm transport.TPMCloser, lockoutPassword []byte) (*lockoutStatus, error) {
+	err := utils.ResetLockout(tpm, lockoutPassword)
+	switch {
+	case errors.Is(err, tpm2.TPMRCBadAuth), errors.Is(err, tpm2.TPMRCAuthFail):
+		// a wrong lockout password blocks it until the lockout recovery
+		info, ierr := utils.ReadTPMInfo(tpm)
+		if ierr != nil || info.LockoutRecovery == 0 {
+			return nil, errors.New("wrong lockout password")
+		}
+		return nil, fmt.Errorf("wrong lockout password, it can be tried again in %s", seconds(info.LockoutRecovery))
+	case errors.Is(err, tpm2.TPMRCLockout):
+		return nil, errors.New("the lockout password is blocked after a wrong password, try again later")
+	case err != nil:
+		return nil, fmt.Errorf("failed resetting the lockout: %w", err)
+	}
+	s, err := readLockout(tpm)
+	if err != nil {
+		return nil, err
+	}
+	s.Reset = true
+	return s, nil
+}
+
+func seconds(s uint32) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+func printLockout(w io.Writer, s *lockoutStatus) {
+	if s.Reset {
+		fmt.Fprintln(w, "The dictionary attack lockout has been reset.")
+	}
+	fmt.Fprintf(w, "failed tries   %d of %d\n", s.FailedTries, s.MaxTries)
+	if s.RecoveryTime != 0 {
+		fmt.Fprintf(w, "recovery time  %s for each failed try\n", seconds(s.RecoveryTime))
+	} else {
+		fmt.Fprintln(w, "recovery time  never, only a reset forgets failed tries")
+	}
+	switch {
+	case !s.InLockout:
+		fmt.Fprintln(w, "lockout        no")
+	case s.RecoveryTime != 0:
+		fmt.Fprintf(w, "lockout        yes, ends in up to %s\n", seconds(s.RecoveryTime))
+	default:
+		fmt.Fprintln(w, "lockout        yes, until reset")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestLockout(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	s, err := readLockout(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.InLockout || s.MaxTries == 0 {
+		t.Fatalf("unexpected lockout state %+v", s)
+	}
+
+	_, err = tpm2.HierarchyChangeAuth{
+		AuthHandle: tpm2.TPMRHLockout,
+		NewAuth:    tpm2.TPM2BAuth{Buffer: []byte("lockout")},
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = readLockout(tpm); err != nil {
+		t.Fatal(err)
+	}
+	if !s.LockoutAuthSet {
+		t.Fatal("lockout password not reported")
+	}
+
+	if s, err = resetLockout(tpm, []byte("lockout")); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	printLockout(&out, s)
+	if !strings.Contains(out.String(), "has been reset") || !strings.Contains(out.String(), "failed tries   0 of") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+
+	if _, err := resetLockout(tpm, []byte("wrong")); err == nil || !strings.Contains(err.Error(), "wrong lockout password") {
+		t.Fatalf("expected a wrong lockout password, got %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -9,7 +11,10 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	"log/slog"
 
@@ -17,7 +22,9 @@ import (
 
 	"github.com/foxboron/ssh-tpm-agent/agent"
 	"github.com/foxboron/ssh-tpm-agent/askpass"
-	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/internal/kms"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
 	"github.com/foxboron/ssh-tpm-agent/utils"
 	"github.com/google/go-tpm/tpm2/transport"
 	sshagent "golang.org/x/crypto/ssh/agent"
@@ -27,29 +34,211 @@ import (
 var Version string
 
 const usage = `Usage:
-    ssh-tpm-agent [OPTIONS]
+    ssh-tpm-agent [OPTIONS] [agent]
     ssh-tpm-agent -l [PATH]
+    eval $(ssh-tpm-agent -s)
     ssh-tpm-agent --install-user-units
+    ssh-tpm-agent [OPTIONS] COMMAND [ARGS]
+
+Commands:
+    agent                   Run the agent, also without a command.
+    keygen [ARGS]           Create and manage keys, runs ssh-tpm-keygen with ARGS.
+    list [--long]           List the keys in --key-dir or the --keystore. --long
+                            shows when, where and with which TPM they were
+                            created, and how they were used.
+    delete FINGERPRINT...   Delete keys from --key-dir or the --keystore.
+    status                  Show if the agent on -l runs and the keys it has,
+                            and what the TPM is and supports.
+    setup [-o] [--persist-srk]
+                            Check and prepare the TPM for ssh-tpm-agent.
+    lockout [--reset]       Show the dictionary attack lockout state of the TPM.
+                            --reset forgets the failed tries with the lockout
+                            password.
+    prune                   Remove keys of a cleared or replaced TPM.
+    diagnose FILE | FINGERPRINT
+                            Show which step of using a key fails.
+    ping                    Check that the agent on -l answers and can use the TPM.
+    backup FILE             Back up the keys in --key-dir.
+    restore FILE            Restore a backup to --key-dir.
+    export --archive FILE   Write the keys in --key-dir to a tar.
+    import --archive FILE   Put the keys of a tar into --key-dir.
+    completion bash | zsh | fish
+                            Print the shell completion script.
+    install [--user | --system] [--force] [--no-enable]
+                            Install and enable the systemd units, running the
+                            agent with the OPTIONS given before install.
+    enroll [-t ecdsa | rsa] [-b BITS] [-f FILE] [-C COMMENT]
+                            Create a key and get a certificate for it from
+                            --enroll-url.
+    version                 Print the version, commit, Go version and features
+                            the binary was built with.
 
 Options:
     -l PATH                 Path of the UNIX socket to open, defaults to
-                            $XDG_RUNTIME_DIR/ssh-tpm-agent.sock.
+                            $XDG_RUNTIME_DIR/ssh-tpm-agent.sock. %t in PATH is
+                            $XDG_RUNTIME_DIR, %u the user name and %U the uid.
+                            Paths starting with @ are sockets in the abstract
+                            namespace of Linux.
 
-    -A PATH                 Fallback ssh-agent sockets for additional key lookup.
+    --abstract              Listen on the abstract socket @ssh-tpm-agent/UID unless
+                            -l is given. Only the user of the agent can connect.
+
+    -A [LABEL=]PATH         Upstream ssh-agent sockets whose keys are served after the
+                            TPM keys, like gpg-agent or a forwarded agent. Can be
+                            repeated. Keys with a LABEL are listed with (from LABEL)
+                            in their comment, keys in several agents only once.
+
+    --piv PROVIDER          Serve the keys of a PIV token, like a YubiKey, along with
+                            the TPM keys. PROVIDER is the PKCS#11 module of the
+                            token, e.g. /usr/lib/libykcs11.so, which is loaded in a
+                            private ssh-agent. The PIN is asked for on start.
+
+    --piv-key FINGERPRINT   Only serve the PIV keys with these fingerprints. Can be
+                            repeated, all keys of the token are served without it.
+
+    --kms-key NAME          Serve the Google Cloud KMS key version NAME, like
+                            projects/P/locations/L/keyRings/R/cryptoKeys/K/cryptoKeyVersions/1,
+                            after the TPM keys. Uses GOOGLE_OAUTH_ACCESS_TOKEN or
+                            gcloud auth print-access-token. Can be repeated.
 
     --print-socket          Prints the socket to STDIN.
 
+    --daemon                Detach from the terminal and run in the background, for
+                            systems without systemd. Logs go to --log-file.
+
+    --metadata PATH         Where to record when and how often keys are used, which
+                            is shown in ssh-add -l, and to read the validity windows
+                            of keys from. An empty PATH disables it.
+                            Defaults to $XDG_STATE_HOME/ssh-tpm-agent/metadata.json.
+
+    --sealed-metadata DIR   Keep the key metadata in DIR instead of --metadata, a
+                            file per key encrypted and authenticated under a secret
+                            sealed to the TPM, so changes on disk are detected.
+
+    --pid-file PATH         Path of the pid file, which is locked while the agent runs
+                            so only one agent uses a socket. Defaults to the socket
+                            path with a .pid suffix, in $XDG_RUNTIME_DIR for
+                            abstract sockets.
+
+    --log-file PATH         Write logs to PATH instead of stdout. Defaults to
+                            $XDG_STATE_HOME/ssh-tpm-agent/agent.log with --daemon.
+
+    -s, -c                  Start the agent in the background and print sh or csh
+                            commands setting SSH_AUTH_SOCK and SSH_AGENT_PID, like
+                            ssh-agent(1).
+
     --key-dir PATH          Path of the directory to look for TPM sealed keys in,
-                            defaults to $HOME/.ssh
+                            defaults to $HOME/.ssh. A colon separated list merges
+                            the keys of all directories.
+
+    --key-glob GLOB         Load key files with names matching the glob, like
+                            'id_*.tpm'. Defaults to '*.tpm'.
 
     --no-load               Do not load TPM sealed keys by default.
 
+    --primary-key NAME      Add the primary key called NAME, which the TPM recreates
+                            from its seed without a key file. Can be repeated.
+
+    --no-watch              Do not reload keys when files in --key-dir change.
+
+    --keystore file | nv    Where to load TPM sealed keys from. file loads keys
+                            from --key-dir, nv loads keys stored in TPM NV
+                            indices by ssh-tpm-keygen --nv. Defaults to file.
+
+    --read-only             Never change the keystore, for machine keys shipped
+                            on an immutable image. Adding, creating, importing
+                            and removing keys is refused.
+
     -o, --owner-password    Ask for the owner password.
 
     --no-cache              The agent will not cache key passwords.
 
+    --pin-ttl DURATION      Forget a cached key password this long after it was
+                            entered. Cached passwords are kept in memory locked
+                            from being swapped out, and forgotten on
+                            ssh-tpm-add --forget-pins.
+
+    --batch                 Never prompt for key passwords or confirmations. Requests
+                            which would need a prompt fail instead. For headless
+                            servers and CI.
+
+    --confirm-for DURATION  Remember a confirmed use of a key added with ssh-add -c,
+                            or needing confirmation by the --policy, for this long.
+
+    --confirm-per-destination
+                            Only remember confirmations for the host the key was
+                            used for. Uses without a bound session are always
+                            confirmed.
+
+    --idle-lock DURATION    Lock the agent when no key was used for this long. The
+                            cached key passwords are forgotten, and the next use of
+                            a key has to be confirmed through SSH_ASKPASS or by
+                            entering its password again.
+
+    --lock-with-session     Lock the agent the same way when systemd-logind locks
+                            the session, like when the screen locks, and unlock
+                            it with the session.
+
+    --approver PROGRAM      Program asked to approve each use of keys created with
+                            ssh-tpm-keygen --approver. It gets the key fingerprint
+                            and comment as arguments and a hex challenge on stdin,
+                            and prints the base64 signature of the challenge.
+
+    --no-sha1               Refuse ssh-rsa signatures, which use SHA-1. RSA keys
+                            still sign with rsa-sha2-256 and rsa-sha2-512.
+
+    --timeout DURATION      Fail requests, including passphrase prompts, that take
+                            longer than DURATION. 0 disables it. Defaults to 1m.
+
+    --tpm-idle-timeout DURATION
+                            Close the TPM after it has been unused for DURATION,
+                            e.g. 30s or 5m. 0 keeps it open. Defaults to 1m.
+
     -d                      Enable debug logging.
 
+    --debug-tpm             Log every TPM command with its sessions, and the
+                            response code.
+
+    --debug-proto           Log the agent protocol requests and responses of each
+                            connection. Key material and signed data are left out.
+
+    --debug-listen ADDR     Serve net/http/pprof and /debug/stats, the goroutines,
+                            heap, connections and queued TPM operations of the
+                            agent, on ADDR. ADDR is a UNIX socket path starting
+                            with / or @, or a loopback address like 127.0.0.1:6060.
+
+    --persist-srk           With setup, make the SRK persistent at 0x81000001.
+
+    --json                  Print the result of the commands as JSON. prune then
+                            only reports the keys and doesn't remove them.
+
+    --enroll-url URL        Endpoint the enroll command sends new keys and their
+                            attestation to, which answers with a certificate.
+                            Defaults to the renewal URL of the agent's --policy.
+
+    --renew                 Renew certificates of the loaded keys at --enroll-url
+                            before they expire.
+
+    --vault-sign PATH       Get short-lived certificates for the loaded keys from the
+                            Vault SSH secrets engine at $VAULT_ADDR, with the sign
+                            path of a role like ssh-client-signer/sign/my-role, and
+                            renew them before they expire. The token is read from
+                            VAULT_TOKEN or ~/.vault-token.
+
+    --vault-principals LIST Comma separated principals of the Vault certificates.
+                            Defaults to the default principals of the role.
+
+    --policy URL | PATH     Signed key policy of the fleet, fetched from a https
+                            URL or read from a file placed by device management.
+                            The signature is read from the same place with a .sig
+                            suffix.
+
+    --policy-key PATH       Administrator public keys the --policy is signed with
+                            by ssh-keygen -Y sign -n ssh-tpm-agent-policy.
+
+    --policy-interval DURATION
+                            How often the --policy is fetched. Defaults to 1h.
+
     --install-user-units    Installs systemd system units and sshd configs for using
                             ssh-tpm-agent as a hostkey agent.
 
@@ -61,10 +250,71 @@ TPM sealed keys are private keys created inside the Trusted Platform Module
 (TPM) and sealed in .tpm suffixed files. They are bound to the hardware they
 where produced on and can't be transferred to other machines.
 
-Use ssh-tpm-keygen to create new keys.
+Use ssh-tpm-keygen, or ssh-tpm-agent keygen, to create new keys.
+
+Options which aren't given on the command line are read from
+$XDG_CONFIG_HOME/ssh-tpm-agent/config, a flag name and its value on each line.
+Lines after a [ssh-tpm-agent] header only apply to ssh-tpm-agent, the others
+also to ssh-tpm-keygen and ssh-tpm-add.
+
+The ping command connects to a running agent, checks that it answers requests
+and can use the TPM, and exits non-zero otherwise.
+
+The setup command checks that the TPM supports the keys of ssh-tpm-agent, that
+the owner hierarchy can be used with the owner password, and that the TPM is
+not in dictionary attack lockout, and reports what is missing.
+
+The lockout command shows how many failed authorizations the TPM counted, how
+many it allows before the dictionary attack lockout and how long it takes to
+forget one. With --reset the lockout password is read from
+SSH_TPM_AGENT_LOCKOUT_PASSWORD, or asked for if the TPM has one, and the TPM
+forgets all failed tries. A wrong lockout password blocks resets for a while.
+
+The prune command finds keys which can't be loaded because the TPM was cleared
+or replaced since they were created, and offers to remove them. These keys are
+unrecoverable.
+
+The diagnose command loads the parent of a key, loads the key, satisfies its
+policy and makes a test signature, or unseals a sealed key, one step at a time.
+It shows the step which failed and the response code of the TPM.
+
+The version command prints the version along with the commit and Go version
+of the build, and the features the binary was built with. With --json it is
+printed as JSON for tools to check.
+
+The completion command prints the completion script for the shell, e.g.
+    $ ssh-tpm-agent completion bash > /usr/share/bash-completion/completions/ssh-tpm-agent
+
+The backup command writes the TPM sealed keys in --key-dir, with their public
+keys, and the --metadata to FILE, encrypted and authenticated with a
+passphrase. The restore command puts them back, without replacing different
+files. Keys still only work on the TPM they were created on, unless they were
+created with ssh-tpm-keygen --duplicable and exported.
+
+The export and import commands do the same with a plain tar, keeping the
+permissions and modification times of the files, to move the keystore to a
+reinstalled machine or another home directory on the same TPM.
+
+The enroll command creates a key in --key-dir, by default id_ecdsa, with an
+attestation of its creation, and posts both as JSON to --enroll-url. The
+certificate the endpoint returns is saved as FILE-cert.pub. A bearer token for
+the endpoint is read from SSH_TPM_ENROLL_TOKEN.
+
+With --renew the agent posts certificates of loaded keys with less than a
+fifth of their lifetime left to the same endpoint, with an SSH signature by the
+key in the ssh-tpm-agent-renew namespace, and swaps in the new certificate.
+
+The --policy is a JSON manifest which can limit the key types the agent uses
+with "algorithms", require confirmations with "confirm" or for the fingerprints
+in "confirm_keys", and give the "renewal_url" of certificates. Manifests with a
+lower "serial" than the current one are rejected. The last policy is kept in
+$XDG_STATE_HOME/ssh-tpm-agent/policy.json while the URL can't be reached.
 
 The agent loads all TPM sealed keys from $HOME/.ssh, unless --key-dir is
-specified.
+specified. New, changed and removed keys are picked up while the agent runs.
+With a list like --key-dir $HOME/.ssh:/etc/ssh-tpm-agent/keys, keys in earlier
+directories take precedence. Commands writing keys use the first directory.
+Only key files matching --key-glob are loaded.
 
 Example:
     $ ssh-tpm-agent &
@@ -98,45 +348,110 @@ func NewSocketSet(allowed []string, d string) *SocketSet {
 
 func main() {
 	flag.Usage = func() {
-		fmt.Println(usage)
+		fmt.Printf("%s\n", usage)
 	}
 
 	var (
-		socketPath, keyDir               string
-		swtpmFlag, printSocketFlag       bool
+		printSocketFlag                  bool
 		installUserUnits, system, noLoad bool
-		askOwnerPassword, debugMode      bool
-		noCache                          bool
+		debugMode                        bool
+		noCache, noWatch, batch          bool
+		shFlag, cshFlag, daemon          bool
+		abstract                         bool
+		debugProto, noSHA1, renew        bool
+		logFile, pidFile                 string
+		approver, debugListen            string
+		pivProvider                      string
+		vaultPath, vaultPrincipals       string
+		tpmIdleTimeout, confirmFor       time.Duration
+		idleLock, pinTTL                 time.Duration
+		confirmPerDestination            bool
+		lockWithSessionFlag              bool
+		policySource, policyKey          string
+		policyInterval                   time.Duration
 	)
+	c := &cli{}
+
+	runtimeDir := utils.RuntimeDir()
 
 	envSocketPath := func() string {
 		// Find a default socket name from ssh-tpm-agent.service
-		if val, ok := os.LookupEnv("SSH_TPM_AUTH_SOCK"); ok && socketPath == "" {
+		if val, ok := os.LookupEnv("SSH_TPM_AUTH_SOCK"); ok && c.socketPath == "" {
 			return val
 		}
-
-		dir := os.Getenv("XDG_RUNTIME_DIR")
-		if dir == "" {
-			dir = "/var/tmp"
-		}
-		return path.Join(dir, "ssh-tpm-agent.sock")
+		return path.Join(runtimeDir, "ssh-tpm-agent.sock")
 	}()
 
-	var sockets SocketSet
+	var sockets, primaryKeys, pivKeys, kmsKeys SocketSet
 
-	flag.StringVar(&socketPath, "l", envSocketPath, "path of the UNIX socket to listen on")
+	flag.StringVar(&c.socketPath, "l", envSocketPath, "path of the UNIX socket to listen on")
+	flag.BoolVar(&abstract, "abstract", false, "listen on the abstract socket @ssh-tpm-agent/UID")
 	flag.Var(&sockets, "A", "fallback ssh-agent sockets")
-	flag.BoolVar(&swtpmFlag, "swtpm", false, "use swtpm instead of actual tpm")
+	flag.BoolVar(&c.swtpm, "swtpm", false, "use swtpm instead of actual tpm")
 	flag.BoolVar(&printSocketFlag, "print-socket", false, "print path of UNIX socket to stdout")
-	flag.StringVar(&keyDir, "key-dir", "", "path of the directory to look for keys in")
+	flag.BoolVar(&shFlag, "s", false, "start in the background and print sh commands for the environment")
+	flag.BoolVar(&cshFlag, "c", false, "start in the background and print csh commands for the environment")
+	flag.BoolVar(&daemon, "daemon", false, "detach from the terminal and run in the background")
+	flag.StringVar(&logFile, "log-file", "", "write logs to this file")
+	flag.StringVar(&pidFile, "pid-file", "", "path of the pid file")
+	flag.StringVar(&c.metadataFile, "metadata", path.Join(utils.StateDir(), "metadata.json"), "path of the key metadata file")
+	flag.StringVar(&c.sealedMetadata, "sealed-metadata", "", "directory of the key metadata sealed to the tpm")
+	flag.StringVar(&c.keyDir, "key-dir", "", "colon separated list of directories to look for keys in")
+	flag.StringVar(&c.keyGlob, "key-glob", keystore.DefaultGlob, "glob matching the names of key files")
 	flag.BoolVar(&installUserUnits, "install-user-units", false, "install systemd user units")
 	flag.BoolVar(&system, "install-system", false, "install systemd user units")
 	flag.BoolVar(&noLoad, "no-load", false, "don't load TPM sealed keys")
-	flag.BoolVar(&askOwnerPassword, "o", false, "ask for the owner password")
-	flag.BoolVar(&askOwnerPassword, "owner-password", false, "ask for the owner password")
+	flag.Var(&primaryKeys, "primary-key", "names of primary keys to add")
+	flag.BoolVar(&noWatch, "no-watch", false, "don't reload keys when the key directory changes")
+	flag.StringVar(&c.keystoreType, "keystore", "file", "where to load TPM sealed keys from")
+	flag.BoolVar(&c.readOnly, "read-only", false, "never change the keystore")
+	flag.BoolVar(&c.askOwnerPassword, "o", false, "ask for the owner password")
+	flag.BoolVar(&c.askOwnerPassword, "owner-password", false, "ask for the owner password")
 	flag.BoolVar(&debugMode, "d", false, "debug mode")
+	flag.BoolVar(&utils.DebugTPM, "debug-tpm", false, "log every tpm command and response")
+	flag.BoolVar(&debugProto, "debug-proto", false, "log the agent protocol messages")
+	flag.StringVar(&debugListen, "debug-listen", "", "serve pprof and runtime stats on this address")
 	flag.BoolVar(&noCache, "no-cache", false, "do not cache key passwords")
+	flag.DurationVar(&pinTTL, "pin-ttl", 0, "forget cached key passwords after this long")
+	flag.BoolVar(&batch, "batch", false, "never prompt, fail requests which need a prompt")
+	flag.DurationVar(&confirmFor, "confirm-for", 0, "remember confirmations of keys for this long")
+	flag.BoolVar(&confirmPerDestination, "confirm-per-destination", false, "remember confirmations per destination host")
+	flag.DurationVar(&idleLock, "idle-lock", 0, "lock the agent when no key was used for this long")
+	flag.BoolVar(&lockWithSessionFlag, "lock-with-session", false, "lock the agent when logind locks the session")
+	flag.StringVar(&approver, "approver", "", "program approving the use of keys")
+	flag.StringVar(&pivProvider, "piv", "", "pkcs#11 provider of a piv token to serve the keys of")
+	flag.Var(&pivKeys, "piv-key", "fingerprints of the piv keys to serve")
+	flag.Var(&kmsKeys, "kms-key", "names of google cloud kms key versions to serve")
+	flag.BoolVar(&noSHA1, "no-sha1", false, "refuse ssh-rsa signatures using sha1")
+	flag.BoolVar(&c.persistSRK, "persist-srk", false, "make the srk persistent with setup")
+	flag.BoolVar(&c.jsonOutput, "json", false, "print the result of commands as json")
+	flag.StringVar(&c.enrollURL, "enroll-url", "", "endpoint certifying keys created with enroll")
+	flag.BoolVar(&renew, "renew", false, "renew certificates before they expire")
+	flag.StringVar(&vaultPath, "vault-sign", "", "sign path of a vault ssh secrets engine role")
+	flag.StringVar(&vaultPrincipals, "vault-principals", "", "principals of certificates signed by vault")
+	flag.StringVar(&policySource, "policy", "", "url or file of the signed key policy")
+	flag.StringVar(&policyKey, "policy-key", "", "public keys the key policy is signed with")
+	flag.DurationVar(&policyInterval, "policy-interval", time.Hour, "how often the key policy is fetched")
+	flag.DurationVar(&c.requestTimeout, "timeout", agent.DefaultRequestTimeout, "deadline of a single request")
+	flag.DurationVar(&tpmIdleTimeout, "tpm-idle-timeout", time.Minute, "close the tpm after being idle for this long")
 	flag.Parse()
+	c.flags = os.Args[1 : len(os.Args)-flag.NArg()]
+	if err := utils.LoadConfig(flag.CommandLine, "ssh-tpm-agent", utils.ConfigFile()); err != nil {
+		log.Fatal(err)
+	}
+
+	if abstract && !isFlagSet(flag.CommandLine, "l") {
+		c.socketPath = "@ssh-tpm-agent/%U"
+	}
+	socketPath, err := utils.ExpandSocketPath(c.socketPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c.socketPath = socketPath
+
+	if Version != "" {
+		agent.Version = Version
+	}
 
 	opts := &slog.HandlerOptions{
 		Level: slog.LevelInfo,
@@ -146,7 +461,17 @@ func main() {
 		opts.Level = slog.LevelDebug
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, opts))
+	logOutput := os.Stdout
+	if logFile != "" && !daemon && !shFlag && !cshFlag {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		logOutput = f
+	}
+
+	logger := slog.New(slog.NewTextHandler(logOutput, opts))
 
 	slog.SetDefault(logger)
 
@@ -161,102 +486,350 @@ func main() {
 		os.Exit(0)
 	}
 
-	if socketPath == "" {
+	if c.socketPath == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
 
 	if printSocketFlag {
-		fmt.Println(socketPath)
+		fmt.Println(c.socketPath)
 		os.Exit(0)
 	}
 
-	if keyDir == "" {
-		keyDir = utils.SSHDir()
+	if pidFile == "" {
+		pidFile = c.socketPath + ".pid"
+		if agent.IsAbstractSocket(c.socketPath) {
+			name := strings.ReplaceAll(strings.TrimPrefix(c.socketPath, "@"), "/", "-")
+			pidFile = path.Join(runtimeDir, name+".pid")
+		}
+	}
+
+	if shFlag || cshFlag {
+		if pid, ok := runningAgent(pidFile); ok {
+			printEnv(os.Stdout, cshFlag, c.socketPath, pid)
+			os.Exit(0)
+		}
+		pid, err := background(c.socketPath, logFile, []string{"-s", "--s", "-c", "--c"})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed starting ssh-tpm-agent: %v\n", err)
+			os.Exit(1)
+		}
+		printEnv(os.Stdout, cshFlag, c.socketPath, pid)
+		os.Exit(0)
+	}
+
+	if daemon {
+		if pid, ok := runningAgent(pidFile); ok {
+			fmt.Printf("ssh-tpm-agent is already running with pid %d, listening on %s\n", pid, c.socketPath)
+			os.Exit(0)
+		}
+		if logFile == "" {
+			logFile = defaultLogFile()
+		}
+		pid, err := background(c.socketPath, logFile, []string{"-daemon", "--daemon"})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed starting ssh-tpm-agent: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("ssh-tpm-agent started with pid %d, listening on %s\n", pid, c.socketPath)
+		os.Exit(0)
+	}
+
+	if c.keyDir == "" {
+		c.keyDir = utils.SSHDir()
+	}
+	if _, err := filepath.Match(c.keyGlob, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --key-glob %q: %v\n", c.keyGlob, err)
+		os.Exit(1)
+	}
+
+	if name := flag.Arg(0); name != "" {
+		cmd := lookupCommand(name)
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+			flag.Usage()
+			os.Exit(1)
+		}
+		if cmd.run != nil {
+			if err := c.checkReadOnly(cmd); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if err := cmd.run(c, flag.Args()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
+	if batch && c.askOwnerPassword {
+		slog.Error("can't ask for the owner password in batch mode, use SSH_TPM_AGENT_OWNER_PASSWORD")
+		os.Exit(1)
+	}
+
+	if vaultPath != "" && os.Getenv("VAULT_ADDR") == "" {
+		slog.Error("--vault-sign needs the address of vault in VAULT_ADDR")
+		os.Exit(1)
 	}
 
 	if term.IsTerminal(int(os.Stdin.Fd())) {
 		slog.Info("Warning: ssh-tpm-agent is meant to run as a background daemon.")
 		slog.Info("Running multiple instances is likely to lead to conflicts.")
-		slog.Info("Consider using a systemd service.")
+		slog.Info("Consider using a systemd service, or --daemon.")
 	}
 
-	var agents []sshagent.ExtendedAgent
+	var providers []agent.Provider
 
 	for _, s := range sockets.Value {
-		conn, err := net.Dial("unix", s)
+		u := parseUpstream(s)
+		// forwarded agents come and go, the keys are listed once it's back
+		if conn, err := net.Dial("unix", u.Socket); err != nil {
+			slog.Warn("upstream agent isn't reachable", slog.String("socket", u.Socket), slog.String("error", err.Error()))
+		} else {
+			conn.Close()
+		}
+		providers = append(providers, u)
+	}
+
+	if pivProvider != "" {
+		piv, err := startPIV(pivProvider)
 		if err != nil {
-			slog.Error(err.Error())
+			slog.Error("starting the piv backend", slog.String("error", err.Error()))
 			os.Exit(1)
 		}
-		agents = append(agents, sshagent.NewClient(conn))
+		defer piv.Close()
+		providers = append(providers, &selectedAgent{piv, pivKeys.Value})
 	}
 
-	listener, err := createListener(socketPath)
+	// Creating the listener removes the socket of any running agent
+	lock, pid, err := lockPidFile(pidFile)
+	if errors.Is(err, errRunning) {
+		slog.Info("ssh-tpm-agent is already running", slog.Int("pid", pid), slog.String("socket", c.socketPath))
+		fmt.Println(c.socketPath)
+		os.Exit(0)
+	} else if err != nil {
+		slog.Error("creating pid file", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	defer lock.Close()
+	defer os.Remove(pidFile)
+
+	listener, err := createListener(c.socketPath)
 	if err != nil {
 		slog.Error("creating listener", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 
-	agent := agent.NewAgent(listener, agents,
+	// TPM Callback
+	tpmFetch := tpmconn.Func(func() (transport.TPMCloser, error) {
+		// the agent keeps the TPM open until --tpm-idle-timeout passes, and
+		// opens it again for the next request if it fails, like right after
+		// resuming
+		return utils.TPM(c.swtpm)
+	})
+
+	// Prompts are bounded by the request timeout so a stuck askpass program
+	// is killed along with the request
+	promptContext := func() (context.Context, context.CancelFunc) {
+		if c.requestTimeout == 0 {
+			return context.WithCancel(context.Background())
+		}
+		return context.WithTimeout(context.Background(), c.requestTimeout)
+	}
 
-		// TPM Callback
-		func() (tpm transport.TPMCloser) {
-			// the agent will close the TPM after this is called
-			tpm, err := utils.TPM(swtpmFlag)
-			if err != nil {
-				log.Fatal(err)
-			}
-			return tpm
-		},
+	// Owner password
+	ownerPassword := func() ([]byte, error) {
+		if c.askOwnerPassword {
+			ctx, cancel := promptContext()
+			defer cancel()
+			return askpass.ReadPassphraseContext(ctx, "Enter owner password for TPM", askpass.RP_USE_ASKPASS)
+		} else {
+			ownerPassword := os.Getenv("SSH_TPM_AGENT_OWNER_PASSWORD")
 
-		// Owner password
-		func() ([]byte, error) {
-			if askOwnerPassword {
-				return askpass.ReadPassphrase("Enter owner password for TPM", askpass.RP_USE_ASKPASS)
-			} else {
-				ownerPassword := os.Getenv("SSH_TPM_AGENT_OWNER_PASSWORD")
+			return []byte(ownerPassword), nil
+		}
+	}
 
-				return []byte(ownerPassword), nil
-			}
-		},
-
-		// PIN Callback with caching
-		// SSHKeySigner in signer/signer.go resets this value if
-		// we get a TPMRCAuthFail
-		func(key *key.SSHTPMKey) ([]byte, error) {
-			if len(key.Userauth) != 0 {
-				slog.Debug("providing cached userauth for key", slog.String("desc", key.Description))
-				return key.Userauth, nil
-			}
-			keyInfo := fmt.Sprintf("Enter passphrase for (%s): ", key.Description)
-			userauth, err := askpass.ReadPassphrase(keyInfo, askpass.RP_USE_ASKPASS)
-			if !noCache && err == nil {
-				slog.Debug("caching userauth for key", slog.String("desc", key.Description))
-				key.Userauth = userauth
-			}
-			return userauth, err
-		},
-	)
+	agentOpts := []agent.Option{
+		agent.WithListener(listener),
+		agent.WithTPM(tpmFetch),
+		agent.WithOwnerPassword(ownerPassword),
+		agent.WithPrompter(&agent.AskpassPrompter{NoCache: noCache, TTL: pinTTL}),
+		agent.WithRequestTimeout(c.requestTimeout),
+		agent.WithTPMIdleTimeout(tpmIdleTimeout),
+	}
+	for _, p := range providers {
+		agentOpts = append(agentOpts, agent.WithProvider(p))
+	}
+	if len(kmsKeys.Value) != 0 {
+		agentOpts = append(agentOpts, agent.WithProvider(kms.NewGCP(kmsKeys.Value)))
+	}
+	agent, err := agent.New(agentOpts...)
+	if err != nil {
+		slog.Error("starting the agent", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	var ks keystore.Keystore
+	switch c.keystoreType {
+	case "file":
+		ks = keystore.NewDirs(c.keyDir, c.keyGlob)
+	case "nv":
+		// through the transport of the agent, the device may only be
+		// opened once
+		ks = keystore.NewNV(agent.TPM(), ownerPassword)
+	default:
+		slog.Error("unsupported keystore", slog.String("keystore", c.keystoreType))
+		os.Exit(1)
+	}
+	c.markReadOnly(ks)
+
+	agent.SetBatch(batch)
+	agent.SetDebugProto(debugProto)
+	agent.SetNoSHA1(noSHA1)
+	agent.SetReadOnly(c.readOnly)
+	agent.SetConfirmCache(confirmFor, confirmPerDestination)
+	agent.SetIdleLock(idleLock)
+	if lockWithSessionFlag {
+		if err := lockWithSession(agent); err != nil {
+			slog.Error("following the session lock", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+	if approver != "" {
+		agent.SetApprover(approveHelper(approver))
+	}
+
+	if debugListen != "" {
+		if err := serveDebug(agent, debugListen); err != nil {
+			slog.Error("serving the debug endpoint", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	if policySource != "" {
+		if err := applyPolicy(agent, policySource, policyKey, policyInterval); err != nil {
+			slog.Error("loading policy", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+	if renew {
+		agent.WatchCertificates(c.enrollURL, renewCertificate(os.Getenv("SSH_TPM_ENROLL_TOKEN")))
+	}
+
+	if c.sealedMetadata != "" {
+		// without it the restrictions of the keys would be lost
+		metadata, err := c.openSealedMetadata(ownerPassword)
+		if err != nil {
+			slog.Error("opening sealed key metadata", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		agent.SetMetadata(metadata)
+	} else if c.metadataFile != "" {
+		metadata, err := keystore.OpenMetadata(c.metadataFile)
+		if err != nil {
+			slog.Error("opening key metadata", slog.String("error", err.Error()))
+		} else {
+			agent.SetMetadata(metadata)
+		}
+	}
+
+	if len(primaryKeys.Value) != 0 {
+		if err := agent.AddPrimaryKeys(primaryKeys.Value); err != nil {
+			slog.Error("adding primary keys", slog.String("error", err.Error()))
+		}
+	}
 
 	// Signal handling
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
 	go func() {
-		for range c {
+		for range sig {
 			agent.Stop()
 		}
 	}()
 
 	if !noLoad {
-		if err := agent.LoadKeys(keyDir); err != nil {
+		if err := agent.LoadKeystore(ks); err != nil {
 			slog.Error("loading keys", slog.String("error", err.Error()))
 		}
+		if _, ok := ks.(keystore.Watcher); ok && !noWatch {
+			if err := agent.WatchKeystore(ks); err != nil {
+				slog.Error("watching keys", slog.String("error", err.Error()))
+			}
+		}
+	}
+
+	// after loading the keys, so they are certified right away
+	if vaultPath != "" {
+		agent.WatchCertify(vaultCertify(os.Getenv("VAULT_ADDR"), vaultPath, vaultPrincipals))
+	}
+
+	if err := agent.ReportTPM(); err != nil {
+		slog.Error("checking the tpm", slog.String("error", err.Error()))
 	}
 
 	agent.Wait()
 }
 
+// parseUpstream parses a -A socket, PATH or LABEL=PATH
+func parseUpstream(s string) *agent.Upstream {
+	if label, path, ok := strings.Cut(s, "="); ok && label != "" && !strings.Contains(label, "/") {
+		return &agent.Upstream{Label: label, Socket: path}
+	}
+	return &agent.Upstream{Socket: s}
+}
+
+// readOwnerPassword asks for the owner password, or reads it from
+// SSH_TPM_AGENT_OWNER_PASSWORD, for the commands
+func readOwnerPassword(ask bool) []byte {
+	if !ask {
+		return []byte(os.Getenv("SSH_TPM_AGENT_OWNER_PASSWORD"))
+	}
+	p, err := askpass.ReadPassphrase("Enter owner password: ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+// readLockoutPassword returns the lockout password from
+// SSH_TPM_AGENT_LOCKOUT_PASSWORD, or asks for it if the TPM has one
+func readLockoutPassword(set bool) []byte {
+	if p, ok := os.LookupEnv("SSH_TPM_AGENT_LOCKOUT_PASSWORD"); ok || !set {
+		return []byte(p)
+	}
+	p, err := askpass.ReadPassphrase("Enter lockout password: ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+func ping(socketPath string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	return agent.PingAgent(sshagent.NewClient(conn))
+}
+
+// isFlagSet reports if the flag name was given on the command line or in the
+// configuration file
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func createListener(socketPath string) (*net.UnixListener, error) {
 	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
 		f := os.NewFile(uintptr(3), "ssh-tpm-agent.socket")
@@ -275,9 +848,21 @@ func createListener(socketPath string) (*net.UnixListener, error) {
 		return listener, nil
 	}
 
+	if agent.IsAbstractSocket(socketPath) {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("abstract sockets like %s are only supported on linux", socketPath)
+		}
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socketPath})
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Listening on abstract socket", slog.String("path", socketPath))
+		return listener, nil
+	}
+
 	_ = os.Remove(socketPath)
 
-	if err := os.MkdirAll(filepath.Dir(socketPath), 0o770); err != nil {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0o700); err != nil {
 		return nil, fmt.Errorf("creating UNIX socket directory: %w", err)
 	}
 
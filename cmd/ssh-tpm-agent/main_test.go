@@ -15,8 +15,8 @@ import (
 	"github.com/foxboron/ssh-tpm-agent/agent"
 	"github.com/foxboron/ssh-tpm-agent/internal/keytest"
 	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
 	"github.com/google/go-tpm/tpm2"
-	"github.com/google/go-tpm/tpm2/transport"
 	"github.com/google/go-tpm/tpm2/transport/simulator"
 	"golang.org/x/crypto/ssh"
 	sshagent "golang.org/x/crypto/ssh/agent"
@@ -140,7 +140,7 @@ func runSSHAuth(t *testing.T, keytype tpm2.TPMAlgID, bits int, pin []byte, keyfn
 	ag := agent.NewAgent(unixList,
 		[]sshagent.ExtendedAgent{},
 		// TPM Callback
-		func() transport.TPMCloser { return tpm },
+		tpmconn.Static(tpm),
 		// Owner password
 		func() ([]byte, error) { return []byte(""), nil },
 		// PIN Callback
@@ -220,3 +220,19 @@ func TestSSHAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestParseUpstream(t *testing.T) {
+	for _, c := range []struct {
+		arg, label, socket string
+	}{
+		{"/run/user/1000/gnupg/S.gpg-agent.ssh", "", "/run/user/1000/gnupg/S.gpg-agent.ssh"},
+		{"gpg=/run/user/1000/gnupg/S.gpg-agent.ssh", "gpg", "/run/user/1000/gnupg/S.gpg-agent.ssh"},
+		{"/tmp/a=b/agent.sock", "", "/tmp/a=b/agent.sock"},
+		{"=/tmp/agent.sock", "", "=/tmp/agent.sock"},
+	} {
+		u := parseUpstream(c.arg)
+		if u.Label != c.label || u.Socket != c.socket {
+			t.Errorf("parseUpstream(%q) = %+v", c.arg, u)
+		}
+	}
+}
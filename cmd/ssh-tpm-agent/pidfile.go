@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// errRunning is returned when another agent holds the pid file
+var errRunning = errors.New("ssh-tpm-agent is already running")
+
+// lockPidFile takes an exclusive lock on the pid file at path and writes our
+// pid to it. The lock is held until the file is closed. If another agent holds
+// the lock, its pid is returned along with errRunning.
+func lockPidFile(path string) (*os.File, int, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o770); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			b, _ := os.ReadFile(path)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+			return nil, pid, errRunning
+		}
+		return nil, 0, fmt.Errorf("failed locking %s: %w", path, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, 0, nil
+}
+
+// runningAgent returns the pid of the agent holding the pid file at path
+func runningAgent(path string) (int, bool) {
+	f, pid, err := lockPidFile(path)
+	if err != nil {
+		return pid, errors.Is(err, errRunning)
+	}
+	os.Remove(path)
+	f.Close()
+	return 0, false
+}
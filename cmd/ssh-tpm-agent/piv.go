@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// pivAgent is an ssh-agent holding the keys of a PIV token, loaded with the
+// PKCS#11 provider of the token. ssh-agent talks to the token, so the agent
+// doesn't need to know about smartcards.
+type pivAgent struct {
+	sshagent.ExtendedAgent
+	cmd *exec.Cmd
+	dir string
+}
+
+// startPIV starts ssh-agent only allowing provider, and adds the keys of the
+// token to it. ssh-add asks for the PIN of the token, with SSH_ASKPASS when
+// there's no terminal.
+func startPIV(provider string) (*pivAgent, error) {
+	provider, err := filepath.Abs(provider)
+	if err != nil {
+		return nil, err
+	}
+	// ssh-add resolves the provider path, which has to match the -P allowlist
+	if provider, err = filepath.EvalSymlinks(provider); err != nil {
+		return nil, fmt.Errorf("pkcs#11 provider: %w", err)
+	}
+	dir, err := os.MkdirTemp(os.Getenv("XDG_RUNTIME_DIR"), "ssh-tpm-agent-piv")
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(dir, "agent.sock")
+
+	cmd := exec.Command("ssh-agent", "-D", "-a", socket, "-P", provider)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	p := &pivAgent{cmd: cmd, dir: dir}
+
+	var conn net.Conn
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+	}
+	if conn == nil {
+		p.Close()
+		return nil, fmt.Errorf("ssh-agent didn't start listening: %w", err)
+	}
+	p.ExtendedAgent = sshagent.NewClient(conn)
+
+	add := exec.Command("ssh-add", "-s", provider)
+	add.Env = append(os.Environ(), "SSH_AUTH_SOCK="+socket)
+	add.Stdin = os.Stdin
+	add.Stdout = os.Stderr
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("adding the keys of %s: %w", provider, err)
+	}
+	keys, err := p.List()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	for _, k := range keys {
+		slog.Info("serving piv key", slog.String("fingerprint", ssh.FingerprintSHA256(k)), slog.String("comment", k.Comment))
+	}
+	return p, nil
+}
+
+// Close stops ssh-agent
+func (p *pivAgent) Close() error {
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	return os.RemoveAll(p.dir)
+}
+
+// selectedAgent only serves the keys of an agent with the fingerprints in
+// keys, and all of them when keys is empty.
+type selectedAgent struct {
+	sshagent.ExtendedAgent
+	keys []string
+}
+
+var errNotSelected = errors.New("key isn't selected")
+
+func (s *selectedAgent) selected(k ssh.PublicKey) bool {
+	return len(s.keys) == 0 || slices.Contains(s.keys, ssh.FingerprintSHA256(k))
+}
+
+func (s *selectedAgent) List() ([]*sshagent.Key, error) {
+	keys, err := s.ExtendedAgent.List()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(keys, func(k *sshagent.Key) bool { return !s.selected(k) }), nil
+}
+
+func (s *selectedAgent) Signers() ([]ssh.Signer, error) {
+	signers, err := s.ExtendedAgent.Signers()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(signers, func(k ssh.Signer) bool { return !s.selected(k.PublicKey()) }), nil
+}
+
+func (s *selectedAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return s.SignWithFlags(key, data, 0)
+}
+
+func (s *selectedAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags sshagent.SignatureFlags) (*ssh.Signature, error) {
+	if !s.selected(key) {
+		return nil, errNotSelected
+	}
+	return s.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (s *selectedAgent) Remove(key ssh.PublicKey) error {
+	if !s.selected(key) {
+		return errNotSelected
+	}
+	return s.ExtendedAgent.Remove(key)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+func TestSelectedAgent(t *testing.T) {
+	keyring := sshagent.NewKeyring().(sshagent.ExtendedAgent)
+	var pks []ssh.PublicKey
+	for i := 0; i < 2; i++ {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keyring.Add(sshagent.AddedKey{PrivateKey: k}); err != nil {
+			t.Fatal(err)
+		}
+		pk, err := ssh.NewPublicKey(&k.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pks = append(pks, pk)
+	}
+
+	s := &selectedAgent{keyring, []string{ssh.FingerprintSHA256(pks[1])}}
+	keys, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || ssh.FingerprintSHA256(keys[0]) != ssh.FingerprintSHA256(pks[1]) {
+		t.Fatalf("listed %v", keys)
+	}
+	if _, err := s.Sign(pks[0], []byte("data")); !errors.Is(err, errNotSelected) {
+		t.Fatalf("signed with a key which isn't selected: %v", err)
+	}
+	sig, err := s.Sign(pks[1], []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pks[1].Verify([]byte("data"), sig); err != nil {
+		t.Fatal(err)
+	}
+
+	all := &selectedAgent{keyring, nil}
+	if keys, _ := all.List(); len(keys) != 2 {
+		t.Fatalf("listed %d keys without a selection", len(keys))
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// policyCache keeps the last policy, for starting while the source can't be
+// reached
+var policyCache = path.Join(utils.StateDir(), "policy.json")
+
+// readPolicyKeys reads the administrator keys policies are signed with, in
+// authorized_keys format
+func readPolicyKeys(file string) ([]ssh.PublicKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for len(b) != 0 {
+		pk, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			break
+		}
+		keys = append(keys, pk)
+		b = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys in %s", file)
+	}
+	return keys, nil
+}
+
+// applyPolicy applies the cached policy and then the one from source, and
+// fetches it every interval.
+func applyPolicy(a *agent.Agent, source, keyFile string, interval time.Duration) error {
+	if keyFile == "" {
+		return errors.New("--policy needs the administrator keys in --policy-key")
+	}
+	keys, err := readPolicyKeys(keyFile)
+	if err != nil {
+		return err
+	}
+	save := func(p *keystore.Policy) {
+		if err := p.Save(policyCache); err != nil {
+			slog.Error("failed saving policy", slog.String("error", err.Error()))
+		}
+	}
+
+	if p, err := keystore.FetchPolicy(policyCache, keys); err == nil {
+		if err := a.SetPolicy(p); err != nil {
+			return err
+		}
+		slog.Debug("applied cached policy", slog.Uint64("serial", p.Serial))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Info("ignoring cached policy", slog.String("error", err.Error()))
+	}
+
+	fetch := func() (*keystore.Policy, error) {
+		return keystore.FetchPolicy(source, keys)
+	}
+	if p, err := fetch(); err != nil {
+		slog.Error("failed fetching policy", slog.String("source", source), slog.String("error", err.Error()))
+	} else if err := a.SetPolicy(p); err != nil {
+		slog.Error("not applying policy", slog.String("error", err.Error()))
+	} else {
+		slog.Info("applied policy", slog.Uint64("serial", p.Serial))
+		save(p)
+	}
+	a.WatchPolicy(fetch, interval, save)
+	return nil
+}
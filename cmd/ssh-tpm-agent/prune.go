@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// keyCheck is the result of checking if the TPM can still load a key
+type keyCheck struct {
+	utils.KeyJSON
+	// ok, unrecoverable or unknown
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	key *key.SSHTPMKey
+}
+
+// checkKeys checks if the TPM can load the keys in ks
+func checkKeys(ks keystore.Keystore, tpm transport.TPMCloser, ownerPassword []byte) ([]keyCheck, error) {
+	keys, err := ks.Keys()
+	if err != nil {
+		return nil, err
+	}
+	checks := []keyCheck{}
+	for _, k := range keys {
+		c := keyCheck{KeyJSON: utils.NewKeyJSON(k), Status: "ok", key: k}
+		err := k.Check(tpm, ownerPassword)
+		switch {
+		case errors.Is(err, key.ErrWrongTPM):
+			c.Status = "unrecoverable"
+		case err != nil:
+			// e.g. a wrong owner password, which says nothing about the key
+			c.Status = "unknown"
+		}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		checks = append(checks, c)
+	}
+	return checks, nil
+}
+
+// prune finds the keys in ks which the TPM can't load anymore, because it was
+// cleared or replaced, and removes them if confirm agrees.
+func prune(w io.Writer, ks keystore.Keystore, tpm transport.TPMCloser, ownerPassword []byte, confirm func(n int) bool) error {
+	checks, err := checkKeys(ks, tpm, ownerPassword)
+	if err != nil {
+		return err
+	}
+	var dead []*key.SSHTPMKey
+	for _, c := range checks {
+		switch c.Status {
+		case "unrecoverable":
+			fmt.Fprintf(w, "%s %s: unrecoverable, %s\n", c.Fingerprint, c.Comment, c.Error)
+			dead = append(dead, c.key)
+		case "unknown":
+			fmt.Fprintf(w, "%s %s: can't check the key: %s\n", c.Fingerprint, c.Comment, c.Error)
+		}
+	}
+	if len(dead) == 0 {
+		fmt.Fprintf(w, "No unrecoverable keys in %d keys\n", len(checks))
+		return nil
+	}
+	fmt.Fprintln(w, "The TPM was cleared or replaced since these keys were created, they can't be used anymore.")
+	if !confirm(len(dead)) {
+		return nil
+	}
+	r, ok := ks.(keystore.Remover)
+	if !ok {
+		return errors.New("keys can't be removed from the keystore")
+	}
+	for _, k := range dead {
+		if err := r.Remove(k); err != nil {
+			return fmt.Errorf("failed removing %s: %w", k.Fingerprint(), err)
+		}
+		fmt.Fprintf(w, "Removed %s %s\n", k.Fingerprint(), k.Description)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestPrune(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	dir := t.TempDir()
+	write := func(name string) *key.SSHTPMKey {
+		k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := k.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".tpm"), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".pub"), k.AuthorizedKey(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	write("id_old")
+	_, err = tpm2.Clear{
+		AuthHandle: tpm2.AuthHandle{Handle: tpm2.TPMRHLockout, Auth: tpm2.PasswordAuth(nil)},
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("id_new")
+
+	ks := &keystore.Dir{Path: dir}
+	checks, err := checkKeys(ks, tpm, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := map[string]int{}
+	for _, c := range checks {
+		status[c.Status]++
+	}
+	if len(checks) != 2 || status["ok"] != 1 || status["unrecoverable"] != 1 {
+		t.Fatalf("unexpected key checks %+v", checks)
+	}
+
+	var out bytes.Buffer
+	var asked int
+	if err := prune(&out, ks, tpm, []byte(""), func(n int) bool { asked = n; return false }); err != nil {
+		t.Fatal(err)
+	}
+	if asked != 1 {
+		t.Fatalf("asked to remove %d keys, expected 1:\n%s", asked, out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "id_old.tpm")); err != nil {
+		t.Fatal("key removed without confirmation")
+	}
+
+	if err := prune(&out, ks, tpm, []byte(""), func(int) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"id_old.tpm", "id_old.pub"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed", f)
+		}
+	}
+	keys, err := ks.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected the new key to be kept, have %d keys", len(keys))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/sshsig"
+	"golang.org/x/crypto/ssh"
+)
+
+// renewNamespace is the namespace renewal requests are signed in
+const renewNamespace = "ssh-tpm-agent-renew"
+
+// renewRequest is posted to the enrollment endpoint to renew Certificate.
+// Signature is an armored SSH signature by the certified key of the
+// renewMessage.
+type renewRequest struct {
+	Certificate string `json:"certificate"`
+	Timestamp   int64  `json:"timestamp"`
+	Signature   string `json:"signature"`
+}
+
+// renewMessage is the certificate and the timestamp of the request, on a line
+// each
+func renewMessage(cert string, timestamp int64) []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n", cert, timestamp))
+}
+
+// renewCertificate returns a RenewFunc posting renewRequests to the
+// enrollment endpoint, with token as bearer token when set.
+func renewCertificate(token string) agent.RenewFunc {
+	return func(ctx context.Context, url string, cert *ssh.Certificate, signer ssh.AlgorithmSigner) (*ssh.Certificate, error) {
+		req := renewRequest{
+			Certificate: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))),
+			Timestamp:   time.Now().Unix(),
+		}
+		sig, err := sshsig.Sign(signer, bytes.NewReader(renewMessage(req.Certificate, req.Timestamp)), renewNamespace)
+		if err != nil {
+			return nil, err
+		}
+		req.Signature = string(sig.Armor())
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > enrollTimeout {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, enrollTimeout)
+			defer cancel()
+		}
+		return requestCertificate(ctx, url, token, req)
+	}
+}
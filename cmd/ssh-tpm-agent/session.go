@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/internal/logind"
+)
+
+// lockWithSession locks the agent when systemd-logind locks a session of the
+// user, and unlocks it again with the session.
+func lockWithSession(a *agent.Agent) error {
+	w, err := logind.Watch()
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer w.Close()
+		err := followSession(a, w.Next)
+		slog.Warn("not locking with the session anymore", slog.String("error", err.Error()))
+	}()
+	return nil
+}
+
+// followSession locks and unlocks the agent with the session events from next
+// until it fails
+func followSession(a *agent.Agent, next func() (logind.Event, error)) error {
+	for {
+		ev, err := next()
+		if err != nil {
+			return err
+		}
+		slog.Debug("session signal", slog.String("event", ev.String()))
+		switch ev {
+		case logind.Lock:
+			a.LockSession()
+		case logind.Unlock:
+			a.UnlockSession()
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/internal/logind"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn/tpmconntest"
+	"golang.org/x/crypto/ssh"
+)
+
+// events returns the session events one by one, then io.EOF
+func events(evs ...logind.Event) func() (logind.Event, error) {
+	return func() (logind.Event, error) {
+		if len(evs) == 0 {
+			return 0, io.EOF
+		}
+		ev := evs[0]
+		evs = evs[1:]
+		return ev, nil
+	}
+}
+
+func TestSessionLockUnseal(t *testing.T) {
+	tpm, _ := tpmconntest.Simulator(t)
+	a, err := agent.New(agent.WithTPM(tpm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	// unlocking the agent would prompt
+	a.SetBatch(true)
+
+	b, err := a.Seal(ssh.Marshal(agent.SealMsg{Secret: []byte("hunter2")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed agent.SealResponse
+	if err := ssh.Unmarshal(b, &sealed); err != nil {
+		t.Fatal(err)
+	}
+	req := ssh.Marshal(agent.UnsealMsg{Key: sealed.Key})
+
+	if err := followSession(a, events(logind.Lock)); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if _, err := a.Unseal(req); !errors.Is(err, agent.ErrInteractionRequired) {
+		t.Fatalf("unsealed with the session locked: %v", err)
+	}
+	if err := followSession(a, events(logind.Unlock)); !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	if _, err := a.Unseal(req); err != nil {
+		t.Fatal(err)
+	}
+}
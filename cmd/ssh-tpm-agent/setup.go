@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var errSetup = errors.New("the TPM is not ready for ssh-tpm-agent")
+
+// setupCheck is the result of one check of setup
+type setupCheck struct {
+	Check  string `json:"check"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// printChecks prints the checks of setup as a table
+func printChecks(w io.Writer, checks []setupCheck) {
+	for _, c := range checks {
+		status := "ok"
+		if !c.OK {
+			status = "missing"
+		}
+		fmt.Fprintf(w, "%-18s %-8s %s\n", c.Check, status, c.Detail)
+	}
+}
+
+// setup checks that the TPM can be used for creating and loading keys,
+// creates the SRK and optionally persists it. It returns the result of each
+// check, and errSetup if any failed.
+func setup(tpm transport.TPMCloser, ownerPassword []byte, persist bool) ([]setupCheck, error) {
+	var checks []setupCheck
+	var failed bool
+	report := func(check string, ok bool, format string, a ...any) {
+		if !ok {
+			failed = true
+		}
+		checks = append(checks, setupCheck{Check: check, OK: ok, Detail: fmt.Sprintf(format, a...)})
+	}
+
+	info, err := utils.ReadTPMInfo(tpm)
+	if err != nil {
+		report("TPM", false, "%v", err)
+		return checks, errSetup
+	}
+	report("TPM", true, "%s, firmware %s", info.Manufacturer, info.FirmwareVersion)
+
+	report("ECC P-256", slices.Contains(info.ECCBits, 256), "needed for ecdsa keys and the SRK")
+	report("RSA 2048", info.RSA, "needed for rsa keys")
+	report("SHA-256 PCRs", info.SHA256PCR, "needed for keys bound to PCRs")
+
+	if info.InLockout {
+		report("Lockout", false, "the TPM is in dictionary attack lockout after %d failed authorizations, wait or reset it with ssh-tpm-agent lockout --reset", info.LockoutCounter)
+	} else {
+		report("Lockout", true, "%d of %d failed authorizations", info.LockoutCounter, info.MaxAuthFail)
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	srk, _, err := key.CreateSRK(sess, tpm2.TPMRHOwner, ownerPassword, false)
+	switch {
+	case errors.Is(err, tpm2.TPMRCBadAuth), errors.Is(err, tpm2.TPMRCAuthFail):
+		if info.OwnerAuthSet && len(ownerPassword) == 0 {
+			report("Owner hierarchy", false, "the owner hierarchy has a password, use --owner-password")
+		} else {
+			report("Owner hierarchy", false, "wrong owner password")
+		}
+		return checks, errSetup
+	case err != nil:
+		report("Owner hierarchy", false, "%v", err)
+		return checks, errSetup
+	}
+	keyfile.FlushHandle(tpm, srk)
+	if info.OwnerAuthSet {
+		report("Owner hierarchy", true, "password accepted")
+	} else {
+		report("Owner hierarchy", true, "no password set")
+	}
+
+	if persist {
+		created, err := key.PersistSRK(tpm, ownerPassword)
+		switch {
+		case errors.Is(err, key.ErrSRKHandleInUse):
+			report("SRK", false, "0x%x holds a different key", key.SRKHandle)
+		case err != nil:
+			report("SRK", false, "%v", err)
+		case created:
+			report("SRK", true, "persisted at 0x%x", key.SRKHandle)
+		default:
+			report("SRK", true, "already persisted at 0x%x", key.SRKHandle)
+		}
+	} else {
+		_, err := tpm2.ReadPublic{ObjectHandle: key.SRKHandle}.Execute(tpm)
+		if err == nil {
+			report("SRK", true, "created, persistent SRK at 0x%x", key.SRKHandle)
+		} else {
+			report("SRK", true, "created, --persist-srk makes it persistent")
+		}
+	}
+
+	if failed {
+		return checks, errSetup
+	}
+	return checks, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestSetup(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	var out bytes.Buffer
+	run := func(ownerPassword []byte, persist bool) error {
+		out.Reset()
+		checks, err := setup(tpm, ownerPassword, persist)
+		printChecks(&out, checks)
+		return err
+	}
+	if err := run([]byte(""), true); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "persisted at 0x81000001") {
+		t.Fatalf("srk not persisted:\n%s", out.String())
+	}
+	defer func() {
+		pub, err := tpm2.ReadPublic{ObjectHandle: key.SRKHandle}.Execute(tpm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tpm2.EvictControl{
+			Auth:             tpm2.TPMRHOwner,
+			ObjectHandle:     tpm2.NamedHandle{Handle: key.SRKHandle, Name: pub.Name},
+			PersistentHandle: key.SRKHandle,
+		}.Execute(tpm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := run([]byte(""), true); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "already persisted") {
+		t.Fatalf("srk persisted twice:\n%s", out.String())
+	}
+
+	_, err = tpm2.HierarchyChangeAuth{
+		AuthHandle: tpm2.TPMRHOwner,
+		NewAuth:    tpm2.TPM2BAuth{Buffer: []byte("owner")},
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm2.HierarchyChangeAuth{
+		AuthHandle: tpm2.AuthHandle{Handle: tpm2.TPMRHOwner, Auth: tpm2.PasswordAuth([]byte("owner"))},
+	}.Execute(tpm)
+
+	if err := run([]byte(""), false); !errors.Is(err, errSetup) {
+		t.Fatalf("setup without the owner password: %v", err)
+	}
+	if !strings.Contains(out.String(), "--owner-password") {
+		t.Fatalf("missing owner password not reported:\n%s", out.String())
+	}
+	if err := run([]byte("owner"), false); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+}
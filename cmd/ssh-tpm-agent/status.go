@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// tpmStatus is what status shows about the TPM, for support requests about
+// hardware specific issues
+type tpmStatus struct {
+	Manufacturer     string   `json:"manufacturer"`
+	VendorString     string   `json:"vendor_string"`
+	FirmwareVersion  string   `json:"firmware_version"`
+	FirmwareVersion2 uint32   `json:"firmware_version2"`
+	SpecFamily       string   `json:"spec_family"`
+	SpecLevel        uint32   `json:"spec_level"`
+	SpecRevision     string   `json:"spec_revision"`
+	SpecYear         uint32   `json:"spec_year"`
+	Algorithms       []string `json:"algorithms"`
+	ECCBits          []int    `json:"ecc_bits"`
+	Transient        handles  `json:"transient"`
+	Persistent       handles  `json:"persistent"`
+}
+
+// handles are the objects of a kind in the TPM, and how many more fit
+type handles struct {
+	Used      uint32 `json:"used"`
+	Available uint32 `json:"available"`
+}
+
+func readTPMStatus(tpm transport.TPMCloser) (*tpmStatus, error) {
+	info, err := utils.ReadTPMInfo(tpm)
+	if err != nil {
+		return nil, err
+	}
+	return &tpmStatus{
+		Manufacturer:     info.Manufacturer,
+		VendorString:     info.VendorString,
+		FirmwareVersion:  info.FirmwareVersion,
+		FirmwareVersion2: info.FirmwareVersion2,
+		SpecFamily:       info.SpecFamily,
+		SpecLevel:        info.SpecLevel,
+		// the revision is given times 100
+		SpecRevision: fmt.Sprintf("%d.%02d", info.SpecRevision/100, info.SpecRevision%100),
+		SpecYear:     info.SpecYear,
+		Algorithms:   append([]string{}, info.Algorithms...),
+		ECCBits:      append([]int{}, info.ECCBits...),
+		Transient:    handles{info.TransientLoaded, info.TransientAvail},
+		Persistent:   handles{info.Persistent, info.PersistentAvail},
+	}, nil
+}
+
+func printTPMStatus(w io.Writer, s *tpmStatus) {
+	fmt.Fprintf(w, "TPM            %s %s\n", s.Manufacturer, s.VendorString)
+	fmt.Fprintf(w, "firmware       %s (0x%08x)\n", s.FirmwareVersion, s.FirmwareVersion2)
+	fmt.Fprintf(w, "specification  %s level %d revision %s (%d)\n", s.SpecFamily, s.SpecLevel, s.SpecRevision, s.SpecYear)
+	fmt.Fprintf(w, "algorithms     %s\n", strings.Join(s.Algorithms, " "))
+	curves := make([]string, 0, len(s.ECCBits))
+	for _, bits := range s.ECCBits {
+		curves = append(curves, fmt.Sprintf("P-%d", bits))
+	}
+	fmt.Fprintf(w, "ecc curves     %s\n", strings.Join(curves, " "))
+	fmt.Fprintf(w, "transient      %d loaded, %d more fit\n", s.Transient.Used, s.Transient.Available)
+	fmt.Fprintf(w, "persistent     %d stored, %d more fit\n", s.Persistent.Used, s.Persistent.Available)
+}
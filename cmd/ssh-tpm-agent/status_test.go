@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestTPMStatus(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	s, err := readTPMStatus(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Manufacturer == "" || len(s.Algorithms) == 0 || len(s.ECCBits) == 0 || s.Persistent.Available == 0 {
+		t.Fatalf("incomplete tpm status %+v", s)
+	}
+	var out bytes.Buffer
+	printTPMStatus(&out, s)
+	for _, line := range []string{
+		"specification  2.0 level 0 revision 1.",
+		"ecc curves     P-",
+		"persistent     0 stored, ",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Fatalf("%q missing in\n%s", line, out.String())
+		}
+	}
+}
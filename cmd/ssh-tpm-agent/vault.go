@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"golang.org/x/crypto/ssh"
+)
+
+// vaultRequest is posted to the sign endpoint of the Vault SSH secrets engine
+type vaultRequest struct {
+	PublicKey       string `json:"public_key"`
+	CertType        string `json:"cert_type"`
+	ValidPrincipals string `json:"valid_principals,omitempty"`
+}
+
+type vaultResponse struct {
+	Data struct {
+		SignedKey string `json:"signed_key"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// vaultToken returns VAULT_TOKEN, or the token vault login saved in
+// ~/.vault-token. It's read for every request so logging in again is picked
+// up by the agent.
+func vaultToken() (string, error) {
+	if t := os.Getenv("VAULT_TOKEN"); t != "" {
+		return t, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errors.New("no vault token, set VAULT_TOKEN or run vault login")
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// vaultCertify returns a CertifyFunc signing keys with the Vault SSH secrets
+// engine at addr, with the sign path of a role like ssh-client-signer/sign/ROLE.
+// principals is a comma separated list, empty for the default principals of
+// the role.
+func vaultCertify(addr, path, principals string) agent.CertifyFunc {
+	url := strings.TrimSuffix(addr, "/") + "/v1/" + strings.Trim(path, "/")
+	return func(ctx context.Context, pub ssh.PublicKey) (*ssh.Certificate, error) {
+		token, err := vaultToken()
+		if err != nil {
+			return nil, err
+		}
+		body, err := json.Marshal(vaultRequest{
+			PublicKey:       strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+			CertType:        "user",
+			ValidPrincipals: principals,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > enrollTimeout {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, enrollTimeout)
+			defer cancel()
+		}
+		hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		hreq.Header.Set("Content-Type", "application/json")
+		hreq.Header.Set("X-Vault-Token", token)
+		if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+			hreq.Header.Set("X-Vault-Namespace", ns)
+		}
+		rsp, err := http.DefaultClient.Do(hreq)
+		if err != nil {
+			return nil, err
+		}
+		defer rsp.Body.Close()
+
+		var vr vaultResponse
+		if err := json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(&vr); err != nil && rsp.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("malformed vault response: %w", err)
+		}
+		if rsp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("vault refused to sign the key: %s: %s", rsp.Status, strings.Join(vr.Errors, ", "))
+		}
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(vr.Data.SignedKey))
+		if err != nil {
+			return nil, fmt.Errorf("malformed certificate from vault: %w", err)
+		}
+		cert, ok := pk.(*ssh.Certificate)
+		if !ok {
+			return nil, errors.New("vault didn't return a certificate")
+		}
+		return cert, nil
+	}
+}
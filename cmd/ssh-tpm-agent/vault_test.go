@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVaultCertify(t *testing.T) {
+	ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/ssh-client-signer/sign/dev" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		var req vaultRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cert := &ssh.Certificate{
+			Key:             pk,
+			CertType:        ssh.UserCert,
+			ValidPrincipals: strings.Split(req.ValidPrincipals, ","),
+			ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var rsp vaultResponse
+		rsp.Data.SignedKey = string(ssh.MarshalAuthorizedKey(cert))
+		json.NewEncoder(w).Encode(rsp)
+	}))
+	defer srv.Close()
+
+	certify := vaultCertify(srv.URL+"/", "/ssh-client-signer/sign/dev", "alice,bob")
+
+	t.Setenv("VAULT_TOKEN", "s.wrong")
+	if _, err := certify(context.Background(), pub); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("unexpected error with a wrong token: %v", err)
+	}
+
+	t.Setenv("VAULT_TOKEN", "s.token")
+	cert, err := certify(context.Background(), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(cert.Key) != ssh.FingerprintSHA256(pub) || strings.Join(cert.ValidPrincipals, ",") != "alice,bob" {
+		t.Fatalf("unexpected certificate %v", cert)
+	}
+}
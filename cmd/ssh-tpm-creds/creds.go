@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	credentialPEM   = "SSH TPM CREDENTIAL"
+	credentialLabel = "ssh-tpm-creds"
+)
+
+var ErrWrongName = errors.New("credential name does not match")
+
+// credential is an encrypted credential. The content is encrypted with
+// ChaCha20-Poly1305 under a key which only the TPM key can recover, with the
+// name as additional data so a credential can't be used under another name.
+type credential struct {
+	Name    string
+	KeyBlob []byte
+
+	// Share is the uncompressed ephemeral ECDH public key of ECDSA keys, the
+	// encryption key is derived from the shared secret with HKDF-SHA256.
+	Share []byte
+
+	// WrappedKey is the OAEP-SHA256 encrypted encryption key of RSA keys.
+	WrappedKey []byte
+
+	Ciphertext []byte
+}
+
+func credentialKey(shared, share, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, share...), recipient...)
+	k := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(credentialLabel)), k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// encrypt encrypts the credential to the TPM key with the public key pub.
+func encrypt(pub ssh.PublicKey, name string, plaintext []byte) ([]byte, error) {
+	cpub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.New("unsupported key")
+	}
+	cred := credential{Name: name, KeyBlob: pub.Marshal()}
+
+	var encKey []byte
+	switch k := cpub.CryptoPublicKey().(type) {
+	case *ecdsa.PublicKey:
+		recipient, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, err
+		}
+		cred.Share = ephemeral.PublicKey().Bytes()
+		encKey, err = credentialKey(shared, cred.Share, recipient.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	case *rsa.PublicKey:
+		encKey = make([]byte, chacha20poly1305.KeySize)
+		if _, err := rand.Read(encKey); err != nil {
+			return nil, err
+		}
+		var err error
+		cred.WrappedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, k, encKey, nil)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported key")
+	}
+
+	aead, err := chacha20poly1305.New(encKey)
+	if err != nil {
+		return nil, err
+	}
+	// Each credential has a new key, so the nonce can be fixed
+	cred.Ciphertext = aead.Seal(nil, make([]byte, aead.NonceSize()), plaintext, []byte(name))
+	return pem.EncodeToMemory(&pem.Block{Type: credentialPEM, Bytes: ssh.Marshal(cred)}), nil
+}
+
+// decrypt decrypts the credential through the agent. An empty name skips the
+// name check.
+func decrypt(client sshagent.ExtendedAgent, name string, b []byte) ([]byte, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != credentialPEM {
+		return nil, errors.New("not a ssh-tpm-creds credential")
+	}
+	var cred credential
+	if err := ssh.Unmarshal(block.Bytes, &cred); err != nil {
+		return nil, fmt.Errorf("malformed credential: %w", err)
+	}
+	if name != "" && name != cred.Name {
+		return nil, fmt.Errorf("%w: expected %q, got %q", ErrWrongName, name, cred.Name)
+	}
+	pub, err := ssh.ParsePublicKey(cred.KeyBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	cpub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.New("unsupported key")
+	}
+
+	var encKey []byte
+	switch k := cpub.CryptoPublicKey().(type) {
+	case *ecdsa.PublicKey:
+		recipient, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		share, err := recipient.Curve().NewPublicKey(cred.Share)
+		if err != nil {
+			return nil, fmt.Errorf("malformed credential: %w", err)
+		}
+		shared, err := agent.ECDHWithKey(client, pub, share)
+		if err != nil {
+			return nil, err
+		}
+		encKey, err = credentialKey(shared, cred.Share, recipient.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	case *rsa.PublicKey:
+		encKey, err = agent.DecryptWithKey(client, pub, cred.WrappedKey, "sha256")
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported key")
+	}
+
+	aead, err := chacha20poly1305.New(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), cred.Ciphertext, []byte(cred.Name))
+}
+
+// encryptionKey returns the first ECDSA or RSA key of the agent
+func encryptionKey(client sshagent.ExtendedAgent) (ssh.PublicKey, error) {
+	keys, err := client.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		switch k.Format {
+		case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoRSA:
+			return ssh.ParsePublicKey(k.Blob)
+		}
+	}
+	return nil, errors.New("no ecdsa or rsa key in the agent")
+}
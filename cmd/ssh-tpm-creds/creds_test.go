@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+func TestCredentials(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := agent.NewAgent(unixList,
+		[]sshagent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	client := func() (sshagent.ExtendedAgent, func(), error) {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sshagent.NewClient(conn), func() { conn.Close() }, nil
+	}
+	c, done, err := client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	secret := []byte("hunter2")
+
+	for _, tc := range []struct {
+		name string
+		alg  tpm2.TPMAlgID
+		bits int
+	}{
+		{"p256", tpm2.TPMAlgECC, 256},
+		{"p384", tpm2.TPMAlgECC, 384},
+		{"rsa", tpm2.TPMAlgRSA, 2048},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k, err := key.NewSSHTPMKey(tpm, tc.alg, tc.bits, []byte(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ag.AddKey(k); err != nil {
+				t.Fatal(err)
+			}
+			defer ag.RemoveAll()
+			pub, err := k.SSHPublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := encrypt(pub, "db-password", secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := decrypt(c, "db-password", b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plaintext, secret) {
+				t.Fatalf("got %q", plaintext)
+			}
+			if _, err := decrypt(c, "other", b); !errors.Is(err, ErrWrongName) {
+				t.Fatalf("decrypting under another name returned %v", err)
+			}
+		})
+	}
+
+	// Serve the credential like systemd requests it
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.AddKey(k); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	b, err := encrypt(pub, "db-password", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "db-password.cred"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	credSocket := path.Join(t.TempDir(), "creds.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: credSocket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serve(l, dir, client)
+
+	conn, err := net.DialUnix("unix",
+		&net.UnixAddr{Net: "unix", Name: "@0123456789abcdef/unit/test.service/db-password"},
+		&net.UnixAddr{Net: "unix", Name: credSocket},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	plaintext, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, secret) {
+		t.Fatalf("served %q", plaintext)
+	}
+}
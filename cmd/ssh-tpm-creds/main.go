@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var Version string
+
+const usage = `Usage:
+    ssh-tpm-creds encrypt [OPTIONS] INPUT OUTPUT
+    ssh-tpm-creds decrypt [OPTIONS] INPUT [OUTPUT]
+    ssh-tpm-creds serve [-l SOCKET] DIR
+
+Options:
+    -k FILE.pub            Encrypt to the TPM key with this public key. Defaults
+                           to the first ECDSA or RSA key in the agent.
+    --name NAME            Name of the credential, which is checked on
+                           decryption. Defaults to the file name of OUTPUT when
+                           encrypting and of INPUT when decrypting, without the
+                           .cred suffix. An empty name disables the check.
+    -l SOCKET              Socket to serve credentials on. Defaults to
+                           $XDG_RUNTIME_DIR/ssh-tpm-creds.sock, or
+                           /run/ssh-tpm-creds.sock for root.
+
+Encrypt and decrypt service credentials with a TPM key of ssh-tpm-agent, like
+systemd-creds(1). INPUT and OUTPUT may be - for stdin and stdout. Decryption
+is done by ssh-tpm-agent through SSH_AUTH_SOCK, so the same TPM key protects
+both SSH and the credentials.
+
+serve answers systemd LoadCredential= requests on SOCKET with the decrypted
+credential DIR/NAME.cred, where NAME is the name of the credential in the
+unit.
+
+Example:
+    $ echo -n hunter2 | ssh-tpm-creds encrypt - /etc/credstore.tpm/db-password.cred
+    $ ssh-tpm-creds decrypt /etc/credstore.tpm/db-password.cred
+    hunter2
+
+    # In the service unit
+    [Service]
+    LoadCredential=db-password:/run/ssh-tpm-creds.sock`
+
+func agentClient() (sshagent.ExtendedAgent, func(), error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil, fmt.Errorf("can't find any ssh-tpm-agent socket")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sshagent.NewClient(conn), func() { conn.Close() }, nil
+}
+
+func defaultSocket() string {
+	if os.Getuid() == 0 {
+		return "/run/ssh-tpm-creds.sock"
+	}
+	return path.Join(utils.RuntimeDir(), "ssh-tpm-creds.sock")
+}
+
+// credentialName returns the name of the credential from the file name
+func credentialName(file string) string {
+	if file == "-" {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.Base(file), ".cred")
+}
+
+func readInput(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+func writeOutput(file string, b []byte) error {
+	if file == "-" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	return utils.WriteFileAtomic(file, b, 0o600)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Println(usage)
+	}
+
+	var (
+		keyFile, name, socket string
+	)
+
+	flag.StringVar(&keyFile, "k", "", "public key to encrypt to")
+	flag.StringVar(&name, "name", "", "name of the credential")
+	flag.StringVar(&socket, "l", defaultSocket(), "socket to serve credentials on")
+	flag.Parse()
+
+	// Allow options after the command
+	cmd := flag.Arg(0)
+	if err := flag.CommandLine.Parse(flag.Args()[min(1, flag.NArg()):]); err != nil {
+		os.Exit(2)
+	}
+	args := flag.Args()
+
+	nameSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "name" {
+			nameSet = true
+		}
+	})
+
+	switch {
+	case cmd == "encrypt" && len(args) == 2:
+		if !nameSet {
+			name = credentialName(args[1])
+		}
+		var pub ssh.PublicKey
+		if keyFile != "" {
+			b, err := os.ReadFile(keyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			pub, _, _, _, err = ssh.ParseAuthorizedKey(b)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			client, done, err := agentClient()
+			if err != nil {
+				log.Fatal(err)
+			}
+			pub, err = encryptionKey(client)
+			done()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		plaintext, err := readInput(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		b, err := encrypt(pub, name, plaintext)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeOutput(args[1], b); err != nil {
+			log.Fatal(err)
+		}
+	case cmd == "decrypt" && (len(args) == 1 || len(args) == 2):
+		if !nameSet {
+			name = credentialName(args[0])
+		}
+		out := "-"
+		if len(args) == 2 {
+			out = args[1]
+		}
+		b, err := readInput(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		client, done, err := agentClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer done()
+		plaintext, err := decrypt(client, name, b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeOutput(out, plaintext); err != nil {
+			log.Fatal(err)
+		}
+	case cmd == "serve" && len(args) == 1:
+		_ = os.Remove(socket)
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.Close()
+		if err := serve(l, args[0], agentClient); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// credentialPeer returns the unit and credential name systemd binds the
+// client side of LoadCredential= sockets to, the abstract address
+// "@<random>/unit/<unit>/<credential>".
+func credentialPeer(addr net.Addr) (string, string, error) {
+	parts := strings.Split(addr.String(), "/")
+	if len(parts) != 4 || !strings.HasPrefix(parts[0], "@") || parts[1] != "unit" {
+		return "", "", errors.New("peer is not a systemd credential request")
+	}
+	return parts[2], parts[3], nil
+}
+
+// serve answers systemd LoadCredential= requests on the listener with the
+// decrypted credentials from dir, named <credential>.cred.
+func serve(l *net.UnixListener, dir string, client func() (sshagent.ExtendedAgent, func(), error)) error {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := serveCredential(conn, dir, client); err != nil {
+				slog.Error("failed serving credential", slog.String("error", err.Error()))
+			}
+		}()
+	}
+}
+
+func serveCredential(conn *net.UnixConn, dir string, client func() (sshagent.ExtendedAgent, func(), error)) error {
+	unit, name, err := credentialPeer(conn.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	if name == "" || name != filepath.Base(name) {
+		return errors.New("invalid credential name")
+	}
+	log := slog.With(slog.String("unit", unit), slog.String("credential", name))
+
+	b, err := os.ReadFile(filepath.Join(dir, name+".cred"))
+	if err != nil {
+		return err
+	}
+	c, done, err := client()
+	if err != nil {
+		return err
+	}
+	defer done()
+	plaintext, err := decrypt(c, name, b)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(plaintext); err != nil {
+		return err
+	}
+	log.Info("served credential")
+	return nil
+}
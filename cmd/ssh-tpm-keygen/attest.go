@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"golang.org/x/crypto/ssh"
+)
+
+// readCAs reads the PEM encoded TPM vendor CAs. Self-signed certificates are
+// roots, the rest intermediates.
+func readCAs(file string) (*x509.CertPool, *x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cert.CheckSignatureFrom(cert) == nil {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	return roots, intermediates, nil
+}
+
+// verifyAttestationFile verifies the attestation and prints what it proves
+// about the key.
+func verifyAttestationFile(file, pubkeyFile, caFile, nonce string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	a, err := key.DecodeAttestation(b)
+	if err != nil {
+		return err
+	}
+
+	opts := &key.VerifyOptions{}
+	if nonce != "" {
+		opts.Nonce, err = hex.DecodeString(nonce)
+		if err != nil {
+			return fmt.Errorf("invalid nonce: %v", err)
+		}
+	}
+	if caFile != "" {
+		opts.Roots, opts.Intermediates, err = readCAs(caFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := a.Verify(opts)
+	if err != nil {
+		return err
+	}
+	pub, err := ssh.NewPublicKey(result.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	if pubkeyFile != "" {
+		pb, err := os.ReadFile(pubkeyFile)
+		if err != nil {
+			return err
+		}
+		want, _, _, _, err := ssh.ParseAuthorizedKey(pb)
+		if err != nil {
+			k, err := key.Decode(pb)
+			if err != nil {
+				return fmt.Errorf("%s is not a public key or a TPM key", pubkeyFile)
+			}
+			if want, err = k.SSHPublicKey(); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(want.Marshal(), pub.Marshal()) {
+			return fmt.Errorf("attestation is for %s, not %s", ssh.FingerprintSHA256(pub), ssh.FingerprintSHA256(want))
+		}
+	}
+
+	fmt.Printf("Good attestation of %s key %s\n", pub.Type(), ssh.FingerprintSHA256(pub))
+	if result.Creation {
+		fmt.Println("Attested at key creation")
+	}
+	if result.EKParent {
+		fmt.Println("The key was created under the endorsement key")
+	}
+	if result.Generated {
+		fmt.Println("The key was generated inside the TPM")
+	} else {
+		fmt.Println("The key was imported into the TPM")
+	}
+	if result.EKCertificate != nil {
+		fmt.Printf("Endorsement key certificate issued by %s\n", result.EKCertificate.Issuer)
+	} else {
+		fmt.Println("Endorsement key certificate not verified, use --ca")
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// Formats of --convert
+const (
+	formatNative    = "native"
+	formatTSS2      = "tss2"
+	formatTPM2Tools = "tpm2-tools"
+)
+
+// tpm2ToolsFiles returns the TPM2B_PUBLIC and TPM2B_PRIVATE files of the
+// tpm2-tools key path, named like tpm2_create -u key.pub -r key.priv.
+func tpm2ToolsFiles(path string) (pub, priv string) {
+	base := strings.TrimSuffix(path, ".priv")
+	return base + ".pub", base + ".priv"
+}
+
+// readConvertKey reads the key to convert from path. A .priv path is a
+// tpm2-tools key with the .pub next to it, which is loaded under parent to
+// check that it belongs to the TPM.
+func readConvertKey(tpm transport.TPMCloser, ownerPassword []byte, path string, parent tpm2.TPMHandle, rsaParent bool, comment string) (*key.SSHTPMKey, error) {
+	if !strings.HasSuffix(path, ".priv") {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return key.Decode(b)
+	}
+	pubFile, privFile := tpm2ToolsFiles(path)
+	pub, err := os.ReadFile(pubFile)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := os.ReadFile(privFile)
+	if err != nil {
+		return nil, err
+	}
+	k, err := key.NewTPM2ToolsKey(pub, priv, parent, keyfile.WithDescription(comment))
+	if err != nil {
+		return nil, err
+	}
+	k.RSAParent = rsaParent
+	if err := k.Check(tpm, ownerPassword); err != nil {
+		return nil, fmt.Errorf("%s can't be loaded under the parent: %w", path, err)
+	}
+	return k, nil
+}
+
+// writeConvertedKey writes k in format to output, and returns the files
+// written. It returns nil if overwriting a file was declined.
+func writeConvertedKey(k *key.SSHTPMKey, format, output string) ([]string, error) {
+	var files []string
+	contents := map[string][]byte{}
+	switch format {
+	case formatNative:
+		filename := strings.TrimSuffix(output, ".tpm")
+		files = []string{filename + ".tpm", filename + ".pub"}
+		b, err := k.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		contents[files[0]] = b
+		contents[files[1]] = k.AuthorizedKey()
+	case formatTSS2:
+		b, err := k.TSS2()
+		if err != nil {
+			return nil, err
+		}
+		files = []string{output}
+		contents[output] = b
+	case formatTPM2Tools:
+		pub, priv, err := k.TPM2Tools()
+		if err != nil {
+			return nil, err
+		}
+		pubFile, privFile := tpm2ToolsFiles(output)
+		files = []string{pubFile, privFile}
+		contents[pubFile], contents[privFile] = pub, priv
+	default:
+		return nil, fmt.Errorf("unsupported key format %q, expected %s, %s or %s", format, formatNative, formatTSS2, formatTPM2Tools)
+	}
+	for _, f := range files {
+		if !confirmOverwrite(f) {
+			return nil, nil
+		}
+	}
+	for _, f := range files {
+		if err := utils.WriteFileAtomic(f, contents[f], 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// tpm2ToolsParent returns the parent a tpm2-tools key is loaded under with
+// tpm2_load -C, and if it is the SRK, which has to be made persistent first.
+// It returns "" for parents tpm2-tools can't name.
+func tpm2ToolsParent(k *key.SSHTPMKey) (string, bool) {
+	switch {
+	case k.Parent == tpm2.TPMRHOwner && !k.RSAParent:
+		return fmt.Sprintf("0x%x", uint32(key.SRKHandle)), true
+	case k.Parent>>24 == tpm2.TPMHandle(tpm2.TPMHTPersistent):
+		return fmt.Sprintf("0x%x", uint32(k.Parent)), false
+	}
+	return "", false
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -14,7 +15,9 @@ import (
 	"os/user"
 	"path"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"log/slog"
 
@@ -22,8 +25,11 @@ import (
 	tpmpkix "github.com/foxboron/go-tpm-keyfiles/pkix"
 	"github.com/foxboron/ssh-tpm-agent/askpass"
 	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/keystore"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
 	"github.com/foxboron/ssh-tpm-agent/utils"
 	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -37,22 +43,142 @@ Options:
     -C                          Provide a comment with the key.
     -f                          Output keyfile.
     -N                          passphrase for the key.
-    -t ecdsa | rsa              Specify the type of key to create. Defaults to ecdsa
+    -t ecdsa | rsa              Specify the type of key to create. Defaults to ecdsa,
+                                or rsa on TPMs without ECC P-256.
     -b bits                     Number of bits in the key to create.
                                     rsa: 2048 (default)
                                     ecdsa: 256 (default) | 384 | 521
+    --pss                       Restrict the rsa key to RSA-PSS signatures with
+                                SHA-256, for TPMs whose policy forbids PKCS #1
+                                v1.5. Such keys can only be used through the
+                                sign-digest extension, not for SSH signatures.
+    --duplicable                Create a key which can be exported to another TPM
+                                with --duplicate-to, e.g. for a backup machine.
+    --bind-secureboot           Bind the key to the Secure Boot state in PCR 7. The
+                                key stops working when Secure Boot is turned off
+                                or its key databases change.
+    --duplicate-to PATH         Export the duplicable key given with -f to the TPM
+                                with the SRK public key from PATH, see --print-srk.
+                                The exported key is printed and can only be
+                                imported on that TPM.
+    --print-srk                 Print the public key of the SRK of the TPM, for
+                                duplicating keys to this TPM.
+    --import-duplicate PATH     Import a key duplicated to this TPM with
+                                --duplicate-to, and save it like a new key with -f
+                                or --nv.
+    --duplicate-public PATH     Public area (TPM2B_PUBLIC) of a duplicate made by
+                                tpm2_duplicate. --import-duplicate is then the
+                                duplicate private (TPM2B_PRIVATE).
+    --duplicate-seed PATH       Encrypted seed (TPM2B_ENCRYPTED_SECRET) of a
+                                duplicate made by tpm2_duplicate.
+    --deriver                   Create a key which per-host keys are derived from,
+                                saved to -f or ~/.ssh/id_derive.tpm.
+    --derive-host HOST          Derive the key for HOST from the deriver given with
+                                -f, and print it for the authorized_keys of HOST.
+                                The agent only uses it for connections to HOST.
+    --primary NAME              Print the primary key called NAME, which the TPM
+                                recreates from its seed for ssh-tpm-agent
+                                --primary-key NAME. Nothing is saved.
     -I, --import PATH           Import existing key into ssh-tpm-agent.
+    -p                          Change the passphrase of the key given with -f, or
+                                asked for.
+    --change-pin PATH           Change the PIN of the key in PATH. The TPM re-wraps
+                                the key with the new PIN, the public key stays the
+                                same. -N gives the new PIN instead of asking.
+                                Copies of the old key file keep working with the
+                                old PIN, no backup of it is kept.
+    --convert FORMAT            Convert the key given with -f to FORMAT, saved to
+                                --output. A -f or --output ending in .priv is a
+                                tpm2-tools key with the .pub next to it.
+                                    native      key file of ssh-tpm-agent
+                                    tss2        TSS2 PEM of other TPM 2.0 Key
+                                                Files implementations
+                                    tpm2-tools  TPM2B_PUBLIC and TPM2B_PRIVATE
+                                                of tpm2_create and tpm2_load
+                                Converted tpm2-tools keys are under the
+                                --parent-handle, with the -C comment.
+    --output PATH               File of the key converted with --convert.
     -A                          Generate host keys for all key types (rsa and ecdsa).
     --parent-handle             Parent for the TPM key. Can be a hierarchy or a
                                 persistent handle.
                                     owner, o (default)
-                                    endorment, e
+                                    endorsement, e
                                     null, n
                                     platform, p
+                                    ek
+                                ek creates the key under the endorsement key
+                                instead of a SRK, authorized with the EK policy.
+                                -o gives the endorsement hierarchy password.
+    --parent-template ecc | rsa Template of the storage parent key (SRK) the key
+                                is created under, or of the EK. Defaults to ecc,
+                                or rsa on TPMs without ECC P-256.
+    --nv                        Store the private key in a TPM NV index instead
+                                of a file. Load it with ssh-tpm-agent --keystore nv.
+    --not-before TIME           Start of the validity window of the key. TIME is a
+                                date (2006-01-02), a RFC 3339 time or a duration
+                                from now (+720h).
+    --not-after TIME            End of the validity window of the key. The agent
+                                does not list or sign with keys outside of their
+                                window, and warns before a key expires.
+    --algorithms ALGS           Comma separated signature algorithms the agent signs
+                                with the key, e.g. rsa-sha2-512 to refuse SHA-1
+                                ssh-rsa signatures. With -f of an existing key the
+                                algorithms of that key are changed, any lifts the
+                                restriction.
+    --metadata PATH             Key metadata file of the agent the validity window,
+                                and when, where and with which TPM the key was
+                                created, are stored in. Defaults to
+                                $XDG_STATE_HOME/ssh-tpm-agent/metadata.json.
+    --sealed-metadata DIR       Sealed key metadata of the agent to use instead of
+                                --metadata, see ssh-tpm-agent --sealed-metadata.
+    --authorizer PATH           Public key of an administrator whose signed policies
+                                authorize the use of the key. The key can't be used
+                                until a policy is signed for it.
+    --approver PATH             Public key of an external approver, e.g. a helper
+                                for a FIDO token or phone, which has to sign a
+                                fresh challenge for each use of the key. See
+                                ssh-tpm-agent --approver.
+    --sign-policy PATH          Sign a policy for the key given with -f, with the
+                                administrator private key from PATH. The policy
+                                binds the key to the --pcrs and its passphrase, and
+                                replaces the policy of the same --policy-name.
+    --pcrs PCRS                 Comma separated SHA-256 PCRs the signed policy binds
+                                the key to the current values of.
+    --policy-name NAME          Name of the signed policy. Defaults to the PCRs.
+    --reseal PATH               Sign the policies of the key given with -f again
+                                with the administrator private key from PATH, for
+                                the current values of their PCRs after a firmware
+                                or kernel update.
+    --attest                    Certify the creation of the key with the TPM
+                                attestation key, saved next to the key as .attest.
+    --export-attestation PATH   Print an attestation of the TPM key, with the
+                                endorsement key certificate of the TPM.
+    --nonce HEX                 Nonce from the verifier to include in the
+                                exported attestation, or to check when verifying.
+    --verify-attestation PATH   Verify an attestation from --attest or
+                                --export-attestation. The key given with -f is
+                                checked against the attestation.
+    --ca PATH                   PEM file with the TPM vendor CAs to verify the
+                                endorsement key certificate against.
+    --escrow PATH               Public key of the escrow administrator. A copy of
+                                the key imported with -I is encrypted to it and
+                                saved next to the key as .escrow.
+    --recover-escrow PATH       Decrypt the escrow copy given with -f with the
+                                escrow private key from PATH, and print the
+                                private key.
     --print-pubkey              Print the public key given a TPM private key.
     --supported                 List the supported keys of the TPM.
+    --completion SHELL          Print the completion script for bash, zsh or fish.
+    --json                      Print the created key, --print-pubkey, --supported,
+                                --derive-host and --primary as JSON. Messages and
+                                prompts go to stderr instead.
     --wrap PATH                 A SSH key to wrap for import on remote machine.
     --wrap-with PATH            Parent key to wrap the SSH key with.
+    -Y sign                     Sign files with the key given with -f, like
+                                ssh-keygen -Y sign. Other -Y operations are
+                                passed on to ssh-keygen.
+    -n namespace                Namespace of the signature.
+    -U                          Use the key given with -f from the agent.
 
 Generate new TPM sealed keys for ssh-tpm-agent.
 
@@ -60,6 +186,9 @@ TPM sealed keys are private keys created inside the Trusted Platform Module
 (TPM) and sealed in .tpm suffixed files. They are bound to the hardware they
 where produced on and can't be transferred to other machines.
 
+Options which aren't given on the command line are read from
+$XDG_CONFIG_HOME/ssh-tpm-agent/config, see ssh-tpm-agent --help.
+
 Example:
     $ ssh-tpm-keygen
     Generating a sealed public/private ecdsa key pair.
@@ -72,6 +201,17 @@ Example:
     SHA256:NCMJJ2La+q5tGcngQUQvEOJP3gPH8bMP98wJOEMV564
     The key's randomart image is the color of television, tuned to a dead channel.`
 
+// savedKey is the --json output for a key which was saved
+type savedKey struct {
+	utils.KeyJSON
+	PrivateKey  string     `json:"private_key"`
+	PublicKey   string     `json:"public_key,omitempty"`
+	Attestation string     `json:"attestation,omitempty"`
+	Escrow      string     `json:"escrow,omitempty"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+}
+
 func getPin() ([]byte, error) {
 	for {
 		pin1, err := askpass.ReadPassphrase("Enter passphrase (empty for no passphrase): ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
@@ -94,14 +234,143 @@ func getOwnerPassword() ([]byte, error) {
 	return askpass.ReadPassphrase("Enter owner password: ", askpass.RP_ALLOW_STDIN)
 }
 
+// parseTime parses a time of the key validity window, relative to now if it
+// starts with a +. An empty string is no time.
+func parseTime(s string, now time.Time) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if d, ok := strings.CutPrefix(s, "+"); ok {
+		dur, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q: %w", s, err)
+		}
+		t := now.Add(dur)
+		return &t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %q, expected a date, a RFC 3339 time or +duration", s)
+	}
+	return &t, nil
+}
+
+// keyAlgorithms returns the signature algorithms of k, the hash of rsa keys
+// is picked by the client
+func keyAlgorithms(k *key.SSHTPMKey) []string {
+	pk, err := k.SSHPublicKey()
+	if err != nil {
+		return nil
+	}
+	if pk.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSA, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512}
+	}
+	return []string{pk.Type()}
+}
+
+// parseAlgorithms parses the comma separated signature algorithms k is
+// restricted to, any lifts the restriction.
+func parseAlgorithms(s string, k *key.SSHTPMKey) ([]string, error) {
+	if s == "any" {
+		return nil, nil
+	}
+	supported := keyAlgorithms(k)
+	var algs []string
+	for _, alg := range strings.Split(s, ",") {
+		if !slices.Contains(supported, alg) {
+			return nil, fmt.Errorf("the key can't sign with %q, use one of %s", alg, strings.Join(supported, ","))
+		}
+		if !slices.Contains(algs, alg) {
+			algs = append(algs, alg)
+		}
+	}
+	return algs, nil
+}
+
+func parsePCRs(s string) ([]uint, error) {
+	var pcrs []uint
+	if s == "" {
+		return pcrs, nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(p), 10, 8)
+		if err != nil || n > 23 {
+			return nil, fmt.Errorf("invalid pcr %q", p)
+		}
+		pcrs = append(pcrs, uint(n))
+	}
+	return pcrs, nil
+}
+
+// readPublicKey reads a SSH public key
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, err
+	}
+	cpk, ok := pk.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type")
+	}
+	return cpk.CryptoPublicKey(), nil
+}
+
+// readSigner reads a SSH private key, asking for the passphrase if needed
+func readSigner(path string) (crypto.Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rawKey, err := ssh.ParseRawPrivateKey(b)
+	var kerr *ssh.PassphraseMissingError
+	if errors.As(err, &kerr) {
+		pin, perr := askpass.ReadPassphrase(fmt.Sprintf("Enter passphrase for %s: ", path), askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+		if perr != nil {
+			return nil, perr
+		}
+		rawKey, err = ssh.ParseRawPrivateKeyWithPassphrase(b, pin)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, ok := rawKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type")
+	}
+	return s, nil
+}
+
+// confirmOverwrite asks before overwriting the file, if it exists
+func confirmOverwrite(filename string) bool {
+	if !utils.FileExists(filename) {
+		return true
+	}
+	fmt.Printf("%s already exists.\n", filename)
+	s, err := askpass.ReadPassphrase("Overwrite (y/n)? ", askpass.RP_ALLOW_STDIN|askpass.RPP_ECHO_ON)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return bytes.Equal(s, []byte("y"))
+}
+
 func getParentHandle(ph string) (tpm2.TPMHandle, error) {
 	switch ph {
-	case "endoresement", "e":
+	case "endorsement", "endoresement", "e":
 		return tpm2.TPMRHEndorsement, nil
 	case "null", "n":
 		return tpm2.TPMRHNull, nil
-	case "plattform", "p":
+	case "platform", "plattform", "p":
 		return tpm2.TPMRHPlatform, nil
+	case "ek":
+		// the parent template picks the rsa or ecc ek
+		return key.ECCEKHandle, nil
 	case "owner", "o":
 		fallthrough
 	default:
@@ -114,6 +383,8 @@ func main() {
 		fmt.Println(usage)
 	}
 
+	passthroughSSHKeygen()
+
 	var (
 		askOwnerPassword               bool
 		comment, outputFile, keyPin    string
@@ -123,6 +394,29 @@ func main() {
 		listsupported                  bool
 		printPubkey                    string
 		parentHandle, wrap, wrapWith   string
+		parentTemplate                 string
+		storeNV                        bool
+		sigOp, namespace               string
+		useAgent                       bool
+		attest                         bool
+		exportAttestation, nonce       string
+		verifyAttestation, caFile      string
+		notBefore, notAfter            string
+		metadataFile                   string
+		authorizer, signPolicy, reseal string
+		algorithms, sealedMetadata     string
+		approver                       string
+		pss, duplicable, printSRK      bool
+		bindSecureBoot                 bool
+		duplicateTo, importDuplicate   string
+		dupPublic, dupSeed             string
+		pcrs, policyName               string
+		deriver, jsonOutput            bool
+		deriveHost, completion         string
+		primary                        string
+		escrow, recoverEscrow          string
+		changePinFile                  string
+		convert, convertOutput         string
 	)
 
 	defaultComment := func() string {
@@ -146,11 +440,14 @@ func main() {
 	flag.StringVar(&comment, "C", defaultComment, "provide a comment, default to user@host")
 	flag.StringVar(&outputFile, "f", "", "output keyfile")
 	flag.StringVar(&keyPin, "N", "", "new passphrase for the key")
-	flag.StringVar(&keyType, "t", "ecdsa", "key to create")
+	flag.StringVar(&keyType, "t", "", "key to create")
 	flag.IntVar(&bits, "b", 0, "number of bits")
 	flag.StringVar(&importKey, "I", "", "import key")
 	flag.StringVar(&importKey, "import", "", "import key")
 	flag.BoolVar(&changePin, "p", false, "change passphrase")
+	flag.StringVar(&changePinFile, "change-pin", "", "change the pin of the key")
+	flag.StringVar(&convert, "convert", "", "convert the key to another format")
+	flag.StringVar(&convertOutput, "output", "", "file of the converted key")
 	flag.BoolVar(&swtpmFlag, "swtpm", false, "use swtpm instead of actual tpm")
 	flag.BoolVar(&hostKeys, "A", false, "generate host keys")
 	flag.BoolVar(&listsupported, "supported", false, "list tpm caps")
@@ -158,23 +455,218 @@ func main() {
 	flag.StringVar(&wrap, "wrap", "", "wrap key")
 	flag.StringVar(&wrapWith, "wrap-with", "", "wrap with key")
 	flag.StringVar(&parentHandle, "parent-handle", "owner", "parent handle for the key")
+	flag.BoolVar(&storeNV, "nv", false, "store the key in a nv index")
+	flag.StringVar(&parentTemplate, "parent-template", "", "srk template for the parent key")
+	flag.StringVar(&sigOp, "Y", "", "signature operation")
+	flag.StringVar(&namespace, "n", "", "signature namespace")
+	flag.BoolVar(&useAgent, "U", false, "use the key in the agent")
+	flag.BoolVar(&attest, "attest", false, "certify the key creation")
+	flag.StringVar(&exportAttestation, "export-attestation", "", "export attestation of the key")
+	flag.StringVar(&nonce, "nonce", "", "nonce of the attestation")
+	flag.StringVar(&verifyAttestation, "verify-attestation", "", "verify attestation")
+	flag.StringVar(&caFile, "ca", "", "tpm vendor ca certificates")
+	flag.StringVar(&notBefore, "not-before", "", "start of the key validity window")
+	flag.StringVar(&notAfter, "not-after", "", "end of the key validity window")
+	flag.StringVar(&authorizer, "authorizer", "", "public key of the policy authorizer")
+	flag.StringVar(&approver, "approver", "", "public key of the external approver")
+	flag.BoolVar(&pss, "pss", false, "restrict the rsa key to rsa-pss")
+	flag.BoolVar(&duplicable, "duplicable", false, "create a duplicable key")
+	flag.BoolVar(&bindSecureBoot, "bind-secureboot", false, "bind the key to the secure boot state in pcr 7")
+	flag.StringVar(&duplicateTo, "duplicate-to", "", "export the key to the tpm with the srk")
+	flag.BoolVar(&printSRK, "print-srk", false, "print the srk public key")
+	flag.StringVar(&importDuplicate, "import-duplicate", "", "import a duplicated key")
+	flag.StringVar(&dupPublic, "duplicate-public", "", "public area of the duplicate")
+	flag.StringVar(&dupSeed, "duplicate-seed", "", "encrypted seed of the duplicate")
+	flag.StringVar(&completion, "completion", "", "print the shell completion script")
+	flag.BoolVar(&jsonOutput, "json", false, "print the result as json")
+	flag.BoolVar(&deriver, "deriver", false, "create a key for deriving per-host keys")
+	flag.StringVar(&deriveHost, "derive-host", "", "derive a key for the host")
+	flag.StringVar(&primary, "primary", "", "print the primary key with the name")
+	flag.StringVar(&signPolicy, "sign-policy", "", "sign a policy with the authorizer private key")
+	flag.StringVar(&reseal, "reseal", "", "sign the policies again for the current pcrs")
+	flag.StringVar(&pcrs, "pcrs", "", "pcrs of the signed policy")
+	flag.StringVar(&policyName, "policy-name", "", "name of the signed policy")
+	flag.StringVar(&escrow, "escrow", "", "public key to escrow imported keys to")
+	flag.StringVar(&recoverEscrow, "recover-escrow", "", "recover an escrow copy with the escrow private key")
+	flag.StringVar(&algorithms, "algorithms", "", "signature algorithms the key may sign with")
+	flag.StringVar(&metadataFile, "metadata", path.Join(utils.StateDir(), "metadata.json"), "path of the key metadata file")
+	flag.StringVar(&sealedMetadata, "sealed-metadata", "", "directory of the key metadata sealed to the tpm")
 
 	flag.Parse()
-
-	tpm, err := utils.TPM(swtpmFlag)
-	if err != nil {
+	if err := utils.LoadConfig(flag.CommandLine, "ssh-tpm-keygen", utils.ConfigFile()); err != nil {
 		log.Fatal(err)
 	}
-	defer tpm.Close()
 
-	if bits == 0 {
-		if keyType == "ecdsa" {
-			bits = 256
+	if completion != "" {
+		c := &utils.Completion{
+			Program: "ssh-tpm-keygen",
+			Flags:   flag.CommandLine,
+			Values: map[string]utils.CompletionKind{
+				"f":                  utils.CompleteKey,
+				"I":                  utils.CompleteFile,
+				"import":             utils.CompleteFile,
+				"change-pin":         utils.CompleteKey,
+				"output":             utils.CompleteFile,
+				"print-pubkey":       utils.CompleteKey,
+				"wrap":               utils.CompleteFile,
+				"wrap-with":          utils.CompleteFile,
+				"export-attestation": utils.CompleteKey,
+				"verify-attestation": utils.CompleteFile,
+				"ca":                 utils.CompleteFile,
+				"metadata":           utils.CompleteFile,
+				"sealed-metadata":    utils.CompleteDir,
+				"authorizer":         utils.CompleteFile,
+				"approver":           utils.CompleteFile,
+				"sign-policy":        utils.CompleteFile,
+				"reseal":             utils.CompleteFile,
+				"duplicate-to":       utils.CompleteFile,
+				"import-duplicate":   utils.CompleteFile,
+				"duplicate-public":   utils.CompleteFile,
+				"duplicate-seed":     utils.CompleteFile,
+				"escrow":             utils.CompleteFile,
+				"recover-escrow":     utils.CompleteFile,
+			},
+			Words: map[string][]string{
+				"t":               {"ecdsa", "rsa"},
+				"b":               {"256", "384", "521", "2048"},
+				"parent-handle":   {"owner", "endorsement", "null", "platform", "ek"},
+				"parent-template": {"ecc", "rsa"},
+				"convert":         {formatNative, formatTSS2, formatTPM2Tools},
+				"Y":               {"sign", "verify", "find-principals", "check-novalidate"},
+				"completion":      utils.CompletionShells,
+			},
+			Args: utils.CompleteFile,
 		}
-		if keyType == "rsa" {
-			bits = 2048
+		if err := c.Write(os.Stdout, completion); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	// openMetadata opens the --sealed-metadata, or the --metadata
+	openMetadata := func(tpm transport.TPMCloser, ownerPassword []byte) (*keystore.Metadata, error) {
+		if sealedMetadata != "" {
+			return keystore.OpenSealedMetadata(sealedMetadata, tpm, ownerPassword)
+		}
+		return keystore.OpenMetadata(metadataFile)
+	}
+
+	if sigOp != "" {
+		if sigOp != "sign" {
+			log.Fatalf("unsupported signature operation: %s", sigOp)
 		}
+		if outputFile == "" {
+			log.Fatal("-Y sign needs a key with -f")
+		}
+		ownerPassword := []byte("")
+		if askOwnerPassword {
+			p, err := getOwnerPassword()
+			if err != nil {
+				log.Fatal(err)
+			}
+			ownerPassword = p
+		}
+		tpmFetch := tpmconn.Func(func() (transport.TPMCloser, error) {
+			return utils.TPM(swtpmFlag)
+		})
+		s, err := signingKey(outputFile, useAgent, tpmFetch, ownerPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := signFiles(s, namespace, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if verifyAttestation != "" {
+		if err := verifyAttestationFile(verifyAttestation, outputFile, caFile, nonce); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if recoverEscrow != "" {
+		if outputFile == "" {
+			log.Fatal("--recover-escrow needs an escrow copy with -f")
+		}
+		b, err := os.ReadFile(outputFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s, err := readSigner(recoverEscrow)
+		if err != nil {
+			log.Fatalf("can't read escrow private key: %v", err)
+		}
+		recovered, err := keystore.RecoverEscrow(b, s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(recovered)
+		os.Exit(0)
+	}
+
+	// an existing key given with -f only has its algorithms changed
+	if algorithms != "" && outputFile != "" && utils.FileExists(outputFile) {
+		b, err := os.ReadFile(outputFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := key.Decode(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		algs, err := parseAlgorithms(algorithms, k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var tpm transport.TPMCloser
+		var ownerPassword []byte
+		if sealedMetadata != "" {
+			if askOwnerPassword {
+				if ownerPassword, err = getOwnerPassword(); err != nil {
+					log.Fatal(err)
+				}
+			}
+			if tpm, err = utils.TPM(swtpmFlag); err != nil {
+				log.Fatal(err)
+			}
+		}
+		metadata, err := openMetadata(tpm, ownerPassword)
+		if tpm != nil {
+			tpm.Close()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := metadata.SetAlgorithms(k.Fingerprint(), algs); err != nil {
+			log.Fatal(err)
+		}
+		if algs == nil {
+			fmt.Printf("%s can sign with any algorithm\n", outputFile)
+		} else {
+			fmt.Printf("%s can only sign with %s\n", outputFile, strings.Join(algs, ","))
+		}
+		os.Exit(0)
+	}
+
+	// The messages and prompts go to stderr with --json, so stdout only has
+	// the JSON document or the requested output.
+	stdout := os.Stdout
+	if jsonOutput {
+		os.Stdout = os.Stderr
+	}
+	printJSON := func(v any) {
+		if err := utils.PrintJSON(stdout, v); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	tpm, err := utils.TPM(swtpmFlag)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer tpm.Close()
 
 	supportedECCBitsizes := keyfile.SupportedECCAlgorithms(tpm)
 
@@ -188,6 +680,10 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if jsonOutput {
+			printJSON(utils.NewKeyJSON(k))
+			os.Exit(0)
+		}
 		fmt.Print(string(k.AuthorizedKey()))
 
 		os.Exit(0)
@@ -208,6 +704,13 @@ func main() {
 	}
 
 	if listsupported {
+		if jsonOutput {
+			printJSON(struct {
+				ECDSA []int `json:"ecdsa"`
+				RSA   []int `json:"rsa"`
+			}{append([]int{}, supportedECCBitsizes...), []int{2048}})
+			os.Exit(0)
+		}
 		fmt.Printf("ecdsa bit lengths:")
 		for _, alg := range supportedECCBitsizes {
 			fmt.Printf(" %d", alg)
@@ -228,6 +731,259 @@ func main() {
 		ownerPassword = []byte("")
 	}
 
+	if exportAttestation != "" {
+		b, err := os.ReadFile(exportAttestation)
+		if err != nil {
+			log.Fatalf("failed reading TPM key %s: %v", exportAttestation, err)
+		}
+		k, err := key.Decode(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		qualifying, err := hex.DecodeString(nonce)
+		if err != nil {
+			log.Fatalf("invalid nonce: %v", err)
+		}
+		var pin []byte
+		if !k.EmptyAuth {
+			pin, err = askpass.ReadPassphrase(fmt.Sprintf("Enter passphrase for (%s): ", k.Description), askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		a, err := k.Certify(tpm, ownerPassword, pin, qualifying)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if a.EKCertificate == nil {
+			fmt.Fprintln(os.Stderr, "Warning: the TPM has no endorsement key certificate")
+		}
+		stdout.Write(a.Bytes())
+		os.Exit(0)
+	}
+
+	if printSRK {
+		b, err := key.MarshalSRK(tpm, ownerPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stdout.Write(b)
+		os.Exit(0)
+	}
+
+	if primary != "" {
+		k, err := key.NewPrimary(tpm, ownerPassword, primary)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jsonOutput {
+			printJSON(utils.NewKeyJSON(k))
+			os.Exit(0)
+		}
+		fmt.Print(string(k.AuthorizedKey()))
+		os.Exit(0)
+	}
+
+	if deriver {
+		filename := outputFile
+		if filename == "" {
+			filename = path.Join(utils.SSHDir(), "id_derive")
+		}
+		filename = strings.TrimSuffix(filename, ".tpm") + ".tpm"
+		if !confirmOverwrite(filename) {
+			return
+		}
+		pin := []byte(keyPin)
+		if keyPin == "" {
+			fmt.Println("Generating a key for deriving per-host keys.")
+			pin, err = getPin()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		k, err := key.NewDeriver(tpm, ownerPassword, pin, keyfile.WithDescription(comment))
+		if err != nil {
+			log.Fatal(err)
+		}
+		b, err := k.Bytes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := utils.WriteFileAtomic(filename, b, 0o600); err != nil {
+			log.Fatal(err)
+		}
+		if jsonOutput {
+			printJSON(struct {
+				Deriver string `json:"deriver"`
+			}{filename})
+			os.Exit(0)
+		}
+		fmt.Printf("Your deriver has been saved in %s\n", filename)
+		fmt.Printf("Derive keys for hosts with ssh-tpm-keygen -f %s --derive-host HOST\n", filename)
+		os.Exit(0)
+	}
+
+	if deriveHost != "" {
+		filename := outputFile
+		if filename == "" {
+			filename = path.Join(utils.SSHDir(), "id_derive.tpm")
+		}
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d, err := key.Decode(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !d.IsDeriver() {
+			log.Fatalf("%s is not a deriver, create one with --deriver", filename)
+		}
+		var pin []byte
+		if !d.EmptyAuth {
+			pin, err = askpass.ReadPassphrase(fmt.Sprintf("Enter passphrase for (%s): ", d.Description), askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		k, err := d.Derive(tpm, ownerPassword, pin, deriveHost)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := keystore.AddDerived(filename, k); err != nil {
+			log.Fatal(err)
+		}
+		if jsonOutput {
+			printJSON(utils.NewKeyJSON(k))
+			os.Exit(0)
+		}
+		fmt.Print(string(k.AuthorizedKey()))
+		os.Exit(0)
+	}
+
+	if duplicateTo != "" {
+		if outputFile == "" {
+			log.Fatal("--duplicate-to needs a key with -f")
+		}
+		b, err := os.ReadFile(outputFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := key.Decode(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srkFile, err := os.ReadFile(duplicateTo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srk, err := key.ParseSRK(srkFile)
+		if err != nil {
+			log.Fatalf("%s does not contain a valid srk: %v", duplicateTo, err)
+		}
+		var pin []byte
+		if !k.EmptyAuth {
+			pin, err = askpass.ReadPassphrase(fmt.Sprintf("Enter passphrase for (%s): ", k.Description), askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		dup, err := k.Duplicate(tpm, ownerPassword, pin, srk)
+		if errors.Is(err, key.ErrNotDuplicable) {
+			log.Fatalf("%s was not created with --duplicable", outputFile)
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		b, err = dup.Bytes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		stdout.Write(b)
+		os.Exit(0)
+	}
+
+	if importDuplicate != "" {
+		b, err := os.ReadFile(importDuplicate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var dup *key.SSHTPMKey
+		if dupPublic != "" || dupSeed != "" {
+			if dupPublic == "" || dupSeed == "" {
+				log.Fatal("--duplicate-public and --duplicate-seed are both needed")
+			}
+			pub, err := os.ReadFile(dupPublic)
+			if err != nil {
+				log.Fatal(err)
+			}
+			seed, err := os.ReadFile(dupSeed)
+			if err != nil {
+				log.Fatal(err)
+			}
+			dup, err = key.NewDuplicate(pub, b, seed, keyfile.WithDescription(comment))
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			dup, err = key.Decode(b)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		k, err := dup.Import(tpm, ownerPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		filename := outputFile
+		if filename == "" {
+			filename = "id_ecdsa"
+			if k.KeyAlgo() == tpm2.TPMAlgRSA {
+				filename = "id_rsa"
+			}
+			filename = path.Join(utils.SSHDir(), filename)
+		}
+		filename = strings.TrimSuffix(filename, ".tpm")
+		privatekeyFilename := filename + ".tpm"
+		pubkeyFilename := filename + ".pub"
+		if !storeNV && !confirmOverwrite(privatekeyFilename) {
+			return
+		}
+		if !confirmOverwrite(pubkeyFilename) {
+			return
+		}
+
+		b, err = k.Bytes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(pubkeyFilename, k.AuthorizedKey(), 0o600); err != nil {
+			log.Fatal(err)
+		}
+		if storeNV {
+			ks := keystore.NewNV(
+				tpmconn.Static(tpm),
+				func() ([]byte, error) { return ownerPassword, nil },
+			)
+			index, err := ks.Save(k)
+			if err != nil {
+				log.Fatal(err)
+			}
+			privatekeyFilename = fmt.Sprintf("NV index 0x%x", index)
+		} else if err := utils.WriteFileAtomic(privatekeyFilename, b, 0o600); err != nil {
+			log.Fatal(err)
+		}
+		if jsonOutput {
+			printJSON(savedKey{KeyJSON: utils.NewKeyJSON(k), PrivateKey: privatekeyFilename, PublicKey: pubkeyFilename})
+			os.Exit(0)
+		}
+		fmt.Printf("Your identification has been saved in %s\n", privatekeyFilename)
+		fmt.Printf("Your public key has been saved in %s\n", pubkeyFilename)
+		fmt.Printf("The key fingerprint is:\n")
+		fmt.Println(k.Fingerprint())
+		os.Exit(0)
+	}
+
 	// Generate host keys
 	if hostKeys {
 		// Mimics the `ssh-keygen -A -f ./something` behaviour
@@ -236,6 +992,7 @@ func main() {
 			outputPath = path.Join(outputFile, outputPath)
 		}
 
+		created := []savedKey{}
 		lookup := map[string]struct {
 			alg  tpm2.TPMAlgID
 			bits int
@@ -262,16 +1019,65 @@ func main() {
 			}
 
 			sshkey := key.SSHTPMKey{TPMKey: k}
+			b, err := sshkey.Bytes()
+			if err != nil {
+				log.Fatal(err)
+			}
 
 			if err := os.WriteFile(pubkeyFilename, sshkey.AuthorizedKey(), 0o600); err != nil {
 				log.Fatal(err)
 			}
 
-			if err := os.WriteFile(privatekeyFilename, sshkey.Bytes(), 0o600); err != nil {
+			if err := utils.WriteFileAtomic(privatekeyFilename, b, 0o600); err != nil {
 				log.Fatal(err)
 			}
 
 			slog.Info("Wrote private key", slog.String("filename", privatekeyFilename))
+			created = append(created, savedKey{KeyJSON: utils.NewKeyJSON(&sshkey), PrivateKey: privatekeyFilename, PublicKey: pubkeyFilename})
+		}
+		if jsonOutput {
+			printJSON(struct {
+				Keys []savedKey `json:"keys"`
+			}{created})
+		}
+		os.Exit(0)
+	}
+
+	if convert != "" {
+		if outputFile == "" || convertOutput == "" {
+			log.Fatal("--convert needs the key with -f and the converted key with --output")
+		}
+		parent, err := getParentHandle(parentHandle)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := readConvertKey(tpm, ownerPassword, outputFile, parent, parentTemplate == "rsa", comment)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files, err := writeConvertedKey(k, convert, convertOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if files == nil {
+			return
+		}
+		if jsonOutput {
+			printJSON(struct {
+				utils.KeyJSON
+				Format string   `json:"format"`
+				Files  []string `json:"files"`
+			}{utils.NewKeyJSON(k), convert, files})
+			os.Exit(0)
+		}
+		fmt.Printf("Your key has been converted to %s in %s\n", convert, strings.Join(files, " and "))
+		if convert == formatTPM2Tools {
+			if parent, srk := tpm2ToolsParent(k); parent != "" {
+				fmt.Printf("Load it with tpm2_load -C %s -u %s -r %s -c key.ctx\n", parent, files[0], files[1])
+				if srk {
+					fmt.Println("after making the SRK persistent with ssh-tpm-agent setup --persist-srk")
+				}
+			}
 		}
 		os.Exit(0)
 	}
@@ -290,6 +1096,48 @@ func main() {
 		}
 	}
 
+	// Keys created on the TPM default to what it supports, imported keys
+	// always use the ecc srk
+	if importKey == "" && wrap == "" {
+		info, err := utils.ReadTPMInfo(tpm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyType, bits, err = info.ChooseKey(keyType, bits)
+		if err != nil {
+			log.Fatal(err)
+		}
+		parentTemplate, err = info.ChooseParent(parentTemplate)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if keyType == "" {
+			keyType = "ecdsa"
+		}
+		if parentTemplate == "" {
+			parentTemplate = "ecc"
+		}
+	}
+
+	var rsaParent bool
+	switch parentTemplate {
+	case "ecc":
+	case "rsa":
+		rsaParent = true
+	default:
+		log.Fatalf("unsupported parent template: %s", parentTemplate)
+	}
+
+	if rsaParent && (importKey != "" || wrap != "") {
+		log.Fatal("--parent-template rsa can only be used for keys created on the TPM")
+	}
+
+	ekParent := key.IsEKHandle(keyParentHandle)
+	if ekParent && (importKey != "" || wrap != "") {
+		log.Fatal("--parent-handle ek can only be used for keys created on the TPM")
+	}
+
 	// Wrapping of keyfile for import
 	if wrap != "" {
 		if wrapWith == "" {
@@ -367,7 +1215,7 @@ func main() {
 		privatekeyFilename = outputFile + ".tpm"
 		pubkeyFilename = outputFile + ".pub"
 
-		if err := os.WriteFile(privatekeyFilename, k.Bytes(), 0o600); err != nil {
+		if err := utils.WriteFileAtomic(privatekeyFilename, k.Bytes(), 0o600); err != nil {
 			log.Fatal(err)
 		}
 
@@ -384,11 +1232,6 @@ func main() {
 	case "ecdsa":
 		tpmkeyType = tpm2.TPMAlgECC
 		filename = "id_ecdsa"
-
-		if !slices.Contains(supportedECCBitsizes, bits) {
-			log.Fatalf("invalid ecdsa key length: TPM does not support %v bits", bits)
-		}
-
 	case "rsa":
 		tpmkeyType = tpm2.TPMAlgRSA
 		filename = "id_rsa"
@@ -400,61 +1243,188 @@ func main() {
 		filename = path.Join(utils.SSHDir(), filename)
 	}
 
-	if changePin {
-		b, err := os.ReadFile(filename)
+	if reseal != "" {
+		if outputFile == "" {
+			log.Fatal("--reseal needs a key with -f")
+		}
+		b, err := os.ReadFile(outputFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		parsedk, err := keyfile.Decode(b)
+		k, err := key.Decode(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !k.IsAuthorized() {
+			if len(k.BoundPCRs()) != 0 {
+				log.Fatalf("%s is bound to the PCRs without an --authorizer, it has to be created again", outputFile)
+			}
+			log.Fatalf("%s was not created with --authorizer", outputFile)
+		}
+		admin, err := readSigner(reseal)
 		if err != nil {
 			log.Fatal(err)
 		}
+		names, err := k.ResignPolicies(tpm, admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b, err = k.Bytes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := utils.WriteFileAtomic(outputFile, b, 0o600); err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range names {
+			fmt.Printf("Signed policy %q has been updated in %s\n", name, outputFile)
+		}
+		os.Exit(0)
+	}
 
-		k := &key.SSHTPMKey{TPMKey: parsedk}
+	if signPolicy != "" {
+		if outputFile == "" {
+			log.Fatal("--sign-policy needs a key with -f")
+		}
+		b, err := os.ReadFile(outputFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		k, err := key.Decode(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		admin, err := readSigner(signPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pcrList, err := parsePCRs(pcrs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if policyName == "" {
+			policyName = "pcrs " + pcrs
+		}
+		ap, err := key.SignPolicy(tpm, admin, policyName, pcrList)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := k.AddAuthPolicy(ap); err != nil {
+			log.Fatal(err)
+		}
+		b, err = k.Bytes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := utils.WriteFileAtomic(outputFile, b, 0o600); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Signed policy %q has been added to %s\n", policyName, outputFile)
+		os.Exit(0)
+	}
 
-		if k.Description != "" {
-			fmt.Printf("Key has comment '%s'\n", k.Description)
+	var authorizerKey, approverKey, escrowKey crypto.PublicKey
+	if authorizer != "" {
+		authorizerKey, err = readPublicKey(authorizer)
+		if err != nil {
+			log.Fatalf("can't read authorizer public key: %v", err)
 		}
-		if outputFile == "" {
-			f, err := askpass.ReadPassphrase(fmt.Sprintf("Enter file in which the key is (%s): ", filename), askpass.RP_ALLOW_STDIN|askpass.RPP_ECHO_ON)
-			if err != nil {
-				log.Fatal(err)
-			}
-			filename = string(f)
+	}
+	if approver != "" {
+		approverKey, err = readPublicKey(approver)
+		if err != nil {
+			log.Fatalf("can't read approver public key: %v", err)
 		}
+	}
+	if escrow != "" {
+		escrowKey, err = readPublicKey(escrow)
+		if err != nil {
+			log.Fatalf("can't read escrow public key: %v", err)
+		}
+	}
 
-		oldPin, err := askpass.ReadPassphrase("Enter old passphrase: ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+	if changePinFile != "" {
+		changePin = true
+		filename = changePinFile
+	} else if changePin && outputFile == "" {
+		f, err := askpass.ReadPassphrase(fmt.Sprintf("Enter file in which the key is (%s): ", filename), askpass.RP_ALLOW_STDIN|askpass.RPP_ECHO_ON)
 		if err != nil {
 			log.Fatal(err)
 		}
-		newPin, err := askpass.ReadPassphrase("Enter new passphrase (empty for no passphrase): ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+		if len(f) != 0 {
+			filename = string(f)
+		}
+	}
+
+	if changePin {
+		b, err := os.ReadFile(filename)
 		if err != nil {
 			log.Fatal(err)
 		}
-		newPin2, err := askpass.ReadPassphrase("Enter same passphrase: ", askpass.RP_ALLOW_STDIN)
+
+		k, err := key.Decode(b)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if !bytes.Equal(newPin, newPin2) {
-			log.Fatal("Passphrases do not match. Try again.")
+
+		if k.Description != "" {
+			fmt.Printf("Key has comment '%s'\n", k.Description)
+		}
+
+		var oldPin []byte
+		if k.HasAuth() {
+			oldPin, err = askpass.ReadPassphrase("Enter old passphrase: ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		newPin := []byte(keyPin)
+		if keyPin == "" {
+			newPin, err = askpass.ReadPassphrase("Enter new passphrase (empty for no passphrase): ", askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+			if err != nil {
+				log.Fatal(err)
+			}
+			newPin2, err := askpass.ReadPassphrase("Enter same passphrase: ", askpass.RP_ALLOW_STDIN)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !bytes.Equal(newPin, newPin2) {
+				log.Fatal("Passphrases do not match. Try again.")
+			}
+			fmt.Println()
 		}
-		fmt.Println()
 
-		if err := keyfile.ChangeAuth(tpm, ownerPassword, k.TPMKey, oldPin, newPin); err != nil {
-			log.Fatal("Failed changing passphrase on the key.")
+		err = k.ChangeAuth(tpm, ownerPassword, oldPin, newPin)
+		switch {
+		case errors.Is(err, tpm2.TPMRCBadAuth), errors.Is(err, tpm2.TPMRCAuthFail):
+			log.Fatal("Wrong passphrase, the key was not changed.")
+		case errors.Is(err, tpm2.TPMRCLockout):
+			log.Fatal("The TPM is in dictionary attack lockout, try again later.")
+		case err != nil:
+			log.Fatalf("Failed changing passphrase on the key: %v", err)
 		}
 
-		if err := os.WriteFile(filename, k.Bytes(), 0o600); err != nil {
+		// the old key file still works with the old passphrase, so no
+		// backup of it is kept
+		b, err = k.Bytes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := utils.ReplaceFileAtomic(filename, b, 0o600); err != nil {
 			log.Fatal(err)
 		}
 
+		if jsonOutput {
+			printJSON(savedKey{KeyJSON: utils.NewKeyJSON(k), PrivateKey: filename})
+			os.Exit(0)
+		}
 		fmt.Println("Your identification has been saved with the new passphrase.")
 		os.Exit(0)
 	}
 
 	// Only used with -I/--import
 	var toImportKey any
+	var importedKey crypto.PrivateKey
 
 	var wrappedKey bool
 	var pem []byte
@@ -514,6 +1484,7 @@ func main() {
 			default:
 				log.Fatal("unsupported key type")
 			}
+			importedKey = rawKey
 
 			pubPem, err := os.ReadFile(importKey + ".pub")
 			if err != nil {
@@ -545,26 +1516,11 @@ func main() {
 	privatekeyFilename = filename + ".tpm"
 	pubkeyFilename = filename + ".pub"
 
-	if utils.FileExists(privatekeyFilename) {
-		fmt.Printf("%s already exists.\n", privatekeyFilename)
-		s, err := askpass.ReadPassphrase("Overwrite (y/n)? ", askpass.RP_ALLOW_STDIN|askpass.RPP_ECHO_ON)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if !bytes.Equal(s, []byte("y")) {
-			return
-		}
+	if !storeNV && !confirmOverwrite(privatekeyFilename) {
+		return
 	}
-
-	if utils.FileExists(pubkeyFilename) {
-		fmt.Printf("%s already exists.\n", pubkeyFilename)
-		s, err := askpass.ReadPassphrase("Overwrite (y/n)? ", askpass.RP_ALLOW_STDIN|askpass.RPP_ECHO_ON)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if !bytes.Equal(s, []byte("y")) {
-			return
-		}
+	if !confirmOverwrite(pubkeyFilename) {
+		return
 	}
 
 	var pin []byte
@@ -582,6 +1538,38 @@ func main() {
 		}
 	}
 
+	now := time.Now()
+	validFrom, err := parseTime(notBefore, now)
+	if err != nil {
+		log.Fatal(err)
+	}
+	validUntil, err := parseTime(notAfter, now)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if validFrom != nil && validUntil != nil && !validUntil.After(*validFrom) {
+		log.Fatal("--not-after needs to be after --not-before")
+	}
+
+	if attest && (wrappedKey || importKey != "") {
+		log.Fatal("--attest only works with keys created by the TPM")
+	}
+	if (authorizerKey != nil || approverKey != nil) && (wrappedKey || importKey != "") {
+		log.Fatal("--authorizer and --approver only work with keys created by the TPM")
+	}
+	if duplicable && (wrappedKey || importKey != "") {
+		log.Fatal("--duplicable only works with keys created by the TPM")
+	}
+	if bindSecureBoot && (wrappedKey || importKey != "") {
+		log.Fatal("--bind-secureboot only works with keys created by the TPM")
+	}
+	if escrowKey != nil && (wrappedKey || importKey == "") {
+		log.Fatal("--escrow only works with imported keys, keys created by the TPM can't leave it")
+	}
+	if escrowKey != nil && storeNV {
+		log.Fatal("--escrow needs a key file, not --nv")
+	}
+
 	var k *key.SSHTPMKey
 
 	if wrappedKey {
@@ -605,31 +1593,150 @@ func main() {
 			log.Fatal(err)
 		}
 	} else {
-		k, err = key.NewSSHTPMKey(tpm, tpmkeyType, bits, ownerPassword,
-			keyfile.WithParent(keyParentHandle),
-			keyfile.WithDescription(defaultComment),
-			keyfile.WithUserAuth(pin),
-			keyfile.WithDescription(comment),
-		)
-		if err != nil {
+		var bindPCRs []uint
+		if bindSecureBoot {
+			bindPCRs = []uint{7}
+		}
+		k, err = withProgress(tpm, "Generating the key", func(tpm transport.TPMCloser) (*key.SSHTPMKey, error) {
+			return key.NewSSHTPMKeyWithOptions(tpm, tpmkeyType, bits, ownerPassword,
+				&key.CreateOptions{
+					Userauth:   pin,
+					RSAParent:  rsaParent,
+					Attest:     attest,
+					Authorizer: authorizerKey,
+					Approver:   approverKey,
+					PSS:        pss,
+					Duplicable: duplicable,
+					EKParent:   ekParent,
+					PCRs:       bindPCRs,
+				},
+				keyfile.WithParent(keyParentHandle),
+				keyfile.WithDescription(comment),
+			)
+		})
+		if errors.Is(err, errCancelled) {
+			fmt.Fprintln(os.Stderr, "Key generation cancelled")
+			os.Exit(130)
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var algs []string
+	if algorithms != "" {
+		if algs, err = parseAlgorithms(algorithms, k); err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	b, err := k.Bytes()
+	if err != nil {
+		log.Fatal(err)
+	}
 	if importKey == "" {
 		if err := os.WriteFile(pubkeyFilename, k.AuthorizedKey(), 0o600); err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	if err := os.WriteFile(privatekeyFilename, k.Bytes(), 0o600); err != nil {
+	if storeNV {
+		ks := keystore.NewNV(
+			tpmconn.Static(tpm),
+			func() ([]byte, error) { return ownerPassword, nil },
+		)
+		index, err := ks.Save(k)
+		if err != nil {
+			log.Fatal(err)
+		}
+		privatekeyFilename = fmt.Sprintf("NV index 0x%x", index)
+	} else if err := utils.WriteFileAtomic(privatekeyFilename, b, 0o600); err != nil {
 		log.Fatal(err)
 	}
 
+	if k.Attestation != nil {
+		if err := os.WriteFile(filename+".attest", k.Attestation.Bytes(), 0o600); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if escrowKey != nil {
+		b, err := keystore.Escrow(escrowKey, importedKey, comment)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(filename+".escrow", b, 0o600); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if validFrom != nil || validUntil != nil {
+		metadata, err := openMetadata(tpm, ownerPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := metadata.SetValidity(k.Fingerprint(), validFrom, validUntil); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if algs != nil {
+		metadata, err := openMetadata(tpm, ownerPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := metadata.SetAlgorithms(k.Fingerprint(), algs); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if metadataFile != "" || sealedMetadata != "" {
+		metadata, err := openMetadata(tpm, ownerPassword)
+		if err == nil {
+			err = metadata.SetCreation(k.Fingerprint(), keystore.NewKeyCreation(tpm, k))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed recording the creation of the key: %v\n", err)
+		}
+	}
+
+	if jsonOutput {
+		saved := savedKey{
+			KeyJSON:    utils.NewKeyJSON(k),
+			PrivateKey: privatekeyFilename,
+			NotBefore:  validFrom,
+			NotAfter:   validUntil,
+		}
+		if importKey == "" {
+			saved.PublicKey = pubkeyFilename
+		}
+		if k.Attestation != nil {
+			saved.Attestation = filename + ".attest"
+		}
+		if escrowKey != nil {
+			saved.Escrow = filename + ".escrow"
+		}
+		printJSON(saved)
+		return
+	}
 	fmt.Printf("Your identification has been saved in %s\n", privatekeyFilename)
 	if importKey == "" {
 		fmt.Printf("Your public key has been saved in %s\n", pubkeyFilename)
 	}
+	if k.Attestation != nil {
+		fmt.Printf("Your attestation has been saved in %s.attest\n", filename)
+	}
+	if escrowKey != nil {
+		fmt.Printf("Your escrow copy has been saved in %s.escrow\n", filename)
+	}
+	if validFrom != nil {
+		fmt.Printf("The key is valid from %s\n", validFrom.Local().Format(time.DateTime))
+	}
+	if validUntil != nil {
+		fmt.Printf("The key is valid until %s\n", validUntil.Local().Format(time.DateTime))
+	}
+	if bindSecureBoot {
+		fmt.Println("The key is bound to the current Secure Boot state in PCR 7")
+	}
 	fmt.Printf("The key fingerprint is:\n")
 	fmt.Println(k.Fingerprint())
 	fmt.Println("The key's randomart image is the color of television, tuned to a dead channel.")
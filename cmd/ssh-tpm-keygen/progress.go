@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/term"
+)
+
+var errCancelled = errors.New("cancelled")
+
+// cancelTPM fails the commands sent after the key creation was cancelled,
+// except for flushing, so the objects loaded so far are cleaned up.
+type cancelTPM struct {
+	transport.TPMCloser
+	mu        sync.Mutex
+	cancelled bool
+}
+
+func (c *cancelTPM) Send(cmd []byte) ([]byte, error) {
+	if c.isCancelled() && (len(cmd) < 10 || tpm2.TPMCC(binary.BigEndian.Uint32(cmd[6:10])) != tpm2.TPMCCFlushContext) {
+		return nil, errCancelled
+	}
+	return c.TPMCloser.Send(cmd)
+}
+
+func (c *cancelTPM) cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled = true
+}
+
+func (c *cancelTPM) isCancelled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled
+}
+
+// withProgress runs create with tpm and shows the elapsed time on a terminal
+// while it runs, as RSA keys can take a long time on discrete TPMs. An
+// interrupt cancels create after the running TPM command, which can't be
+// aborted, a second one exits right away.
+func withProgress[T any](tpm transport.TPMCloser, msg string, create func(transport.TPMCloser) (T, error)) (T, error) {
+	ctpm := &cancelTPM{TPMCloser: tpm}
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tty := term.IsTerminal(int(os.Stderr.Fd()))
+		start := time.Now()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		spinner := `|/-\`
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				if tty {
+					fmt.Fprint(os.Stderr, "\r\033[K")
+				}
+				return
+			case <-sig:
+				if ctpm.isCancelled() {
+					os.Exit(130)
+				}
+				ctpm.cancel()
+				msg = "Cancelling, waiting for the TPM"
+				if !tty {
+					fmt.Fprintln(os.Stderr, msg)
+				}
+			case <-ticker.C:
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r\033[K%s %c %ds", msg, spinner[i%len(spinner)], int(time.Since(start).Seconds()))
+				}
+			}
+		}
+	}()
+
+	v, err := create(ctpm)
+	close(done)
+	<-stopped
+	if ctpm.isCancelled() {
+		var zero T
+		return zero, errCancelled
+	}
+	return v, err
+}
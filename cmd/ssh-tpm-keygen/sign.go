@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/askpass"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/signer"
+	"github.com/foxboron/ssh-tpm-agent/sshsig"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// passthroughSSHKeygen replaces the process with ssh-keygen for the -Y
+// operations we don't implement, so ssh-tpm-keygen can be used as
+// gpg.ssh.program in git which also verifies signatures.
+func passthroughSSHKeygen() {
+	for i, arg := range os.Args {
+		if arg != "-Y" || i+1 >= len(os.Args) || os.Args[i+1] == "sign" {
+			continue
+		}
+		bin, err := exec.LookPath("ssh-keygen")
+		if err != nil {
+			log.Fatalf("-Y %s needs ssh-keygen: %v", os.Args[i+1], err)
+		}
+		args := append([]string{bin}, os.Args[1:]...)
+		log.Fatal(syscall.Exec(bin, args, os.Environ()))
+	}
+}
+
+// agentSigner returns the signer of the public key from the agent
+func agentSigner(pub ssh.PublicKey) (ssh.AlgorithmSigner, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("can't find any ssh-tpm-agent socket")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := sshagent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+			return s.(ssh.AlgorithmSigner), nil
+		}
+	}
+	return nil, fmt.Errorf("agent has no key %s", ssh.FingerprintSHA256(pub))
+}
+
+// tpmSigner returns a signer for the TPM key, prompting for the passphrase
+func tpmSigner(k *key.SSHTPMKey, tpm transport.TPMCloser, ownerPassword []byte) (ssh.AlgorithmSigner, error) {
+	s, err := ssh.NewSignerFromSigner(
+		signer.NewSSHKeySigner(k,
+			func() ([]byte, error) { return ownerPassword, nil },
+			tpmconn.Static(tpm),
+			func(_ *keyfile.TPMKey) ([]byte, error) {
+				return askpass.ReadPassphrase(fmt.Sprintf("Enter passphrase for (%s): ", k.Description), askpass.RP_ALLOW_STDIN|askpass.RP_NEWLINE)
+			}))
+	if err != nil {
+		return nil, err
+	}
+	return s.(ssh.AlgorithmSigner), nil
+}
+
+// signingKey finds the signer for the key file. This is either a TPM key, the
+// TPM key next to the public key, or the key matching the public key in the
+// agent.
+func signingKey(keyFile string, useAgent bool, tpm tpmconn.Opener, ownerPassword []byte) (ssh.AlgorithmSigner, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if !useAgent {
+		for _, f := range []string{keyFile, strings.TrimSuffix(keyFile, ".pub") + ".tpm"} {
+			kb, err := os.ReadFile(f)
+			if err != nil {
+				continue
+			}
+			k, err := key.Decode(kb)
+			if err != nil {
+				continue
+			}
+			t, err := tpm.Open()
+			if err != nil {
+				return nil, err
+			}
+			return tpmSigner(k, t, ownerPassword)
+		}
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a TPM key or a public key", keyFile)
+	}
+	return agentSigner(pub)
+}
+
+// signFiles implements ssh-keygen -Y sign. The signatures are written to
+// FILE.sig, or stdout when signing stdin.
+func signFiles(s ssh.AlgorithmSigner, namespace string, files []string) error {
+	if len(files) == 0 {
+		sig, err := sshsig.Sign(s, os.Stdin, namespace)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(sig.Armor())
+		return err
+	}
+
+	for _, file := range files {
+		var r io.Reader
+		if file == "-" {
+			r = os.Stdin
+		} else {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		sig, err := sshsig.Sign(s, r, namespace)
+		if err != nil {
+			return err
+		}
+
+		if file == "-" {
+			if _, err := os.Stdout.Write(sig.Armor()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.WriteFile(file+".sig", sig.Armor(), 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Signing file %s\nWrite signature to %s.sig\n", file, file)
+	}
+	return nil
+}
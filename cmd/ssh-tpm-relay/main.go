@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/foxboron/ssh-tpm-agent/internal/relay"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var Version string
+
+const usage = `Usage:
+    ssh-tpm-relay
+
+Relay TPM commands read from stdin to the local TPM and write the responses to
+stdout. Built for Windows, where the TPM is reached through the TPM Base
+Services, so ssh-tpm-agent and ssh-tpm-keygen running inside WSL can use the
+Windows TPM by setting SSH_TPM_RELAY to the path of ssh-tpm-relay.exe.
+
+Every command and response is framed by a big-endian uint32 length.
+
+Example:
+    $ GOOS=windows go build -o /mnt/c/Users/me/ssh-tpm-relay.exe ./cmd/ssh-tpm-relay
+    $ export SSH_TPM_RELAY=/mnt/c/Users/me/ssh-tpm-relay.exe
+    $ ssh-tpm-agent`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Println(usage)
+	}
+	flag.Parse()
+
+	if len(flag.Args()) != 0 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	tpm, err := transport.OpenTPM()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tpm.Close()
+
+	if err := relay.Serve(tpm, os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
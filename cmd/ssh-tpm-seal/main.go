@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+var Version string
+
+const usage = `Usage:
+    ssh-tpm-seal [OPTIONS] < SECRET > FILE
+    ssh-tpm-seal -d FILE
+
+Options:
+    -d, --unseal           Unseal FILE and write the secret to stdout.
+    --pcrs PCRS            Bind the secret to the current values of the
+                           comma separated SHA-256 PCRs.
+    --confirm              Ask for confirmation through SSH_ASKPASS before
+                           every unseal.
+    -C, --comment COMMENT  Comment stored in the sealed file.
+
+Seal a small secret (up to 128 bytes) read from stdin to the TPM through
+ssh-tpm-agent, and write the sealed file to stdout. Sealed files can only be
+unsealed by the TPM that created them.
+
+Example:
+    $ echo -n hunter2 | ssh-tpm-seal --pcrs 7 > secret.tpm
+    $ ssh-tpm-seal -d secret.tpm
+    hunter2`
+
+func parsePCRs(s string) (uint32, error) {
+	var mask uint32
+	if s == "" {
+		return mask, nil
+	}
+	for _, p := range strings.Split(s, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(p), 10, 8)
+		if err != nil || n > 23 {
+			return 0, fmt.Errorf("invalid pcr %q", p)
+		}
+		mask |= 1 << n
+	}
+	return mask, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Println(usage)
+	}
+
+	var (
+		unseal, confirm bool
+		pcrs, comment   string
+	)
+
+	flag.BoolVar(&unseal, "d", false, "unseal")
+	flag.BoolVar(&unseal, "unseal", false, "unseal")
+	flag.StringVar(&pcrs, "pcrs", "", "pcrs to bind the secret to")
+	flag.BoolVar(&confirm, "confirm", false, "confirm unseal")
+	flag.StringVar(&comment, "C", "", "comment")
+	flag.StringVar(&comment, "comment", "", "comment")
+	flag.Parse()
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		fmt.Println("Can't find any ssh-tpm-agent socket.")
+		os.Exit(1)
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := sshagent.NewClient(conn)
+
+	if unseal {
+		if len(flag.Args()) != 1 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		b, err := os.ReadFile(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		secret, err := agent.UnsealSecret(client, b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(secret)
+		return
+	}
+
+	mask, err := parsePCRs(pcrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	secret, err := io.ReadAll(io.LimitReader(os.Stdin, key.MaxSealedSize+1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sealed, err := agent.SealSecret(client, &agent.SealMsg{
+		Secret:  secret,
+		PCRMask: mask,
+		Confirm: confirm,
+		Comment: comment,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(sealed)
+}
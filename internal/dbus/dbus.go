@@ -0,0 +1,462 @@
+// Package dbus implements just enough of the D-Bus wire protocol to call
+// methods with simple arguments, to receive signals and to receive the file
+// descriptors of replies. Messages are always sent little endian.
+package dbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	MsgMethodCall   = 1
+	MsgMethodReturn = 2
+	MsgError        = 3
+	MsgSignal       = 4
+
+	FieldPath        = 1
+	FieldInterface   = 2
+	FieldMember      = 3
+	FieldErrorName   = 4
+	FieldReplySerial = 5
+	FieldDestination = 6
+	FieldSender      = 7
+	FieldSignature   = 8
+	FieldUnixFDs     = 9
+
+	MaxMessage = 1 << 20
+)
+
+var order = binary.LittleEndian
+
+// BusAddress returns the path of the unix socket of the bus, from the first
+// unix:path= or unix:abstract= address of a D-Bus server address.
+func BusAddress(addr string) (string, error) {
+	for _, a := range strings.Split(addr, ";") {
+		transport, params, ok := strings.Cut(a, ":")
+		if !ok || transport != "unix" {
+			continue
+		}
+		for _, p := range strings.Split(params, ",") {
+			k, v, _ := strings.Cut(p, "=")
+			v, err := url.PathUnescape(v)
+			if err != nil {
+				return "", fmt.Errorf("invalid bus address %q: %w", addr, err)
+			}
+			switch k {
+			case "path":
+				return v, nil
+			case "abstract":
+				return "@" + v, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no unix socket in bus address %q", addr)
+}
+
+// SystemBusAddress returns the path of the socket of the system bus
+func SystemBusAddress() (string, error) {
+	addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if addr == "" {
+		addr = "unix:path=/var/run/dbus/system_bus_socket"
+	}
+	return BusAddress(addr)
+}
+
+// Encoder marshals message bodies
+type Encoder struct {
+	b []byte
+}
+
+func (e *Encoder) Bytes() []byte { return e.b }
+
+func (e *Encoder) Align(n int) {
+	for len(e.b)%n != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *Encoder) Byte(v byte) { e.b = append(e.b, v) }
+
+func (e *Encoder) Uint32(v uint32) {
+	e.Align(4)
+	e.b = order.AppendUint32(e.b, v)
+}
+
+func (e *Encoder) Uint64(v uint64) {
+	e.Align(8)
+	e.b = order.AppendUint64(e.b, v)
+}
+
+func (e *Encoder) String(s string) {
+	e.Uint32(uint32(len(s)))
+	e.b = append(e.b, s...)
+	e.b = append(e.b, 0)
+}
+
+func (e *Encoder) Signature(s string) {
+	e.b = append(e.b, byte(len(s)))
+	e.b = append(e.b, s...)
+	e.b = append(e.b, 0)
+}
+
+// Decoder unmarshals message bodies. Errors are kept until Err is checked.
+type Decoder struct {
+	b   []byte
+	off int
+	err error
+}
+
+func NewDecoder(b []byte) *Decoder {
+	return &Decoder{b: b}
+}
+
+var errShortMessage = errors.New("dbus: short message")
+
+// Err returns the first error of the decoder
+func (d *Decoder) Err() error { return d.err }
+
+// Offset returns the position of the decoder in the body
+func (d *Decoder) Offset() int { return d.off }
+
+func (d *Decoder) Align(n int) {
+	for d.off%n != 0 {
+		d.off++
+	}
+}
+
+func (d *Decoder) next(n int) []byte {
+	if d.err != nil || d.off+n > len(d.b) {
+		d.err = errShortMessage
+		return make([]byte, n)
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *Decoder) Byte() byte { return d.next(1)[0] }
+
+func (d *Decoder) Uint32() uint32 {
+	d.Align(4)
+	return order.Uint32(d.next(4))
+}
+
+func (d *Decoder) Uint64() uint64 {
+	d.Align(8)
+	return order.Uint64(d.next(8))
+}
+
+func (d *Decoder) String() string {
+	n := d.Uint32()
+	if n > MaxMessage {
+		d.err = errShortMessage
+		return ""
+	}
+	s := string(d.next(int(n)))
+	d.next(1)
+	return s
+}
+
+func (d *Decoder) Signature() string {
+	n := d.Byte()
+	s := string(d.next(int(n)))
+	d.next(1)
+	return s
+}
+
+// variant decodes the header field values, which are all strings or uint32.
+func (d *Decoder) variant() any {
+	switch sig := d.Signature(); sig {
+	case "s", "o":
+		return d.String()
+	case "g":
+		return d.Signature()
+	case "u":
+		return d.Uint32()
+	default:
+		d.err = fmt.Errorf("dbus: unsupported header field type %q", sig)
+		return nil
+	}
+}
+
+// Message is a D-Bus message. The header fields are strings, except for
+// FieldReplySerial and FieldUnixFDs which are uint32.
+type Message struct {
+	Type   byte
+	Serial uint32
+	Fields map[byte]any
+	Body   []byte
+	FDs    []int
+}
+
+// Field returns the string header field code
+func (m *Message) Field(code byte) string {
+	s, _ := m.Fields[code].(string)
+	return s
+}
+
+func (m *Message) Marshal() []byte {
+	var fields Encoder
+	for _, code := range []byte{FieldPath, FieldInterface, FieldMember, FieldErrorName, FieldReplySerial, FieldDestination, FieldSender, FieldSignature, FieldUnixFDs} {
+		v, ok := m.Fields[code]
+		if !ok {
+			continue
+		}
+		// fields in the header start at offset 16, which is 8 aligned
+		fields.Align(8)
+		fields.Byte(code)
+		switch code {
+		case FieldPath:
+			fields.Signature("o")
+			fields.String(v.(string))
+		case FieldSignature:
+			fields.Signature("g")
+			fields.Signature(v.(string))
+		case FieldReplySerial, FieldUnixFDs:
+			fields.Signature("u")
+			fields.Uint32(v.(uint32))
+		default:
+			fields.Signature("s")
+			fields.String(v.(string))
+		}
+	}
+	e := Encoder{b: []byte{'l', m.Type, 0, 1}}
+	e.Uint32(uint32(len(m.Body)))
+	e.Uint32(m.Serial)
+	e.Uint32(uint32(len(fields.b)))
+	e.b = append(e.b, fields.b...)
+	e.Align(8)
+	return append(e.b, m.Body...)
+}
+
+// MessageLen returns the length of the message starting with the 16 byte
+// header b.
+func MessageLen(b []byte) (int, error) {
+	if b[0] != 'l' {
+		return 0, errors.New("dbus: big endian messages are not supported")
+	}
+	bodyLen := order.Uint32(b[4:])
+	fieldsLen := order.Uint32(b[12:])
+	if bodyLen > MaxMessage || fieldsLen > MaxMessage {
+		return 0, errors.New("dbus: message too large")
+	}
+	return (16+int(fieldsLen)+7)&^7 + int(bodyLen), nil
+}
+
+// ParseMessage decodes the message b, which is MessageLen long
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) < 16 {
+		return nil, errShortMessage
+	}
+	headerLen := (16 + int(order.Uint32(b[12:])) + 7) &^ 7
+	if headerLen > len(b) {
+		return nil, errShortMessage
+	}
+	d := &Decoder{b: b[:headerLen]}
+	m := &Message{Fields: map[byte]any{}}
+	d.next(1)
+	m.Type = d.Byte()
+	d.next(2)
+	d.Uint32()
+	m.Serial = d.Uint32()
+	end := 16 + int(d.Uint32())
+	for d.err == nil && d.off < end {
+		d.Align(8)
+		code := d.Byte()
+		m.Fields[code] = d.variant()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	m.Body = append([]byte(nil), b[headerLen:]...)
+	return m, nil
+}
+
+// Conn is a connection to a bus.
+type Conn struct {
+	c      *net.UnixConn
+	buf    []byte
+	fds    []int
+	serial uint32
+	// signals received while waiting for a reply
+	signals []*Message
+}
+
+func Dial(path string) (*Conn, error) {
+	c, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{c: c}, nil
+}
+
+// Auth authenticates as the user running the process and asks for file
+// descriptor passing, which tabrmd hands out the TPM connections with.
+func (c *Conn) Auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	r := bufio.NewReader(c.c)
+	for _, step := range []struct{ send, expect string }{
+		{"\x00AUTH EXTERNAL " + uid + "\r\n", "OK "},
+		{"NEGOTIATE_UNIX_FD\r\n", "AGREE_UNIX_FD"},
+	} {
+		if _, err := c.c.Write([]byte(step.send)); err != nil {
+			return err
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, step.expect) {
+			return fmt.Errorf("dbus: authentication failed: %s", strings.TrimSpace(line))
+		}
+	}
+	if r.Buffered() != 0 {
+		return errors.New("dbus: unexpected data after authentication")
+	}
+	_, err := c.c.Write([]byte("BEGIN\r\n"))
+	return err
+}
+
+// fill reads at least n bytes into buf, collecting passed file descriptors.
+func (c *Conn) fill(n int) error {
+	for len(c.buf) < n {
+		b := make([]byte, 4096)
+		oob := make([]byte, syscall.CmsgSpace(4*16))
+		bn, oobn, _, _, err := c.c.ReadMsgUnix(b, oob)
+		if err != nil {
+			return err
+		}
+		if oobn > 0 {
+			msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				return err
+			}
+			for _, m := range msgs {
+				fds, err := syscall.ParseUnixRights(&m)
+				if err != nil {
+					return err
+				}
+				c.fds = append(c.fds, fds...)
+			}
+		}
+		c.buf = append(c.buf, b[:bn]...)
+	}
+	return nil
+}
+
+func (c *Conn) read() (*Message, error) {
+	if err := c.fill(16); err != nil {
+		return nil, err
+	}
+	total, err := MessageLen(c.buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.fill(total); err != nil {
+		return nil, err
+	}
+	m, err := ParseMessage(c.buf[:total])
+	if err != nil {
+		return nil, err
+	}
+	c.buf = c.buf[total:]
+
+	if n, ok := m.Fields[FieldUnixFDs].(uint32); ok {
+		if int(n) > len(c.fds) {
+			return nil, errors.New("dbus: missing file descriptors")
+		}
+		m.FDs, c.fds = c.fds[:n], c.fds[n:]
+	}
+	return m, nil
+}
+
+// Signal returns the next signal received on the connection
+func (c *Conn) Signal() (*Message, error) {
+	for {
+		if len(c.signals) != 0 {
+			m := c.signals[0]
+			c.signals = c.signals[1:]
+			return m, nil
+		}
+		m, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if m.Type == MsgSignal {
+			return m, nil
+		}
+		for _, fd := range m.FDs {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// Call calls a method with the arguments body of signature and returns the
+// reply. Signals received in the meantime are kept for Signal.
+func (c *Conn) Call(dest, path, iface, member, signature string, body []byte) (*Message, error) {
+	c.serial++
+	m := &Message{
+		Type:   MsgMethodCall,
+		Serial: c.serial,
+		Fields: map[byte]any{
+			FieldPath:        path,
+			FieldInterface:   iface,
+			FieldMember:      member,
+			FieldDestination: dest,
+		},
+		Body: body,
+	}
+	if signature != "" {
+		m.Fields[FieldSignature] = signature
+	}
+	if _, err := c.c.Write(m.Marshal()); err != nil {
+		return nil, err
+	}
+	for {
+		rsp, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if serial, _ := rsp.Fields[FieldReplySerial].(uint32); serial != m.Serial {
+			for _, fd := range rsp.FDs {
+				syscall.Close(fd)
+			}
+			if rsp.Type == MsgSignal {
+				rsp.FDs = nil
+				c.signals = append(c.signals, rsp)
+			}
+			continue
+		}
+		if rsp.Type == MsgError {
+			msg := NewDecoder(rsp.Body).String()
+			return nil, fmt.Errorf("dbus: %s: %s", rsp.Field(FieldErrorName), msg)
+		}
+		return rsp, nil
+	}
+}
+
+// Hello registers the connection on the bus, and returns its unique name
+func (c *Conn) Hello() (string, error) {
+	rsp, err := c.Call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "", nil)
+	if err != nil {
+		return "", err
+	}
+	return NewDecoder(rsp.Body).String(), nil
+}
+
+func (c *Conn) Close() error {
+	for _, fd := range c.fds {
+		syscall.Close(fd)
+	}
+	return c.c.Close()
+}
@@ -0,0 +1,22 @@
+package dbus
+
+import "testing"
+
+func TestBusAddress(t *testing.T) {
+	for _, c := range []struct{ addr, path string }{
+		{"unix:path=/run/user/1000/bus", "/run/user/1000/bus"},
+		{"tcp:host=localhost;unix:abstract=/tmp/dbus-x,guid=1", "@/tmp/dbus-x"},
+		{"unix:path=/tmp/a%20b", "/tmp/a b"},
+	} {
+		path, err := BusAddress(c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != c.path {
+			t.Fatalf("%s: got %q, want %q", c.addr, path, c.path)
+		}
+	}
+	if _, err := BusAddress("tcp:host=localhost"); err == nil {
+		t.Fatal("expected an error without a unix address")
+	}
+}
@@ -0,0 +1,4 @@
+// Package integration tests the ssh-tpm-agent binaries together with swtpm
+// and the OpenSSH client. The tests are skipped when swtpm, swtpm_setup, ssh
+// or ssh-add are missing.
+package integration
@@ -0,0 +1,404 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	swtpm "github.com/foxboron/swtpm_test"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	binDir   string
+	build    sync.Once
+	buildErr error
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "ssh-tpm-agent-integration")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// buildBinaries builds the programs under test once for all tests
+func buildBinaries() error {
+	build.Do(func() {
+		cmd := exec.Command("go", "build", "-o", binDir,
+			"github.com/foxboron/ssh-tpm-agent/cmd/ssh-tpm-agent",
+			"github.com/foxboron/ssh-tpm-agent/cmd/ssh-tpm-keygen",
+			"github.com/foxboron/ssh-tpm-agent/cmd/ssh-tpm-add",
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			buildErr = fmt.Errorf("%w: %s", err, out)
+		}
+	})
+	return buildErr
+}
+
+// env is a home directory with its own swtpm, and an agent once started
+type env struct {
+	dir    string
+	home   string
+	socket string
+	vars   []string
+}
+
+func newEnv(t *testing.T) *env {
+	t.Helper()
+	for _, program := range []string{"swtpm", "swtpm_setup", "ssh", "ssh-add"} {
+		if _, err := exec.LookPath(program); err != nil {
+			t.Skipf("%s is not installed", program)
+		}
+	}
+	if err := buildBinaries(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	tpm := swtpm.NewSwtpm(filepath.Join(dir, "tpm"))
+	if err := os.Mkdir(tpm.Tpmstate, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	tpmSocket, err := tpm.Socket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tpm.Close() })
+
+	e := &env{
+		dir:    dir,
+		home:   filepath.Join(dir, "home"),
+		socket: filepath.Join(dir, "agent.sock"),
+	}
+	if err := os.MkdirAll(filepath.Join(e.home, ".ssh"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every prompt is answered by askpass with the contents of the pin file
+	askpass := filepath.Join(dir, "askpass")
+	script := fmt.Sprintf("#!/bin/sh\ncat %q\n", filepath.Join(dir, "pin"))
+	if err := os.WriteFile(askpass, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	e.setPin(t, "")
+
+	e.vars = append(os.Environ(),
+		"HOME="+e.home,
+		"XDG_CONFIG_HOME="+filepath.Join(e.home, ".config"),
+		"XDG_STATE_HOME="+filepath.Join(e.home, ".local", "state"),
+		"XDG_RUNTIME_DIR="+dir,
+		"SSH_AUTH_SOCK="+e.socket,
+		"SSH_TPM_TCTI=swtpm:path="+tpmSocket,
+		"SSH_ASKPASS="+askpass,
+		"SSH_ASKPASS_REQUIRE=force",
+	)
+	return e
+}
+
+// setPin sets the answer of the askpass prompts
+func (e *env) setPin(t *testing.T, pin string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(e.dir, "pin"), []byte(pin+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *env) command(name string, args ...string) *exec.Cmd {
+	if _, err := os.Stat(filepath.Join(binDir, name)); err == nil {
+		name = filepath.Join(binDir, name)
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Env = e.vars
+	cmd.Dir = e.home
+	return cmd
+}
+
+// run runs a program with the environment, and returns its output
+func (e *env) run(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	out, err := e.command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// keygen creates a key in ~/.ssh with ssh-tpm-keygen
+func (e *env) keygen(t *testing.T, name string, args ...string) ssh.PublicKey {
+	t.Helper()
+	file := filepath.Join(e.home, ".ssh", name)
+	e.run(t, "ssh-tpm-keygen", append([]string{"-C", name, "-f", file}, args...)...)
+	return e.publicKey(t, file)
+}
+
+func (e *env) publicKey(t *testing.T, file string) ssh.PublicKey {
+	t.Helper()
+	b, err := os.ReadFile(file + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+// startAgent runs ssh-tpm-agent on the socket of the environment until the
+// test ends
+func (e *env) startAgent(t *testing.T) {
+	t.Helper()
+	var logs bytes.Buffer
+	cmd := e.command("ssh-tpm-agent", "-d", "-l", e.socket)
+	cmd.Stdout = &logs
+	cmd.Stderr = &logs
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+		if t.Failed() {
+			t.Logf("ssh-tpm-agent:\n%s", logs.String())
+		}
+	})
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		select {
+		case <-exited:
+			t.Fatalf("ssh-tpm-agent exited:\n%s", logs.String())
+		default:
+		}
+		if conn, err := net.Dial("unix", e.socket); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	t.Fatal("ssh-tpm-agent didn't start listening")
+}
+
+// sshServer accepts public key authentication with keys on a local port,
+// and runs every command successfully.
+func sshServer(t *testing.T, keys ...ssh.PublicKey) string {
+	t.Helper()
+	authorized := map[string]bool{}
+	for _, k := range keys {
+		authorized[string(k.Marshal())] = true
+	}
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromSigner(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, pk ssh.PublicKey) (*ssh.Permissions, error) {
+			if authorized[string(pk.Marshal())] {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %q", c.User())
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "exec" || req.Type == "env"
+				req.Reply(ok, nil)
+				if req.Type == "exec" {
+					status := binary.BigEndian.AppendUint32(nil, 0)
+					channel.SendRequest("exit-status", false, status)
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+// login runs true on the server with OpenSSH, authenticating with the key in
+// the agent matching the public key file.
+func (e *env) login(t *testing.T, port, pubFile string) {
+	t.Helper()
+	e.run(t, "ssh",
+		"-F", "/dev/null",
+		"-p", port,
+		"-i", pubFile,
+		"-o", "IdentitiesOnly=yes",
+		"-o", "IdentityAgent="+e.socket,
+		"-o", "BatchMode=yes",
+		"-o", "PreferredAuthentications=publickey",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+		"test@127.0.0.1", "true",
+	)
+}
+
+func TestAgent(t *testing.T) {
+	e := newEnv(t)
+
+	cases := []struct {
+		name string
+		pin  string
+		args []string
+	}{
+		{"ecdsa", "", []string{"-t", "ecdsa"}},
+		{"rsa", "", []string{"-t", "rsa"}},
+		{"pin", "1234", []string{"-t", "ecdsa", "-N", "1234"}},
+		{"policy", "", []string{"-t", "ecdsa", "--bind-secureboot"}},
+	}
+	var keys []ssh.PublicKey
+	for _, c := range cases {
+		e.setPin(t, c.pin)
+		keys = append(keys, e.keygen(t, c.name, c.args...))
+	}
+
+	e.startAgent(t)
+	out := e.run(t, "ssh-add", "-l")
+	for i, c := range cases {
+		fp := ssh.FingerprintSHA256(keys[i])
+		if !strings.Contains(out, fp+" "+c.name) {
+			t.Fatalf("ssh-add -l doesn't list the %s key %s:\n%s", c.name, fp, out)
+		}
+	}
+
+	port := sshServer(t, keys...)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e.setPin(t, c.pin)
+			e.login(t, port, filepath.Join(e.home, ".ssh", c.name+".pub"))
+		})
+	}
+}
+
+func TestCreateThroughAgent(t *testing.T) {
+	e := newEnv(t)
+	e.startAgent(t)
+
+	file := filepath.Join(e.dir, "created")
+	e.setPin(t, "5678")
+	e.run(t, "ssh-tpm-add", "--create", "ecdsa", "-C", "created", "-f", file)
+	pk := e.publicKey(t, file)
+
+	out := e.run(t, "ssh-add", "-l")
+	if !strings.Contains(out, ssh.FingerprintSHA256(pk)) {
+		t.Fatalf("created key wasn't added:\n%s", out)
+	}
+	e.login(t, sshServer(t, pk), file+".pub")
+}
+
+func TestChangePin(t *testing.T) {
+	e := newEnv(t)
+
+	e.setPin(t, "1234")
+	pk := e.keygen(t, "changed", "-t", "ecdsa", "-N", "1234")
+	file := filepath.Join(e.home, ".ssh", "changed.tpm")
+	e.run(t, "ssh-tpm-keygen", "--change-pin", file, "-N", "5678")
+	if pub := e.publicKey(t, filepath.Join(e.home, ".ssh", "changed")); !bytes.Equal(pub.Marshal(), pk.Marshal()) {
+		t.Fatal("the public key changed with the pin")
+	}
+	if _, err := os.Stat(file + ".bak"); !os.IsNotExist(err) {
+		t.Fatal("kept the key file with the old pin")
+	}
+	if out, err := e.command("ssh-tpm-keygen", "--change-pin", file, "-N", "0000").CombinedOutput(); err == nil {
+		t.Fatalf("the old pin still changed the pin:\n%s", out)
+	}
+
+	e.startAgent(t)
+	e.setPin(t, "5678")
+	e.login(t, sshServer(t, pk), filepath.Join(e.home, ".ssh", "changed.pub"))
+}
+
+func TestConvert(t *testing.T) {
+	e := newEnv(t)
+
+	e.setPin(t, "1234")
+	pk := e.keygen(t, "original", "-t", "ecdsa", "-N", "1234")
+	original := filepath.Join(e.home, ".ssh", "original.tpm")
+	tss2 := filepath.Join(e.dir, "original.pem")
+	e.run(t, "ssh-tpm-keygen", "-f", original, "--convert", "tss2", "--output", tss2)
+	b, err := os.ReadFile(tss2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("-----BEGIN TSS2 PRIVATE KEY-----")) {
+		t.Fatalf("not a TSS2 key:\n%s", b)
+	}
+
+	pair := filepath.Join(e.dir, "tools.priv")
+	e.run(t, "ssh-tpm-keygen", "-f", tss2, "--convert", "tpm2-tools", "--output", pair)
+	converted := filepath.Join(e.home, ".ssh", "converted")
+	e.run(t, "ssh-tpm-keygen", "-f", pair, "-C", "converted", "--convert", "native", "--output", converted)
+	if !bytes.Equal(e.publicKey(t, converted).Marshal(), pk.Marshal()) {
+		t.Fatal("converted a different key")
+	}
+
+	if err := os.Remove(original); err != nil {
+		t.Fatal(err)
+	}
+	e.startAgent(t)
+	e.login(t, sshServer(t, pk), converted+".pub")
+}
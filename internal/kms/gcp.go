@@ -0,0 +1,278 @@
+// Package kms serves asymmetric signing keys of Google Cloud KMS through the
+// agent, as an agent.Provider. It uses the Cloud KMS REST API, the private
+// keys never leave KMS.
+package kms
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	DefaultEndpoint = "https://cloudkms.googleapis.com/v1/"
+
+	requestTimeout = 30 * time.Second
+
+	// gcloud access tokens are valid for an hour
+	tokenLifetime = 30 * time.Minute
+)
+
+var ErrUnsupported = errors.New("kms keys can't be added or removed")
+
+// algorithm is how a KMS algorithm signs for SSH
+type algorithm struct {
+	hash   crypto.Hash
+	digest string
+	format string
+}
+
+var algorithms = map[string]algorithm{
+	"EC_SIGN_P256_SHA256":        {crypto.SHA256, "sha256", ssh.KeyAlgoECDSA256},
+	"EC_SIGN_P384_SHA384":        {crypto.SHA384, "sha384", ssh.KeyAlgoECDSA384},
+	"RSA_SIGN_PKCS1_2048_SHA256": {crypto.SHA256, "sha256", ssh.KeyAlgoRSASHA256},
+	"RSA_SIGN_PKCS1_3072_SHA256": {crypto.SHA256, "sha256", ssh.KeyAlgoRSASHA256},
+	"RSA_SIGN_PKCS1_4096_SHA256": {crypto.SHA256, "sha256", ssh.KeyAlgoRSASHA256},
+	"RSA_SIGN_PKCS1_4096_SHA512": {crypto.SHA512, "sha512", ssh.KeyAlgoRSASHA512},
+}
+
+type gcpKey struct {
+	name string
+	pub  ssh.PublicKey
+	alg  algorithm
+}
+
+// GCP is a provider of Cloud KMS key versions, named like
+// projects/P/locations/L/keyRings/R/cryptoKeys/K/cryptoKeyVersions/V. The
+// public keys are fetched when the keys are first listed, keys which can't be
+// fetched are left out until the next time.
+type GCP struct {
+	Names []string
+
+	// Token returns the OAuth access token for the API, by default
+	// GOOGLE_OAUTH_ACCESS_TOKEN or gcloud auth print-access-token
+	Token    func() (string, error)
+	Endpoint string
+	Client   *http.Client
+
+	mu   sync.Mutex
+	keys map[string]*gcpKey
+}
+
+// NewGCP returns the provider of the key versions names
+func NewGCP(names []string) *GCP {
+	return &GCP{
+		Names:    names,
+		Token:    gcloudToken(),
+		Endpoint: DefaultEndpoint,
+		Client:   &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// gcloudToken returns the access token of the environment, or asks gcloud
+// for one and keeps it for tokenLifetime
+func gcloudToken() func() (string, error) {
+	var (
+		mu      sync.Mutex
+		token   string
+		fetched time.Time
+	)
+	return func() (string, error) {
+		if t := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); t != "" {
+			return t, nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if token != "" && time.Since(fetched) < tokenLifetime {
+			return token, nil
+		}
+		out, err := exec.Command("gcloud", "auth", "print-access-token").Output()
+		if err != nil {
+			return "", fmt.Errorf("gcloud auth print-access-token: %w", err)
+		}
+		token, fetched = strings.TrimSpace(string(out)), time.Now()
+		return token, nil
+	}
+}
+
+// call sends body to the API method of name, and decodes the response to v
+func (g *GCP) call(name, method string, body, v any) error {
+	token, err := g.Token()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	hmethod, url := http.MethodGet, g.Endpoint+name+"/"+method
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		hmethod, url, r = http.MethodPost, g.Endpoint+name+":"+method, bytes.NewReader(b)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, hmethod, url, r)
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		hreq.Header.Set("Content-Type", "application/json")
+	}
+	rsp, err := g.Client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("kms %s of %s: %s: %s", method, name, rsp.Status, bytes.TrimSpace(msg))
+	}
+	if err := json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("malformed kms response: %w", err)
+	}
+	return nil
+}
+
+func (g *GCP) fetch(name string) (*gcpKey, error) {
+	var rsp struct {
+		Pem       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := g.call(name, "publicKey", nil, &rsp); err != nil {
+		return nil, err
+	}
+	alg, ok := algorithms[rsp.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("kms key %s has the unsupported algorithm %s", name, rsp.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(rsp.Pem))
+	if block == nil {
+		return nil, fmt.Errorf("kms key %s has no pem public key", name)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpKey{name: name, pub: pk, alg: alg}, nil
+}
+
+// loaded returns the keys, fetching the ones which weren't yet
+func (g *GCP) loaded() []*gcpKey {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.keys == nil {
+		g.keys = map[string]*gcpKey{}
+	}
+	var keys []*gcpKey
+	for _, name := range g.Names {
+		k, ok := g.keys[name]
+		if !ok {
+			var err error
+			if k, err = g.fetch(name); err != nil {
+				slog.Info("failed fetching kms key", slog.String("key", name), slog.String("error", err.Error()))
+				continue
+			}
+			g.keys[name] = k
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (g *GCP) List() ([]*agent.Key, error) {
+	var keys []*agent.Key
+	for _, k := range g.loaded() {
+		keys = append(keys, &agent.Key{
+			Format:  k.pub.Type(),
+			Blob:    k.pub.Marshal(),
+			Comment: k.name,
+		})
+	}
+	return keys, nil
+}
+
+func (g *GCP) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	var k *gcpKey
+	for _, kk := range g.loaded() {
+		if bytes.Equal(kk.pub.Marshal(), key.Marshal()) {
+			k = kk
+		}
+	}
+	if k == nil {
+		return nil, fmt.Errorf("no kms key matches the requested public key")
+	}
+
+	// KMS RSA keys sign with a single hash
+	switch k.alg.format {
+	case ssh.KeyAlgoRSASHA256:
+		if flags&agent.SignatureFlagRsaSha256 == 0 {
+			return nil, fmt.Errorf("kms key %s only signs with %s", k.name, k.alg.format)
+		}
+	case ssh.KeyAlgoRSASHA512:
+		if flags&agent.SignatureFlagRsaSha512 == 0 {
+			return nil, fmt.Errorf("kms key %s only signs with %s", k.name, k.alg.format)
+		}
+	}
+
+	h := k.alg.hash.New()
+	h.Write(data)
+	req := map[string]any{
+		"digest": map[string][]byte{k.alg.digest: h.Sum(nil)},
+	}
+	var rsp struct {
+		Signature string `json:"signature"`
+	}
+	if err := g.call(k.name, "asymmetricSign", req, &rsp); err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(rsp.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("malformed kms signature: %w", err)
+	}
+
+	if k.pub.Type() == ssh.KeyAlgoRSA {
+		return &ssh.Signature{Format: k.alg.format, Blob: sig}, nil
+	}
+	// KMS returns DER ECDSA signatures, SSH wants the two integers
+	var ecSig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(sig, &ecSig); err != nil {
+		return nil, fmt.Errorf("malformed kms signature: %w", err)
+	}
+	return &ssh.Signature{Format: k.alg.format, Blob: ssh.Marshal(ecSig)}, nil
+}
+
+func (g *GCP) Add(agent.AddedKey) error {
+	return ErrUnsupported
+}
+
+func (g *GCP) Remove(ssh.PublicKey) error {
+	return ErrUnsupported
+}
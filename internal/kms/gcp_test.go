@@ -0,0 +1,124 @@
+package kms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// fakeKMS serves the publicKey and asymmetricSign methods for signers
+func fakeKMS(t *testing.T, signers map[string]crypto.Signer, algorithms map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+		if name, ok := strings.CutSuffix(path, "/publicKey"); ok {
+			s, ok := signers[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			der, err := x509.MarshalPKIXPublicKey(s.Public())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{
+				"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+				"algorithm": algorithms[name],
+			})
+			return
+		}
+		name, _ := strings.CutSuffix(path, ":asymmetricSign")
+		var req struct {
+			Digest map[string][]byte `json:"digest"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+			return
+		}
+		var digest []byte
+		var hash crypto.Hash
+		for alg, d := range req.Digest {
+			digest = d
+			hash = map[string]crypto.Hash{"sha256": crypto.SHA256, "sha384": crypto.SHA384, "sha512": crypto.SHA512}[alg]
+		}
+		sig, err := signers[name].Sign(rand.Reader, digest, hash)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]byte{"signature": sig})
+	}))
+}
+
+func TestGCP(t *testing.T) {
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		ecName  = "projects/p/locations/global/keyRings/r/cryptoKeys/ec/cryptoKeyVersions/1"
+		rsaName = "projects/p/locations/global/keyRings/r/cryptoKeys/rsa/cryptoKeyVersions/1"
+	)
+	srv := fakeKMS(t,
+		map[string]crypto.Signer{ecName: ec, rsaName: rk},
+		map[string]string{ecName: "EC_SIGN_P256_SHA256", rsaName: "RSA_SIGN_PKCS1_2048_SHA256"})
+	defer srv.Close()
+
+	g := NewGCP([]string{ecName, rsaName, "projects/p/missing"})
+	g.Endpoint = srv.URL + "/v1/"
+	g.Token = func() (string, error) { return "token", nil }
+
+	keys, err := g.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Comment != ecName || keys[1].Comment != rsaName {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	data := []byte("data")
+	for _, c := range []struct {
+		key   *agent.Key
+		flags agent.SignatureFlags
+	}{
+		{keys[0], 0},
+		{keys[1], agent.SignatureFlagRsaSha256},
+	} {
+		pk, err := ssh.ParsePublicKey(c.key.Blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := g.SignWithFlags(pk, data, c.flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pk.Verify(data, sig); err != nil {
+			t.Fatalf("%s: %v", c.key.Comment, err)
+		}
+	}
+
+	pk, _ := ssh.ParsePublicKey(keys[1].Blob)
+	if _, err := g.SignWithFlags(pk, data, agent.SignatureFlagRsaSha512); err == nil {
+		t.Fatal("signed with rsa-sha2-512 using a sha256 key")
+	}
+}
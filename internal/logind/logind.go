@@ -0,0 +1,159 @@
+// Package logind follows the Lock and Unlock signals systemd-logind sends to
+// the sessions of the user, when the screen is locked and unlocked.
+package logind
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/foxboron/ssh-tpm-agent/internal/dbus"
+)
+
+const (
+	busName        = "org.freedesktop.login1"
+	managerPath    = "/org/freedesktop/login1"
+	managerIface   = "org.freedesktop.login1.Manager"
+	sessionIface   = "org.freedesktop.login1.Session"
+	busDaemon      = "org.freedesktop.DBus"
+	busDaemonPath  = "/org/freedesktop/DBus"
+	busDaemonIface = "org.freedesktop.DBus"
+)
+
+// Event is a signal of a session of the user
+type Event int
+
+const (
+	Lock Event = iota
+	Unlock
+)
+
+func (e Event) String() string {
+	if e == Lock {
+		return "lock"
+	}
+	return "unlock"
+}
+
+// Watcher receives the Lock and Unlock signals of the sessions of the user
+type Watcher struct {
+	conn *dbus.Conn
+	// unique bus name of logind, the only sender signals are accepted from
+	owner string
+	uid   uint32
+	// object paths of the sessions of the user
+	sessions map[string]bool
+}
+
+// Watch connects to the system bus and subscribes to the signals of the
+// sessions
+func Watch() (*Watcher, error) {
+	path, err := dbus.SystemBusAddress()
+	if err != nil {
+		return nil, fmt.Errorf("logind: %w", err)
+	}
+	c, err := dbus.Dial(path)
+	if err != nil {
+		return nil, fmt.Errorf("logind: %w", err)
+	}
+	w, err := watch(c, uint32(os.Getuid()))
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("logind: %w", err)
+	}
+	return w, nil
+}
+
+func watch(c *dbus.Conn, uid uint32) (*Watcher, error) {
+	if err := c.Auth(); err != nil {
+		return nil, err
+	}
+	if _, err := c.Hello(); err != nil {
+		return nil, err
+	}
+	var e dbus.Encoder
+	e.String(fmt.Sprintf("type='signal',sender='%s',interface='%s'", busName, sessionIface))
+	if _, err := c.Call(busDaemon, busDaemonPath, busDaemonIface, "AddMatch", "s", e.Bytes()); err != nil {
+		return nil, err
+	}
+	e = dbus.Encoder{}
+	e.String(busName)
+	rsp, err := c.Call(busDaemon, busDaemonPath, busDaemonIface, "GetNameOwner", "s", e.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{conn: c, owner: dbus.NewDecoder(rsp.Body).String(), uid: uid}
+	if err := w.listSessions(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// listSessions finds the sessions of the user with ListSessions, which
+// returns an array of (id, uid, user, seat, path).
+func (w *Watcher) listSessions() error {
+	rsp, err := w.conn.Call(busName, managerPath, managerIface, "ListSessions", "", nil)
+	if err != nil {
+		return err
+	}
+	if sig := rsp.Field(dbus.FieldSignature); sig != "a(susso)" {
+		return fmt.Errorf("unexpected ListSessions reply %q", sig)
+	}
+	d := dbus.NewDecoder(rsp.Body)
+	n := int(d.Uint32())
+	d.Align(8)
+	end := d.Offset() + n
+	sessions := map[string]bool{}
+	for d.Err() == nil && d.Offset() < end {
+		d.Align(8)
+		_ = d.String() // id
+		uid := d.Uint32()
+		_ = d.String() // user
+		_ = d.String() // seat
+		path := d.String()
+		if uid == w.uid {
+			sessions[path] = true
+		}
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+	w.sessions = sessions
+	return nil
+}
+
+// Next returns the next Lock or Unlock signal of a session of the user
+func (w *Watcher) Next() (Event, error) {
+	for {
+		m, err := w.conn.Signal()
+		if err != nil {
+			return 0, fmt.Errorf("logind: %w", err)
+		}
+		if m.Field(dbus.FieldSender) != w.owner || m.Field(dbus.FieldInterface) != sessionIface {
+			continue
+		}
+		var ev Event
+		switch m.Field(dbus.FieldMember) {
+		case "Lock":
+			ev = Lock
+		case "Unlock":
+			ev = Unlock
+		default:
+			continue
+		}
+		path := m.Field(dbus.FieldPath)
+		if !w.sessions[path] {
+			// the session might have started after the last list
+			if err := w.listSessions(); err != nil {
+				return 0, fmt.Errorf("logind: %w", err)
+			}
+			if !w.sessions[path] {
+				continue
+			}
+		}
+		return ev, nil
+	}
+}
+
+func (w *Watcher) Close() error {
+	return w.conn.Close()
+}
@@ -0,0 +1,170 @@
+package logind
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/internal/dbus"
+)
+
+type session struct {
+	uid  uint32
+	path string
+}
+
+// fakeBus answers like the bus and logind, with the sessions returned by
+// sessions, and sends signal after the first ListSessions.
+func fakeBus(t *testing.T, c *net.UnixConn, sessions func() []session, signals []*dbus.Message) {
+	r := bufio.NewReader(c)
+	for _, reply := range []string{"OK 1234\r\n", "AGREE_UNIX_FD\r\n", ""} {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Error(err)
+			return
+		}
+		if reply == "" {
+			break
+		}
+		c.Write([]byte(reply))
+	}
+
+	for serial := uint32(1); ; serial++ {
+		hdr := make([]byte, 16)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return
+		}
+		n := (16+int(binary.LittleEndian.Uint32(hdr[12:]))+7)&^7 + int(binary.LittleEndian.Uint32(hdr[4:]))
+		b := make([]byte, n)
+		copy(b, hdr)
+		if _, err := io.ReadFull(r, b[16:]); err != nil {
+			t.Error(err)
+			return
+		}
+		m, err := dbus.ParseMessage(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		rsp := &dbus.Message{Type: dbus.MsgMethodReturn, Serial: serial, Fields: map[byte]any{dbus.FieldReplySerial: m.Serial}}
+		var e dbus.Encoder
+		switch m.Field(dbus.FieldMember) {
+		case "Hello":
+			e.String(":1.2")
+			rsp.Fields[dbus.FieldSignature] = "s"
+		case "AddMatch":
+			if m.Field(dbus.FieldSignature) != "s" {
+				t.Errorf("AddMatch with signature %q", m.Field(dbus.FieldSignature))
+			}
+		case "GetNameOwner":
+			e.String(":1.1")
+			rsp.Fields[dbus.FieldSignature] = "s"
+		case "ListSessions":
+			var elems dbus.Encoder
+			for _, s := range sessions() {
+				elems.Align(8)
+				elems.String("1")
+				elems.Uint32(s.uid)
+				elems.String("user")
+				elems.String("seat0")
+				elems.String(s.path)
+			}
+			e.Uint32(uint32(len(elems.Bytes())))
+			e.Align(8)
+			rsp.Body = elems.Bytes()
+			rsp.Fields[dbus.FieldSignature] = "a(susso)"
+		default:
+			rsp.Type = dbus.MsgError
+			rsp.Fields[dbus.FieldErrorName] = "org.freedesktop.DBus.Error.UnknownMethod"
+		}
+		rsp.Body = append(e.Bytes(), rsp.Body...)
+		if _, err := c.Write(rsp.Marshal()); err != nil {
+			t.Error(err)
+			return
+		}
+		if m.Field(dbus.FieldMember) == "ListSessions" {
+			for _, sig := range signals {
+				c.Write(sig.Marshal())
+			}
+			signals = nil
+		}
+	}
+}
+
+func signal(sender, path, member string) *dbus.Message {
+	return &dbus.Message{
+		Type:   dbus.MsgSignal,
+		Serial: 1000,
+		Fields: map[byte]any{
+			dbus.FieldSender:    sender,
+			dbus.FieldPath:      path,
+			dbus.FieldInterface: sessionIface,
+			dbus.FieldMember:    member,
+		},
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	const (
+		mine  = "/org/freedesktop/login1/session/_31"
+		later = "/org/freedesktop/login1/session/_32"
+		other = "/org/freedesktop/login1/session/_33"
+	)
+	var listed atomic.Int32
+	sessions := func() []session {
+		s := []session{{1000, mine}, {1001, other}}
+		if listed.Add(1) > 1 {
+			s = append(s, session{1000, later})
+		}
+		return s
+	}
+	signals := []*dbus.Message{
+		signal(":1.3", mine, "Unlock"),
+		signal(":1.1", other, "Lock"),
+		signal(":1.1", mine, "PauseDevice"),
+		signal(":1.1", mine, "Lock"),
+		signal(":1.1", later, "Unlock"),
+	}
+
+	path := filepath.Join(t.TempDir(), "bus")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fakeBus(t, c, sessions, signals)
+	}()
+
+	c, err := dbus.Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := watch(c, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, want := range []Event{Lock, Unlock} {
+		ev, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev != want {
+			t.Fatalf("got %s, want %s", ev, want)
+		}
+	}
+	if n := listed.Load(); n != 2 {
+		t.Fatalf("expected the sessions to be listed again for a new session, listed %d times", n)
+	}
+}
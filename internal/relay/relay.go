@@ -0,0 +1,127 @@
+// Package relay forwards raw TPM commands over a byte stream. It is used to
+// reach the Windows TPM from inside WSL, where no TPM device is exposed to the
+// Linux VM.
+//
+// Every command and response is sent as a big-endian uint32 length followed
+// by the bytes of the TPM command or response.
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// MaxFrame is the largest command or response accepted. TPM buffers are a
+// few kilobytes, anything bigger is a broken stream.
+const MaxFrame = 64 * 1024
+
+var ErrFrameTooLarge = errors.New("relay: frame too large")
+
+func WriteFrame(w io.Writer, b []byte) error {
+	if len(b) > MaxFrame {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > MaxFrame {
+		return nil, ErrFrameTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Serve reads commands from r, runs them on tpm and writes the responses to
+// w until r is closed.
+func Serve(tpm transport.TPM, r io.Reader, w io.Writer) error {
+	for {
+		cmd, err := ReadFrame(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rsp, err := tpm.Send(cmd)
+		if err != nil {
+			return fmt.Errorf("relay: %w", err)
+		}
+		if err := WriteFrame(w, rsp); err != nil {
+			return err
+		}
+	}
+}
+
+// TPM is a transport.TPMCloser sending the commands to a relay.
+type TPM struct {
+	mu    sync.Mutex
+	w     io.Writer
+	r     io.Reader
+	close func() error
+}
+
+// New returns a TPM talking to a relay on the other end of r and w. close is
+// called by Close.
+func New(r io.Reader, w io.Writer, close func() error) *TPM {
+	return &TPM{r: r, w: w, close: close}
+}
+
+// Open starts program and relays the commands over its stdin and stdout.
+// Under WSL program is usually the path to ssh-tpm-relay.exe on the Windows
+// side, which is run through the WSL interop.
+func Open(program string, args ...string) (*TPM, error) {
+	cmd := exec.Command(program, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("relay: starting %s: %w", program, err)
+	}
+	return New(stdout, stdin, func() error {
+		stdin.Close()
+		return cmd.Wait()
+	}), nil
+}
+
+func (t *TPM) Send(cmd []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := WriteFrame(t.w, cmd); err != nil {
+		return nil, fmt.Errorf("relay: %w", err)
+	}
+	rsp, err := ReadFrame(t.r)
+	if err != nil {
+		return nil, fmt.Errorf("relay: %w", err)
+	}
+	return rsp, nil
+}
+
+func (t *TPM) Close() error {
+	if t.close == nil {
+		return nil
+	}
+	return t.close()
+}
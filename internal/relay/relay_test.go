@@ -0,0 +1,55 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestRelay(t *testing.T) {
+	sim, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	cmdr, cmdw := io.Pipe()
+	rspr, rspw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(sim, cmdr, rspw)
+		rspw.Close()
+	}()
+
+	tpm := New(rspr, cmdw, cmdw.Close)
+
+	rsp, err := tpm2.GetRandom{BytesRequested: 16}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.RandomBytes.Buffer) != 16 {
+		t.Fatalf("got %d random bytes, want 16", len(rsp.RandomBytes.Buffer))
+	}
+
+	if err := tpm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, make([]byte, MaxFrame+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := ReadFrame(&buf); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+// Package tabrmd talks to the TPM through tpm2-abrmd, the userspace access
+// broker and resource manager of tpm2-tss, instead of the kernel device.
+//
+// A connection is requested over D-Bus with the CreateConnection method, which
+// returns a socket the raw TPM commands and responses are sent over. This
+// needs tpm2-abrmd 2.0 or newer.
+package tabrmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/foxboron/ssh-tpm-agent/internal/dbus"
+)
+
+const (
+	DefaultBusName = "com.intel.tss2.Tabrmd"
+
+	objectPath = "/com/intel/tss2/Tabrmd/Tcti"
+	iface      = "com.intel.tss2.TctiTabrmd"
+)
+
+type Bus int
+
+const (
+	SystemBus Bus = iota
+	SessionBus
+)
+
+// ParseBus parses the bus_type of the tabrmd TCTI.
+func ParseBus(s string) (Bus, error) {
+	switch s {
+	case "", "system":
+		return SystemBus, nil
+	case "session":
+		return SessionBus, nil
+	}
+	return 0, fmt.Errorf("tabrmd: unknown bus %q", s)
+}
+
+func (b Bus) address() (string, error) {
+	if b == SessionBus {
+		addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+		if addr == "" {
+			return "", errors.New("tabrmd: DBUS_SESSION_BUS_ADDRESS is not set")
+		}
+		return dbus.BusAddress(addr)
+	}
+	return dbus.SystemBusAddress()
+}
+
+// TPM is a transport.TPMCloser for a connection to tpm2-abrmd.
+type TPM struct {
+	mu  sync.Mutex
+	rw  io.ReadWriteCloser
+	bus *dbus.Conn
+}
+
+// Open connects to tpm2-abrmd owning name, DefaultBusName if empty, on bus.
+func Open(bus Bus, name string) (*TPM, error) {
+	if name == "" {
+		name = DefaultBusName
+	}
+	path, err := bus.address()
+	if err != nil {
+		return nil, err
+	}
+	c, err := dbus.Dial(path)
+	if err != nil {
+		return nil, fmt.Errorf("tabrmd: %w", err)
+	}
+	tpm, err := open(c, name)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("tabrmd: %w", err)
+	}
+	return tpm, nil
+}
+
+func open(c *dbus.Conn, name string) (*TPM, error) {
+	if err := c.Auth(); err != nil {
+		return nil, err
+	}
+	if _, err := c.Hello(); err != nil {
+		return nil, err
+	}
+	rsp, err := c.Call(name, objectPath, iface, "CreateConnection", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if sig := rsp.Field(dbus.FieldSignature); sig != "aht" {
+		for _, fd := range rsp.FDs {
+			syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("unexpected CreateConnection reply %q", sig)
+	}
+	d := dbus.NewDecoder(rsp.Body)
+	n := d.Uint32()
+	idx := make([]uint32, 0, n/4)
+	for i := uint32(0); i < n/4; i++ {
+		idx = append(idx, d.Uint32())
+	}
+	d.Uint64() // the connection id, only needed for Cancel and SetLocality
+	if d.Err() != nil || len(idx) != 1 || int(idx[0]) >= len(rsp.FDs) {
+		for _, fd := range rsp.FDs {
+			syscall.Close(fd)
+		}
+		return nil, errors.New("CreateConnection didn't return a connection")
+	}
+	for i, fd := range rsp.FDs {
+		if i != int(idx[0]) {
+			syscall.Close(fd)
+		}
+	}
+	return &TPM{
+		rw:  os.NewFile(uintptr(rsp.FDs[idx[0]]), "tabrmd"),
+		bus: c,
+	}, nil
+}
+
+func (t *TPM) Send(cmd []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.rw.Write(cmd); err != nil {
+		return nil, fmt.Errorf("tabrmd: %w", err)
+	}
+	rsp := make([]byte, 10)
+	if _, err := io.ReadFull(t.rw, rsp); err != nil {
+		return nil, fmt.Errorf("tabrmd: %w", err)
+	}
+	size := binary.BigEndian.Uint32(rsp[2:])
+	if size < 10 || size > dbus.MaxMessage {
+		return nil, fmt.Errorf("tabrmd: invalid response size %d", size)
+	}
+	rsp = append(rsp, make([]byte, size-10)...)
+	if _, err := io.ReadFull(t.rw, rsp[10:]); err != nil {
+		return nil, fmt.Errorf("tabrmd: %w", err)
+	}
+	return rsp, nil
+}
+
+func (t *TPM) Close() error {
+	err := t.rw.Close()
+	t.bus.Close()
+	return err
+}
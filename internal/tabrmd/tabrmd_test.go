@@ -0,0 +1,157 @@
+package tabrmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/internal/dbus"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+// fakeBus answers Hello and CreateConnection like the bus and tpm2-abrmd,
+// and serves the connection from tpm.
+func fakeBus(t *testing.T, c *net.UnixConn, tpm transport.TPM) {
+	r := bufio.NewReader(c)
+	for _, reply := range []string{"OK 1234\r\n", "AGREE_UNIX_FD\r\n", ""} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if reply == "" {
+			if line != "BEGIN\r\n" {
+				t.Errorf("expected BEGIN, got %q", line)
+			}
+			break
+		}
+		c.Write([]byte(reply))
+	}
+
+	for serial := uint32(1); ; serial++ {
+		hdr := make([]byte, 16)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return
+		}
+		n := (16+int(binary.LittleEndian.Uint32(hdr[12:]))+7)&^7 + int(binary.LittleEndian.Uint32(hdr[4:]))
+		b := make([]byte, n)
+		copy(b, hdr)
+		if _, err := io.ReadFull(r, b[16:]); err != nil {
+			t.Error(err)
+			return
+		}
+		m, err := dbus.ParseMessage(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		rsp := &dbus.Message{Type: dbus.MsgMethodReturn, Serial: serial, Fields: map[byte]any{dbus.FieldReplySerial: m.Serial}}
+		var oob []byte
+		passed := -1
+		switch m.Field(dbus.FieldMember) {
+		case "Hello":
+			var e dbus.Encoder
+			e.String(":1.1")
+			rsp.Fields[dbus.FieldSignature] = "s"
+			rsp.Body = e.Bytes()
+			// a signal before the reply, which is skipped
+			sig := &dbus.Message{Type: dbus.MsgSignal, Serial: 100, Fields: map[byte]any{dbus.FieldMember: "NameAcquired"}}
+			c.Write(sig.Marshal())
+		case "CreateConnection":
+			if m.Field(dbus.FieldDestination) != DefaultBusName || m.Field(dbus.FieldPath) != objectPath {
+				t.Errorf("CreateConnection sent to %s %s", m.Field(dbus.FieldDestination), m.Field(dbus.FieldPath))
+			}
+			fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			go serveTPM(os.NewFile(uintptr(fds[1]), "server"), tpm)
+			passed = fds[0]
+			oob = syscall.UnixRights(passed)
+			var e dbus.Encoder
+			e.Uint32(4)
+			e.Uint32(0)
+			e.Uint64(1)
+			rsp.Fields[dbus.FieldSignature] = "aht"
+			rsp.Fields[dbus.FieldUnixFDs] = uint32(1)
+			rsp.Body = e.Bytes()
+		default:
+			rsp.Type = dbus.MsgError
+			rsp.Fields[dbus.FieldErrorName] = "org.freedesktop.DBus.Error.UnknownMethod"
+		}
+		if _, _, err := c.WriteMsgUnix(rsp.Marshal(), oob, nil); err != nil {
+			t.Error(err)
+			return
+		}
+		if passed != -1 {
+			syscall.Close(passed)
+		}
+	}
+}
+
+func serveTPM(f *os.File, tpm transport.TPM) {
+	defer f.Close()
+	for {
+		cmd := make([]byte, 10)
+		if _, err := io.ReadFull(f, cmd); err != nil {
+			return
+		}
+		cmd = append(cmd, make([]byte, binary.BigEndian.Uint32(cmd[2:])-10)...)
+		if _, err := io.ReadFull(f, cmd[10:]); err != nil {
+			return
+		}
+		rsp, err := tpm.Send(cmd)
+		if err != nil {
+			return
+		}
+		f.Write(rsp)
+	}
+}
+
+func TestTabrmd(t *testing.T) {
+	sim, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	path := filepath.Join(t.TempDir(), "bus")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fakeBus(t, c, sim)
+	}()
+
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "unix:path="+strings.ReplaceAll(path, "/", "%2f"))
+	tpm, err := Open(SystemBus, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	rsp, err := tpm2.GetRandom{BytesRequested: 16}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.RandomBytes.Buffer) != 16 {
+		t.Fatalf("got %d random bytes, want 16", len(rsp.RandomBytes.Buffer))
+	}
+}
@@ -0,0 +1,117 @@
+package key
+
+import (
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/go-tpm-keyfiles/template"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var ErrNoApprover = errors.New("key needs an external approval, but there is no approver")
+
+// Keys created with CreateOptions.Approver have a PolicySigned policy, with the
+// TPM2B_PUBLIC of the approver and the TPM2B_DIGEST policy reference as the
+// command policy, followed by a PolicyAuthValue so the passphrase of the key
+// is still needed.
+
+// approvePolicy returns the policy for keys approved by pk and its digest.
+func approvePolicy(pk crypto.PublicKey) ([]*keyfile.TPMPolicy, []byte, error) {
+	pub, err := authorizerPublic(pk)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, err := tpm2.ObjectName(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	calc, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed := tpm2.PolicySigned{AuthObject: tpm2.NamedHandle{Name: *name}}
+	if err := signed.Update(calc); err != nil {
+		return nil, nil, err
+	}
+	if err := (tpm2.PolicyAuthValue{}).Update(calc); err != nil {
+		return nil, nil, err
+	}
+	return []*keyfile.TPMPolicy{
+		{
+			CommandCode:   int(tpm2.TPMCCPolicySigned),
+			CommandPolicy: append(tpm2.Marshal(tpm2.New2B(*pub)), tpm2.Marshal(signed.PolicyRef)...),
+		},
+		{CommandCode: int(tpm2.TPMCCPolicyAuthValue)},
+	}, calc.Hash().Digest, nil
+}
+
+// NeedsApproval returns true if the key was created with
+// CreateOptions.Approver.
+func (k *SSHTPMKey) NeedsApproval() bool {
+	for _, p := range k.Policy {
+		if tpm2.TPMCC(p.CommandCode) == tpm2.TPMCCPolicySigned {
+			return true
+		}
+	}
+	return false
+}
+
+// runPolicySigned asks approve to sign the challenge of the policy session,
+// and satisfies the PolicySigned with it. The challenge is nonceTPM ||
+// expiration || cpHashA || policyRef, and the signature is over its SHA-256
+// digest. The nonce binds the approval to the session, so each use of the key
+// needs a new one.
+func runPolicySigned(tpm transport.TPM, sess tpm2.Session, p *keyfile.TPMPolicy, approve func([]byte) ([]byte, error)) error {
+	pub, ref, _, err := parsePublicRef(p.CommandPolicy)
+	if err != nil {
+		return fmt.Errorf("malformed PolicySigned: %w", err)
+	}
+	if approve == nil {
+		return ErrNoApprover
+	}
+
+	nonce := sess.NonceTPM()
+	var expiration int32
+	challenge := append([]byte{}, nonce.Buffer...)
+	challenge = binary.BigEndian.AppendUint32(challenge, uint32(expiration))
+	challenge = append(challenge, ref.Buffer...)
+
+	sig, err := approve(challenge)
+	if err != nil {
+		return fmt.Errorf("approval failed: %w", err)
+	}
+	pk, err := template.FromTPMPublicToPubkey(pub)
+	if err != nil {
+		return err
+	}
+	tpmsig, err := tpmSignature(pk, sig)
+	if err != nil {
+		return err
+	}
+
+	ext, err := tpm2.LoadExternal{
+		InPublic:  tpm2.New2B(*pub),
+		Hierarchy: tpm2.TPMRHNull,
+	}.Execute(tpm)
+	if err != nil {
+		return fmt.Errorf("failed loading approver: %w", err)
+	}
+	defer keyfile.FlushHandle(tpm, ext.ObjectHandle)
+
+	_, err = tpm2.PolicySigned{
+		AuthObject:    tpm2.NamedHandle{Handle: ext.ObjectHandle, Name: ext.Name},
+		PolicySession: sess.Handle(),
+		NonceTPM:      nonce,
+		PolicyRef:     tpm2.TPM2BNonce{Buffer: ref.Buffer},
+		Expiration:    expiration,
+		Auth:          *tpmsig,
+	}.Execute(tpm)
+	if err != nil {
+		return fmt.Errorf("PolicySigned failed: %w", err)
+	}
+	return nil
+}
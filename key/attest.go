@@ -0,0 +1,484 @@
+package key
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/go-tpm-keyfiles/template"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/crypto/ssh"
+)
+
+var attestationPemType = "TPM ATTESTATION"
+
+var ErrNotAttestation = errors.New("not a tpm attestation")
+
+// AKTemplate is the ECC P-256 restricted signing key created as a primary
+// under the endorsement hierarchy to certify the creation of keys. Being a
+// primary key it's the same key every time on a TPM until the endorsement seed
+// changes.
+var AKTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgECC,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:            true,
+		FixedParent:         true,
+		SensitiveDataOrigin: true,
+		UserWithAuth:        true,
+		NoDA:                true,
+		Restricted:          true,
+		SignEncrypt:         true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(
+		tpm2.TPMAlgECC,
+		&tpm2.TPMSECCParms{
+			CurveID: tpm2.TPMECCNistP256,
+			Scheme: tpm2.TPMTECCScheme{
+				Scheme: tpm2.TPMAlgECDSA,
+				Details: tpm2.NewTPMUAsymScheme(
+					tpm2.TPMAlgECDSA,
+					&tpm2.TPMSSigSchemeECDSA{
+						HashAlg: tpm2.TPMAlgSHA256,
+					},
+				),
+			},
+		},
+	),
+}
+
+// Attestation is the TPM2_CertifyCreation or TPM2_Certify of a key signed by
+// the attestation key, proving the key lives inside the TPM the attestation
+// key belongs to. The endorsement key and its certificate are included when
+// the TPM has one, so the chain can be validated against the TPM vendor CA.
+type Attestation struct {
+	// Public is the TPM public area of the certified key
+	Public tpm2.TPM2BPublic
+	// AKPublic is the public area of the attestation key
+	AKPublic tpm2.TPM2BPublic
+	// CreationData is only set on TPM2_CertifyCreation attestations
+	CreationData tpm2.TPM2B[tpm2.TPMSCreationData, *tpm2.TPMSCreationData]
+	Attest       tpm2.TPM2BAttest
+	Signature    tpm2.TPMTSignature
+
+	EKCertificate []byte
+	EKPublic      tpm2.TPM2BPublic
+}
+
+type attestationWire struct {
+	Public        []byte
+	AKPublic      []byte
+	CreationData  []byte
+	Attest        []byte
+	Signature     []byte
+	EKCertificate []byte
+	EKPublic      []byte
+}
+
+func createAK(tpm transport.TPM) (*tpm2.CreatePrimaryResponse, error) {
+	ak, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMRHEndorsement,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		InPublic: tpm2.New2B(AKTemplate),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating attestation key: %w", err)
+	}
+	return ak, nil
+}
+
+// addEndorsement adds the endorsement key to the attestation if the TPM has
+// an EK certificate, preferring the EK of the handle.
+func (a *Attestation) addEndorsement(tpm transport.TPM, prefer tpm2.TPMHandle) error {
+	ek, err := readEndorsement(tpm, prefer)
+	if errors.Is(err, ErrNoEKCertificate) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	a.EKCertificate = ek.Certificate
+	a.EKPublic = ek.Public
+	return nil
+}
+
+// Certify certifies the key with the attestation key. The nonce is included
+// as qualifying data for the verifier to check the attestation is fresh.
+func (k *SSHTPMKey) Certify(tpm transport.TPMCloser, ownerauth, auth, nonce []byte) (*Attestation, error) {
+	a := &Attestation{Public: k.Pubkey}
+	if err := a.addEndorsement(tpm, k.Parent); err != nil {
+		return nil, err
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	handle, _, err := k.Load(sess, ownerauth)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.FlushHandle()
+	defer keyfile.FlushHandle(tpm, handle)
+
+	if len(auth) != 0 {
+		handle.Auth = tpm2.PasswordAuth(auth)
+	}
+
+	ak, err := createAK(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer keyfile.FlushHandle(tpm, ak.ObjectHandle)
+
+	certify, err := tpm2.Certify{
+		ObjectHandle: *handle,
+		SignHandle: tpm2.AuthHandle{
+			Handle: ak.ObjectHandle,
+			Name:   ak.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		QualifyingData: tpm2.TPM2BData{Buffer: nonce},
+		InScheme: tpm2.TPMTSigScheme{
+			Scheme: tpm2.TPMAlgNull,
+		},
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed certifying key: %w", err)
+	}
+
+	a.AKPublic = ak.OutPublic
+	a.Attest = certify.CertifyInfo
+	a.Signature = certify.Signature
+	return a, nil
+}
+
+// certifyCreation certifies the newly created key under parent. The
+// endorsement key is added by the caller once the key is flushed.
+func certifyCreation(sess *keyfile.TPMSession, parent *tpm2.AuthHandle, k *SSHTPMKey, rsp *tpm2.CreateResponse) (*Attestation, error) {
+	handle, err := keyfile.LoadKeyWithParent(sess, *parent, k.TPMKey)
+	if err != nil {
+		return nil, err
+	}
+	defer keyfile.FlushHandle(sess.GetTPM(), handle)
+
+	ak, err := createAK(sess.GetTPM())
+	if err != nil {
+		return nil, err
+	}
+	defer keyfile.FlushHandle(sess.GetTPM(), ak.ObjectHandle)
+
+	certify, err := tpm2.CertifyCreation{
+		SignHandle: tpm2.AuthHandle{
+			Handle: ak.ObjectHandle,
+			Name:   ak.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		ObjectHandle: tpm2.NamedHandle{
+			Handle: handle.Handle,
+			Name:   handle.Name,
+		},
+		CreationHash: rsp.CreationHash,
+		InScheme: tpm2.TPMTSigScheme{
+			Scheme: tpm2.TPMAlgNull,
+		},
+		CreationTicket: rsp.CreationTicket,
+	}.Execute(sess.GetTPM())
+	if err != nil {
+		return nil, fmt.Errorf("failed certifying key creation: %w", err)
+	}
+
+	return &Attestation{
+		Public:       rsp.OutPublic,
+		AKPublic:     ak.OutPublic,
+		CreationData: rsp.CreationData,
+		Attest:       certify.CertifyInfo,
+		Signature:    certify.Signature,
+	}, nil
+}
+
+// Bytes returns the PEM encoded attestation
+func (a *Attestation) Bytes() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: attestationPemType,
+		Bytes: ssh.Marshal(attestationWire{
+			Public:        tpm2.Marshal(a.Public),
+			AKPublic:      tpm2.Marshal(a.AKPublic),
+			CreationData:  tpm2.Marshal(a.CreationData),
+			Attest:        tpm2.Marshal(a.Attest),
+			Signature:     tpm2.Marshal(a.Signature),
+			EKCertificate: a.EKCertificate,
+			EKPublic:      tpm2.Marshal(a.EKPublic),
+		}),
+	})
+}
+
+// DecodeAttestation parses a PEM encoded attestation
+func DecodeAttestation(b []byte) (*Attestation, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != attestationPemType {
+		return nil, ErrNotAttestation
+	}
+	var w attestationWire
+	if err := ssh.Unmarshal(block.Bytes, &w); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAttestation, err)
+	}
+
+	pub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](w.Public)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAttestation, err)
+	}
+	akpub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](w.AKPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAttestation, err)
+	}
+	creation, err := tpm2.Unmarshal[tpm2.TPM2B[tpm2.TPMSCreationData, *tpm2.TPMSCreationData]](w.CreationData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAttestation, err)
+	}
+	attest, err := tpm2.Unmarshal[tpm2.TPM2BAttest](w.Attest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAttestation, err)
+	}
+	sig, err := tpm2.Unmarshal[tpm2.TPMTSignature](w.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAttestation, err)
+	}
+	ekpub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](w.EKPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAttestation, err)
+	}
+
+	return &Attestation{
+		Public:        *pub,
+		AKPublic:      *akpub,
+		CreationData:  *creation,
+		Attest:        *attest,
+		Signature:     *sig,
+		EKCertificate: w.EKCertificate,
+		EKPublic:      *ekpub,
+	}, nil
+}
+
+var ErrInvalidAttestation = errors.New("invalid tpm attestation")
+
+// oidSubjectAltName is marked critical in EK certificates and contains TPM
+// specific names crypto/x509 doesn't handle
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// VerifyOptions are the trust anchors and freshness checks of Verify
+type VerifyOptions struct {
+	// Roots and Intermediates are the TPM vendor CAs the EK certificate is
+	// verified against. Without Roots the EK certificate isn't checked.
+	Roots         *x509.CertPool
+	Intermediates *x509.CertPool
+
+	// Nonce has to match the qualifying data of the attestation when set
+	Nonce []byte
+}
+
+// AttestationResult is the verified content of an attestation
+type AttestationResult struct {
+	PublicKey crypto.PublicKey
+
+	// Generated is true when the key was created inside the TPM and not
+	// imported
+	Generated bool
+
+	// Creation is true for attestations made when the key was created
+	Creation bool
+
+	// EKParent is true for attestations made at key creation when the parent
+	// of the key is the endorsement key of the attestation
+	EKParent bool
+
+	// EKCertificate is the verified EK certificate, nil when no roots were
+	// given
+	EKCertificate *x509.Certificate
+}
+
+func invalidAttestation(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidAttestation, fmt.Sprintf(format, a...))
+}
+
+// akQualifiedName returns the qualified name of the attestation key as a
+// primary of the endorsement hierarchy
+func akQualifiedName(name []byte) []byte {
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(tpm2.TPMRHEndorsement)))
+	h.Write(name)
+	return h.Sum(binary.BigEndian.AppendUint16(nil, uint16(tpm2.TPMAlgSHA256)))
+}
+
+// verifyEK checks the EK certificate chains to the roots and belongs to the
+// endorsement key
+func verifyEK(ekcert []byte, ekpublic tpm2.TPM2BPublic, opts *VerifyOptions) (*x509.Certificate, error) {
+	if len(ekcert) == 0 {
+		return nil, invalidAttestation("no ek certificate")
+	}
+	cert, err := x509.ParseCertificate(ekcert)
+	if err != nil {
+		return nil, invalidAttestation("failed parsing ek certificate: %v", err)
+	}
+
+	unhandled := cert.UnhandledCriticalExtensions[:0]
+	for _, ext := range cert.UnhandledCriticalExtensions {
+		if !ext.Equal(oidSubjectAltName) {
+			unhandled = append(unhandled, ext)
+		}
+	}
+	cert.UnhandledCriticalExtensions = unhandled
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: opts.Intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, invalidAttestation("ek certificate: %v", err)
+	}
+
+	ekpub, err := ekpublic.Contents()
+	if err != nil {
+		return nil, invalidAttestation("no ek public key")
+	}
+	pk, err := template.FromTPMPublicToPubkey(ekpub)
+	if err != nil {
+		return nil, invalidAttestation("ek public key: %v", err)
+	}
+	if eq, ok := pk.(interface{ Equal(crypto.PublicKey) bool }); !ok || !eq.Equal(cert.PublicKey) {
+		return nil, invalidAttestation("ek certificate doesn't match the ek")
+	}
+	return cert, nil
+}
+
+// verifyAKSignature checks attested is signed by the attestation key, a
+// restricted signing primary of the endorsement hierarchy.
+func verifyAKSignature(akpublic tpm2.TPM2BPublic, attested tpm2.TPM2BAttest, signature tpm2.TPMTSignature) (*tpm2.TPMSAttest, error) {
+	akpub, err := akpublic.Contents()
+	if err != nil {
+		return nil, invalidAttestation("no attestation key")
+	}
+	if !akpub.ObjectAttributes.FixedTPM || !akpub.ObjectAttributes.Restricted || !akpub.ObjectAttributes.SignEncrypt {
+		return nil, invalidAttestation("attestation key is not a restricted signing key")
+	}
+	ak, err := template.FromTPMPublicToPubkey(akpub)
+	if err != nil {
+		return nil, invalidAttestation("attestation key: %v", err)
+	}
+	akecdsa, ok := ak.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, invalidAttestation("unsupported attestation key")
+	}
+
+	sig, err := signature.Signature.ECDSA()
+	if err != nil || signature.SigAlg != tpm2.TPMAlgECDSA || sig.Hash != tpm2.TPMAlgSHA256 {
+		return nil, invalidAttestation("unsupported signature")
+	}
+	digest := sha256.Sum256(tpm2.Marshal(attested)[2:])
+	if !ecdsa.Verify(akecdsa,
+		digest[:],
+		new(big.Int).SetBytes(sig.SignatureR.Buffer),
+		new(big.Int).SetBytes(sig.SignatureS.Buffer)) {
+		return nil, invalidAttestation("bad signature")
+	}
+
+	attest, err := attested.Contents()
+	if err != nil {
+		return nil, invalidAttestation("%v", err)
+	}
+	akname, err := tpm2.ObjectName(akpub)
+	if err != nil {
+		return nil, invalidAttestation("%v", err)
+	}
+	if !bytes.Equal(attest.QualifiedSigner.Buffer, akQualifiedName(akname.Buffer)) {
+		return nil, invalidAttestation("not signed by an endorsement hierarchy attestation key")
+	}
+	return attest, nil
+}
+
+// Verify checks the attestation is signed by the attestation key and
+// certifies the key, and that the EK certificate chains to the roots.
+//
+// The attestation key isn't bound to the EK by the attestation itself, proving
+// they live in the same TPM needs credential activation with the TPM.
+func (a *Attestation) Verify(opts *VerifyOptions) (*AttestationResult, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+
+	attest, err := verifyAKSignature(a.AKPublic, a.Attest, a.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Nonce != nil && !bytes.Equal(attest.ExtraData.Buffer, opts.Nonce) {
+		return nil, invalidAttestation("nonce doesn't match")
+	}
+
+	pub, err := a.Public.Contents()
+	if err != nil {
+		return nil, invalidAttestation("no public key")
+	}
+	name, err := tpm2.ObjectName(pub)
+	if err != nil {
+		return nil, invalidAttestation("%v", err)
+	}
+
+	result := &AttestationResult{
+		Generated: pub.ObjectAttributes.SensitiveDataOrigin,
+	}
+
+	switch attest.Type {
+	case tpm2.TPMSTAttestCertify:
+		info, err := attest.Attested.Certify()
+		if err != nil {
+			return nil, invalidAttestation("%v", err)
+		}
+		if !bytes.Equal(info.Name.Buffer, name.Buffer) {
+			return nil, invalidAttestation("attestation is for another key")
+		}
+	case tpm2.TPMSTAttestCreation:
+		info, err := attest.Attested.Creation()
+		if err != nil {
+			return nil, invalidAttestation("%v", err)
+		}
+		if !bytes.Equal(info.ObjectName.Buffer, name.Buffer) {
+			return nil, invalidAttestation("attestation is for another key")
+		}
+		creation := sha256.Sum256(tpm2.Marshal(a.CreationData)[2:])
+		if !bytes.Equal(info.CreationHash.Buffer, creation[:]) {
+			return nil, invalidAttestation("creation data doesn't match")
+		}
+		result.Creation = true
+		if ekpub, err := a.EKPublic.Contents(); err == nil {
+			ekname, err := tpm2.ObjectName(ekpub)
+			cd, cerr := a.CreationData.Contents()
+			result.EKParent = err == nil && cerr == nil && bytes.Equal(cd.ParentName.Buffer, ekname.Buffer)
+		}
+	default:
+		return nil, invalidAttestation("unsupported attestation type %v", attest.Type)
+	}
+
+	if !pub.ObjectAttributes.FixedTPM {
+		return nil, invalidAttestation("key can be duplicated out of the TPM")
+	}
+	result.PublicKey, err = template.FromTPMPublicToPubkey(pub)
+	if err != nil {
+		return nil, invalidAttestation("%v", err)
+	}
+
+	if opts.Roots != nil {
+		result.EKCertificate, err = verifyEK(a.EKCertificate, a.EKPublic, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
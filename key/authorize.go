@@ -0,0 +1,421 @@
+package key
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/go-tpm-keyfiles/template"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+var ErrNoAuthorizedPolicy = errors.New("key has no signed policy")
+
+// Keys created with CreateOptions.Authorizer have a single PolicyAuthorize
+// policy, with the TPM2B_PUBLIC of the authorizer and the TPM2B_DIGEST policy
+// reference as the command policy. The policies signed by the authorizer are
+// kept in the AuthPolicy list of the key, each ending with a PolicyAuthorize
+// which carries the TPMT_SIGNATURE over the policy after them.
+
+// authorizerPublic returns the TPM public area of a ECDSA or RSA authorizer.
+func authorizerPublic(pk crypto.PublicKey) (*tpm2.TPMTPublic, error) {
+	switch pk := pk.(type) {
+	case *ecdsa.PublicKey:
+		return template.EcdsaToTPMTPublic(pk, tpm2.TPMAlgSHA256), nil
+	case *rsa.PublicKey:
+		return template.RSAToTPMTPublic(pk, pk.N.BitLen()), nil
+	}
+	return nil, fmt.Errorf("unsupported authorizer key type %T", pk)
+}
+
+// authorizePolicy returns the PolicyAuthorize policy for the authorizer and
+// its policy digest.
+func authorizePolicy(pk crypto.PublicKey) (*keyfile.TPMPolicy, []byte, error) {
+	pub, err := authorizerPublic(pk)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, err := tpm2.ObjectName(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	calc, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := tpm2.PolicyAuthorize{KeySign: *name}
+	if err := cmd.Update(calc); err != nil {
+		return nil, nil, err
+	}
+	return &keyfile.TPMPolicy{
+		CommandCode:   int(tpm2.TPMCCPolicyAuthorize),
+		CommandPolicy: append(tpm2.Marshal(tpm2.New2B(*pub)), tpm2.Marshal(cmd.PolicyRef)...),
+	}, calc.Hash().Digest, nil
+}
+
+type authorization struct {
+	pub       *tpm2.TPMTPublic
+	policyRef tpm2.TPM2BDigest
+	signature *tpm2.TPMTSignature
+}
+
+// parsePublicRef parses the TPM2B_PUBLIC and TPM2B_DIGEST policy reference
+// at the start of a command policy, and returns the rest.
+func parsePublicRef(b []byte) (*tpm2.TPMTPublic, *tpm2.TPM2BDigest, []byte, error) {
+	pub2b, err := tpm2.Unmarshal[tpm2.TPM2BPublic](b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pub, err := pub2b.Contents()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	b = b[len(tpm2.Marshal(pub2b)):]
+	ref, err := tpm2.Unmarshal[tpm2.TPM2BDigest](b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return pub, ref, b[2+len(ref.Buffer):], nil
+}
+
+// parseAuthorize parses the command policy of a PolicyAuthorize, with the
+// signature if withSignature is set.
+func parseAuthorize(p *keyfile.TPMPolicy, withSignature bool) (*authorization, error) {
+	if tpm2.TPMCC(p.CommandCode) != tpm2.TPMCCPolicyAuthorize {
+		return nil, errors.New("not a PolicyAuthorize")
+	}
+	pub, ref, rest, err := parsePublicRef(p.CommandPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PolicyAuthorize: %w", err)
+	}
+	a := &authorization{pub: pub, policyRef: *ref}
+	if withSignature {
+		a.signature, err = tpm2.Unmarshal[tpm2.TPMTSignature](rest)
+		if err != nil {
+			return nil, fmt.Errorf("malformed PolicyAuthorize signature: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// policyDigest calculates the digest of the policy commands runPolicy
+// supports.
+func policyDigest(policy []*keyfile.TPMPolicy) ([]byte, error) {
+	calc, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range policy {
+		switch tpm2.TPMCC(p.CommandCode) {
+		case tpm2.TPMCCPolicyPCR:
+			digest, err := tpm2.Unmarshal[tpm2.TPM2BDigest](p.CommandPolicy)
+			if err != nil {
+				return nil, fmt.Errorf("malformed PolicyPCR: %w", err)
+			}
+			sel, err := tpm2.Unmarshal[tpm2.TPMLPCRSelection](p.CommandPolicy[2+len(digest.Buffer):])
+			if err != nil {
+				return nil, fmt.Errorf("malformed PolicyPCR: %w", err)
+			}
+			err = tpm2.PolicyPCR{PcrDigest: *digest, Pcrs: *sel}.Update(calc)
+			if err != nil {
+				return nil, err
+			}
+		case tpm2.TPMCCPolicyCommandCode:
+			if len(p.CommandPolicy) != 4 {
+				return nil, errors.New("malformed PolicyCommandCode")
+			}
+			err := tpm2.PolicyCommandCode{Code: tpm2.TPMCC(binary.BigEndian.Uint32(p.CommandPolicy))}.Update(calc)
+			if err != nil {
+				return nil, err
+			}
+		case tpm2.TPMCCPolicyAuthValue:
+			if err := (tpm2.PolicyAuthValue{}).Update(calc); err != nil {
+				return nil, err
+			}
+		case tpm2.TPMCCPolicySigned:
+			pub, ref, _, err := parsePublicRef(p.CommandPolicy)
+			if err != nil {
+				return nil, fmt.Errorf("malformed PolicySigned: %w", err)
+			}
+			name, err := tpm2.ObjectName(pub)
+			if err != nil {
+				return nil, err
+			}
+			err = tpm2.PolicySigned{
+				AuthObject: tpm2.NamedHandle{Name: *name},
+				PolicyRef:  tpm2.TPM2BNonce{Buffer: ref.Buffer},
+			}.Update(calc)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported policy command 0x%x", p.CommandCode)
+		}
+	}
+	return calc.Hash().Digest, nil
+}
+
+// SignPolicy signs a policy for keys created with the public key of
+// authorizer as CreateOptions.Authorizer. The policy binds the keys to the
+// current values of the PCRs and requires the passphrase of the key. The
+// result is added to the AuthPolicy of the keys, any of which may satisfy the
+// PolicyAuthorize of the key.
+func SignPolicy(tpm transport.TPM, authorizer crypto.Signer, name string, pcrs []uint) (*keyfile.TPMAuthPolicy, error) {
+	policy, _, err := sealPolicy(tpm, &SealOptions{PCRs: pcrs})
+	if err != nil {
+		return nil, err
+	}
+	policy = append(policy, &keyfile.TPMPolicy{CommandCode: int(tpm2.TPMCCPolicyAuthValue)})
+
+	approved, err := policyDigest(policy)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := authorizerPublic(authorizer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	var policyRef tpm2.TPM2BDigest
+	aHash := sha256.Sum256(append(approved, policyRef.Buffer...))
+	sig, err := authorizer.Sign(rand.Reader, aHash[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed signing policy: %w", err)
+	}
+
+	tpmsig, err := tpmSignature(authorizer.Public(), sig)
+	if err != nil {
+		return nil, err
+	}
+
+	authorize := &keyfile.TPMPolicy{
+		CommandCode: int(tpm2.TPMCCPolicyAuthorize),
+		CommandPolicy: bytes.Join([][]byte{
+			tpm2.Marshal(tpm2.New2B(*pub)),
+			tpm2.Marshal(policyRef),
+			tpm2.Marshal(*tpmsig),
+		}, nil),
+	}
+	return &keyfile.TPMAuthPolicy{
+		Name:   name,
+		Policy: append(policy, authorize),
+	}, nil
+}
+
+// tpmSignature returns the TPM signature of a ASN.1 ECDSA or PKCS#1 v1.5 RSA
+// signature over a SHA-256 digest.
+func tpmSignature(pk crypto.PublicKey, sig []byte) (*tpm2.TPMTSignature, error) {
+	switch pk.(type) {
+	case *ecdsa.PublicKey:
+		r, s, err := parseECDSASignature(sig)
+		if err != nil {
+			return nil, err
+		}
+		return &tpm2.TPMTSignature{
+			SigAlg: tpm2.TPMAlgECDSA,
+			Signature: tpm2.NewTPMUSignature(tpm2.TPMAlgECDSA, &tpm2.TPMSSignatureECC{
+				Hash:       tpm2.TPMAlgSHA256,
+				SignatureR: tpm2.TPM2BECCParameter{Buffer: r.Bytes()},
+				SignatureS: tpm2.TPM2BECCParameter{Buffer: s.Bytes()},
+			}),
+		}, nil
+	case *rsa.PublicKey:
+		return &tpm2.TPMTSignature{
+			SigAlg: tpm2.TPMAlgRSASSA,
+			Signature: tpm2.NewTPMUSignature(tpm2.TPMAlgRSASSA, &tpm2.TPMSSignatureRSA{
+				Hash: tpm2.TPMAlgSHA256,
+				Sig:  tpm2.TPM2BPublicKeyRSA{Buffer: sig},
+			}),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", pk)
+}
+
+func parseECDSASignature(sig []byte) (*big.Int, *big.Int, error) {
+	r, s := new(big.Int), new(big.Int)
+	input := cryptobyte.String(sig)
+	var inner cryptobyte.String
+	if !input.ReadASN1(&inner, asn1.SEQUENCE) ||
+		!inner.ReadASN1Integer(r) ||
+		!inner.ReadASN1Integer(s) {
+		return nil, nil, errors.New("malformed ecdsa signature")
+	}
+	return r, s, nil
+}
+
+// AddAuthPolicy adds a signed policy to the key, replacing the policy with the
+// same name.
+func (k *SSHTPMKey) AddAuthPolicy(ap *keyfile.TPMAuthPolicy) error {
+	if !k.IsAuthorized() {
+		return errors.New("key was not created with an authorizer")
+	}
+	own, err := parseAuthorize(k.Policy[0], false)
+	if err != nil {
+		return err
+	}
+	signed, err := parseAuthorize(ap.Policy[len(ap.Policy)-1], true)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tpm2.Marshal(tpm2.New2B(*own.pub)), tpm2.Marshal(tpm2.New2B(*signed.pub))) {
+		return errors.New("policy is signed by a different authorizer than the key requires")
+	}
+	for i, p := range k.AuthPolicy {
+		if p.Name == ap.Name {
+			k.AuthPolicy[i] = ap
+			return nil
+		}
+	}
+	k.AuthPolicy = append(k.AuthPolicy, ap)
+	return nil
+}
+
+// ResignPolicies signs the signed policies of the key again with the
+// authorizer, binding them to the current values of the same PCRs. This keeps
+// the key working after firmware or kernel updates changed the PCRs. It
+// returns the names of the policies.
+func (k *SSHTPMKey) ResignPolicies(tpm transport.TPM, authorizer crypto.Signer) ([]string, error) {
+	if len(k.AuthPolicy) == 0 {
+		return nil, ErrNoAuthorizedPolicy
+	}
+	var policies []*keyfile.TPMAuthPolicy
+	for _, old := range k.AuthPolicy {
+		ap, err := SignPolicy(tpm, authorizer, old.Name, policyPCRs(old.Policy))
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, ap)
+	}
+	// all policies have the same authorizer, so only the first can fail
+	var names []string
+	for _, ap := range policies {
+		if err := k.AddAuthPolicy(ap); err != nil {
+			return nil, err
+		}
+		names = append(names, ap.Name)
+	}
+	return names, nil
+}
+
+// IsAuthorized returns true if the key was created with
+// CreateOptions.Authorizer.
+func (k *SSHTPMKey) IsAuthorized() bool {
+	return len(k.Policy) == 1 && tpm2.TPMCC(k.Policy[0].CommandCode) == tpm2.TPMCCPolicyAuthorize
+}
+
+// runAuthorized satisfies the PolicyAuthorize of the key in sess with the
+// signed policy.
+func runAuthorized(tpm transport.TPM, sess tpm2.Session, own *authorization, ap *keyfile.TPMAuthPolicy, approve func([]byte) ([]byte, error)) error {
+	if len(ap.Policy) == 0 {
+		return errors.New("empty signed policy")
+	}
+	signed, err := parseAuthorize(ap.Policy[len(ap.Policy)-1], true)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tpm2.Marshal(tpm2.New2B(*own.pub)), tpm2.Marshal(tpm2.New2B(*signed.pub))) {
+		return errors.New("policy is signed by a different authorizer")
+	}
+
+	if err := runPolicy(tpm, sess, ap.Policy[:len(ap.Policy)-1], approve); err != nil {
+		return err
+	}
+	approved, err := tpm2.PolicyGetDigest{PolicySession: sess.Handle()}.Execute(tpm)
+	if err != nil {
+		return fmt.Errorf("PolicyGetDigest failed: %w", err)
+	}
+
+	// Keys in the null hierarchy only give null tickets
+	ext, err := tpm2.LoadExternal{
+		InPublic:  tpm2.New2B(*signed.pub),
+		Hierarchy: tpm2.TPMRHOwner,
+	}.Execute(tpm)
+	if err != nil {
+		return fmt.Errorf("failed loading authorizer: %w", err)
+	}
+	aHash := sha256.Sum256(append(approved.PolicyDigest.Buffer, signed.policyRef.Buffer...))
+	verified, err := tpm2.VerifySignature{
+		KeyHandle: ext.ObjectHandle,
+		Digest:    tpm2.TPM2BDigest{Buffer: aHash[:]},
+		Signature: *signed.signature,
+	}.Execute(tpm)
+	keyfile.FlushHandle(tpm, ext.ObjectHandle)
+	if err != nil {
+		return fmt.Errorf("invalid policy signature: %w", err)
+	}
+
+	_, err = tpm2.PolicyAuthorize{
+		PolicySession:  sess.Handle(),
+		ApprovedPolicy: approved.PolicyDigest,
+		PolicyRef:      signed.policyRef,
+		KeySign:        ext.Name,
+		CheckTicket:    verified.Validation,
+	}.Execute(tpm)
+	if err != nil {
+		return fmt.Errorf("PolicyAuthorize failed: %w", err)
+	}
+	return nil
+}
+
+// policySession returns a policy session satisfying the policy of the key.
+// For keys with signed policies each is tried in turn, and the error of the
+// last is returned if none are satisfied.
+func (k *SSHTPMKey) policySession(tpm transport.TPM, auth []byte, opts ...tpm2.AuthOption) (tpm2.Session, func() error, error) {
+	opts = append(opts, tpm2.Auth(auth))
+	if !k.IsAuthorized() {
+		sess, cleanup, err := tpm2.PolicySession(tpm, tpm2.TPMAlgSHA256, 16, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := runPolicy(tpm, sess, k.Policy, k.Approve); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		return sess, cleanup, nil
+	}
+
+	own, err := parseAuthorize(k.Policy[0], false)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ErrNoAuthorizedPolicy
+	for _, ap := range k.AuthPolicy {
+		sess, cleanup, serr := tpm2.PolicySession(tpm, tpm2.TPMAlgSHA256, 16, opts...)
+		if serr != nil {
+			return nil, nil, serr
+		}
+		if err = runAuthorized(tpm, sess, own, ap, k.Approve); err == nil {
+			return sess, cleanup, nil
+		}
+		cleanup()
+	}
+	return nil, nil, err
+}
+
+// authorize sets the authorization of the loaded key, with a policy session
+// if the key has a policy. The returned function flushes the session.
+func (k *SSHTPMKey) authorize(tpm transport.TPM, handle *tpm2.AuthHandle, auth []byte) (func() error, error) {
+	if len(k.Policy) == 0 {
+		if len(auth) != 0 {
+			handle.Auth = tpm2.PasswordAuth(auth)
+		}
+		return func() error { return nil }, nil
+	}
+	sess, cleanup, err := k.policySession(tpm, auth)
+	if err != nil {
+		return nil, err
+	}
+	handle.Auth = sess
+	return cleanup, nil
+}
@@ -0,0 +1,68 @@
+package key
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/google/go-tpm/tpm2"
+)
+
+// TSS2 returns the PEM encoded TSS2 PRIVATE KEY without the format line of
+// FormatVersioned, for implementations of the TPM 2.0 Key Files format which
+// don't skip the text before the PEM block.
+func (k *SSHTPMKey) TSS2() ([]byte, error) {
+	b, err := k.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimPrefix(b, formatLine(FormatVersion)), nil
+}
+
+// TPM2Tools returns the TPM2B_PUBLIC and TPM2B_PRIVATE of the key, as written
+// by tpm2_create -u and -r, to be loaded with tpm2_load under the parent of
+// the key. The files only hold the TPM object, so keys with policies, which
+// tpm2-tools couldn't know about, or which aren't a loadable object are
+// refused.
+func (k *SSHTPMKey) TPM2Tools() (pub, priv []byte, err error) {
+	switch {
+	case k.derived != nil || k.primary != "":
+		return nil, nil, errors.New("key has no TPM object of its own")
+	case !k.Keytype.Equal(keyfile.OIDLoadableKey) && !k.Keytype.Equal(keyfile.OIDSealedKey):
+		return nil, nil, errors.New("only loadable keys can be converted, import the key first")
+	case len(k.Policy) != 0 || len(k.AuthPolicy) != 0:
+		return nil, nil, errors.New("key has TPM policies, which tpm2-tools files can't hold")
+	}
+	return tpm2.Marshal(k.Pubkey), tpm2.Marshal(k.Privkey), nil
+}
+
+// NewTPM2ToolsKey returns the TPM2B_PUBLIC and TPM2B_PRIVATE of a key made by
+// tpm2_create as a loadable key under parent. Like with NewDuplicate the key
+// is expected to have a passphrase.
+func NewTPM2ToolsKey(pub, priv []byte, parent tpm2.TPMHandle, fn ...keyfile.TPMKeyOption) (*SSHTPMKey, error) {
+	tpub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](pub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public area: %w", err)
+	}
+	public, err := tpub.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("invalid public area: %w", err)
+	}
+	if public.ObjectAttributes.Restricted || !public.ObjectAttributes.SignEncrypt {
+		return nil, errors.New("not a signing key")
+	}
+	tpriv, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](priv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private area: %w", err)
+	}
+	fn = append([]keyfile.TPMKeyOption{keyfile.WithParent(parent)}, fn...)
+	k := &SSHTPMKey{
+		TPMKey: keyfile.NewTPMKey(keyfile.OIDLoadableKey, *tpub, *tpriv, fn...),
+	}
+	k.EmptyAuth = false
+	if _, err := k.SSHPublicKey(); err != nil {
+		return nil, fmt.Errorf("unsupported key: %w", err)
+	}
+	return k, nil
+}
@@ -0,0 +1,89 @@
+package key
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// The TPM 2.0 Key Files specification defines
+//
+//	rsaParent   [5] EXPLICIT BOOLEAN OPTIONAL,
+//
+// between the description and the parent handle. go-tpm-keyfiles doesn't know
+// about the field, so we splice it in and out of the DER ourselves.
+var rsaParentTag = asn1.Tag(5).ContextSpecific().Constructed()
+
+// splitRSAParent removes the rsaParent field from a TPMKey DER structure and
+// returns its value.
+func splitRSAParent(der []byte) ([]byte, bool, error) {
+	var rsaParent bool
+
+	s := cryptobyte.String(der)
+	var seq cryptobyte.String
+	if !s.ReadASN1(&seq, asn1.SEQUENCE) {
+		return nil, false, errors.New("no sequence")
+	}
+
+	var b cryptobyte.Builder
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !seq.Empty() {
+			var elem cryptobyte.String
+			var tag asn1.Tag
+			if !seq.ReadAnyASN1Element(&elem, &tag) {
+				b.SetError(errors.New("malformed key"))
+				return
+			}
+			if tag != rsaParentTag {
+				b.AddBytes(elem)
+				continue
+			}
+			var inner cryptobyte.String
+			if !elem.ReadASN1(&inner, rsaParentTag) || !inner.ReadASN1Boolean(&rsaParent) {
+				b.SetError(errors.New("could not parse rsaParent"))
+				return
+			}
+		}
+	})
+
+	out, err := b.Bytes()
+	if err != nil {
+		return nil, false, err
+	}
+	return out, rsaParent, nil
+}
+
+// addRSAParent inserts rsaParent=TRUE into a TPMKey DER structure.
+func addRSAParent(der []byte) ([]byte, error) {
+	s := cryptobyte.String(der)
+	var seq cryptobyte.String
+	if !s.ReadASN1(&seq, asn1.SEQUENCE) {
+		return nil, errors.New("no sequence")
+	}
+
+	var inserted bool
+	var b cryptobyte.Builder
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !seq.Empty() {
+			var elem cryptobyte.String
+			var tag asn1.Tag
+			if !seq.ReadAnyASN1Element(&elem, &tag) {
+				b.SetError(errors.New("malformed key"))
+				return
+			}
+			// The parent INTEGER is the first untagged field after the oid
+			if tag == asn1.INTEGER && !inserted {
+				b.AddASN1(rsaParentTag, func(b *cryptobyte.Builder) {
+					b.AddASN1Boolean(true)
+				})
+				inserted = true
+			}
+			b.AddBytes(elem)
+		}
+		if !inserted {
+			b.SetError(errors.New("key has no parent"))
+		}
+	})
+	return b.Bytes()
+}
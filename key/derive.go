@@ -0,0 +1,250 @@
+package key
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrNotDeriver = errors.New("key is not a deriver")
+
+// A deriver is a keyedhash derivation parent. The keys derived from it are
+// recreated with TPM2_CreateLoaded for every use, with derivedLabel as the
+// label and the host name as the context, so the deriver is the only key
+// file and each host gets its own key.
+const derivedLabel = "ssh-tpm-agent host key"
+
+var deriverTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgKeyedHash,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:            true,
+		FixedParent:         true,
+		SensitiveDataOrigin: true,
+		UserWithAuth:        true,
+		Restricted:          true,
+		Decrypt:             true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(
+		tpm2.TPMAlgKeyedHash,
+		&tpm2.TPMSKeyedHashParms{
+			Scheme: tpm2.TPMTKeyedHashScheme{
+				Scheme: tpm2.TPMAlgXOR,
+				Details: tpm2.NewTPMUSchemeKeyedHash(
+					tpm2.TPMAlgXOR,
+					&tpm2.TPMSSchemeXOR{
+						HashAlg: tpm2.TPMAlgSHA256,
+						KDF:     tpm2.TPMAlgKDF1SP800108,
+					},
+				),
+			},
+		},
+	),
+}
+
+// Derived keys are ecdsa P-256 signing keys. The unique field is left empty,
+// the TPM fills it with the derived point.
+var derivedTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgECC,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:     true,
+		FixedParent:  true,
+		UserWithAuth: true,
+		SignEncrypt:  true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(
+		tpm2.TPMAlgECC,
+		&tpm2.TPMSECCParms{
+			CurveID: tpm2.TPMECCNistP256,
+			Scheme: tpm2.TPMTECCScheme{
+				Scheme: tpm2.TPMAlgNull,
+			},
+		},
+	),
+}
+
+// derivation is what a derived key is recreated from
+type derivation struct {
+	deriver *SSHTPMKey
+	host    string
+}
+
+// NewDeriver creates a deriver under the ECC SRK, protected by pin.
+func NewDeriver(tpm transport.TPMCloser, ownerauth, pin []byte, fn ...keyfile.TPMKeyOption) (*SSHTPMKey, error) {
+	fn = append(fn, keyfile.WithUserAuth(pin))
+	k := &SSHTPMKey{
+		TPMKey: keyfile.NewTPMKey(keyfile.OIDLoadableKey, tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fn...),
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	parenthandle, err := k.ParentHandle(sess, ownerauth)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.FlushHandle()
+	defer keyfile.FlushHandle(tpm, parenthandle)
+
+	create := tpm2.Create{
+		ParentHandle: *parenthandle,
+		InPublic:     tpm2.New2B(deriverTemplate),
+	}
+	if len(pin) != 0 {
+		create.InSensitive = tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				UserAuth: tpm2.TPM2BAuth{Buffer: pin},
+			},
+		}
+	}
+	rsp, err := create.Execute(tpm, sess.GetHMAC())
+	if err != nil {
+		return nil, fmt.Errorf("failed creating deriver: %w", err)
+	}
+	k.AddOptions(
+		keyfile.WithPubkey(rsp.OutPublic),
+		keyfile.WithPrivkey(rsp.OutPrivate),
+	)
+	return k, nil
+}
+
+// IsDeriver returns true if keys can be derived from the key.
+func (k *SSHTPMKey) IsDeriver() bool {
+	pub, err := k.Pubkey.Contents()
+	if err != nil {
+		return false
+	}
+	return pub.Type == tpm2.TPMAlgKeyedHash && pub.ObjectAttributes.Restricted && pub.ObjectAttributes.Decrypt
+}
+
+// DerivedHost returns the host a key was derived for, or an empty string for
+// keys which aren't derived.
+func (k *SSHTPMKey) DerivedHost() string {
+	if k.derived == nil {
+		return ""
+	}
+	return k.derived.host
+}
+
+// Deriver returns the deriver of a derived key, or nil.
+func (k *SSHTPMKey) Deriver() *SSHTPMKey {
+	if k.derived == nil {
+		return nil
+	}
+	return k.derived.deriver
+}
+
+// createDerived recreates the key for host under the deriver. The returned
+// handle has auth as its authorization value, like the deriver.
+func (k *SSHTPMKey) createDerived(sess *keyfile.TPMSession, ownerauth, auth []byte, host string) (*tpm2.AuthHandle, *tpm2.TPM2BPublic, error) {
+	if !k.IsDeriver() {
+		return nil, nil, ErrNotDeriver
+	}
+	tpm := sess.GetTPM()
+	handle, _, err := k.Load(sess, ownerauth)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer keyfile.FlushHandle(tpm, handle)
+	cleanup, err := k.authorize(tpm, handle, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+
+	derive := tpm2.New2B(tpm2.TPMSDerive{
+		Label:   tpm2.TPM2BLabel{Buffer: []byte(derivedLabel)},
+		Context: tpm2.TPM2BLabel{Buffer: []byte(host)},
+	})
+	sensitive := &tpm2.TPMSSensitiveCreate{
+		Data: tpm2.NewTPMUSensitiveCreate(&derive),
+	}
+	if len(auth) != 0 {
+		sensitive.UserAuth = tpm2.TPM2BAuth{Buffer: auth}
+	}
+	rsp, err := tpm2.CreateLoaded{
+		ParentHandle: *handle,
+		InSensitive:  tpm2.TPM2BSensitiveCreate{Sensitive: sensitive},
+		InPublic:     tpm2.New2BTemplate(&derivedTemplate),
+	}.Execute(tpm, sess.GetHMACIn())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed deriving key: %w", err)
+	}
+	return &tpm2.AuthHandle{
+		Handle: rsp.ObjectHandle,
+		Name:   rsp.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}, &rsp.OutPublic, nil
+}
+
+// Derive returns the key derived from the deriver for host. The derived key
+// has the authorization of the deriver.
+func (k *SSHTPMKey) Derive(tpm transport.TPMCloser, ownerauth, auth []byte, host string) (*SSHTPMKey, error) {
+	if host == "" {
+		return nil, errors.New("keys can only be derived for a host")
+	}
+	sess := keyfile.NewTPMSession(tpm)
+	handle, pub, err := k.createDerived(sess, ownerauth, auth, host)
+	if err != nil {
+		return nil, err
+	}
+	sess.FlushHandle()
+	keyfile.FlushHandle(tpm, handle)
+	return k.derivedKey(*pub, host), nil
+}
+
+// NewDerived returns the key derived from the deriver for host, from its
+// public key as returned by Derive, without the TPM.
+func NewDerived(deriver *SSHTPMKey, host string, pk ssh.PublicKey) (*SSHTPMKey, error) {
+	if !deriver.IsDeriver() {
+		return nil, ErrNotDeriver
+	}
+	cpk, ok := pk.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.New("not a derived key")
+	}
+	ecpk, ok := cpk.CryptoPublicKey().(*ecdsa.PublicKey)
+	if !ok || ecpk.Curve != elliptic.P256() {
+		return nil, errors.New("not a derived key")
+	}
+	pub := derivedTemplate
+	pub.Unique = tpm2.NewTPMUPublicID(
+		tpm2.TPMAlgECC,
+		&tpm2.TPMSECCPoint{
+			X: tpm2.TPM2BECCParameter{Buffer: ecpk.X.FillBytes(make([]byte, 32))},
+			Y: tpm2.TPM2BECCParameter{Buffer: ecpk.Y.FillBytes(make([]byte, 32))},
+		},
+	)
+	return deriver.derivedKey(tpm2.New2B(pub), host), nil
+}
+
+func (k *SSHTPMKey) derivedKey(pub tpm2.TPM2BPublic, host string) *SSHTPMKey {
+	dk := &SSHTPMKey{
+		TPMKey: keyfile.NewTPMKey(keyfile.OIDLoadableKey, pub, tpm2.TPM2BPrivate{},
+			keyfile.WithParent(k.Parent),
+			keyfile.WithDescription(host),
+		),
+		derived: &derivation{deriver: k, host: host},
+	}
+	dk.EmptyAuth = k.EmptyAuth
+	return dk
+}
+
+// loadDerived recreates a derived key, and checks it is still the same key.
+func (k *SSHTPMKey) loadDerived(sess *keyfile.TPMSession, ownerauth, auth []byte) (*tpm2.AuthHandle, error) {
+	handle, pub, err := k.derived.deriver.createDerived(sess, ownerauth, auth, k.derived.host)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pub.Bytes(), k.Pubkey.Bytes()) {
+		keyfile.FlushHandle(sess.GetTPM(), handle)
+		return nil, fmt.Errorf("%w: derived key for %s changed", ErrWrongTPM, k.derived.host)
+	}
+	return handle, nil
+}
@@ -0,0 +1,98 @@
+package key
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"errors"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// DiagnoseStep is the result of one step of Diagnose. RC is the response code
+// if the TPM failed the step.
+type DiagnoseStep struct {
+	Step string
+	Err  error
+	RC   tpm2.TPMRC
+}
+
+func (s *DiagnoseStep) OK() bool {
+	return s.Err == nil
+}
+
+// Diagnose goes through using the key one step at a time: loading the parent
+// and the key, satisfying the policy of the key, and making a test signature
+// or unsealing the secret. It stops at the first step which fails.
+func (k *SSHTPMKey) Diagnose(tpm transport.TPMCloser, ownerauth, auth []byte) []DiagnoseStep {
+	var steps []DiagnoseStep
+	step := func(name string, err error) bool {
+		s := DiagnoseStep{Step: name, Err: err}
+		var rc tpm2.TPMRC
+		if errors.As(err, &rc) {
+			s.RC = rc
+		}
+		steps = append(steps, s)
+		return err == nil
+	}
+
+	// The session flushes the parent it was salted with
+	if k.derived == nil && k.primary == "" {
+		sess := keyfile.NewTPMSession(tpm)
+		_, err := k.ParentHandle(sess, ownerauth)
+		sess.FlushHandle()
+		if !step("parent", err) {
+			return steps
+		}
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	var handle *tpm2.AuthHandle
+	var err error
+	switch {
+	case k.derived != nil:
+		handle, err = k.loadDerived(sess, ownerauth, auth)
+	case k.primary != "":
+		handle, err = k.loadPrimary(sess, ownerauth)
+	default:
+		handle, _, err = k.Load(sess, ownerauth)
+	}
+	if !step("load", err) {
+		return steps
+	}
+	sess.FlushHandle()
+	keyfile.FlushHandle(tpm, handle)
+
+	if len(k.Policy) != 0 {
+		_, cleanup, err := k.policySession(tpm, auth)
+		if !step("policy", err) {
+			return steps
+		}
+		cleanup()
+	}
+
+	if k.Keytype.Equal(keyfile.OIDSealedKey) {
+		_, err := k.Unseal(tpm, ownerauth, auth)
+		step("unseal", err)
+		return steps
+	}
+	if !k.HasSigner() {
+		return steps
+	}
+
+	digest := sha256.Sum256([]byte("ssh-tpm-agent diagnose"))
+	sig, err := k.Sign(tpm, ownerauth, auth, digest[:], tpm2.TPMAlgSHA256)
+	if !step("sign", err) {
+		return steps
+	}
+	if ok, err := k.Verify(crypto.SHA256, digest[:], sig); !ok {
+		if err == nil {
+			err = errors.New("signature doesn't verify with the public key")
+		}
+		step("verify", err)
+		return steps
+	}
+	step("verify", nil)
+	return steps
+}
@@ -0,0 +1,203 @@
+package key
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/go-tpm-keyfiles/template"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var ErrNotDuplicable = errors.New("key was not created duplicable")
+
+// Keys created with CreateOptions.Duplicable have FixedTPM and FixedParent
+// cleared, and an authPolicy of PolicyAuthValue and
+// PolicyCommandCode(TPM2_Duplicate). The policy is only used for Duplicate,
+// so it is not recorded in the key file and the key is otherwise used with
+// its passphrase.
+var duplicatePolicy = []*keyfile.TPMPolicy{
+	{CommandCode: int(tpm2.TPMCCPolicyAuthValue)},
+	{
+		CommandCode:   int(tpm2.TPMCCPolicyCommandCode),
+		CommandPolicy: binary.BigEndian.AppendUint32(nil, uint32(tpm2.TPMCCDuplicate)),
+	},
+}
+
+// ParseSRK parses the PEM encoded public key of an ECC SRK, as printed by
+// MarshalSRK or tpm2_createprimary -f pem. The PEM only has the point, the
+// rest of the public area is from ECCSRKTemplate.
+func ParseSRK(b []byte) (*tpm2.TPMTPublic, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM public key")
+	}
+	pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecpk, ok := pk.(*ecdsa.PublicKey)
+	if !ok || ecpk.Curve != elliptic.P256() {
+		return nil, errors.New("srk needs to be an ecc p256 key")
+	}
+	srk := ECCSRKTemplate
+	srk.Unique = tpm2.NewTPMUPublicID(
+		tpm2.TPMAlgECC,
+		&tpm2.TPMSECCPoint{
+			X: tpm2.TPM2BECCParameter{Buffer: ecpk.X.FillBytes(make([]byte, 32))},
+			Y: tpm2.TPM2BECCParameter{Buffer: ecpk.Y.FillBytes(make([]byte, 32))},
+		},
+	)
+	return &srk, nil
+}
+
+// MarshalSRK returns the PEM encoded public key of the ECC SRK of the TPM,
+// for the other TPM to duplicate keys to.
+func MarshalSRK(tpm transport.TPMCloser, ownerauth []byte) ([]byte, error) {
+	sess := keyfile.NewTPMSession(tpm)
+	srk, pub, err := CreateSRK(sess, tpm2.TPMRHOwner, ownerauth, false)
+	if err != nil {
+		return nil, err
+	}
+	keyfile.FlushHandle(tpm, srk)
+	pk, err := template.FromTPMPublicToPubkey(pub)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// IsDuplicable returns true if the key can be duplicated to another TPM.
+func (k *SSHTPMKey) IsDuplicable() bool {
+	pub, err := k.Pubkey.Contents()
+	if err != nil {
+		return false
+	}
+	return !pub.ObjectAttributes.FixedTPM && !pub.ObjectAttributes.FixedParent
+}
+
+// Duplicate exports the key to the TPM which newParent is the ECC SRK of, see
+// ParseSRK. The
+// duplicate is only protected by the outer wrapper, a seed encrypted to
+// newParent, and is returned as an importable key which loads under the owner
+// hierarchy of the other TPM.
+func (k *SSHTPMKey) Duplicate(tpm transport.TPMCloser, ownerauth, auth []byte, newParent *tpm2.TPMTPublic) (*SSHTPMKey, error) {
+	if !k.Keytype.Equal(keyfile.OIDLoadableKey) {
+		return nil, errors.New("can only duplicate loadable keys")
+	}
+	if !k.IsDuplicable() {
+		return nil, ErrNotDuplicable
+	}
+	if newParent.Type != tpm2.TPMAlgECC || !newParent.ObjectAttributes.Restricted || !newParent.ObjectAttributes.Decrypt {
+		return nil, errors.New("the new parent needs to be an ecc storage key")
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	handle, _, err := k.Load(sess, ownerauth)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.FlushHandle()
+	defer keyfile.FlushHandle(tpm, handle)
+
+	parent, err := tpm2.LoadExternal{
+		InPublic:  tpm2.New2B(*newParent),
+		Hierarchy: tpm2.TPMRHNull,
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading the new parent: %w", err)
+	}
+	defer keyfile.FlushHandle(tpm, parent.ObjectHandle)
+
+	psess, cleanup, err := tpm2.PolicySession(tpm, tpm2.TPMAlgSHA256, 16, tpm2.Auth(auth))
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if err := runPolicy(tpm, psess, duplicatePolicy, nil); err != nil {
+		return nil, err
+	}
+	handle.Auth = psess
+
+	rsp, err := tpm2.Duplicate{
+		ObjectHandle: *handle,
+		NewParentHandle: tpm2.NamedHandle{
+			Handle: parent.ObjectHandle,
+			Name:   parent.Name,
+		},
+		Symmetric: tpm2.TPMTSymDef{Algorithm: tpm2.TPMAlgNull},
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed duplicating key: %w", err)
+	}
+
+	dup := keyfile.NewTPMKey(keyfile.OIDImportableKey, k.Pubkey, rsp.Duplicate,
+		keyfile.WithSecret(rsp.OutSymSeed),
+		keyfile.WithParent(tpm2.TPMRHOwner),
+		keyfile.WithDescription(k.Description),
+	)
+	dup.EmptyAuth = k.EmptyAuth
+	return &SSHTPMKey{TPMKey: dup}, nil
+}
+
+// NewDuplicate returns a duplication package made by other tools, like
+// tpm2_duplicate, as an importable key. pub is the TPM2B_PUBLIC of the key,
+// dup the TPM2B_PRIVATE duplicate and seed the TPM2B_ENCRYPTED_SECRET seed it
+// is wrapped with. The package is expected to be duplicated to the ECC SRK,
+// and the key to have a passphrase.
+func NewDuplicate(pub, dup, seed []byte, fn ...keyfile.TPMKeyOption) (*SSHTPMKey, error) {
+	tpub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](pub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public area: %w", err)
+	}
+	if _, err := tpub.Contents(); err != nil {
+		return nil, fmt.Errorf("invalid public area: %w", err)
+	}
+	tdup, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](dup)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duplicate: %w", err)
+	}
+	tseed, err := tpm2.Unmarshal[tpm2.TPM2BEncryptedSecret](seed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid seed: %w", err)
+	}
+	fn = append([]keyfile.TPMKeyOption{keyfile.WithSecret(*tseed)}, fn...)
+	k := &SSHTPMKey{
+		TPMKey: keyfile.NewTPMKey(keyfile.OIDImportableKey, *tpub, *tdup, fn...),
+	}
+	k.EmptyAuth = false
+	return k, nil
+}
+
+// Import imports a key duplicated to this TPM under the ECC SRK of the owner
+// hierarchy, and returns it as a loadable key.
+func (k *SSHTPMKey) Import(tpm transport.TPMCloser, ownerauth []byte) (*SSHTPMKey, error) {
+	if !k.Keytype.Equal(keyfile.OIDImportableKey) {
+		return nil, errors.New("not an importable key")
+	}
+	if k.RSAParent {
+		return nil, errors.New("importable keys can't have an rsa parent")
+	}
+	pub, err := k.Pubkey.Contents()
+	if err != nil {
+		return nil, err
+	}
+	if pub.ObjectAttributes.Restricted || !pub.ObjectAttributes.SignEncrypt {
+		return nil, errors.New("duplicate is not a signing key")
+	}
+	tkey, err := keyfile.ImportTPMKey(tpm, k.TPMKey, ownerauth)
+	if err != nil {
+		return nil, fmt.Errorf("failed importing key: %w", err)
+	}
+	return &SSHTPMKey{TPMKey: tkey}, nil
+}
@@ -0,0 +1,193 @@
+package key
+
+import (
+	"errors"
+	"fmt"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// NV indices of the EK certificates provisioned by the TPM vendor, from the
+// TCG EK Credential Profile.
+const (
+	RSAEKCertIndex = tpm2.TPMHandle(0x01c00002)
+	ECCEKCertIndex = tpm2.TPMHandle(0x01c0000a)
+)
+
+// Persistent handles of the RSA-2048 and ECC P-256 endorsement keys, from the
+// TCG TPM v2.0 Provisioning Guidance. Keys created with CreateOptions.EKParent
+// have them as parent, the EK is recreated from its template when loading.
+const (
+	RSAEKHandle = tpm2.TPMHandle(0x81010001)
+	ECCEKHandle = tpm2.TPMHandle(0x81010002)
+)
+
+var ErrNoEKCertificate = errors.New("tpm has no ek certificate")
+
+// IsEKHandle returns true for the parent handles of keys under the EK
+func IsEKHandle(h tpm2.TPMHandle) bool {
+	return h == RSAEKHandle || h == ECCEKHandle
+}
+
+func ekTemplate(handle tpm2.TPMHandle) tpm2.TPMTPublic {
+	if handle == RSAEKHandle {
+		return tpm2.RSAEKTemplate
+	}
+	return tpm2.ECCEKTemplate
+}
+
+// ekPolicy satisfies the auth policy of the EK templates,
+// TPM2_PolicySecret with the endorsement hierarchy.
+func ekPolicy(endorsementAuth []byte) tpm2.PolicyCallback {
+	return func(tpm transport.TPM, handle tpm2.TPMISHPolicy, nonceTPM tpm2.TPM2BNonce) error {
+		_, err := tpm2.PolicySecret{
+			AuthHandle: tpm2.AuthHandle{
+				Handle: tpm2.TPMRHEndorsement,
+				Auth:   tpm2.PasswordAuth(endorsementAuth),
+			},
+			PolicySession: handle,
+			NonceTPM:      nonceTPM,
+		}.Execute(tpm)
+		if err != nil {
+			return fmt.Errorf("failed satisfying the ek policy: %w", err)
+		}
+		return nil
+	}
+}
+
+// ekParent creates the EK of handle as a parent. The EK has no user auth, it
+// is authorized with a fresh ekPolicy session for each command.
+func ekParent(sess *keyfile.TPMSession, handle tpm2.TPMHandle, endorsementAuth []byte) (*tpm2.AuthHandle, *tpm2.TPMTPublic, error) {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMRHEndorsement,
+			Auth:   tpm2.PasswordAuth(endorsementAuth),
+		},
+		InPublic: tpm2.New2B(ekTemplate(handle)),
+	}.Execute(sess.GetTPM())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed creating endorsement key: %w", err)
+	}
+	pub, err := rsp.OutPublic.Contents()
+	if err != nil {
+		keyfile.FlushHandle(sess.GetTPM(), rsp.ObjectHandle)
+		return nil, nil, err
+	}
+	return &tpm2.AuthHandle{
+		Handle: rsp.ObjectHandle,
+		Name:   rsp.Name,
+		Auth:   tpm2.Policy(tpm2.TPMAlgSHA256, 16, ekPolicy(endorsementAuth)),
+	}, pub, nil
+}
+
+// Endorsement is an endorsement key and its certificate, which is signed by
+// the TPM vendor CA.
+type Endorsement struct {
+	// Certificate is the DER encoded x509 certificate of the EK
+	Certificate []byte
+	Public      tpm2.TPM2BPublic
+}
+
+// NVBufferMax returns the largest NV read or write the TPM accepts
+func NVBufferMax(tpm transport.TPM) int {
+	rsp, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapTPMProperties,
+		Property:      uint32(tpm2.TPMPTNVBufferMax),
+		PropertyCount: 1,
+	}.Execute(tpm)
+	if err != nil {
+		return 512
+	}
+	props, err := rsp.CapabilityData.Data.TPMProperties()
+	if err != nil || len(props.TPMProperty) == 0 || props.TPMProperty[0].Property != tpm2.TPMPTNVBufferMax {
+		return 512
+	}
+	return int(props.TPMProperty[0].Value)
+}
+
+// ReadNV reads the whole NV index with the index authorization
+func ReadNV(tpm transport.TPM, index tpm2.TPMHandle) ([]byte, error) {
+	pub, err := tpm2.NVReadPublic{NVIndex: index}.Execute(tpm)
+	if err != nil {
+		return nil, err
+	}
+	nvpub, err := pub.NVPublic.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	bufMax := NVBufferMax(tpm)
+
+	var data []byte
+	for offset := 0; offset < int(nvpub.DataSize); offset += bufMax {
+		size := min(bufMax, int(nvpub.DataSize)-offset)
+		rsp, err := tpm2.NVRead{
+			AuthHandle: tpm2.AuthHandle{
+				Handle: index,
+				Name:   pub.NVName,
+				Auth:   tpm2.PasswordAuth(nil),
+			},
+			NVIndex: tpm2.NamedHandle{
+				Handle: index,
+				Name:   pub.NVName,
+			},
+			Size:   uint16(size),
+			Offset: uint16(offset),
+		}.Execute(tpm)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, rsp.Data.Buffer...)
+	}
+	return data, nil
+}
+
+func ekPublic(tpm transport.TPM, template tpm2.TPMTPublic) (*tpm2.TPM2BPublic, error) {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMRHEndorsement,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		InPublic: tpm2.New2B(template),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer keyfile.FlushHandle(tpm, rsp.ObjectHandle)
+	return &rsp.OutPublic, nil
+}
+
+// ReadEndorsement returns the RSA or ECC endorsement key with the certificate
+// provisioned by the TPM vendor. The RSA EK is preferred as most TPMs ship
+// with its certificate.
+func ReadEndorsement(tpm transport.TPM) (*Endorsement, error) {
+	return readEndorsement(tpm, RSAEKHandle)
+}
+
+// readEndorsement is ReadEndorsement preferring the EK of the handle
+func readEndorsement(tpm transport.TPM, prefer tpm2.TPMHandle) (*Endorsement, error) {
+	eks := []struct {
+		index    tpm2.TPMHandle
+		template tpm2.TPMTPublic
+	}{
+		{RSAEKCertIndex, tpm2.RSAEKTemplate},
+		{ECCEKCertIndex, tpm2.ECCEKTemplate},
+	}
+	if prefer == ECCEKHandle {
+		eks[0], eks[1] = eks[1], eks[0]
+	}
+	for _, ek := range eks {
+		cert, err := ReadNV(tpm, ek.index)
+		if err != nil {
+			continue
+		}
+		pub, err := ekPublic(tpm, ek.template)
+		if err != nil {
+			return nil, err
+		}
+		return &Endorsement{Certificate: cert, Public: *pub}, nil
+	}
+	return nil, ErrNoEKCertificate
+}
@@ -0,0 +1,91 @@
+package key
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// The format version of a key file is written as explanatory text before the
+// PEM block, which RFC 7468 has parsers skip, so other implementations of the
+// TPM 2.0 Key Files format still read the keys:
+//
+//	ssh-tpm-agent key format: 2
+//	-----BEGIN TSS2 PRIVATE KEY-----
+//
+// Key files without it are version 0 in the old foxboron/ssh-tpm-agent
+// format, or version 1, the TSS2 format of earlier releases.
+const (
+	FormatLegacy = iota
+	FormatTSS2
+	FormatVersioned
+
+	// FormatVersion is the format written by Bytes
+	FormatVersion = FormatVersioned
+)
+
+const formatPrefix = "ssh-tpm-agent key format: "
+
+var ErrNewerFormat = errors.New("key file is in a newer format than this version of ssh-tpm-agent supports")
+
+// migrations upgrade a key file from the format at their index to the next
+// one. A format change adds a FormatX constant and the migration to it.
+var migrations = []func(b []byte) ([]byte, error){
+	FormatLegacy: func(b []byte) ([]byte, error) {
+		k, err := decodeLegacy(b)
+		if err != nil {
+			return nil, err
+		}
+		return k.Bytes(), nil
+	},
+	FormatTSS2: func(b []byte) ([]byte, error) {
+		return append(formatLine(FormatVersioned), b...), nil
+	},
+}
+
+func formatLine(version int) []byte {
+	return []byte(formatPrefix + strconv.Itoa(version) + "\n")
+}
+
+// Format returns the format version of the key file b
+func Format(b []byte) (int, error) {
+	if IsLegacy(b) {
+		return FormatLegacy, nil
+	}
+	text, _, ok := bytes.Cut(b, []byte("-----BEGIN "))
+	if !ok {
+		return 0, errors.New("not a PEM encoded key file")
+	}
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		if v, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte(formatPrefix)); ok {
+			version, err := strconv.Atoi(string(v))
+			if err != nil {
+				return 0, fmt.Errorf("invalid key file format %q", v)
+			}
+			return version, nil
+		}
+	}
+	return FormatTSS2, nil
+}
+
+// Migrate upgrades the key file b to FormatVersion, one format at a time. It
+// returns nil if b is in the current format already.
+func Migrate(b []byte) ([]byte, error) {
+	version, err := Format(b)
+	if err != nil {
+		return nil, err
+	}
+	if version > FormatVersion {
+		return nil, fmt.Errorf("%w: format %d", ErrNewerFormat, version)
+	}
+	if version == FormatVersion {
+		return nil, nil
+	}
+	for ; version < FormatVersion; version++ {
+		if b, err = migrations[version](b); err != nil {
+			return nil, fmt.Errorf("failed migrating key file from format %d: %w", version, err)
+		}
+	}
+	return b, nil
+}
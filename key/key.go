@@ -1,6 +1,9 @@
+// Package key is the TPM key of ssh-tpm-agent, a TSS2 key file, and the TPM
+// operations done with it.
 package key
 
 import (
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"strings"
@@ -15,11 +18,32 @@ var (
 	ErrOldKey = errors.New("old format on key")
 )
 
+var tss2PemType = "TSS2 PRIVATE KEY"
+
 // SSHTPMKey is a wrapper for TPMKey implementing the ssh.PublicKey specific parts
 type SSHTPMKey struct {
 	*keyfile.TPMKey
-	Userauth    []byte
 	Certificate *ssh.Certificate
+
+	// The key lives under the RSA-2048 SRK instead of the ECC P-256 SRK
+	RSAParent bool
+
+	// Attestation of the key creation, only set on new keys created with
+	// CreateOptions.Attest
+	Attestation *Attestation
+
+	// Approve signs the challenge of keys created with
+	// CreateOptions.Approver, it is asked for each use of the key.
+	Approve func(challenge []byte) ([]byte, error)
+
+	// set on keys returned by Derive and NewDerived
+	derived *derivation
+
+	// the name of keys returned by NewPrimary
+	primary string
+
+	// the PIN cached by CacheUserauth
+	cached *cachedUserauth
 }
 
 func NewSSHTPMKey(tpm transport.TPMCloser, alg tpm2.TPMAlgID, bits int, ownerauth []byte, fn ...keyfile.TPMKeyOption) (*SSHTPMKey, error) {
@@ -29,7 +53,7 @@ func NewSSHTPMKey(tpm transport.TPMCloser, alg tpm2.TPMAlgID, bits int, owneraut
 	if err != nil {
 		return nil, err
 	}
-	return &SSHTPMKey{k, nil, nil}, nil
+	return &SSHTPMKey{TPMKey: k}, nil
 }
 
 // This assumes we are just getting a local PK.
@@ -51,7 +75,7 @@ func NewImportedSSHTPMKey(tpm transport.TPMCloser, pk any, ownerauth []byte, fn
 	if err != nil {
 		return nil, fmt.Errorf("failed turning imported key to loadable key: %v", err)
 	}
-	return &SSHTPMKey{k, nil, nil}, nil
+	return &SSHTPMKey{TPMKey: k}, nil
 }
 
 func (k *SSHTPMKey) SSHPublicKey() (ssh.PublicKey, error) {
@@ -81,10 +105,53 @@ func (k *SSHTPMKey) AuthorizedKey() []byte {
 	return []byte(fmt.Sprintf("%s %s\n", authKey, k.Description))
 }
 
+// Bytes returns the PEM encoded TSS2 PRIVATE KEY in FormatVersion, including
+// the rsaParent field go-tpm-keyfiles doesn't support.
+func (k *SSHTPMKey) Bytes() ([]byte, error) {
+	if !k.RSAParent {
+		return append(formatLine(FormatVersion), k.TPMKey.Bytes()...), nil
+	}
+	der, err := addRSAParent(keyfile.Marshal(k.TPMKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed marshaling key: %w", err)
+	}
+	return append(formatLine(FormatVersion), pem.EncodeToMemory(&pem.Block{
+		Type:  tss2PemType,
+		Bytes: der,
+	})...), nil
+}
+
+// Decode parses a TSS2 PRIVATE KEY, or a key in the old foxboron/ssh-tpm-agent
+// format which is transparently converted.
 func Decode(b []byte) (*SSHTPMKey, error) {
-	k, err := keyfile.Decode(b)
+	if IsLegacy(b) {
+		k, err := decodeLegacy(b)
+		if err != nil {
+			return nil, err
+		}
+		return &SSHTPMKey{TPMKey: k}, nil
+	}
+	if version, err := Format(b); err == nil && version > FormatVersion {
+		return nil, fmt.Errorf("%w: format %d", ErrNewerFormat, version)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != tss2PemType {
+		// Let go-tpm-keyfiles give the appropriate error
+		k, err := keyfile.Decode(b)
+		if err != nil {
+			return nil, err
+		}
+		return &SSHTPMKey{TPMKey: k}, nil
+	}
+
+	der, rsaParent, err := splitRSAParent(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	k, err := keyfile.Parse(der)
 	if err != nil {
 		return nil, err
 	}
-	return &SSHTPMKey{k, nil, nil}, nil
+	return &SSHTPMKey{TPMKey: k, RSAParent: rsaParent}, nil
 }
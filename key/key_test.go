@@ -0,0 +1,1312 @@
+package key
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/go-tpm-keyfiles/template"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"golang.org/x/crypto/ssh"
+)
+
+// Produce a key file in the old foxboron/ssh-tpm-agent format
+func encodeLegacy(k *keyfile.TPMKey) []byte {
+	pin := legacyNoPIN
+	if k.HasAuth() {
+		pin = legacyHasPIN
+	}
+	var b []byte
+	b = append(b, 2, byte(pin))
+	b = binary.BigEndian.AppendUint16(b, uint16(k.KeyAlgo()))
+	b = append(b, tpm2.Marshal(k.Pubkey)...)
+	b = append(b, tpm2.Marshal(k.Privkey)...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(k.Description)))
+	b = append(b, []byte(k.Description)...)
+	return pem.EncodeToMemory(&pem.Block{Type: legacyPemType, Bytes: b})
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	for _, c := range []struct {
+		name string
+		alg  tpm2.TPMAlgID
+		bits int
+		pin  []byte
+	}{
+		{"ecdsa", tpm2.TPMAlgECC, 256, []byte("")},
+		{"ecdsa with pin", tpm2.TPMAlgECC, 256, []byte("1234")},
+		{"rsa", tpm2.TPMAlgRSA, 2048, []byte("")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			k, err := NewSSHTPMKey(tpm, c.alg, c.bits, []byte(""),
+				keyfile.WithUserAuth(c.pin),
+				keyfile.WithDescription("legacy"),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b := encodeLegacy(k.TPMKey)
+			if !IsLegacy(b) {
+				t.Fatalf("key not detected as legacy")
+			}
+
+			lk, err := Decode(b)
+			if err != nil {
+				t.Fatalf("failed decoding legacy key: %v", err)
+			}
+
+			if lk.Fingerprint() != k.Fingerprint() {
+				t.Fatalf("fingerprint mismatch")
+			}
+			if lk.Description != "legacy" {
+				t.Fatalf("wrong description: %s", lk.Description)
+			}
+			if lk.HasAuth() != k.HasAuth() {
+				t.Fatalf("pin status mismatch")
+			}
+
+			signer, err := lk.Signer(tpm, []byte(""), c.pin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := sha256.Sum256([]byte("heyho"))
+			sig, err := signer.Sign(rand.Reader, h[:], crypto.SHA256)
+			if err != nil {
+				t.Fatalf("failed signing with legacy key: %v", err)
+			}
+			if ok, err := lk.Verify(crypto.SHA256, h[:], sig); !ok {
+				t.Fatalf("invalid signature: %v", err)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""), keyfile.WithDescription("format"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := k.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name    string
+		b       []byte
+		version int
+	}{
+		{"legacy", encodeLegacy(k.TPMKey), FormatLegacy},
+		{"tss2", k.TPMKey.Bytes(), FormatTSS2},
+		{"current", current, FormatVersion},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			version, err := Format(c.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != c.version {
+				t.Fatalf("expected format %d, got %d", c.version, version)
+			}
+			migrated, err := Migrate(c.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.version == FormatVersion {
+				if migrated != nil {
+					t.Fatal("migrated a key in the current format")
+				}
+				return
+			}
+			if !bytes.Equal(migrated, current) {
+				t.Fatalf("migrated key differs:\n%s", migrated)
+			}
+			// other implementations skip the format line
+			if _, err := keyfile.Decode(migrated); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	newer := append([]byte("ssh-tpm-agent key format: 99\n"), k.TPMKey.Bytes()...)
+	if _, err := Migrate(newer); !errors.Is(err, ErrNewerFormat) {
+		t.Fatalf("expected ErrNewerFormat migrating, got %v", err)
+	}
+	if _, err := Decode(newer); !errors.Is(err, ErrNewerFormat) {
+		t.Fatalf("expected ErrNewerFormat decoding, got %v", err)
+	}
+}
+
+func TestRSAParent(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	for _, c := range []struct {
+		name      string
+		alg       tpm2.TPMAlgID
+		bits      int
+		rsaParent bool
+	}{
+		{"ecdsa - ecc parent", tpm2.TPMAlgECC, 256, false},
+		{"ecdsa - rsa parent", tpm2.TPMAlgECC, 256, true},
+		{"rsa - ecc parent", tpm2.TPMAlgRSA, 2048, false},
+		{"rsa - rsa parent", tpm2.TPMAlgRSA, 2048, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			pin := []byte("1234")
+			k, err := NewSSHTPMKeyWithOptions(tpm, c.alg, c.bits, []byte(""),
+				&CreateOptions{Userauth: pin, RSAParent: c.rsaParent},
+				keyfile.WithDescription("parent"),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := k.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dk, err := Decode(b)
+			if err != nil {
+				t.Fatalf("failed decoding key: %v", err)
+			}
+			if dk.RSAParent != c.rsaParent {
+				t.Fatalf("rsaParent not preserved")
+			}
+			if dk.Description != "parent" {
+				t.Fatalf("wrong description: %s", dk.Description)
+			}
+
+			// Keys without rsaParent need to stay readable by go-tpm-keyfiles
+			if !c.rsaParent {
+				if _, err := keyfile.Decode(b); err != nil {
+					t.Fatalf("go-tpm-keyfiles can't parse key: %v", err)
+				}
+			}
+
+			h := sha256.Sum256([]byte("heyho"))
+			sig, err := dk.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256)
+			if err != nil {
+				t.Fatalf("failed signing: %v", err)
+			}
+			if ok, err := dk.Verify(crypto.SHA256, h[:], sig); !ok {
+				t.Fatalf("invalid signature: %v", err)
+			}
+
+			if err := dk.ChangeAuth(tpm, []byte(""), pin, []byte("4321")); err != nil {
+				t.Fatalf("failed changing auth: %v", err)
+			}
+			if _, err := dk.Sign(tpm, []byte(""), []byte("4321"), h[:], tpm2.TPMAlgSHA256); err != nil {
+				t.Fatalf("failed signing with new pin: %v", err)
+			}
+		})
+	}
+}
+
+func TestAddRSAParentMalformed(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		der  []byte
+	}{
+		{"not der", []byte("junk")},
+		{"no parent", []byte{0x30, 0x00}},
+		{"truncated", []byte{0x30, 0x03, 0x02, 0x01}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if der, err := addRSAParent(c.der); err == nil {
+				t.Fatalf("added rsaParent to a malformed key: %x", der)
+			}
+		})
+	}
+}
+
+func TestEKParent(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	for _, c := range []struct {
+		name      string
+		alg       tpm2.TPMAlgID
+		bits      int
+		rsaParent bool
+		parent    tpm2.TPMHandle
+	}{
+		{"ecdsa - ecc ek", tpm2.TPMAlgECC, 256, false, ECCEKHandle},
+		{"rsa - rsa ek", tpm2.TPMAlgRSA, 2048, true, RSAEKHandle},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			pin := []byte("1234")
+			k, err := NewSSHTPMKeyWithOptions(tpm, c.alg, c.bits, []byte(""),
+				&CreateOptions{Userauth: pin, RSAParent: c.rsaParent, EKParent: true, Attest: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := k.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dk, err := Decode(b)
+			if err != nil {
+				t.Fatalf("failed decoding key: %v", err)
+			}
+			if dk.Parent != c.parent || dk.RSAParent {
+				t.Fatalf("wrong parent 0x%x", dk.Parent)
+			}
+
+			h := sha256.Sum256([]byte("heyho"))
+			sig, err := dk.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256)
+			if err != nil {
+				t.Fatalf("failed signing: %v", err)
+			}
+			if ok, err := dk.Verify(crypto.SHA256, h[:], sig); !ok {
+				t.Fatalf("invalid signature: %v", err)
+			}
+
+			// the simulator has no ek certificate, add the ek ourselves
+			ekpub, err := ekPublic(tpm, ekTemplate(c.parent))
+			if err != nil {
+				t.Fatal(err)
+			}
+			k.Attestation.EKPublic = *ekpub
+			result, err := k.Attestation.Verify(nil)
+			if err != nil {
+				t.Fatalf("failed verifying attestation: %v", err)
+			}
+			if !result.EKParent {
+				t.Fatal("attestation doesn't show the ek as parent")
+			}
+		})
+	}
+
+	k, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &CreateOptions{Attest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ekpub, err := ekPublic(tpm, tpm2.ECCEKTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Attestation.EKPublic = *ekpub
+	result, err := k.Attestation.Verify(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.EKParent {
+		t.Fatal("key under the srk attested as under the ek")
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		&CreateOptions{Attest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Attestation == nil {
+		t.Fatal("no attestation on key")
+	}
+
+	a, err := DecodeAttestation(k.Attestation.Bytes())
+	if err != nil {
+		t.Fatalf("failed decoding attestation: %v", err)
+	}
+	attest, err := a.Attest.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attest.Type != tpm2.TPMSTAttestCreation {
+		t.Fatalf("wrong attestation type %v", attest.Type)
+	}
+	creation, err := attest.Attested.Creation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.Pubkey.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := tpm2.ObjectName(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(creation.ObjectName.Buffer, name.Buffer) {
+		t.Fatal("attestation doesn't certify the key")
+	}
+
+	result, err := a.Verify(nil)
+	if err != nil {
+		t.Fatalf("failed verifying attestation: %v", err)
+	}
+	if !result.Creation || !result.Generated {
+		t.Fatal("attestation is not of a key generated in the tpm")
+	}
+	pk, err := k.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pk.(*ecdsa.PublicKey).Equal(result.PublicKey) {
+		t.Fatal("attestation is for another key")
+	}
+
+	a.Public = k.Attestation.AKPublic
+	if _, err := a.Verify(nil); !errors.Is(err, ErrInvalidAttestation) {
+		t.Fatalf("verified attestation of another key: %v", err)
+	}
+}
+
+// provisionEKCertificate writes an EK certificate to the simulator like a TPM
+// vendor would.
+func provisionEKCertificate(t *testing.T, tpm transport.TPM, cert []byte) {
+	t.Helper()
+	def := tpm2.NVDefineSpace{
+		AuthHandle: tpm2.TPMRHPlatform,
+		PublicInfo: tpm2.New2B(tpm2.TPMSNVPublic{
+			NVIndex: RSAEKCertIndex,
+			NameAlg: tpm2.TPMAlgSHA256,
+			Attributes: tpm2.TPMANV{
+				PPWrite:        true,
+				PPRead:         true,
+				OwnerRead:      true,
+				AuthRead:       true,
+				NoDA:           true,
+				PlatformCreate: true,
+				NT:             tpm2.TPMNTOrdinary,
+			},
+			DataSize: uint16(len(cert)),
+		}),
+	}
+	if _, err := def.Execute(tpm); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := def.PublicInfo.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := tpm2.NVName(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := 0; offset < len(cert); offset += 512 {
+		_, err := tpm2.NVWrite{
+			AuthHandle: tpm2.TPMRHPlatform,
+			NVIndex:    tpm2.NamedHandle{Handle: RSAEKCertIndex, Name: *name},
+			Data:       tpm2.TPM2BMaxNVBuffer{Buffer: cert[offset:min(offset+512, len(cert))]},
+			Offset:     uint16(offset),
+		}.Execute(tpm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertify(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	ca, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "TPM Vendor CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &ca.PublicKey, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ekpub, err := ekPublic(tpm, tpm2.RSAEKTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ekcontents, err := ekpub.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := template.FromTPMPublicToPubkey(ekcontents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment,
+	}, caCert, ek, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provisionEKCertificate(t, tpm, cert)
+
+	pin := []byte("123")
+	k, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &CreateOptions{Userauth: pin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := []byte("nonce")
+	a, err := k.Certify(tpm, []byte(""), pin, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = DecodeAttestation(a.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.EKCertificate, cert) {
+		t.Fatal("attestation doesn't have the ek certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	result, err := a.Verify(&VerifyOptions{Roots: roots, Nonce: nonce})
+	if err != nil {
+		t.Fatalf("failed verifying attestation: %v", err)
+	}
+	if result.Creation || result.EKCertificate == nil {
+		t.Fatal("wrong certify attestation")
+	}
+
+	if _, err := a.Verify(&VerifyOptions{Roots: roots, Nonce: []byte("other")}); !errors.Is(err, ErrInvalidAttestation) {
+		t.Fatalf("verified attestation with the wrong nonce: %v", err)
+	}
+	if _, err := a.Verify(&VerifyOptions{Roots: x509.NewCertPool()}); !errors.Is(err, ErrInvalidAttestation) {
+		t.Fatalf("verified ek certificate of another ca: %v", err)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	digest := sha256.Sum256([]byte("measurement"))
+	_, err = tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMHandle(16),
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{{HashAlg: tpm2.TPMAlgSHA256, Digest: digest[:]}},
+		},
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := readPCRs(tpm, []uint{16})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := []byte("nonce")
+	q, err := NewQuote(tpm, []uint{23, 0, 16}, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err = DecodeQuote(q.Bytes())
+	if err != nil {
+		t.Fatalf("failed decoding quote: %v", err)
+	}
+
+	result, err := q.Verify(&VerifyOptions{Nonce: nonce})
+	if err != nil {
+		t.Fatalf("failed verifying quote: %v", err)
+	}
+	if len(result.PCRs) != 3 {
+		t.Fatalf("expected 3 pcrs, got %d", len(result.PCRs))
+	}
+	if !bytes.Equal(result.PCRs[16], values.Digests[0].Buffer) {
+		t.Fatal("wrong value of pcr 16")
+	}
+
+	if _, err := q.Verify(&VerifyOptions{Nonce: []byte("other")}); !errors.Is(err, ErrInvalidAttestation) {
+		t.Fatalf("verified quote with the wrong nonce: %v", err)
+	}
+	q.PCRValues.Digests[1].Buffer = make([]byte, 32)
+	if _, err := q.Verify(nil); !errors.Is(err, ErrInvalidAttestation) {
+		t.Fatalf("verified quote with a modified pcr value: %v", err)
+	}
+	if _, err := NewQuote(tpm, nil, nonce); err == nil {
+		t.Fatal("quoted no pcrs")
+	}
+}
+
+func TestAuthorizedPolicy(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	for _, c := range []struct {
+		name string
+		gen  func() (crypto.Signer, error)
+	}{
+		{"ecdsa authorizer", func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) }},
+		{"rsa authorizer", func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			admin, err := c.gen()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pin := []byte("1234")
+			k, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+				&CreateOptions{Userauth: pin, Authorizer: admin.Public()},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := sha256.Sum256([]byte("heyho"))
+			if _, err := k.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256); !errors.Is(err, ErrNoAuthorizedPolicy) {
+				t.Fatalf("signing without a signed policy returned %v", err)
+			}
+
+			// Reset the debug PCR to have a known value to change
+			if _, err := (tpm2.PCRReset{PCRHandle: tpm2.AuthHandle{Handle: 16, Auth: tpm2.PasswordAuth(nil)}}).Execute(tpm); err != nil {
+				t.Fatal(err)
+			}
+			ap, err := SignPolicy(tpm, admin, "pcr16", []uint{16})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := k.AddAuthPolicy(ap); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := k.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dk, err := Decode(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, err := dk.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256)
+			if err != nil {
+				t.Fatalf("failed signing: %v", err)
+			}
+			if ok, err := dk.Verify(crypto.SHA256, h[:], sig); !ok {
+				t.Fatalf("invalid signature: %v", err)
+			}
+			if _, err := dk.Sign(tpm, []byte(""), []byte("4321"), h[:], tpm2.TPMAlgSHA256); err == nil {
+				t.Fatal("signed with the wrong pin")
+			}
+
+			if _, err := (tpm2.PCRExtend{
+				PCRHandle: tpm2.AuthHandle{Handle: 16, Auth: tpm2.PasswordAuth(nil)},
+				Digests: tpm2.TPMLDigestValues{
+					Digests: []tpm2.TPMTHA{{HashAlg: tpm2.TPMAlgSHA256, Digest: h[:]}},
+				},
+			}).Execute(tpm); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := dk.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256); !errors.Is(err, ErrPCRMismatch) {
+				t.Fatalf("signing with changed pcrs returned %v", err)
+			}
+
+			// Updating the policy doesn't need a new key
+			ap, err = SignPolicy(tpm, admin, "pcr16", []uint{16})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dk.AddAuthPolicy(ap); err != nil {
+				t.Fatal(err)
+			}
+			if len(dk.AuthPolicy) != 1 {
+				t.Fatalf("expected the policy to be replaced, got %d policies", len(dk.AuthPolicy))
+			}
+			if _, err := dk.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256); err != nil {
+				t.Fatalf("failed signing with the updated policy: %v", err)
+			}
+
+			// Signing the policies again for the current pcrs
+			if _, err := (tpm2.PCRExtend{
+				PCRHandle: tpm2.AuthHandle{Handle: 16, Auth: tpm2.PasswordAuth(nil)},
+				Digests: tpm2.TPMLDigestValues{
+					Digests: []tpm2.TPMTHA{{HashAlg: tpm2.TPMAlgSHA256, Digest: h[:]}},
+				},
+			}).Execute(tpm); err != nil {
+				t.Fatal(err)
+			}
+			names, err := dk.ResignPolicies(tpm, admin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(names, []string{"pcr16"}) {
+				t.Fatalf("signed policies %v again", names)
+			}
+			if pcrs := policyPCRs(dk.AuthPolicy[0].Policy); !slices.Equal(pcrs, []uint{16}) {
+				t.Fatalf("policy was signed again for pcrs %v", pcrs)
+			}
+			if _, err := dk.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256); err != nil {
+				t.Fatalf("failed signing with the policy signed again: %v", err)
+			}
+
+			other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ap, err = SignPolicy(tpm, other, "other", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dk.AddAuthPolicy(ap); err == nil {
+				t.Fatal("added a policy of another authorizer")
+			}
+			if _, err := dk.ResignPolicies(tpm, other); err == nil {
+				t.Fatal("signed the policies again with another authorizer")
+			}
+		})
+	}
+}
+
+func TestApprover(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	approver, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	approve := func(s crypto.Signer) func([]byte) ([]byte, error) {
+		return func(challenge []byte) ([]byte, error) {
+			h := sha256.Sum256(challenge)
+			return s.Sign(rand.Reader, h[:], crypto.SHA256)
+		}
+	}
+
+	pin := []byte("1234")
+	k, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		&CreateOptions{Userauth: pin, Approver: approver.Public()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err = Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.NeedsApproval() {
+		t.Fatal("key does not need approval")
+	}
+
+	h := sha256.Sum256([]byte("heyho"))
+	if _, err := k.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256); !errors.Is(err, ErrNoApprover) {
+		t.Fatalf("signing without an approver returned %v", err)
+	}
+
+	var last []byte
+	k.Approve = func(challenge []byte) ([]byte, error) {
+		sig, err := approve(approver)(challenge)
+		last = sig
+		return sig, err
+	}
+	sig, err := k.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256)
+	if err != nil {
+		t.Fatalf("failed signing: %v", err)
+	}
+	if ok, err := k.Verify(crypto.SHA256, h[:], sig); !ok {
+		t.Fatalf("invalid signature: %v", err)
+	}
+	if _, err := k.Sign(tpm, []byte(""), []byte("4321"), h[:], tpm2.TPMAlgSHA256); err == nil {
+		t.Fatal("signed with the wrong pin")
+	}
+
+	// Approvals are bound to the session
+	replay := last
+	k.Approve = func([]byte) ([]byte, error) { return replay, nil }
+	if _, err := k.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256); err == nil {
+		t.Fatal("signed with a replayed approval")
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Approve = approve(other)
+	if _, err := k.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256); err == nil {
+		t.Fatal("signed with an approval of another key")
+	}
+}
+
+func TestPCRBound(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	pin := []byte("1234")
+	k, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		&CreateOptions{Userauth: pin, PCRs: []uint{7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pcrs := dk.BoundPCRs(); !slices.Equal(pcrs, []uint{7}) {
+		t.Fatalf("key is bound to pcrs %v", pcrs)
+	}
+
+	h := sha256.Sum256([]byte("heyho"))
+	sig, err := dk.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256)
+	if err != nil {
+		t.Fatalf("failed signing: %v", err)
+	}
+	if ok, err := dk.Verify(crypto.SHA256, h[:], sig); !ok {
+		t.Fatalf("invalid signature: %v", err)
+	}
+	if _, err := dk.Sign(tpm, []byte(""), []byte("4321"), h[:], tpm2.TPMAlgSHA256); err == nil {
+		t.Fatal("signed with the wrong pin")
+	}
+
+	if _, err := (tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{Handle: 7, Auth: tpm2.PasswordAuth(nil)},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{{HashAlg: tpm2.TPMAlgSHA256, Digest: h[:]}},
+		},
+	}).Execute(tpm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dk.Sign(tpm, []byte(""), pin, h[:], tpm2.TPMAlgSHA256); !errors.Is(err, ErrPCRMismatch) {
+		t.Fatalf("signing with a changed pcr 7 returned %v", err)
+	}
+
+	if _, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		&CreateOptions{PCRs: []uint{7}, Duplicable: true}); err == nil {
+		t.Fatal("created a duplicable key bound to pcrs")
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	steps := func(ds []DiagnoseStep) (s []string) {
+		for _, d := range ds {
+			s = append(s, d.Step)
+		}
+		return s
+	}
+
+	pin := []byte("1234")
+	k, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &CreateOptions{Userauth: pin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := k.Diagnose(tpm, []byte(""), pin)
+	if s := steps(ds); !slices.Equal(s, []string{"parent", "load", "sign", "verify"}) {
+		t.Fatalf("diagnosed steps %v", s)
+	}
+	for _, d := range ds {
+		if !d.OK() {
+			t.Fatalf("step %s failed: %v", d.Step, d.Err)
+		}
+	}
+
+	ds = k.Diagnose(tpm, []byte(""), []byte("4321"))
+	last := ds[len(ds)-1]
+	if last.Step != "sign" || !errors.Is(last.RC, tpm2.TPMRCAuthFail) {
+		t.Fatalf("wrong pin failed step %s with %v", last.Step, last.Err)
+	}
+
+	pk, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		&CreateOptions{Userauth: pin, PCRs: []uint{16}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte("heyho"))
+	if _, err := (tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{Handle: 16, Auth: tpm2.PasswordAuth(nil)},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{{HashAlg: tpm2.TPMAlgSHA256, Digest: h[:]}},
+		},
+	}).Execute(tpm); err != nil {
+		t.Fatal(err)
+	}
+	ds = pk.Diagnose(tpm, []byte(""), pin)
+	last = ds[len(ds)-1]
+	if last.Step != "policy" || !errors.Is(last.Err, ErrPCRMismatch) || !errors.Is(last.RC, tpm2.TPMRCValue) {
+		t.Fatalf("changed pcr failed step %s with %v", last.Step, last.Err)
+	}
+}
+
+func TestPSS(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	if _, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &CreateOptions{PSS: true}); err == nil {
+		t.Fatal("created an ecdsa key with the pss scheme")
+	}
+
+	k, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgRSA, 2048, []byte(""), &CreateOptions{PSS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.IsPSS() {
+		t.Fatal("key is not a pss key")
+	}
+
+	digest := sha256.Sum256([]byte("data"))
+	sig, err := k.Sign(tpm, []byte(""), []byte(""), digest[:], tpm2.TPMAlgSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := k.Decrypt(tpm, []byte(""), []byte(""), []byte("ciphertext"), tpm2.TPMAlgSHA256); err == nil {
+		t.Fatal("pss key decrypted")
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	srkPEM, err := MarshalSRK(tpm, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srkPublic, err := ParseSRK(srkPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Duplicate(tpm, []byte(""), []byte(""), srkPublic); !errors.Is(err, ErrNotDuplicable) {
+		t.Fatalf("duplicated a fixed key: %v", err)
+	}
+
+	pin := []byte("1234")
+	k, err = NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""), &CreateOptions{
+		Userauth:   pin,
+		Duplicable: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.IsDuplicable() {
+		t.Fatal("key is not duplicable")
+	}
+	if _, err := k.Duplicate(tpm, []byte(""), []byte("wrong"), srkPublic); err == nil {
+		t.Fatal("duplicated with the wrong passphrase")
+	}
+	dup, err := k.Duplicate(tpm, []byte(""), pin, srkPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dup.Keytype.Equal(keyfile.OIDImportableKey) {
+		t.Fatal("duplicate is not an importable key")
+	}
+	if dup.Fingerprint() != k.Fingerprint() {
+		t.Fatal("duplicate is a different key")
+	}
+
+	ik, err := dup.Import(tpm, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ik.Keytype.Equal(keyfile.OIDLoadableKey) {
+		t.Fatal("imported key is not a loadable key")
+	}
+	digest := sha256.Sum256([]byte("data"))
+	sig, err := ik.Sign(tpm, []byte(""), pin, digest[:], tpm2.TPMAlgSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := k.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], sig) {
+		t.Fatal("invalid signature by the imported key")
+	}
+}
+
+func TestNewDuplicate(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	srkPEM, err := MarshalSRK(tpm, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srkPublic, err := ParseSRK(srkPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgRSA, 2048, []byte(""), &CreateOptions{Duplicable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup, err := k.Duplicate(tpm, []byte(""), []byte(""), srkPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the package as written by tpm2_duplicate
+	pkg, err := NewDuplicate(tpm2.Marshal(dup.Pubkey), tpm2.Marshal(dup.Privkey), tpm2.Marshal(dup.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.EmptyAuth {
+		t.Fatal("package without a passphrase")
+	}
+	if _, err := NewDuplicate([]byte("public"), tpm2.Marshal(dup.Privkey), tpm2.Marshal(dup.Secret)); err == nil {
+		t.Fatal("parsed an invalid public area")
+	}
+	ik, err := pkg.Import(tpm, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ik.Fingerprint() != k.Fingerprint() {
+		t.Fatal("imported a different key")
+	}
+	digest := sha256.Sum256([]byte("data"))
+	if _, err := ik.Sign(tpm, []byte(""), []byte(""), digest[:], tpm2.TPMAlgSHA256); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	pin := []byte("1234")
+	k, err := NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		keyfile.WithUserAuth(pin), keyfile.WithDescription("convert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := k.TSS2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := Format(b); err != nil || version != FormatTSS2 {
+		t.Fatalf("TSS2 is format %d: %v", version, err)
+	}
+	tk, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Fingerprint() != k.Fingerprint() || tk.Description != "convert" {
+		t.Fatal("TSS2 is a different key")
+	}
+
+	pub, priv, err := k.TPM2Tools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := NewTPM2ToolsKey(pub, priv, tpm2.TPMRHOwner, keyfile.WithDescription("pair"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk.Fingerprint() != k.Fingerprint() || pk.EmptyAuth {
+		t.Fatal("tpm2-tools files are a different key")
+	}
+	digest := sha256.Sum256([]byte("data"))
+	if _, err := pk.Sign(tpm, []byte(""), pin, digest[:], tpm2.TPMAlgSHA256); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTPM2ToolsKey([]byte("public"), priv, tpm2.TPMRHOwner); err == nil {
+		t.Fatal("parsed an invalid public area")
+	}
+
+	bound, err := NewSSHTPMKeyWithOptions(tpm, tpm2.TPMAlgECC, 256, []byte(""),
+		&CreateOptions{Userauth: pin, PCRs: []uint{7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := bound.TPM2Tools(); err == nil {
+		t.Fatal("converted a key with policies")
+	}
+}
+
+func TestClearedTPM(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Check(tpm, []byte("")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tpm2.Clear{
+		AuthHandle: tpm2.AuthHandle{Handle: tpm2.TPMRHLockout, Auth: tpm2.PasswordAuth(nil)},
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Check(tpm, []byte("")); !errors.Is(err, ErrWrongTPM) {
+		t.Fatalf("expected ErrWrongTPM, got %v", err)
+	}
+	digest := sha256.Sum256([]byte("data"))
+	if _, err := k.Sign(tpm, []byte(""), []byte(""), digest[:], tpm2.TPMAlgSHA256); !errors.Is(err, ErrWrongTPM) {
+		t.Fatalf("expected ErrWrongTPM, got %v", err)
+	}
+}
+
+func TestDerive(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	pin := []byte("123")
+	deriver, err := NewDeriver(tpm, []byte(""), pin, keyfile.WithDescription("deriver"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deriver.IsDeriver() {
+		t.Fatal("deriver is not a deriver")
+	}
+	b, err := deriver.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deriver, err = Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k1, err := deriver.Derive(tpm, []byte(""), pin, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := deriver.Derive(tpm, []byte(""), pin, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.Fingerprint() != again.Fingerprint() {
+		t.Fatal("derived keys for the same host differ")
+	}
+	k2, err := deriver.Derive(tpm, []byte(""), pin, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.Fingerprint() == k2.Fingerprint() {
+		t.Fatal("derived keys for different hosts are the same")
+	}
+	if k1.DerivedHost() != "example.com" || k1.EmptyAuth {
+		t.Fatalf("unexpected derived key %s %v", k1.DerivedHost(), k1.EmptyAuth)
+	}
+
+	pk, err := k1.SSHPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewDerived(deriver, "example.com", pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("data"))
+	sig, err := k.Sign(tpm, []byte(""), pin, digest[:], tpm2.TPMAlgSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpk, _ := pk.(ssh.CryptoPublicKey)
+	if !ecdsa.VerifyASN1(cpk.CryptoPublicKey().(*ecdsa.PublicKey), digest[:], sig) {
+		t.Fatal("invalid signature")
+	}
+	if _, err := k.Sign(tpm, []byte(""), []byte("wrong"), digest[:], tpm2.TPMAlgSHA256); err == nil {
+		t.Fatal("signed with the wrong pin")
+	}
+
+	// a key claiming to be derived for another host
+	k, err = NewDerived(deriver, "example.org", pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Sign(tpm, []byte(""), pin, digest[:], tpm2.TPMAlgSHA256); err == nil {
+		t.Fatal("signed with a mismatching derived key")
+	}
+}
+
+func TestPrimary(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := NewPrimary(tpm, []byte(""), "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewPrimary(tpm, []byte(""), "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Fingerprint() != again.Fingerprint() {
+		t.Fatal("primary keys with the same name differ")
+	}
+	other, err := NewPrimary(tpm, []byte(""), "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Fingerprint() == other.Fingerprint() {
+		t.Fatal("primary keys with different names are the same")
+	}
+	if k.PrimaryName() != "work" || k.Description != "work" {
+		t.Fatalf("unexpected primary key %q %q", k.PrimaryName(), k.Description)
+	}
+
+	digest := sha256.Sum256([]byte("data"))
+	sig, err := k.Sign(tpm, []byte(""), []byte(""), digest[:], tpm2.TPMAlgSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := k.Verify(crypto.SHA256, digest[:], sig); !ok {
+		t.Fatalf("invalid signature: %v", err)
+	}
+	if err := k.Check(tpm, []byte("")); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range k.Diagnose(tpm, []byte(""), nil) {
+		if !d.OK() {
+			t.Fatalf("step %s failed: %v", d.Step, d.Err)
+		}
+	}
+
+	// a key claiming to be the primary key of another name
+	other.primary = "work"
+	if _, err := other.Sign(tpm, []byte(""), []byte(""), digest[:], tpm2.TPMAlgSHA256); !errors.Is(err, ErrWrongTPM) {
+		t.Fatalf("signed with a mismatching primary key: %v", err)
+	}
+}
+
+func TestCacheUserauth(t *testing.T) {
+	k := &SSHTPMKey{TPMKey: &keyfile.TPMKey{Description: "test"}}
+	pin := []byte("1234")
+
+	k.CacheUserauth(pin, 0)
+	pin[0] = '0'
+	got := k.CachedUserauth()
+	if string(got) != "1234" {
+		t.Fatalf("cached %q", got)
+	}
+	k.ForgetUserauth()
+	if k.CachedUserauth() != nil {
+		t.Fatal("forgotten userauth is still cached")
+	}
+	// the copy outlives the wiped and unmapped cache
+	if string(got) != "1234" {
+		t.Fatalf("forgetting changed the copy to %q", got)
+	}
+
+	k.CacheUserauth([]byte("1234"), 50*time.Millisecond)
+	k.CacheUserauth([]byte("5678"), time.Hour)
+	time.Sleep(100 * time.Millisecond)
+	if got := k.CachedUserauth(); string(got) != "5678" {
+		t.Fatalf("the expiry of the replaced userauth forgot %q", got)
+	}
+	k.CacheUserauth([]byte("1234"), 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if k.CachedUserauth() != nil {
+		t.Fatal("expired userauth is still cached")
+	}
+}
@@ -0,0 +1,108 @@
+package key
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/google/go-tpm/tpm2"
+)
+
+// Key files written by foxboron/ssh-tpm-agent before it moved to the
+// TSS2 PRIVATE KEY format. They are a small binary blob wrapped in PEM.
+//
+//	uint8  version
+//	uint8  pin status (0: no pin, 1: has pin)
+//	uint16 key algorithm
+//	TPM2B_PUBLIC
+//	TPM2B_PRIVATE
+//	uint16 comment length (version > 1)
+//	[]byte comment        (version > 1)
+//
+// The keys were always created under the ECC SRK of the owner hierarchy,
+// which is the default parent of a loadable TPMKey.
+var legacyPemType = "TPM PRIVATE KEY"
+
+type legacyPINStatus uint8
+
+const (
+	legacyNoPIN legacyPINStatus = iota
+	legacyHasPIN
+)
+
+type legacyKey struct {
+	Version uint8
+	PIN     legacyPINStatus
+	Type    tpm2.TPMAlgID
+	Public  tpm2.TPM2BPublic
+	Private tpm2.TPM2BPrivate
+	Comment []byte
+}
+
+func unmarshalLegacyKey(b []byte) (*legacyKey, error) {
+	var k legacyKey
+
+	r := bytes.NewBuffer(b)
+	for _, v := range []any{&k.Version, &k.PIN, &k.Type} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return nil, fmt.Errorf("failed reading legacy key header: %v", err)
+		}
+	}
+
+	public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](r.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing legacy public key: %v", err)
+	}
+	r.Next(len(tpm2.Marshal(public)))
+
+	private, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](r.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing legacy private key: %v", err)
+	}
+	r.Next(len(tpm2.Marshal(private)))
+
+	k.Public = *public
+	k.Private = *private
+
+	if k.Version > 1 {
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("failed reading legacy key comment: %v", err)
+		}
+		k.Comment = make([]byte, length)
+		if _, err := io.ReadFull(r, k.Comment); err != nil {
+			return nil, fmt.Errorf("failed reading legacy key comment: %v", err)
+		}
+	}
+	return &k, nil
+}
+
+// IsLegacy reports if b is a key file in the old foxboron/ssh-tpm-agent format.
+func IsLegacy(b []byte) bool {
+	block, _ := pem.Decode(b)
+	return block != nil && block.Type == legacyPemType
+}
+
+// decodeLegacy converts a key in the old foxboron/ssh-tpm-agent format into a
+// loadable TPMKey.
+func decodeLegacy(b []byte) (*keyfile.TPMKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != legacyPemType {
+		return nil, ErrOldKey
+	}
+
+	lk, err := unmarshalLegacyKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Join(ErrOldKey, err)
+	}
+
+	k := keyfile.NewTPMKey(keyfile.OIDLoadableKey, lk.Public, lk.Private,
+		keyfile.WithDescription(string(lk.Comment)),
+	)
+	k.EmptyAuth = lk.PIN == legacyNoPIN
+	return k, nil
+}
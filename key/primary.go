@@ -0,0 +1,99 @@
+package key
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// Primary keys are ecdsa P-256 signing keys created with TPM2_CreatePrimary
+// in the owner hierarchy, with the SHA-256 of primaryLabel and the name of
+// the key as the unique field. The TPM derives the same key from the owner
+// seed every time, so nothing is stored. They are only as protected as the
+// owner hierarchy, anyone who can use it can recreate the key.
+const primaryLabel = "ssh-tpm-agent primary key"
+
+func primaryTemplate(name string) tpm2.TPMTPublic {
+	t := derivedTemplate
+	t.ObjectAttributes.SensitiveDataOrigin = true
+	unique := sha256.Sum256([]byte(primaryLabel + "\x00" + name))
+	t.Unique = tpm2.NewTPMUPublicID(
+		tpm2.TPMAlgECC,
+		&tpm2.TPMSECCPoint{
+			X: tpm2.TPM2BECCParameter{Buffer: unique[:]},
+			Y: tpm2.TPM2BECCParameter{Buffer: make([]byte, 32)},
+		},
+	)
+	return t
+}
+
+// createPrimary creates the primary key called name
+func createPrimary(tpm transport.TPM, ownerauth []byte, name string) (*tpm2.AuthHandle, *tpm2.TPM2BPublic, error) {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMRHOwner,
+			Auth:   tpm2.PasswordAuth(ownerauth),
+		},
+		InPublic: tpm2.New2B(primaryTemplate(name)),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed creating primary key: %w", err)
+	}
+	return &tpm2.AuthHandle{
+		Handle: rsp.ObjectHandle,
+		Name:   rsp.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}, &rsp.OutPublic, nil
+}
+
+// NewPrimary returns the primary key called name. It is the same key for the
+// same name until the TPM is cleared.
+func NewPrimary(tpm transport.TPMCloser, ownerauth []byte, name string) (*SSHTPMKey, error) {
+	if name == "" {
+		return nil, errors.New("primary keys need a name")
+	}
+	handle, pub, err := createPrimary(tpm, ownerauth, name)
+	if err != nil {
+		return nil, err
+	}
+	keyfile.FlushHandle(tpm, handle)
+	return &SSHTPMKey{
+		TPMKey: keyfile.NewTPMKey(keyfile.OIDLoadableKey, *pub, tpm2.TPM2BPrivate{},
+			keyfile.WithParent(tpm2.TPMRHOwner),
+			keyfile.WithDescription(name),
+		),
+		primary: name,
+	}, nil
+}
+
+// PrimaryName returns the name of a primary key, or an empty string for keys
+// which aren't primary keys.
+func (k *SSHTPMKey) PrimaryName() string {
+	return k.primary
+}
+
+// loadPrimary creates the primary key again, and checks it is still the same
+// key. The session is salted with the SRK of the owner hierarchy.
+func (k *SSHTPMKey) loadPrimary(sess *keyfile.TPMSession, ownerauth []byte) (*tpm2.AuthHandle, error) {
+	parenthandle, err := k.ParentHandle(sess, ownerauth)
+	if err != nil {
+		return nil, err
+	}
+	tpm := sess.GetTPM()
+	handle, pub, err := createPrimary(tpm, ownerauth, k.primary)
+	if err != nil {
+		keyfile.FlushHandle(tpm, parenthandle)
+		return nil, err
+	}
+	if !bytes.Equal(pub.Bytes(), k.Pubkey.Bytes()) {
+		keyfile.FlushHandle(tpm, handle)
+		keyfile.FlushHandle(tpm, parenthandle)
+		return nil, fmt.Errorf("%w: primary key %s changed", ErrWrongTPM, k.primary)
+	}
+	return handle, nil
+}
@@ -0,0 +1,271 @@
+package key
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/crypto/ssh"
+)
+
+var quotePemType = "TPM QUOTE"
+
+var ErrNotQuote = errors.New("not a tpm quote")
+
+// Quote is a TPM2_Quote of the SHA-256 PCRs signed by the attestation key,
+// together with the PCR values so the verifier can check them against the
+// quoted digest. Like Attestation it includes the endorsement key and its
+// certificate when the TPM has one.
+type Quote struct {
+	AKPublic  tpm2.TPM2BPublic
+	Quoted    tpm2.TPM2BAttest
+	Signature tpm2.TPMTSignature
+
+	// PCRValues are the values of the quoted PCRs in ascending order
+	PCRValues tpm2.TPMLDigest
+
+	EKCertificate []byte
+	EKPublic      tpm2.TPM2BPublic
+}
+
+type quoteWire struct {
+	AKPublic      []byte
+	Quoted        []byte
+	Signature     []byte
+	PCRValues     []byte
+	EKCertificate []byte
+	EKPublic      []byte
+}
+
+func pcrSelection(pcrs []uint) tpm2.TPMLPCRSelection {
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{
+			{
+				Hash:      tpm2.TPMAlgSHA256,
+				PCRSelect: tpm2.PCClientCompatible.PCRs(pcrs...),
+			},
+		},
+	}
+}
+
+// selectedPCRs returns the PCRs of a SHA-256 selection in ascending order
+func selectedPCRs(sel tpm2.TPMLPCRSelection) ([]uint, error) {
+	if len(sel.PCRSelections) != 1 || sel.PCRSelections[0].Hash != tpm2.TPMAlgSHA256 {
+		return nil, errors.New("not a sha256 pcr selection")
+	}
+	var pcrs []uint
+	for i, b := range sel.PCRSelections[0].PCRSelect {
+		for bit := uint(0); bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				pcrs = append(pcrs, uint(i)*8+bit)
+			}
+		}
+	}
+	return pcrs, nil
+}
+
+// readPCRs reads the SHA-256 values of the PCRs one at a time, as TPMs only
+// return a few digests per TPM2_PCR_Read.
+func readPCRs(tpm transport.TPM, pcrs []uint) (tpm2.TPMLDigest, error) {
+	var values tpm2.TPMLDigest
+	for _, pcr := range pcrs {
+		rsp, err := tpm2.PCRRead{PCRSelectionIn: pcrSelection([]uint{pcr})}.Execute(tpm)
+		if err != nil {
+			return values, fmt.Errorf("failed reading pcr %d: %w", pcr, err)
+		}
+		if len(rsp.PCRValues.Digests) != 1 {
+			return values, fmt.Errorf("tpm did not return pcr %d", pcr)
+		}
+		values.Digests = append(values.Digests, rsp.PCRValues.Digests[0])
+	}
+	return values, nil
+}
+
+// NewQuote quotes the SHA-256 values of the PCRs with the attestation key.
+// The nonce is included as qualifying data for the verifier to check the
+// quote is fresh.
+func NewQuote(tpm transport.TPM, pcrs []uint, nonce []byte) (*Quote, error) {
+	if len(pcrs) == 0 {
+		return nil, errors.New("no pcrs to quote")
+	}
+	pcrs = slices.Clone(pcrs)
+	slices.Sort(pcrs)
+	pcrs = slices.Compact(pcrs)
+	for _, pcr := range pcrs {
+		if pcr > 23 {
+			return nil, fmt.Errorf("invalid pcr %d", pcr)
+		}
+	}
+
+	q := &Quote{}
+	if err := q.addEndorsement(tpm); err != nil {
+		return nil, err
+	}
+
+	ak, err := createAK(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer keyfile.FlushHandle(tpm, ak.ObjectHandle)
+
+	rsp, err := tpm2.Quote{
+		SignHandle: tpm2.AuthHandle{
+			Handle: ak.ObjectHandle,
+			Name:   ak.Name,
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		QualifyingData: tpm2.TPM2BData{Buffer: nonce},
+		InScheme: tpm2.TPMTSigScheme{
+			Scheme: tpm2.TPMAlgNull,
+		},
+		PCRSelect: pcrSelection(pcrs),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed quoting pcrs: %w", err)
+	}
+
+	// Read after the quote, a PCR extended in between fails verification
+	// instead of passing with the old value
+	q.PCRValues, err = readPCRs(tpm, pcrs)
+	if err != nil {
+		return nil, err
+	}
+	q.AKPublic = ak.OutPublic
+	q.Quoted = rsp.Quoted
+	q.Signature = rsp.Signature
+	return q, nil
+}
+
+func (q *Quote) addEndorsement(tpm transport.TPM) error {
+	ek, err := ReadEndorsement(tpm)
+	if errors.Is(err, ErrNoEKCertificate) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	q.EKCertificate = ek.Certificate
+	q.EKPublic = ek.Public
+	return nil
+}
+
+// Bytes returns the PEM encoded quote
+func (q *Quote) Bytes() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: quotePemType,
+		Bytes: ssh.Marshal(quoteWire{
+			AKPublic:      tpm2.Marshal(q.AKPublic),
+			Quoted:        tpm2.Marshal(q.Quoted),
+			Signature:     tpm2.Marshal(q.Signature),
+			PCRValues:     tpm2.Marshal(q.PCRValues),
+			EKCertificate: q.EKCertificate,
+			EKPublic:      tpm2.Marshal(q.EKPublic),
+		}),
+	})
+}
+
+// DecodeQuote parses a PEM encoded quote
+func DecodeQuote(b []byte) (*Quote, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != quotePemType {
+		return nil, ErrNotQuote
+	}
+	var w quoteWire
+	if err := ssh.Unmarshal(block.Bytes, &w); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotQuote, err)
+	}
+
+	akpub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](w.AKPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotQuote, err)
+	}
+	quoted, err := tpm2.Unmarshal[tpm2.TPM2BAttest](w.Quoted)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotQuote, err)
+	}
+	sig, err := tpm2.Unmarshal[tpm2.TPMTSignature](w.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotQuote, err)
+	}
+	values, err := tpm2.Unmarshal[tpm2.TPMLDigest](w.PCRValues)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotQuote, err)
+	}
+	ekpub, err := tpm2.Unmarshal[tpm2.TPM2BPublic](w.EKPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotQuote, err)
+	}
+
+	return &Quote{
+		AKPublic:      *akpub,
+		Quoted:        *quoted,
+		Signature:     *sig,
+		PCRValues:     *values,
+		EKCertificate: w.EKCertificate,
+		EKPublic:      *ekpub,
+	}, nil
+}
+
+// QuoteResult is the verified content of a quote
+type QuoteResult struct {
+	// PCRs are the SHA-256 values of the quoted PCRs
+	PCRs map[uint][]byte
+
+	// EKCertificate is the verified EK certificate, nil when no roots were
+	// given
+	EKCertificate *x509.Certificate
+}
+
+// Verify checks the quote is signed by the attestation key, that the PCR
+// values match the quoted digest, and that the EK certificate chains to the
+// roots. As for attestations the attestation key isn't bound to the EK.
+func (q *Quote) Verify(opts *VerifyOptions) (*QuoteResult, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+
+	attest, err := verifyAKSignature(q.AKPublic, q.Quoted, q.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Nonce != nil && !bytes.Equal(attest.ExtraData.Buffer, opts.Nonce) {
+		return nil, invalidAttestation("nonce doesn't match")
+	}
+	if attest.Type != tpm2.TPMSTAttestQuote {
+		return nil, invalidAttestation("not a quote")
+	}
+	info, err := attest.Attested.Quote()
+	if err != nil {
+		return nil, invalidAttestation("%v", err)
+	}
+	pcrs, err := selectedPCRs(info.PCRSelect)
+	if err != nil {
+		return nil, invalidAttestation("%v", err)
+	}
+	if len(pcrs) != len(q.PCRValues.Digests) {
+		return nil, invalidAttestation("quote has %d pcr values for %d pcrs", len(q.PCRValues.Digests), len(pcrs))
+	}
+	h := sha256.New()
+	result := &QuoteResult{PCRs: map[uint][]byte{}}
+	for i, d := range q.PCRValues.Digests {
+		h.Write(d.Buffer)
+		result.PCRs[pcrs[i]] = d.Buffer
+	}
+	if !bytes.Equal(h.Sum(nil), info.PCRDigest.Buffer) {
+		return nil, invalidAttestation("pcr values don't match the quote")
+	}
+
+	if opts.Roots != nil {
+		result.EKCertificate, err = verifyEK(q.EKCertificate, q.EKPublic, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
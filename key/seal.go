@@ -0,0 +1,306 @@
+package key
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// MaxSealedSize is the largest secret a TPM guarantees it can seal
+const MaxSealedSize = 128
+
+var ErrPCRMismatch = errors.New("pcr values do not match the sealed policy")
+
+// SealOptions are the policies a secret is sealed with.
+type SealOptions struct {
+	// PCRs binds the secret to the current SHA-256 values of the PCRs.
+	PCRs []uint
+
+	// Confirm requires the user to confirm each unseal. The TPM doesn't
+	// know about confirmation, so this is recorded as a PolicyCommandCode for
+	// TPM2_Unseal which can't be removed from the key without breaking the
+	// policy.
+	Confirm bool
+}
+
+// pcrPolicy returns the PolicyPCR binding to the current values of the PCRs,
+// and adds it to calc.
+func pcrPolicy(tpm transport.TPM, calc *tpm2.PolicyCalculator, pcrs []uint) (*keyfile.TPMPolicy, error) {
+	sel := pcrSelection(pcrs)
+	rsp, err := tpm2.PCRRead{PCRSelectionIn: sel}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading pcrs: %w", err)
+	}
+	var want int
+	for _, b := range sel.PCRSelections[0].PCRSelect {
+		want += bits.OnesCount8(b)
+	}
+	if len(rsp.PCRValues.Digests) != want {
+		return nil, errors.New("tpm did not return all selected pcrs")
+	}
+	h := sha256.New()
+	for _, d := range rsp.PCRValues.Digests {
+		h.Write(d.Buffer)
+	}
+
+	cmd := tpm2.PolicyPCR{
+		PcrDigest: tpm2.TPM2BDigest{Buffer: h.Sum(nil)},
+		Pcrs:      sel,
+	}
+	if err := cmd.Update(calc); err != nil {
+		return nil, err
+	}
+	return &keyfile.TPMPolicy{
+		CommandCode:   int(tpm2.TPMCCPolicyPCR),
+		CommandPolicy: append(tpm2.Marshal(cmd.PcrDigest), tpm2.Marshal(cmd.Pcrs)...),
+	}, nil
+}
+
+func sealPolicy(tpm transport.TPM, opts *SealOptions) ([]*keyfile.TPMPolicy, []byte, error) {
+	calc, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var policy []*keyfile.TPMPolicy
+
+	if len(opts.PCRs) != 0 {
+		p, err := pcrPolicy(tpm, calc, opts.PCRs)
+		if err != nil {
+			return nil, nil, err
+		}
+		policy = append(policy, p)
+	}
+
+	if opts.Confirm {
+		cmd := tpm2.PolicyCommandCode{Code: tpm2.TPMCCUnseal}
+		if err := cmd.Update(calc); err != nil {
+			return nil, nil, err
+		}
+		policy = append(policy, &keyfile.TPMPolicy{
+			CommandCode:   int(tpm2.TPMCCPolicyCommandCode),
+			CommandPolicy: binary.BigEndian.AppendUint32(nil, uint32(cmd.Code)),
+		})
+	}
+
+	if len(policy) == 0 {
+		return nil, nil, nil
+	}
+	return policy, calc.Hash().Digest, nil
+}
+
+// Seal seals the secret to the TPM and returns it as a sealed key.
+func Seal(tpm transport.TPMCloser, ownerauth, secret []byte, opts *SealOptions, fn ...keyfile.TPMKeyOption) (*SSHTPMKey, error) {
+	if opts == nil {
+		opts = &SealOptions{}
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("no secret to seal")
+	}
+	if len(secret) > MaxSealedSize {
+		return nil, fmt.Errorf("secret is larger than %d bytes", MaxSealedSize)
+	}
+
+	policy, digest, err := sealPolicy(tpm, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &SSHTPMKey{
+		TPMKey: keyfile.NewTPMKey(keyfile.OIDSealedKey, tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fn...),
+	}
+	k.EmptyAuth = true
+	k.Policy = policy
+
+	template := tpm2.TPMTPublic{
+		Type:    tpm2.TPMAlgKeyedHash,
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			FixedTPM:     true,
+			FixedParent:  true,
+			UserWithAuth: len(policy) == 0,
+			NoDA:         true,
+		},
+		AuthPolicy: tpm2.TPM2BDigest{Buffer: digest},
+		Parameters: tpm2.NewTPMUPublicParms(
+			tpm2.TPMAlgKeyedHash,
+			&tpm2.TPMSKeyedHashParms{
+				Scheme: tpm2.TPMTKeyedHashScheme{
+					Scheme: tpm2.TPMAlgNull,
+				},
+			},
+		),
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	parenthandle, err := k.ParentHandle(sess, ownerauth)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.FlushHandle()
+
+	rsp, err := tpm2.Create{
+		ParentHandle: *parenthandle,
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				Data: tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{
+					Buffer: secret,
+				}),
+			},
+		},
+		InPublic: tpm2.New2B(template),
+	}.Execute(tpm, sess.GetHMAC())
+	if err != nil {
+		return nil, fmt.Errorf("failed sealing secret: %w", err)
+	}
+
+	k.AddOptions(
+		keyfile.WithPubkey(rsp.OutPublic),
+		keyfile.WithPrivkey(rsp.OutPrivate),
+	)
+	return k, nil
+}
+
+// NeedsConfirm returns true if the sealed key was created with
+// SealOptions.Confirm.
+func (k *SSHTPMKey) NeedsConfirm() bool {
+	return slices.ContainsFunc(k.Policy, func(p *keyfile.TPMPolicy) bool {
+		return p.CommandCode == int(tpm2.TPMCCPolicyCommandCode) &&
+			slices.Equal(p.CommandPolicy, binary.BigEndian.AppendUint32(nil, uint32(tpm2.TPMCCUnseal)))
+	})
+}
+
+func runPolicy(tpm transport.TPM, sess tpm2.Session, policy []*keyfile.TPMPolicy, approve func([]byte) ([]byte, error)) error {
+	for _, p := range policy {
+		switch tpm2.TPMCC(p.CommandCode) {
+		case tpm2.TPMCCPolicySigned:
+			if err := runPolicySigned(tpm, sess, p, approve); err != nil {
+				return err
+			}
+		case tpm2.TPMCCPolicyPCR:
+			digest, err := tpm2.Unmarshal[tpm2.TPM2BDigest](p.CommandPolicy)
+			if err != nil {
+				return fmt.Errorf("malformed PolicyPCR: %w", err)
+			}
+			sel, err := tpm2.Unmarshal[tpm2.TPMLPCRSelection](p.CommandPolicy[2+len(digest.Buffer):])
+			if err != nil {
+				return fmt.Errorf("malformed PolicyPCR: %w", err)
+			}
+			_, err = tpm2.PolicyPCR{
+				PolicySession: sess.Handle(),
+				PcrDigest:     *digest,
+				Pcrs:          *sel,
+			}.Execute(tpm)
+			if errors.Is(err, tpm2.TPMRCValue) {
+				return fmt.Errorf("%w: %w", ErrPCRMismatch, err)
+			} else if err != nil {
+				return fmt.Errorf("PolicyPCR failed: %w", err)
+			}
+		case tpm2.TPMCCPolicyCommandCode:
+			if len(p.CommandPolicy) != 4 {
+				return errors.New("malformed PolicyCommandCode")
+			}
+			_, err := tpm2.PolicyCommandCode{
+				PolicySession: sess.Handle(),
+				Code:          tpm2.TPMCC(binary.BigEndian.Uint32(p.CommandPolicy)),
+			}.Execute(tpm)
+			if err != nil {
+				return fmt.Errorf("PolicyCommandCode failed: %w", err)
+			}
+		case tpm2.TPMCCPolicyAuthValue:
+			_, err := tpm2.PolicyAuthValue{
+				PolicySession: sess.Handle(),
+			}.Execute(tpm)
+			if err != nil {
+				return fmt.Errorf("PolicyAuthValue failed: %w", err)
+			}
+		default:
+			return fmt.Errorf("unsupported policy command 0x%x", p.CommandCode)
+		}
+	}
+	return nil
+}
+
+// BoundPCRs returns the PCRs the policy of the key binds it to, see
+// CreateOptions.PCRs and SealOptions.PCRs.
+func (k *SSHTPMKey) BoundPCRs() []uint {
+	return policyPCRs(k.Policy)
+}
+
+// policyPCRs returns the PCRs of the first PolicyPCR of the policy
+func policyPCRs(policy []*keyfile.TPMPolicy) []uint {
+	for _, p := range policy {
+		if tpm2.TPMCC(p.CommandCode) != tpm2.TPMCCPolicyPCR {
+			continue
+		}
+		digest, err := tpm2.Unmarshal[tpm2.TPM2BDigest](p.CommandPolicy)
+		if err != nil {
+			return nil
+		}
+		sel, err := tpm2.Unmarshal[tpm2.TPMLPCRSelection](p.CommandPolicy[2+len(digest.Buffer):])
+		if err != nil {
+			return nil
+		}
+		pcrs, _ := selectedPCRs(*sel)
+		return pcrs
+	}
+	return nil
+}
+
+// Unseal returns the secret of a sealed key. Confirmation is not handled
+// here, callers should check NeedsConfirm.
+func (k *SSHTPMKey) Unseal(tpm transport.TPMCloser, ownerauth, auth []byte) ([]byte, error) {
+	if !k.Keytype.Equal(keyfile.OIDSealedKey) {
+		return nil, errors.New("not a sealed key")
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	handle, parenthandle, err := k.Load(sess, ownerauth)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.FlushHandle()
+	defer keyfile.FlushHandle(tpm, handle)
+
+	_, parentpub, err := keyfile.ReadPublic(tpm, parenthandle.Handle)
+	if err != nil {
+		return nil, err
+	}
+
+	// TPM2_Unseal has no command parameters, so only the returned secret
+	// can be encrypted
+	enc := []tpm2.AuthOption{
+		tpm2.AESEncryption(128, tpm2.EncryptOut),
+		tpm2.Salted(parenthandle.Handle, *parentpub),
+	}
+
+	var sessions []tpm2.Session
+	if len(k.Policy) != 0 {
+		psess, cleanup, err := k.policySession(tpm, auth, enc...)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		handle.Auth = psess
+	} else {
+		if len(auth) != 0 {
+			handle.Auth = tpm2.PasswordAuth(auth)
+		}
+		sessions = append(sessions, tpm2.HMAC(tpm2.TPMAlgSHA256, 16, enc...))
+	}
+
+	rsp, err := tpm2.Unseal{
+		ItemHandle: *handle,
+	}.Execute(tpm, sessions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed unsealing secret: %w", err)
+	}
+	return rsp.OutData.Buffer, nil
+}
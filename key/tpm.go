@@ -0,0 +1,769 @@
+package key
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"slices"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// TCG EK Credential Profile H-2 template, used for the ECC P-256 SRK. The
+// RSA-2048 SRK uses tpm2.RSASRKTemplate.
+var ECCSRKTemplate = keyfile.ECCSRK_H2_Template
+
+// CreateOptions are the TPM object choices made when creating a key which
+// can't be expressed through keyfile.TPMKeyOption.
+type CreateOptions struct {
+	// Userauth is the passphrase of the key. keyfile.WithUserAuth is applied
+	// from this value.
+	Userauth []byte
+
+	// RSAParent creates the key under the RSA-2048 SRK instead of the ECC
+	// P-256 SRK.
+	RSAParent bool
+
+	// Attest certifies the creation of the key with the attestation key, the
+	// result is in SSHTPMKey.Attestation.
+	Attest bool
+
+	// Authorizer is the public key of an administrator whose signed policies,
+	// see SignPolicy, authorize the use of the key. The key can't be used
+	// until a signed policy is added.
+	Authorizer crypto.PublicKey
+
+	// Approver is the public key of an external approver, which needs to sign
+	// a fresh challenge for each use of the key, see SSHTPMKey.Approve.
+	Approver crypto.PublicKey
+
+	// PSS restricts an RSA key to RSA-PSS signatures with SHA-256. Such keys
+	// can't decrypt, and can't make SSH signatures, which are PKCS #1 v1.5.
+	PSS bool
+
+	// Duplicable creates the key with FixedTPM and FixedParent cleared, so
+	// it can be exported to another TPM with SSHTPMKey.Duplicate.
+	Duplicable bool
+
+	// EKParent creates the key under the ECC P-256 endorsement key, or the
+	// RSA-2048 one with RSAParent, instead of a SRK. The owner password is
+	// used as the endorsement hierarchy password.
+	EKParent bool
+
+	// PCRs binds the key to the current SHA-256 values of the PCRs, its
+	// passphrase is still needed. Binding to PCR 7 makes the key stop working
+	// when the Secure Boot state or its key databases change.
+	PCRs []uint
+}
+
+// CreateSRK creates the storage root key under the hierarchy using the ECC or
+// RSA template.
+func CreateSRK(sess *keyfile.TPMSession, hier tpm2.TPMHandle, ownerAuth []byte, rsaParent bool) (*tpm2.AuthHandle, *tpm2.TPMTPublic, error) {
+	template := ECCSRKTemplate
+	if rsaParent {
+		template = tpm2.RSASRKTemplate
+	}
+
+	srk := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.AuthHandle{
+			Handle: hier,
+			Auth:   tpm2.PasswordAuth(ownerAuth),
+		},
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				UserAuth: tpm2.TPM2BAuth{
+					Buffer: []byte(nil),
+				},
+			},
+		},
+		InPublic: tpm2.New2B(template),
+	}
+
+	rsp, err := srk.Execute(sess.GetTPM())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed creating primary key: %w", err)
+	}
+
+	srkPublic, err := rsp.OutPublic.Contents()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed getting srk public content: %v", err)
+	}
+
+	return &tpm2.AuthHandle{
+		Handle: rsp.ObjectHandle,
+		Name:   rsp.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}, srkPublic, nil
+}
+
+// ErrWrongTPM is returned when loading a key created by another TPM, or by
+// this TPM before it was cleared. The key can't be recovered.
+var ErrWrongTPM = errors.New("key was created by another TPM, or before the TPM was cleared")
+
+// SRKHandle is the persistent handle of the SRK in the TCG TPM v2.0
+// Provisioning Guidance.
+const SRKHandle = tpm2.TPMHandle(0x81000001)
+
+var ErrSRKHandleInUse = errors.New("the srk handle holds a different key")
+
+// PersistSRK makes the ECC SRK of the owner hierarchy persistent at
+// SRKHandle. It returns false if it already was.
+func PersistSRK(tpm transport.TPMCloser, ownerauth []byte) (bool, error) {
+	sess := keyfile.NewTPMSession(tpm)
+	srk, _, err := CreateSRK(sess, tpm2.TPMRHOwner, ownerauth, false)
+	if err != nil {
+		return false, err
+	}
+	defer keyfile.FlushHandle(tpm, srk)
+
+	if pub, err := (tpm2.ReadPublic{ObjectHandle: SRKHandle}).Execute(tpm); err == nil {
+		if !bytes.Equal(pub.Name.Buffer, srk.Name.Buffer) {
+			return false, ErrSRKHandleInUse
+		}
+		return false, nil
+	}
+
+	_, err = tpm2.EvictControl{
+		Auth: tpm2.AuthHandle{
+			Handle: tpm2.TPMRHOwner,
+			Auth:   tpm2.PasswordAuth(ownerauth),
+		},
+		ObjectHandle: tpm2.NamedHandle{
+			Handle: srk.Handle,
+			Name:   srk.Name,
+		},
+		PersistentHandle: SRKHandle,
+	}.Execute(tpm)
+	if err != nil {
+		return false, fmt.Errorf("failed persisting srk: %w", err)
+	}
+	return true, nil
+}
+
+// ParentHandle is keyfile.GetParentHandle which respects the parent
+// template of the key.
+func (k *SSHTPMKey) ParentHandle(sess *keyfile.TPMSession, ownerauth []byte) (*tpm2.AuthHandle, error) {
+	hier := k.Parent
+	switch {
+	case IsEKHandle(hier):
+		handle, pub, err := ekParent(sess, hier, ownerauth)
+		if err != nil {
+			return nil, err
+		}
+		sess.SetSalted(handle.Handle, *pub)
+		return handle, nil
+	case keyfile.IsMSO(hier, keyfile.TPM_HT_PERSISTENT):
+		handle, pub, err := keyfile.ReadPublic(sess.GetTPM(), hier)
+		if errors.Is(err, tpm2.TPMRCHandle) {
+			return nil, fmt.Errorf("%w: parent 0x%x does not exist", ErrWrongTPM, hier)
+		} else if err != nil {
+			return nil, err
+		}
+		sess.SetSalted(hier, *pub)
+		return handle, nil
+	case keyfile.IsMSO(hier, keyfile.TPM_HT_PERMANENT):
+	default:
+		// Parent should never be transient, but we might have keys that use
+		// the wrong handle. Load them under the owner hierarchy.
+		hier = tpm2.TPMRHOwner
+	}
+
+	srkHandle, pub, err := CreateSRK(sess, hier, ownerauth, k.RSAParent)
+	if err != nil {
+		return nil, err
+	}
+	sess.SetSalted(srkHandle.Handle, *pub)
+	return srkHandle, nil
+}
+
+// Load loads the key under its parent. The returned handle needs to be
+// flushed, together with the session handle.
+func (k *SSHTPMKey) Load(sess *keyfile.TPMSession, ownerauth []byte) (*tpm2.AuthHandle, *tpm2.AuthHandle, error) {
+	if k.derived != nil || k.primary != "" {
+		return nil, nil, errors.New("derived and primary keys are recreated for each use and can't be loaded")
+	}
+	tkey := k.TPMKey
+	if tkey.Keytype.Equal(keyfile.OIDImportableKey) {
+		if k.RSAParent {
+			return nil, nil, errors.New("importable keys can't have an rsa parent")
+		}
+		var err error
+		tkey, err = keyfile.ImportTPMKey(sess.GetTPM(), tkey, ownerauth)
+		if errors.Is(err, tpm2.TPMRCIntegrity) {
+			return nil, nil, fmt.Errorf("%w: %w", ErrWrongTPM, err)
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failing loading imported key: %w", err)
+		}
+	} else if !tkey.Keytype.Equal(keyfile.OIDLoadableKey) && !tkey.Keytype.Equal(keyfile.OIDSealedKey) {
+		return nil, nil, fmt.Errorf("not a loadable key")
+	}
+
+	parenthandle, err := k.ParentHandle(sess, ownerauth)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rsp, err := tpm2.Load{
+		ParentHandle: *parenthandle,
+		InPrivate:    tkey.Privkey,
+		InPublic:     tkey.Pubkey,
+	}.Execute(sess.GetTPM())
+	if err != nil {
+		keyfile.FlushHandle(sess.GetTPM(), parenthandle)
+		// The private part is protected with the seed of the parent, which
+		// changes when the TPM is cleared.
+		if errors.Is(err, tpm2.TPMRCIntegrity) {
+			return nil, nil, fmt.Errorf("%w: %w", ErrWrongTPM, err)
+		}
+		return nil, nil, fmt.Errorf("failed loading key: %w", err)
+	}
+	return &tpm2.AuthHandle{
+		Handle: rsp.ObjectHandle,
+		Name:   rsp.Name,
+		Auth:   tpm2.PasswordAuth(nil),
+	}, parenthandle, nil
+}
+
+// Check loads the key to check that it belongs to the TPM. It returns
+// ErrWrongTPM if the TPM was cleared or replaced since the key was created.
+func (k *SSHTPMKey) Check(tpm transport.TPMCloser, ownerauth []byte) error {
+	if k.derived != nil {
+		return k.derived.deriver.Check(tpm, ownerauth)
+	}
+	sess := keyfile.NewTPMSession(tpm)
+	if k.primary != "" {
+		handle, err := k.loadPrimary(sess, ownerauth)
+		sess.FlushHandle()
+		if err != nil {
+			return err
+		}
+		keyfile.FlushHandle(tpm, handle)
+		return nil
+	}
+	handle, _, err := k.Load(sess, ownerauth)
+	if err != nil {
+		return err
+	}
+	sess.FlushHandle()
+	keyfile.FlushHandle(tpm, handle)
+	return nil
+}
+
+func keyTemplate(tpm transport.TPMCloser, alg tpm2.TPMAlgID, bits int) (tpm2.TPMTPublic, error) {
+	template := tpm2.TPMTPublic{
+		Type:    alg,
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			FixedTPM:            true,
+			FixedParent:         true,
+			SensitiveDataOrigin: true,
+			UserWithAuth:        true,
+			SignEncrypt:         true,
+			Decrypt:             true,
+		},
+	}
+
+	switch alg {
+	case tpm2.TPMAlgECC:
+		var curve tpm2.TPMECCCurve
+		switch bits {
+		case 0, 256:
+			bits = 256
+			curve = tpm2.TPMECCNistP256
+		case 384:
+			curve = tpm2.TPMECCNistP384
+		case 521:
+			curve = tpm2.TPMECCNistP521
+		default:
+			return template, errors.New("invalid ecdsa key length: valid length are 256, 384 or 521 bits")
+		}
+		if !slices.Contains(keyfile.SupportedECCAlgorithms(tpm), bits) {
+			return template, fmt.Errorf("invalid ecdsa key length: TPM does not support %v bits", bits)
+		}
+		template.Parameters = tpm2.NewTPMUPublicParms(
+			tpm2.TPMAlgECC,
+			&tpm2.TPMSECCParms{
+				CurveID: curve,
+				Scheme: tpm2.TPMTECCScheme{
+					Scheme: tpm2.TPMAlgNull,
+				},
+			},
+		)
+	case tpm2.TPMAlgRSA:
+		if bits != 0 && bits != 2048 {
+			return template, errors.New("invalid rsa key length: only 2048 is supported")
+		}
+		template.Parameters = tpm2.NewTPMUPublicParms(
+			tpm2.TPMAlgRSA,
+			&tpm2.TPMSRSAParms{
+				Scheme: tpm2.TPMTRSAScheme{
+					Scheme: tpm2.TPMAlgNull,
+				},
+				KeyBits: 2048,
+			},
+		)
+	default:
+		return template, fmt.Errorf("unsupported key type")
+	}
+	return template, nil
+}
+
+// NewSSHTPMKeyWithOptions creates a new loadable key like NewSSHTPMKey, with
+// the additional TPM object choices from CreateOptions.
+func NewSSHTPMKeyWithOptions(tpm transport.TPMCloser, alg tpm2.TPMAlgID, bits int, ownerauth []byte, opts *CreateOptions, fn ...keyfile.TPMKeyOption) (*SSHTPMKey, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+
+	fn = append(fn, keyfile.WithUserAuth(opts.Userauth))
+	k := &SSHTPMKey{
+		TPMKey:    keyfile.NewTPMKey(keyfile.OIDLoadableKey, tpm2.TPM2BPublic{}, tpm2.TPM2BPrivate{}, fn...),
+		RSAParent: opts.RSAParent,
+	}
+	if opts.EKParent {
+		// the handle tells which EK is the parent
+		k.Parent = ECCEKHandle
+		if opts.RSAParent {
+			k.Parent = RSAEKHandle
+		}
+		k.RSAParent = false
+	}
+
+	template, err := keyTemplate(tpm, alg, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.PSS {
+		if alg != tpm2.TPMAlgRSA {
+			return nil, errors.New("only rsa keys can use the pss scheme")
+		}
+		// keys with a scheme can't both sign and decrypt
+		template.ObjectAttributes.Decrypt = false
+		template.Parameters = tpm2.NewTPMUPublicParms(
+			tpm2.TPMAlgRSA,
+			&tpm2.TPMSRSAParms{
+				Scheme: tpm2.TPMTRSAScheme{
+					Scheme: tpm2.TPMAlgRSAPSS,
+					Details: tpm2.NewTPMUAsymScheme(
+						tpm2.TPMAlgRSAPSS,
+						&tpm2.TPMSSigSchemeRSAPSS{HashAlg: tpm2.TPMAlgSHA256},
+					),
+				},
+				KeyBits: 2048,
+			},
+		)
+	}
+
+	if opts.Authorizer != nil {
+		policy, digest, err := authorizePolicy(opts.Authorizer)
+		if err != nil {
+			return nil, err
+		}
+		k.Policy = []*keyfile.TPMPolicy{policy}
+		template.AuthPolicy = tpm2.TPM2BDigest{Buffer: digest}
+		template.ObjectAttributes.UserWithAuth = false
+	}
+	if opts.Approver != nil {
+		if opts.Authorizer != nil {
+			return nil, errors.New("keys can't have both an authorizer and an approver")
+		}
+		policy, digest, err := approvePolicy(opts.Approver)
+		if err != nil {
+			return nil, err
+		}
+		k.Policy = policy
+		template.AuthPolicy = tpm2.TPM2BDigest{Buffer: digest}
+		template.ObjectAttributes.UserWithAuth = false
+	}
+
+	if len(opts.PCRs) != 0 {
+		if opts.Authorizer != nil || opts.Approver != nil || opts.Duplicable {
+			return nil, errors.New("keys bound to pcrs can't have an authorizer or an approver, or be duplicable")
+		}
+		calc, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
+		if err != nil {
+			return nil, err
+		}
+		policy, err := pcrPolicy(tpm, calc, opts.PCRs)
+		if err != nil {
+			return nil, err
+		}
+		if err := (tpm2.PolicyAuthValue{}).Update(calc); err != nil {
+			return nil, err
+		}
+		k.Policy = []*keyfile.TPMPolicy{policy, {CommandCode: int(tpm2.TPMCCPolicyAuthValue)}}
+		template.AuthPolicy = tpm2.TPM2BDigest{Buffer: calc.Hash().Digest}
+		template.ObjectAttributes.UserWithAuth = false
+	}
+
+	if opts.Duplicable {
+		if opts.Authorizer != nil || opts.Approver != nil {
+			return nil, errors.New("duplicable keys can't have an authorizer or an approver")
+		}
+		digest, err := policyDigest(duplicatePolicy)
+		if err != nil {
+			return nil, err
+		}
+		template.AuthPolicy = tpm2.TPM2BDigest{Buffer: digest}
+		template.ObjectAttributes.FixedTPM = false
+		template.ObjectAttributes.FixedParent = false
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	parenthandle, err := k.ParentHandle(sess, ownerauth)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.FlushHandle()
+
+	createKey := tpm2.Create{
+		ParentHandle: *parenthandle,
+		InPublic:     tpm2.New2B(template),
+	}
+
+	if !bytes.Equal(opts.Userauth, []byte("")) {
+		createKey.InSensitive = tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				UserAuth: tpm2.TPM2BAuth{
+					Buffer: opts.Userauth,
+				},
+			},
+		}
+	}
+
+	rsp, err := createKey.Execute(sess.GetTPM(), sess.GetHMAC())
+	if err != nil {
+		return nil, fmt.Errorf("failed creating TPM key: %w", err)
+	}
+
+	k.AddOptions(
+		keyfile.WithPubkey(rsp.OutPublic),
+		keyfile.WithPrivkey(rsp.OutPrivate),
+	)
+
+	if opts.Attest {
+		k.Attestation, err = certifyCreation(sess, parenthandle, k, rsp)
+		if err != nil {
+			return nil, err
+		}
+		if err := k.Attestation.addEndorsement(sess.GetTPM(), k.Parent); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// from crypto/ecdsa
+func addASN1IntBytes(b *cryptobyte.Builder, bytes []byte) {
+	for len(bytes) > 0 && bytes[0] == 0 {
+		bytes = bytes[1:]
+	}
+	if len(bytes) == 0 {
+		b.SetError(errors.New("invalid integer"))
+		return
+	}
+	b.AddASN1(asn1.INTEGER, func(c *cryptobyte.Builder) {
+		if bytes[0]&0x80 != 0 {
+			c.AddUint8(0)
+		}
+		c.AddBytes(bytes)
+	})
+}
+
+// from crypto/ecdsa
+func encodeSignature(r, s []byte) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		addASN1IntBytes(b, r)
+		addASN1IntBytes(b, s)
+	})
+	return b.Bytes()
+}
+
+func digestLength(digestalg tpm2.TPMAlgID) (int, error) {
+	switch digestalg {
+	case tpm2.TPMAlgSHA1:
+		return 20, nil
+	case tpm2.TPMAlgSHA256:
+		return 32, nil
+	case tpm2.TPMAlgSHA384:
+		return 48, nil
+	case tpm2.TPMAlgSHA512:
+		return 64, nil
+	}
+	return 0, fmt.Errorf("%v is not a supported hashing algorithm", digestalg)
+}
+
+// IsPSS returns true if the key was created with CreateOptions.PSS
+func (k *SSHTPMKey) IsPSS() bool {
+	pub, err := k.Pubkey.Contents()
+	if err != nil || pub.Type != tpm2.TPMAlgRSA {
+		return false
+	}
+	rsaDetail, err := pub.Parameters.RSADetail()
+	if err != nil {
+		return false
+	}
+	return rsaDetail.Scheme.Scheme == tpm2.TPMAlgRSAPSS
+}
+
+// Sign signs the digest with the key and returns an ASN.1 encoded ECDSA
+// signature or a PKCS#1 v1.5 RSA signature. Keys created with
+// CreateOptions.PSS return an RSA-PSS signature.
+func (k *SSHTPMKey) Sign(tpm transport.TPMCloser, ownerauth, auth, digest []byte, digestalg tpm2.TPMAlgID) ([]byte, error) {
+	length, err := digestLength(digestalg)
+	if err != nil {
+		return nil, err
+	}
+	if len(digest) != length {
+		return nil, fmt.Errorf("incorrect checksum length. expected %v got %v", length, len(digest))
+	}
+
+	if !k.HasSigner() {
+		return nil, fmt.Errorf("key does not have a signer")
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	var handle *tpm2.AuthHandle
+	switch {
+	case k.derived != nil:
+		handle, err = k.loadDerived(sess, ownerauth, auth)
+	case k.primary != "":
+		handle, err = k.loadPrimary(sess, ownerauth)
+	default:
+		handle, _, err = k.Load(sess, ownerauth)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer sess.FlushHandle()
+	defer keyfile.FlushHandle(tpm, handle)
+
+	cleanup, err := k.authorize(tpm, handle, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	var sigscheme tpm2.TPMTSigScheme
+	switch k.KeyAlgo() {
+	case tpm2.TPMAlgECC:
+		sigscheme = tpm2.TPMTSigScheme{
+			Scheme: tpm2.TPMAlgECDSA,
+			Details: tpm2.NewTPMUSigScheme(
+				tpm2.TPMAlgECDSA,
+				&tpm2.TPMSSchemeHash{HashAlg: digestalg},
+			),
+		}
+	case tpm2.TPMAlgRSA:
+		scheme := tpm2.TPMAlgRSASSA
+		if k.IsPSS() {
+			scheme = tpm2.TPMAlgRSAPSS
+		}
+		sigscheme = tpm2.TPMTSigScheme{
+			Scheme: scheme,
+			Details: tpm2.NewTPMUSigScheme(
+				scheme,
+				&tpm2.TPMSSchemeHash{HashAlg: digestalg},
+			),
+		}
+	}
+
+	rsp, err := tpm2.Sign{
+		KeyHandle: *handle,
+		Digest:    tpm2.TPM2BDigest{Buffer: digest},
+		InScheme:  sigscheme,
+		Validation: tpm2.TPMTTKHashCheck{
+			Tag: tpm2.TPMSTHashCheck,
+		},
+	}.Execute(tpm, sess.GetHMACIn())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+
+	switch k.KeyAlgo() {
+	case tpm2.TPMAlgECC:
+		eccsig, err := rsp.Signature.Signature.ECDSA()
+		if err != nil {
+			return nil, fmt.Errorf("failed getting signature: %v", err)
+		}
+		return encodeSignature(eccsig.SignatureR.Buffer, eccsig.SignatureS.Buffer)
+	case tpm2.TPMAlgRSA:
+		if k.IsPSS() {
+			rsapss, err := rsp.Signature.Signature.RSAPSS()
+			if err != nil {
+				return nil, fmt.Errorf("failed getting rsapss signature")
+			}
+			return rsapss.Sig.Buffer, nil
+		}
+		rsassa, err := rsp.Signature.Signature.RSASSA()
+		if err != nil {
+			return nil, fmt.Errorf("failed getting rsassa signature")
+		}
+		return rsassa.Sig.Buffer, nil
+	}
+	return nil, fmt.Errorf("failed returning signature")
+}
+
+// Decrypt decrypts RSA-OAEP ciphertext, encrypted with an empty label, with
+// the key.
+func (k *SSHTPMKey) Decrypt(tpm transport.TPMCloser, ownerauth, auth, ciphertext []byte, hashalg tpm2.TPMAlgID) ([]byte, error) {
+	if k.KeyAlgo() != tpm2.TPMAlgRSA {
+		return nil, fmt.Errorf("can only decrypt with rsa keys")
+	}
+
+	switch hashalg {
+	case tpm2.TPMAlgSHA1, tpm2.TPMAlgSHA256, tpm2.TPMAlgSHA384, tpm2.TPMAlgSHA512:
+	default:
+		return nil, fmt.Errorf("%v is not a supported hashing algorithm", hashalg)
+	}
+
+	pub, err := k.Pubkey.Contents()
+	if err != nil {
+		return nil, err
+	}
+	if !pub.ObjectAttributes.Decrypt {
+		return nil, fmt.Errorf("key can't be used for decryption")
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	handle, _, err := k.Load(sess, ownerauth)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.FlushHandle()
+	defer keyfile.FlushHandle(tpm, handle)
+
+	cleanup, err := k.authorize(tpm, handle, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	rsp, err := tpm2.RSADecrypt{
+		KeyHandle:  *handle,
+		CipherText: tpm2.TPM2BPublicKeyRSA{Buffer: ciphertext},
+		InScheme: tpm2.TPMTRSADecrypt{
+			Scheme: tpm2.TPMAlgOAEP,
+			Details: tpm2.NewTPMUAsymScheme(
+				tpm2.TPMAlgOAEP,
+				&tpm2.TPMSEncSchemeOAEP{HashAlg: hashalg},
+			),
+		},
+	}.Execute(tpm, sess.GetHMAC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return rsp.Message.Buffer, nil
+}
+
+var eccCurves = map[tpm2.TPMECCCurve]ecdh.Curve{
+	tpm2.TPMECCNistP256: ecdh.P256(),
+	tpm2.TPMECCNistP384: ecdh.P384(),
+	tpm2.TPMECCNistP521: ecdh.P521(),
+}
+
+// ECDH returns the x coordinate of the shared point between the key and peer.
+func (k *SSHTPMKey) ECDH(tpm transport.TPMCloser, ownerauth, auth []byte, peer *ecdh.PublicKey) ([]byte, error) {
+	if k.KeyAlgo() != tpm2.TPMAlgECC {
+		return nil, fmt.Errorf("can only derive with ecc keys")
+	}
+
+	pub, err := k.Pubkey.Contents()
+	if err != nil {
+		return nil, err
+	}
+	if !pub.ObjectAttributes.Decrypt {
+		return nil, fmt.Errorf("key can't be used for key agreement")
+	}
+	params, err := pub.Parameters.ECCDetail()
+	if err != nil {
+		return nil, err
+	}
+	if eccCurves[params.CurveID] != peer.Curve() {
+		return nil, fmt.Errorf("peer key is not on the curve of the key")
+	}
+
+	// Uncompressed point, 0x04 || X || Y
+	point := peer.Bytes()
+	size := (len(point) - 1) / 2
+
+	sess := keyfile.NewTPMSession(tpm)
+	handle, _, err := k.Load(sess, ownerauth)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.FlushHandle()
+	defer keyfile.FlushHandle(tpm, handle)
+
+	cleanup, err := k.authorize(tpm, handle, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	rsp, err := tpm2.ECDHZGen{
+		KeyHandle: *handle,
+		InPoint: tpm2.New2B(
+			tpm2.TPMSECCPoint{
+				X: tpm2.TPM2BECCParameter{Buffer: point[1 : 1+size]},
+				Y: tpm2.TPM2BECCParameter{Buffer: point[1+size:]},
+			},
+		),
+	}.Execute(tpm, sess.GetHMAC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive: %w", err)
+	}
+
+	shared, err := rsp.OutPoint.Contents()
+	if err != nil {
+		return nil, err
+	}
+	x := make([]byte, size)
+	copy(x[size-min(size, len(shared.X.Buffer)):], shared.X.Buffer)
+	return x, nil
+}
+
+// ChangeAuth changes the passphrase of the key. The private blob of the key
+// is changed in-place.
+func (k *SSHTPMKey) ChangeAuth(tpm transport.TPMCloser, ownerauth, oldpin, newpin []byte) error {
+	if !k.Keytype.Equal(keyfile.OIDLoadableKey) {
+		return fmt.Errorf("can only be used on loadable keys")
+	}
+
+	sess := keyfile.NewTPMSession(tpm)
+	handle, parenthandle, err := k.Load(sess, ownerauth)
+	if err != nil {
+		return err
+	}
+	defer sess.FlushHandle()
+	defer keyfile.FlushHandle(tpm, handle)
+
+	if len(oldpin) != 0 {
+		handle.Auth = tpm2.PasswordAuth(oldpin)
+	}
+
+	rsp, err := tpm2.ObjectChangeAuth{
+		ParentHandle: parenthandle,
+		ObjectHandle: *handle,
+		NewAuth: tpm2.TPM2BAuth{
+			Buffer: newpin,
+		},
+	}.Execute(tpm, sess.GetHMAC())
+	if err != nil {
+		return fmt.Errorf("ObjectChangeAuth failed: %w", err)
+	}
+
+	k.AddOptions(
+		keyfile.WithPrivkey(rsp.OutPrivate),
+		keyfile.WithUserAuth(newpin),
+	)
+	return nil
+}
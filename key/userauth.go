@@ -0,0 +1,98 @@
+package key
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// userauthMu guards the cached PINs of all keys, so they can be wiped while
+// other goroutines use the keys
+var userauthMu sync.Mutex
+
+// cachedUserauth is the memory a PIN is cached in
+type cachedUserauth struct {
+	mem []byte
+	// auth is the PIN in mem, it's never handed out as it's gone once mem
+	// is unmapped
+	auth []byte
+	// mem is a mapped and locked page, and not on the heap
+	mapped bool
+	expiry *time.Timer
+}
+
+// lockedCopy copies auth into memory which isn't swapped out, or onto the
+// heap if it can't be locked
+func lockedCopy(auth []byte) *cachedUserauth {
+	page := os.Getpagesize()
+	size := max((len(auth)+page-1)/page*page, page)
+	mem, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err == nil {
+		if err = unix.Mlock(mem); err != nil {
+			unix.Munmap(mem)
+		}
+	}
+	if err != nil {
+		slog.Debug("caching userauth in unlocked memory", slog.String("error", err.Error()))
+		return &cachedUserauth{mem: append([]byte(nil), auth...)}
+	}
+	return &cachedUserauth{mem: mem, mapped: true}
+}
+
+// CacheUserauth caches a copy of auth as the PIN of k, in memory locked from
+// being swapped out. The copy is wiped after ttl, unless it's zero.
+func (k *SSHTPMKey) CacheUserauth(auth []byte, ttl time.Duration) {
+	userauthMu.Lock()
+	defer userauthMu.Unlock()
+	k.forgetUserauth()
+	c := lockedCopy(auth)
+	c.auth = c.mem[:copy(c.mem, auth)]
+	if ttl != 0 {
+		c.expiry = time.AfterFunc(ttl, func() {
+			userauthMu.Lock()
+			defer userauthMu.Unlock()
+			// it was cached again in the meantime
+			if k.cached != c {
+				return
+			}
+			slog.Debug("forgetting expired userauth for key", slog.String("desc", k.Description))
+			k.forgetUserauth()
+		})
+	}
+	k.cached = c
+}
+
+// CachedUserauth returns a copy of the PIN cached for k, or nil without one.
+// Only the cache itself is locked memory, callers wipe the copy with clear
+// once the TPM command used it.
+func (k *SSHTPMKey) CachedUserauth() []byte {
+	userauthMu.Lock()
+	defer userauthMu.Unlock()
+	if k.cached == nil || len(k.cached.auth) == 0 {
+		return nil
+	}
+	return append([]byte(nil), k.cached.auth...)
+}
+
+// ForgetUserauth wipes the PIN cached for k with CacheUserauth
+func (k *SSHTPMKey) ForgetUserauth() {
+	userauthMu.Lock()
+	defer userauthMu.Unlock()
+	k.forgetUserauth()
+}
+
+func (k *SSHTPMKey) forgetUserauth() {
+	if c := k.cached; c != nil {
+		if c.expiry != nil {
+			c.expiry.Stop()
+		}
+		clear(c.mem)
+		if c.mapped {
+			unix.Munmap(c.mem)
+		}
+		k.cached = nil
+	}
+}
@@ -0,0 +1,315 @@
+package keystore
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"golang.org/x/crypto/scrypt"
+)
+
+// A backup is a gzipped tar of the key files and the metadata, encrypted
+// with AES-256-GCM under a key derived from a passphrase with scrypt:
+//
+//	magic || salt (16 bytes) || nonce (12 bytes) || ciphertext
+//
+// The magic, salt and nonce are authenticated as additional data. Key files
+// are stored below keys/ relative to the key directory, and the metadata as
+// metadata.json. An archive is the same tar, neither compressed nor encrypted.
+const backupMagic = "ssh-tpm-agent backup v1\n"
+
+const (
+	backupKeys     = "keys/"
+	backupMetadata = "metadata.json"
+	// scrypt parameters recommended for interactive use in 2017
+	scryptN = 1 << 15
+)
+
+var ErrBackupAuth = errors.New("wrong passphrase or the backup was modified")
+
+// ErrBackupConflict is returned by RestoreBackup when a file in the backup
+// would replace a different file in the key directory.
+var ErrBackupConflict = errors.New("file exists with different content")
+
+func backupKey(passphrase, salt []byte) (cipher.AEAD, error) {
+	k, err := scrypt.Key(passphrase, salt, scryptN, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// backupFiles returns the TPM keys in dir, with the public keys,
+// attestations, derived hosts and escrow copies next to them, relative to dir.
+func backupFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".tpm") {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if _, err := key.Decode(b); err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		base := strings.TrimSuffix(rel, ".tpm")
+		for _, ext := range []string{".pub", ".attest", ".hosts", ".escrow"} {
+			if _, err := os.Stat(filepath.Join(dir, base+ext)); err == nil {
+				files = append(files, base+ext)
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// writeTar writes the TPM keys in dir, with the files next to them, and the
+// metadata, which may be nil, as a tar to w. It returns the key files.
+func writeTar(w io.Writer, dir string, metadata *Metadata) ([]string, error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := backupFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(w)
+	add := func(name string, b []byte, mode fs.FileMode, modTime time.Time) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    int64(mode),
+			Size:    int64(len(b)),
+			ModTime: modTime,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	}
+
+	var keys []string
+	for _, f := range files {
+		p := filepath.Join(dir, f)
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(backupKeys+filepath.ToSlash(f), b, fi.Mode().Perm(), fi.ModTime()); err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(f, ".tpm") {
+			keys = append(keys, p)
+		}
+	}
+	if metadata != nil {
+		b, err := json.MarshalIndent(metadata.all(), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := add(backupMetadata, b, 0o600, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// readTar puts the files of a tar written by writeTar into dir with their
+// permissions and modification times, and merges the metadata of keys the
+// metadata, which may be nil, doesn't know about. Files which already exist
+// with the same content are skipped, and nothing is written if any exist
+// with a different content. It returns the written key files.
+func readTar(r io.Reader, dir string, metadata *Metadata) ([]string, error) {
+	tr := tar.NewReader(r)
+	files := map[string]*tar.Header{}
+	contents := map[string][]byte{}
+	var names []string
+	var meta map[string]*KeyMetadata
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == backupMetadata {
+			if err := json.Unmarshal(content, &meta); err != nil {
+				return nil, fmt.Errorf("invalid metadata: %w", err)
+			}
+			continue
+		}
+		name, ok := strings.CutPrefix(hdr.Name, backupKeys)
+		if !ok || hdr.Typeflag != tar.TypeReg || !filepath.IsLocal(filepath.FromSlash(name)) || path.Clean(name) != name {
+			return nil, fmt.Errorf("invalid file %q", hdr.Name)
+		}
+		name = filepath.FromSlash(name)
+		files[name] = hdr
+		contents[name] = content
+		names = append(names, name)
+	}
+
+	var write []string
+	for _, name := range names {
+		existing, err := os.ReadFile(filepath.Join(dir, name))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			write = append(write, name)
+		case err != nil:
+			return nil, err
+		case !bytes.Equal(existing, contents[name]):
+			return nil, fmt.Errorf("%w: %s", ErrBackupConflict, filepath.Join(dir, name))
+		}
+	}
+
+	var keys []string
+	for _, name := range write {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+			return nil, err
+		}
+		// the files are private keys, bits besides permissions are dropped
+		perm := fs.FileMode(files[name].Mode).Perm()
+		if err := utils.WriteFileAtomic(p, contents[name], perm); err != nil {
+			return nil, err
+		}
+		if modTime := files[name].ModTime; !modTime.IsZero() {
+			if err := os.Chtimes(p, modTime, modTime); err != nil {
+				return nil, err
+			}
+		}
+		if strings.HasSuffix(name, ".tpm") {
+			keys = append(keys, p)
+		}
+	}
+
+	if metadata != nil && len(meta) != 0 {
+		err := metadata.modify(func(keys map[string]*KeyMetadata) {
+			for fp, km := range meta {
+				if _, ok := keys[fp]; !ok && km != nil {
+					keys[fp] = km
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// WriteBackup writes an encrypted backup of the TPM keys in dir and of the
+// metadata, which may be nil, to w. It returns the backed up key files.
+func WriteBackup(w io.Writer, passphrase []byte, dir string, metadata *Metadata) ([]string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	keys, err := writeTar(zw, dir, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(backupMagic)+16+12)
+	copy(header, backupMagic)
+	if _, err := rand.Read(header[len(backupMagic):]); err != nil {
+		return nil, err
+	}
+	salt := header[len(backupMagic) : len(backupMagic)+16]
+	nonce := header[len(backupMagic)+16:]
+	aead, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(aead.Seal(header, nonce, buf.Bytes(), header)); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RestoreBackup restores a backup made by WriteBackup into dir, and merges
+// the metadata of keys the metadata, which may be nil, doesn't know about.
+// Files which already exist with the same content are skipped, and nothing
+// is restored if any exist with a different content. It returns the
+// restored key files.
+func RestoreBackup(r io.Reader, passphrase []byte, dir string, metadata *Metadata) ([]string, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := len(backupMagic) + 16 + 12
+	if len(b) < headerLen || !bytes.HasPrefix(b, []byte(backupMagic)) {
+		return nil, errors.New("not a ssh-tpm-agent backup")
+	}
+	header := b[:headerLen]
+	aead, err := backupKey(passphrase, header[len(backupMagic):len(backupMagic)+16])
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, header[len(backupMagic)+16:], b[headerLen:], header)
+	if err != nil {
+		return nil, ErrBackupAuth
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, err
+	}
+	return readTar(zr, dir, metadata)
+}
+
+// WriteArchive writes the TPM keys in dir, with the files next to them and
+// their permissions, and the metadata, which may be nil, to w as a plain tar.
+// Unlike a backup it isn't encrypted, the keys are only of use with the TPM
+// they were created on. It returns the archived key files.
+func WriteArchive(w io.Writer, dir string, metadata *Metadata) ([]string, error) {
+	return writeTar(w, dir, metadata)
+}
+
+// ImportArchive puts the files of an archive made by WriteArchive into dir
+// like RestoreBackup. It returns the imported key files.
+func ImportArchive(r io.Reader, dir string, metadata *Metadata) ([]string, error) {
+	return readTar(r, dir, metadata)
+}
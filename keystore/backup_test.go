@@ -0,0 +1,202 @@
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestBackup(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "work"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		filepath.Join("work", "id_ecdsa.tpm"): b,
+		filepath.Join("work", "id_ecdsa.pub"): k.AuthorizedKey(),
+	}
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not a TPM key
+	if err := os.WriteFile(filepath.Join(dir, "config"), []byte("Host *"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := OpenMetadata(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	if err := metadata.SetValidity(k.Fingerprint(), nil, &now); err != nil {
+		t.Fatal(err)
+	}
+
+	passphrase := []byte("passphrase")
+	var backup bytes.Buffer
+	keys, err := WriteBackup(&backup, passphrase, dir, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 backed up key, got %v", keys)
+	}
+
+	if _, err := RestoreBackup(bytes.NewReader(backup.Bytes()), []byte("wrong"), t.TempDir(), nil); !errors.Is(err, ErrBackupAuth) {
+		t.Fatalf("restored with the wrong passphrase: %v", err)
+	}
+	tampered := bytes.Clone(backup.Bytes())
+	tampered[len(tampered)-1] ^= 1
+	if _, err := RestoreBackup(bytes.NewReader(tampered), passphrase, t.TempDir(), nil); !errors.Is(err, ErrBackupAuth) {
+		t.Fatalf("restored a modified backup: %v", err)
+	}
+
+	restoreDir := t.TempDir()
+	restoredMetadata, err := OpenMetadata(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = RestoreBackup(bytes.NewReader(backup.Bytes()), passphrase, restoreDir, restoredMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 restored key, got %v", keys)
+	}
+	for name, b := range files {
+		restored, err := os.ReadFile(filepath.Join(restoreDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(restored, b) {
+			t.Fatalf("%s differs", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(restoreDir, "config")); err == nil {
+		t.Fatal("restored a file which is not a key")
+	}
+	if km := restoredMetadata.Get(k.Fingerprint()); km.NotAfter == nil || !km.NotAfter.Equal(now) {
+		t.Fatalf("metadata not restored: %+v", km)
+	}
+
+	// restoring again skips the same files
+	if keys, err := RestoreBackup(bytes.NewReader(backup.Bytes()), passphrase, restoreDir, nil); err != nil || len(keys) != 0 {
+		t.Fatalf("restoring again: %v %v", keys, err)
+	}
+	pub := filepath.Join(restoreDir, "work", "id_ecdsa.pub")
+	if err := os.WriteFile(pub, []byte("other"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreBackup(bytes.NewReader(backup.Bytes()), passphrase, restoreDir, nil); !errors.Is(err, ErrBackupConflict) {
+		t.Fatalf("replaced a different file: %v", err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	files := map[string]os.FileMode{
+		"id_ecdsa.tpm": 0o600,
+		"id_ecdsa.pub": 0o644,
+	}
+	for name, perm := range files {
+		b, err := k.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Ext(name) == ".pub" {
+			b = k.AuthorizedKey()
+		}
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, b, perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata, err := OpenMetadata(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := metadata.SetAlgorithms(k.Fingerprint(), []string{"ecdsa-sha2-nistp256"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	keys, err := WriteArchive(&archive, dir, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 archived key, got %v", keys)
+	}
+
+	importDir := t.TempDir()
+	importedMetadata, err := OpenMetadata(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = ImportArchive(bytes.NewReader(archive.Bytes()), importDir, importedMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 imported key, got %v", keys)
+	}
+	for name, perm := range files {
+		fi, err := os.Stat(filepath.Join(importDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != perm || !fi.ModTime().Equal(modTime) {
+			t.Fatalf("%s: expected %v at %v, got %v at %v", name, perm, modTime, fi.Mode().Perm(), fi.ModTime())
+		}
+	}
+	if km := importedMetadata.Get(k.Fingerprint()); km.AllowsAlgorithm("ecdsa-sha2-nistp384") {
+		t.Fatalf("metadata not imported: %+v", km)
+	}
+
+	// a backup isn't an archive
+	var backup bytes.Buffer
+	if _, err := WriteBackup(&backup, []byte("passphrase"), dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportArchive(bytes.NewReader(backup.Bytes()), t.TempDir(), nil); err == nil {
+		t.Fatal("imported a backup as an archive")
+	}
+}
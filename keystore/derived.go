@@ -0,0 +1,96 @@
+package keystore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// The keys derived from a deriver are listed in a .hosts file next to it,
+// with the host and the public key of the derived key on each line:
+//
+//	example.com ecdsa-sha2-nistp256 AAAA...
+//
+// The public keys are recorded so the keys can be listed without deriving
+// them, which needs the passphrase of the deriver.
+func hostsFile(deriverPath string) string {
+	return strings.TrimSuffix(deriverPath, ".tpm") + ".hosts"
+}
+
+// derivedKeys returns the keys listed in the hosts file of the deriver.
+func derivedKeys(deriverPath string, deriver *key.SSHTPMKey) ([]*key.SSHTPMKey, error) {
+	b, err := os.ReadFile(hostsFile(deriverPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []*key.SSHTPMKey
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		host, authorizedKey, _ := strings.Cut(line, " ")
+		pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", hostsFile(deriverPath), n, err)
+		}
+		k, err := key.NewDerived(deriver, host, pk)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", hostsFile(deriverPath), n, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, s.Err()
+}
+
+// writeDerived rewrites the hosts file of the deriver with the host of k
+// dropped, and added again with k if add is set.
+func writeDerived(deriverPath string, k *key.SSHTPMKey, add bool) error {
+	path := hostsFile(deriverPath)
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var out bytes.Buffer
+	found := false
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		if host, _, _ := strings.Cut(strings.TrimSpace(line), " "); host == k.DerivedHost() {
+			found = true
+			continue
+		}
+		out.WriteString(line + "\n")
+	}
+	if !add && !found {
+		return fmt.Errorf("key not found")
+	}
+	if add {
+		pk, err := k.SSHPublicKey()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&out, "%s %s", k.DerivedHost(), ssh.MarshalAuthorizedKey(pk))
+	}
+	return utils.WriteFileAtomic(path, out.Bytes(), 0o600)
+}
+
+// AddDerived records the key derived from the deriver at deriverPath, so the
+// agent lists it. An earlier key for the same host is replaced.
+func AddDerived(deriverPath string, k *key.SSHTPMKey) error {
+	if k.DerivedHost() == "" {
+		return errors.New("not a derived key")
+	}
+	return writeDerived(deriverPath, k, true)
+}
@@ -0,0 +1,79 @@
+package keystore
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestDerivedKeys(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	deriver, err := key.NewDeriver(tpm, []byte(""), []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	deriverPath := filepath.Join(dir, "id_derive.tpm")
+	b, err := deriver.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(deriverPath, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"example.com", "example.org", "example.com"} {
+		k, err := deriver.Derive(tpm, []byte(""), []byte(""), host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := AddDerived(deriverPath, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := &Dir{Path: dir}
+	hosts := func() []string {
+		keys, err := d.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hosts []string
+		for _, k := range keys {
+			hosts = append(hosts, k.DerivedHost())
+		}
+		slices.Sort(hosts)
+		return hosts
+	}
+	if got := hosts(); !slices.Equal(got, []string{"example.com", "example.org"}) {
+		t.Fatalf("unexpected derived keys %v", got)
+	}
+
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := hosts(); len(got) != 1 || got[0] == keys[0].DerivedHost() {
+		t.Fatalf("unexpected derived keys after removing %s: %v", keys[0].DerivedHost(), got)
+	}
+
+	files, err := backupFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(files, "id_derive.hosts") {
+		t.Fatal("hosts file is not backed up")
+	}
+}
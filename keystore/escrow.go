@@ -0,0 +1,158 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+)
+
+// Escrow copies are the OpenSSH private key, encrypted with
+// ChaCha20-Poly1305 to the escrow public key like ssh-tpm-creds credentials:
+// for ECDSA escrow keys the encryption key is derived with HKDF-SHA256 from
+// an ephemeral ECDH share, for RSA it's encrypted with OAEP-SHA256.
+const (
+	escrowPEM   = "SSH TPM ESCROW"
+	escrowLabel = "ssh-tpm-agent escrow"
+)
+
+var ErrNotEscrow = errors.New("not an escrow copy")
+
+type escrowBlob struct {
+	Recipient  []byte
+	Share      []byte
+	WrappedKey []byte
+	Ciphertext []byte
+}
+
+func escrowKey(shared, share, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, share...), recipient...)
+	k := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(escrowLabel)), k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Escrow encrypts the private key to the ECDSA or RSA escrow public key, for
+// an administrator to recover imported keys with RecoverEscrow.
+func Escrow(recipient crypto.PublicKey, privateKey crypto.PrivateKey, comment string) ([]byte, error) {
+	pub, err := ssh.NewPublicKey(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported escrow key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(privateKey, comment)
+	if err != nil {
+		return nil, err
+	}
+	blob := escrowBlob{Recipient: pub.Marshal()}
+
+	var encKey []byte
+	switch k := recipient.(type) {
+	case *ecdsa.PublicKey:
+		ecdhpub, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := ecdhpub.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(ecdhpub)
+		if err != nil {
+			return nil, err
+		}
+		blob.Share = ephemeral.PublicKey().Bytes()
+		encKey, err = escrowKey(shared, blob.Share, ecdhpub.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	case *rsa.PublicKey:
+		encKey = make([]byte, chacha20poly1305.KeySize)
+		if _, err := rand.Read(encKey); err != nil {
+			return nil, err
+		}
+		blob.WrappedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, k, encKey, nil)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported escrow key %s", pub.Type())
+	}
+
+	aead, err := chacha20poly1305.New(encKey)
+	if err != nil {
+		return nil, err
+	}
+	// Each copy has a new key, so the nonce can be fixed
+	blob.Ciphertext = aead.Seal(nil, make([]byte, aead.NonceSize()), pem.EncodeToMemory(block), blob.Recipient)
+	return pem.EncodeToMemory(&pem.Block{Type: escrowPEM, Bytes: ssh.Marshal(blob)}), nil
+}
+
+// RecoverEscrow decrypts an escrow copy with the escrow private key and
+// returns the OpenSSH private key.
+func RecoverEscrow(b []byte, privateKey crypto.Signer) ([]byte, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != escrowPEM {
+		return nil, ErrNotEscrow
+	}
+	var blob escrowBlob
+	if err := ssh.Unmarshal(block.Bytes, &blob); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotEscrow, err)
+	}
+	pub, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(pub.Marshal(), blob.Recipient) {
+		return nil, errors.New("escrow copy is for another escrow key")
+	}
+
+	var encKey []byte
+	switch k := privateKey.(type) {
+	case *ecdsa.PrivateKey:
+		priv, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		share, err := priv.Curve().NewPublicKey(blob.Share)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNotEscrow, err)
+		}
+		shared, err := priv.ECDH(share)
+		if err != nil {
+			return nil, err
+		}
+		encKey, err = escrowKey(shared, blob.Share, priv.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+	case *rsa.PrivateKey:
+		encKey, err = rsa.DecryptOAEP(sha256.New(), nil, k, blob.WrappedKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed decrypting escrow copy: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported escrow key %T", privateKey)
+	}
+
+	aead, err := chacha20poly1305.New(encKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), blob.Ciphertext, blob.Recipient)
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting escrow copy: %w", err)
+	}
+	return plaintext, nil
+}
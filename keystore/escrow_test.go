@@ -0,0 +1,66 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestEscrow(t *testing.T) {
+	imported, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecc, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{"ecdsa", ecc},
+		{"rsa", rsaKey},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := Escrow(c.key.Public(), imported, "user@host")
+			if err != nil {
+				t.Fatal(err)
+			}
+			recovered, err := RecoverEscrow(b, c.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := ssh.ParseRawPrivateKey(recovered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !imported.Equal(raw) {
+				t.Fatal("recovered another key")
+			}
+
+			other := crypto.Signer(ecc)
+			if c.key == ecc {
+				other = rsaKey
+			}
+			if _, err := RecoverEscrow(b, other); err == nil {
+				t.Fatal("recovered the escrow copy with another key")
+			}
+		})
+	}
+
+	if _, err := RecoverEscrow([]byte("not an escrow copy"), ecc); !errors.Is(err, ErrNotEscrow) {
+		t.Fatalf("expected ErrNotEscrow, got %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+// Package keystore loads and saves TPM keys, in directories of key files, NV
+// indices or backups, along with their metadata.
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+)
+
+// Keystore is a place TPM keys are loaded from.
+type Keystore interface {
+	Keys() ([]*key.SSHTPMKey, error)
+}
+
+// Watcher is a keystore that can tell when its keys change.
+type Watcher interface {
+	// Watch starts watching the keystore and calls changed when keys are
+	// added, changed or removed, until done is closed.
+	Watch(done <-chan interface{}, changed func()) error
+}
+
+// Remover is a keystore keys can be removed from.
+type Remover interface {
+	Remove(k *key.SSHTPMKey) error
+}
+
+// DefaultGlob matches the key files of a Dir without a Glob.
+const DefaultGlob = "*.tpm"
+
+// ErrReadOnly is returned when changing the keys of a read-only keystore
+var ErrReadOnly = errors.New("the keystore is read-only")
+
+// Dir is a keystore of key files in a directory tree. Glob matches the names
+// of the key files, DefaultGlob when empty. A ReadOnly directory, like one
+// shipped on an immutable image, is never written to.
+type Dir struct {
+	Path     string
+	Glob     string
+	ReadOnly bool
+}
+
+// match reports if the file name matches the glob of the directory
+func (d *Dir) match(path string) bool {
+	glob := d.Glob
+	if glob == "" {
+		glob = DefaultGlob
+	}
+	ok, _ := filepath.Match(glob, filepath.Base(path))
+	return ok
+}
+
+// Dirs is a search path of key directories, like a read-only system directory
+// of machine keys and the directory of the user. Keys in earlier directories
+// take precedence.
+type Dirs []*Dir
+
+var (
+	_ Keystore = &Dir{}
+	_ Watcher  = &Dir{}
+	_ Remover  = &Dir{}
+
+	_ Keystore = Dirs{}
+	_ Watcher  = Dirs{}
+	_ Remover  = Dirs{}
+)
+
+var errKeyNotFound = errors.New("key not found")
+
+// NewDirs returns the keystore of a colon separated list of directories, with
+// key files matching glob.
+func NewDirs(path, glob string) Dirs {
+	var dirs Dirs
+	for _, p := range filepath.SplitList(path) {
+		if p != "" {
+			dirs = append(dirs, &Dir{Path: p, Glob: glob})
+		}
+	}
+	return dirs
+}
+
+func (d *Dir) Keys() ([]*key.SSHTPMKey, error) {
+	keyDir, err := filepath.EvalSymlinks(d.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*key.SSHTPMKey
+
+	walkFunc := func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if de.IsDir() {
+			return nil
+		}
+
+		// the previous version kept by utils.WriteFileAtomic
+		if strings.HasSuffix(path, utils.BackupSuffix) {
+			return nil
+		}
+
+		if !d.match(path) {
+			slog.Debug("skipping key: does not match the key glob", slog.String("name", path))
+			return nil
+		}
+
+		f, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed reading %s", path)
+		}
+
+		k, err := key.Decode(f)
+		if err != nil {
+			if errors.Is(err, key.ErrOldKey) {
+				slog.Info("TPM key is in an old format. Will not load it.", slog.String("key_path", path), slog.String("error", err.Error()))
+
+			} else if errors.Is(err, key.ErrNewerFormat) {
+				slog.Info("TPM key is in a newer format. Will not load it.", slog.String("key_path", path), slog.String("error", err.Error()))
+			} else {
+				slog.Debug("not a TPM sealed key", slog.String("key_path", path), slog.String("error", err.Error()))
+			}
+			return nil
+		}
+
+		if !d.ReadOnly {
+			migrateKeyFile(path, f)
+		}
+
+		if k.IsDeriver() {
+			derived, err := derivedKeys(path, k)
+			if err != nil {
+				slog.Info("failed reading derived keys", slog.String("key_path", path), slog.String("error", err.Error()))
+				return nil
+			}
+			keys = append(keys, derived...)
+			slog.Debug("added derived keys", slog.String("name", path), slog.Int("keys", len(derived)))
+			return nil
+		}
+
+		if !k.HasSigner() {
+			slog.Debug("skipping key: not a signing key", slog.String("key_path", path))
+			return nil
+		}
+
+		keys = append(keys, k)
+
+		slog.Debug("added TPM key", slog.String("name", path))
+		return nil
+	}
+
+	err = filepath.WalkDir(keyDir, walkFunc)
+	return keys, err
+}
+
+// migrateKeyFile upgrades the key file at path with the content b to the
+// current format, keeping the old file next to it. A key which can't be
+// written is still used as it is.
+func migrateKeyFile(path string, b []byte) {
+	migrated, err := key.Migrate(b)
+	if err != nil {
+		slog.Info("failed migrating TPM key", slog.String("key_path", path), slog.String("error", err.Error()))
+		return
+	}
+	if migrated == nil {
+		return
+	}
+	perm := fs.FileMode(0o600)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	if err := utils.WriteFileAtomic(path, migrated, perm); err != nil {
+		slog.Info("TPM key is in an old format and can't be migrated. Converting it in memory.", slog.String("key_path", path), slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("migrated TPM key to the current format", slog.String("key_path", path), slog.String("backup", path+utils.BackupSuffix))
+}
+
+// Remove deletes the files of the key, with the public key and attestation
+// next to them. Derived keys are removed from the hosts file of their
+// deriver. Keys of a ReadOnly directory aren't removed.
+func (d *Dir) Remove(k *key.SSHTPMKey) error {
+	keyDir, err := filepath.EvalSymlinks(d.Path)
+	if err != nil {
+		return err
+	}
+	deriver := k.Deriver()
+	var files []string
+	err = filepath.WalkDir(keyDir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() || !d.match(path) {
+			return nil
+		}
+		f, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		dk, err := key.Decode(f)
+		switch {
+		case err != nil:
+			return nil
+		case deriver != nil:
+			if !bytes.Equal(dk.Pubkey.Bytes(), deriver.Pubkey.Bytes()) {
+				return nil
+			}
+		case !dk.HasSigner() || dk.Fingerprint() != k.Fingerprint():
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errKeyNotFound
+	}
+	if d.ReadOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, d.Path)
+	}
+	if deriver != nil {
+		return writeDerived(files[0], k, false)
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+		if err := os.Remove(f + utils.BackupSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		base := strings.TrimSuffix(f, ".tpm")
+		for _, ext := range []string{".pub", ".attest"} {
+			if err := os.Remove(base + ext); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exists reports if the directory is there, missing directories in the search
+// path are skipped
+func (d *Dir) exists() (bool, error) {
+	_, err := os.Stat(d.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Debug("skipping missing key directory", slog.String("path", d.Path))
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Keys merges the keys of the directories. A key in more than one directory is
+// only loaded from the first one.
+func (ds Dirs) Keys() ([]*key.SSHTPMKey, error) {
+	var keys []*key.SSHTPMKey
+	seen := map[string]bool{}
+	for _, d := range ds {
+		if ok, err := d.exists(); !ok {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		dirKeys, err := d.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range dirKeys {
+			if seen[k.Fingerprint()] {
+				slog.Debug("skipping key: already loaded from an earlier directory", slog.String("fingerprint", k.Fingerprint()), slog.String("path", d.Path))
+				continue
+			}
+			seen[k.Fingerprint()] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// Watch watches all directories of the search path which exist.
+func (ds Dirs) Watch(done <-chan interface{}, changed func()) error {
+	for _, d := range ds {
+		if ok, err := d.exists(); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.Watch(done, changed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes the key from the first directory it's in.
+func (ds Dirs) Remove(k *key.SSHTPMKey) error {
+	for _, d := range ds {
+		if ok, err := d.exists(); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := d.Remove(k)
+		if !errors.Is(err, errKeyNotFound) {
+			return err
+		}
+	}
+	return errKeyNotFound
+}
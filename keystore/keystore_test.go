@@ -0,0 +1,204 @@
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestDirs(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	system, user := t.TempDir(), t.TempDir()
+	write := func(dir, name string, k *key.SSHTPMKey) {
+		b, err := k.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	machine, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	personal, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(system, "machine.tpm", machine)
+	write(user, "id_ecdsa.tpm", personal)
+	write(user, "copy.tpm", machine)
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	ds := NewDirs(strings.Join([]string{system, missing, user}, string(filepath.ListSeparator)), "")
+	if len(ds) != 3 {
+		t.Fatalf("expected 3 directories, got %d", len(ds))
+	}
+	keys, err := ds.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	if keys[0].Fingerprint() != machine.Fingerprint() || keys[1].Fingerprint() != personal.Fingerprint() {
+		t.Fatal("keys are not in search path order")
+	}
+
+	if err := ds.Remove(personal); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(user, "id_ecdsa.tpm")); !os.IsNotExist(err) {
+		t.Fatal("key was not removed from the user directory")
+	}
+	if err := ds.Remove(personal); err == nil {
+		t.Fatal("removed a key which isn't in the keystore")
+	}
+}
+
+func TestDirGlob(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"id_ecdsa.tpm", "ssh.key", "other.tpm"} {
+		b, err := k.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		glob string
+		keys int
+	}{
+		{"", 2},
+		{"id_*.tpm", 1},
+		{"ssh.key", 1},
+		{"*.pem", 0},
+	} {
+		keys, err := (&Dir{Path: dir, Glob: c.glob}).Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != c.keys {
+			t.Fatalf("glob %q: expected %d keys, got %d", c.glob, c.keys, len(keys))
+		}
+	}
+}
+
+func TestMigration(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "id_ecdsa.tpm")
+	old := k.TPMKey.Bytes()
+	if err := os.WriteFile(path, old, 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewDirs(dir, "").Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Fingerprint() != k.Fingerprint() {
+		t.Fatal("migrated key wasn't loaded")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := key.Format(b); err != nil || version != key.FormatVersion {
+		t.Fatalf("key file wasn't migrated, format %d: %v", version, err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Fatalf("permissions of the key file weren't kept: %v", err)
+	}
+	bak, err := os.ReadFile(path + utils.BackupSuffix)
+	if err != nil || !bytes.Equal(bak, old) {
+		t.Fatalf("old key file wasn't kept: %v", err)
+	}
+}
+
+func TestReadOnlyDir(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	system, user := t.TempDir(), t.TempDir()
+	old := k.TPMKey.Bytes()
+	path := filepath.Join(system, "machine.tpm")
+	if err := os.WriteFile(path, old, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	personal, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := personal.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(user, "id_ecdsa.tpm"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := Dirs{{Path: system, ReadOnly: true}, {Path: user}}
+	keys, err := ds.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	if b, err := os.ReadFile(path); err != nil || !bytes.Equal(b, old) {
+		t.Fatalf("key of the read-only directory was migrated: %v", err)
+	}
+	if err := ds.Remove(k); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	// keys of other directories can still be removed
+	if err := ds.Remove(personal); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,280 @@
+package keystore
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"golang.org/x/sys/unix"
+)
+
+// KeyMetadata is what is recorded about a key outside of the key.
+type KeyMetadata struct {
+	LastUsed time.Time `json:"last_used,omitempty"`
+	Uses     uint64    `json:"uses,omitempty"`
+
+	// Validity window of the key, set on creation
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+
+	Created *KeyCreation `json:"created,omitempty"`
+
+	// Signature algorithms the key may sign with, e.g. rsa-sha2-512, or any
+	// if empty
+	Algorithms []string `json:"algorithms,omitempty"`
+}
+
+// KeyCreation records where and how a key was created.
+type KeyCreation struct {
+	Time            time.Time `json:"time"`
+	Host            string    `json:"host,omitempty"`
+	TPMManufacturer string    `json:"tpm_manufacturer,omitempty"`
+	TPMFirmware     string    `json:"tpm_firmware,omitempty"`
+	// the key type and the template of its parent
+	Template string `json:"template,omitempty"`
+}
+
+// NewKeyCreation returns the KeyCreation of k, created now on this host with
+// tpm.
+func NewKeyCreation(tpm transport.TPMCloser, k *key.SSHTPMKey) *KeyCreation {
+	c := &KeyCreation{Time: time.Now().UTC(), Template: keyTemplate(k)}
+	c.Host, _ = os.Hostname()
+	if info, err := utils.ReadTPMInfo(tpm); err == nil {
+		c.TPMManufacturer = info.Manufacturer
+		c.TPMFirmware = info.FirmwareVersion
+	}
+	return c
+}
+
+// keyTemplate describes the type of k and the parent it was created under,
+// e.g. "ecdsa-sha2-nistp256 under the ecc srk of the owner hierarchy"
+func keyTemplate(k *key.SSHTPMKey) string {
+	typ := "unknown"
+	if pk, err := k.SSHPublicKey(); err == nil {
+		typ = pk.Type()
+	}
+	if key.IsEKHandle(k.Parent) {
+		return fmt.Sprintf("%s under the endorsement key", typ)
+	}
+	srk := "ecc"
+	if k.RSAParent {
+		srk = "rsa"
+	}
+	switch k.Parent {
+	case tpm2.TPMRHOwner:
+		return fmt.Sprintf("%s under the %s srk of the owner hierarchy", typ, srk)
+	case tpm2.TPMRHEndorsement:
+		return fmt.Sprintf("%s under the %s srk of the endorsement hierarchy", typ, srk)
+	case tpm2.TPMRHNull:
+		return fmt.Sprintf("%s under the %s srk of the null hierarchy", typ, srk)
+	case tpm2.TPMRHPlatform:
+		return fmt.Sprintf("%s under the %s srk of the platform hierarchy", typ, srk)
+	}
+	return fmt.Sprintf("%s under the parent 0x%x", typ, uint32(k.Parent))
+}
+
+// Valid reports if t is within the validity window
+func (km KeyMetadata) Valid(t time.Time) bool {
+	if km.NotBefore != nil && t.Before(*km.NotBefore) {
+		return false
+	}
+	if km.NotAfter != nil && t.After(*km.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// AllowsAlgorithm reports if the key may sign with the signature algorithm
+func (km KeyMetadata) AllowsAlgorithm(alg string) bool {
+	return len(km.Algorithms) == 0 || slices.Contains(km.Algorithms, alg)
+}
+
+// Metadata keeps KeyMetadata by SSH key fingerprint in a JSON file. The file
+// is shared between the agent and ssh-tpm-keygen, so it is re-read when it
+// changes and updated under a lock.
+type Metadata struct {
+	Path string
+
+	mu   sync.Mutex
+	keys map[string]*KeyMetadata
+
+	// the file as it was last read or written
+	fi os.FileInfo
+
+	// with sealed metadata Path is a directory of encrypted files, see
+	// OpenSealedMetadata
+	aead cipher.AEAD
+}
+
+// OpenMetadata reads the metadata file at path. A missing file is empty.
+func OpenMetadata(path string) (*Metadata, error) {
+	m := &Metadata{Path: path, keys: map[string]*KeyMetadata{}}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load reads the file if it changed since it was last read
+func (m *Metadata) load() error {
+	fi, err := os.Stat(m.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// updates replace the file, so an unchanged file is the same one
+	if m.fi != nil && os.SameFile(m.fi, fi) && m.fi.ModTime().Equal(fi.ModTime()) {
+		return nil
+	}
+	if m.aead != nil {
+		keys, err := m.loadSealed()
+		if errors.Is(err, ErrMetadataModified) && m.fi != nil {
+			// the metadata read last is kept, and written back by the
+			// next update
+			slog.Warn("ignoring modified key metadata", slog.String("error", err.Error()))
+			m.fi = fi
+			return nil
+		} else if err != nil {
+			return err
+		}
+		m.keys = keys
+		m.fi = fi
+		return nil
+	}
+	b, err := os.ReadFile(m.Path)
+	if err != nil {
+		return err
+	}
+	keys := map[string]*KeyMetadata{}
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return fmt.Errorf("failed parsing %s: %w", m.Path, err)
+	}
+	m.keys = keys
+	m.fi = fi
+	return nil
+}
+
+// Get returns the metadata of the key with the fingerprint
+func (m *Metadata) Get(fingerprint string) KeyMetadata {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_ = m.load()
+	if km, ok := m.keys[fingerprint]; ok {
+		return *km
+	}
+	return KeyMetadata{}
+}
+
+// all returns a copy of the metadata of all keys
+func (m *Metadata) all() map[string]*KeyMetadata {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_ = m.load()
+	keys := make(map[string]*KeyMetadata, len(m.keys))
+	for fp, km := range m.keys {
+		c := *km
+		keys[fp] = &c
+	}
+	return keys
+}
+
+// update changes the metadata of the key with the fingerprint and saves it
+func (m *Metadata) update(fingerprint string, f func(*KeyMetadata)) error {
+	return m.modify(func(keys map[string]*KeyMetadata) {
+		km, ok := keys[fingerprint]
+		if !ok {
+			km = &KeyMetadata{}
+			keys[fingerprint] = km
+		}
+		f(km)
+	})
+}
+
+// modify changes the metadata of all keys under the file lock and saves it
+func (m *Metadata) modify(f func(map[string]*KeyMetadata)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(m.Path), 0o700); err != nil {
+		return err
+	}
+	lockPath := m.Path + ".lock"
+	if m.aead != nil {
+		lockPath = filepath.Join(m.Path, ".lock")
+	}
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+
+	if err := m.load(); err != nil {
+		return err
+	}
+	f(m.keys)
+	return m.save()
+}
+
+// RecordUse counts a use of the key with the fingerprint at t
+func (m *Metadata) RecordUse(fingerprint string, t time.Time) error {
+	return m.update(fingerprint, func(km *KeyMetadata) {
+		km.Uses++
+		km.LastUsed = t.UTC()
+	})
+}
+
+// SetValidity sets the validity window of the key with the fingerprint. Nil
+// times leave the window open on that end.
+func (m *Metadata) SetValidity(fingerprint string, notBefore, notAfter *time.Time) error {
+	return m.update(fingerprint, func(km *KeyMetadata) {
+		km.NotBefore = notBefore
+		km.NotAfter = notAfter
+	})
+}
+
+// SetCreation records how the key with the fingerprint was created
+func (m *Metadata) SetCreation(fingerprint string, c *KeyCreation) error {
+	return m.update(fingerprint, func(km *KeyMetadata) {
+		km.Created = c
+	})
+}
+
+// SetAlgorithms restricts the key with the fingerprint to the signature
+// algorithms, none lifts the restriction.
+func (m *Metadata) SetAlgorithms(fingerprint string, algs []string) error {
+	return m.update(fingerprint, func(km *KeyMetadata) {
+		km.Algorithms = algs
+	})
+}
+
+func (m *Metadata) save() error {
+	if m.aead != nil {
+		return m.saveSealed()
+	}
+	b, err := json.MarshalIndent(m.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.Path, b); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(m.Path); err == nil {
+		m.fi = fi
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package keystore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "metadata.json")
+	m, err := OpenMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if km := m.Get("SHA256:key"); km.Uses != 0 {
+		t.Fatalf("expected unused key, got %+v", km)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		if err := m.RecordUse("SHA256:key", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err = OpenMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km := m.Get("SHA256:key")
+	if km.Uses != 3 || !km.LastUsed.Equal(now) {
+		t.Fatalf("unexpected metadata %+v", km)
+	}
+	if !km.AllowsAlgorithm("ssh-rsa") {
+		t.Fatal("unrestricted key doesn't allow ssh-rsa")
+	}
+
+	if err := m.SetAlgorithms("SHA256:key", []string{"rsa-sha2-512"}); err != nil {
+		t.Fatal(err)
+	}
+	km = m.Get("SHA256:key")
+	if km.AllowsAlgorithm("ssh-rsa") || !km.AllowsAlgorithm("rsa-sha2-512") || km.Uses != 3 {
+		t.Fatalf("unexpected metadata %+v", km)
+	}
+}
+
+func TestKeyCreation(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte(""), keyfile.WithParent(tpm2.TPMRHOwner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewKeyCreation(tpm, k)
+	if c.Template != "ecdsa-sha2-nistp256 under the ecc srk of the owner hierarchy" {
+		t.Fatalf("unexpected template %q", c.Template)
+	}
+	if c.TPMManufacturer == "" || c.Time.IsZero() {
+		t.Fatalf("incomplete creation %+v", c)
+	}
+
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	m, err := OpenMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetCreation(k.Fingerprint(), c); err != nil {
+		t.Fatal(err)
+	}
+	m, err = OpenMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km := m.Get(k.Fingerprint())
+	if km.Created == nil || km.Created.Template != c.Template || km.Created.Host != c.Host || !km.Created.Time.Equal(c.Time) {
+		t.Fatalf("unexpected creation %+v", km.Created)
+	}
+}
@@ -0,0 +1,263 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+var (
+	// Start of the NV indices used by the keystore. This is inside the owner
+	// range of the TCG handle registry.
+	DefaultNVBase tpm2.TPMHandle = 0x01805300
+
+	// Number of NV indices used by the keystore.
+	DefaultNVCount = 16
+
+	ErrNVFull = errors.New("no free nv index for the key")
+
+	// Header of the data stored in the NV index, followed by an uint16 length
+	// and the key file.
+	nvMagic = []byte("SSHTPM")
+)
+
+// NV is a keystore storing key files in TPM NV indices, for machines that can't
+// persist files.
+//
+// The indices are readable without authorization, as the keys are wrapped by
+// the TPM and worthless without it. Writing and deleting keys requires owner
+// authorization.
+type NV struct {
+	Base  tpm2.TPMHandle
+	Count int
+	// ReadOnly refuses to save and remove keys
+	ReadOnly bool
+
+	tpm       tpmconn.Opener
+	ownerAuth func() ([]byte, error)
+}
+
+var (
+	_ Keystore = &NV{}
+	_ Remover  = &NV{}
+)
+
+func NewNV(tpm tpmconn.Opener, ownerAuth func() ([]byte, error)) *NV {
+	return &NV{
+		Base:      DefaultNVBase,
+		Count:     DefaultNVCount,
+		tpm:       tpm,
+		ownerAuth: ownerAuth,
+	}
+}
+
+func (n *NV) indices() []tpm2.TPMHandle {
+	var handles []tpm2.TPMHandle
+	for i := 0; i < n.Count; i++ {
+		handles = append(handles, n.Base+tpm2.TPMHandle(i))
+	}
+	return handles
+}
+
+func decodeNV(data []byte) (*key.SSHTPMKey, error) {
+	if !bytes.HasPrefix(data, nvMagic) || len(data) < len(nvMagic)+2 {
+		return nil, errors.New("not a ssh-tpm-agent nv index")
+	}
+	data = data[len(nvMagic):]
+	length := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if length > len(data) {
+		return nil, errors.New("truncated nv index")
+	}
+	return key.Decode(pem.EncodeToMemory(&pem.Block{
+		Type:  "TSS2 PRIVATE KEY",
+		Bytes: data[:length],
+	}))
+}
+
+func encodeNV(k *key.SSHTPMKey) ([]byte, error) {
+	// Store the DER to save space in the index
+	pemBytes, err := k.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("failed encoding key")
+	}
+	var b []byte
+	b = append(b, nvMagic...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(block.Bytes)))
+	b = append(b, block.Bytes...)
+	return b, nil
+}
+
+// Keys returns the keys stored in the NV indices
+func (n *NV) Keys() ([]*key.SSHTPMKey, error) {
+	tpm, err := n.tpm.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.Close()
+
+	var keys []*key.SSHTPMKey
+	for _, index := range n.indices() {
+		data, err := key.ReadNV(tpm, index)
+		if errors.Is(err, tpm2.TPMRCHandle) {
+			continue
+		} else if err != nil {
+			slog.Debug("failed reading nv index", slog.String("index", fmt.Sprintf("0x%x", index)), slog.String("error", err.Error()))
+			continue
+		}
+
+		k, err := decodeNV(data)
+		if err != nil {
+			slog.Debug("not a TPM sealed key", slog.String("index", fmt.Sprintf("0x%x", index)), slog.String("error", err.Error()))
+			continue
+		}
+
+		keys = append(keys, k)
+		slog.Debug("added TPM key", slog.String("index", fmt.Sprintf("0x%x", index)))
+	}
+	return keys, nil
+}
+
+// Save stores the key in the first free NV index and returns the index.
+func (n *NV) Save(k *key.SSHTPMKey) (tpm2.TPMHandle, error) {
+	if n.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	tpm, err := n.tpm.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer tpm.Close()
+
+	data, err := encodeNV(k)
+	if err != nil {
+		return 0, err
+	}
+
+	ownerauth, err := n.ownerAuth()
+	if err != nil {
+		return 0, err
+	}
+
+	var index tpm2.TPMHandle
+	for _, i := range n.indices() {
+		_, err := tpm2.NVReadPublic{NVIndex: i}.Execute(tpm)
+		if errors.Is(err, tpm2.TPMRCHandle) {
+			index = i
+			break
+		}
+	}
+	if index == 0 {
+		return 0, ErrNVFull
+	}
+
+	owner := tpm2.AuthHandle{
+		Handle: tpm2.TPMRHOwner,
+		Auth:   tpm2.PasswordAuth(ownerauth),
+	}
+
+	_, err = tpm2.NVDefineSpace{
+		AuthHandle: owner,
+		PublicInfo: tpm2.New2B(tpm2.TPMSNVPublic{
+			NVIndex: index,
+			NameAlg: tpm2.TPMAlgSHA256,
+			Attributes: tpm2.TPMANV{
+				OwnerWrite: true,
+				AuthRead:   true,
+				NoDA:       true,
+				NT:         tpm2.TPMNTOrdinary,
+			},
+			DataSize: uint16(len(data)),
+		}),
+	}.Execute(tpm)
+	if err != nil {
+		return 0, fmt.Errorf("failed defining nv index: %w", err)
+	}
+
+	pub, err := tpm2.NVReadPublic{NVIndex: index}.Execute(tpm)
+	if err != nil {
+		return 0, err
+	}
+
+	bufMax := key.NVBufferMax(tpm)
+	for offset := 0; offset < len(data); offset += bufMax {
+		end := min(offset+bufMax, len(data))
+		_, err := tpm2.NVWrite{
+			AuthHandle: owner,
+			NVIndex: tpm2.NamedHandle{
+				Handle: index,
+				Name:   pub.NVName,
+			},
+			Data:   tpm2.TPM2BMaxNVBuffer{Buffer: data[offset:end]},
+			Offset: uint16(offset),
+		}.Execute(tpm)
+		if err != nil {
+			n.undefine(tpm, ownerauth, index)
+			return 0, fmt.Errorf("failed writing nv index: %w", err)
+		}
+	}
+	return index, nil
+}
+
+func (n *NV) undefine(tpm transport.TPM, ownerauth []byte, index tpm2.TPMHandle) error {
+	pub, err := tpm2.NVReadPublic{NVIndex: index}.Execute(tpm)
+	if err != nil {
+		return err
+	}
+	_, err = tpm2.NVUndefineSpace{
+		AuthHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMRHOwner,
+			Auth:   tpm2.PasswordAuth(ownerauth),
+		},
+		NVIndex: tpm2.NamedHandle{
+			Handle: index,
+			Name:   pub.NVName,
+		},
+	}.Execute(tpm)
+	return err
+}
+
+// Remove deletes the NV index holding the key
+func (n *NV) Remove(k *key.SSHTPMKey) error {
+	if n.ReadOnly {
+		return ErrReadOnly
+	}
+	tpm, err := n.tpm.Open()
+	if err != nil {
+		return err
+	}
+	defer tpm.Close()
+
+	ownerauth, err := n.ownerAuth()
+	if err != nil {
+		return err
+	}
+
+	for _, index := range n.indices() {
+		data, err := key.ReadNV(tpm, index)
+		if err != nil {
+			continue
+		}
+		nk, err := decodeNV(data)
+		if err != nil {
+			continue
+		}
+		if nk.Fingerprint() != k.Fingerprint() {
+			continue
+		}
+		return n.undefine(tpm, ownerauth, index)
+	}
+	return fmt.Errorf("key not found")
+}
@@ -0,0 +1,112 @@
+package keystore
+
+import (
+	"testing"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn/tpmconntest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+func TestNVKeystore(t *testing.T) {
+	opener, tpm := tpmconntest.Simulator(t)
+
+	ks := NewNV(
+		opener,
+		func() ([]byte, error) { return []byte(""), nil },
+	)
+	ks.Count = 2
+
+	var keys []*key.SSHTPMKey
+	for _, alg := range []tpm2.TPMAlgID{tpm2.TPMAlgECC, tpm2.TPMAlgRSA} {
+		k, err := key.NewSSHTPMKey(tpm, alg, 0, []byte(""),
+			keyfile.WithDescription("nv key"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ks.Save(k); err != nil {
+			t.Fatalf("failed saving key: %v", err)
+		}
+		keys = append(keys, k)
+	}
+
+	if _, err := ks.Save(keys[0]); err != ErrNVFull {
+		t.Fatalf("expected full keystore, got: %v", err)
+	}
+
+	loaded, err := ks.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(loaded))
+	}
+	for i, k := range loaded {
+		if k.Fingerprint() != keys[i].Fingerprint() {
+			t.Fatalf("fingerprint mismatch")
+		}
+		if k.Description != "nv key" {
+			t.Fatalf("wrong description: %s", k.Description)
+		}
+	}
+
+	if err := ks.Remove(keys[0]); err != nil {
+		t.Fatalf("failed removing key: %v", err)
+	}
+	loaded, err = ks.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || loaded[0].Fingerprint() != keys[1].Fingerprint() {
+		t.Fatalf("wrong key removed")
+	}
+}
+
+// countingOpener counts the transports opened and closed through it
+type countingOpener struct {
+	tpm    transport.TPMCloser
+	opened int
+	closed int
+}
+
+func (c *countingOpener) Open() (transport.TPMCloser, error) {
+	c.opened++
+	return countingTPM{c.tpm, c}, nil
+}
+
+type countingTPM struct {
+	transport.TPMCloser
+	c *countingOpener
+}
+
+func (t countingTPM) Close() error {
+	t.c.closed++
+	return nil
+}
+
+func TestNVKeystoreClosesTPM(t *testing.T) {
+	_, tpm := tpmconntest.Simulator(t)
+	opener := &countingOpener{tpm: tpm}
+	ks := NewNV(opener, func() ([]byte, error) { return []byte(""), nil })
+	ks.Count = 1
+
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 0, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Save(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Keys(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Remove(k); err != nil {
+		t.Fatal(err)
+	}
+	if opener.opened == 0 || opener.opened != opener.closed {
+		t.Fatalf("opened %d transports and closed %d", opener.opened, opener.closed)
+	}
+}
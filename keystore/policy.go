@@ -0,0 +1,159 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/foxboron/ssh-tpm-agent/sshsig"
+	"golang.org/x/crypto/ssh"
+)
+
+// PolicyNamespace is the namespace policy manifests are signed in, with
+// ssh-keygen -Y sign -n ssh-tpm-agent-policy.
+const PolicyNamespace = "ssh-tpm-agent-policy"
+
+var ErrPolicyRollback = errors.New("policy is older than the current policy")
+
+// Policy is a key policy provisioned centrally for a fleet of machines. The
+// JSON manifest is signed by an administrator, the signature is next to it
+// with a .sig suffix.
+type Policy struct {
+	// Serial increases with each manifest, older manifests are rejected
+	Serial uint64 `json:"serial"`
+
+	// Algorithms are the SSH key types the agent uses, all when empty
+	Algorithms []string `json:"algorithms,omitempty"`
+
+	// Confirm requires a confirmation for each use of any key, ConfirmKeys
+	// only for the keys with these fingerprints
+	Confirm     bool     `json:"confirm,omitempty"`
+	ConfirmKeys []string `json:"confirm_keys,omitempty"`
+
+	// RenewalURL is the enrollment endpoint renewing certificates, see
+	// ssh-tpm-agent enroll
+	RenewalURL string `json:"renewal_url,omitempty"`
+
+	manifest, signature []byte
+}
+
+// Allows reports if keys of the type of pk may be used
+func (p *Policy) Allows(pk ssh.PublicKey) bool {
+	if p == nil || len(p.Algorithms) == 0 {
+		return true
+	}
+	if cert, ok := pk.(*ssh.Certificate); ok {
+		pk = cert.Key
+	}
+	return slices.Contains(p.Algorithms, pk.Type())
+}
+
+// NeedsConfirm reports if each use of the key with the fingerprint has to
+// be confirmed
+func (p *Policy) NeedsConfirm(fingerprint string) bool {
+	return p != nil && (p.Confirm || slices.Contains(p.ConfirmKeys, fingerprint))
+}
+
+// ParsePolicy verifies the armored signature of the manifest with the
+// administrator keys and parses it.
+func ParsePolicy(manifest, signature []byte, keys []ssh.PublicKey) (*Policy, error) {
+	sig, err := sshsig.Unarmor(signature)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(keys, func(k ssh.PublicKey) bool {
+		return bytes.Equal(k.Marshal(), sig.PublicKey.Marshal())
+	}) {
+		return nil, fmt.Errorf("policy is signed by an unknown key %s", ssh.FingerprintSHA256(sig.PublicKey))
+	}
+	if err := sshsig.Verify(sig, bytes.NewReader(manifest), PolicyNamespace); err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(manifest, &p); err != nil {
+		return nil, fmt.Errorf("failed parsing policy: %w", err)
+	}
+	p.manifest = manifest
+	p.signature = signature
+	return &p, nil
+}
+
+var policyTimeout = time.Minute
+
+// readPolicySource reads a http(s) URL or a file
+func readPolicySource(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "http://") {
+		return os.ReadFile(source)
+	}
+	client := &http.Client{Timeout: policyTimeout}
+	rsp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", source, rsp.Status)
+	}
+	return io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+}
+
+// FetchPolicy reads the manifest and its signature from source, a URL or a
+// file dropped by device management, and verifies it with the administrator
+// keys.
+func FetchPolicy(source string, keys []ssh.PublicKey) (*Policy, error) {
+	manifest, err := readPolicySource(source)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := readPolicySource(source + ".sig")
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(manifest, signature, keys)
+}
+
+// Update returns next if it may replace p, and ErrPolicyRollback if it is an
+// older manifest.
+func (p *Policy) Update(next *Policy) (*Policy, error) {
+	if p != nil && next.Serial < p.Serial {
+		return p, fmt.Errorf("%w: serial %d, current %d", ErrPolicyRollback, next.Serial, p.Serial)
+	}
+	return next, nil
+}
+
+// Save writes the signed manifest to path and path.sig, so the policy is
+// kept while the source can't be reached.
+func (p *Policy) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name string
+		b    []byte
+	}{{path + ".sig", p.signature}, {path, p.manifest}} {
+		tmp, err := os.CreateTemp(filepath.Dir(path), ".policy")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(f.b); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), f.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/sshsig"
+	"golang.org/x/crypto/ssh"
+)
+
+func signPolicy(t *testing.T, s ssh.Signer, namespace string, manifest []byte) []byte {
+	t.Helper()
+	sig, err := sshsig.Sign(s.(ssh.AlgorithmSigner), bytes.NewReader(manifest), namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig.Armor()
+}
+
+func TestPolicy(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := ssh.NewSignerFromKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	admin, other := newSigner(), newSigner()
+	keys := []ssh.PublicKey{admin.PublicKey()}
+
+	manifest := []byte(`{"serial": 2, "algorithms": ["ecdsa-sha2-nistp256"], "confirm_keys": ["SHA256:key"], "renewal_url": "https://ca.example.com/enroll"}`)
+	dir := t.TempDir()
+	source := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(source, manifest, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(source+".sig", signPolicy(t, admin, PolicyNamespace, manifest), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := FetchPolicy(source, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Serial != 2 || p.RenewalURL != "https://ca.example.com/enroll" {
+		t.Fatalf("wrong policy %+v", p)
+	}
+	if !p.Allows(admin.PublicKey()) {
+		t.Fatal("ecdsa key not allowed")
+	}
+	if !p.NeedsConfirm("SHA256:key") || p.NeedsConfirm("SHA256:other") {
+		t.Fatal("wrong confirmation keys")
+	}
+	var none *Policy
+	if !none.Allows(admin.PublicKey()) || none.NeedsConfirm("SHA256:key") {
+		t.Fatal("no policy restricts keys")
+	}
+
+	cache := filepath.Join(dir, "cache", "policy.json")
+	if err := p.Save(cache); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchPolicy(cache, keys); err != nil {
+		t.Fatalf("failed reading saved policy: %v", err)
+	}
+
+	if _, err := ParsePolicy(manifest, signPolicy(t, other, PolicyNamespace, manifest), keys); err == nil {
+		t.Fatal("accepted policy signed by another key")
+	}
+	if _, err := ParsePolicy(manifest, signPolicy(t, admin, "file", manifest), keys); err == nil {
+		t.Fatal("accepted policy signed in another namespace")
+	}
+	modified := bytes.Replace(manifest, []byte(`"serial": 2`), []byte(`"serial": 9`), 1)
+	if _, err := ParsePolicy(modified, signPolicy(t, admin, PolicyNamespace, manifest), keys); err == nil {
+		t.Fatal("accepted modified policy")
+	}
+
+	old, err := ParsePolicy([]byte(`{"serial": 1}`), signPolicy(t, admin, PolicyNamespace, []byte(`{"serial": 1}`)), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Update(old); !errors.Is(err, ErrPolicyRollback) {
+		t.Fatalf("expected rollback error, got %v", err)
+	}
+}
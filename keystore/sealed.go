@@ -0,0 +1,196 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// Sealed metadata keeps the KeyMetadata of each key in its own file in a
+// directory, encrypted with AES-256-GCM under a secret sealed to the TPM in
+// secret.tpm:
+//
+//	magic || nonce (12 bytes) || ciphertext
+//
+// The magic and the file name are authenticated as additional data, so a
+// modified file, or the file of one key put in place of another, is detected.
+// Removed files aren't.
+const sealedMetadataMagic = "ssh-tpm-agent metadata v1\n"
+
+const (
+	sealedMetadataSecret = "secret.tpm"
+	sealedMetadataExt    = ".meta"
+)
+
+var ErrMetadataModified = errors.New("key metadata was modified outside of ssh-tpm-agent")
+
+// sealedKeyMetadata is the content of the file of a key
+type sealedKeyMetadata struct {
+	Fingerprint string       `json:"fingerprint"`
+	Metadata    *KeyMetadata `json:"metadata"`
+}
+
+// OpenSealedMetadata opens the sealed metadata in dir, which is created with
+// a new secret sealed to tpm if it doesn't exist. The secret is unsealed once,
+// the TPM isn't used after.
+func OpenSealedMetadata(dir string, tpm transport.TPMCloser, ownerPassword []byte) (*Metadata, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	secret, err := metadataSecret(filepath.Join(dir, sealedMetadataSecret), tpm, ownerPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed unsealing the metadata secret: %w", err)
+	}
+	defer clear(secret)
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{Path: dir, keys: map[string]*KeyMetadata{}, aead: aead}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// metadataSecret unseals the secret in path, or seals a new one there
+func metadataSecret(path string, tpm transport.TPMCloser, ownerPassword []byte) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		k, err := key.Seal(tpm, ownerPassword, secret, nil, keyfile.WithDescription("ssh-tpm-agent metadata"))
+		if err != nil {
+			return nil, err
+		}
+		b, err := k.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := utils.WriteFileAtomic(path, b, 0o600); err != nil {
+			return nil, err
+		}
+		return secret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	k, err := key.Decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k.Unseal(tpm, ownerPassword, nil)
+}
+
+// sealedFileName is the name of the file of the key with the fingerprint
+func sealedFileName(fingerprint string) string {
+	return strings.NewReplacer(":", "_", "/", "_", "+", "-").Replace(fingerprint) + sealedMetadataExt
+}
+
+func sealedAD(name string) []byte {
+	return append([]byte(sealedMetadataMagic), name...)
+}
+
+// loadSealed reads the files of all keys in the directory
+func (m *Metadata) loadSealed() (map[string]*KeyMetadata, error) {
+	entries, err := os.ReadDir(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]*KeyMetadata{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, sealedMetadataExt) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(m.Path, name))
+		if err != nil {
+			return nil, err
+		}
+		km, err := m.open(name, b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(m.Path, name), err)
+		}
+		keys[km.Fingerprint] = km.Metadata
+	}
+	return keys, nil
+}
+
+// open decrypts the file name with the content b
+func (m *Metadata) open(name string, b []byte) (*sealedKeyMetadata, error) {
+	rest, ok := bytes.CutPrefix(b, []byte(sealedMetadataMagic))
+	if !ok || len(rest) < m.aead.NonceSize() {
+		return nil, ErrMetadataModified
+	}
+	nonce, ciphertext := rest[:m.aead.NonceSize()], rest[m.aead.NonceSize():]
+	plaintext, err := m.aead.Open(nil, nonce, ciphertext, sealedAD(name))
+	if err != nil {
+		return nil, ErrMetadataModified
+	}
+	var km sealedKeyMetadata
+	if err := json.Unmarshal(plaintext, &km); err != nil {
+		return nil, err
+	}
+	if km.Metadata == nil || sealedFileName(km.Fingerprint) != name {
+		return nil, ErrMetadataModified
+	}
+	return &km, nil
+}
+
+// saveSealed writes the files of all keys, replacing each atomically
+func (m *Metadata) saveSealed() error {
+	for fp, km := range m.keys {
+		name := sealedFileName(fp)
+		plaintext, err := json.Marshal(sealedKeyMetadata{Fingerprint: fp, Metadata: km})
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, m.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		b := append([]byte(sealedMetadataMagic), nonce...)
+		b = m.aead.Seal(b, nonce, plaintext, sealedAD(name))
+		if err := writeFileAtomic(filepath.Join(m.Path, name), b); err != nil {
+			return err
+		}
+	}
+	if fi, err := os.Stat(m.Path); err == nil {
+		m.fi = fi
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with b through a temporary file
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".metadata")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,94 @@
+package keystore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestSealedMetadata(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	dir := filepath.Join(t.TempDir(), "metadata")
+	m, err := OpenSealedMetadata(dir, tpm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	for _, fp := range []string{"SHA256:a/b+c", "SHA256:other"} {
+		if err := m.RecordUse(fp, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SetAlgorithms("SHA256:a/b+c", []string{"rsa-sha2-512"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second opening unseals the same secret
+	m, err = OpenSealedMetadata(dir, tpm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km := m.Get("SHA256:a/b+c")
+	if km.Uses != 1 || !km.LastUsed.Equal(now) || km.AllowsAlgorithm("ssh-rsa") {
+		t.Fatalf("unexpected metadata %+v", km)
+	}
+
+	// the file of one key in place of another
+	name := filepath.Join(dir, sealedFileName("SHA256:a/b+c"))
+	restricted, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := os.ReadFile(filepath.Join(dir, sealedFileName("SHA256:other")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, other, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSealedMetadata(dir, tpm, nil); !errors.Is(err, ErrMetadataModified) {
+		t.Fatalf("expected ErrMetadataModified for a swapped file, got %v", err)
+	}
+
+	flipped := append([]byte(nil), restricted...)
+	flipped[len(flipped)-1] ^= 1
+	if err := os.WriteFile(name, flipped, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSealedMetadata(dir, tpm, nil); !errors.Is(err, ErrMetadataModified) {
+		t.Fatalf("expected ErrMetadataModified for a modified file, got %v", err)
+	}
+
+	// while open, the metadata read before is kept and written back
+	if err := os.WriteFile(name, restricted, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err = OpenSealedMetadata(dir, tpm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name+".tmp", flipped, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		t.Fatal(err)
+	}
+	if km := m.Get("SHA256:a/b+c"); km.AllowsAlgorithm("ssh-rsa") {
+		t.Fatalf("modified metadata was used %+v", km)
+	}
+	if err := m.RecordUse("SHA256:other", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSealedMetadata(dir, tpm, nil); err != nil {
+		t.Fatalf("modified file wasn't written back: %v", err)
+	}
+}
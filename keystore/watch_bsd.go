@@ -0,0 +1,176 @@
+//go:build freebsd || openbsd || netbsd || dragonfly
+
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	watchEvents = unix.NOTE_WRITE | unix.NOTE_EXTEND | unix.NOTE_ATTRIB |
+		unix.NOTE_DELETE | unix.NOTE_RENAME
+
+	// Writing a key touches a couple of files, wait for things to settle
+	// before reloading.
+	watchSettle = 100 * time.Millisecond
+
+	// kqueue can't be woken up by closing it, so the watch checks if it
+	// is done this often.
+	watchPoll = time.Second
+)
+
+// watchedFile is what a reload depends on of a directory or key file
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// kqueueWatch keeps an open file for each watched directory and key file,
+// which kqueue needs to watch them.
+type kqueueWatch struct {
+	kq    int
+	dir   *Dir
+	files map[string]watchFd
+}
+
+// watchFd is the open file of a path, and the inode it was opened as. Key
+// files are replaced by renaming over them, and are opened again then.
+type watchFd struct {
+	fd  int
+	ino uint64
+}
+
+// scan watches the directories and key files of the tree which aren't yet,
+// stops watching the ones which are gone, and returns their state.
+func (w *kqueueWatch) scan(root string) (map[string]watchedFile, error) {
+	state := map[string]watchedFile{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path != root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && !w.dir.match(path) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			state[path] = watchedFile{}
+		} else {
+			state[path] = watchedFile{size: fi.Size(), modTime: fi.ModTime()}
+		}
+		var ino uint64
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			ino = uint64(st.Ino)
+		}
+		if f, ok := w.files[path]; ok {
+			if f.ino == ino {
+				return nil
+			}
+			unix.Close(f.fd)
+			delete(w.files, path)
+		}
+		fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("failed watching %s: %w", path, err)
+		}
+		var ev unix.Kevent_t
+		unix.SetKevent(&ev, fd, unix.EVFILT_VNODE, unix.EV_ADD|unix.EV_CLEAR)
+		ev.Fflags = watchEvents
+		if _, err := unix.Kevent(w.kq, []unix.Kevent_t{ev}, nil, nil); err != nil {
+			unix.Close(fd)
+			return fmt.Errorf("failed watching %s: %w", path, err)
+		}
+		w.files[path] = watchFd{fd: fd, ino: ino}
+		return nil
+	})
+	for path, f := range w.files {
+		if _, ok := state[path]; !ok {
+			unix.Close(f.fd)
+			delete(w.files, path)
+		}
+	}
+	return state, err
+}
+
+func (w *kqueueWatch) close() {
+	for _, f := range w.files {
+		unix.Close(f.fd)
+	}
+	unix.Close(w.kq)
+}
+
+// Watch watches the directory tree for .tpm files with kqueue. kqueue only
+// tells that a directory or file changed and not what, so the tree is scanned
+// again and compared to find out if keys changed.
+func (d *Dir) Watch(done <-chan interface{}, changed func()) error {
+	keyDir, err := filepath.EvalSymlinks(d.Path)
+	if err != nil {
+		return err
+	}
+
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return fmt.Errorf("failed creating kqueue: %w", err)
+	}
+	unix.CloseOnExec(kq)
+	w := &kqueueWatch{kq: kq, dir: d, files: map[string]watchFd{}}
+	state, err := w.scan(keyDir)
+	if err != nil {
+		w.close()
+		return err
+	}
+
+	go func() {
+		defer w.close()
+		var settle *time.Timer
+		events := make([]unix.Kevent_t, 64)
+		timeout := unix.NsecToTimespec(int64(watchPoll))
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n, err := unix.Kevent(w.kq, nil, events, &timeout)
+			if errors.Is(err, unix.EINTR) {
+				continue
+			} else if err != nil {
+				slog.Error("watching keystore failed", slog.String("error", err.Error()))
+				return
+			}
+			if n == 0 {
+				continue
+			}
+
+			newState, err := w.scan(keyDir)
+			if err != nil {
+				slog.Debug("failed watching keystore", slog.String("path", keyDir), slog.String("error", err.Error()))
+			}
+			if maps.Equal(state, newState) {
+				continue
+			}
+			state = newState
+			slog.Debug("key files changed", slog.String("path", keyDir))
+			if settle == nil {
+				settle = time.AfterFunc(watchSettle, changed)
+			} else {
+				settle.Reset(watchSettle)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,121 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	watchEvents = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_DELETE |
+		unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF
+
+	// Writing a key touches a couple of files, wait for things to settle
+	// before reloading.
+	watchSettle = 100 * time.Millisecond
+)
+
+// Watch watches the directory tree for .tpm files with inotify.
+func (d *Dir) Watch(done <-chan interface{}, changed func()) error {
+	keyDir, err := filepath.EvalSymlinks(d.Path)
+	if err != nil {
+		return err
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed creating inotify instance: %w", err)
+	}
+	// The non-blocking fd makes the runtime poller unblock Read on Close
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	dirs := map[int32]string{}
+	watch := func(dir string) error {
+		return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			wd, err := unix.InotifyAddWatch(fd, path, watchEvents)
+			if err != nil {
+				return fmt.Errorf("failed watching %s: %w", path, err)
+			}
+			dirs[int32(wd)] = path
+			return nil
+		})
+	}
+	if err := watch(keyDir); err != nil {
+		f.Close()
+		return err
+	}
+
+	go func() {
+		<-done
+		f.Close()
+	}()
+
+	go func() {
+		defer f.Close()
+		var settle *time.Timer
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.PathMax))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					slog.Error("watching keystore failed", slog.String("error", err.Error()))
+				}
+				return
+			}
+
+			reload := false
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := strings.TrimRight(string(buf[off+unix.SizeofInotifyEvent:off+unix.SizeofInotifyEvent+int(ev.Len)]), "\x00")
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+
+				dir, ok := dirs[ev.Wd]
+				if !ok {
+					continue
+				}
+				path := filepath.Join(dir, name)
+
+				switch {
+				case ev.Mask&unix.IN_DELETE_SELF != 0:
+					delete(dirs, ev.Wd)
+					reload = true
+				case ev.Mask&unix.IN_ISDIR != 0:
+					if ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+						if err := watch(path); err != nil {
+							slog.Debug("failed watching new directory", slog.String("path", path), slog.String("error", err.Error()))
+						}
+					}
+					reload = true
+				case d.match(name) && ev.Mask&unix.IN_CREATE == 0:
+					// Wait for the file to be written rather than created
+					slog.Debug("key file changed", slog.String("path", path))
+					reload = true
+				}
+			}
+
+			if !reload {
+				continue
+			}
+			if settle == nil {
+				settle = time.AfterFunc(watchSettle, changed)
+			} else {
+				settle.Reset(watchSettle)
+			}
+		}
+	}()
+	return nil
+}
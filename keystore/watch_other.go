@@ -0,0 +1,9 @@
+//go:build !linux && !freebsd && !openbsd && !netbsd && !dragonfly
+
+package keystore
+
+import "errors"
+
+func (d *Dir) Watch(done <-chan interface{}, changed func()) error {
+	return errors.New("watching the keystore is only supported on linux")
+}
@@ -0,0 +1,62 @@
+//go:build linux || freebsd || openbsd || netbsd || dragonfly
+
+package keystore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirWatch(t *testing.T) {
+	dir := t.TempDir()
+	done := make(chan interface{})
+	defer close(done)
+
+	changed := make(chan struct{}, 10)
+	d := &Dir{Path: dir}
+	if err := d.Watch(done, func() { changed <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(what string, want bool) {
+		t.Helper()
+		select {
+		case <-changed:
+			if !want {
+				t.Fatalf("%s: unexpected reload", what)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if want {
+				t.Fatalf("%s: expected reload", what)
+			}
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "id_ecdsa.pub"), []byte("pub"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expect("public key", false)
+
+	if err := os.WriteFile(filepath.Join(dir, "id_ecdsa.tpm"), []byte("key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expect("new key", true)
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	expect("new directory", true)
+
+	if err := os.WriteFile(filepath.Join(sub, "id_rsa.tpm"), []byte("key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expect("key in new directory", true)
+
+	if err := os.Remove(filepath.Join(dir, "id_ecdsa.tpm")); err != nil {
+		t.Fatal(err)
+	}
+	expect("removed key", true)
+}
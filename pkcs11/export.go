@@ -0,0 +1,450 @@
+package main
+
+/*
+#include "pkcs11.h"
+*/
+import "C"
+
+import (
+	"net"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// slotID is the only slot of the module
+const slotID = 0
+
+var (
+	mu  sync.Mutex
+	tok *token
+)
+
+func agentDial() (net.Conn, error) {
+	if socket, ok := os.LookupEnv("SSH_TPM_AUTH_SOCK"); ok {
+		return net.Dial("unix", socket)
+	}
+	return net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+}
+
+func initialized() (*token, C.CK_RV) {
+	mu.Lock()
+	defer mu.Unlock()
+	if tok == nil {
+		return nil, ckrCryptokiNotInitialized
+	}
+	return tok, ckrOK
+}
+
+// padded copies s into the blank padded PKCS#11 string field
+func padded(dst unsafe.Pointer, size int, s string) {
+	b := unsafe.Slice((*byte)(dst), size)
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+}
+
+//export C_Initialize
+func C_Initialize(pInitArgs C.CK_VOID_PTR) C.CK_RV {
+	mu.Lock()
+	defer mu.Unlock()
+	if tok != nil {
+		return ckrCryptokiAlreadyInit
+	}
+	tok = newToken(agentDial)
+	return ckrOK
+}
+
+//export C_Finalize
+func C_Finalize(pReserved C.CK_VOID_PTR) C.CK_RV {
+	if pReserved != nil {
+		return ckrArgumentsBad
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if tok == nil {
+		return ckrCryptokiNotInitialized
+	}
+	tok = nil
+	return ckrOK
+}
+
+//export C_GetInfo
+func C_GetInfo(pInfo C.CK_INFO_PTR) C.CK_RV {
+	if _, rv := initialized(); rv != ckrOK {
+		return rv
+	}
+	if pInfo == nil {
+		return ckrArgumentsBad
+	}
+	pInfo.cryptokiVersion = C.CK_VERSION{major: C.CRYPTOKI_VERSION_MAJOR, minor: C.CRYPTOKI_VERSION_MINOR}
+	padded(unsafe.Pointer(&pInfo.manufacturerID), len(pInfo.manufacturerID), "ssh-tpm-agent")
+	pInfo.flags = 0
+	padded(unsafe.Pointer(&pInfo.libraryDescription), len(pInfo.libraryDescription), "ssh-tpm-agent PKCS#11 module")
+	pInfo.libraryVersion = C.CK_VERSION{major: 0, minor: 1}
+	return ckrOK
+}
+
+//export C_GetSlotList
+func C_GetSlotList(tokenPresent C.CK_BBOOL, pSlotList C.CK_SLOT_ID_PTR, pulCount C.CK_ULONG_PTR) C.CK_RV {
+	if _, rv := initialized(); rv != ckrOK {
+		return rv
+	}
+	if pulCount == nil {
+		return ckrArgumentsBad
+	}
+	if pSlotList != nil {
+		if *pulCount < 1 {
+			*pulCount = 1
+			return ckrBufferTooSmall
+		}
+		*pSlotList = slotID
+	}
+	*pulCount = 1
+	return ckrOK
+}
+
+//export C_GetSlotInfo
+func C_GetSlotInfo(slot C.CK_SLOT_ID, pInfo C.CK_SLOT_INFO_PTR) C.CK_RV {
+	if _, rv := initialized(); rv != ckrOK {
+		return rv
+	}
+	if slot != slotID {
+		return ckrSlotIDInvalid
+	}
+	if pInfo == nil {
+		return ckrArgumentsBad
+	}
+	padded(unsafe.Pointer(&pInfo.slotDescription), len(pInfo.slotDescription), "ssh-tpm-agent")
+	padded(unsafe.Pointer(&pInfo.manufacturerID), len(pInfo.manufacturerID), "ssh-tpm-agent")
+	pInfo.flags = C.CKF_TOKEN_PRESENT
+	pInfo.hardwareVersion = C.CK_VERSION{}
+	pInfo.firmwareVersion = C.CK_VERSION{}
+	return ckrOK
+}
+
+//export C_GetTokenInfo
+func C_GetTokenInfo(slot C.CK_SLOT_ID, pInfo C.CK_TOKEN_INFO_PTR) C.CK_RV {
+	if _, rv := initialized(); rv != ckrOK {
+		return rv
+	}
+	if slot != slotID {
+		return ckrSlotIDInvalid
+	}
+	if pInfo == nil {
+		return ckrArgumentsBad
+	}
+	*pInfo = C.CK_TOKEN_INFO{}
+	padded(unsafe.Pointer(&pInfo.label), len(pInfo.label), "ssh-tpm-agent")
+	padded(unsafe.Pointer(&pInfo.manufacturerID), len(pInfo.manufacturerID), "ssh-tpm-agent")
+	padded(unsafe.Pointer(&pInfo.model), len(pInfo.model), "TPM")
+	padded(unsafe.Pointer(&pInfo.serialNumber), len(pInfo.serialNumber), "")
+	padded(unsafe.Pointer(&pInfo.utcTime), len(pInfo.utcTime), "")
+	pInfo.flags = C.CKF_TOKEN_INITIALIZED | C.CKF_WRITE_PROTECTED
+	pInfo.ulMaxSessionCount = C.CK_EFFECTIVELY_INFINITE
+	pInfo.ulSessionCount = C.CK_UNAVAILABLE_INFORMATION
+	pInfo.ulMaxRwSessionCount = C.CK_EFFECTIVELY_INFINITE
+	pInfo.ulRwSessionCount = C.CK_UNAVAILABLE_INFORMATION
+	pInfo.ulTotalPublicMemory = C.CK_UNAVAILABLE_INFORMATION
+	pInfo.ulFreePublicMemory = C.CK_UNAVAILABLE_INFORMATION
+	pInfo.ulTotalPrivateMemory = C.CK_UNAVAILABLE_INFORMATION
+	pInfo.ulFreePrivateMemory = C.CK_UNAVAILABLE_INFORMATION
+	return ckrOK
+}
+
+//export C_GetMechanismList
+func C_GetMechanismList(slot C.CK_SLOT_ID, pMechanismList C.CK_MECHANISM_TYPE_PTR, pulCount C.CK_ULONG_PTR) C.CK_RV {
+	if _, rv := initialized(); rv != ckrOK {
+		return rv
+	}
+	if slot != slotID {
+		return ckrSlotIDInvalid
+	}
+	if pulCount == nil {
+		return ckrArgumentsBad
+	}
+	if pMechanismList != nil {
+		if int(*pulCount) < len(mechanisms) {
+			*pulCount = C.CK_ULONG(len(mechanisms))
+			return ckrBufferTooSmall
+		}
+		list := unsafe.Slice(pMechanismList, len(mechanisms))
+		for i, m := range mechanisms {
+			list[i] = C.CK_MECHANISM_TYPE(m)
+		}
+	}
+	*pulCount = C.CK_ULONG(len(mechanisms))
+	return ckrOK
+}
+
+//export C_GetMechanismInfo
+func C_GetMechanismInfo(slot C.CK_SLOT_ID, typ C.CK_MECHANISM_TYPE, pInfo C.CK_MECHANISM_INFO_PTR) C.CK_RV {
+	if _, rv := initialized(); rv != ckrOK {
+		return rv
+	}
+	if slot != slotID {
+		return ckrSlotIDInvalid
+	}
+	if pInfo == nil {
+		return ckrArgumentsBad
+	}
+	kt, ok := mechanismKeyType(uint(typ))
+	if !ok {
+		return ckrMechanismInvalid
+	}
+	pInfo.flags = C.CKF_HW | C.CKF_SIGN
+	if kt == ckkRSA {
+		pInfo.ulMinKeySize, pInfo.ulMaxKeySize = 2048, 4096
+	} else {
+		pInfo.ulMinKeySize, pInfo.ulMaxKeySize = 256, 521
+		pInfo.flags |= C.CKF_EC_F_P | C.CKF_EC_NAMEDCURVE | C.CKF_EC_UNCOMPRESS
+	}
+	return ckrOK
+}
+
+//export C_OpenSession
+func C_OpenSession(slot C.CK_SLOT_ID, flags C.CK_FLAGS, pApplication C.CK_VOID_PTR, notify C.CK_NOTIFY, phSession C.CK_SESSION_HANDLE_PTR) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if slot != slotID {
+		return ckrSlotIDInvalid
+	}
+	if flags&C.CKF_SERIAL_SESSION == 0 {
+		return ckrSessionParallelNotSupp
+	}
+	if phSession == nil {
+		return ckrArgumentsBad
+	}
+	*phSession = C.CK_SESSION_HANDLE(t.OpenSession())
+	return ckrOK
+}
+
+//export C_CloseSession
+func C_CloseSession(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	return C.CK_RV(errorRV(t.CloseSession(uint(hSession))))
+}
+
+//export C_CloseAllSessions
+func C_CloseAllSessions(slot C.CK_SLOT_ID) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if slot != slotID {
+		return ckrSlotIDInvalid
+	}
+	t.CloseAllSessions()
+	return ckrOK
+}
+
+//export C_GetSessionInfo
+func C_GetSessionInfo(hSession C.CK_SESSION_HANDLE, pInfo C.CK_SESSION_INFO_PTR) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if pInfo == nil {
+		return ckrArgumentsBad
+	}
+	if !t.HasSession(uint(hSession)) {
+		return ckrSessionHandleInvalid
+	}
+	pInfo.slotID = slotID
+	pInfo.state = C.CKS_RO_USER_FUNCTIONS
+	pInfo.flags = C.CKF_SERIAL_SESSION
+	pInfo.ulDeviceError = 0
+	return ckrOK
+}
+
+// C_Login is accepted for applications that always log in. The PINs of the
+// keys are asked for by the agent.
+//
+//export C_Login
+func C_Login(hSession C.CK_SESSION_HANDLE, userType C.CK_USER_TYPE, pPin C.CK_UTF8CHAR_PTR, ulPinLen C.CK_ULONG) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if !t.HasSession(uint(hSession)) {
+		return ckrSessionHandleInvalid
+	}
+	return ckrOK
+}
+
+//export C_Logout
+func C_Logout(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if !t.HasSession(uint(hSession)) {
+		return ckrSessionHandleInvalid
+	}
+	return ckrOK
+}
+
+//export C_GetAttributeValue
+func C_GetAttributeValue(hSession C.CK_SESSION_HANDLE, hObject C.CK_OBJECT_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if !t.HasSession(uint(hSession)) {
+		return ckrSessionHandleInvalid
+	}
+	if pTemplate == nil && ulCount > 0 {
+		return ckrArgumentsBad
+	}
+
+	ret := C.CK_RV(ckrOK)
+	for i := range unsafe.Slice(pTemplate, ulCount) {
+		attr := &unsafe.Slice(pTemplate, ulCount)[i]
+		v, err := t.Attribute(uint(hObject), uint(attr._type))
+		switch {
+		case errorRV(err) == ckrObjectHandleInvalid:
+			return ckrObjectHandleInvalid
+		case err != nil:
+			attr.ulValueLen = C.CK_UNAVAILABLE_INFORMATION
+			ret = ckrAttributeTypeInvalid
+		case attr.pValue == nil:
+			attr.ulValueLen = C.ulong(len(v))
+		case int(attr.ulValueLen) < len(v):
+			attr.ulValueLen = C.CK_UNAVAILABLE_INFORMATION
+			ret = ckrBufferTooSmall
+		default:
+			copy(unsafe.Slice((*byte)(attr.pValue), len(v)), v)
+			attr.ulValueLen = C.ulong(len(v))
+		}
+	}
+	return ret
+}
+
+//export C_FindObjectsInit
+func C_FindObjectsInit(hSession C.CK_SESSION_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if pTemplate == nil && ulCount > 0 {
+		return ckrArgumentsBad
+	}
+	var template []attribute
+	for _, attr := range unsafe.Slice(pTemplate, ulCount) {
+		template = append(template, attribute{
+			typ:   uint(attr._type),
+			value: C.GoBytes(attr.pValue, C.int(attr.ulValueLen)),
+		})
+	}
+	return C.CK_RV(errorRV(t.FindObjectsInit(uint(hSession), template)))
+}
+
+//export C_FindObjects
+func C_FindObjects(hSession C.CK_SESSION_HANDLE, phObject C.CK_OBJECT_HANDLE_PTR, ulMaxObjectCount C.CK_ULONG, pulObjectCount C.CK_ULONG_PTR) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if (phObject == nil && ulMaxObjectCount > 0) || pulObjectCount == nil {
+		return ckrArgumentsBad
+	}
+	handles, err := t.FindObjects(uint(hSession), int(ulMaxObjectCount))
+	if err != nil {
+		return C.CK_RV(errorRV(err))
+	}
+	objects := unsafe.Slice(phObject, ulMaxObjectCount)
+	for i, h := range handles {
+		objects[i] = C.CK_OBJECT_HANDLE(h)
+	}
+	*pulObjectCount = C.CK_ULONG(len(handles))
+	return ckrOK
+}
+
+//export C_FindObjectsFinal
+func C_FindObjectsFinal(hSession C.CK_SESSION_HANDLE) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	return C.CK_RV(errorRV(t.FindObjectsFinal(uint(hSession))))
+}
+
+//export C_SignInit
+func C_SignInit(hSession C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, hKey C.CK_OBJECT_HANDLE) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if pMechanism == nil {
+		return ckrArgumentsBad
+	}
+	return C.CK_RV(errorRV(t.SignInit(uint(hSession), uint(pMechanism.mechanism), uint(hKey))))
+}
+
+// signFinal returns the signature length when pSignature is NULL, otherwise
+// the operation is finished with the signature of the data.
+func signFinal(t *token, hSession C.CK_SESSION_HANDLE, data []byte, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
+	if pulSignatureLen == nil {
+		return ckrArgumentsBad
+	}
+	length, err := t.SignLength(uint(hSession))
+	if err != nil {
+		return C.CK_RV(errorRV(err))
+	}
+	if pSignature == nil {
+		*pulSignatureLen = C.CK_ULONG(length)
+		return ckrOK
+	}
+	if int(*pulSignatureLen) < length {
+		*pulSignatureLen = C.CK_ULONG(length)
+		return ckrBufferTooSmall
+	}
+	sig, err := t.SignFinal(uint(hSession), data)
+	if err != nil {
+		return C.CK_RV(errorRV(err))
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(pSignature)), len(sig)), sig)
+	*pulSignatureLen = C.CK_ULONG(len(sig))
+	return ckrOK
+}
+
+//export C_Sign
+func C_Sign(hSession C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.CK_ULONG, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if pData == nil && ulDataLen > 0 {
+		return ckrArgumentsBad
+	}
+	return signFinal(t, hSession, C.GoBytes(unsafe.Pointer(pData), C.int(ulDataLen)), pSignature, pulSignatureLen)
+}
+
+//export C_SignUpdate
+func C_SignUpdate(hSession C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR, ulPartLen C.CK_ULONG) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	if pPart == nil && ulPartLen > 0 {
+		return ckrArgumentsBad
+	}
+	return C.CK_RV(errorRV(t.SignUpdate(uint(hSession), C.GoBytes(unsafe.Pointer(pPart), C.int(ulPartLen)))))
+}
+
+//export C_SignFinal
+func C_SignFinal(hSession C.CK_SESSION_HANDLE, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
+	t, rv := initialized()
+	if rv != ckrOK {
+		return rv
+	}
+	return signFinal(t, hSession, nil, pSignature, pulSignatureLen)
+}
+
+func main() {}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// Return values, object classes, attributes and mechanisms from the PKCS#11
+// specification used by the token.
+const (
+	ckrOK                      = 0x000
+	ckrSlotIDInvalid           = 0x003
+	ckrGeneralError            = 0x005
+	ckrFunctionFailed          = 0x006
+	ckrArgumentsBad            = 0x007
+	ckrAttributeTypeInvalid    = 0x012
+	ckrDataLenRange            = 0x021
+	ckrDeviceError             = 0x030
+	ckrKeyTypeInconsistent     = 0x063
+	ckrKeyFunctionNotPermitted = 0x068
+	ckrMechanismInvalid        = 0x070
+	ckrObjectHandleInvalid     = 0x082
+	ckrOperationActive         = 0x090
+	ckrOperationNotInitialized = 0x091
+	ckrSessionHandleInvalid    = 0x0b3
+	ckrSessionParallelNotSupp  = 0x0b4
+	ckrBufferTooSmall          = 0x150
+	ckrCryptokiNotInitialized  = 0x190
+	ckrCryptokiAlreadyInit     = 0x191
+
+	ckoPublicKey  = 2
+	ckoPrivateKey = 3
+
+	ckkRSA = 0
+	ckkEC  = 3
+
+	ckaClass          = 0x000
+	ckaToken          = 0x001
+	ckaPrivate        = 0x002
+	ckaLabel          = 0x003
+	ckaKeyType        = 0x100
+	ckaID             = 0x102
+	ckaSensitive      = 0x103
+	ckaDecrypt        = 0x105
+	ckaSign           = 0x108
+	ckaVerify         = 0x10a
+	ckaDerive         = 0x10c
+	ckaModulus        = 0x120
+	ckaModulusBits    = 0x121
+	ckaPublicExponent = 0x122
+	ckaExtractable    = 0x162
+	ckaNeverExtract   = 0x164
+	ckaAlwaysSens     = 0x165
+	ckaEcParams       = 0x180
+	ckaEcPoint        = 0x181
+	ckaAlwaysAuth     = 0x202
+
+	ckmRSAPKCS       = 0x0001
+	ckmSHA256RSAPKCS = 0x0040
+	ckmSHA384RSAPKCS = 0x0041
+	ckmSHA512RSAPKCS = 0x0042
+	ckmECDSA         = 0x1041
+	ckmECDSASHA256   = 0x1044
+	ckmECDSASHA384   = 0x1045
+	ckmECDSASHA512   = 0x1046
+)
+
+// ckError is a PKCS#11 return value
+type ckError uint
+
+func (e ckError) Error() string {
+	return fmt.Sprintf("CKR 0x%x", uint(e))
+}
+
+// errorRV returns the PKCS#11 return value of err
+func errorRV(err error) uint {
+	if err == nil {
+		return ckrOK
+	}
+	var ck ckError
+	if errors.As(err, &ck) {
+		return uint(ck)
+	}
+	return ckrFunctionFailed
+}
+
+// ulongSize is the size of CK_ULONG, unsigned long in C
+var ulongSize = strconv.IntSize / 8
+
+func ulong(v uint) []byte {
+	if ulongSize == 4 {
+		return binary.NativeEndian.AppendUint32(nil, uint32(v))
+	}
+	return binary.NativeEndian.AppendUint64(nil, uint64(v))
+}
+
+func bbool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+var curveOIDs = map[elliptic.Curve]asn1.ObjectIdentifier{
+	elliptic.P256(): {1, 2, 840, 10045, 3, 1, 7},
+	elliptic.P384(): {1, 3, 132, 0, 34},
+	elliptic.P521(): {1, 3, 132, 0, 35},
+}
+
+// digestInfoPrefix is the DER prefix of the PKCS#1 v1.5 DigestInfo
+var digestInfoPrefix = map[string][]byte{
+	"sha256": {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	"sha384": {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	"sha512": {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var hashNames = map[crypto.Hash]string{
+	crypto.SHA256: "sha256",
+	crypto.SHA384: "sha384",
+	crypto.SHA512: "sha512",
+}
+
+// object is a public or private key of a key in the agent
+type object struct {
+	class   uint
+	pub     ssh.PublicKey
+	key     crypto.PublicKey
+	comment string
+}
+
+func (o *object) keyType() uint {
+	if _, ok := o.key.(*rsa.PublicKey); ok {
+		return ckkRSA
+	}
+	return ckkEC
+}
+
+// attribute returns the encoded value of the attribute
+func (o *object) attribute(typ uint) ([]byte, bool) {
+	id := sha256.Sum256(o.pub.Marshal())
+	private := o.class == ckoPrivateKey
+
+	switch typ {
+	case ckaClass:
+		return ulong(o.class), true
+	case ckaKeyType:
+		return ulong(o.keyType()), true
+	case ckaID:
+		return id[:], true
+	case ckaLabel:
+		return []byte(o.comment), true
+	case ckaToken:
+		return bbool(true), true
+	case ckaPrivate, ckaDecrypt, ckaDerive, ckaExtractable, ckaAlwaysAuth:
+		return bbool(false), true
+	case ckaSign:
+		return bbool(private), true
+	case ckaVerify:
+		return bbool(!private), true
+	case ckaSensitive, ckaNeverExtract, ckaAlwaysSens:
+		if private {
+			return bbool(true), true
+		}
+	}
+
+	switch k := o.key.(type) {
+	case *rsa.PublicKey:
+		switch typ {
+		case ckaModulus:
+			return k.N.Bytes(), true
+		case ckaModulusBits:
+			return ulong(uint(k.N.BitLen())), true
+		case ckaPublicExponent:
+			return big.NewInt(int64(k.E)).Bytes(), true
+		}
+	case *ecdsa.PublicKey:
+		switch typ {
+		case ckaEcParams:
+			b, err := asn1.Marshal(curveOIDs[k.Curve])
+			return b, err == nil
+		case ckaEcPoint:
+			pk, err := k.ECDH()
+			if err != nil {
+				return nil, false
+			}
+			b, err := asn1.Marshal(pk.Bytes())
+			return b, err == nil
+		}
+	}
+	return nil, false
+}
+
+type attribute struct {
+	typ   uint
+	value []byte
+}
+
+func (o *object) matches(template []attribute) bool {
+	for _, a := range template {
+		v, ok := o.attribute(a.typ)
+		if !ok || !bytes.Equal(v, a.value) {
+			return false
+		}
+	}
+	return true
+}
+
+type session struct {
+	found []uint
+
+	signing  bool
+	signKey  *object
+	signMech uint
+	signData []byte
+}
+
+// token exposes the keys of the agent as a PKCS#11 token with a single slot.
+// The keys don't need a login, the agent asks for PINs.
+type token struct {
+	mu sync.Mutex
+
+	dial     func() (net.Conn, error)
+	objects  []*object
+	sessions map[uint]*session
+	next     uint
+}
+
+func newToken(dial func() (net.Conn, error)) *token {
+	return &token{
+		dial:     dial,
+		sessions: make(map[uint]*session),
+	}
+}
+
+// withAgent runs fn with a connection to the agent
+func (t *token) withAgent(fn func(sshagent.ExtendedAgent) error) error {
+	conn, err := t.dial()
+	if err != nil {
+		return ckError(ckrDeviceError)
+	}
+	defer conn.Close()
+	return fn(sshagent.NewClient(conn))
+}
+
+// refresh adds objects for the keys in the agent. Handles of known keys are
+// stable, removed keys fail when used.
+func (t *token) refresh() ([]uint, error) {
+	var keys []*sshagent.Key
+	err := t.withAgent(func(client sshagent.ExtendedAgent) error {
+		var err error
+		keys, err = client.List()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var handles []uint
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			continue
+		}
+		cpub, ok := pub.(ssh.CryptoPublicKey)
+		if !ok {
+			continue
+		}
+		switch ck := cpub.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+		case *ecdsa.PublicKey:
+			if _, ok := curveOIDs[ck.Curve]; !ok {
+				continue
+			}
+		default:
+			continue
+		}
+
+		for _, class := range []uint{ckoPublicKey, ckoPrivateKey} {
+			handles = append(handles, t.objectHandle(class, pub, k.Comment))
+		}
+	}
+	return handles, nil
+}
+
+func (t *token) objectHandle(class uint, pub ssh.PublicKey, comment string) uint {
+	for i, o := range t.objects {
+		if o.class == class && bytes.Equal(o.pub.Marshal(), pub.Marshal()) {
+			o.comment = comment
+			return uint(i + 1)
+		}
+	}
+	t.objects = append(t.objects, &object{
+		class:   class,
+		pub:     pub,
+		key:     pub.(ssh.CryptoPublicKey).CryptoPublicKey(),
+		comment: comment,
+	})
+	return uint(len(t.objects))
+}
+
+func (t *token) object(handle uint) (*object, error) {
+	if handle == 0 || handle > uint(len(t.objects)) {
+		return nil, ckError(ckrObjectHandleInvalid)
+	}
+	return t.objects[handle-1], nil
+}
+
+func (t *token) session(handle uint) (*session, error) {
+	s, ok := t.sessions[handle]
+	if !ok {
+		return nil, ckError(ckrSessionHandleInvalid)
+	}
+	return s, nil
+}
+
+func (t *token) OpenSession() uint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next++
+	t.sessions[t.next] = &session{}
+	return t.next
+}
+
+func (t *token) CloseSession(handle uint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.session(handle); err != nil {
+		return err
+	}
+	delete(t.sessions, handle)
+	return nil
+}
+
+func (t *token) CloseAllSessions() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions = make(map[uint]*session)
+}
+
+func (t *token) HasSession(handle uint) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.sessions[handle]
+	return ok
+}
+
+// Attribute returns the attribute value of an object
+func (t *token) Attribute(handle, typ uint) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, err := t.object(handle)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := o.attribute(typ)
+	if !ok {
+		return nil, ckError(ckrAttributeTypeInvalid)
+	}
+	return v, nil
+}
+
+func (t *token) FindObjectsInit(handle uint, template []attribute) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.session(handle)
+	if err != nil {
+		return err
+	}
+	if s.found != nil {
+		return ckError(ckrOperationActive)
+	}
+	handles, err := t.refresh()
+	if err != nil {
+		return err
+	}
+	s.found = []uint{}
+	for _, h := range handles {
+		if t.objects[h-1].matches(template) {
+			s.found = append(s.found, h)
+		}
+	}
+	return nil
+}
+
+func (t *token) FindObjects(handle uint, max int) ([]uint, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.session(handle)
+	if err != nil {
+		return nil, err
+	}
+	if s.found == nil {
+		return nil, ckError(ckrOperationNotInitialized)
+	}
+	n := min(max, len(s.found))
+	ret := s.found[:n]
+	s.found = s.found[n:]
+	return ret, nil
+}
+
+func (t *token) FindObjectsFinal(handle uint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.session(handle)
+	if err != nil {
+		return err
+	}
+	if s.found == nil {
+		return ckError(ckrOperationNotInitialized)
+	}
+	s.found = nil
+	return nil
+}
+
+// mechanismKeyType returns the key type the mechanism signs with
+func mechanismKeyType(mech uint) (uint, bool) {
+	switch mech {
+	case ckmRSAPKCS, ckmSHA256RSAPKCS, ckmSHA384RSAPKCS, ckmSHA512RSAPKCS:
+		return ckkRSA, true
+	case ckmECDSA, ckmECDSASHA256, ckmECDSASHA384, ckmECDSASHA512:
+		return ckkEC, true
+	}
+	return 0, false
+}
+
+// mechanisms are the mechanisms supported by the token
+var mechanisms = []uint{
+	ckmRSAPKCS, ckmSHA256RSAPKCS, ckmSHA384RSAPKCS, ckmSHA512RSAPKCS,
+	ckmECDSA, ckmECDSASHA256, ckmECDSASHA384, ckmECDSASHA512,
+}
+
+func (t *token) SignInit(handle, mech, key uint) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.session(handle)
+	if err != nil {
+		return err
+	}
+	if s.signing {
+		return ckError(ckrOperationActive)
+	}
+	o, err := t.object(key)
+	if err != nil {
+		return err
+	}
+	if o.class != ckoPrivateKey {
+		return ckError(ckrKeyFunctionNotPermitted)
+	}
+	kt, ok := mechanismKeyType(mech)
+	if !ok {
+		return ckError(ckrMechanismInvalid)
+	}
+	if kt != o.keyType() {
+		return ckError(ckrKeyTypeInconsistent)
+	}
+	s.signing = true
+	s.signKey = o
+	s.signMech = mech
+	s.signData = nil
+	return nil
+}
+
+func (t *token) SignUpdate(handle uint, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.session(handle)
+	if err != nil {
+		return err
+	}
+	if !s.signing {
+		return ckError(ckrOperationNotInitialized)
+	}
+	s.signData = append(s.signData, data...)
+	return nil
+}
+
+// SignLength returns the length of the signature of the active operation
+func (t *token) SignLength(handle uint) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.session(handle)
+	if err != nil {
+		return 0, err
+	}
+	if !s.signing {
+		return 0, ckError(ckrOperationNotInitialized)
+	}
+	switch k := s.signKey.key.(type) {
+	case *rsa.PublicKey:
+		return k.Size(), nil
+	case *ecdsa.PublicKey:
+		return 2 * ((k.Curve.Params().BitSize + 7) / 8), nil
+	}
+	return 0, ckError(ckrGeneralError)
+}
+
+// SignFinal signs the data passed to SignUpdate, or data when it's the only
+// part. The operation is finished.
+func (t *token) SignFinal(handle uint, data []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, err := t.session(handle)
+	if err != nil {
+		return nil, err
+	}
+	if !s.signing {
+		return nil, ckError(ckrOperationNotInitialized)
+	}
+	data = append(s.signData, data...)
+	o, mech := s.signKey, s.signMech
+	s.signing = false
+	s.signKey = nil
+	s.signData = nil
+
+	digest, hash, err := signDigest(mech, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var sig []byte
+	err = t.withAgent(func(client sshagent.ExtendedAgent) error {
+		var err error
+		sig, err = agent.SignDigestWithKey(client, o.pub, digest, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if k, ok := o.key.(*ecdsa.PublicKey); ok {
+		return rawECDSASignature(sig, (k.Curve.Params().BitSize+7)/8)
+	}
+	return sig, nil
+}
+
+// signDigest returns the digest and hash of the data for the mechanism
+func signDigest(mech uint, data []byte) ([]byte, string, error) {
+	var h crypto.Hash
+	switch mech {
+	case ckmRSAPKCS:
+		for name, prefix := range digestInfoPrefix {
+			if bytes.HasPrefix(data, prefix) && len(data) == len(prefix)+int(prefix[len(prefix)-1]) {
+				return data[len(prefix):], name, nil
+			}
+		}
+		return nil, "", ckError(ckrDataLenRange)
+	case ckmECDSA:
+		switch len(data) {
+		case 32:
+			return data, "sha256", nil
+		case 48:
+			return data, "sha384", nil
+		case 64:
+			return data, "sha512", nil
+		}
+		return nil, "", ckError(ckrDataLenRange)
+	case ckmSHA256RSAPKCS, ckmECDSASHA256:
+		h = crypto.SHA256
+	case ckmSHA384RSAPKCS, ckmECDSASHA384:
+		h = crypto.SHA384
+	case ckmSHA512RSAPKCS, ckmECDSASHA512:
+		h = crypto.SHA512
+	default:
+		return nil, "", ckError(ckrMechanismInvalid)
+	}
+	hh := h.New()
+	hh.Write(data)
+	return hh.Sum(nil), hashNames[h], nil
+}
+
+// rawECDSASignature converts the ASN.1 signature from the agent to the r || s
+// format of PKCS#11
+func rawECDSASignature(sig []byte, size int) ([]byte, error) {
+	var r, s []byte
+	input := cryptobyte.String(sig)
+	var inner cryptobyte.String
+	if !input.ReadASN1(&inner, cbasn1.SEQUENCE) ||
+		!inner.ReadASN1Integer(&r) ||
+		!inner.ReadASN1Integer(&s) {
+		return nil, ckError(ckrFunctionFailed)
+	}
+	ret := make([]byte, 2*size)
+	new(big.Int).SetBytes(r).FillBytes(ret[:size])
+	new(big.Int).SetBytes(s).FillBytes(ret[size:])
+	return ret, nil
+}
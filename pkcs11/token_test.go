@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"math/big"
+	"net"
+	"path"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+func TestToken(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := agent.NewAgent(unixList,
+		[]sshagent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	tok := newToken(func() (net.Conn, error) { return net.Dial("unix", socket) })
+	sess := tok.OpenSession()
+	defer tok.CloseSession(sess)
+
+	msg := []byte("message")
+
+	for _, c := range []struct {
+		name string
+		alg  tpm2.TPMAlgID
+		bits int
+		mech uint
+		hash crypto.Hash
+		data []byte
+	}{
+		{"ecdsa", tpm2.TPMAlgECC, 256, ckmECDSA, crypto.SHA256, func() []byte { h := sha256.Sum256(msg); return h[:] }()},
+		{"ecdsa-sha384", tpm2.TPMAlgECC, 384, ckmECDSASHA384, crypto.SHA384, msg},
+		{"rsa-sha256", tpm2.TPMAlgRSA, 2048, ckmSHA256RSAPKCS, crypto.SHA256, msg},
+		{"rsa-pkcs", tpm2.TPMAlgRSA, 2048, ckmRSAPKCS, crypto.SHA512, func() []byte {
+			h := sha512.Sum512(msg)
+			return append(append([]byte{}, digestInfoPrefix["sha512"]...), h[:]...)
+		}()},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			k, err := key.NewSSHTPMKey(tpm, c.alg, c.bits, []byte(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ag.AddKey(k); err != nil {
+				t.Fatal(err)
+			}
+			pub, err := k.SSHPublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := sha256.Sum256(pub.Marshal())
+
+			if err := tok.FindObjectsInit(sess, []attribute{
+				{ckaClass, ulong(ckoPrivateKey)},
+				{ckaID, id[:]},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			handles, err := tok.FindObjects(sess, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tok.FindObjectsFinal(sess); err != nil {
+				t.Fatal(err)
+			}
+			if len(handles) != 1 {
+				t.Fatalf("found %d private keys, expected 1", len(handles))
+			}
+
+			if err := tok.SignInit(sess, c.mech, handles[0]); err != nil {
+				t.Fatal(err)
+			}
+			sig, err := tok.SignFinal(sess, c.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := c.hash.New()
+			h.Write(msg)
+			digest := h.Sum(nil)
+
+			switch pk := tok.objects[handles[0]-1].key.(type) {
+			case *ecdsa.PublicKey:
+				size := len(sig) / 2
+				r := new(big.Int).SetBytes(sig[:size])
+				s := new(big.Int).SetBytes(sig[size:])
+				if !ecdsa.Verify(pk, digest, r, s) {
+					t.Fatal("invalid ecdsa signature")
+				}
+			case *rsa.PublicKey:
+				if err := rsa.VerifyPKCS1v15(pk, c.hash, digest, sig); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+
+	if err := tok.SignInit(sess, ckmECDSA, 1); errorRV(err) != ckrKeyFunctionNotPermitted {
+		t.Fatalf("signing with a public key returned %v", err)
+	}
+}
@@ -1,11 +1,16 @@
+// Package signer provides crypto.Signer for TPM keys, asking for the
+// passphrase when signing.
 package signer
 
 import (
 	"crypto"
+	"crypto/rsa"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpm2/transport"
 
@@ -14,28 +19,92 @@ import (
 )
 
 // Shim for keyfile.TPMKeySigner
-// We need access to the SSHTPMKey to change the userauth for caching
+// We need access to the SSHTPMKey to change the userauth for caching, and to
+// load keys with a non-default parent.
 type SSHKeySigner struct {
 	*keyfile.TPMKeySigner
-	key *key.SSHTPMKey
+	key       *key.SSHTPMKey
+	ownerAuth func() ([]byte, error)
+	tpm       tpmconn.Opener
+	auth      func(*keyfile.TPMKey) ([]byte, error)
 }
 
 // func (t *SSHKeySigner) Public() crypto.PublicKey {
 // 	return t.TPMKeySigner.Public()
 // }
 
+// ErrPSSOnly is returned when asking for a PKCS #1 v1.5 signature from a key
+// created with key.CreateOptions.PSS, like SSH signatures.
+var ErrPSSOnly = errors.New("key only makes RSA-PSS signatures")
+
 func (t *SSHKeySigner) Sign(r io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	b, err := t.TPMKeySigner.Sign(r, digest, opts)
+	var digestalg tpm2.TPMAlgID
+
+	// The salt length is chosen by the TPM, verify with
+	// rsa.PSSSaltLengthAuto.
+	_, pss := opts.(*rsa.PSSOptions)
+	if pss && !t.key.IsPSS() {
+		return nil, errors.New("key was not created for RSA-PSS signatures")
+	} else if !pss && t.key.IsPSS() {
+		return nil, ErrPSSOnly
+	}
+
+	auth := []byte("")
+	if t.key.HasAuth() {
+		p, err := t.auth(t.key.TPMKey)
+		if err != nil {
+			return nil, err
+		}
+		auth = p
+	}
+
+	switch opts.HashFunc() {
+	case crypto.SHA1:
+		// ssh-rsa signatures
+		digestalg = tpm2.TPMAlgSHA1
+	case crypto.SHA256:
+		digestalg = tpm2.TPMAlgSHA256
+	case crypto.SHA384:
+		digestalg = tpm2.TPMAlgSHA384
+	case crypto.SHA512:
+		digestalg = tpm2.TPMAlgSHA512
+	default:
+		return nil, fmt.Errorf("%s is not a supported hashing algorithm", opts.HashFunc())
+	}
+
+	ownerauth, err := t.ownerAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	tpm, err := t.tpm.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.Close()
+	b, err := t.key.Sign(tpm, ownerauth, auth, digest, digestalg)
+	clear(auth)
 	if errors.Is(err, tpm2.TPMRCAuthFail) {
 		slog.Debug("removed cached userauth for key", slog.Any("err", err), slog.String("desc", t.key.Description))
-		t.key.Userauth = []byte(nil)
+		t.key.ForgetUserauth()
 	}
 	return b, err
 }
 
-func NewSSHKeySigner(k *key.SSHTPMKey, ownerAuth func() ([]byte, error), tpm func() transport.TPMCloser, auth func(*keyfile.TPMKey) ([]byte, error)) *SSHKeySigner {
+func NewSSHKeySigner(k *key.SSHTPMKey, ownerAuth func() ([]byte, error), tpm tpmconn.Opener, auth func(*keyfile.TPMKey) ([]byte, error)) *SSHKeySigner {
+	// Sign is shimmed, the TPMKeySigner only needs the public key
+	open := func() transport.TPMCloser {
+		t, err := tpm.Open()
+		if err != nil {
+			slog.Debug("failed opening tpm", slog.String("error", err.Error()))
+		}
+		return t
+	}
 	return &SSHKeySigner{
-		TPMKeySigner: keyfile.NewTPMKeySigner(k.TPMKey, ownerAuth, tpm, auth),
+		TPMKeySigner: keyfile.NewTPMKeySigner(k.TPMKey, ownerAuth, open, auth),
 		key:          k,
+		ownerAuth:    ownerAuth,
+		tpm:          tpm,
+		auth:         auth,
 	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// The flags of enrollments and signatures, see sk-api.h
+const (
+	flagUserPresence     = 0x01
+	flagUserVerification = 0x04
+	flagResidentKey      = 0x20
+)
+
+var (
+	errUnsupported = errors.New("unsupported by tpm security keys")
+	errPINRequired = errors.New("pin required")
+)
+
+// credential is a TPM key enrolled as a security key. The key handle OpenSSH
+// keeps in the private key file is the TSS2 key file, with the application
+// as description.
+type credential struct {
+	PublicKey []byte
+	KeyHandle []byte
+}
+
+// enroll creates a P-256 key for application. A pin is the userauth of the
+// key, and is required for user verification.
+func enroll(tpm transport.TPMCloser, ownerauth []byte, application string, flags uint8, pin []byte) (*credential, error) {
+	if flags&flagResidentKey != 0 {
+		return nil, fmt.Errorf("resident keys are %w", errUnsupported)
+	}
+	if flags&flagUserVerification != 0 && len(pin) == 0 {
+		return nil, errPINRequired
+	}
+	k, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, ownerauth,
+		keyfile.WithUserAuth(pin),
+		keyfile.WithDescription(application),
+	)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := publicPoint(k)
+	if err != nil {
+		return nil, err
+	}
+	b, err := k.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &credential{PublicKey: pub, KeyHandle: b}, nil
+}
+
+// publicPoint returns the uncompressed point of the key
+func publicPoint(k *key.SSHTPMKey) ([]byte, error) {
+	pk, err := k.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	ecpk, ok := pk.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an ecdsa key")
+	}
+	pub, err := ecpk.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return pub.Bytes(), nil
+}
+
+// assertion is a signature like the one of a FIDO authenticator
+type assertion struct {
+	Flags   uint8
+	Counter uint32
+	R, S    *big.Int
+}
+
+// authData is what the key signs for data, the authenticator data of FIDO
+// followed by the hash of the data as client data hash. The counter is
+// always 0, OpenSSH doesn't check it.
+func authData(application string, flags uint8, counter uint32, data []byte) []byte {
+	app := sha256.Sum256([]byte(application))
+	msg := sha256.Sum256(data)
+	b := append(app[:], flags)
+	b = binary.BigEndian.AppendUint32(b, counter)
+	return append(b, msg[:]...)
+}
+
+// sign signs data with the key in keyHandle for application. User presence
+// is confirmed with confirm, user verification is the pin of the key.
+func sign(tpm transport.TPMCloser, ownerauth []byte, application string, keyHandle []byte, data []byte, flags uint8, pin []byte, confirm func() (bool, error)) (*assertion, error) {
+	k, err := key.Decode(keyHandle)
+	if err != nil {
+		return nil, fmt.Errorf("malformed key handle: %w", err)
+	}
+	if k.Description != application {
+		return nil, fmt.Errorf("key was enrolled for %q, not %q", k.Description, application)
+	}
+	if !k.EmptyAuth && len(pin) == 0 {
+		return nil, errPINRequired
+	}
+
+	var response uint8
+	if flags&flagUserPresence != 0 {
+		ok, err := confirm()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("use of the key was not confirmed")
+		}
+		response |= flagUserPresence
+	}
+	if !k.EmptyAuth {
+		response |= flagUserVerification
+	}
+
+	digest := sha256.Sum256(authData(application, response, 0, data))
+	sig, err := k.Sign(tpm, ownerauth, pin, digest[:], tpm2.TPMAlgSHA256)
+	if err != nil {
+		if errors.Is(err, tpm2.TPMRCAuthFail) {
+			return nil, fmt.Errorf("%w: %v", errPINRequired, err)
+		}
+		return nil, err
+	}
+	a := &assertion{Flags: response}
+	var esig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig, &esig); err != nil {
+		return nil, err
+	}
+	a.R, a.S = esig.R, esig.S
+	return a, nil
+}
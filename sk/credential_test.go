@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"golang.org/x/crypto/ssh"
+)
+
+// skPublicKey is the sk-ecdsa-sha2-nistp256@openssh.com key OpenSSH makes
+// from the enrollment
+func skPublicKey(t *testing.T, c *credential, application string) ssh.PublicKey {
+	t.Helper()
+	pk, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Type, Curve string
+		Point       []byte
+		Application string
+	}{ssh.KeyAlgoSKECDSA256, "nistp256", c.PublicKey, application}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+// skSignature is the SSH signature OpenSSH makes from the assertion
+func skSignature(a *assertion) *ssh.Signature {
+	return &ssh.Signature{
+		Format: ssh.KeyAlgoSKECDSA256,
+		Blob:   ssh.Marshal(struct{ R, S *big.Int }{a.R, a.S}),
+		Rest: ssh.Marshal(struct {
+			Flags   uint8
+			Counter uint32
+		}{a.Flags, a.Counter}),
+	}
+}
+
+func TestCredential(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	confirmed := 0
+	confirm := func() (bool, error) {
+		confirmed++
+		return true, nil
+	}
+	data := []byte("data")
+
+	c, err := enroll(tpm, nil, "ssh:", flagUserPresence, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := sign(tpm, nil, "ssh:", c.KeyHandle, data, flagUserPresence, nil, confirm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed != 1 || a.Flags != flagUserPresence {
+		t.Fatalf("user presence wasn't confirmed, flags %#x", a.Flags)
+	}
+	if err := skPublicKey(t, c, "ssh:").Verify(data, skSignature(a)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sign(tpm, nil, "ssh:other", c.KeyHandle, data, 0, nil, confirm); err == nil {
+		t.Fatal("signed for another application")
+	}
+
+	if _, err := enroll(tpm, nil, "ssh:", flagUserVerification, nil); !errors.Is(err, errPINRequired) {
+		t.Fatalf("enrolled user verification without a pin: %v", err)
+	}
+	if _, err := enroll(tpm, nil, "ssh:", flagResidentKey, nil); !errors.Is(err, errUnsupported) {
+		t.Fatalf("enrolled a resident key: %v", err)
+	}
+	c, err = enroll(tpm, nil, "ssh:", flagUserVerification, []byte("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sign(tpm, nil, "ssh:", c.KeyHandle, data, 0, nil, confirm); !errors.Is(err, errPINRequired) {
+		t.Fatalf("signed without the pin: %v", err)
+	}
+	if _, err := sign(tpm, nil, "ssh:", c.KeyHandle, data, 0, []byte("4321"), confirm); !errors.Is(err, errPINRequired) {
+		t.Fatalf("signed with the wrong pin: %v", err)
+	}
+	a, err = sign(tpm, nil, "ssh:", c.KeyHandle, data, 0, []byte("1234"), confirm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Flags != flagUserVerification {
+		t.Fatalf("unexpected flags %#x", a.Flags)
+	}
+	if err := skPublicKey(t, c, "ssh:").Verify(data, skSignature(a)); err != nil {
+		t.Fatal(err)
+	}
+}
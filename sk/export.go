@@ -0,0 +1,150 @@
+package main
+
+/*
+#include <stdlib.h>
+#include "sk-api.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/foxboron/ssh-tpm-agent/askpass"
+	"github.com/foxboron/ssh-tpm-agent/utils"
+)
+
+// ownerPassword is the owner password of the TPM, OpenSSH has no way to ask
+// for it
+func ownerPassword() []byte {
+	return []byte(os.Getenv("SSH_TPM_AGENT_OWNER_PASSWORD"))
+}
+
+func goPIN(pin *C.char) []byte {
+	if pin == nil {
+		return nil
+	}
+	return []byte(C.GoString(pin))
+}
+
+// checkOptions refuses required options, except the device which is always
+// the TPM
+func checkOptions(options **C.struct_sk_option) C.int {
+	if options == nil {
+		return 0
+	}
+	for _, o := range unsafe.Slice(options, 1<<16) {
+		if o == nil {
+			return 0
+		}
+		if o.required != 0 && C.GoString(o.name) != "device" {
+			fmt.Fprintf(os.Stderr, "ssh-tpm-sk: unsupported option %s\n", C.GoString(o.name))
+			return C.SSH_SK_ERR_UNSUPPORTED
+		}
+	}
+	return 0
+}
+
+// errorCode returns the sk-api error of err, and says what went wrong
+func errorCode(err error) C.int {
+	switch {
+	case errors.Is(err, errPINRequired):
+		return C.SSH_SK_ERR_PIN_REQUIRED
+	case errors.Is(err, errUnsupported):
+		fmt.Fprintf(os.Stderr, "ssh-tpm-sk: %v\n", err)
+		return C.SSH_SK_ERR_UNSUPPORTED
+	case errors.Is(err, utils.ErrNoTPM):
+		fmt.Fprintf(os.Stderr, "ssh-tpm-sk: %v\n", err)
+		return C.SSH_SK_ERR_DEVICE_NOT_FOUND
+	default:
+		fmt.Fprintf(os.Stderr, "ssh-tpm-sk: %v\n", err)
+		return C.SSH_SK_ERR_GENERAL
+	}
+}
+
+func cBytes(b []byte) (*C.uint8_t, C.size_t) {
+	return (*C.uint8_t)(C.CBytes(b)), C.size_t(len(b))
+}
+
+//export sk_api_version
+func sk_api_version() C.uint32_t {
+	return C.SSH_SK_VERSION_MAJOR
+}
+
+//export sk_enroll
+func sk_enroll(alg C.uint32_t, challenge *C.uint8_t, challengeLen C.size_t, application *C.char, flags C.uint8_t, pin *C.char, options **C.struct_sk_option, response **C.struct_sk_enroll_response) C.int {
+	if response == nil || application == nil {
+		return C.SSH_SK_ERR_GENERAL
+	}
+	*response = nil
+	if alg != C.SSH_SK_ECDSA {
+		return errorCode(fmt.Errorf("ed25519 keys are %w", errUnsupported))
+	}
+	if rv := checkOptions(options); rv != 0 {
+		return rv
+	}
+
+	tpm, err := utils.TPM(false)
+	if err != nil {
+		return errorCode(err)
+	}
+	defer tpm.Close()
+	c, err := enroll(tpm, ownerPassword(), C.GoString(application), uint8(flags), goPIN(pin))
+	if err != nil {
+		return errorCode(err)
+	}
+
+	// OpenSSH frees the response with free()
+	r := (*C.struct_sk_enroll_response)(C.calloc(1, C.sizeof_struct_sk_enroll_response))
+	r.flags = flags
+	r.public_key, r.public_key_len = cBytes(c.PublicKey)
+	r.key_handle, r.key_handle_len = cBytes(c.KeyHandle)
+	*response = r
+	return 0
+}
+
+//export sk_sign
+func sk_sign(alg C.uint32_t, data *C.uint8_t, dataLen C.size_t, application *C.char, keyHandle *C.uint8_t, keyHandleLen C.size_t, flags C.uint8_t, pin *C.char, options **C.struct_sk_option, response **C.struct_sk_sign_response) C.int {
+	if response == nil || application == nil || keyHandle == nil {
+		return C.SSH_SK_ERR_GENERAL
+	}
+	*response = nil
+	if alg != C.SSH_SK_ECDSA {
+		return C.SSH_SK_ERR_UNSUPPORTED
+	}
+	if rv := checkOptions(options); rv != 0 {
+		return rv
+	}
+
+	tpm, err := utils.TPM(false)
+	if err != nil {
+		return errorCode(err)
+	}
+	defer tpm.Close()
+	a, err := sign(tpm, ownerPassword(), C.GoString(application),
+		C.GoBytes(unsafe.Pointer(keyHandle), C.int(keyHandleLen)),
+		C.GoBytes(unsafe.Pointer(data), C.int(dataLen)),
+		uint8(flags), goPIN(pin), askpass.AskPermission)
+	if err != nil {
+		return errorCode(err)
+	}
+
+	r := (*C.struct_sk_sign_response)(C.calloc(1, C.sizeof_struct_sk_sign_response))
+	r.flags = C.uint8_t(a.Flags)
+	r.counter = C.uint32_t(a.Counter)
+	r.sig_r, r.sig_r_len = cBytes(a.R.Bytes())
+	r.sig_s, r.sig_s_len = cBytes(a.S.Bytes())
+	*response = r
+	return 0
+}
+
+// sk_load_resident_keys is unsupported, keys only live in their key handle
+//
+//export sk_load_resident_keys
+func sk_load_resident_keys(pin *C.char, options **C.struct_sk_option, rks ***C.struct_sk_resident_key, nrks *C.size_t) C.int {
+	return C.SSH_SK_ERR_UNSUPPORTED
+}
+
+func main() {}
@@ -0,0 +1,68 @@
+/*
+ * The types and constants of the security key middleware API of OpenSSH,
+ * version 10, from sk-api.h in OpenSSH. The functions are declared by the
+ * cgo export header.
+ */
+#ifndef SSH_TPM_SK_API_H
+#define SSH_TPM_SK_API_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+#define SSH_SK_USER_PRESENCE_REQD	0x01
+#define SSH_SK_USER_VERIFICATION_REQD	0x04
+#define SSH_SK_FORCE_OPERATION		0x10
+#define SSH_SK_RESIDENT_KEY		0x20
+
+#define SSH_SK_ECDSA			0x00
+#define SSH_SK_ED25519			0x01
+
+#define SSH_SK_ERR_GENERAL		-1
+#define SSH_SK_ERR_UNSUPPORTED		-2
+#define SSH_SK_ERR_PIN_REQUIRED		-3
+#define SSH_SK_ERR_DEVICE_NOT_FOUND	-4
+#define SSH_SK_ERR_CREDENTIAL_EXISTS	-5
+
+#define SSH_SK_VERSION_MAJOR		0x000a0000
+#define SSH_SK_VERSION_MAJOR_MASK	0xffff0000
+
+struct sk_enroll_response {
+	uint8_t flags;
+	uint8_t *public_key;
+	size_t public_key_len;
+	uint8_t *key_handle;
+	size_t key_handle_len;
+	uint8_t *signature;
+	size_t signature_len;
+	uint8_t *attestation_cert;
+	size_t attestation_cert_len;
+	uint8_t *authdata;
+	size_t authdata_len;
+};
+
+struct sk_sign_response {
+	uint8_t flags;
+	uint32_t counter;
+	uint8_t *sig_r;
+	size_t sig_r_len;
+	uint8_t *sig_s;
+	size_t sig_s_len;
+};
+
+struct sk_resident_key {
+	uint32_t alg;
+	size_t slot;
+	char *application;
+	struct sk_enroll_response key;
+	uint8_t flags;
+	uint8_t *user_id;
+	size_t user_id_len;
+};
+
+struct sk_option {
+	char *name;
+	char *value;
+	uint8_t required;
+};
+
+#endif
@@ -0,0 +1,189 @@
+// Package sshsig implements the SSH signature format used by ssh-keygen -Y
+// sign and git, see PROTOCOL.sshsig in OpenSSH.
+package sshsig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	magic   = "SSHSIG"
+	version = 1
+
+	pemType = "SSH SIGNATURE"
+)
+
+var ErrInvalidSignature = errors.New("invalid ssh signature")
+
+// Signature is a parsed SSH signature
+type Signature struct {
+	PublicKey ssh.PublicKey
+	Namespace string
+	HashAlg   string
+	Signature *ssh.Signature
+}
+
+type signedData struct {
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Hash      []byte
+}
+
+type blob struct {
+	Version   uint32
+	PublicKey []byte
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Signature []byte
+}
+
+func hasher(alg string) (hash.Hash, error) {
+	switch alg {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm %s", alg)
+}
+
+func message(r io.Reader, namespace, hashalg string) ([]byte, error) {
+	h, err := hasher(hashalg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return append([]byte(magic), ssh.Marshal(signedData{
+		Namespace: namespace,
+		HashAlg:   hashalg,
+		Hash:      h.Sum(nil),
+	})...), nil
+}
+
+// Sign signs the message with SHA-512 like ssh-keygen. RSA keys are signed
+// with rsa-sha2-512.
+func Sign(signer ssh.AlgorithmSigner, r io.Reader, namespace string) (*Signature, error) {
+	if namespace == "" {
+		return nil, errors.New("namespace is required")
+	}
+
+	data, err := message(r, namespace, "sha512")
+	if err != nil {
+		return nil, err
+	}
+
+	alg := signer.PublicKey().Type()
+	if alg == ssh.KeyAlgoRSA {
+		alg = ssh.KeyAlgoRSASHA512
+	}
+
+	sig, err := signer.SignWithAlgorithm(rand.Reader, data, alg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signature{
+		PublicKey: signer.PublicKey(),
+		Namespace: namespace,
+		HashAlg:   "sha512",
+		Signature: sig,
+	}, nil
+}
+
+// Verify checks the signature over the message in the namespace. The caller
+// decides if the public key of the signature is trusted.
+func Verify(sig *Signature, r io.Reader, namespace string) error {
+	if sig.Namespace != namespace {
+		return fmt.Errorf("%w: namespace %q does not match %q", ErrInvalidSignature, sig.Namespace, namespace)
+	}
+	if sig.PublicKey.Type() == ssh.KeyAlgoRSA && sig.Signature.Format == ssh.KeyAlgoRSA {
+		return fmt.Errorf("%w: ssh-rsa signatures are not allowed", ErrInvalidSignature)
+	}
+	data, err := message(r, sig.Namespace, sig.HashAlg)
+	if err != nil {
+		return err
+	}
+	if err := sig.PublicKey.Verify(data, sig.Signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// Marshal returns the binary SSH signature
+func (s *Signature) Marshal() []byte {
+	return append([]byte(magic), ssh.Marshal(blob{
+		Version:   version,
+		PublicKey: s.PublicKey.Marshal(),
+		Namespace: s.Namespace,
+		HashAlg:   s.HashAlg,
+		Signature: ssh.Marshal(s.Signature),
+	})...)
+}
+
+// Armor returns the PEM armored SSH signature written by ssh-keygen
+func (s *Signature) Armor() []byte {
+	// ssh-keygen wraps at 70 characters, encoding/pem at 64
+	b64 := base64.StdEncoding.EncodeToString(s.Marshal())
+	var b strings.Builder
+	b.WriteString("-----BEGIN " + pemType + "-----\n")
+	for len(b64) > 70 {
+		b.WriteString(b64[:70] + "\n")
+		b64 = b64[70:]
+	}
+	b.WriteString(b64 + "\n")
+	b.WriteString("-----END " + pemType + "-----\n")
+	return []byte(b.String())
+}
+
+// Parse parses a binary SSH signature
+func Parse(b []byte) (*Signature, error) {
+	if !bytes.HasPrefix(b, []byte(magic)) {
+		return nil, ErrInvalidSignature
+	}
+	var sb blob
+	if err := ssh.Unmarshal(b[len(magic):], &sb); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if sb.Version != version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSignature, sb.Version)
+	}
+	pub, err := ssh.ParsePublicKey(sb.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(sb.Signature, &sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return &Signature{
+		PublicKey: pub,
+		Namespace: sb.Namespace,
+		HashAlg:   sb.HashAlg,
+		Signature: &sig,
+	}, nil
+}
+
+// Unarmor parses a PEM armored SSH signature
+func Unarmor(b []byte) (*Signature, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != pemType {
+		return nil, ErrInvalidSignature
+	}
+	return Parse(block.Bytes)
+}
@@ -0,0 +1,124 @@
+package sshsig_test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/agent"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/foxboron/ssh-tpm-agent/sshsig"
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+func TestSignThroughAgent(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	socket := path.Join(t.TempDir(), "socket")
+	unixList, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixList.Close()
+
+	ag := agent.NewAgent(unixList,
+		[]sshagent.ExtendedAgent{},
+		tpmconn.Static(tpm),
+		func() ([]byte, error) { return []byte(""), nil },
+		func(_ *key.SSHTPMKey) ([]byte, error) { return []byte(""), nil },
+	)
+	defer ag.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := sshagent.NewClient(conn)
+
+	for _, c := range []struct {
+		name string
+		alg  tpm2.TPMAlgID
+		bits int
+	}{
+		{"ecdsa", tpm2.TPMAlgECC, 256},
+		{"rsa", tpm2.TPMAlgRSA, 2048},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			k, err := key.NewSSHTPMKey(tpm, c.alg, c.bits, []byte(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ag.AddKey(k); err != nil {
+				t.Fatal(err)
+			}
+			pub, err := k.SSHPublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signers, err := client.Signers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var signer ssh.AlgorithmSigner
+			for _, s := range signers {
+				if bytes.Equal(s.PublicKey().Marshal(), pub.Marshal()) {
+					signer = s.(ssh.AlgorithmSigner)
+				}
+			}
+			if signer == nil {
+				t.Fatal("key not in agent")
+			}
+
+			msg := []byte("signed commit")
+			sig, err := sshsig.Sign(signer, bytes.NewReader(msg), "git")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.alg == tpm2.TPMAlgRSA && sig.Signature.Format != ssh.KeyAlgoRSASHA512 {
+				t.Fatalf("rsa signature is %s, expected %s", sig.Signature.Format, ssh.KeyAlgoRSASHA512)
+			}
+
+			parsed, err := sshsig.Unarmor(sig.Armor())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sshsig.Verify(parsed, bytes.NewReader(msg), "git"); err != nil {
+				t.Fatal(err)
+			}
+			if err := sshsig.Verify(parsed, bytes.NewReader(msg), "file"); err == nil {
+				t.Fatal("verified signature with the wrong namespace")
+			}
+			if err := sshsig.Verify(parsed, bytes.NewReader([]byte("other")), "git"); err == nil {
+				t.Fatal("verified signature over the wrong message")
+			}
+
+			sshkeygen, err := exec.LookPath("ssh-keygen")
+			if err != nil {
+				t.Skip("ssh-keygen not found")
+			}
+			sigFile := path.Join(t.TempDir(), "msg.sig")
+			if err := os.WriteFile(sigFile, sig.Armor(), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(sshkeygen, "-Y", "check-novalidate", "-n", "git", "-s", sigFile)
+			cmd.Stdin = bytes.NewReader(msg)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("ssh-keygen failed verifying the signature: %v: %s", err, out)
+			}
+		})
+	}
+}
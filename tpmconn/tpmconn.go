@@ -0,0 +1,45 @@
+// Package tpmconn is how the agent, signers and keystores get the transport
+// to the TPM. Programs pass an Opener, tests one returning the simulator, see
+// tpmconntest.
+package tpmconn
+
+import (
+	"errors"
+
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// ErrNoTPM is returned by the Opener of Static without a transport
+var ErrNoTPM = errors.New("no tpm transport")
+
+// Opener returns the transport to send the commands of an operation to. The
+// caller closes it when the operation is done. Opening can fail for a moment,
+// like right after resuming, the caller opens it again for the next operation.
+type Opener interface {
+	Open() (transport.TPMCloser, error)
+}
+
+// Func adapts a function to an Opener
+type Func func() (transport.TPMCloser, error)
+
+func (f Func) Open() (transport.TPMCloser, error) {
+	return f()
+}
+
+// Static returns an Opener for a transport which is already open. Closing the
+// transports it returns does nothing, the caller of Static closes tpm.
+func Static(tpm transport.TPMCloser) Opener {
+	if tpm == nil {
+		return Func(func() (transport.TPMCloser, error) { return nil, ErrNoTPM })
+	}
+	return Func(func() (transport.TPMCloser, error) { return unclosed{tpm}, nil })
+}
+
+// unclosed is a transport which is closed by its owner
+type unclosed struct {
+	transport.TPMCloser
+}
+
+func (unclosed) Close() error {
+	return nil
+}
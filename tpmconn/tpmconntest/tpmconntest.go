@@ -0,0 +1,48 @@
+// Package tpmconntest provides Openers for tests, without a TPM.
+package tpmconntest
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/tpmconn"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+// Simulator opens the go-tpm simulator, and closes it when the test ends. The
+// transport is returned as well, for creating keys with it.
+func Simulator(t testing.TB) (tpmconn.Opener, transport.TPMCloser) {
+	t.Helper()
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tpm.Close() })
+	return tpmconn.Static(tpm), tpm
+}
+
+// Mock is a transport answering the commands with the response codes in RCs,
+// one after another and then the last one again. Sent counts the commands.
+type Mock struct {
+	RCs  []tpm2.TPMRC
+	Sent int
+}
+
+var _ transport.TPMCloser = &Mock{}
+
+func (m *Mock) Send(cmd []byte) ([]byte, error) {
+	rc := tpm2.TPMRCSuccess
+	if len(m.RCs) != 0 {
+		rc = m.RCs[min(m.Sent, len(m.RCs)-1)]
+	}
+	m.Sent++
+	rsp := make([]byte, 10)
+	binary.BigEndian.PutUint16(rsp[0:], uint16(tpm2.TPMSTNoSessions))
+	binary.BigEndian.PutUint32(rsp[2:], 10)
+	binary.BigEndian.PutUint32(rsp[6:], uint32(rc))
+	return rsp, nil
+}
+
+func (m *Mock) Close() error { return nil }
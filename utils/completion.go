@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CompletionKind is how the value of a flag, or an argument, is completed
+type CompletionKind int
+
+const (
+	CompleteNone CompletionKind = iota
+	CompleteFile
+	CompleteDir
+	// .tpm key files
+	CompleteKey
+)
+
+// Completion describes the command line of a program, for generating shell
+// completion scripts.
+type Completion struct {
+	Program string
+	Flags   *flag.FlagSet
+	// how the values of flags are completed, by flag name
+	Values map[string]CompletionKind
+	// the values of flags taking one of a few words, by flag name
+	Words map[string][]string
+	// subcommands, completed as the first argument
+	Commands []string
+	// how the other arguments are completed
+	Args CompletionKind
+}
+
+// CompletionShells are the shells Completion.Write supports
+var CompletionShells = []string{"bash", "zsh", "fish"}
+
+type completionFlag struct {
+	name, usage string
+	isBool      bool
+	kind        CompletionKind
+	words       []string
+}
+
+// dashed returns the flag as it is usually written, -x or --name
+func (f *completionFlag) dashed() string {
+	if len(f.name) == 1 {
+		return "-" + f.name
+	}
+	return "--" + f.name
+}
+
+func (c *Completion) flags() []*completionFlag {
+	var flags []*completionFlag
+	c.Flags.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, &completionFlag{
+			name:   f.Name,
+			usage:  f.Usage,
+			isBool: ok && b.IsBoolFlag(),
+			kind:   c.Values[f.Name],
+			words:  c.Words[f.Name],
+		})
+	})
+	return flags
+}
+
+// Write writes the completion script for shell to w.
+func (c *Completion) Write(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		return c.writeBash(w)
+	case "zsh":
+		return c.writeZsh(w)
+	case "fish":
+		return c.writeFish(w)
+	}
+	return fmt.Errorf("unsupported shell %q, expected one of %s", shell, strings.Join(CompletionShells, ", "))
+}
+
+func bashCompgen(kind CompletionKind) string {
+	switch kind {
+	case CompleteFile:
+		return `COMPREPLY=($(compgen -f -- "$cur"))`
+	case CompleteDir:
+		return `COMPREPLY=($(compgen -d -- "$cur"))`
+	case CompleteKey:
+		return `COMPREPLY=($(compgen -d -- "$cur") $(compgen -f -X '!*.tpm' -- "$cur"))`
+	}
+	return "COMPREPLY=()"
+}
+
+func (c *Completion) writeBash(w io.Writer) error {
+	fn := "_" + strings.ReplaceAll(c.Program, "-", "_")
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s\n", c.Program)
+	fmt.Fprintf(&b, "%s() {\n", fn)
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	b.WriteString("\tcase \"$prev\" in\n")
+	var names []string
+	for _, f := range c.flags() {
+		names = append(names, f.dashed())
+		if f.isBool {
+			continue
+		}
+		fmt.Fprintf(&b, "\t-%s|--%s)\n", f.name, f.name)
+		if f.words != nil {
+			fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(f.words, " "))
+		} else {
+			fmt.Fprintf(&b, "\t\t%s\n", bashCompgen(f.kind))
+		}
+		b.WriteString("\t\treturn\n\t\t;;\n")
+	}
+	b.WriteString("\tesac\n")
+	fmt.Fprintf(&b, "\tif [[ \"$cur\" == -* ]]; then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\tfi\n", strings.Join(names, " "))
+	if len(c.Commands) != 0 {
+		b.WriteString("\tlocal i\n\tfor ((i = 1; i < COMP_CWORD; i++)); do\n")
+		fmt.Fprintf(&b, "\t\tcase \"${COMP_WORDS[i]}\" in\n\t\t%s)\n", strings.Join(c.Commands, "|"))
+		fmt.Fprintf(&b, "\t\t\t%s\n\t\t\treturn\n\t\t\t;;\n\t\tesac\n\tdone\n", bashCompgen(c.Args))
+		fmt.Fprintf(&b, "\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(c.Commands, " "))
+	} else {
+		fmt.Fprintf(&b, "\t%s\n", bashCompgen(c.Args))
+	}
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "complete -F %s %s\n", fn, c.Program)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// zshEscape escapes s for the description in an _arguments spec
+func zshEscape(s string) string {
+	return strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`).Replace(s)
+}
+
+func zshAction(kind CompletionKind) string {
+	switch kind {
+	case CompleteFile:
+		return "_files"
+	case CompleteDir:
+		return "_files -/"
+	case CompleteKey:
+		return `_files -g "*.tpm"`
+	}
+	return " "
+}
+
+func (c *Completion) writeZsh(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n\n_arguments", c.Program)
+	for _, f := range c.flags() {
+		spec := fmt.Sprintf("%s[%s]", f.dashed(), zshEscape(f.usage))
+		switch {
+		case f.isBool:
+		case f.words != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.name, strings.Join(f.words, " "))
+		default:
+			spec += fmt.Sprintf(":%s:%s", f.name, zshAction(f.kind))
+		}
+		fmt.Fprintf(&b, " \\\n\t'%s'", spec)
+	}
+	if len(c.Commands) != 0 {
+		fmt.Fprintf(&b, " \\\n\t'1:command:(%s)'", strings.Join(c.Commands, " "))
+	}
+	if c.Args != CompleteNone {
+		fmt.Fprintf(&b, " \\\n\t'*:argument:%s'", zshAction(c.Args))
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func fishArguments(kind CompletionKind) string {
+	switch kind {
+	case CompleteFile:
+		return " -F"
+	case CompleteDir:
+		return " -a '(__fish_complete_directories)'"
+	case CompleteKey:
+		return " -a '(__fish_complete_suffix .tpm)'"
+	}
+	return ""
+}
+
+func (c *Completion) writeFish(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s\n", c.Program)
+	fmt.Fprintf(&b, "complete -c %s -f\n", c.Program)
+	for _, f := range c.flags() {
+		opt := "-l " + f.name
+		if len(f.name) == 1 {
+			opt = "-s " + f.name
+		}
+		line := fmt.Sprintf("complete -c %s %s -d '%s'", c.Program, opt, strings.ReplaceAll(f.usage, `'`, `\'`))
+		switch {
+		case f.isBool:
+		case f.words != nil:
+			line += fmt.Sprintf(" -r -a '%s'", strings.Join(f.words, " "))
+		default:
+			line += " -r" + fishArguments(f.kind)
+		}
+		b.WriteString(line + "\n")
+	}
+	if len(c.Commands) != 0 {
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -a '%s'\n", c.Program, strings.Join(c.Commands, " "))
+		if c.Args != CompleteNone {
+			fmt.Fprintf(&b, "complete -c %s -n 'not __fish_use_subcommand'%s\n", c.Program, fishArguments(c.Args))
+		}
+	} else if c.Args != CompleteNone {
+		fmt.Fprintf(&b, "complete -c %s%s\n", c.Program, fishArguments(c.Args))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCompletion() *Completion {
+	fs := flag.NewFlagSet("ssh-tpm-test", flag.ContinueOnError)
+	fs.Bool("d", false, "debug mode")
+	fs.String("key-dir", "", "path of the directory to look for keys in")
+	fs.String("keystore", "file", "where to load keys from")
+	fs.String("f", "", "key file")
+	return &Completion{
+		Program:  "ssh-tpm-test",
+		Flags:    fs,
+		Values:   map[string]CompletionKind{"key-dir": CompleteDir, "f": CompleteKey},
+		Words:    map[string][]string{"keystore": {"file", "nv"}},
+		Commands: []string{"ping", "setup"},
+		Args:     CompleteFile,
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	c := testCompletion()
+	for _, shell := range CompletionShells {
+		var b bytes.Buffer
+		if err := c.Write(&b, shell); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(b.String(), "keystore") || !strings.Contains(b.String(), "setup") {
+			t.Fatalf("%s completion misses flags or commands:\n%s", shell, b.String())
+		}
+	}
+	if err := c.Write(&bytes.Buffer{}, "csh"); err == nil {
+		t.Fatal("no error for an unsupported shell")
+	}
+}
+
+func TestBashCompletion(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	dir := t.TempDir()
+	for _, f := range []string{"id_ecdsa.tpm", "id_ecdsa.pub"} {
+		if err := os.WriteFile(filepath.Join(dir, f), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var script bytes.Buffer
+	if err := testCompletion().Write(&script, "bash"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		words string
+		want  string
+	}{
+		{"ssh-tpm-test --keys", "--keystore"},
+		{"ssh-tpm-test --keystore n", "nv"},
+		{"ssh-tpm-test se", "setup"},
+		{"ssh-tpm-test -f id_", "id_ecdsa.tpm"},
+		{"ssh-tpm-test ping id_ecdsa.p", "id_ecdsa.pub"},
+	} {
+		cmd := exec.Command("bash", "-c", script.String()+`
+COMP_WORDS=(`+tc.words+`)
+COMP_CWORD=$((${#COMP_WORDS[@]} - 1))
+_ssh_tpm_test
+echo "${COMPREPLY[@]}"`)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != tc.want {
+			t.Errorf("completing %q: got %q, expected %q", tc.words, got, tc.want)
+		}
+	}
+}
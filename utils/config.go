@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ConfigFile is the configuration file shared by the programs,
+// $XDG_CONFIG_HOME/ssh-tpm-agent/config.
+func ConfigFile() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return path.Join(dir, "ssh-tpm-agent", "config")
+	}
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		panic("$HOME is not defined")
+	}
+	return path.Join(dirname, ".config", "ssh-tpm-agent", "config")
+}
+
+// LoadConfig sets the flags of fs which weren't given on the command line
+// from the configuration file at path. Each line is the name of a flag and
+// its value, boolean flags without a value are set. Lines after a [program]
+// header only apply to that program:
+//
+//	key-dir ~/.ssh/tpm
+//
+//	[ssh-tpm-agent]
+//	batch
+//	timeout 30s
+//
+// Flags the program doesn't have are skipped, as the file is shared. A
+// missing file is an empty configuration.
+func LoadConfig(fs *flag.FlagSet, program, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	section := ""
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, ok := strings.CutPrefix(line, "["); ok {
+			section, ok = strings.CutSuffix(name, "]")
+			if !ok {
+				return fmt.Errorf("%s:%d: invalid section %q", path, n, line)
+			}
+			continue
+		}
+		if section != "" && section != program {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		fl := fs.Lookup(name)
+		if fl == nil || set[name] {
+			continue
+		}
+		if b, ok := fl.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() && value == "" {
+			value = "true"
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			if rest, ok := strings.CutPrefix(value, "~/"); ok {
+				value = filepath.Join(home, rest)
+			}
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return s.Err()
+}
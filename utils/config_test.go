@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	config := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(config, []byte(`# shared
+key-dir ~/keys
+keystore nv
+
+[ssh-tpm-agent]
+batch
+timeout 30s
+
+[ssh-tpm-keygen]
+t rsa
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("ssh-tpm-agent", flag.ContinueOnError)
+	keyDir := fs.String("key-dir", "", "")
+	keystore := fs.String("keystore", "file", "")
+	batch := fs.Bool("batch", false, "")
+	timeout := fs.Duration("timeout", time.Minute, "")
+	if err := fs.Parse([]string{"--keystore", "file"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfig(fs, "ssh-tpm-agent", config); err != nil {
+		t.Fatal(err)
+	}
+	if *keyDir != filepath.Join(home, "keys") {
+		t.Errorf("key-dir is %q", *keyDir)
+	}
+	if *keystore != "file" {
+		t.Errorf("the config replaced the keystore of the command line with %q", *keystore)
+	}
+	if !*batch || *timeout != 30*time.Second {
+		t.Errorf("agent section not applied: batch %v, timeout %v", *batch, *timeout)
+	}
+
+	if err := LoadConfig(fs, "ssh-tpm-agent", filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Fatalf("missing config: %v", err)
+	}
+	if err := os.WriteFile(config, []byte("timeout soon\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs = flag.NewFlagSet("ssh-tpm-agent", flag.ContinueOnError)
+	fs.Duration("timeout", time.Minute, "")
+	if err := LoadConfig(fs, "ssh-tpm-agent", config); err == nil {
+		t.Fatal("no error for an invalid value")
+	}
+}
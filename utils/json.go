@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+)
+
+// KeyJSON describes a key in the --json output of the commands. The fields are
+// stable and only ever added to.
+type KeyJSON struct {
+	Fingerprint   string `json:"fingerprint"`
+	Type          string `json:"type"`
+	Comment       string `json:"comment"`
+	AuthorizedKey string `json:"authorized_key"`
+	// set for keys derived for a host
+	Host string `json:"host,omitempty"`
+}
+
+// NewKeyJSON returns the KeyJSON of a signing key.
+func NewKeyJSON(k *key.SSHTPMKey) KeyJSON {
+	kj := KeyJSON{
+		Fingerprint:   k.Fingerprint(),
+		Comment:       k.Description,
+		AuthorizedKey: strings.TrimSpace(string(k.AuthorizedKey())),
+		Host:          k.DerivedHost(),
+	}
+	if pk, err := k.SSHPublicKey(); err == nil {
+		kj.Type = pk.Type()
+	}
+	return kj
+}
+
+// PrintJSON writes v to w as indented JSON followed by a newline.
+func PrintJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,23 @@
+//go:build freebsd || openbsd || netbsd || dragonfly
+
+package utils
+
+import (
+	"fmt"
+	"path"
+)
+
+// The tpm(4) drivers of FreeBSD and NetBSD have no resource manager like
+// /dev/tpmrm0 of Linux, so the device can only be used by one process at a
+// time. tpm2-abrmd shares it, see SSH_TPM_TABRMD.
+var tpmDevices = []string{"/dev/tpm0", "/dev/tpm"}
+
+func devicePermissionHint(dev, group string) string {
+	return fmt.Sprintf("the %s group needs to have access to %s, e.g. with the devfs.rules(5) rule \"add path %s mode 0660 group %[1]s\" on FreeBSD, and your user needs to be in it", group, dev, path.Base(dev))
+}
+
+// XDG_RUNTIME_DIR is rarely set on the BSDs, and /var/tmp is shared by all
+// users. Like ssh-agent of OpenSSH 10.1 the sockets go in ~/.ssh/agent.
+func defaultRuntimeDir() string {
+	return path.Join(SSHDir(), "agent")
+}
@@ -0,0 +1,17 @@
+//go:build !freebsd && !openbsd && !netbsd && !dragonfly
+
+package utils
+
+import "fmt"
+
+// The kernel resource manager is preferred, /dev/tpm0 is only used on kernels
+// without it as it can only be opened by one process at a time.
+var tpmDevices = []string{"/dev/tpmrm0", "/dev/tpm0"}
+
+func devicePermissionHint(dev, group string) string {
+	return fmt.Sprintf("the %s group needs to have access to the TPM, add your user to it with \"usermod -aG %[1]s $USER\" and log in again", group)
+}
+
+func defaultRuntimeDir() string {
+	return "/var/tmp"
+}
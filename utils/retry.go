@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+const (
+	// MaxRetries is the number of times a command is resent before the
+	// warning is returned to the caller.
+	MaxRetries = 8
+
+	retryBackoff    = 10 * time.Millisecond
+	retryBackoffMax = 500 * time.Millisecond
+)
+
+// Warnings the TPM returns when it didn't run the command and wants it
+// resent later.
+var retryWarnings = []tpm2.TPMRC{
+	tpm2.TPMRCRetry,
+	tpm2.TPMRCYielded,
+	tpm2.TPMRCTesting,
+	tpm2.TPMRCNVRate,
+	tpm2.TPMRCNVUnavailable,
+}
+
+// RetryTPM resends commands the TPM answered with a retry warning, or which
+// failed with a transient device error, with a bounded exponential backoff.
+type RetryTPM struct {
+	transport.TPMCloser
+	retries atomic.Uint64
+}
+
+func NewRetryTPM(tpm transport.TPMCloser) *RetryTPM {
+	return &RetryTPM{TPMCloser: tpm}
+}
+
+func retryable(rsp []byte, err error) (tpm2.TPMRC, bool) {
+	if err != nil {
+		return 0, errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EINTR)
+	}
+	if len(rsp) < 10 {
+		return 0, false
+	}
+	rc := tpm2.TPMRC(binary.BigEndian.Uint32(rsp[6:10]))
+	for _, w := range retryWarnings {
+		if rc == w {
+			return rc, true
+		}
+	}
+	return rc, false
+}
+
+func (r *RetryTPM) Send(cmd []byte) ([]byte, error) {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		rsp, err := r.TPMCloser.Send(cmd)
+		rc, ok := retryable(rsp, err)
+		if !ok || attempt == MaxRetries {
+			return rsp, err
+		}
+		r.retries.Add(1)
+		if err != nil {
+			slog.Debug("retrying tpm command", slog.Int("attempt", attempt+1), slog.String("error", err.Error()))
+		} else {
+			slog.Debug("retrying tpm command", slog.Int("attempt", attempt+1), slog.String("rc", rc.Error()))
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, retryBackoffMax)
+	}
+}
+
+// Retries returns the number of resent commands
+func (r *RetryTPM) Retries() uint64 {
+	return r.retries.Load()
+}
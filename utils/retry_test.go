@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/tpmconn/tpmconntest"
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestRetryTPM(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		rcs     []tpm2.TPMRC
+		sent    int
+		retries uint64
+		rc      tpm2.TPMRC
+	}{
+		{"success", []tpm2.TPMRC{tpm2.TPMRCSuccess}, 1, 0, tpm2.TPMRCSuccess},
+		{"retry", []tpm2.TPMRC{tpm2.TPMRCRetry, tpm2.TPMRCYielded, tpm2.TPMRCSuccess}, 3, 2, tpm2.TPMRCSuccess},
+		{"error", []tpm2.TPMRC{tpm2.TPMRCAuthFail}, 1, 0, tpm2.TPMRCAuthFail},
+		{"bounded", []tpm2.TPMRC{tpm2.TPMRCRetry}, MaxRetries + 1, MaxRetries, tpm2.TPMRCRetry},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := &tpmconntest.Mock{RCs: c.rcs}
+			tpm := NewRetryTPM(f)
+			rsp, err := tpm.Send([]byte{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rc := tpm2.TPMRC(binary.BigEndian.Uint32(rsp[6:])); rc != c.rc {
+				t.Fatalf("got rc %v, expected %v", rc, c.rc)
+			}
+			if f.Sent != c.sent {
+				t.Fatalf("sent %d commands, expected %d", f.Sent, c.sent)
+			}
+			if tpm.Retries() != c.retries {
+				t.Fatalf("retried %d times, expected %d", tpm.Retries(), c.retries)
+			}
+		})
+	}
+}
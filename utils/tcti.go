@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/foxboron/ssh-tpm-agent/internal/tabrmd"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// TCTIOpener opens a transport from the configuration part of a TCTI string,
+// the text after the colon.
+type TCTIOpener func(conf string) (transport.TPMCloser, error)
+
+var tctis = map[string]TCTIOpener{
+	"device": openDeviceTCTI,
+	"swtpm":  openSwtpmTCTI,
+	"mssim":  openMssimTCTI,
+	"tabrmd": openTabrmdTCTI,
+}
+
+// RegisterTCTI adds a transport OpenTCTI can open by name.
+func RegisterTCTI(name string, open TCTIOpener) {
+	tctis[name] = open
+}
+
+// OpenTCTI opens the transport described by a TCTI string like the ones of
+// tpm2-tools, NAME[:CONF]:
+//
+//	device:/dev/tpmrm0
+//	swtpm:host=localhost,port=2321
+//	swtpm:path=/run/swtpm/sock
+//	mssim:host=localhost,port=2321
+//	tabrmd:bus_name=com.intel.tss2.Tabrmd,bus_type=system
+func OpenTCTI(s string) (transport.TPMCloser, error) {
+	name, conf, _ := strings.Cut(s, ":")
+	open, ok := tctis[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown tcti %q, supported are %s", name, strings.Join(tctiNames(), ", "))
+	}
+	tpm, err := open(conf)
+	if err != nil {
+		return nil, fmt.Errorf("tcti %s: %w", name, err)
+	}
+	return tpm, nil
+}
+
+// tctiNames returns the sorted names of the transports OpenTCTI can open
+func tctiNames() []string {
+	names := make([]string, 0, len(tctis))
+	for n := range tctis {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// parseTCTIConf parses the key=value pairs of a configuration, only allowing
+// the given keys.
+func parseTCTIConf(conf string, keys ...string) (map[string]string, error) {
+	m := map[string]string{}
+	if conf == "" {
+		return m, nil
+	}
+	for _, kv := range strings.Split(conf, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || !slices.Contains(keys, k) {
+			return nil, fmt.Errorf("invalid option %q, supported are %s", kv, strings.Join(keys, ", "))
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+func tcpAddress(conf map[string]string) (string, error) {
+	host, port := conf["host"], conf["port"]
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "2321"
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func openDeviceTCTI(conf string) (transport.TPMCloser, error) {
+	if conf == "" {
+		return openDevice()
+	}
+	return transport.OpenTPM(conf)
+}
+
+// swtpm takes raw TPM commands on its server socket.
+func openSwtpmTCTI(conf string) (transport.TPMCloser, error) {
+	m, err := parseTCTIConf(conf, "host", "port", "path")
+	if err != nil {
+		return nil, err
+	}
+	if p := m["path"]; p != "" {
+		return transport.OpenTPM(p)
+	}
+	addr, err := tcpAddress(m)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &streamTPM{c: c}, nil
+}
+
+// The Microsoft simulator, and swtpm started with the same ports, wrap the
+// commands with TPM_SEND_COMMAND on the command port.
+func openMssimTCTI(conf string) (transport.TPMCloser, error) {
+	m, err := parseTCTIConf(conf, "host", "port")
+	if err != nil {
+		return nil, err
+	}
+	addr, err := tcpAddress(m)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &streamTPM{c: c, mssim: true}, nil
+}
+
+func openTabrmdTCTI(conf string) (transport.TPMCloser, error) {
+	m, err := parseTCTIConf(conf, "bus_name", "bus_type")
+	if err != nil {
+		return nil, err
+	}
+	bus, err := tabrmd.ParseBus(m["bus_type"])
+	if err != nil {
+		return nil, err
+	}
+	return tabrmd.Open(bus, m["bus_name"])
+}
+
+const mssimSendCommand = 8
+
+var errMssimAck = errors.New("mssim: command failed")
+
+// streamTPM sends commands over a connection, raw or with the framing of the
+// Microsoft simulator.
+type streamTPM struct {
+	mu    sync.Mutex
+	c     io.ReadWriteCloser
+	mssim bool
+}
+
+func (s *streamTPM) Send(cmd []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mssim {
+		// command, locality 0 and the length of the command
+		hdr := binary.BigEndian.AppendUint32(nil, mssimSendCommand)
+		hdr = append(hdr, 0)
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(len(cmd)))
+		cmd = append(hdr, cmd...)
+	}
+	if _, err := s.c.Write(cmd); err != nil {
+		return nil, err
+	}
+
+	if s.mssim {
+		var n uint32
+		if err := binary.Read(s.c, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		if n < 10 || n > 64*1024 {
+			return nil, fmt.Errorf("mssim: invalid response size %d", n)
+		}
+		rsp := make([]byte, n)
+		if _, err := io.ReadFull(s.c, rsp); err != nil {
+			return nil, err
+		}
+		var ack uint32
+		if err := binary.Read(s.c, binary.BigEndian, &ack); err != nil {
+			return nil, err
+		}
+		if ack != 0 {
+			return nil, errMssimAck
+		}
+		return rsp, nil
+	}
+
+	rsp := make([]byte, 10)
+	if _, err := io.ReadFull(s.c, rsp); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(rsp[2:])
+	if n < 10 || n > 64*1024 {
+		return nil, fmt.Errorf("invalid response size %d", n)
+	}
+	rsp = append(rsp, make([]byte, n-10)...)
+	if _, err := io.ReadFull(s.c, rsp[10:]); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func (s *streamTPM) Close() error {
+	return s.c.Close()
+}
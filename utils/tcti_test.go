@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+// serveMssim answers TPM_SEND_COMMAND on c from the simulator.
+func serveMssim(t *testing.T, c net.Conn) {
+	defer c.Close()
+	sim, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sim.Close()
+	for {
+		hdr := make([]byte, 9)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return
+		}
+		if binary.BigEndian.Uint32(hdr) != mssimSendCommand {
+			t.Errorf("unexpected mssim command %d", binary.BigEndian.Uint32(hdr))
+			return
+		}
+		cmd := make([]byte, binary.BigEndian.Uint32(hdr[5:]))
+		if _, err := io.ReadFull(c, cmd); err != nil {
+			return
+		}
+		rsp, err := sim.Send(cmd)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(rsp)))
+		b = append(b, rsp...)
+		c.Write(binary.BigEndian.AppendUint32(b, 0))
+	}
+}
+
+func TestOpenTCTI(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		serveMssim(t, c)
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	tpm, err := OpenTCTI("mssim:host=127.0.0.1,port=" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+	rsp, err := tpm2.GetRandom{BytesRequested: 16}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.RandomBytes.Buffer) != 16 {
+		t.Fatalf("got %d random bytes, want 16", len(rsp.RandomBytes.Buffer))
+	}
+
+	for _, c := range []struct{ tcti, err string }{
+		{"foo:bar", "unknown tcti"},
+		{"mssim:hots=localhost", "invalid option"},
+		{"swtpm:port=99999", "invalid port"},
+		{"tabrmd:bus_type=user", "unknown bus"},
+	} {
+		if _, err := OpenTCTI(c.tcti); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("%s: expected %q, got %v", c.tcti, c.err, err)
+		}
+	}
+}
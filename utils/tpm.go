@@ -2,9 +2,14 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"os/user"
 	"path"
+	"strconv"
+	"syscall"
 
+	"github.com/foxboron/ssh-tpm-agent/internal/relay"
 	swtpm "github.com/foxboron/swtpm_test"
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpm2/transport"
@@ -24,7 +29,53 @@ func FlushHandle(tpm transport.TPM, h handle) {
 
 var swtpmPath = "/var/tmp/ssh-tpm-agent"
 
-// Smaller wrapper for getting the correct TPM instance
+var ErrNoTPM = errors.New("no TPM found")
+
+// deviceGroup returns the name of the group owning the device, or tss which
+// the udev rules of tpm2-tss use.
+func deviceGroup(dev string) string {
+	fi, err := os.Stat(dev)
+	if err != nil {
+		return "tss"
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Gid == 0 {
+		return "tss"
+	}
+	g, err := user.LookupGroupId(strconv.FormatUint(uint64(st.Gid), 10))
+	if err != nil {
+		return "tss"
+	}
+	return g.Name
+}
+
+// openDevice opens the first of tpmDevices which exists.
+func openDevice() (transport.TPMCloser, error) {
+	for _, dev := range tpmDevices {
+		tpm, err := transport.OpenTPM(dev)
+		switch {
+		case err == nil:
+			return tpm, nil
+		case errors.Is(err, os.ErrNotExist):
+			continue
+		case errors.Is(err, os.ErrPermission):
+			return nil, fmt.Errorf("%w: %s", err, devicePermissionHint(dev, deviceGroup(dev)))
+		case errors.Is(err, syscall.EBUSY):
+			return nil, fmt.Errorf("%w: %s is in use by another program, set SSH_TPM_TABRMD=system if it is tpm2-abrmd", err, dev)
+		default:
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: none of %v exist", ErrNoTPM, tpmDevices)
+}
+
+// Smaller wrapper for getting the correct TPM instance. Commands are retried
+// on TPM retry warnings, see RetryTPM. SSH_TPM_TCTI configures the transport
+// with a TCTI string, see OpenTCTI. SSH_TPM_RELAY relays the commands
+// through the given program instead, which is used to reach the Windows TPM
+// from WSL. SSH_TPM_TABRMD=system or session goes through tpm2-abrmd on that
+// D-Bus bus. Otherwise /dev/tpmrm0 is used, or /dev/tpm0 when there
+// is no resource manager.
 func TPM(f bool) (transport.TPMCloser, error) {
 	var tpm transport.TPMCloser
 	var err error
@@ -33,11 +84,20 @@ func TPM(f bool) (transport.TPMCloser, error) {
 			os.MkdirTemp(path.Dir(swtpmPath), path.Base(swtpmPath))
 		}
 		tpm, err = swtpm.OpenSwtpm(swtpmPath)
+	} else if tcti := os.Getenv("SSH_TPM_TCTI"); tcti != "" {
+		tpm, err = OpenTCTI(tcti)
+	} else if program := os.Getenv("SSH_TPM_RELAY"); program != "" {
+		tpm, err = relay.Open(program)
+	} else if bus := os.Getenv("SSH_TPM_TABRMD"); bus != "" {
+		tpm, err = OpenTCTI("tabrmd:bus_type=" + bus)
 	} else {
-		tpm, err = transport.OpenTPM()
+		tpm, err = openDevice()
 	}
 	if err != nil {
 		return nil, err
 	}
-	return tpm, nil
+	if DebugTPM {
+		tpm = NewTraceTPM(tpm)
+	}
+	return NewRetryTPM(tpm), nil
 }
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenDevice(t *testing.T) {
+	dir := t.TempDir()
+	defer func(devs []string) { tpmDevices = devs }(tpmDevices)
+
+	tpmDevices = []string{filepath.Join(dir, "tpmrm0"), filepath.Join(dir, "tpm0")}
+	if _, err := openDevice(); !errors.Is(err, ErrNoTPM) {
+		t.Fatalf("expected ErrNoTPM, got %v", err)
+	}
+
+	// falls back to the second device, which isn't a TPM
+	if err := os.WriteFile(tpmDevices[1], nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDevice(); err == nil || errors.Is(err, ErrNoTPM) {
+		t.Fatalf("expected an error opening %s, got %v", tpmDevices[1], err)
+	}
+}
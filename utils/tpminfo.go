@@ -0,0 +1,402 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// TPMA_PERMANENT bits
+const (
+	permanentOwnerAuthSet   = 1 << 0
+	permanentLockoutAuthSet = 1 << 2
+	permanentInLockout      = 1 << 9
+)
+
+// TPMInfo is what the TPM reports about itself which matters for using it
+// with ssh-tpm-agent.
+type TPMInfo struct {
+	Manufacturer string
+	VendorString string
+	// major.minor of the firmware, and the vendor specific second part
+	FirmwareVersion  string
+	FirmwareVersion2 uint32
+	// the version of the TPM library specification, e.g. 2.0 level 0
+	// revision 159 of 2019
+	SpecFamily   string
+	SpecLevel    uint32
+	SpecRevision uint32
+	SpecYear     uint32
+
+	OwnerAuthSet   bool
+	LockoutAuthSet bool
+	InLockout      bool
+	LockoutCounter uint32
+	MaxAuthFail    uint32
+	// seconds until a failed authorization is forgotten, and until the
+	// lockout password can be tried again after it was wrong
+	LockoutInterval uint32
+	LockoutRecovery uint32
+
+	ECCBits    []int
+	RSA        bool
+	SHA256PCR  bool
+	Algorithms []string
+
+	// loaded transient objects and persistent objects, with how many more
+	// fit, which the TPM may estimate
+	TransientLoaded uint32
+	TransientAvail  uint32
+	Persistent      uint32
+	PersistentAvail uint32
+}
+
+var algorithmNames = map[tpm2.TPMAlgID]string{
+	tpm2.TPMAlgRSA:          "rsa",
+	tpm2.TPMAlgTDES:         "tdes",
+	tpm2.TPMAlgSHA1:         "sha1",
+	tpm2.TPMAlgHMAC:         "hmac",
+	tpm2.TPMAlgAES:          "aes",
+	tpm2.TPMAlgMGF1:         "mgf1",
+	tpm2.TPMAlgKeyedHash:    "keyedhash",
+	tpm2.TPMAlgXOR:          "xor",
+	tpm2.TPMAlgSHA256:       "sha256",
+	tpm2.TPMAlgSHA384:       "sha384",
+	tpm2.TPMAlgSHA512:       "sha512",
+	tpm2.TPMAlgNull:         "null",
+	tpm2.TPMAlgSM3256:       "sm3_256",
+	tpm2.TPMAlgSM4:          "sm4",
+	tpm2.TPMAlgRSASSA:       "rsassa",
+	tpm2.TPMAlgRSAES:        "rsaes",
+	tpm2.TPMAlgRSAPSS:       "rsapss",
+	tpm2.TPMAlgOAEP:         "oaep",
+	tpm2.TPMAlgECDSA:        "ecdsa",
+	tpm2.TPMAlgECDH:         "ecdh",
+	tpm2.TPMAlgECDAA:        "ecdaa",
+	tpm2.TPMAlgSM2:          "sm2",
+	tpm2.TPMAlgECSchnorr:    "ecschnorr",
+	tpm2.TPMAlgECMQV:        "ecmqv",
+	tpm2.TPMAlgKDF1SP80056A: "kdf1_sp800_56a",
+	tpm2.TPMAlgKDF2:         "kdf2",
+	tpm2.TPMAlgKDF1SP800108: "kdf1_sp800_108",
+	tpm2.TPMAlgECC:          "ecc",
+	tpm2.TPMAlgSymCipher:    "symcipher",
+	tpm2.TPMAlgCamellia:     "camellia",
+	tpm2.TPMAlgSHA3256:      "sha3_256",
+	tpm2.TPMAlgSHA3384:      "sha3_384",
+	tpm2.TPMAlgSHA3512:      "sha3_512",
+	tpm2.TPMAlgCMAC:         "cmac",
+	tpm2.TPMAlgCTR:          "ctr",
+	tpm2.TPMAlgOFB:          "ofb",
+	tpm2.TPMAlgCBC:          "cbc",
+	tpm2.TPMAlgCFB:          "cfb",
+	tpm2.TPMAlgECB:          "ecb",
+}
+
+// AlgorithmName is the name of alg in the TCG algorithm registry, or its
+// number for algorithms it doesn't know
+func AlgorithmName(alg tpm2.TPMAlgID) string {
+	if name, ok := algorithmNames[alg]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", uint16(alg))
+}
+
+// propertyString decodes the characters packed into the properties, like
+// the manufacturer and the vendor string
+func propertyString(values ...uint32) string {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return string(bytes.TrimRight(bytes.ReplaceAll(b, []byte{0}, nil), " "))
+}
+
+// tpmHandleCount counts the handles of type ht in use
+func tpmHandleCount(tpm transport.TPM, ht tpm2.TPMHT) (uint32, error) {
+	var n uint32
+	next := uint32(ht) << 24
+	for {
+		rsp, err := tpm2.GetCapability{
+			Capability:    tpm2.TPMCapHandles,
+			Property:      next,
+			PropertyCount: 64,
+		}.Execute(tpm)
+		if err != nil {
+			return 0, err
+		}
+		handles, err := rsp.CapabilityData.Data.Handles()
+		if err != nil {
+			return 0, err
+		}
+		for _, h := range handles.Handle {
+			if uint32(h)>>24 != uint32(ht) {
+				return n, nil
+			}
+			n++
+			next = uint32(h) + 1
+		}
+		if !rsp.MoreData || len(handles.Handle) == 0 {
+			return n, nil
+		}
+	}
+}
+
+// tpmAlgorithms returns the names of the algorithms the TPM implements
+func tpmAlgorithms(tpm transport.TPM) ([]string, error) {
+	var names []string
+	next := uint32(0)
+	for {
+		rsp, err := tpm2.GetCapability{
+			Capability:    tpm2.TPMCapAlgs,
+			Property:      next,
+			PropertyCount: 64,
+		}.Execute(tpm)
+		if err != nil {
+			return nil, err
+		}
+		algs, err := rsp.CapabilityData.Data.Algorithms()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range algs.AlgProperties {
+			names = append(names, AlgorithmName(p.Alg))
+			next = uint32(p.Alg) + 1
+		}
+		if !rsp.MoreData || len(algs.AlgProperties) == 0 {
+			return names, nil
+		}
+	}
+}
+
+func tpmProperties(tpm transport.TPM, first tpm2.TPMPT, count uint32) (map[tpm2.TPMPT]uint32, error) {
+	rsp, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapTPMProperties,
+		Property:      uint32(first),
+		PropertyCount: count,
+	}.Execute(tpm)
+	if err != nil {
+		return nil, err
+	}
+	props, err := rsp.CapabilityData.Data.TPMProperties()
+	if err != nil {
+		return nil, err
+	}
+	m := map[tpm2.TPMPT]uint32{}
+	for _, p := range props.TPMProperty {
+		m[p.Property] = p.Value
+	}
+	return m, nil
+}
+
+// SelfTest runs TPM2_SelfTest, which go-tpm doesn't have. Without full only
+// the algorithms which weren't tested yet are tested.
+func SelfTest(tpm transport.TPM, full bool) error {
+	cmd := binary.BigEndian.AppendUint16(nil, uint16(tpm2.TPMSTNoSessions))
+	cmd = binary.BigEndian.AppendUint32(cmd, 11)
+	cmd = binary.BigEndian.AppendUint32(cmd, uint32(tpm2.TPMCCSelfTest))
+	if full {
+		cmd = append(cmd, 1)
+	} else {
+		cmd = append(cmd, 0)
+	}
+	rsp, err := tpm.Send(cmd)
+	if err != nil {
+		return err
+	}
+	if len(rsp) < 10 {
+		return fmt.Errorf("short self test response")
+	}
+	// TPM_RC_TESTING is returned while the tests run in the background
+	switch rc := tpm2.TPMRC(binary.BigEndian.Uint32(rsp[6:10])); rc {
+	case tpm2.TPMRCSuccess, tpm2.TPMRCTesting:
+		return nil
+	default:
+		return rc
+	}
+}
+
+// ResetLockout runs TPM2_DictionaryAttackLockReset, which go-tpm doesn't
+// have, with the lockout password. It forgets all failed authorizations and
+// ends the dictionary attack lockout.
+func ResetLockout(tpm transport.TPM, lockoutPassword []byte) error {
+	// the password session: TPM_RS_PW, no nonce, no attributes, the password
+	auth := binary.BigEndian.AppendUint32(nil, uint32(tpm2.TPMRSPW))
+	auth = binary.BigEndian.AppendUint16(auth, 0)
+	auth = append(auth, 0)
+	auth = binary.BigEndian.AppendUint16(auth, uint16(len(lockoutPassword)))
+	auth = append(auth, lockoutPassword...)
+
+	cmd := binary.BigEndian.AppendUint16(nil, uint16(tpm2.TPMSTSessions))
+	cmd = binary.BigEndian.AppendUint32(cmd, uint32(18+len(auth)))
+	cmd = binary.BigEndian.AppendUint32(cmd, uint32(tpm2.TPMCCDictionaryAttackLockReset))
+	cmd = binary.BigEndian.AppendUint32(cmd, uint32(tpm2.TPMRHLockout))
+	cmd = binary.BigEndian.AppendUint32(cmd, uint32(len(auth)))
+	cmd = append(cmd, auth...)
+	rsp, err := tpm.Send(cmd)
+	if err != nil {
+		return err
+	}
+	if len(rsp) < 10 {
+		return fmt.Errorf("short dictionary attack lock reset response")
+	}
+	if rc := tpm2.TPMRC(binary.BigEndian.Uint32(rsp[6:10])); rc != tpm2.TPMRCSuccess {
+		return rc
+	}
+	return nil
+}
+
+// ReadTPMInfo reads the TPMInfo through TPM2_GetCapability
+func ReadTPMInfo(tpm transport.TPMCloser) (*TPMInfo, error) {
+	fixed, err := tpmProperties(tpm, tpm2.TPMPTFamilyIndicator, uint32(tpm2.TPMPTFirmwareVersion2-tpm2.TPMPTFamilyIndicator+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading tpm properties: %w", err)
+	}
+	vars, err := tpmProperties(tpm, tpm2.TPMPTPermanent, uint32(tpm2.TPMPTLockoutRecovery-tpm2.TPMPTPermanent+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading tpm properties: %w", err)
+	}
+
+	info := &TPMInfo{
+		Manufacturer: propertyString(fixed[tpm2.TPMPTManufacturer]),
+		VendorString: propertyString(fixed[tpm2.TPMPTVendorString1], fixed[tpm2.TPMPTVendorString2],
+			fixed[tpm2.TPMPTVendorString3], fixed[tpm2.TPMPTVendorString4]),
+		FirmwareVersion: fmt.Sprintf("%d.%d",
+			fixed[tpm2.TPMPTFirmwareVersion1]>>16, fixed[tpm2.TPMPTFirmwareVersion1]&0xffff),
+		FirmwareVersion2: fixed[tpm2.TPMPTFirmwareVersion2],
+		SpecFamily:       propertyString(fixed[tpm2.TPMPTFamilyIndicator]),
+		SpecLevel:        fixed[tpm2.TPMPTLevel],
+		SpecRevision:     fixed[tpm2.TPMPTRevision],
+		SpecYear:         fixed[tpm2.TPMPTYear],
+		OwnerAuthSet:     vars[tpm2.TPMPTPermanent]&permanentOwnerAuthSet != 0,
+		LockoutAuthSet:   vars[tpm2.TPMPTPermanent]&permanentLockoutAuthSet != 0,
+		InLockout:        vars[tpm2.TPMPTPermanent]&permanentInLockout != 0,
+		LockoutCounter:   vars[tpm2.TPMPTLockoutCounter],
+		MaxAuthFail:      vars[tpm2.TPMPTMaxAuthFail],
+		LockoutInterval:  vars[tpm2.TPMPTLockoutInterval],
+		LockoutRecovery:  vars[tpm2.TPMPTLockoutRecovery],
+		ECCBits:          keyfile.SupportedECCAlgorithms(tpm),
+		TransientLoaded:  vars[tpm2.TPMPTHRLoaded],
+		TransientAvail:   vars[tpm2.TPMPTHRTransientAvail],
+		Persistent:       vars[tpm2.TPMPTHRPersistent],
+		PersistentAvail:  vars[tpm2.TPMPTHRPersistentAvail],
+	}
+	if info.Algorithms, err = tpmAlgorithms(tpm); err != nil {
+		return nil, fmt.Errorf("failed reading tpm algorithms: %w", err)
+	}
+	info.RSA = slices.Contains(info.Algorithms, AlgorithmName(tpm2.TPMAlgRSA))
+	if info.TransientLoaded, err = tpmHandleCount(tpm, tpm2.TPMHTTransient); err != nil {
+		return nil, fmt.Errorf("failed reading tpm handles: %w", err)
+	}
+
+	pcrs, err := tpm2.GetCapability{
+		Capability:    tpm2.TPMCapPCRs,
+		PropertyCount: 1,
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading pcr banks: %w", err)
+	}
+	if sel, err := pcrs.CapabilityData.Data.AssignedPCR(); err == nil {
+		info.SHA256PCR = slices.ContainsFunc(sel.PCRSelections, func(s tpm2.TPMSPCRSelection) bool {
+			return s.Hash == tpm2.TPMAlgSHA256 && slices.ContainsFunc(s.PCRSelect, func(b byte) bool { return b != 0 })
+		})
+	}
+	return info, nil
+}
+
+// Missing returns what k needs which the TPM doesn't support, or an empty
+// string if the TPM can use k.
+func (i *TPMInfo) Missing(k *key.SSHTPMKey) string {
+	switch k.KeyAlgo() {
+	case tpm2.TPMAlgECC:
+		if pk, err := k.PublicKey(); err == nil {
+			if ecpk, ok := pk.(*ecdsa.PublicKey); ok && !slices.Contains(i.ECCBits, ecpk.Curve.Params().BitSize) {
+				return fmt.Sprintf("ECC P-%d", ecpk.Curve.Params().BitSize)
+			}
+		}
+	case tpm2.TPMAlgRSA:
+		if !i.RSA {
+			return "RSA"
+		}
+	}
+	// persistent parents exist already
+	if !keyfile.IsMSO(k.Parent, keyfile.TPM_HT_PERSISTENT) {
+		if k.RSAParent && !i.RSA {
+			return "RSA for the SRK"
+		}
+		if !k.RSAParent && !slices.Contains(i.ECCBits, 256) {
+			return "ECC P-256 for the SRK"
+		}
+	}
+	if len(k.BoundPCRs()) != 0 && !i.SHA256PCR {
+		return "SHA-256 PCRs"
+	}
+	return ""
+}
+
+// ChooseKey checks that the TPM can create keys of keyType with bits, and
+// picks them when they aren't given: ecdsa with 256 bits, or rsa with 2048
+// bits on TPMs without ECC P-256.
+func (i *TPMInfo) ChooseKey(keyType string, bits int) (string, int, error) {
+	if keyType == "" {
+		switch {
+		case slices.Contains(i.ECCBits, 256):
+			keyType = "ecdsa"
+		case i.RSA:
+			keyType = "rsa"
+		default:
+			return "", 0, fmt.Errorf("the TPM supports neither ecdsa P-256 nor rsa keys")
+		}
+	}
+	switch keyType {
+	case "ecdsa":
+		if bits == 0 {
+			bits = 256
+		}
+		if slices.Contains(i.ECCBits, bits) {
+			return keyType, bits, nil
+		}
+		if len(i.ECCBits) == 0 {
+			return "", 0, fmt.Errorf("the TPM doesn't support ecdsa keys, use -t rsa")
+		}
+		return "", 0, fmt.Errorf("the TPM doesn't support ecdsa keys with %d bits, use -b with one of %v", bits, i.ECCBits)
+	case "rsa":
+		if bits == 0 {
+			bits = 2048
+		}
+		if !i.RSA {
+			return "", 0, fmt.Errorf("the TPM doesn't support rsa keys, use -t ecdsa")
+		}
+		return keyType, bits, nil
+	}
+	return "", 0, fmt.Errorf("unsupported key type %s, use -t ecdsa or -t rsa", keyType)
+}
+
+// ChooseParent checks that the TPM can create the SRK from template, ecc or
+// rsa, and picks ecc, or rsa on TPMs without ECC P-256, when it isn't given.
+func (i *TPMInfo) ChooseParent(template string) (string, error) {
+	ecc := slices.Contains(i.ECCBits, 256)
+	switch template {
+	case "":
+		if !ecc && i.RSA {
+			return "rsa", nil
+		}
+		return "ecc", nil
+	case "ecc":
+		if !ecc && i.RSA {
+			return "", fmt.Errorf("the TPM doesn't support ECC P-256 for the SRK, use --parent-template rsa")
+		}
+	case "rsa":
+		if !i.RSA && ecc {
+			return "", fmt.Errorf("the TPM doesn't support rsa for the SRK, use --parent-template ecc")
+		}
+	}
+	return template, nil
+}
@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestSelfTest(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	for _, full := range []bool{false, true} {
+		if err := SelfTest(tpm, full); err != nil {
+			t.Fatalf("self test with full %v: %v", full, err)
+		}
+	}
+}
+
+func TestReadTPMInfo(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	info, err := ReadTPMInfo(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Manufacturer == "" || info.SpecFamily != "2.0" || info.SpecRevision == 0 || info.SpecYear == 0 {
+		t.Fatalf("incomplete tpm info: %+v", info)
+	}
+	for _, alg := range []string{"rsa", "ecc", "sha256", "ecdsa"} {
+		if !slices.Contains(info.Algorithms, alg) {
+			t.Fatalf("%s missing in %v", alg, info.Algorithms)
+		}
+	}
+	if AlgorithmName(tpm2.TPMAlgID(0x7fff)) != "0x7fff" {
+		t.Fatal("unknown algorithm isn't shown as a number")
+	}
+
+	srk, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(tpm2.ECCSRKTemplate),
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm2.FlushContext{FlushHandle: srk.ObjectHandle}.Execute(tpm)
+	persistent := tpm2.TPMHandle(0x81000100)
+	_, err = tpm2.EvictControl{
+		Auth:             tpm2.TPMRHOwner,
+		ObjectHandle:     &tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		PersistentHandle: persistent,
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm2.EvictControl{
+		Auth:             tpm2.TPMRHOwner,
+		ObjectHandle:     &tpm2.NamedHandle{Handle: persistent, Name: srk.Name},
+		PersistentHandle: persistent,
+	}.Execute(tpm)
+	after, err := ReadTPMInfo(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Persistent != info.Persistent+1 || after.TransientLoaded != info.TransientLoaded+1 {
+		t.Fatalf("handles not counted: %+v", after)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	info, err := ReadTPMInfo(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecc, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 384, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgRSA, 2048, []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []*key.SSHTPMKey{ecc, rsa} {
+		if missing := info.Missing(k); missing != "" {
+			t.Fatalf("the simulator is missing %s", missing)
+		}
+	}
+
+	for _, c := range []struct {
+		info    TPMInfo
+		k       *key.SSHTPMKey
+		missing string
+	}{
+		{TPMInfo{ECCBits: []int{256}, RSA: true}, ecc, "ECC P-384"},
+		{TPMInfo{ECCBits: []int{256}}, rsa, "RSA"},
+		{TPMInfo{RSA: true, ECCBits: []int{384}}, ecc, "ECC P-256 for the SRK"},
+	} {
+		if missing := c.info.Missing(c.k); missing != c.missing {
+			t.Fatalf("expected %q to be missing, got %q", c.missing, missing)
+		}
+	}
+}
+
+func TestChooseKey(t *testing.T) {
+	for _, c := range []struct {
+		info       TPMInfo
+		keyType    string
+		bits       int
+		chosen     string
+		chosenBits int
+		parent     string
+		err        bool
+	}{
+		{info: TPMInfo{ECCBits: []int{256, 384}, RSA: true}, chosen: "ecdsa", chosenBits: 256, parent: "ecc"},
+		{info: TPMInfo{RSA: true}, chosen: "rsa", chosenBits: 2048, parent: "rsa"},
+		{info: TPMInfo{ECCBits: []int{256, 384}, RSA: true}, keyType: "ecdsa", bits: 384, chosen: "ecdsa", chosenBits: 384, parent: "ecc"},
+		{info: TPMInfo{ECCBits: []int{256}, RSA: true}, keyType: "rsa", chosen: "rsa", chosenBits: 2048, parent: "ecc"},
+		{info: TPMInfo{ECCBits: []int{256}, RSA: true}, keyType: "ecdsa", bits: 521, err: true},
+		{info: TPMInfo{ECCBits: []int{256}}, keyType: "rsa", err: true},
+		{info: TPMInfo{RSA: true}, keyType: "ecdsa", err: true},
+		{info: TPMInfo{}, err: true},
+		{info: TPMInfo{ECCBits: []int{256}}, keyType: "ed25519", err: true},
+	} {
+		keyType, bits, err := c.info.ChooseKey(c.keyType, c.bits)
+		if c.err {
+			if err == nil {
+				t.Fatalf("expected %s %d to be refused on %+v", c.keyType, c.bits, c.info)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyType != c.chosen || bits != c.chosenBits {
+			t.Fatalf("chose %s %d instead of %s %d", keyType, bits, c.chosen, c.chosenBits)
+		}
+		if parent, err := c.info.ChooseParent(""); err != nil || parent != c.parent {
+			t.Fatalf("chose the %s srk instead of %s: %v", parent, c.parent, err)
+		}
+	}
+
+	if _, err := (&TPMInfo{RSA: true}).ChooseParent("ecc"); err == nil {
+		t.Fatal("chose the ecc srk on a TPM without ECC P-256")
+	}
+}
+
+func TestResetLockout(t *testing.T) {
+	tpm, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm.Close()
+
+	// a parent with a password, which counts failed authorizations
+	template := tpm2.ECCSRKTemplate
+	template.ObjectAttributes.NoDA = false
+	srk, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				UserAuth: tpm2.TPM2BAuth{Buffer: []byte("pin")},
+			},
+		},
+		InPublic: tpm2.New2B(template),
+	}.Execute(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tpm2.FlushContext{FlushHandle: srk.ObjectHandle}.Execute(tpm)
+	_, err = tpm2.Create{
+		ParentHandle: tpm2.AuthHandle{Handle: srk.ObjectHandle, Name: srk.Name, Auth: tpm2.PasswordAuth([]byte("wrong"))},
+		InPublic:     tpm2.New2B(tpm2.ECCSRKTemplate),
+	}.Execute(tpm)
+	if !errors.Is(err, tpm2.TPMRCAuthFail) {
+		t.Fatalf("expected a failed authorization, got %v", err)
+	}
+
+	info, err := ReadTPMInfo(tpm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LockoutCounter == 0 {
+		t.Fatal("failed authorization wasn't counted")
+	}
+	if err := ResetLockout(tpm, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = ReadTPMInfo(tpm); err != nil {
+		t.Fatal(err)
+	}
+	if info.LockoutCounter != 0 {
+		t.Fatalf("%d failed authorizations after the reset", info.LockoutCounter)
+	}
+
+	if err := ResetLockout(tpm, []byte("wrong")); !errors.Is(err, tpm2.TPMRCBadAuth) && !errors.Is(err, tpm2.TPMRCAuthFail) {
+		t.Fatalf("expected a wrong lockout password, got %v", err)
+	}
+}
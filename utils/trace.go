@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+// DebugTPM makes TPM wrap the transport in a TraceTPM
+var DebugTPM bool
+
+// Names of the commands and the number of handles in their handle area,
+// which is needed to find the sessions.
+var commands = map[tpm2.TPMCC]struct {
+	name    string
+	handles int
+}{
+	tpm2.TPMCCNVUndefineSpaceSpecial:     {"TPM2_NV_UndefineSpaceSpecial", 2},
+	tpm2.TPMCCEvictControl:               {"TPM2_EvictControl", 2},
+	tpm2.TPMCCHierarchyControl:           {"TPM2_HierarchyControl", 1},
+	tpm2.TPMCCNVUndefineSpace:            {"TPM2_NV_UndefineSpace", 2},
+	tpm2.TPMCCChangeEPS:                  {"TPM2_ChangeEPS", 1},
+	tpm2.TPMCCChangePPS:                  {"TPM2_ChangePPS", 1},
+	tpm2.TPMCCClear:                      {"TPM2_Clear", 1},
+	tpm2.TPMCCClearControl:               {"TPM2_ClearControl", 1},
+	tpm2.TPMCCClockSet:                   {"TPM2_ClockSet", 1},
+	tpm2.TPMCCHierarchyChanegAuth:        {"TPM2_HierarchyChangeAuth", 1},
+	tpm2.TPMCCNVDefineSpace:              {"TPM2_NV_DefineSpace", 1},
+	tpm2.TPMCCPCRAllocate:                {"TPM2_PCR_Allocate", 1},
+	tpm2.TPMCCPCRSetAuthPolicy:           {"TPM2_PCR_SetAuthPolicy", 1},
+	tpm2.TPMCCPPCommands:                 {"TPM2_PP_Commands", 1},
+	tpm2.TPMCCSetPrimaryPolicy:           {"TPM2_SetPrimaryPolicy", 1},
+	tpm2.TPMCCFieldUpgradeStart:          {"TPM2_FieldUpgradeStart", 2},
+	tpm2.TPMCCClockRateAdjust:            {"TPM2_ClockRateAdjust", 1},
+	tpm2.TPMCCCreatePrimary:              {"TPM2_CreatePrimary", 1},
+	tpm2.TPMCCNVGlobalWriteLock:          {"TPM2_NV_GlobalWriteLock", 1},
+	tpm2.TPMCCGetCommandAuditDigest:      {"TPM2_GetCommandAuditDigest", 2},
+	tpm2.TPMCCNVIncrement:                {"TPM2_NV_Increment", 2},
+	tpm2.TPMCCNVSetBits:                  {"TPM2_NV_SetBits", 2},
+	tpm2.TPMCCNVExtend:                   {"TPM2_NV_Extend", 2},
+	tpm2.TPMCCNVWrite:                    {"TPM2_NV_Write", 2},
+	tpm2.TPMCCNVWriteLock:                {"TPM2_NV_WriteLock", 2},
+	tpm2.TPMCCDictionaryAttackLockReset:  {"TPM2_DictionaryAttackLockReset", 1},
+	tpm2.TPMCCDictionaryAttackParameters: {"TPM2_DictionaryAttackParameters", 1},
+	tpm2.TPMCCNVChangeAuth:               {"TPM2_NV_ChangeAuth", 1},
+	tpm2.TPMCCPCREvent:                   {"TPM2_PCR_Event", 1},
+	tpm2.TPMCCPCRReset:                   {"TPM2_PCR_Reset", 1},
+	tpm2.TPMCCSequenceComplete:           {"TPM2_SequenceComplete", 1},
+	tpm2.TPMCCSetAlgorithmSet:            {"TPM2_SetAlgorithmSet", 1},
+	tpm2.TPMCCSetCommandCodeAuditStatus:  {"TPM2_SetCommandCodeAuditStatus", 1},
+	tpm2.TPMCCFieldUpgradeData:           {"TPM2_FieldUpgradeData", 0},
+	tpm2.TPMCCIncrementalSelfTest:        {"TPM2_IncrementalSelfTest", 0},
+	tpm2.TPMCCSelfTest:                   {"TPM2_SelfTest", 0},
+	tpm2.TPMCCStartup:                    {"TPM2_Startup", 0},
+	tpm2.TPMCCShutdown:                   {"TPM2_Shutdown", 0},
+	tpm2.TPMCCStirRandom:                 {"TPM2_StirRandom", 0},
+	tpm2.TPMCCActivateCredential:         {"TPM2_ActivateCredential", 2},
+	tpm2.TPMCCCertify:                    {"TPM2_Certify", 2},
+	tpm2.TPMCCPolicyNV:                   {"TPM2_PolicyNV", 3},
+	tpm2.TPMCCCertifyCreation:            {"TPM2_CertifyCreation", 2},
+	tpm2.TPMCCDuplicate:                  {"TPM2_Duplicate", 2},
+	tpm2.TPMCCGetTime:                    {"TPM2_GetTime", 2},
+	tpm2.TPMCCGetSessionAuditDigest:      {"TPM2_GetSessionAuditDigest", 3},
+	tpm2.TPMCCNVRead:                     {"TPM2_NV_Read", 2},
+	tpm2.TPMCCNVReadLock:                 {"TPM2_NV_ReadLock", 2},
+	tpm2.TPMCCObjectChangeAuth:           {"TPM2_ObjectChangeAuth", 2},
+	tpm2.TPMCCPolicySecret:               {"TPM2_PolicySecret", 2},
+	tpm2.TPMCCRewrap:                     {"TPM2_Rewrap", 2},
+	tpm2.TPMCCCreate:                     {"TPM2_Create", 1},
+	tpm2.TPMCCECDHZGen:                   {"TPM2_ECDH_ZGen", 1},
+	tpm2.TPMCCMAC:                        {"TPM2_MAC", 1},
+	tpm2.TPMCCImport:                     {"TPM2_Import", 1},
+	tpm2.TPMCCLoad:                       {"TPM2_Load", 1},
+	tpm2.TPMCCQuote:                      {"TPM2_Quote", 1},
+	tpm2.TPMCCRSADecrypt:                 {"TPM2_RSA_Decrypt", 1},
+	tpm2.TPMCCMACStart:                   {"TPM2_MAC_Start", 1},
+	tpm2.TPMCCSequenceUpdate:             {"TPM2_SequenceUpdate", 1},
+	tpm2.TPMCCSign:                       {"TPM2_Sign", 1},
+	tpm2.TPMCCUnseal:                     {"TPM2_Unseal", 1},
+	tpm2.TPMCCPolicySigned:               {"TPM2_PolicySigned", 2},
+	tpm2.TPMCCContextLoad:                {"TPM2_ContextLoad", 0},
+	tpm2.TPMCCContextSave:                {"TPM2_ContextSave", 1},
+	tpm2.TPMCCECDHKeyGen:                 {"TPM2_ECDH_KeyGen", 1},
+	tpm2.TPMCCEncryptDecrypt:             {"TPM2_EncryptDecrypt", 1},
+	tpm2.TPMCCFlushContext:               {"TPM2_FlushContext", 0},
+	tpm2.TPMCCLoadExternal:               {"TPM2_LoadExternal", 0},
+	tpm2.TPMCCMakeCredential:             {"TPM2_MakeCredential", 1},
+	tpm2.TPMCCNVReadPublic:               {"TPM2_NV_ReadPublic", 1},
+	tpm2.TPMCCPolicyAuthorize:            {"TPM2_PolicyAuthorize", 1},
+	tpm2.TPMCCPolicyAuthValue:            {"TPM2_PolicyAuthValue", 1},
+	tpm2.TPMCCPolicyCommandCode:          {"TPM2_PolicyCommandCode", 1},
+	tpm2.TPMCCPolicyCounterTimer:         {"TPM2_PolicyCounterTimer", 1},
+	tpm2.TPMCCPolicyCpHash:               {"TPM2_PolicyCpHash", 1},
+	tpm2.TPMCCPolicyLocality:             {"TPM2_PolicyLocality", 1},
+	tpm2.TPMCCPolicyNameHash:             {"TPM2_PolicyNameHash", 1},
+	tpm2.TPMCCPolicyOR:                   {"TPM2_PolicyOR", 1},
+	tpm2.TPMCCPolicyTicket:               {"TPM2_PolicyTicket", 1},
+	tpm2.TPMCCReadPublic:                 {"TPM2_ReadPublic", 1},
+	tpm2.TPMCCRSAEncrypt:                 {"TPM2_RSA_Encrypt", 1},
+	tpm2.TPMCCStartAuthSession:           {"TPM2_StartAuthSession", 2},
+	tpm2.TPMCCVerifySignature:            {"TPM2_VerifySignature", 1},
+	tpm2.TPMCCECCParameters:              {"TPM2_ECC_Parameters", 0},
+	tpm2.TPMCCFirmwareRead:               {"TPM2_FirmwareRead", 0},
+	tpm2.TPMCCGetCapability:              {"TPM2_GetCapability", 0},
+	tpm2.TPMCCGetRandom:                  {"TPM2_GetRandom", 0},
+	tpm2.TPMCCGetTestResult:              {"TPM2_GetTestResult", 0},
+	tpm2.TPMCCHash:                       {"TPM2_Hash", 0},
+	tpm2.TPMCCPCRRead:                    {"TPM2_PCR_Read", 0},
+	tpm2.TPMCCPolicyPCR:                  {"TPM2_PolicyPCR", 1},
+	tpm2.TPMCCPolicyRestart:              {"TPM2_PolicyRestart", 1},
+	tpm2.TPMCCReadClock:                  {"TPM2_ReadClock", 0},
+	tpm2.TPMCCPCRExtend:                  {"TPM2_PCR_Extend", 1},
+	tpm2.TPMCCPCRSetAuthValue:            {"TPM2_PCR_SetAuthValue", 1},
+	tpm2.TPMCCNVCertify:                  {"TPM2_NV_Certify", 3},
+	tpm2.TPMCCEventSequenceComplete:      {"TPM2_EventSequenceComplete", 2},
+	tpm2.TPMCCHashSequenceStart:          {"TPM2_HashSequenceStart", 0},
+	tpm2.TPMCCPolicyPhysicalPresence:     {"TPM2_PolicyPhysicalPresence", 1},
+	tpm2.TPMCCPolicyDuplicationSelect:    {"TPM2_PolicyDuplicationSelect", 1},
+	tpm2.TPMCCPolicyGetDigest:            {"TPM2_PolicyGetDigest", 1},
+	tpm2.TPMCCTestParms:                  {"TPM2_TestParms", 0},
+	tpm2.TPMCCCommit:                     {"TPM2_Commit", 1},
+	tpm2.TPMCCPolicyPassword:             {"TPM2_PolicyPassword", 1},
+	tpm2.TPMCCZGen2Phase:                 {"TPM2_ZGen_2Phase", 1},
+	tpm2.TPMCCECEphemeral:                {"TPM2_EC_Ephemeral", 0},
+	tpm2.TPMCCPolicyNvWritten:            {"TPM2_PolicyNvWritten", 1},
+	tpm2.TPMCCPolicyTemplate:             {"TPM2_PolicyTemplate", 1},
+	tpm2.TPMCCCreateLoaded:               {"TPM2_CreateLoaded", 1},
+	tpm2.TPMCCPolicyAuthorizeNV:          {"TPM2_PolicyAuthorizeNV", 3},
+	tpm2.TPMCCEncryptDecrypt2:            {"TPM2_EncryptDecrypt2", 1},
+	tpm2.TPMCCACGetCapability:            {"TPM2_AC_GetCapability", 1},
+	tpm2.TPMCCACSend:                     {"TPM2_AC_Send", 3},
+	tpm2.TPMCCPolicyACSendSelect:         {"TPM2_Policy_AC_SendSelect", 1},
+	tpm2.TPMCCCertifyX509:                {"TPM2_CertifyX509", 2},
+	tpm2.TPMCCACTSetTimeout:              {"TPM2_ACT_SetTimeout", 1},
+}
+
+// TraceTPM logs every command sent to the TPM and its response code.
+type TraceTPM struct {
+	transport.TPMCloser
+}
+
+func NewTraceTPM(tpm transport.TPMCloser) *TraceTPM {
+	return &TraceTPM{TPMCloser: tpm}
+}
+
+// sessionType describes a session handle
+func sessionType(h tpm2.TPMHandle) string {
+	switch {
+	case h == tpm2.TPMRSPW:
+		return "password"
+	case h>>24 == tpm2.TPMHandle(tpm2.TPMHTHMACSession):
+		return fmt.Sprintf("hmac(0x%08x)", uint32(h))
+	case h>>24 == tpm2.TPMHandle(tpm2.TPMHTPolicySession):
+		return fmt.Sprintf("policy(0x%08x)", uint32(h))
+	}
+	return fmt.Sprintf("0x%08x", uint32(h))
+}
+
+func sessionAttrs(a byte) string {
+	var attrs []string
+	for _, f := range []struct {
+		bit  byte
+		name string
+	}{
+		{1 << 0, "continue"},
+		{1 << 5, "decrypt"},
+		{1 << 6, "encrypt"},
+		{1 << 7, "audit"},
+	} {
+		if a&f.bit != 0 {
+			attrs = append(attrs, f.name)
+		}
+	}
+	return strings.Join(attrs, "|")
+}
+
+// commandSessions returns a description of the authorization sessions of the
+// command, or nil if they can't be found.
+func commandSessions(cc tpm2.TPMCC, cmd []byte) []string {
+	c, ok := commands[cc]
+	if !ok || len(cmd) < 10+4*c.handles {
+		return nil
+	}
+	r := bytes.NewReader(cmd[10+4*c.handles:])
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil
+	}
+	var sessions []string
+	for r.Len() > 0 && size > 0 {
+		var h uint32
+		var nonceSize, hmacSize uint16
+		var attrs byte
+		if binary.Read(r, binary.BigEndian, &h) != nil ||
+			binary.Read(r, binary.BigEndian, &nonceSize) != nil {
+			return sessions
+		}
+		r.Seek(int64(nonceSize), 1)
+		if binary.Read(r, binary.BigEndian, &attrs) != nil ||
+			binary.Read(r, binary.BigEndian, &hmacSize) != nil {
+			return sessions
+		}
+		r.Seek(int64(hmacSize), 1)
+		sessions = append(sessions, fmt.Sprintf("%s[%s]", sessionType(tpm2.TPMHandle(h)), sessionAttrs(attrs)))
+		size -= uint32(4 + 2 + int(nonceSize) + 1 + 2 + int(hmacSize))
+	}
+	return sessions
+}
+
+func commandName(cc tpm2.TPMCC) string {
+	if c, ok := commands[cc]; ok {
+		return c.name
+	}
+	return fmt.Sprintf("0x%08x", uint32(cc))
+}
+
+func responseName(rc tpm2.TPMRC) string {
+	if rc == tpm2.TPMRCSuccess {
+		return "TPM_RC_SUCCESS"
+	}
+	return rc.Error()
+}
+
+func (t *TraceTPM) Send(cmd []byte) ([]byte, error) {
+	if len(cmd) < 10 {
+		return t.TPMCloser.Send(cmd)
+	}
+	tag := tpm2.TPMST(binary.BigEndian.Uint16(cmd[0:2]))
+	cc := tpm2.TPMCC(binary.BigEndian.Uint32(cmd[6:10]))
+	name := commandName(cc)
+
+	attrs := []any{slog.String("command", name), slog.Int("size", len(cmd))}
+	if tag == tpm2.TPMSTSessions {
+		attrs = append(attrs, slog.Any("sessions", commandSessions(cc, cmd)))
+	}
+	slog.Info("tpm command", attrs...)
+
+	start := time.Now()
+	rsp, err := t.TPMCloser.Send(cmd)
+	if err != nil {
+		slog.Info("tpm response", slog.String("command", name), slog.String("error", err.Error()))
+		return rsp, err
+	}
+	var rc tpm2.TPMRC
+	if len(rsp) >= 10 {
+		rc = tpm2.TPMRC(binary.BigEndian.Uint32(rsp[6:10]))
+	}
+	slog.Info("tpm response",
+		slog.String("command", name),
+		slog.String("rc", responseName(rc)),
+		slog.Duration("duration", time.Since(start)))
+	return rsp, err
+}
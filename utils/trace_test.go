@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/ssh-tpm-agent/key"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestTraceTPM(t *testing.T) {
+	sim, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	tpm := NewTraceTPM(sim)
+	if _, err := key.NewSSHTPMKey(tpm, tpm2.TPMAlgECC, 256, []byte("")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (tpm2.ReadPublic{ObjectHandle: 0x81000001}).Execute(tpm); err == nil {
+		t.Fatal("expected reading a missing handle to fail")
+	}
+
+	out := buf.String()
+	for _, s := range []string{
+		"command=TPM2_CreatePrimary",
+		"command=TPM2_Create",
+		"rc=TPM_RC_SUCCESS",
+		"hmac(0x02000000)[decrypt|encrypt]",
+		`rc="TPM_RC_HANDLE`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("trace is missing %q:\n%s", s, out)
+		}
+	}
+}
@@ -3,11 +3,15 @@ package utils
 import (
 	"errors"
 	"fmt"
-	"github.com/foxboron/ssh-tpm-agent/contrib"
-	"html/template"
 	"io/fs"
 	"os"
+	"os/user"
 	"path"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/foxboron/ssh-tpm-agent/contrib"
 )
 
 func SSHDir() string {
@@ -19,6 +23,63 @@ func SSHDir() string {
 	return path.Join(dirname, ".ssh")
 }
 
+// StateDir is the directory the agent keeps its state in,
+// $XDG_STATE_HOME/ssh-tpm-agent.
+func StateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return path.Join(dir, "ssh-tpm-agent")
+	}
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		panic("$HOME is not defined")
+	}
+	return path.Join(dirname, ".local", "state", "ssh-tpm-agent")
+}
+
+// RuntimeDir is $XDG_RUNTIME_DIR, or defaultRuntimeDir when it isn't set.
+func RuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return defaultRuntimeDir()
+}
+
+// ExpandSocketPath expands the specifiers in a socket path, like systemd: %t
+// is the RuntimeDir, %u the user name, %U the uid and %% a %.
+func ExpandSocketPath(p string) (string, error) {
+	if !strings.Contains(p, "%") {
+		return p, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] != '%' {
+			b.WriteByte(p[i])
+			continue
+		}
+		i++
+		if i == len(p) {
+			return "", fmt.Errorf("%s: path ends with %%", p)
+		}
+		switch p[i] {
+		case '%':
+			b.WriteByte('%')
+		case 't':
+			b.WriteString(RuntimeDir())
+		case 'U':
+			b.WriteString(strconv.Itoa(os.Getuid()))
+		case 'u':
+			u, err := user.Current()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(u.Username)
+		default:
+			return "", fmt.Errorf("%s: unknown specifier %%%c", p, p[i])
+		}
+	}
+	return b.String(), nil
+}
+
 func FileExists(s string) bool {
 	_, err := os.Stat(s)
 
@@ -41,6 +102,44 @@ func fmtSystemdInstallPath() string {
 	return path.Join(DESTDIR, PREFIX, "lib/systemd")
 }
 
+// UnitOptions configures the agent units written by InstallAgentUnits.
+type UnitOptions struct {
+	// Args are appended to the ExecStart of the service.
+	Args []string
+	// Environment are NAME=value settings of the service.
+	Environment []string
+	// Force replaces existing units instead of leaving them alone.
+	Force bool
+}
+
+// ErrUnitExists is returned when a unit is already installed.
+var ErrUnitExists = errors.New("exists")
+
+// AgentUnitDir is the directory the user units are installed in,
+// $HOME/.config/systemd/user or the system user unit directory if global or
+// when running as root.
+func AgentUnitDir(global bool) (string, error) {
+	if global || os.Getuid() == 0 {
+		return path.Join(fmtSystemdInstallPath(), "/user/"), nil
+	}
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dirname, ".config/systemd/user"), nil
+}
+
+// InstallAgentUnits installs the agent service and socket into
+// AgentUnitDir(global) and returns the directory. Existing units are an
+// ErrUnitExists error unless opts.Force is set.
+func InstallAgentUnits(global bool, opts *UnitOptions) (string, error) {
+	dir, err := AgentUnitDir(global)
+	if err != nil {
+		return "", err
+	}
+	return dir, installUnits(dir, contrib.EmbeddedUserServices(), opts)
+}
+
 // Installs user units to the target system.
 // It will either place the files under $HOME/.config/systemd/user or if global
 // is supplied (through --install-system) into system user directories.
@@ -48,23 +147,43 @@ func fmtSystemdInstallPath() string {
 // Passing the env TEMPLATE_BINARY will use /usr/bin/ssh-tpm-agent for the
 // binary in the service
 func InstallUserUnits(global bool) error {
-	if global || os.Getuid() == 0 { // If ran as root, install global system units
-		return installUnits(path.Join(fmtSystemdInstallPath(), "/user/"), contrib.EmbeddedUserServices())
+	_, err := InstallAgentUnits(global, nil)
+	if errors.Is(err, ErrUnitExists) {
+		fmt.Printf("%v. Not installing units.\n", err)
+		return nil
 	}
+	return err
+}
 
-	dirname, err := os.UserHomeDir()
-	if err != nil {
-		return err
+func InstallHostkeyUnits() error {
+	err := installUnits(path.Join(fmtSystemdInstallPath(), "/system/"), contrib.EmbeddedSystemServices(), nil)
+	if errors.Is(err, ErrUnitExists) {
+		fmt.Printf("%v. Not installing units.\n", err)
+		return nil
 	}
+	return err
+}
 
-	return installUnits(path.Join(dirname, ".config/systemd/user"), contrib.EmbeddedUserServices())
+// systemdQuote quotes s as a single word of a unit setting, escaping the
+// specifiers systemd would expand.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(s) + `"`
 }
 
-func InstallHostkeyUnits() error {
-	return installUnits(path.Join(fmtSystemdInstallPath(), "/system/"), contrib.EmbeddedSystemServices())
+// systemdExecQuote quotes s as a word of ExecStart, which also expands
+// variables.
+func systemdExecQuote(s string) string {
+	return strings.ReplaceAll(systemdQuote(s), "$", "$$")
 }
 
-func installUnits(installPath string, files map[string][]byte) (err error) {
+func installUnits(installPath string, files map[string][]byte, opts *UnitOptions) (err error) {
+	if opts == nil {
+		opts = &UnitOptions{}
+	}
 	execPath := os.Getenv("TEMPLATE_BINARY")
 	if execPath == "" {
 		execPath, err = os.Executable()
@@ -81,13 +200,24 @@ func installUnits(installPath string, files map[string][]byte) (err error) {
 
 	for name := range files {
 		servicePath := path.Join(installPath, name)
-		if FileExists(servicePath) {
-			fmt.Printf("%s exists. Not installing units.\n", servicePath)
-			return nil
+		if FileExists(servicePath) && !opts.Force {
+			return fmt.Errorf("%s %w", servicePath, ErrUnitExists)
 		}
 	}
 
-	for name, data := range files {
+	data := struct {
+		GoBinary    string
+		Args        string
+		Environment []string
+	}{GoBinary: systemdExecQuote(execPath)}
+	for _, arg := range opts.Args {
+		data.Args += " " + systemdExecQuote(arg)
+	}
+	for _, env := range opts.Environment {
+		data.Environment = append(data.Environment, systemdQuote(env))
+	}
+
+	for name, unit := range files {
 		servicePath := path.Join(installPath, name)
 
 		f, err := os.OpenFile(servicePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
@@ -96,10 +226,8 @@ func installUnits(installPath string, files map[string][]byte) (err error) {
 		}
 		defer f.Close()
 
-		t := template.Must(template.New("service").Parse(string(data)))
-		if err = t.Execute(f, &map[string]string{
-			"GoBinary": execPath,
-		}); err != nil {
+		t := template.Must(template.New("service").Parse(string(unit)))
+		if err = t.Execute(f, &data); err != nil {
 			return err
 		}
 
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestInstallAgentUnits(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Setenv("DESTDIR", t.TempDir())
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("TEMPLATE_BINARY", "/usr/bin/ssh-tpm-agent")
+
+	opts := &UnitOptions{
+		Args:        []string{"--key-dir", "/home/user/my keys", "--batch"},
+		Environment: []string{"SSH_TPM_TCTI=device:/dev/tpmrm0", "SSH_ASKPASS=/usr/bin/ask%pass"},
+	}
+	dir, err := InstallAgentUnits(false, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path.Join(dir, "ssh-tpm-agent.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`ExecStart=/usr/bin/ssh-tpm-agent --key-dir "/home/user/my keys" --batch`,
+		`Environment=SSH_TPM_TCTI=device:/dev/tpmrm0`,
+		`Environment=SSH_ASKPASS=/usr/bin/ask%%pass`,
+		`Environment=SSH_TPM_AUTH_SOCK=%t/ssh-tpm-agent.sock`,
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Fatalf("missing %q in service:\n%s", line, b)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "ssh-tpm-agent.socket")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InstallAgentUnits(false, &UnitOptions{}); !errors.Is(err, ErrUnitExists) {
+		t.Fatalf("expected ErrUnitExists, got %v", err)
+	}
+	if _, err := InstallAgentUnits(false, &UnitOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(path.Join(dir, "ssh-tpm-agent.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "ExecStart=/usr/bin/ssh-tpm-agent\n") {
+		t.Fatalf("units weren't replaced:\n%s", b)
+	}
+}
+
+func TestExpandSocketPath(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	uid := strconv.Itoa(os.Getuid())
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path, expanded string
+	}{
+		{"/tmp/agent.sock", "/tmp/agent.sock"},
+		{"%t/ssh-tpm-agent.sock", "/run/user/1000/ssh-tpm-agent.sock"},
+		{"/tmp/ssh-tpm-agent-%U.sock", "/tmp/ssh-tpm-agent-" + uid + ".sock"},
+		{"/tmp/%u/agent.sock", "/tmp/" + u.Username + "/agent.sock"},
+		{"@ssh-tpm-agent/%U", "@ssh-tpm-agent/" + uid},
+		{"/tmp/100%%.sock", "/tmp/100%.sock"},
+	} {
+		p, err := ExpandSocketPath(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != c.expanded {
+			t.Fatalf("%s expanded to %s, expected %s", c.path, p, c.expanded)
+		}
+	}
+	for _, p := range []string{"/tmp/%x.sock", "/tmp/agent%"} {
+		if _, err := ExpandSocketPath(p); err == nil {
+			t.Fatalf("expanded invalid path %s", p)
+		}
+	}
+}
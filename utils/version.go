@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// BuildInfo describes how a binary was built, for bug reports and for tools
+// checking what it supports.
+type BuildInfo struct {
+	Version    string   `json:"version"`
+	Commit     string   `json:"commit,omitempty"`
+	CommitTime string   `json:"commit_time,omitempty"`
+	Modified   bool     `json:"modified,omitempty"`
+	GoVersion  string   `json:"go_version"`
+	Platform   string   `json:"platform"`
+	Features   []string `json:"features"`
+}
+
+// ReadBuildInfo returns the build information of the running binary. version
+// is the version set at build time, the module version is used without it.
+//
+// The features are the TCTIs ("tcti:NAME"), "swtpm" for --swtpm, "relay" for
+// SSH_TPM_RELAY, "cgo" which the pkcs11 module needs, and on Linux "peercred"
+// for abstract sockets and "inotify" for watching the key directories.
+func ReadBuildInfo(version string) *BuildInfo {
+	info := &BuildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	cgo := false
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Commit = s.Value
+			case "vcs.time":
+				info.CommitTime = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			case "CGO_ENABLED":
+				cgo = s.Value == "1"
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "unknown"
+	}
+
+	for _, name := range tctiNames() {
+		info.Features = append(info.Features, "tcti:"+name)
+	}
+	info.Features = append(info.Features, "swtpm", "relay")
+	if cgo {
+		info.Features = append(info.Features, "cgo")
+	}
+	if runtime.GOOS == "linux" {
+		info.Features = append(info.Features, "peercred", "inotify")
+	}
+	return info
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestReadBuildInfo(t *testing.T) {
+	info := ReadBuildInfo("v1.2.3")
+	if info.Version != "v1.2.3" {
+		t.Fatalf("wrong version %q", info.Version)
+	}
+	if info.GoVersion != runtime.Version() || info.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Fatalf("wrong go version or platform: %+v", info)
+	}
+	if !slices.Contains(info.Features, "tcti:swtpm") {
+		t.Fatalf("missing tcti features: %v", info.Features)
+	}
+	if ReadBuildInfo("").Version == "" {
+		t.Fatal("no version without a build time version")
+	}
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// BackupSuffix is appended to the name of the previous version of a file
+// replaced by WriteFileAtomic.
+const BackupSuffix = ".bak"
+
+// WriteFileAtomic replaces the file at path with data, so a crash leaves
+// either the old or the new file and never a partial one. data is written to
+// a temporary file which is synced and renamed over path, then the directory
+// is synced. A different previous file is kept as path.bak.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(path, data, perm, true)
+}
+
+// ReplaceFileAtomic replaces the file at path with data like WriteFileAtomic,
+// without keeping the previous file. A path.bak left by WriteFileAtomic is
+// removed too, for files whose old versions must not stay around, like a key
+// which still works with its old PIN.
+func ReplaceFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := writeFileAtomic(path, data, perm, false); err != nil {
+		return err
+	}
+	if err := os.Remove(path + BackupSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode, backup bool) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if backup {
+		if err := backupFile(path, data); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// backupFile keeps the file at path as path.bak before it is replaced with
+// data, as a hard link where the filesystem supports it.
+func backupFile(path string, data []byte) error {
+	old, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if bytes.Equal(old, data) {
+		return nil
+	}
+	bak := path + BackupSuffix
+	if err := os.Remove(bak); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(path, bak); err == nil {
+		return nil
+	}
+	f, err := os.OpenFile(bak, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(old); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
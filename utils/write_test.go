@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "id_ecdsa.tpm")
+	read := func(p string) string {
+		t.Helper()
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if err := WriteFileAtomic(path, []byte("first"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("unexpected file %v %v", fi, err)
+	}
+	if FileExists(path + BackupSuffix) {
+		t.Fatal("backup of a new file")
+	}
+
+	if err := WriteFileAtomic(path, []byte("second"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(path); got != "second" {
+		t.Fatalf("got %q", got)
+	}
+	if got := read(path + BackupSuffix); got != "first" {
+		t.Fatalf("got backup %q", got)
+	}
+
+	// rewriting the same content keeps the backup
+	if err := WriteFileAtomic(path, []byte("second"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(path + BackupSuffix); got != "first" {
+		t.Fatalf("got backup %q", got)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestReplaceFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "id_ecdsa.tpm")
+	if err := WriteFileAtomic(path, []byte("first"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, []byte("second"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplaceFileAtomic(path, []byte("third"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "third" {
+		t.Fatalf("got %q %v", b, err)
+	}
+	if FileExists(path + BackupSuffix) {
+		t.Fatal("kept a backup of the replaced file")
+	}
+}